@@ -0,0 +1,618 @@
+// Package admin provides an authenticated http api for inspecting and controlling a running server.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	"github.com/Entscheider/sshtool/stats"
+)
+
+// Status describes the state of the server.
+type Status struct {
+	// The time the server has started.
+	Start time.Time
+	// The number of configured users.
+	Users int
+	// The number of active sessions.
+	Sessions int
+	// Whether new connections are rejected.
+	Maintenance bool
+}
+
+// UserStats contains the statistics of a single user.
+type UserStats struct {
+	Username string
+	// The number of active sessions.
+	Sessions int
+	// The bytes read and written by the active sessions.
+	BytesRead    int64
+	BytesWritten int64
+	// The number of files and directories the user has (only known if MaxFiles is used, otherwise -1).
+	Files int64
+	// The maximal number of files and directories of the user. Zero means no limit.
+	MaxFiles int64
+	// The latest successful login of the user, nil if unknown.
+	LastLogin *LastLogin `json:",omitempty"`
+}
+
+// LastLogin describes a successful login of a user.
+type LastLogin struct {
+	Time time.Time
+	// The address the user has connected from.
+	IP string
+	// The fingerprint of the public key the user has logged in with, empty if no key has been used.
+	KeyFingerprint string `json:",omitempty"`
+	// The authentication methods the user has logged in with.
+	Methods []string
+}
+
+// Backend is the server controlled by the api.
+type Backend interface {
+	// Status returns the current state of the server.
+	Status() Status
+	// Sessions returns all active sessions.
+	Sessions() []stats.SessionSnapshot
+	// KillSession terminates the session with the given id. Returns false if there is no such session.
+	KillSession(id uint64) bool
+	// UserStats returns the statistics of every configured user.
+	UserStats() []UserStats
+	// BanList returns the list of banned addresses connections are rejected from.
+	BanList() *BanList
+	// RecentAccess returns the latest entries of the access log, the newest first.
+	RecentAccess() []logger.AccessEntry
+	// SetMaintenance enables or disables the maintenance mode in which new connections are rejected.
+	SetMaintenance(enabled bool)
+}
+
+// UserManager can be implemented by a Backend to allow changing users at runtime.
+// The config of a user is passed as json.
+type UserManager interface {
+	// User returns the config of the given user.
+	User(name string) (interface{}, bool)
+	// UpdateUser sets the config of the given user. If replace is false, only the fields of the given config
+	// are changed and the user must exist already.
+	UpdateUser(name string, config json.RawMessage, replace bool) error
+	// DeleteUser removes the given user. Returns false if there is no such user.
+	DeleteUser(name string) (bool, error)
+}
+
+// MountManager can be implemented by a Backend to allow changing the directories served to a user at runtime.
+// Connected users see the changes immediately.
+type MountManager interface {
+	// Mounts returns the configs of the directories served to the given user by their name.
+	Mounts(user string) (interface{}, bool)
+	// Mount serves a directory with the json encoded config under the given name to the user.
+	Mount(user string, name string, config json.RawMessage) error
+	// Unmount stops serving the directory with the given name to the user. Returns false if there is no such directory.
+	Unmount(user string, name string) (bool, error)
+}
+
+// MountFreezer can be implemented by a Backend to make a directory of a user read-only at runtime under
+// /api/users/<name>/freeze?mount=<mount>.
+type MountFreezer interface {
+	// FreezeMount freezes the directory with the given name of the user until it is thawed with frozen set to
+	// false. Returns false if there is no such directory.
+	FreezeMount(user string, name string, frozen bool) bool
+	// MountFreeze returns whether the directory is frozen. Returns false if there is no such directory.
+	MountFreeze(user string, name string) (FreezeState, bool)
+}
+
+// FreezeState tells whether a directory is frozen.
+type FreezeState struct {
+	// Whether the directory is read-only at the moment, on demand or due to its schedule.
+	Frozen bool
+	// Whether the directory has been frozen on demand.
+	Manual bool
+}
+
+// SizeReporter can be implemented by a Backend to compute the size of the directories of a user under
+// /api/users/<name>/size.
+type SizeReporter interface {
+	// TreeSize returns the size of everything below the path of the filesystem served to the user.
+	TreeSize(user string, path string) (interface{}, error)
+}
+
+// Archiver can be implemented by a Backend to download the directories of a user as tar.gz under
+// /api/users/<name>/tar.
+type Archiver interface {
+	// Archive returns everything below the path of the filesystem served to the user as tar.gz, which is
+	// generated while it is read.
+	Archive(user string, path string) (io.ReadCloser, error)
+}
+
+// EventSource can be implemented by a Backend to stream the events of the server under /api/events.
+type EventSource interface {
+	// Events returns the bus all events of the server are published to.
+	Events() *events.Bus
+}
+
+// LogSource can be implemented by a Backend to stream the entries of its Logger and AccessLogger under /api/logs.
+type LogSource interface {
+	// Logs returns the stream all log entries of the server are passed to.
+	Logs() *logger.Stream
+}
+
+// The number of events or log entries buffered for a slow client of a stream. Further ones are dropped.
+const eventBuffer = 64
+
+// ErrNoSuchUser is returned by a UserManager if the user to change does not exist.
+var ErrNoSuchUser = fmt.Errorf("no such user")
+
+// Server serves the admin api for a Backend.
+type Server struct {
+	Backend Backend
+	// Every request has to send this token as "Authorization: Bearer <token>".
+	Token string
+	// If set, the api is served over https with this config by ListenAndServe.
+	TLSConfig *tls.Config
+}
+
+// banRequest is the body for banning an address.
+type banRequest struct {
+	IP     string
+	Reason string
+	// The duration of the ban like "1h". Empty for a permanent ban.
+	Duration string
+}
+
+// maintenanceRequest is the body for changing the maintenance mode.
+type maintenanceRequest struct {
+	Enabled bool
+}
+
+// Writes v as json answer.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+// Checks the bearer token of the request.
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// Handler returns the http handler serving the api under /api and the dashboard under /.
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Backend.Status())
+	})
+	api.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Backend.UserStats())
+	})
+	api.HandleFunc("/api/users/", s.handleUser)
+	api.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Backend.Sessions())
+	})
+	api.HandleFunc("/api/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		if !s.Backend.KillSession(id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	api.HandleFunc("/api/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, s.Backend.BanList().Bans())
+		case http.MethodPost:
+			var request banRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.IP == "" {
+				http.Error(w, "invalid ban", http.StatusBadRequest)
+				return
+			}
+			var duration time.Duration
+			if request.Duration != "" {
+				var err error
+				if duration, err = time.ParseDuration(request.Duration); err != nil {
+					http.Error(w, "invalid duration", http.StatusBadRequest)
+					return
+				}
+			}
+			writeJSON(w, s.Backend.BanList().Ban(request.IP, duration, request.Reason))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	api.HandleFunc("/api/bans/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.Backend.BanList().Unban(strings.TrimPrefix(r.URL.Path, "/api/bans/")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	api.HandleFunc("/api/access", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Backend.RecentAccess())
+	})
+	api.HandleFunc("/api/events", s.handleEvents)
+	api.HandleFunc("/api/logs", s.handleLogs)
+	api.HandleFunc("/api/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var request maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		s.Backend.SetMaintenance(request.Enabled)
+		writeJSON(w, s.Backend.Status())
+	})
+	root := http.NewServeMux()
+	// The dashboard itself contains no data, it asks for the token and uses the api.
+	root.Handle("/", http.FileServer(http.FS(dashboardFiles())))
+	root.Handle("/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	return root
+}
+
+// Returns the set of the values of the query parameter. An empty set means no restriction.
+func queryValues(r *http.Request, name string) map[string]bool {
+	values := make(map[string]bool)
+	for _, value := range r.URL.Query()[name] {
+		values[value] = true
+	}
+	return values
+}
+
+// Sends everything passed to the function given to subscribe as server-sent event until the client disconnects.
+// kind returns the name of the event for an item.
+func serveStream[T any](w http.ResponseWriter, r *http.Request, subscribe func(func(T)) func(), kind func(T) string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	pending := make(chan T, eventBuffer)
+	unsubscribe := subscribe(func(item T) {
+		select {
+		case pending <- item:
+		default:
+		}
+	})
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case item := <-pending:
+			data, err := json.Marshal(item)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind(item), data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Streams the events of the server as server-sent events. The events can be restricted to some types with the
+// type query parameter (e.g. "?type=file_changed&type=virus_found") and to a user with the user parameter.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.Backend.(EventSource)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	types := queryValues(r, "type")
+	user := r.URL.Query().Get("user")
+	subscribe := func(send func(events.Event)) func() {
+		return source.Events().Subscribe(func(e events.Event) {
+			if (len(types) > 0 && !types[e.Type]) || (user != "" && e.Username != user) {
+				return
+			}
+			send(e)
+		})
+	}
+	serveStream(w, r, subscribe, func(e events.Event) string { return e.Type })
+}
+
+// Streams the entries of the Logger and the AccessLogger as server-sent events. The entries can be restricted to
+// some levels (e.g. "?level=warn&level=error"), tags and to a user with the query parameters level, tag and user.
+// Entries of the Logger have no user, so only access entries are sent if the user is restricted.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.Backend.(LogSource)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	levels := queryValues(r, "level")
+	tags := queryValues(r, "tag")
+	user := r.URL.Query().Get("user")
+	subscribe := func(send func(logger.StreamEntry)) func() {
+		return source.Logs().Subscribe(func(e logger.StreamEntry) {
+			if (len(levels) > 0 && !levels[e.Level]) || (len(tags) > 0 && !tags[e.Tag]) || (user != "" && e.Username != user) {
+				return
+			}
+			send(e)
+		})
+	}
+	serveStream(w, r, subscribe, func(e logger.StreamEntry) string { return e.Level })
+}
+
+// Handles the requests for reading and changing a single user under /api/users/<name>.
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	manager, ok := s.Backend.(UserManager)
+	if !ok {
+		http.Error(w, "changing users is not supported", http.StatusNotImplemented)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if user, ok := strings.CutSuffix(name, "/size"); ok {
+		s.handleSize(w, r, user)
+		return
+	}
+	if user, ok := strings.CutSuffix(name, "/tar"); ok {
+		s.handleTar(w, r, user)
+		return
+	}
+	if user, ok := strings.CutSuffix(name, "/freeze"); ok {
+		s.handleFreeze(w, r, user)
+		return
+	}
+	if i := strings.Index(name, "/mounts"); i >= 0 {
+		s.handleMounts(w, r, name[:i], strings.TrimPrefix(name[i+len("/mounts"):], "/"))
+		return
+	}
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		user, ok := manager.User(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, user)
+	case http.MethodPut, http.MethodPatch:
+		var config json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, "invalid user config", http.StatusBadRequest)
+			return
+		}
+		err := manager.UpdateUser(name, config, r.Method == http.MethodPut)
+		if err == ErrNoSuchUser {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, _ := manager.User(name)
+		writeJSON(w, user)
+	case http.MethodDelete:
+		found, err := manager.DeleteUser(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Answers the size of a directory of the user, whose path is given by the path query parameter (the root by default).
+func (s *Server) handleSize(w http.ResponseWriter, r *http.Request, user string) {
+	reporter, ok := s.Backend.(SizeReporter)
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	size, err := reporter.TreeSize(user, path)
+	if err == ErrNoSuchUser || errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, size)
+}
+
+// Handles the requests for downloading a directory of a user under /api/users/<name>/tar?path=<path>.
+func (s *Server) handleTar(w http.ResponseWriter, r *http.Request, user string) {
+	archiver, ok := s.Backend.(Archiver)
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	dir := r.URL.Query().Get("path")
+	if dir == "" {
+		dir = "/"
+	}
+	archive, err := archiver.Archive(user, dir)
+	if err == ErrNoSuchUser || errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+	name := path.Base(path.Clean("/" + dir))
+	if name == "/" {
+		name = user
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".tar.gz"}))
+	// The status has been sent already, so an error can only cut the archive off.
+	_, _ = io.Copy(w, archive)
+}
+
+// Handles the requests for the directories served to a user under /api/users/<user>/mounts/<name>.
+func (s *Server) handleMounts(w http.ResponseWriter, r *http.Request, user string, name string) {
+	manager, ok := s.Backend.(MountManager)
+	if !ok {
+		http.Error(w, "changing mounts is not supported", http.StatusNotImplemented)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		mounts, ok := manager.Mounts(user)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, mounts)
+	case r.Method == http.MethodPut && name != "":
+		var config json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, "invalid mount config", http.StatusBadRequest)
+			return
+		}
+		err := manager.Mount(user, name, config)
+		if err == ErrNoSuchUser {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && name != "":
+		found, err := manager.Unmount(user, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Freezes (PUT) or thaws (DELETE) a directory of the user, whose name is given by the mount query parameter
+// (the only directory without a name by default), and answers whether it is frozen.
+func (s *Server) handleFreeze(w http.ResponseWriter, r *http.Request, user string) {
+	freezer, ok := s.Backend.(MountFreezer)
+	if !ok {
+		http.Error(w, "freezing mounts is not supported", http.StatusNotImplemented)
+		return
+	}
+	name := r.URL.Query().Get("mount")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodDelete:
+		if !freezer.FreezeMount(user, name, r.Method == http.MethodPut) {
+			http.NotFound(w, r)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state, ok := freezer.MountFreeze(user, name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, state)
+}
+
+// Listen creates the listener for the given address. Addresses starting with "unix:" are the path of
+// a unix socket, all others are tcp addresses like "localhost:9200".
+func Listen(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		// Remove the socket left by a previous run.
+		_ = os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Only the owner of the server may connect.
+		if err := os.Chmod(path, 0600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// ListenAndServe serves the api at the given address (see Listen) until the context is done.
+func (s *Server) ListenAndServe(ctx context.Context, address string) error {
+	if s.Token == "" {
+		return fmt.Errorf("the admin api needs a token")
+	}
+	listener, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	server := &http.Server{Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	err = server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
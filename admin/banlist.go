@@ -0,0 +1,159 @@
+package admin
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban describes a banned ip address.
+type Ban struct {
+	IP string
+	// Why this address has been banned.
+	Reason string
+	// The time the ban ends. A zero time means the ban never ends.
+	Until time.Time
+}
+
+// Checks whether the ban has ended at the given time.
+func (b Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && now.After(b.Until)
+}
+
+// BanStore keeps bans outside the process, so several servers share the same bans.
+type BanStore interface {
+	// Put adds or replaces the ban of its address.
+	Put(ban Ban) error
+	// Remove removes the ban of the given address. Returns false if it wasn't banned.
+	Remove(ip string) (bool, error)
+	// Get returns the ban of the given address if it is banned.
+	Get(ip string) (Ban, bool, error)
+	// All returns all bans.
+	All() ([]Ban, error)
+}
+
+// BanList is a thread-safe list of banned ip addresses.
+type BanList struct {
+	mutex sync.Mutex
+	bans  map[string]Ban
+	// The shared bans. If nil, the bans are only kept in this process.
+	store BanStore
+	// Called with errors of the store, which are otherwise ignored. May be nil.
+	onError func(err error)
+}
+
+// NewBanList creates an empty BanList.
+func NewBanList() *BanList {
+	return &BanList{bans: map[string]Ban{}}
+}
+
+// NewSharedBanList creates a BanList that keeps its bans in the store. If the store fails, the bans of this
+// process are used instead and the error is passed to onError (if not nil).
+func NewSharedBanList(store BanStore, onError func(err error)) *BanList {
+	return &BanList{bans: map[string]Ban{}, store: store, onError: onError}
+}
+
+// Reports an error of the store.
+func (l *BanList) storeFailed(err error) {
+	if l.onError != nil {
+		l.onError(err)
+	}
+}
+
+// Normalizes an ip address, so different notations of the same address are found.
+// Addresses with a port (like "1.2.3.4:22") are accepted as well.
+func normalizeIP(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// Ban bans the given address for the given duration. A duration of zero bans it forever.
+func (l *BanList) Ban(ip string, duration time.Duration, reason string) Ban {
+	ban := Ban{IP: normalizeIP(ip), Reason: reason}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration)
+	}
+	if l.store != nil {
+		if err := l.store.Put(ban); err != nil {
+			l.storeFailed(err)
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bans[ban.IP] = ban
+	return ban
+}
+
+// Unban removes the ban of the given address. Returns false if it wasn't banned.
+func (l *BanList) Unban(ip string) bool {
+	ip = normalizeIP(ip)
+	l.mutex.Lock()
+	_, ok := l.bans[ip]
+	delete(l.bans, ip)
+	l.mutex.Unlock()
+	if l.store != nil {
+		removed, err := l.store.Remove(ip)
+		if err != nil {
+			l.storeFailed(err)
+		}
+		ok = ok || removed
+	}
+	return ok
+}
+
+// IsBanned checks whether the given address (optionally with a port) is currently banned.
+func (l *BanList) IsBanned(ip string) bool {
+	ip = normalizeIP(ip)
+	if l.store != nil {
+		ban, ok, err := l.store.Get(ip)
+		if err == nil {
+			return ok && !ban.expired(time.Now())
+		}
+		l.storeFailed(err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ban, ok := l.bans[ip]
+	if ok && ban.expired(time.Now()) {
+		delete(l.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// Bans returns all current bans ordered by their address.
+func (l *BanList) Bans() []Ban {
+	now := time.Now()
+	if l.store != nil {
+		bans, err := l.store.All()
+		if err == nil {
+			result := make([]Ban, 0, len(bans))
+			for _, ban := range bans {
+				if !ban.expired(now) {
+					result = append(result, ban)
+				}
+			}
+			sort.Slice(result, func(i, j int) bool { return result[i].IP < result[j].IP })
+			return result
+		}
+		l.storeFailed(err)
+	}
+	l.mutex.Lock()
+	result := make([]Ban, 0, len(l.bans))
+	for ip, ban := range l.bans {
+		if ban.expired(now) {
+			delete(l.bans, ip)
+			continue
+		}
+		result = append(result, ban)
+	}
+	l.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].IP < result[j].IP })
+	return result
+}
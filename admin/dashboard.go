@@ -0,0 +1,19 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed dashboard
+var dashboard embed.FS
+
+// Returns the files of the dashboard with index.html at the root.
+func dashboardFiles() fs.FS {
+	files, err := fs.Sub(dashboard, "dashboard")
+	if err != nil {
+		// Cannot happen as the directory is embedded.
+		panic(err)
+	}
+	return files
+}
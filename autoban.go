@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/admin"
+)
+
+// The defaults of the AutoBanConfig.
+const (
+	defaultAutoBanWindow   = 10 * time.Minute
+	defaultAutoBanDuration = time.Hour
+)
+
+// AutoBanConfig bans addresses for a while after too many failed logins, like fail2ban does.
+type AutoBanConfig struct {
+	// The number of failed logins within the Window after which the address is banned. Every failed connection
+	// counts as well as every wrong password or code. Zero disables the bans.
+	MaxFailures int
+	// The time (e.g. "10m") within which the failures are counted. Defaults to 10m.
+	Window string
+	// How long (e.g. "1h") the address is banned. Defaults to 1h.
+	Duration string
+}
+
+// validate checks the settings for values that are not supported.
+func (c AutoBanConfig) validate() error {
+	if c.MaxFailures < 0 {
+		return fmt.Errorf("the AutoBan MaxFailures must not be negative")
+	}
+	if c.Window != "" {
+		if window, err := time.ParseDuration(c.Window); err != nil || window <= 0 {
+			return fmt.Errorf("invalid AutoBan Window %q", c.Window)
+		}
+	}
+	if c.Duration != "" {
+		if duration, err := time.ParseDuration(c.Duration); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid AutoBan Duration %q", c.Duration)
+		}
+	}
+	return nil
+}
+
+// failureLog counts the recent failures of every address.
+type failureLog struct {
+	// Failures older than this are forgotten.
+	window time.Duration
+	// The number of failures from which an address has failed too often.
+	threshold int
+	// Protects the fields below
+	mutex sync.Mutex
+	// The times of the recent failures of every address.
+	failures map[string][]time.Time
+	// The last time expired failures have been removed from the map.
+	lastCleanup time.Time
+}
+
+func newFailureLog(window time.Duration, threshold int) *failureLog {
+	return &failureLog{window: window, threshold: threshold, failures: map[string][]time.Time{}}
+}
+
+// Returns the failures of the list that have not expired yet.
+func (l *failureLog) recent(failures []time.Time, now time.Time) []time.Time {
+	for len(failures) > 0 && now.Sub(failures[0]) > l.window {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// record remembers a failure of the address. Returns whether it has failed too often now.
+func (l *failureLog) record(addr string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > time.Minute {
+		// Otherwise, the addresses of scanners that never return are kept forever.
+		for ip, failures := range l.failures {
+			if len(l.recent(failures, now)) == 0 {
+				delete(l.failures, ip)
+			}
+		}
+		l.lastCleanup = now
+	}
+	ip := hostOf(addr)
+	failures := l.recent(l.failures[ip], now)
+	if len(failures) < l.threshold {
+		// There is no need to remember more.
+		failures = append(failures, now)
+	}
+	l.failures[ip] = failures
+	return len(failures) >= l.threshold
+}
+
+// exceeded returns whether the address has failed too often recently.
+func (l *failureLog) exceeded(addr string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.recent(l.failures[hostOf(addr)], time.Now())) >= l.threshold
+}
+
+// forget removes the failures of the address.
+func (l *failureLog) forget(addr string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, hostOf(addr))
+}
+
+// autoBan bans the addresses with too many failed logins.
+type autoBan struct {
+	failures *failureLog
+	duration time.Duration
+	bans     *admin.BanList
+}
+
+// newAutoBan creates the automatic bans of the config, which are added to the list. Returns nil if they are
+// disabled.
+func (c AutoBanConfig) newAutoBan(bans *admin.BanList) *autoBan {
+	if c.MaxFailures == 0 {
+		return nil
+	}
+	// The config has been validated before, so we can ignore the errors here.
+	window := defaultAutoBanWindow
+	if c.Window != "" {
+		window, _ = time.ParseDuration(c.Window)
+	}
+	duration := defaultAutoBanDuration
+	if c.Duration != "" {
+		duration, _ = time.ParseDuration(c.Duration)
+	}
+	return &autoBan{failures: newFailureLog(window, c.MaxFailures), duration: duration, bans: bans}
+}
+
+// recordFailure counts a failed login from the address and bans it once it has failed too often. Returns the
+// ban if it has been banned now. Does nothing if a is nil.
+func (a *autoBan) recordFailure(addr string) (admin.Ban, bool) {
+	if a == nil || !a.failures.record(addr) {
+		return admin.Ban{}, false
+	}
+	// The failures would ban it again right after the ban has ended.
+	a.failures.forget(addr)
+	reason := fmt.Sprintf("%d failed logins within %s", a.failures.threshold, a.failures.window)
+	return a.bans.Ban(addr, a.duration, reason), true
+}
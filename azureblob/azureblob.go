@@ -0,0 +1,314 @@
+// Package azureblob provides an [sftp.ObjectStore] for a container of the Azure Blob Storage using its rest api.
+package azureblob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/sftp"
+)
+
+// The version of the rest api used.
+const apiVersion = "2020-10-02"
+
+// How often the state of a pending copy is checked.
+const copyPollInterval = time.Second
+
+// Store is an [sftp.ObjectStore] for a single container.
+type Store struct {
+	// The name of the storage account.
+	Account string
+	// The name of the container.
+	Container string
+	// The base64 encoded access key of the account. Either this or SASToken is needed.
+	AccountKey string
+	// A shared access signature (the query string of a SAS url) allowing access to the container.
+	SASToken string
+	// The url of the service. Defaults to "https://<Account>.blob.core.windows.net".
+	Endpoint string
+	Client   *http.Client
+}
+
+// Returns the url of the given blob (or the container if empty).
+func (s *Store) url(blob string, query url.Values) string {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.Account)
+	}
+	u := endpoint + "/" + s.Container
+	if blob != "" {
+		u += "/" + (&url.URL{Path: blob}).EscapedPath()
+	}
+	encoded := query.Encode()
+	if s.SASToken != "" {
+		if encoded != "" {
+			encoded += "&"
+		}
+		encoded += strings.TrimPrefix(s.SASToken, "?")
+	}
+	if encoded != "" {
+		u += "?" + encoded
+	}
+	return u
+}
+
+// Signs the request with the shared key of the account.
+func (s *Store) sign(request *http.Request, query url.Values) error {
+	key, err := base64.StdEncoding.DecodeString(s.AccountKey)
+	if err != nil {
+		return fmt.Errorf("invalid AccountKey: %v", err)
+	}
+	var headers []string
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			headers = append(headers, lower)
+		}
+	}
+	sort.Strings(headers)
+	var canonical strings.Builder
+	length := ""
+	if request.ContentLength > 0 {
+		length = strconv.FormatInt(request.ContentLength, 10)
+	}
+	// The empty lines are headers we do not send.
+	fmt.Fprintf(&canonical, "%s\n\n\n%s\n\n%s\n\n\n\n\n\n\n", request.Method, length, request.Header.Get("Content-Type"))
+	for _, name := range headers {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, strings.TrimSpace(request.Header.Get(name)))
+	}
+	fmt.Fprintf(&canonical, "/%s%s", s.Account, request.URL.EscapedPath())
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		fmt.Fprintf(&canonical, "\n%s:%s", strings.ToLower(name), strings.Join(values, ","))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canonical.String()))
+	request.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", s.Account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return nil
+}
+
+// contextStore makes the requests of a Store with a context.
+type contextStore struct {
+	*Store
+	ctx context.Context
+}
+
+// WithContext returns the store making its requests with ctx (see [sftp.ContextObjectStore]).
+func (s *Store) WithContext(ctx context.Context) sftp.ObjectStore {
+	return contextStore{Store: s, ctx: ctx}
+}
+
+func (s *Store) List(prefix string, max int) ([]sftp.ObjectInfo, []string, error) {
+	return contextStore{Store: s, ctx: context.Background()}.List(prefix, max)
+}
+
+func (s *Store) Stat(key string) (sftp.ObjectInfo, error) {
+	return contextStore{Store: s, ctx: context.Background()}.Stat(key)
+}
+
+func (s *Store) ReadAt(key string, p []byte, off int64) (int, error) {
+	return contextStore{Store: s, ctx: context.Background()}.ReadAt(key, p, off)
+}
+
+func (s *Store) Put(key string, content io.Reader, size int64) error {
+	return contextStore{Store: s, ctx: context.Background()}.Put(key, content, size)
+}
+
+func (s *Store) Copy(src, dst string) error {
+	return contextStore{Store: s, ctx: context.Background()}.Copy(src, dst)
+}
+
+func (s *Store) Delete(key string) error {
+	return contextStore{Store: s, ctx: context.Background()}.Delete(key)
+}
+
+// Sends a request for the blob and checks the status. A 404 is returned as [os.ErrNotExist].
+func (s contextStore) do(method string, blob string, query url.Values, headers map[string]string, body io.Reader, size int64) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(s.ctx, method, s.url(blob, query), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+		if size == 0 {
+			// Otherwise, no Content-Length header is sent.
+			request.Body = http.NoBody
+		}
+	}
+	request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("x-ms-version", apiVersion)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	if s.SASToken == "" {
+		if err := s.sign(request, query); err != nil {
+			return nil, err
+		}
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("azure blob storage: %s %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// listResult is the answer of the List Blobs operation.
+type listResult struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string
+			Properties struct {
+				ContentLength int64  `xml:"Content-Length"`
+				LastModified  string `xml:"Last-Modified"`
+			}
+		}
+		BlobPrefix []struct {
+			Name string
+		}
+	}
+	NextMarker string
+}
+
+func (s contextStore) List(prefix string, max int) ([]sftp.ObjectInfo, []string, error) {
+	var objects []sftp.ObjectInfo
+	var prefixes []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "delimiter": {"/"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		if max > 0 {
+			query.Set("maxresults", strconv.Itoa(max))
+		}
+		response, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, blob := range result.Blobs.Blob {
+			modified, _ := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			objects = append(objects, sftp.ObjectInfo{Key: blob.Name, Size: blob.Properties.ContentLength, Modified: modified})
+		}
+		for _, blobPrefix := range result.Blobs.BlobPrefix {
+			prefixes = append(prefixes, blobPrefix.Name)
+		}
+		marker = result.NextMarker
+		if marker == "" || (max > 0 && len(objects)+len(prefixes) >= max) {
+			return objects, prefixes, nil
+		}
+	}
+}
+
+// Reads the info of a blob from the headers of a response.
+func objectInfo(key string, header http.Header) sftp.ObjectInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	modified, _ := time.Parse(http.TimeFormat, header.Get("Last-Modified"))
+	return sftp.ObjectInfo{Key: key, Size: size, Modified: modified}
+}
+
+func (s contextStore) Stat(key string) (sftp.ObjectInfo, error) {
+	response, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return sftp.ObjectInfo{}, err
+	}
+	_ = response.Body.Close()
+	return objectInfo(key, response.Header), nil
+}
+
+func (s contextStore) ReadAt(key string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)
+	response, err := s.do(http.MethodGet, key, nil, map[string]string{"x-ms-range": rangeHeader}, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	n, err := io.ReadFull(response.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s contextStore) Put(key string, content io.Reader, size int64) error {
+	response, err := s.do(http.MethodPut, key, nil, map[string]string{"x-ms-blob-type": "BlockBlob"}, content, size)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (s contextStore) Copy(src, dst string) error {
+	response, err := s.do(http.MethodPut, dst, nil, map[string]string{"x-ms-copy-source": s.url(src, nil)}, nil, 0)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	status := response.Header.Get("x-ms-copy-status")
+	// Copies within an account usually finish immediately, otherwise we wait for it.
+	for status == "pending" {
+		select {
+		case <-time.After(copyPollInterval):
+		case <-s.ctx.Done():
+			return fmt.Errorf("azure blob storage: copying %s: %w", src, s.ctx.Err())
+		}
+		response, err := s.do(http.MethodHead, dst, nil, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+		status = response.Header.Get("x-ms-copy-status")
+	}
+	if status != "success" {
+		return fmt.Errorf("azure blob storage: copying %s failed with status %s", src, status)
+	}
+	return nil
+}
+
+func (s contextStore) Delete(key string) error {
+	response, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
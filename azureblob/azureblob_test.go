@@ -0,0 +1,216 @@
+package azureblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The standard headers of the string to sign in their order (Shared Key authorization of the Blob service).
+var signedHeaders = []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-MD5", "Content-Type",
+	"Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"}
+
+// Returns the string a request of the account is signed with, as the service computes it.
+func stringToSign(request *http.Request, account string) string {
+	lines := []string{request.Method}
+	for _, name := range signedHeaders {
+		value := request.Header.Get(name)
+		if name == "Content-Length" {
+			// Empty for no content since version 2015-02-21.
+			value = ""
+			if request.ContentLength > 0 {
+				value = strconv.FormatInt(request.ContentLength, 10)
+			}
+		}
+		lines = append(lines, value)
+	}
+	var names []string
+	for name := range request.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, name+":"+request.Header.Get(name))
+	}
+	resource := "/" + account + request.URL.EscapedPath()
+	query := request.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	return strings.Join(lines, "\n") + "\n" + resource
+}
+
+// fakeContainer is a container "files" of the account "account" whose access key is key. A request must either
+// be signed with it or have the shared access signature sas.
+type fakeContainer struct {
+	key   []byte
+	sas   string
+	mutex sync.Mutex
+	blobs map[string][]byte
+}
+
+func (f *fakeContainer) authorized(request *http.Request) bool {
+	if f.sas != "" {
+		return request.URL.Query().Get("sig") == f.sas && request.Header.Get("Authorization") == ""
+	}
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(stringToSign(request, "account")))
+	want := "SharedKey account:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return request.Header.Get("Authorization") == want && request.Header.Get("x-ms-version") == apiVersion &&
+		request.Header.Get("x-ms-date") != ""
+}
+
+func (f *fakeContainer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if !f.authorized(request) {
+		http.Error(w, "AuthenticationFailed", http.StatusForbidden)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name, ok := strings.CutPrefix(request.URL.Path, "/files/")
+	if request.URL.Path == "/files" && request.URL.Query().Get("comp") == "list" {
+		// Without delimiter and paging, which List does not need here.
+		var list strings.Builder
+		list.WriteString("<EnumerationResults><Blobs>")
+		for key, data := range f.blobs {
+			if strings.HasPrefix(key, request.URL.Query().Get("prefix")) {
+				list.WriteString("<Blob><Name>")
+				_ = xml.EscapeText(&list, []byte(key))
+				list.WriteString("</Name><Properties><Content-Length>" + strconv.Itoa(len(data)) +
+					"</Content-Length></Properties></Blob>")
+			}
+		}
+		list.WriteString("</Blobs><NextMarker/></EnumerationResults>")
+		_, _ = io.WriteString(w, list.String())
+		return
+	}
+	if !ok {
+		http.Error(w, "InvalidUri", http.StatusBadRequest)
+		return
+	}
+	switch request.Method {
+	case http.MethodPut:
+		if source := request.Header.Get("x-ms-copy-source"); source != "" {
+			parsed, _ := url.Parse(source)
+			data, ok := f.blobs[strings.TrimPrefix(parsed.Path, "/files/")]
+			if !ok {
+				http.Error(w, "CannotVerifyCopySource", http.StatusNotFound)
+				return
+			}
+			f.blobs[name] = data
+			w.Header().Set("x-ms-copy-status", "success")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if request.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "MissingRequiredHeader", http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(request.Body)
+		f.blobs[name] = data
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.blobs[name]
+		if !ok {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		if bounds, ok := strings.CutPrefix(request.Header.Get("x-ms-range"), "bytes="); ok {
+			first, last, _ := strings.Cut(bounds, "-")
+			start, _ := strconv.Atoi(first)
+			end, _ := strconv.Atoi(last)
+			data = data[start:min(end+1, len(data))]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func newTestStore(t *testing.T, sas string) (*Store, *fakeContainer) {
+	container := &fakeContainer{key: []byte("account key"), sas: sas, blobs: map[string][]byte{}}
+	server := httptest.NewServer(container)
+	t.Cleanup(server.Close)
+	store := &Store{Account: "account", Container: "files", Endpoint: server.URL}
+	if sas == "" {
+		store.AccountKey = base64.StdEncoding.EncodeToString(container.key)
+	} else {
+		store.SASToken = "?sv=2020-10-02&sig=" + sas
+	}
+	return store, container
+}
+
+func TestStore(t *testing.T) {
+	for _, sas := range []string{"", "signature"} {
+		store, _ := newTestStore(t, sas)
+		// Names that need escaping in the path.
+		key := "dir/a file+ü.txt"
+		if err := store.Put(key, strings.NewReader("hello world"), 11); err != nil {
+			t.Fatalf("Put() = %v", err)
+		}
+		if err := store.Put("dir/empty", strings.NewReader(""), 0); err != nil {
+			t.Fatalf("Put() of an empty blob = %v", err)
+		}
+		if info, err := store.Stat(key); err != nil || info.Size != 11 || info.Key != key {
+			t.Errorf("Stat() = %v, %v", info, err)
+		}
+		p := make([]byte, 5)
+		if n, err := store.ReadAt(key, p, 6); err != nil || string(p[:n]) != "world" {
+			t.Errorf("ReadAt() = %q, %v", p[:n], err)
+		}
+		if err := store.Copy(key, "copy"); err != nil {
+			t.Errorf("Copy() = %v", err)
+		}
+		objects, _, err := store.List("dir/", 0)
+		if err != nil || len(objects) != 2 {
+			t.Errorf("List() = %v, %v", objects, err)
+		}
+		if err := store.Delete(key); err != nil {
+			t.Errorf("Delete() = %v", err)
+		}
+		if _, err := store.Stat(key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat() after Delete() = %v, want %v", err, os.ErrNotExist)
+		}
+	}
+}
+
+func TestStoreWrongKey(t *testing.T) {
+	store, _ := newTestStore(t, "")
+	store.AccountKey = base64.StdEncoding.EncodeToString([]byte("wrong key"))
+	if err := store.Put("a", strings.NewReader("a"), 1); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put() with a wrong key = %v", err)
+	}
+	store.AccountKey = "not base64"
+	if _, err := store.Stat("a"); err == nil || !strings.Contains(err.Error(), "AccountKey") {
+		t.Errorf("Stat() with an invalid key = %v", err)
+	}
+}
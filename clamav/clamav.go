@@ -0,0 +1,95 @@
+// Package clamav implements a client for scanning data with the clamd daemon of ClamAV.
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The size of the chunks the data is sent in.
+const chunkSize = 64 * 1024
+
+// Client connects to clamd for every scan.
+type Client struct {
+	// The address of clamd. Addresses starting with "unix:" are the path of a unix socket,
+	// all others are tcp addresses like "localhost:3310".
+	Address string
+	// The time a single scan may take. Zero means no limit.
+	Timeout time.Duration
+}
+
+// Result is the result of a scan.
+type Result struct {
+	Infected bool
+	// The name of the found virus if infected.
+	Signature string
+}
+
+// Connects to clamd.
+func (c Client) dial() (net.Conn, error) {
+	if path := strings.TrimPrefix(c.Address, "unix:"); path != c.Address {
+		return net.Dial("unix", path)
+	}
+	return net.Dial("tcp", c.Address)
+}
+
+// Scan sends all data of the reader to clamd and returns whether it is infected.
+func (c Client) Scan(reader io.Reader) (Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(c.Timeout)); err != nil {
+			return Result{}, err
+		}
+	}
+	// The "z" prefix means that commands and answers are terminated by a null byte.
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+	// Every chunk is prefixed by its length. A chunk with length zero ends the stream.
+	buffer := make([]byte, 4+chunkSize)
+	for {
+		n, err := reader.Read(buffer[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buffer, uint32(n))
+			if _, err := conn.Write(buffer[:4+n]); err != nil {
+				return Result{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, err
+	}
+	answer, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return Result{}, err
+	}
+	return parseAnswer(strings.TrimRight(answer, "\x00\n"))
+}
+
+// Parses an answer like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseAnswer(answer string) (Result, error) {
+	answer = strings.TrimPrefix(answer, "stream: ")
+	switch {
+	case answer == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(answer, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(answer, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", answer)
+	}
+}
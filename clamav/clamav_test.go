@@ -0,0 +1,81 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd answers every INSTREAM command with the answer returned for the received data.
+func fakeClamd(t *testing.T, answer func(data []byte) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, reader, int64(size)); err != nil {
+						return
+					}
+				}
+				_, _ = conn.Write([]byte(answer(data.Bytes()) + "\x00"))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	// Spans several chunks.
+	clean := bytes.Repeat([]byte("clean data "), chunkSize/5)
+	address := fakeClamd(t, func(data []byte) string {
+		switch {
+		case bytes.HasPrefix(data, []byte("clean")) && !bytes.Equal(data, clean):
+			return "received data differs. ERROR"
+		case bytes.Contains(data, []byte("EICAR")):
+			return "stream: Eicar-Signature FOUND"
+		case len(data) > 3*chunkSize:
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return "stream: OK"
+	})
+	client := Client{Address: address}
+
+	if result, err := client.Scan(bytes.NewReader(clean)); err != nil || result.Infected {
+		t.Errorf("Scan() of clean data = %v, %v", result, err)
+	}
+	result, err := client.Scan(strings.NewReader("EICAR test"))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Errorf("Scan() of infected data = %v, %v", result, err)
+	}
+	if _, err := client.Scan(bytes.NewReader(make([]byte, 4*chunkSize))); err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Errorf("Scan() with an error of clamd = %v", err)
+	}
+	if _, err := (Client{Address: "unix:/nonexistent/clamd.ctl"}).Scan(strings.NewReader("data")); err == nil {
+		t.Error("Scan() without clamd succeeded")
+	}
+}
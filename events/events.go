@@ -0,0 +1,93 @@
+// Package events distributes notable events of the server (like found viruses) to interested subscribers.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of events.
+const (
+	// A file written by a client has been found to be infected.
+	VirusFound = "virus_found"
+	// A file written by a client could not be scanned for viruses.
+	ScanFailed = "scan_failed"
+	// The checksum manifest of a directory could not be updated.
+	ManifestFailed = "manifest_failed"
+	// The OnUpload command for an uploaded file has failed.
+	UploadCommandFailed = "upload_command_failed"
+	// A file is still being transferred (see ConfigSftp.ProgressInterval).
+	TransferProgress = "transfer_progress"
+	// A file or directory of a watched directory has been changed, also from outside of sshtool.
+	// The Message is the kind of change (create, write, remove, rename or chmod).
+	FileChanged = "file_changed"
+	// An operation of a user in AuditOnly mode has been allowed, although the permissions would deny it.
+	PermissionAudit = "permission_audit"
+	// A user has replaced their authorized keys (see ConfigSftp.KeySelfService). The Message lists the fingerprints
+	// of the added and removed keys.
+	KeysChanged = "keys_changed"
+	// A file has been created above the soft limit of the files of a user or directory. The Message tells when the
+	// grace period ends.
+	SoftLimitExceeded = "soft_limit_exceeded"
+)
+
+// Event describes something notable that has happened.
+type Event struct {
+	// The kind of event, e.g. VirusFound.
+	Type string
+	Time time.Time
+	// The connection this event belongs to (may be empty).
+	Username string
+	IP       string
+	// The file this event belongs to (may be empty).
+	Path string
+	// A human-readable description.
+	Message string
+}
+
+// Bus passes every published event to all subscribers. A nil Bus drops all events.
+type Bus struct {
+	mutex       sync.RWMutex
+	subscribers map[uint64]func(Event)
+	// The id of the next subscriber.
+	next uint64
+}
+
+// NewBus creates a Bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[uint64]func(Event))}
+}
+
+// Subscribe adds a function that is called for every published event. It is called synchronously by Publish,
+// so it should not block. The returned function removes the subscriber again.
+func (b *Bus) Subscribe(subscriber func(Event)) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = subscriber
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Publish passes the event to all subscribers. The Time is set if it is zero.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mutex.RLock()
+	subscribers := make([]func(Event), 0, len(b.subscribers))
+	for _, subscriber := range b.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	b.mutex.RUnlock()
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
@@ -0,0 +1,364 @@
+// Package gcs provides an [sftp.ObjectStore] for a bucket of the Google Cloud Storage using its json api.
+package gcs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/sftp"
+)
+
+// The urls of the json api.
+const (
+	apiURL    = "https://storage.googleapis.com/storage/v1"
+	uploadURL = "https://storage.googleapis.com/upload/storage/v1"
+)
+
+// The url the metadata server of a google cloud vm serves access tokens from.
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// The scope of the requested access tokens.
+const scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Store is an [sftp.ObjectStore] for a single bucket.
+type Store struct {
+	// The name of the bucket.
+	Bucket string
+	// The json key file of a service account. If empty, the access token is requested from the metadata server
+	// of the vm we are running on.
+	CredentialsFile string
+	Client          *http.Client
+	// Protects the fields below.
+	mutex       sync.Mutex
+	credentials *serviceAccount
+	token       string
+	expires     time.Time
+}
+
+// serviceAccount is the content of a json key file of a service account.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// tokenResponse is the answer of a token request.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (s *Store) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// Creates the signed assertion a service account exchanges for an access token.
+func (a *serviceAccount) assertion() (string, error) {
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("invalid private key of the service account")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("the private key of the service account is no rsa key")
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": scope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Requests a new access token.
+func (s *Store) requestToken(ctx context.Context) (tokenResponse, error) {
+	var request *http.Request
+	if s.CredentialsFile == "" {
+		var err error
+		if request, err = http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL, nil); err != nil {
+			return tokenResponse{}, err
+		}
+		request.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		if s.credentials == nil {
+			data, err := os.ReadFile(s.CredentialsFile)
+			if err != nil {
+				return tokenResponse{}, err
+			}
+			var credentials serviceAccount
+			if err := json.Unmarshal(data, &credentials); err != nil {
+				return tokenResponse{}, fmt.Errorf("invalid CredentialsFile: %v", err)
+			}
+			s.credentials = &credentials
+		}
+		assertion, err := s.credentials.assertion()
+		if err != nil {
+			return tokenResponse{}, err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		if request, err = http.NewRequestWithContext(ctx, http.MethodPost, s.credentials.TokenURI, strings.NewReader(form.Encode())); err != nil {
+			return tokenResponse{}, err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	response, err := s.client().Do(request)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return tokenResponse{}, fmt.Errorf("google cloud storage: cannot get an access token: %s %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	var token tokenResponse
+	err = json.NewDecoder(response.Body).Decode(&token)
+	return token, err
+}
+
+// Returns a valid access token, requesting a new one shortly before the current one expires.
+func (s *Store) accessToken(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+	token, err := s.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// contextStore makes the requests of a Store with a context.
+type contextStore struct {
+	*Store
+	ctx context.Context
+}
+
+// WithContext returns the store making its requests with ctx (see [sftp.ContextObjectStore]).
+func (s *Store) WithContext(ctx context.Context) sftp.ObjectStore {
+	return contextStore{Store: s, ctx: ctx}
+}
+
+func (s *Store) List(prefix string, max int) ([]sftp.ObjectInfo, []string, error) {
+	return contextStore{Store: s, ctx: context.Background()}.List(prefix, max)
+}
+
+func (s *Store) Stat(key string) (sftp.ObjectInfo, error) {
+	return contextStore{Store: s, ctx: context.Background()}.Stat(key)
+}
+
+func (s *Store) ReadAt(key string, p []byte, off int64) (int, error) {
+	return contextStore{Store: s, ctx: context.Background()}.ReadAt(key, p, off)
+}
+
+func (s *Store) Put(key string, content io.Reader, size int64) error {
+	return contextStore{Store: s, ctx: context.Background()}.Put(key, content, size)
+}
+
+func (s *Store) Copy(src, dst string) error {
+	return contextStore{Store: s, ctx: context.Background()}.Copy(src, dst)
+}
+
+func (s *Store) Delete(key string) error {
+	return contextStore{Store: s, ctx: context.Background()}.Delete(key)
+}
+
+// Returns the url of the given object.
+func (s *Store) objectURL(key string) string {
+	return fmt.Sprintf("%s/b/%s/o/%s", apiURL, url.PathEscape(s.Bucket), url.PathEscape(key))
+}
+
+// Sends an authorized request and checks the status. A 404 is returned as [os.ErrNotExist].
+func (s contextStore) do(method string, u string, headers map[string]string, body io.Reader, size int64) (*http.Response, error) {
+	token, err := s.accessToken(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(s.ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+		if size == 0 {
+			// Otherwise, no Content-Length header is sent.
+			request.Body = http.NoBody
+		}
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, err := s.client().Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("google cloud storage: %s %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// Sends an authorized request and decodes the json answer into v.
+func (s contextStore) doJSON(method string, u string, v interface{}) error {
+	response, err := s.do(method, u, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// object is the resource of an object in the json api.
+type object struct {
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	Updated string `json:"updated"`
+}
+
+func (o object) info() sftp.ObjectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	updated, _ := time.Parse(time.RFC3339, o.Updated)
+	return sftp.ObjectInfo{Key: o.Name, Size: size, Modified: updated}
+}
+
+func (s contextStore) List(prefix string, max int) ([]sftp.ObjectInfo, []string, error) {
+	var objects []sftp.ObjectInfo
+	var prefixes []string
+	pageToken := ""
+	for {
+		query := url.Values{"delimiter": {"/"}, "fields": {"items(name,size,updated),prefixes,nextPageToken"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		if max > 0 {
+			query.Set("maxResults", strconv.Itoa(max))
+		}
+		var result struct {
+			Items         []object `json:"items"`
+			Prefixes      []string `json:"prefixes"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		if err := s.doJSON(http.MethodGet, fmt.Sprintf("%s/b/%s/o?%s", apiURL, url.PathEscape(s.Bucket), query.Encode()), &result); err != nil {
+			return nil, nil, err
+		}
+		for _, item := range result.Items {
+			objects = append(objects, item.info())
+		}
+		prefixes = append(prefixes, result.Prefixes...)
+		pageToken = result.NextPageToken
+		if pageToken == "" || (max > 0 && len(objects)+len(prefixes) >= max) {
+			return objects, prefixes, nil
+		}
+	}
+}
+
+func (s contextStore) Stat(key string) (sftp.ObjectInfo, error) {
+	var result object
+	if err := s.doJSON(http.MethodGet, s.objectURL(key)+"?fields=name,size,updated", &result); err != nil {
+		return sftp.ObjectInfo{}, err
+	}
+	return result.info(), nil
+}
+
+func (s contextStore) ReadAt(key string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)
+	response, err := s.do(http.MethodGet, s.objectURL(key)+"?alt=media", map[string]string{"Range": rangeHeader}, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	n, err := io.ReadFull(response.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s contextStore) Put(key string, content io.Reader, size int64) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	u := fmt.Sprintf("%s/b/%s/o?%s", uploadURL, url.PathEscape(s.Bucket), query.Encode())
+	response, err := s.do(http.MethodPost, u, map[string]string{"Content-Type": "application/octet-stream"}, content, size)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (s contextStore) Copy(src, dst string) error {
+	u := fmt.Sprintf("%s/rewriteTo/b/%s/o/%s", s.objectURL(src), url.PathEscape(s.Bucket), url.PathEscape(dst))
+	rewriteToken := ""
+	// Large objects are copied in several calls.
+	for {
+		next := u
+		if rewriteToken != "" {
+			next += "?rewriteToken=" + url.QueryEscape(rewriteToken)
+		}
+		var result struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+		if err := s.doJSON(http.MethodPost, next, &result); err != nil {
+			return err
+		}
+		if result.Done {
+			return nil
+		}
+		rewriteToken = result.RewriteToken
+	}
+}
+
+func (s contextStore) Delete(key string) error {
+	response, err := s.do(http.MethodDelete, s.objectURL(key), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
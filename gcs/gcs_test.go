@@ -0,0 +1,212 @@
+package gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// redirect sends all requests to the test server instead of the google apis.
+type redirect struct {
+	server *httptest.Server
+}
+
+func (r redirect) RoundTrip(request *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(r.server.URL)
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = target.Scheme, target.Host
+	return r.server.Client().Transport.RoundTrip(request)
+}
+
+// fakeBucket is the bucket "files" that accepts the access token it has issued for an assertion of the service
+// account with the public key.
+type fakeBucket struct {
+	publicKey *rsa.PublicKey
+	// The number of issued tokens.
+	tokens  atomic.Int64
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+// Checks the signed assertion of a token request like the token endpoint does.
+func (f *fakeBucket) checkAssertion(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("no jwt")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.publicKey, crypto.SHA256, hash[:], signature); err != nil {
+		return err
+	}
+	var header map[string]string
+	var claims struct {
+		Iss, Scope, Aud string
+		Iat, Exp        int64
+	}
+	for i, v := range []interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	if header["alg"] != "RS256" || claims.Iss != "sshtool@project.iam.gserviceaccount.com" || claims.Scope != scope ||
+		!strings.HasSuffix(claims.Aud, "/token") || claims.Iat > now || claims.Exp <= now {
+		return fmt.Errorf("invalid claims %s %+v", header, claims)
+	}
+	return nil
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/token" {
+		if err := request.ParseForm(); err != nil || request.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		if err := f.checkAssertion(request.PostForm.Get("assertion")); err != nil {
+			http.Error(w, "invalid_grant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(tokenResponse{AccessToken: fmt.Sprintf("token%d", f.tokens.Add(1)), ExpiresIn: 3600})
+		return
+	}
+	if request.Header.Get("Authorization") != "Bearer token1" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// The name is a single escaped segment of the path.
+	path := request.URL.EscapedPath()
+	switch {
+	case request.Method == http.MethodPost && path == "/upload/storage/v1/b/files/o":
+		if request.URL.Query().Get("uploadType") != "media" {
+			http.Error(w, "invalid upload", http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(request.Body)
+		f.objects[request.URL.Query().Get("name")] = data
+		_, _ = io.WriteString(w, "{}")
+	case strings.HasPrefix(path, "/storage/v1/b/files/o/"):
+		escaped, escapedDst, rewrite := strings.Cut(strings.TrimPrefix(path, "/storage/v1/b/files/o/"), "/rewriteTo/b/files/o/")
+		name, err := url.PathUnescape(escaped)
+		data, ok := f.objects[name]
+		if err != nil || !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		switch {
+		case rewrite && request.Method == http.MethodPost:
+			dst, _ := url.PathUnescape(escapedDst)
+			f.objects[dst] = data
+			_, _ = io.WriteString(w, `{"done": true}`)
+		case request.Method == http.MethodDelete:
+			delete(f.objects, name)
+		case request.URL.Query().Get("alt") == "media":
+			var start, end int
+			_, _ = fmt.Sscanf(request.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			_, _ = w.Write(data[start:min(end+1, len(data))])
+		default:
+			_ = json.NewEncoder(w).Encode(object{Name: name, Size: fmt.Sprint(len(data)), Updated: "2026-10-16T10:00:00Z"})
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Creates a store for the fake bucket with the credentials of a new service account.
+func newTestStore(t *testing.T) (*Store, *fakeBucket) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &fakeBucket{publicKey: &key.PublicKey, objects: map[string][]byte{}}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+	encoded, _ := x509.MarshalPKCS8PrivateKey(key)
+	credentials, _ := json.Marshal(serviceAccount{
+		ClientEmail: "sshtool@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded})),
+		TokenURI:    server.URL + "/token",
+	})
+	filename := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(filename, credentials, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &Store{Bucket: "files", CredentialsFile: filename, Client: &http.Client{Transport: redirect{server}}}, bucket
+}
+
+func TestStore(t *testing.T) {
+	store, bucket := newTestStore(t)
+	// A name that needs escaping, including its slash.
+	key := "dir/a file+ü.txt"
+	if err := store.Put(key, strings.NewReader("hello world"), 11); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if info, err := store.Stat(key); err != nil || info.Size != 11 || info.Key != key || info.Modified.IsZero() {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+	p := make([]byte, 5)
+	if n, err := store.ReadAt(key, p, 6); err != nil || string(p[:n]) != "world" {
+		t.Errorf("ReadAt() = %q, %v", p[:n], err)
+	}
+	if err := store.Copy(key, "dir/copy"); err != nil {
+		t.Errorf("Copy() = %v", err)
+	}
+	if info, err := store.Stat("dir/copy"); err != nil || info.Size != 11 {
+		t.Errorf("Stat() of the copy = %v, %v", info, err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Errorf("Delete() = %v", err)
+	}
+	if _, err := store.Stat(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat() after Delete() = %v, want %v", err, os.ErrNotExist)
+	}
+	// The access token is used until it expires.
+	if bucket.tokens.Load() != 1 {
+		t.Errorf("requested %d access tokens, want 1", bucket.tokens.Load())
+	}
+}
+
+func TestStoreInvalidCredentials(t *testing.T) {
+	store, _ := newTestStore(t)
+	data, _ := os.ReadFile(store.CredentialsFile)
+	var credentials serviceAccount
+	_ = json.Unmarshal(data, &credentials)
+	// The assertion is signed by another key.
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	encoded, _ := x509.MarshalPKCS8PrivateKey(other)
+	credentials.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded}))
+	data, _ = json.Marshal(credentials)
+	if err := os.WriteFile(store.CredentialsFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("a"); err == nil || !strings.Contains(err.Error(), "access token") {
+		t.Errorf("Stat() with a wrong key = %v", err)
+	}
+}
@@ -1,14 +1,22 @@
 module github.com/Entscheider/sshtool
 
-go 1.16
+// golang.org/x/crypto requires this version. Its ssh.PartialSuccessError is needed for AuthenticationMethods.
+go 1.26.0
 
 require (
 	github.com/BurntSushi/toml v1.0.0
 	github.com/creack/pty v1.1.17
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/gliderlabs/ssh v0.3.3
 	github.com/mikesmitty/edkey v0.0.0-20170222072505-3356ea4e686a
 	github.com/pkg/sftp v1.13.4
-	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
-	golang.org/x/net v0.0.0-20220520000938-2e3eb7b945c2
-	golang.org/x/sys v0.0.0-20220325203850-36772127a21f // indirect
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
+	golang.org/x/sys v0.48.0
+)
+
+require (
+	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
 )
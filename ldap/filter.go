@@ -0,0 +1,178 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// The tags of the choices of a filter.
+const (
+	filterAnd            = 0xa0
+	filterOr             = 0xa1
+	filterNot            = 0xa2
+	filterEqualityMatch  = 0xa3
+	filterSubstrings     = 0xa4
+	filterGreaterOrEqual = 0xa5
+	filterLessOrEqual    = 0xa6
+	filterPresent        = 0x87
+	filterApproxMatch    = 0xa8
+
+	substringInitial = 0x80
+	substringAny     = 0x81
+	substringFinal   = 0x82
+)
+
+// EscapeFilter escapes the characters of a value that have a meaning in a filter, so it can be used in a
+// filter like "(uid=" + EscapeFilter(name) + ")".
+func EscapeFilter(value string) string {
+	var result strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			_, _ = fmt.Fprintf(&result, "\\%02x", c)
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// Compiles a filter in its string representation (RFC 4515) into its encoding for a search request.
+// Extensible matches are not supported.
+func compileFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid filter %q: %v", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: invalid filter %q: unexpected %q", filter, rest)
+	}
+	return encoded, nil
+}
+
+// Parses a single parenthesized filter. Returns its encoding and the rest of the string.
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("missing (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("missing )")
+	}
+	var encoded []byte
+	switch s[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		var parts [][]byte
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			part, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+			s = rest
+		}
+		encoded = element(tag, parts...)
+	case '!':
+		part, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		encoded, s = element(filterNot, part), rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("missing )")
+		}
+		var err error
+		if encoded, err = parseItem(s[:end]); err != nil {
+			return nil, "", err
+		}
+		s = s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("missing )")
+	}
+	return encoded, s[1:], nil
+}
+
+// Parses a comparison like "uid=name", "cn=a*b" or "mail=*".
+func parseItem(item string) ([]byte, error) {
+	i := strings.IndexByte(item, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid comparison %q", item)
+	}
+	attribute, value := item[:i], item[i+1:]
+	tag := byte(filterEqualityMatch)
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	case '~':
+		tag = filterApproxMatch
+	case ':':
+		return nil, fmt.Errorf("extensible matches are not supported")
+	}
+	if tag != filterEqualityMatch {
+		attribute = attribute[:len(attribute)-1]
+	}
+	if attribute == "" {
+		return nil, fmt.Errorf("invalid comparison %q", item)
+	}
+	if tag == filterEqualityMatch && value == "*" {
+		return element(filterPresent, []byte(attribute)), nil
+	}
+	if tag == filterEqualityMatch && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for j, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeValue(part)
+			if err != nil {
+				return nil, err
+			}
+			kind := byte(substringAny)
+			if j == 0 {
+				kind = substringInitial
+			} else if j == len(parts)-1 {
+				kind = substringFinal
+			}
+			substrings = append(substrings, element(kind, unescaped))
+		}
+		return element(filterSubstrings, element(tagOctetString, []byte(attribute)), element(tagSequence, substrings...)), nil
+	}
+	unescaped, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return element(tag, element(tagOctetString, []byte(attribute)), element(tagOctetString, unescaped)), nil
+}
+
+// Replaces the escapes like "\2a" of a value of a filter by their bytes.
+func unescapeValue(value string) ([]byte, error) {
+	var result []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			result = append(result, value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return nil, fmt.Errorf("invalid escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape in %q", value)
+		}
+		result = append(result, decoded...)
+		i += 2
+	}
+	return result, nil
+}
@@ -0,0 +1,388 @@
+// Package ldap provides a minimal LDAPv3 client (RFC 4511), which is enough to bind and to search for users and
+// their attributes.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The tags of the protocol operations and the fields we use.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagBoolean     = 0x01
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest          = 0x60
+	tagBindResponse         = 0x61
+	tagUnbindRequest        = 0x42
+	tagSearchRequest        = 0x63
+	tagSearchResultEntry    = 0x64
+	tagSearchResultDone     = 0x65
+	tagSearchResultRef      = 0x73
+	tagSimpleAuthentication = 0x80
+)
+
+// Messages larger than this are rejected.
+const maxMessageSize = 16 << 20
+
+// Error is an error result of the server.
+type Error struct {
+	// The result code, e.g. 49 for invalid credentials.
+	Code int
+	// The diagnostic message of the server.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// The result code of a bind with a wrong password.
+const ResultInvalidCredentials = 49
+
+// Entry is an entry found by a search.
+type Entry struct {
+	// The distinguished name of the entry.
+	DN string
+	// The values of the requested attributes by their name as sent by the server.
+	Attributes map[string][]string
+}
+
+// Values returns the values of the attribute. Attribute names are case-insensitive.
+func (e Entry) Values(attribute string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Conn is a connection to a server. It is not safe for concurrent use.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// The timeout of every operation.
+	timeout time.Duration
+	// The id of the last request.
+	messageID int64
+}
+
+// Dial connects to the server at an address like "ldap://ldap.example.com" or "ldaps://ldap.example.com:636".
+func Dial(address string, timeout time.Duration) (*Conn, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch parsed.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(parsed, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(parsed, "636"), &tls.Config{ServerName: parsed.Hostname()})
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", parsed.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Returns the host and the port of the url, using the default port if it has none.
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
+
+// Close ends the session and closes the connection.
+func (c *Conn) Close() error {
+	c.messageID++
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, _ = c.conn.Write(element(tagSequence, element(tagInteger, encodeInt(c.messageID)), element(tagUnbindRequest)))
+	return c.conn.Close()
+}
+
+// Bind authenticates with the distinguished name and the password. An empty name and password bind anonymously.
+func (c *Conn) Bind(dn string, password string) error {
+	request := element(tagBindRequest,
+		element(tagInteger, encodeInt(3)),
+		element(tagOctetString, []byte(dn)),
+		element(tagSimpleAuthentication, []byte(password)),
+	)
+	if err := c.send(request); err != nil {
+		return err
+	}
+	tag, content, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != tagBindResponse {
+		return fmt.Errorf("ldap: unexpected response 0x%x to bind", tag)
+	}
+	return parseResult(content)
+}
+
+// Search returns the entries below the base that match the filter (RFC 4515, e.g. "(&(objectClass=person)(uid=a))")
+// along with the given attributes.
+func (c *Conn) Search(base string, filter string, attributes []string) ([]Entry, error) {
+	encodedFilter, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attributeList [][]byte
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, element(tagOctetString, []byte(attribute)))
+	}
+	request := element(tagSearchRequest,
+		element(tagOctetString, []byte(base)),
+		// The whole subtree
+		element(tagEnumerated, encodeInt(2)),
+		// Never dereference aliases
+		element(tagEnumerated, encodeInt(0)),
+		// No size and time limit
+		element(tagInteger, encodeInt(0)),
+		element(tagInteger, encodeInt(0)),
+		// Not only the types of the attributes
+		element(tagBoolean, []byte{0}),
+		encodedFilter,
+		element(tagSequence, attributeList...),
+	)
+	if err := c.send(request); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		tag, content, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagSearchResultEntry:
+			entry, err := parseEntry(content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case tagSearchResultRef:
+			// Referrals to other servers are not followed.
+		case tagSearchResultDone:
+			return entries, parseResult(content)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response 0x%x to search", tag)
+		}
+	}
+}
+
+// Sends the protocol operation as a new message.
+func (c *Conn) send(operation []byte) error {
+	c.messageID++
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(element(tagSequence, element(tagInteger, encodeInt(c.messageID)), operation))
+	return err
+}
+
+// Reads the next message for the last request and returns the tag and the content of its protocol operation.
+func (c *Conn) receive() (byte, []byte, error) {
+	for {
+		tag, message, err := readElement(c.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		if tag != tagSequence {
+			return 0, nil, fmt.Errorf("ldap: invalid message")
+		}
+		idTag, id, rest, err := nextElement(message)
+		if err != nil || idTag != tagInteger {
+			return 0, nil, fmt.Errorf("ldap: invalid message")
+		}
+		operationTag, operation, _, err := nextElement(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		if decodeInt(id) != c.messageID {
+			// Like the notice of disconnection (id 0), nothing we have asked for.
+			if decodeInt(id) == 0 {
+				return 0, nil, fmt.Errorf("ldap: the server has closed the connection")
+			}
+			continue
+		}
+		return operationTag, operation, nil
+	}
+}
+
+// Parses an LDAPResult. Returns nil if it reports success.
+func parseResult(content []byte) error {
+	tag, code, rest, err := nextElement(content)
+	if err != nil || tag != tagEnumerated {
+		return fmt.Errorf("ldap: invalid result")
+	}
+	// The matched DN
+	_, _, rest, err = nextElement(rest)
+	if err != nil {
+		return fmt.Errorf("ldap: invalid result")
+	}
+	_, message, _, _ := nextElement(rest)
+	if decodeInt(code) == 0 {
+		return nil
+	}
+	return &Error{Code: int(decodeInt(code)), Message: string(message)}
+}
+
+// Parses a SearchResultEntry.
+func parseEntry(content []byte) (Entry, error) {
+	invalid := errors.New("ldap: invalid search result")
+	tag, dn, rest, err := nextElement(content)
+	if err != nil || tag != tagOctetString {
+		return Entry{}, invalid
+	}
+	entry := Entry{DN: string(dn), Attributes: map[string][]string{}}
+	tag, attributes, _, err := nextElement(rest)
+	if err != nil || tag != tagSequence {
+		return Entry{}, invalid
+	}
+	for len(attributes) > 0 {
+		var attribute []byte
+		if tag, attribute, attributes, err = nextElement(attributes); err != nil || tag != tagSequence {
+			return Entry{}, invalid
+		}
+		tag, name, values, err := nextElement(attribute)
+		if err != nil || tag != tagOctetString {
+			return Entry{}, invalid
+		}
+		if tag, values, _, err = nextElement(values); err != nil || tag != tagSet {
+			return Entry{}, invalid
+		}
+		list := []string{}
+		for len(values) > 0 {
+			var value []byte
+			if _, value, values, err = nextElement(values); err != nil {
+				return Entry{}, invalid
+			}
+			list = append(list, string(value))
+		}
+		entry.Attributes[string(name)] = list
+	}
+	return entry, nil
+}
+
+// Encodes an element of the basic encoding rules with the given tag and content.
+func element(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, part := range content {
+		length += len(part)
+	}
+	result := []byte{tag}
+	if length < 0x80 {
+		result = append(result, byte(length))
+	} else {
+		var digits []byte
+		for n := length; n > 0; n >>= 8 {
+			digits = append([]byte{byte(n)}, digits...)
+		}
+		result = append(append(result, 0x80|byte(len(digits))), digits...)
+	}
+	for _, part := range content {
+		result = append(result, part...)
+	}
+	return result
+}
+
+// Encodes an integer in two's complement with as few bytes as possible.
+func encodeInt(v int64) []byte {
+	result := []byte{byte(v)}
+	for v >>= 8; v != 0 && v != -1; v >>= 8 {
+		result = append([]byte{byte(v)}, result...)
+	}
+	// The sign bit has to match the sign.
+	if (v == 0) != (result[0]&0x80 == 0) {
+		result = append([]byte{byte(v)}, result...)
+	}
+	return result
+}
+
+func decodeInt(data []byte) int64 {
+	var v int64
+	for i, b := range data {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// Reads a single element from the reader.
+func readElement(reader *bufio.Reader) (byte, []byte, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		digits := int(first & 0x7f)
+		if digits == 0 || digits > 4 {
+			return 0, nil, fmt.Errorf("ldap: unsupported length")
+		}
+		length = 0
+		for i := 0; i < digits; i++ {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return 0, nil, fmt.Errorf("ldap: message too large")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// Splits the first element off the data. Returns its tag, its content and the data after it.
+func nextElement(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("ldap: truncated element")
+	}
+	tag, length, offset := data[0], int(data[1]), 2
+	if data[1]&0x80 != 0 {
+		digits := int(data[1] & 0x7f)
+		if digits == 0 || digits > 4 || len(data) < 2+digits {
+			return 0, nil, nil, fmt.Errorf("ldap: unsupported length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+digits] {
+			length = length<<8 | int(b)
+		}
+		offset += digits
+	}
+	if length < 0 || length > len(data)-offset {
+		return 0, nil, nil, fmt.Errorf("ldap: truncated element")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
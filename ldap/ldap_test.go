@@ -0,0 +1,173 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	value := "a*b(c)\\d\x00é"
+	if escaped := EscapeFilter(value); escaped != `a\2ab\28c\29\5cd\00é` {
+		t.Errorf("EscapeFilter() = %q", escaped)
+	}
+	// The escaped value matches exactly the value, without wildcards or nested filters.
+	encoded, err := compileFilter("(uid=" + EscapeFilter(value) + ")")
+	want := element(filterEqualityMatch, element(tagOctetString, []byte("uid")), element(tagOctetString, []byte(value)))
+	if err != nil || !bytes.Equal(encoded, want) {
+		t.Errorf("compileFilter() of the escaped value = %x, %v, want %x", encoded, err, want)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	octets := func(s string) []byte { return element(tagOctetString, []byte(s)) }
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=alice)", element(filterEqualityMatch, octets("uid"), octets("alice"))},
+		{"(mail=*)", element(filterPresent, []byte("mail"))},
+		{"(cn=a*b*c)", element(filterSubstrings, octets("cn"), element(tagSequence,
+			element(substringInitial, []byte("a")), element(substringAny, []byte("b")), element(substringFinal, []byte("c"))))},
+		{"(cn=*b*)", element(filterSubstrings, octets("cn"), element(tagSequence, element(substringAny, []byte("b"))))},
+		{"(uidNumber>=1000)", element(filterGreaterOrEqual, octets("uidNumber"), octets("1000"))},
+		{"(uidNumber<=2000)", element(filterLessOrEqual, octets("uidNumber"), octets("2000"))},
+		{"(cn~=alice)", element(filterApproxMatch, octets("cn"), octets("alice"))},
+		{" (&(objectClass=person)(!(uid=bob))(|(uid=a)(uid=b))) ", element(filterAnd,
+			element(filterEqualityMatch, octets("objectClass"), octets("person")),
+			element(filterNot, element(filterEqualityMatch, octets("uid"), octets("bob"))),
+			element(filterOr, element(filterEqualityMatch, octets("uid"), octets("a")),
+				element(filterEqualityMatch, octets("uid"), octets("b"))))},
+		{`(cn=\2a\28)`, element(filterEqualityMatch, octets("cn"), octets("*("))},
+	}
+	for _, test := range tests {
+		if encoded, err := compileFilter(test.filter); err != nil || !bytes.Equal(encoded, test.want) {
+			t.Errorf("compileFilter(%q) = %x, %v, want %x", test.filter, encoded, err, test.want)
+		}
+	}
+	for _, filter := range []string{"uid=alice", "(uid=alice", "(uid=alice))", "(=alice)", "(uid:dn:=alice)",
+		`(uid=\2)`, `(uid=\zz)`, "(&(uid=a)"} {
+		if _, err := compileFilter(filter); err == nil {
+			t.Errorf("compileFilter(%q) succeeded", filter)
+		}
+	}
+}
+
+func TestEncodeInt(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40} {
+		encoded := encodeInt(v)
+		// A leading byte is only needed for the sign.
+		redundant := len(encoded) > 1 && ((encoded[0] == 0 && encoded[1]&0x80 == 0) ||
+			(encoded[0] == 0xff && encoded[1]&0x80 != 0))
+		if decodeInt(encoded) != v || redundant {
+			t.Errorf("encodeInt(%d) = %x", v, encoded)
+		}
+	}
+}
+
+// fakeServer accepts a single connection and lets answer respond to every request with the protocol operations
+// it returns. Returns the url to connect to.
+func fakeServer(t *testing.T, answer func(tag byte, operation []byte) [][]byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			_, message, err := readElement(reader)
+			if err != nil {
+				return
+			}
+			_, id, rest, _ := nextElement(message)
+			tag, operation, _, _ := nextElement(rest)
+			// A message for another request is skipped by the client.
+			_, _ = conn.Write(element(tagSequence, element(tagInteger, encodeInt(decodeInt(id)+100)),
+				element(tagSearchResultDone, result(1, ""))))
+			for _, response := range answer(tag, operation) {
+				_, _ = conn.Write(element(tagSequence, element(tagInteger, id), response))
+			}
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+// Returns the content of an LDAPResult with the given code.
+func result(code int64, message string) []byte {
+	return bytes.Join([][]byte{element(tagEnumerated, encodeInt(code)), element(tagOctetString),
+		element(tagOctetString, []byte(message))}, nil)
+}
+
+func TestBindAndSearch(t *testing.T) {
+	filter := "(&(objectClass=person)(uid=" + EscapeFilter("alice*") + "))"
+	encodedFilter, _ := compileFilter(filter)
+	attribute := func(name string, values ...string) []byte {
+		var encoded [][]byte
+		for _, value := range values {
+			encoded = append(encoded, element(tagOctetString, []byte(value)))
+		}
+		return element(tagSequence, element(tagOctetString, []byte(name)), element(tagSet, encoded...))
+	}
+	address := fakeServer(t, func(tag byte, operation []byte) [][]byte {
+		switch tag {
+		case tagBindRequest:
+			want := bytes.Join([][]byte{element(tagInteger, encodeInt(3)),
+				element(tagOctetString, []byte("cn=admin")), element(tagSimpleAuthentication, []byte("secret"))}, nil)
+			if !bytes.Equal(operation, want) {
+				return [][]byte{element(tagBindResponse, result(ResultInvalidCredentials, "invalid credentials"))}
+			}
+			return [][]byte{element(tagBindResponse, result(0, ""))}
+		case tagSearchRequest:
+			if !bytes.Contains(operation, encodedFilter) {
+				return [][]byte{element(tagSearchResultDone, result(87, "filter error"))}
+			}
+			// A large entry needs several bytes for its length.
+			key := string(bytes.Repeat([]byte("k"), 300))
+			return [][]byte{
+				element(tagSearchResultEntry, element(tagOctetString, []byte("uid=alice*,dc=example")),
+					element(tagSequence, attribute("uid", "alice*"), attribute("sshPublicKey", key, "second"))),
+				element(tagSearchResultRef, element(tagOctetString, []byte("ldap://other.example"))),
+				element(tagSearchResultDone, result(0, "")),
+			}
+		}
+		return nil
+	})
+	conn, err := Dial(address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var ldapErr *Error
+	if err := conn.Bind("cn=admin", "wrong"); !errors.As(err, &ldapErr) || ldapErr.Code != ResultInvalidCredentials {
+		t.Errorf("Bind() with a wrong password = %v", err)
+	}
+	if err := conn.Bind("cn=admin", "secret"); err != nil {
+		t.Fatalf("Bind() = %v", err)
+	}
+	entries, err := conn.Search("dc=example", filter, []string{"uid", "sshPublicKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DN != "uid=alice*,dc=example" {
+		t.Fatalf("Search() = %v", entries)
+	}
+	if keys := entries[0].Values("SSHPUBLICKEY"); len(keys) != 2 || len(keys[0]) != 300 || keys[1] != "second" {
+		t.Errorf("Values() = %q", keys)
+	}
+	if _, err := conn.Search("dc=example", "(uid=bob)", nil); !errors.As(err, &ldapErr) || ldapErr.Code != 87 {
+		t.Errorf("Search() with an error = %v", err)
+	}
+	if !reflect.DeepEqual(entries[0].Values("missing"), []string(nil)) {
+		t.Errorf("Values() of a missing attribute = %q", entries[0].Values("missing"))
+	}
+}
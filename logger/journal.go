@@ -0,0 +1,148 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// The socket journald receives entries of its native protocol on.
+const journalSocket = "/run/systemd/journal/socket"
+
+// The priorities of the journal (like syslog) used for the levels of a Logger.
+const (
+	journalErr   = "3"
+	journalWarn  = "4"
+	journalInfo  = "6"
+	journalDebug = "7"
+)
+
+// journalWriter sends entries with structured fields to the systemd journal, one datagram per entry.
+type journalWriter struct {
+	conn       *net.UnixConn
+	identifier string
+	dropped    atomic.Uint64
+}
+
+// newJournalWriter connects to the socket of journald (usually journalSocket). The entries are tagged with the
+// identifier as SYSLOG_IDENTIFIER.
+func newJournalWriter(socket string, identifier string) (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the systemd journal: %w", err)
+	}
+	return &journalWriter{conn: conn, identifier: identifier}, nil
+}
+
+// send writes an entry with the given fields (name and value in turn). Empty values are left out. Entries that
+// cannot be sent (e.g. because they are too large for a datagram) are counted as dropped.
+func (w *journalWriter) send(fields ...string) {
+	var data bytes.Buffer
+	fields = append(fields, "SYSLOG_IDENTIFIER", w.identifier)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, value := fields[i], fields[i+1]
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "\n") {
+			data.WriteString(name + "=" + value + "\n")
+			continue
+		}
+		// Values with newlines are sent with their size instead.
+		data.WriteString(name + "\n")
+		_ = binary.Write(&data, binary.LittleEndian, uint64(len(value)))
+		data.WriteString(value + "\n")
+	}
+	if _, err := w.conn.Write(data.Bytes()); err != nil {
+		w.dropped.Add(1)
+	}
+}
+
+func (w *journalWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+func (w *journalWriter) Close() error {
+	return w.conn.Close()
+}
+
+// journalLogger is a Logger writing to the systemd journal.
+type journalLogger struct {
+	*journalWriter
+}
+
+// NewJournalLogger creates a Logger that writes to the systemd journal with the identifier as SYSLOG_IDENTIFIER,
+// the level as PRIORITY and the tag as TAG field. Fails if journald is not running.
+func NewJournalLogger(identifier string) (Logger, error) {
+	writer, err := newJournalWriter(journalSocket, identifier)
+	if err != nil {
+		return nil, err
+	}
+	return journalLogger{writer}, nil
+}
+
+func (l journalLogger) Warn(tag string, msg string) {
+	l.send("MESSAGE", tag+" - "+msg, "PRIORITY", journalWarn, "TAG", tag)
+}
+
+func (l journalLogger) Err(tag string, msg string) {
+	l.send("MESSAGE", tag+" - "+msg, "PRIORITY", journalErr, "TAG", tag)
+}
+
+func (l journalLogger) Debug(tag string, msg string) {
+	l.send("MESSAGE", tag+" - "+msg, "PRIORITY", journalDebug, "TAG", tag)
+}
+
+func (l journalLogger) Info(tag string, msg string) {
+	l.send("MESSAGE", tag+" - "+msg, "PRIORITY", journalInfo, "TAG", tag)
+}
+
+// journalAccessLogger is an AccessLogger writing to the systemd journal.
+type journalAccessLogger struct {
+	*journalWriter
+}
+
+// NewJournalAccessLogger creates an AccessLogger that writes every entry to the systemd journal with the
+// identifier as SYSLOG_IDENTIFIER. Besides a readable MESSAGE, the entries have the fields ACCESS_TYPE, USER,
+// SRC_IP, SRC_HOSTNAME, PATH, KIND, STATUS, CLIENT and PREVIOUS (empty ones are left out), so they can be
+// filtered like "journalctl USER=alice". Fails if journald is not running.
+func NewJournalAccessLogger(identifier string) (AccessLogger, error) {
+	writer, err := newJournalWriter(journalSocket, identifier)
+	if err != nil {
+		return nil, err
+	}
+	return journalAccessLogger{writer}, nil
+}
+
+func (l journalAccessLogger) write(e entry) {
+	message := fmt.Sprintf("%s of %s from %s", e.logType, e.connectionInfo.Username, e.connectionInfo.IP)
+	if e.path != "" {
+		message += fmt.Sprintf(": %s %s", e.kind, e.path)
+	}
+	if e.status != "" {
+		message += fmt.Sprintf(" (%s)", e.status)
+	}
+	l.send("MESSAGE", message, "PRIORITY", journalInfo, "ACCESS_TYPE", e.logType,
+		"USER", e.connectionInfo.Username, "SRC_IP", e.connectionInfo.IP, "SRC_HOSTNAME", e.connectionInfo.Hostname,
+		"PATH", e.path, "KIND", e.kind, "STATUS", e.status, "CLIENT", e.client, "PREVIOUS", e.previous)
+}
+
+func (l journalAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	l.write(entry{logType: "login", connectionInfo: connection, status: status, client: connection.Client})
+}
+
+func (l journalAccessLogger) Logout(connection ConnectionInfo) {
+	l.write(entry{logType: "logout", connectionInfo: connection})
+}
+
+func (l journalAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	l.write(entry{logType: "access", connectionInfo: connection, path: path, kind: kind, status: status})
+}
+
+func (l journalAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.write(entry{logType: "access", connectionInfo: connection, path: path, kind: kind, status: status,
+		previous: previous.String()})
+}
@@ -0,0 +1,124 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJournal listens like journald and returns the socket and a function receiving the next entry.
+func fakeJournal(t *testing.T) (string, func() map[string]string) {
+	socket := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return socket, func() map[string]string {
+		buffer := make([]byte, 1<<16)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseJournalEntry(t, buffer[:n])
+	}
+}
+
+// Parses an entry of the native protocol of journald.
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	fields := map[string]string{}
+	for len(data) > 0 {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			t.Fatalf("unterminated field %q", data)
+		}
+		if name, value, ok := strings.Cut(string(line), "="); ok {
+			fields[name] = value
+			data = rest
+			continue
+		}
+		// The value follows with its size.
+		if len(rest) < 8 {
+			t.Fatalf("missing size of field %s", line)
+		}
+		size := binary.LittleEndian.Uint64(rest)
+		rest = rest[8:]
+		if uint64(len(rest)) < size+1 || rest[size] != '\n' {
+			t.Fatalf("invalid binary field %s", line)
+		}
+		fields[string(line)] = string(rest[:size])
+		data = rest[size+1:]
+	}
+	return fields
+}
+
+func TestJournalLogger(t *testing.T) {
+	socket, receive := fakeJournal(t)
+	writer, err := newJournalWriter(socket, "sshtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	journalLogger{writer}.Warn("Auth", "line one\nline two")
+	fields := receive()
+	want := map[string]string{"MESSAGE": "Auth - line one\nline two", "PRIORITY": journalWarn, "TAG": "Auth",
+		"SYSLOG_IDENTIFIER": "sshtool"}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("%s = %q, want %q", name, fields[name], value)
+		}
+	}
+	if len(fields) != len(want) {
+		t.Errorf("fields = %q, want %q", fields, want)
+	}
+}
+
+func TestJournalAccessLogger(t *testing.T) {
+	socket, receive := fakeJournal(t)
+	writer, err := newJournalWriter(socket, "sshtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	logger := journalAccessLogger{writer}
+	connection := ConnectionInfo{Username: "alice", IP: "192.0.2.1", Client: "SSH-2.0-OpenSSH_9.6"}
+	logger.NewLogin(connection, "accepted")
+	if fields := receive(); fields["ACCESS_TYPE"] != "login" || fields["USER"] != "alice" ||
+		fields["SRC_IP"] != "192.0.2.1" || fields["CLIENT"] != connection.Client || fields["STATUS"] != "accepted" {
+		t.Errorf("login fields = %q", fields)
+	} else if _, ok := fields["PATH"]; ok {
+		t.Errorf("the empty PATH has been sent: %q", fields)
+	}
+	// A path with a newline must not inject another field.
+	logger.NewAccess(connection, "/upload\nUSER=mallory", "write", "")
+	if fields := receive(); fields["PATH"] != "/upload\nUSER=mallory" || fields["USER"] != "alice" || fields["KIND"] != "write" {
+		t.Errorf("access fields = %q", fields)
+	}
+}
+
+func TestJournalWriterCountsDropped(t *testing.T) {
+	socket, receive := fakeJournal(t)
+	writer, err := newJournalWriter(socket, "sshtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Too large for a datagram.
+	writer.send("MESSAGE", strings.Repeat("x", 16<<20))
+	if writer.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", writer.Dropped())
+	}
+	writer.send("MESSAGE", "after")
+	if fields := receive(); fields["MESSAGE"] != "after" {
+		t.Errorf("fields after dropping = %q", fields)
+	}
+	_ = writer.Close()
+	writer.send("MESSAGE", "closed")
+	if writer.Dropped() != 2 {
+		t.Errorf("Dropped() after closing = %d, want 2", writer.Dropped())
+	}
+}
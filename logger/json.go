@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// jsonEntry is the representation of an access log entry used by the JSON AccessLogger.
+type jsonEntry struct {
+	Time     time.Time
+	Type     string
+	IP       string
+	Hostname string `json:",omitempty"`
+	Username string
+	Path     string `json:",omitempty"`
+	Kind     string `json:",omitempty"`
+	Status   string `json:",omitempty"`
+	// The client of a login (see ConnectionInfo.Client).
+	Client string `json:",omitempty"`
+	// The attributes of the file before a change. Nil if unknown.
+	Previous *FileAttributes `json:",omitempty"`
+}
+
+// AccessLogger that writes every entry as a single JSON line, so it can be read back with ReplayAccessLog.
+type jsonAccessLogger struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	writer  io.Writer
+}
+
+// NewJSONAccessLogger creates an AccessLogger that writes every entry as a JSON line to the given writer.
+// This is meant for passing the entries to another process, which feeds them into its own logger using
+// ReplayAccessLog.
+func NewJSONAccessLogger(writer io.Writer) AccessLogger {
+	return &jsonAccessLogger{encoder: json.NewEncoder(writer), writer: writer}
+}
+
+func (l *jsonAccessLogger) write(e jsonEntry) {
+	e.Time = time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_ = l.encoder.Encode(e)
+}
+
+func (l *jsonAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	l.write(jsonEntry{Type: "login", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username, Status: status, Client: connection.Client})
+}
+
+func (l *jsonAccessLogger) Logout(connection ConnectionInfo) {
+	l.write(jsonEntry{Type: "logout", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username})
+}
+
+func (l *jsonAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	l.write(jsonEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status})
+}
+
+func (l *jsonAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.write(jsonEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status, Previous: &previous})
+}
+
+func (l *jsonAccessLogger) Close() error {
+	if closer, ok := l.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ReplayAccessLog reads the lines written by a JSON AccessLogger from the reader until EOF and passes
+// every entry to the target. Lines that are not an access log entry are passed to other (if not nil).
+func ReplayAccessLog(reader io.Reader, target AccessLogger, other func(line string)) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var e jsonEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Type == "" {
+			if other != nil {
+				other(scanner.Text())
+			}
+			continue
+		}
+		info := ConnectionInfo{IP: e.IP, Hostname: e.Hostname, Username: e.Username}
+		switch e.Type {
+		case "login":
+			info.Client = e.Client
+			target.NewLogin(info, e.Status)
+		case "logout":
+			target.Logout(info)
+		case "access":
+			if e.Previous != nil {
+				LogChange(target, info, e.Path, e.Kind, e.Status, *e.Previous)
+			} else {
+				target.NewAccess(info, e.Path, e.Kind, e.Status)
+			}
+		}
+	}
+	return scanner.Err()
+}
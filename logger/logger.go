@@ -3,8 +3,10 @@ package logger
 import (
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,43 +23,123 @@ type Logger interface {
 	Info(tag string, msg string)
 }
 
-// A default implementation of a logger that avoids parallel printing in different thread
-type stdLogger struct {
-	channel     chan<- string
-	waitChannel <-chan bool
-	wg          *sync.WaitGroup
+// DefaultBufferSize is the number of entries a Logger or an AccessLogger of this package keeps while its writer is
+// busy, unless Options says otherwise.
+const DefaultBufferSize = 1024
+
+// Options configures how a Logger or an AccessLogger passes its entries to the writer.
+type Options struct {
+	// The number of entries waiting to be written. Zero uses DefaultBufferSize.
+	BufferSize int
+	// Whether entries are dropped while the buffer is full instead of waiting for the writer, so a slow writer
+	// never stalls the callers. The dropped entries are counted (see DropCounter).
+	NonBlocking bool
 }
 
-// NewLogger creates a new Logger implementation that writes all outputs to the given writer
-func NewLogger(writer io.Writer) Logger {
-	c := make(chan string)
-	wc := make(chan bool)
-	wg := sync.WaitGroup{}
+// DropCounter is implemented by loggers that drop entries if their destination cannot keep up.
+type DropCounter interface {
+	// Dropped returns the number of entries dropped so far.
+	Dropped() uint64
+}
+
+// Dropped returns the number of entries the given logger has dropped so far, or zero if it never drops any.
+func Dropped(l any) uint64 {
+	if counter, ok := l.(DropCounter); ok {
+		return counter.Dropped()
+	}
+	return 0
+}
+
+// lineWriter writes lines to a writer in its own goroutine, so that lines written from different goroutines
+// never interleave and the callers only wait for the writer if the buffer is full (or not at all in the
+// non-blocking mode).
+type lineWriter struct {
+	nonBlocking bool
+	dropped     atomic.Uint64
+	// Closed once all lines have been written.
+	done chan struct{}
+	// Protects lines, which is closed once the writer is closed.
+	mutex  sync.RWMutex
+	lines  chan string
+	closed bool
+}
+
+// Starts writing the lines to the given writer, which is closed along with the lineWriter if it is an io.Closer.
+func newLineWriter(writer io.Writer, options Options) *lineWriter {
+	size := options.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	w := &lineWriter{
+		nonBlocking: options.NonBlocking,
+		done:        make(chan struct{}),
+		lines:       make(chan string, size),
+	}
 	go func() {
-		defer wg.Done()
-		defer close(wc)
-		wg.Add(1)
-		if closer, ok := writer.(io.WriteCloser); ok {
+		defer close(w.done)
+		if closer, ok := writer.(io.Closer); ok {
 			defer closer.Close()
 		}
-		for text := range c {
-			_, _ = fmt.Fprint(writer, text)
-			wc <- true
+		for line := range w.lines {
+			_, _ = io.WriteString(writer, line)
 		}
 	}()
-	return &stdLogger{c, wc, &wg}
+	return w
+}
+
+func (w *lineWriter) write(line string) {
+	// Several goroutines may send at the same time, only Close needs the exclusive lock.
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return
+	}
+	if !w.nonBlocking {
+		w.lines <- line
+		return
+	}
+	select {
+	case w.lines <- line:
+	default:
+		w.dropped.Add(1)
+	}
 }
 
-func (l *stdLogger) Close() error {
-	close(l.channel)
-	l.wg.Wait()
+func (w *lineWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Close waits until the pending lines have been written.
+func (w *lineWriter) Close() error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mutex.Unlock()
+	<-w.done
 	return nil
 }
 
+// A default implementation of a logger that avoids parallel printing in different thread
+type stdLogger struct {
+	*lineWriter
+}
+
+// NewLogger creates a new Logger implementation that writes all outputs to the given writer
+func NewLogger(writer io.Writer) Logger {
+	return NewBufferedLogger(writer, Options{})
+}
+
+// NewBufferedLogger creates a Logger like NewLogger that passes the outputs to the writer as configured by options.
+// The returned Logger implements DropCounter.
+func NewBufferedLogger(writer io.Writer, options Options) Logger {
+	return &stdLogger{newLineWriter(writer, options)}
+}
+
 func (l *stdLogger) print(symbol string, tag string, msg string) {
 	t := time.Now()
-	l.channel <- fmt.Sprintf("%s [%s] %s - %s\n", t.Local(), symbol, tag, msg)
-	<-l.waitChannel
+	l.write(fmt.Sprintf("%s [%s] %s - %s\n", t.Local(), symbol, tag, msg))
 }
 
 func (l *stdLogger) Warn(tag string, msg string) {
@@ -80,6 +162,23 @@ func (l *stdLogger) Info(tag string, msg string) {
 type ConnectionInfo struct {
 	IP       string
 	Username string
+	// The name the IP resolves to by reverse DNS. Empty if it is unknown or not resolved at all.
+	Hostname string `json:",omitempty"`
+	// The SHA256 fingerprint of the public key the user has authenticated with. Empty if no key has been used.
+	KeyFingerprint string `json:",omitempty"`
+	// The identification string of the client, the negotiated algorithms and the sftp version, e.g.
+	// "SSH-2.0-OpenSSH_9.6 kex=curve25519-sha256 ... sftp=3". Logged along with the login.
+	Client string `json:",omitempty"`
+	// The id of the sftp session in the statistics. Zero if the filesystem is not created for a session.
+	SessionID uint64 `json:",omitempty"`
+}
+
+// Address returns the IP of the connection along with its hostname if known, e.g. "192.0.2.1:51234 (host.example)".
+func (c ConnectionInfo) Address() string {
+	if c.Hostname == "" {
+		return c.IP
+	}
+	return fmt.Sprintf("%s (%s)", c.IP, c.Hostname)
 }
 
 // AccessLogger is an interface that adds method for logging ssh related actions
@@ -94,31 +193,49 @@ type AccessLogger interface {
 	NewAccess(connection ConnectionInfo, path string, kind string, status string)
 }
 
+// FileAttributes are the attributes a file had before an access changed or removed it.
+type FileAttributes struct {
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// String formats the attributes like "size=12 mode=-rw-r--r-- mtime=2024-01-02T15:04:05Z".
+func (a FileAttributes) String() string {
+	return fmt.Sprintf("size=%d mode=%s mtime=%s", a.Size, a.Mode, a.ModTime.UTC().Format(time.RFC3339))
+}
+
+// ChangeLogger can be implemented by an AccessLogger to log the attributes a file had before an access.
+type ChangeLogger interface {
+	// NewChange is called instead of NewAccess for an access that changed or removed the file at the given path,
+	// which had the previous attributes before.
+	NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes)
+}
+
+// LogChange logs an access that changed the file at the given path along with its previous attributes, if the
+// logger is a ChangeLogger. Otherwise, the access is logged without them.
+func LogChange(l AccessLogger, connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	if changeLogger, ok := l.(ChangeLogger); ok {
+		changeLogger.NewChange(connection, path, kind, status, previous)
+		return
+	}
+	l.NewAccess(connection, path, kind, status)
+}
+
 // AccessLogger that prints all output to an io.Writer and prevents multiple writes from different threads.
 type stdAccessLogger struct {
-	channel     chan<- string
-	waitChannel <-chan bool
-	wg          *sync.WaitGroup
+	*lineWriter
 }
 
 // NewAccessLogger creates a new standard AccessLogger that prints all output to the given writer
 func NewAccessLogger(writer io.Writer) AccessLogger {
-	c := make(chan string)
-	wc := make(chan bool)
-	wg := sync.WaitGroup{}
-	go func() {
-		defer wg.Done()
-		defer close(wc)
-		wg.Add(1)
-		if closer, ok := writer.(io.WriteCloser); ok {
-			defer closer.Close()
-		}
-		for text := range c {
-			_, _ = fmt.Fprintf(writer, "%s\n", text)
-			wc <- true
-		}
-	}()
-	return &stdAccessLogger{c, wc, &wg}
+	return NewBufferedAccessLogger(writer, Options{})
+}
+
+// NewBufferedAccessLogger creates an AccessLogger like NewAccessLogger that passes the output to the writer as
+// configured by options. The returned AccessLogger implements DropCounter.
+func NewBufferedAccessLogger(writer io.Writer, options Options) AccessLogger {
+	return &stdAccessLogger{newLineWriter(writer, options)}
 }
 
 // Collects information about an access log entry
@@ -128,6 +245,10 @@ type entry struct {
 	path           string
 	kind           string
 	status         string
+	// The client of a login (see ConnectionInfo.Client).
+	client string
+	// The attributes of the file before a change (see FileAttributes.String). Empty if unknown.
+	previous string
 }
 
 func (l *stdAccessLogger) printStrings(entries ...string) {
@@ -137,13 +258,14 @@ func (l *stdAccessLogger) printStrings(entries ...string) {
 	for i, e := range entries {
 		values[i+1] = fmt.Sprintf("\"%s\"", strings.ReplaceAll(e, "\"", "\"\""))
 	}
-	l.channel <- strings.Join(values, ",")
-	<-l.waitChannel
+	l.write(strings.Join(values, ",") + "\n")
 }
 
 func (l *stdAccessLogger) printEntry(e entry) {
-	l.printStrings(e.logType, e.connectionInfo.IP, e.connectionInfo.Username,
-		e.path, e.kind, e.status)
+	// The hostname, the client and the previous attributes are appended (empty if unknown or not a login or
+	// change), so the other columns stay where they are.
+	l.printStrings(e.logType, e.connectionInfo.IP, e.connectionInfo.Username, e.path, e.kind, e.status,
+		e.connectionInfo.Hostname, e.client, e.previous)
 }
 
 func (l *stdAccessLogger) NewLogin(connection ConnectionInfo, status string) {
@@ -151,6 +273,7 @@ func (l *stdAccessLogger) NewLogin(connection ConnectionInfo, status string) {
 		logType:        "login",
 		connectionInfo: connection,
 		status:         status,
+		client:         connection.Client,
 	})
 }
 
@@ -171,8 +294,13 @@ func (l *stdAccessLogger) NewAccess(connection ConnectionInfo, path string, kind
 	})
 }
 
-func (l *stdAccessLogger) Close() error {
-	close(l.channel)
-	l.wg.Wait()
-	return nil
+func (l *stdAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.printEntry(entry{
+		logType:        "access",
+		connectionInfo: connection,
+		path:           path,
+		kind:           kind,
+		status:         status,
+		previous:       previous.String(),
+	})
 }
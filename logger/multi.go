@@ -0,0 +1,55 @@
+package logger
+
+import "errors"
+
+// multiAccessLogger passes every entry to several AccessLoggers.
+type multiAccessLogger []AccessLogger
+
+// NewMultiAccessLogger creates an AccessLogger that passes every entry to all the given loggers in their order.
+func NewMultiAccessLogger(loggers ...AccessLogger) AccessLogger {
+	if len(loggers) == 1 {
+		return loggers[0]
+	}
+	return multiAccessLogger(loggers)
+}
+
+func (m multiAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	for _, l := range m {
+		l.NewLogin(connection, status)
+	}
+}
+
+func (m multiAccessLogger) Logout(connection ConnectionInfo) {
+	for _, l := range m {
+		l.Logout(connection)
+	}
+}
+
+func (m multiAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	for _, l := range m {
+		l.NewAccess(connection, path, kind, status)
+	}
+}
+
+func (m multiAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	for _, l := range m {
+		LogChange(l, connection, path, kind, status, previous)
+	}
+}
+
+// Dropped returns the number of entries dropped by all loggers together.
+func (m multiAccessLogger) Dropped() uint64 {
+	var dropped uint64
+	for _, l := range m {
+		dropped += Dropped(l)
+	}
+	return dropped
+}
+
+func (m multiAccessLogger) Close() error {
+	var errs []error
+	for _, l := range m {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// AccessEntry is a single entry of the access log.
+type AccessEntry struct {
+	Time time.Time
+	// Either login, logout or access.
+	Type     string
+	IP       string
+	Hostname string `json:",omitempty"`
+	Username string
+	Path     string
+	// The kind of access. Empty for logins and logouts.
+	Kind   string
+	Status string
+	// The client of a login (see ConnectionInfo.Client).
+	Client string `json:",omitempty"`
+	// The attributes of the file before a change. Nil if unknown.
+	Previous *FileAttributes `json:",omitempty"`
+}
+
+// RecentAccessLogger is an AccessLogger that keeps the last entries in memory and passes every entry
+// on to another AccessLogger.
+type RecentAccessLogger struct {
+	inner AccessLogger
+	// Protects the fields below
+	mutex sync.Mutex
+	// Ring buffer of the entries. next is the index the next entry is written to.
+	entries []AccessEntry
+	next    int
+	full    bool
+}
+
+// NewRecentAccessLogger creates a RecentAccessLogger that keeps the given number of entries
+// and passes every entry to inner.
+func NewRecentAccessLogger(inner AccessLogger, size int) *RecentAccessLogger {
+	return &RecentAccessLogger{inner: inner, entries: make([]AccessEntry, size)}
+}
+
+func (l *RecentAccessLogger) add(e AccessEntry) {
+	if len(l.entries) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Entries returns the kept entries, the newest first.
+func (l *RecentAccessLogger) Entries() []AccessEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	result := make([]AccessEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		result = append(result, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return result
+}
+
+func (l *RecentAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	l.add(AccessEntry{Type: "login", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username, Status: status, Client: connection.Client})
+	l.inner.NewLogin(connection, status)
+}
+
+func (l *RecentAccessLogger) Logout(connection ConnectionInfo) {
+	l.add(AccessEntry{Type: "logout", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username})
+	l.inner.Logout(connection)
+}
+
+func (l *RecentAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	l.add(AccessEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status})
+	l.inner.NewAccess(connection, path, kind, status)
+}
+
+func (l *RecentAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.add(AccessEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status, Previous: &previous})
+	LogChange(l.inner, connection, path, kind, status, previous)
+}
+
+func (l *RecentAccessLogger) Close() error {
+	return l.inner.Close()
+}
@@ -0,0 +1,129 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StreamEntry is an entry of a Logger or an AccessLogger passed on by a Stream.
+type StreamEntry struct {
+	Time time.Time
+	// Either "debug", "info", "warn" or "error" for entries of the Logger, "access" for those of the AccessLogger.
+	Level string
+	// The tag of the Logger, or the type of the access entry (login, logout or access).
+	Tag string
+	// The user of an access entry, empty for the Logger.
+	Username string `json:",omitempty"`
+	Message  string
+}
+
+// Stream passes the entries of a Logger and an AccessLogger to its subscribers, e.g. to follow them live.
+type Stream struct {
+	mutex       sync.RWMutex
+	subscribers map[uint64]func(StreamEntry)
+	// The id of the next subscriber.
+	next uint64
+}
+
+// NewStream creates a Stream without subscribers.
+func NewStream() *Stream {
+	return &Stream{subscribers: make(map[uint64]func(StreamEntry))}
+}
+
+// Subscribe adds a function that is called for every entry. It is called synchronously while logging,
+// so it should not block. The returned function removes the subscriber again.
+func (s *Stream) Subscribe(subscriber func(StreamEntry)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.next
+	s.next++
+	s.subscribers[id] = subscriber
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+func (s *Stream) publish(e StreamEntry) {
+	e.Time = time.Now()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, subscriber := range s.subscribers {
+		subscriber(e)
+	}
+}
+
+// streamLogger is a Logger that passes every entry to another Logger and a Stream.
+type streamLogger struct {
+	inner  Logger
+	stream *Stream
+}
+
+// NewStreamLogger creates a Logger that passes every entry to inner and to the stream.
+func NewStreamLogger(inner Logger, stream *Stream) Logger {
+	return &streamLogger{inner: inner, stream: stream}
+}
+
+func (l *streamLogger) Warn(tag string, msg string) {
+	l.stream.publish(StreamEntry{Level: "warn", Tag: tag, Message: msg})
+	l.inner.Warn(tag, msg)
+}
+
+func (l *streamLogger) Err(tag string, msg string) {
+	l.stream.publish(StreamEntry{Level: "error", Tag: tag, Message: msg})
+	l.inner.Err(tag, msg)
+}
+
+func (l *streamLogger) Debug(tag string, msg string) {
+	l.stream.publish(StreamEntry{Level: "debug", Tag: tag, Message: msg})
+	l.inner.Debug(tag, msg)
+}
+
+func (l *streamLogger) Info(tag string, msg string) {
+	l.stream.publish(StreamEntry{Level: "info", Tag: tag, Message: msg})
+	l.inner.Info(tag, msg)
+}
+
+func (l *streamLogger) Close() error {
+	return l.inner.Close()
+}
+
+// streamAccessLogger is an AccessLogger that passes every entry to another AccessLogger and a Stream.
+type streamAccessLogger struct {
+	inner  AccessLogger
+	stream *Stream
+}
+
+// NewStreamAccessLogger creates an AccessLogger that passes every entry to inner and to the stream.
+func NewStreamAccessLogger(inner AccessLogger, stream *Stream) AccessLogger {
+	return &streamAccessLogger{inner: inner, stream: stream}
+}
+
+func (l *streamAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	l.stream.publish(StreamEntry{Level: "access", Tag: "login", Username: connection.Username,
+		Message: fmt.Sprintf("%s %s %s", connection.Address(), connection.Client, status)})
+	l.inner.NewLogin(connection, status)
+}
+
+func (l *streamAccessLogger) Logout(connection ConnectionInfo) {
+	l.stream.publish(StreamEntry{Level: "access", Tag: "logout", Username: connection.Username, Message: connection.Address()})
+	l.inner.Logout(connection)
+}
+
+func (l *streamAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	l.stream.publish(StreamEntry{Level: "access", Tag: "access", Username: connection.Username,
+		Message: fmt.Sprintf("%s %s %s %s", connection.Address(), kind, path, status)})
+	l.inner.NewAccess(connection, path, kind, status)
+}
+
+func (l *streamAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.stream.publish(StreamEntry{Level: "access", Tag: "access", Username: connection.Username,
+		Message: fmt.Sprintf("%s %s %s %s (before: %s)", connection.Address(), kind, path, status, previous)})
+	LogChange(l.inner, connection, path, kind, status, previous)
+}
+
+func (l *streamAccessLogger) Close() error {
+	return l.inner.Close()
+}
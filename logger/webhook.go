@@ -0,0 +1,121 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of entries waiting to be posted. Further ones are dropped, so a slow receiver does not slow down
+// the server.
+const webhookBuffer = 1024
+
+// webhookAccessLogger posts every entry as json to an url.
+type webhookAccessLogger struct {
+	url     string
+	client  *http.Client
+	onError func(error)
+	done    chan struct{}
+	// Protects entries, which is closed once the logger is closed.
+	mutex   sync.Mutex
+	entries chan jsonEntry
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// NewWebhookAccessLogger creates an AccessLogger that posts every entry as json object (like the JSON
+// AccessLogger writes them) to the url. The entries are posted in the background and dropped if the receiver
+// cannot keep up. The requests are made with the client, or a client with a timeout of 10 seconds if it is nil.
+// Failed requests are passed to onError (if not nil).
+func NewWebhookAccessLogger(url string, client *http.Client, onError func(error)) AccessLogger {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	l := &webhookAccessLogger{
+		url:     url,
+		client:  client,
+		onError: onError,
+		entries: make(chan jsonEntry, webhookBuffer),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Posts the entries until the logger is closed.
+func (l *webhookAccessLogger) run() {
+	defer close(l.done)
+	for e := range l.entries {
+		if err := l.post(e); err != nil && l.onError != nil {
+			l.onError(err)
+		}
+	}
+}
+
+func (l *webhookAccessLogger) post(e jsonEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	response, err := l.client.Post(l.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook %s answered with %s", l.url, response.Status)
+	}
+	return nil
+}
+
+func (l *webhookAccessLogger) write(e jsonEntry) {
+	e.Time = time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *webhookAccessLogger) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+func (l *webhookAccessLogger) NewLogin(connection ConnectionInfo, status string) {
+	l.write(jsonEntry{Type: "login", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username, Status: status, Client: connection.Client})
+}
+
+func (l *webhookAccessLogger) Logout(connection ConnectionInfo) {
+	l.write(jsonEntry{Type: "logout", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username})
+}
+
+func (l *webhookAccessLogger) NewAccess(connection ConnectionInfo, path string, kind string, status string) {
+	l.write(jsonEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status})
+}
+
+func (l *webhookAccessLogger) NewChange(connection ConnectionInfo, path string, kind string, status string, previous FileAttributes) {
+	l.write(jsonEntry{Type: "access", IP: connection.IP, Hostname: connection.Hostname, Username: connection.Username,
+		Path: path, Kind: kind, Status: status, Previous: &previous})
+}
+
+// Close waits until the pending entries have been posted.
+func (l *webhookAccessLogger) Close() error {
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.mutex.Unlock()
+	<-l.done
+	return nil
+}
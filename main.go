@@ -4,6 +4,9 @@ import "os"
 import "fmt"
 import "io"
 
+// The argument the cmd and sftp subcommands take instead of a config file to print their default config.
+const printDefaultFlag = "--print-default"
+
 // A subcommand we support.
 type cmd struct {
 	// The function for handling this command. It will be called with the program arguments for this
@@ -17,6 +20,10 @@ var CMDS = map[string]cmd{
 	"cmd":      {mainCmd, sshcmdhelp},
 	"sftp":     {mainSftp, sftpHelp},
 	"generate": {main_sshgen, sshgenhelp},
+	"sync":     {mainSync, sshsynchelp},
+	"logtail":  {mainLogtail, logtailHelp},
+	"import":   {mainImport, importHelp},
+	"replay":   {mainReplay, replayHelp},
 }
 
 // Prints all available commands to the given writer
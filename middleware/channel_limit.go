@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ChannelCounter counts the open channels (sessions and port forwards) of every ssh connection, as clients
+// like GUI file managers open several ones over a single connection. Channels beyond a limit are rejected.
+type ChannelCounter struct {
+	// Returns the maximal number of channels a connection may have opened at the same time. Zero means no limit.
+	max func(ctx ssh.Context) int
+	// Called whenever a channel is rejected because of the limit. May be nil.
+	onReject func(ctx ssh.Context, channelType string)
+	// Protects counts
+	mutex  sync.Mutex
+	counts map[gossh.Conn]int
+}
+
+// NewChannelCounter creates a ChannelCounter that limits the channels of a connection to max(ctx).
+// onReject is called whenever a channel is rejected and may be nil.
+func NewChannelCounter(max func(ctx ssh.Context) int, onReject func(ctx ssh.Context, channelType string)) *ChannelCounter {
+	return &ChannelCounter{max: max, onReject: onReject, counts: map[gossh.Conn]int{}}
+}
+
+// Count returns the number of open channels of the connection of the given context (e.g. of a [ssh.Session]).
+func (c *ChannelCounter) Count(ctx context.Context) int {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[conn]
+}
+
+// add changes the number of open channels of conn by delta. Adding fails if the limit would be exceeded.
+func (c *ChannelCounter) add(conn gossh.Conn, delta int, max int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, known := c.counts[conn]
+	count := current + delta
+	if delta > 0 && max > 0 && count > max {
+		return false
+	}
+	if !known {
+		if delta < 0 {
+			// The connection has already ended.
+			return true
+		}
+		// The entry is removed along with the connection, which also forgets channels that have never been
+		// accepted or rejected.
+		go func() {
+			_ = conn.Wait()
+			c.mutex.Lock()
+			delete(c.counts, conn)
+			c.mutex.Unlock()
+		}()
+	}
+	c.counts[conn] = count
+	return true
+}
+
+// Limit wraps a [ssh.ChannelHandler] so that its channels are counted and rejected beyond the limit.
+// A channel is counted until it has been closed or rejected.
+func (c *ChannelCounter) Limit(handler ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		if !c.add(conn, 1, c.max(ctx)) {
+			if c.onReject != nil {
+				c.onReject(ctx, newChan.ChannelType())
+			}
+			_ = newChan.Reject(gossh.ResourceShortage, "too many channels")
+			return
+		}
+		counted := &countedNewChannel{NewChannel: newChan}
+		counted.done = func() { c.add(conn, -1, 0) }
+		handler(srv, conn, counted, ctx)
+	}
+}
+
+// countedNewChannel is a [gossh.NewChannel] that calls done once it has been rejected or closed.
+type countedNewChannel struct {
+	gossh.NewChannel
+	done func()
+	once sync.Once
+}
+
+func (c *countedNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	channel, requests, err := c.NewChannel.Accept()
+	if err != nil {
+		c.once.Do(c.done)
+		return channel, requests, err
+	}
+	// The requests are closed along with the channel.
+	forwarded := make(chan *gossh.Request)
+	go func() {
+		defer c.once.Do(c.done)
+		defer close(forwarded)
+		for req := range requests {
+			forwarded <- req
+		}
+	}()
+	return channel, forwarded, nil
+}
+
+func (c *countedNewChannel) Reject(reason gossh.RejectionReason, message string) error {
+	c.once.Do(c.done)
+	return c.NewChannel.Reject(reason, message)
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Names of session requests that can be filtered.
+const (
+	AgentForwardingRequest = "auth-agent-req@openssh.com"
+	X11ForwardingRequest   = "x11-req"
+	PtyRequest             = "pty-req"
+)
+
+// RequestFilter decides whether a request of the given type within a session should be passed on.
+// Rejected requests are answered with a failure.
+type RequestFilter func(ctx ssh.Context, requestType string) bool
+
+// FilterSessionRequests wraps a session [ssh.ChannelHandler] so that every request within the session
+// is checked by the given filter before it reaches the handler.
+func FilterSessionRequests(handler ssh.ChannelHandler, filter RequestFilter) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		handler(srv, conn, filteredNewChannel{newChan, filter, ctx}, ctx)
+	}
+}
+
+// filteredNewChannel is a [gossh.NewChannel] that filters the requests of the channel once accepted.
+type filteredNewChannel struct {
+	gossh.NewChannel
+	filter RequestFilter
+	ctx    ssh.Context
+}
+
+func (f filteredNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	channel, requests, err := f.NewChannel.Accept()
+	if err != nil {
+		return channel, requests, err
+	}
+	filtered := make(chan *gossh.Request)
+	go func() {
+		defer close(filtered)
+		for req := range requests {
+			if !f.filter(f.ctx, req.Type) {
+				if req.WantReply {
+					_ = req.Reply(false, nil)
+				}
+				continue
+			}
+			filtered <- req
+		}
+	}()
+	return channel, filtered, nil
+}
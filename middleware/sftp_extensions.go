@@ -0,0 +1,451 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The types of the packets of the sftp protocol the extension stream has to look at.
+const (
+	sftpVersionPacket       = 2
+	sftpOpenPacket          = 3
+	sftpClosePacket         = 4
+	sftpReadPacket          = 5
+	sftpRealpathPacket      = 16
+	sftpStatusPacket        = 101
+	sftpHandlePacket        = 102
+	sftpDataPacket          = 103
+	sftpExtendedPacket      = 200
+	sftpExtendedReplyPacket = 201
+)
+
+// The extended request that resolves a path like realpath, but also expands a leading "~" to the home directory.
+// It is answered by the realpath request of the server.
+const expandPathExtension = "expand-path@openssh.com"
+
+// Packets larger than this are rejected. The server does not accept them anyway.
+const maxSftpPacket = 1 << 20
+
+// Reads of the files of a FileExtendedHandler return at most this many bytes.
+const maxExtendedRead = 1 << 18
+
+// At most this many extended requests are handled at the same time. Further requests of the client wait until
+// one has finished.
+const maxConcurrentExtended = 8
+
+// The handles of the files of a FileExtendedHandler start with this prefix, which sftp.RequestServer does not
+// use for its handles.
+const extendedHandlePrefix = "ext-"
+
+// ExtendedHandler handles extended requests of the sftp protocol that sftp.RequestServer does not support itself.
+// The FileCmd of the sftp.Handlers can implement it to serve them (see WithExtensions).
+type ExtendedHandler interface {
+	// Extensions returns the names of the handled requests, which are announced to the client.
+	Extensions() []string
+	// Extended handles the request with the given name and its request specific data. The file function returns
+	// the path of a file the client has opened with the given handle. If the returned data is nil, the client
+	// gets a status of the error (or success), otherwise the data is sent as the reply.
+	Extended(request string, data []byte, file func(handle string) (string, bool)) ([]byte, error)
+}
+
+// FileExtendedHandler can be implemented by an ExtendedHandler for extended requests that are answered with a
+// handle, like an open request. The client reads the content from the handle and closes it afterwards.
+type FileExtendedHandler interface {
+	// FileExtensions returns the names of the requests answered with a handle, which are announced to the client.
+	FileExtensions() []string
+	// ExtendedFile handles the request with the given name and its request specific data. The returned reader
+	// is closed with the handle if it is an io.Closer.
+	ExtendedFile(request string, data []byte) (io.ReaderAt, error)
+}
+
+// extensionStream is passed to the sftp.RequestServer instead of the stream of the client and answers the
+// requests of an ExtendedHandler itself.
+type extensionStream struct {
+	// The stream of the client.
+	client io.ReadWriteCloser
+	// The server reads the packets the extension stream passes on from this pipe.
+	requests *io.PipeReader
+	handler  ExtendedHandler
+	// The supported names of the extended requests.
+	extensions map[string]bool
+	// The names of the extended requests answered with a handle.
+	fileExtensions map[string]bool
+	// Protects writing to the client and the buffer.
+	writeMutex sync.Mutex
+	// The part of a packet written by the server that has not been sent yet.
+	buffer []byte
+	// Protects the maps below.
+	mutex sync.Mutex
+	// The paths of the files opened by the requests with the given ids whose handles are not known yet.
+	opening map[uint32]string
+	// The paths of the open files by their handle.
+	handles map[string]string
+	// The open files of the FileExtendedHandler by their handle.
+	files map[string]io.ReaderAt
+	// The number of the next handle of a file of the FileExtendedHandler.
+	nextFile int
+	// Holds a value for every extended request that is currently handled.
+	running chan struct{}
+}
+
+// WithExtensions returns the stream the server for the handlers should use instead of the stream of the client.
+// If the FileCmd of the handlers is an ExtendedHandler, its requests are answered by it. Otherwise, the
+// stream is returned as it is.
+func WithExtensions(stream io.ReadWriteCloser, handlers sftp.Handlers) io.ReadWriteCloser {
+	handler, ok := handlers.FileCmd.(ExtendedHandler)
+	if !ok || len(announcedExtensions(handler)) == 0 {
+		return stream
+	}
+	reader, writer := io.Pipe()
+	s := &extensionStream{
+		client:         stream,
+		requests:       reader,
+		handler:        handler,
+		extensions:     map[string]bool{},
+		fileExtensions: map[string]bool{},
+		opening:        map[uint32]string{},
+		handles:        map[string]string{},
+		files:          map[string]io.ReaderAt{},
+		running:        make(chan struct{}, maxConcurrentExtended),
+	}
+	for _, name := range handler.Extensions() {
+		s.extensions[name] = true
+	}
+	if fileHandler, ok := handler.(FileExtendedHandler); ok {
+		for _, name := range fileHandler.FileExtensions() {
+			s.fileExtensions[name] = true
+		}
+	}
+	go func() {
+		writer.CloseWithError(s.forward(writer))
+	}()
+	return s
+}
+
+// Returns the names of all extended requests of the handler.
+func announcedExtensions(handler ExtendedHandler) []string {
+	names := handler.Extensions()
+	if fileHandler, ok := handler.(FileExtendedHandler); ok {
+		names = append(append([]string{}, names...), fileHandler.FileExtensions()...)
+	}
+	return names
+}
+
+// Reads a string field of a packet at the given offset. Returns the string and the offset after it.
+func packetString(packet []byte, offset int) (string, int, bool) {
+	if len(packet) < offset+4 {
+		return "", 0, false
+	}
+	n := int(binary.BigEndian.Uint32(packet[offset:]))
+	if n > len(packet)-offset-4 {
+		return "", 0, false
+	}
+	return string(packet[offset+4 : offset+4+n]), offset + 4 + n, true
+}
+
+// Appends a string field to a packet.
+func appendString(packet []byte, s string) []byte {
+	packet = binary.BigEndian.AppendUint32(packet, uint32(len(s)))
+	return append(packet, s...)
+}
+
+// Expands a leading "~" or "~/" of a path sent with expand-path to the home directory of the user, which is the
+// root directory. The home directories of other users ("~user") are unknown.
+func expandPath(path string) (string, bool) {
+	if path == "~" {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return "/" + rest, true
+	}
+	return path, !strings.HasPrefix(path, "~")
+}
+
+// Passes the packets of the client on to the server until the client stream ends, except for the extended
+// requests of the handler, which are answered directly.
+func (s *extensionStream) forward(server io.Writer) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(s.client, header); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || length > maxSftpPacket {
+			return errors.New("invalid sftp packet length")
+		}
+		packet := make([]byte, 4+length)
+		copy(packet, header)
+		if _, err := io.ReadFull(s.client, packet[4:]); err != nil {
+			return err
+		}
+		body := packet[4:]
+		if len(body) >= 5 {
+			id := binary.BigEndian.Uint32(body[1:])
+			switch body[0] {
+			case sftpOpenPacket:
+				if path, _, ok := packetString(body, 5); ok {
+					s.mutex.Lock()
+					s.opening[id] = path
+					s.mutex.Unlock()
+				}
+			case sftpClosePacket:
+				if handle, _, ok := packetString(body, 5); ok {
+					if strings.HasPrefix(handle, extendedHandlePrefix) {
+						s.send(statusPacket(id, s.closeFile(handle)))
+						continue
+					}
+					s.mutex.Lock()
+					delete(s.handles, handle)
+					s.mutex.Unlock()
+				}
+			case sftpReadPacket:
+				if handle, offset, ok := packetString(body, 5); ok && strings.HasPrefix(handle, extendedHandlePrefix) {
+					if len(body) < offset+12 {
+						s.send(statusPacket(id, errors.New("invalid read request")))
+						continue
+					}
+					// Generating the content may take a while, so other requests are not blocked by it.
+					start, length := binary.BigEndian.Uint64(body[offset:]), binary.BigEndian.Uint32(body[offset+8:])
+					s.spawn(func() { s.read(id, handle, start, length) })
+					continue
+				}
+			case sftpExtendedPacket:
+				if name, offset, ok := packetString(body, 5); ok && name == expandPathExtension {
+					path, _, ok := packetString(body, offset)
+					if ok {
+						path, ok = expandPath(path)
+					}
+					if !ok {
+						s.send(statusPacket(id, os.ErrNotExist))
+						continue
+					}
+					// The server resolves the expanded path as usual.
+					packet = []byte{0, 0, 0, 0, sftpRealpathPacket}
+					packet = binary.BigEndian.AppendUint32(packet, id)
+					packet = appendString(packet, path)
+					binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+					break
+				}
+				if name, offset, ok := packetString(body, 5); ok && s.extensions[name] {
+					// Copying may take a while, so other requests are not blocked by it.
+					s.spawn(func() { s.answer(id, name, body[offset:]) })
+					continue
+				}
+				if name, offset, ok := packetString(body, 5); ok && s.fileExtensions[name] {
+					s.spawn(func() { s.open(id, name, body[offset:]) })
+					continue
+				}
+			}
+		}
+		if _, err := server.Write(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// Runs the handling of an extended request in its own goroutine. Waits while maxConcurrentExtended requests
+// are handled already, so a client cannot start an unbounded number of them.
+func (s *extensionStream) spawn(handle func()) {
+	s.running <- struct{}{}
+	go func() {
+		defer func() { <-s.running }()
+		handle()
+	}()
+}
+
+// Returns the path of the file opened with the given handle.
+func (s *extensionStream) file(handle string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path, ok := s.handles[handle]
+	return path, ok
+}
+
+// Returns the status code of the sftp protocol for the error.
+func statusCode(err error) uint32 {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, io.EOF):
+		return 1
+	case errors.Is(err, os.ErrNotExist):
+		return 2
+	case errors.Is(err, os.ErrPermission):
+		return 3
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		return 8
+	default:
+		return 4
+	}
+}
+
+// Returns a status packet for the request with the given id that reports the error (or success).
+func statusPacket(id uint32, err error) []byte {
+	packet := []byte{0, 0, 0, 0, sftpStatusPacket}
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	packet = binary.BigEndian.AppendUint32(packet, statusCode(err))
+	message := "Success"
+	if err != nil {
+		message = err.Error()
+	}
+	packet = appendString(packet, message)
+	return appendString(packet, "")
+}
+
+// Sends a packet of the extension stream to the client. The length of the packet is filled in.
+func (s *extensionStream) send(packet []byte) {
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	// If the client is gone, the server notices it as well.
+	_, _ = s.client.Write(packet)
+}
+
+// Handles the extended request with the given id and sends the reply to the client.
+func (s *extensionStream) answer(id uint32, name string, data []byte) {
+	reply, err := s.handler.Extended(name, data, s.file)
+	if reply == nil || err != nil {
+		s.send(statusPacket(id, err))
+		return
+	}
+	packet := []byte{0, 0, 0, 0, sftpExtendedReplyPacket}
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	s.send(append(packet, reply...))
+}
+
+// Handles the extended request of the FileExtendedHandler with the given id and sends the handle of the file
+// to the client.
+func (s *extensionStream) open(id uint32, name string, data []byte) {
+	file, err := s.handler.(FileExtendedHandler).ExtendedFile(name, data)
+	if err != nil {
+		s.send(statusPacket(id, err))
+		return
+	}
+	s.mutex.Lock()
+	handle := extendedHandlePrefix + strconv.Itoa(s.nextFile)
+	s.nextFile++
+	s.files[handle] = file
+	s.mutex.Unlock()
+	packet := []byte{0, 0, 0, 0, sftpHandlePacket}
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	s.send(appendString(packet, handle))
+}
+
+// Reads from a file of the FileExtendedHandler and sends the data to the client.
+func (s *extensionStream) read(id uint32, handle string, offset uint64, length uint32) {
+	s.mutex.Lock()
+	file, ok := s.files[handle]
+	s.mutex.Unlock()
+	if !ok {
+		s.send(statusPacket(id, os.ErrInvalid))
+		return
+	}
+	data := make([]byte, min(length, maxExtendedRead))
+	n, err := file.ReadAt(data, int64(offset))
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		s.send(statusPacket(id, err))
+		return
+	}
+	packet := []byte{0, 0, 0, 0, sftpDataPacket}
+	packet = binary.BigEndian.AppendUint32(packet, id)
+	s.send(appendString(packet, string(data[:n])))
+}
+
+// Closes a file of the FileExtendedHandler.
+func (s *extensionStream) closeFile(handle string) error {
+	s.mutex.Lock()
+	file, ok := s.files[handle]
+	delete(s.files, handle)
+	s.mutex.Unlock()
+	if !ok {
+		return os.ErrInvalid
+	}
+	if closer, ok := file.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	return nil
+}
+
+func (s *extensionStream) Read(p []byte) (int, error) {
+	return s.requests.Read(p)
+}
+
+// Write collects the packets of the server, so they are not interleaved with the replies of the handler.
+func (s *extensionStream) Write(p []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.buffer = append(s.buffer, p...)
+	for len(s.buffer) >= 4 {
+		length := int(binary.BigEndian.Uint32(s.buffer))
+		if len(s.buffer) < 4+length {
+			break
+		}
+		packet := s.inspect(s.buffer[:4+length])
+		if _, err := s.client.Write(packet); err != nil {
+			return 0, err
+		}
+		s.buffer = s.buffer[4+length:]
+	}
+	if len(s.buffer) == 0 {
+		s.buffer = nil
+	}
+	return len(p), nil
+}
+
+// Looks at a complete packet of the server before it is sent. Returns the packet to send instead.
+func (s *extensionStream) inspect(packet []byte) []byte {
+	body := packet[4:]
+	if len(body) < 5 {
+		return packet
+	}
+	switch body[0] {
+	case sftpVersionPacket:
+		// Announces the extensions along with the ones of the server.
+		extended := append([]byte{}, packet...)
+		for _, name := range append(announcedExtensions(s.handler), expandPathExtension) {
+			extended = appendString(extended, name)
+			extended = appendString(extended, "1")
+		}
+		binary.BigEndian.PutUint32(extended, uint32(len(extended)-4))
+		return extended
+	case sftpHandlePacket:
+		id := binary.BigEndian.Uint32(body[1:])
+		s.mutex.Lock()
+		if path, ok := s.opening[id]; ok {
+			if handle, _, ok := packetString(body, 5); ok {
+				s.handles[handle] = path
+			}
+			delete(s.opening, id)
+		}
+		s.mutex.Unlock()
+	case sftpStatusPacket:
+		// The file could not be opened.
+		id := binary.BigEndian.Uint32(body[1:])
+		s.mutex.Lock()
+		delete(s.opening, id)
+		s.mutex.Unlock()
+	}
+	return packet
+}
+
+func (s *extensionStream) Close() error {
+	s.mutex.Lock()
+	for handle := range s.files {
+		if closer, ok := s.files[handle].(io.Closer); ok {
+			_ = closer.Close()
+		}
+		delete(s.files, handle)
+	}
+	s.mutex.Unlock()
+	_ = s.requests.Close()
+	return s.client.Close()
+}
@@ -1,28 +1,104 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"github.com/Entscheider/sshtool/logger"
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"log"
 )
 
+// The type of the first packet of the sftp protocol, which contains the version of the client.
+const sftpInitPacket = 1
+
 // Handler is a function that handles a new connection and creates the desired sftp.Handlers filesystem
-// to serve for this connection.
-type Handler func(info logger.ConnectionInfo) sftp.Handlers
+// to serve for this connection. The session can be used to terminate the connection. The returned function is called once the connection has ended and can be
+// used to release resources (it may be nil).
+type Handler func(info logger.ConnectionInfo, session ssh.Session) (sftp.Handlers, func())
+
+// ContextKeyHostname is the key of a func() string in the context of a connection that returns the hostname of
+// the client. It is set by servers that resolve the addresses of their clients.
+var ContextKeyHostname = &struct{ name string }{"hostname"}
+
+// NewConnectionInfo creates the meta information about the connection of the given session.
+func NewConnectionInfo(s ssh.Session) logger.ConnectionInfo {
+	info := logger.ConnectionInfo{
+		Username: s.User(),
+		IP:       s.RemoteAddr().String(),
+	}
+	if key := s.PublicKey(); key != nil {
+		info.KeyFingerprint = gossh.FingerprintSHA256(key)
+	}
+	if ctx, ok := s.Context().(ssh.Context); ok {
+		info.Client = describeClient(ctx)
+		if hostname, ok := ctx.Value(ContextKeyHostname).(func() string); ok {
+			info.Hostname = hostname()
+		}
+	}
+	return info
+}
+
+// Describes the identification string of the client and the algorithms negotiated with it.
+func describeClient(ctx ssh.Context) string {
+	description := ctx.ClientVersion()
+	var conn gossh.Conn
+	if serverConn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn); ok {
+		// The ServerConn only exposes the methods of the Conn interface.
+		conn = serverConn.Conn
+	}
+	if metadata, ok := conn.(gossh.AlgorithmsConnMetadata); ok {
+		algorithms := metadata.Algorithms()
+		description += fmt.Sprintf(" kex=%s hostkey=%s cipher=%s", algorithms.KeyExchange, algorithms.HostKey, algorithms.Read.Cipher)
+		// Ciphers like chacha20-poly1305 need no separate mac.
+		if algorithms.Read.MAC != "" {
+			description += " mac=" + algorithms.Read.MAC
+		}
+	}
+	return description
+}
+
+// sftpStream is the stream of an sftp session whose first bytes have already been read.
+type sftpStream struct {
+	io.Reader
+	ssh.Session
+}
+
+func (s sftpStream) Read(p []byte) (int, error) {
+	return s.Reader.Read(p)
+}
+
+// PeekSFTPVersion reads the version from the first packet the client has sent within the session. The returned
+// stream replays the read bytes, so it has to be used instead of the session. The version is zero if the
+// packet is not the expected one.
+func PeekSFTPVersion(s ssh.Session) (uint32, io.ReadWriteCloser) {
+	// The length, the type and the version of the packet.
+	header := make([]byte, 9)
+	n, err := io.ReadFull(s, header)
+	stream := sftpStream{Reader: io.MultiReader(bytes.NewReader(header[:n]), s), Session: s}
+	if err != nil || header[4] != sftpInitPacket {
+		return 0, stream
+	}
+	return binary.BigEndian.Uint32(header[5:]), stream
+}
 
 // A function that wraps the given handler into an ssh.SubsystemHandler and logs access using the accessLogger.
 func subsystemHandler(handler Handler, accessLogger logger.AccessLogger) ssh.SubsystemHandler {
 	return func(s ssh.Session) {
 		// Create the meta information object.
-		info := logger.ConnectionInfo{
-			Username: s.User(),
-			IP:       s.RemoteAddr().String(),
-		}
+		info := NewConnectionInfo(s)
+		version, stream := PeekSFTPVersion(s)
+		info.Client += fmt.Sprintf(" sftp=%d", version)
 		accessLogger.NewLogin(info, "granted")
 		// Create a new sftp server that handles this connection using the filesystem from the handler.
-		server := sftp.NewRequestServer(s, handler(info))
+		handlers, cleanup := handler(info, s)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		server := sftp.NewRequestServer(WithExtensions(stream, handlers), handlers)
 		// A channel whose closing signals that the sftp connection has ended.
 		servingChan := make(chan bool)
 		// Serving the client in a separate go routine.
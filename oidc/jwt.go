@@ -0,0 +1,153 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Claims are the claims of a verified id token.
+type Claims map[string]interface{}
+
+// String returns the claim with the given name if it is a string.
+func (c Claims) String(name string) (string, bool) {
+	value, ok := c[name].(string)
+	return value, ok
+}
+
+// keySet contains the rsa keys of the provider by their key id.
+type keySet map[string]*rsa.PublicKey
+
+// jwk is a single key of a json web key set.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Fetches the keys of the provider. They are cached until a token with an unknown key id is encountered.
+func (p *Provider) getKeys(ctx context.Context, kid string) (keySet, error) {
+	p.mutex.Lock()
+	keys := p.keys
+	p.mutex.Unlock()
+	if keys != nil {
+		if _, ok := (*keys)[kid]; ok {
+			return *keys, nil
+		}
+	}
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	result := keySet{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			continue
+		}
+		result[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mutex.Lock()
+	p.keys = &result
+	p.mutex.Unlock()
+	return result, nil
+}
+
+// VerifyIDToken checks the signature (RS256 only), issuer, audience and expiration of the id token
+// and returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %s", header.Alg)
+	}
+	keys, err := p.getKeys(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %s", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid id token signature")
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if issuer, _ := claims.String("iss"); issuer != d.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %s", issuer)
+	}
+	if !claims.hasAudience(p.ClientID) {
+		return nil, fmt.Errorf("id token is not issued for this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("id token has expired")
+	}
+	return claims, nil
+}
+
+// hasAudience checks whether the aud claim (a string or a list of strings) contains the given audience.
+func (c Claims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Decodes a base64 encoded json segment of a token into v.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,198 @@
+// Package oidc implements the OAuth 2.0 device authorization grant (RFC 8628) against an OpenID Connect provider
+// and the verification of the returned id tokens.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDenied is returned if the user has denied the authorization or has not completed it in time.
+var ErrDenied = fmt.Errorf("authorization denied")
+
+// Provider is an OpenID Connect provider supporting the device authorization grant.
+type Provider struct {
+	// The issuer url. The endpoints are discovered from "<Issuer>/.well-known/openid-configuration".
+	Issuer string
+	// The id of this client registered at the provider.
+	ClientID string
+	// The secret of this client. May be empty for public clients.
+	ClientSecret string
+	// The requested scopes. "openid" is always requested.
+	Scopes []string
+	// The client used for all requests.
+	Client *http.Client
+
+	mutex     sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+// discovery contains the parts of the provider metadata we need.
+type discovery struct {
+	Issuer                      string `json:"issuer"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	JwksURI                     string `json:"jwks_uri"`
+}
+
+// DeviceAuthorization is the answer of the provider to a new device authorization request.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// tokenResponse is the answer of the token endpoint, either successful or with an error.
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+// NewProvider creates a new Provider for the given issuer and client.
+func NewProvider(issuer, clientID, clientSecret string, scopes []string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+		Client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Fetches the provider metadata once and caches it.
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d discovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.DeviceAuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, fmt.Errorf("provider %s does not support the device authorization grant", p.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// Requests the url and decodes the json answer into v.
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Posts the form with the client credentials to the endpoint and decodes the json answer into v.
+// Returns the status code of the answer.
+func (p *Provider) postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) (int, error) {
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s answered with %s", endpoint, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// StartDeviceFlow requests a new device code. The user has to open the returned verification uri
+// and enter the user code, before the login can be completed with WaitForLogin.
+func (p *Provider) StartDeviceFlow(ctx context.Context) (*DeviceAuthorization, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scopes := append([]string{"openid"}, p.Scopes...)
+	var auth DeviceAuthorization
+	status, err := p.postForm(ctx, d.DeviceAuthorizationEndpoint, url.Values{"scope": {strings.Join(scopes, " ")}}, &auth)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || auth.DeviceCode == "" {
+		return nil, fmt.Errorf("device authorization failed with status %d", status)
+	}
+	return &auth, nil
+}
+
+// WaitForLogin polls the provider until the user has completed the authorization started with StartDeviceFlow.
+// It returns the verified claims of the id token.
+func (p *Provider) WaitForLogin(ctx context.Context, auth *DeviceAuthorization) (Claims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if auth.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(auth.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	form := url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {auth.DeviceCode},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrDenied
+		case <-time.After(interval):
+		}
+		var token tokenResponse
+		_, err := p.postForm(ctx, d.TokenEndpoint, form, &token)
+		if err != nil {
+			return nil, err
+		}
+		switch token.Error {
+		case "":
+			return p.VerifyIDToken(ctx, token.IDToken)
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied", "expired_token":
+			return nil, ErrDenied
+		default:
+			return nil, fmt.Errorf("token request failed: %s", token.Error)
+		}
+	}
+}
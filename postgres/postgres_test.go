@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer accepts a single connection, refuses TLS, reads the startup message and lets serve answer the
+// messages of the client. Returns the url to connect to.
+func fakeServer(t *testing.T, serve func(server *Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server := &Conn{conn: conn, reader: bufio.NewReader(conn), timeout: time.Second}
+		for _, answer := range []byte{'N', 0} {
+			var length uint32
+			if binary.Read(server.reader, binary.BigEndian, &length) != nil || length < 8 {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, server.reader, int64(length-4)); err != nil {
+				return
+			}
+			if answer != 0 {
+				_, _ = conn.Write([]byte{answer})
+			}
+		}
+		serve(server)
+	}()
+	return "postgres://alice:secret@" + listener.Addr().String() + "/users?sslmode=prefer"
+}
+
+// Sends an authentication request with the given data.
+func authenticate(server *Conn, method uint32, data string) {
+	_ = server.send('R', append(binary.BigEndian.AppendUint32(nil, method), data...))
+}
+
+// Accepts the login and waits for queries.
+func ready(server *Conn) {
+	authenticate(server, authOK, "")
+	_ = server.send('Z', []byte{'I'})
+}
+
+// scramServer logs in with SCRAM-SHA-256 for the password "secret", but signs its final message with the
+// signingPassword. If skipFinal is set, the login is accepted without the final message.
+func scramServer(signingPassword string, skipFinal bool) func(server *Conn) {
+	return func(server *Conn) {
+		authenticate(server, authSASL, "SCRAM-SHA-256\x00\x00")
+		_, body, err := server.receive()
+		if err != nil {
+			return
+		}
+		_, clientFirst, _ := strings.Cut(string(body), "n,,")
+		_, clientNonce, _ := strings.Cut(clientFirst, "r=")
+		salt := []byte("salt")
+		serverFirst := "r=" + clientNonce + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+		authenticate(server, authSASLContinue, serverFirst)
+		if _, body, err = server.receive(); err != nil {
+			return
+		}
+		withoutProof, proof, _ := strings.Cut(string(body), ",p=")
+		authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+		saltedPassword, _ := pbkdf2.Key(sha256.New, "secret", salt, 4096, sha256.Size)
+		clientKey := hmacSHA256(saltedPassword, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		signature := hmacSHA256(storedKey[:], authMessage)
+		for i := range clientKey {
+			clientKey[i] ^= signature[i]
+		}
+		if proof != base64.StdEncoding.EncodeToString(clientKey) {
+			_ = server.send('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+		if !skipFinal {
+			signingKey, _ := pbkdf2.Key(sha256.New, signingPassword, salt, 4096, sha256.Size)
+			serverSignature := hmacSHA256(hmacSHA256(signingKey, "Server Key"), authMessage)
+			authenticate(server, authSASLFinal, "v="+base64.StdEncoding.EncodeToString(serverSignature))
+		}
+		ready(server)
+	}
+}
+
+func TestDialAuthentication(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   func(server *Conn)
+		wantErr string
+	}{
+		{"scram", scramServer("secret", false), ""},
+		{"scram with a wrong signature", scramServer("guessed", false), "signature"},
+		{"scram without signature", scramServer("secret", true), "not proven"},
+		{"cleartext without tls", func(server *Conn) {
+			authenticate(server, authCleartextPassword, "")
+			if _, body, err := server.receive(); err == nil && strings.Contains(string(body), "secret") {
+				t.Error("the password has been sent without TLS")
+			}
+		}, "without TLS"},
+		{"md5 without tls", func(server *Conn) {
+			authenticate(server, authMD5Password, "salt")
+		}, "without TLS"},
+		{"error", func(server *Conn) {
+			_ = server.send('E', []byte("SFATAL\x00C3D000\x00Mdatabase does not exist\x00\x00"))
+		}, "database does not exist"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := Dial(fakeServer(t, test.serve), time.Second)
+			if err == nil {
+				_ = conn.Close()
+			}
+			if test.wantErr == "" && err != nil {
+				t.Errorf("Dial() = %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("Dial() = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// Appends a value of a DataRow, where nil is NULL.
+func appendValue(row []byte, value *string) []byte {
+	if value == nil {
+		return binary.BigEndian.AppendUint32(row, 0xffffffff)
+	}
+	return append(binary.BigEndian.AppendUint32(row, uint32(len(*value))), *value...)
+}
+
+func TestQuery(t *testing.T) {
+	name, config := "alice", `{"CanRead": [".*"]}`
+	url := fakeServer(t, func(server *Conn) {
+		ready(server)
+		var bind []byte
+		for {
+			messageType, body, err := server.receive()
+			if err != nil {
+				return
+			}
+			if messageType == 'B' {
+				bind = body
+			}
+			if messageType != 'S' {
+				continue
+			}
+			// The query of the portal "" with the statement "" has a single parameter "alice".
+			if string(bind) != "\x00\x00\x00\x00\x00\x01\x00\x00\x00\x05alice\x00\x00" {
+				_ = server.send('E', []byte("SERROR\x00C08P01\x00Minvalid bind\x00\x00"))
+				_ = server.send('Z', []byte{'I'})
+				continue
+			}
+			row := appendValue(appendValue(appendValue(binary.BigEndian.AppendUint16(nil, 3), &name), nil), &config)
+			_ = server.send('D', row)
+			_ = server.send('C', []byte("SELECT 1\x00"))
+			_ = server.send('Z', []byte{'I'})
+		}
+	})
+	conn, err := Dial(url, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rows, err := conn.Query("SELECT name, NULL, config FROM users WHERE name = $1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || strings.Join(rows[0], "|") != "alice||"+config {
+		t.Errorf("Query() = %q", rows)
+	}
+	if _, err := conn.Query("SELECT", "bob"); err == nil || !strings.Contains(err.Error(), "invalid bind") {
+		t.Errorf("Query() with an error = %v", err)
+	}
+	// The connection is still usable after an error.
+	if _, err := conn.Query("SELECT", "alice"); err != nil {
+		t.Errorf("Query() after an error = %v", err)
+	}
+}
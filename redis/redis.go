@@ -0,0 +1,266 @@
+// Package redis provides a minimal client for the redis protocol (RESP), which is enough to share state between
+// several servers.
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNil is returned by the helper functions if the server answered with nil (e.g. for a missing key).
+var ErrNil = fmt.Errorf("redis: nil")
+
+// Error is an error answer of the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// How many idle connections are kept open.
+const maxIdleConnections = 8
+
+// Client sends commands to a redis server. It is safe for concurrent use and keeps a few connections open.
+type Client struct {
+	// The address of the server like "localhost:6379".
+	Address string
+	// The password to authenticate with. Empty for no authentication.
+	Password string
+	// The database to select.
+	DB int
+	// The timeout for connecting and for every command.
+	Timeout time.Duration
+	idle    chan *conn
+}
+
+// NewClient creates a Client for the server at the given address.
+func NewClient(address, password string, db int) *Client {
+	return &Client{Address: address, Password: password, DB: db, Timeout: 5 * time.Second, idle: make(chan *conn, maxIdleConnections)}
+}
+
+// conn is a single connection to the server.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Sends the command and reads the answer.
+func (c *conn) do(timeout time.Duration, args []string) (interface{}, error) {
+	_ = c.SetDeadline(time.Now().Add(timeout))
+	var request strings.Builder
+	_, _ = fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		_, _ = fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, request.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// Reads a single answer of the server.
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, length)
+		for i := range array {
+			if array[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+// Returns an idle connection or opens a new one.
+func (c *Client) get() (*conn, error) {
+	select {
+	case idle := <-c.idle:
+		return idle, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", c.Address, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	result := &conn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	var setup [][]string
+	if c.Password != "" {
+		setup = append(setup, []string{"AUTH", c.Password})
+	}
+	if c.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.DB)})
+	}
+	for _, args := range setup {
+		reply, err := result.do(c.Timeout, args)
+		if replyErr, ok := reply.(Error); ok && err == nil {
+			err = replyErr
+		}
+		if err != nil {
+			_ = result.Close()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Keeps the connection for the next command or closes it if there are enough idle connections.
+func (c *Client) put(idle *conn) {
+	select {
+	case c.idle <- idle:
+	default:
+		_ = idle.Close()
+	}
+}
+
+// Do sends a command like "SET", "key", "value" and returns the answer. The answer is a string, an int64,
+// nil or a []interface{} of these. Error answers of the server are returned as Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	connection, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := connection.do(c.Timeout, args)
+	if err != nil {
+		// The state of the connection is unknown, so we do not reuse it.
+		_ = connection.Close()
+		return nil, err
+	}
+	c.put(connection)
+	if replyErr, ok := reply.(Error); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+}
+
+// Close closes all idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case idle := <-c.idle:
+			_ = idle.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Int converts the answer of Do into an integer.
+func Int(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch value := reply.(type) {
+	case int64:
+		return value, nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+}
+
+// String converts the answer of Do into a string.
+func String(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch value := reply.(type) {
+	case string:
+		return value, nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case nil:
+		return "", ErrNil
+	}
+	return "", fmt.Errorf("redis: unexpected reply %v", reply)
+}
+
+// Strings converts the answer of Do into a list of strings. Nil entries become empty strings.
+func Strings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	array, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	result := make([]string, len(array))
+	for i, entry := range array {
+		if entry == nil {
+			continue
+		}
+		if result[i], err = String(entry, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Scan returns all keys matching the pattern (like "prefix:*") using SCAN.
+func (c *Client) Scan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		array, ok := reply.([]interface{})
+		if !ok || len(array) != 2 {
+			return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		if cursor, err = String(array[0], nil); err != nil {
+			return nil, err
+		}
+		found, err := Strings(array[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
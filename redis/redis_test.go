@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer answers every command with the reply returned for its arguments. The replies are written one byte at
+// a time, so the client has to read them in parts. Returns the address of the server.
+func fakeServer(t *testing.T, reply func(args []string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					for _, b := range []byte(reply(args)) {
+						if _, err := conn.Write([]byte{b}); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Reads a command sent as array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	var count int
+	if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		var length int
+		if _, err := fmt.Fscanf(reader, "$%d\r\n", &length); err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+func TestDo(t *testing.T) {
+	address := fakeServer(t, func(args []string) string {
+		switch strings.Join(args, " ") {
+		case "AUTH secret", "SELECT 2":
+			return "+OK\r\n"
+		case "GET text":
+			return "$12\r\nhello\r\nworld\r\n"
+		case "GET empty":
+			return "$0\r\n\r\n"
+		case "GET missing":
+			return "$-1\r\n"
+		case "INCRBY counter -3":
+			return ":-2\r\n"
+		case "LRANGE list":
+			return "*3\r\n$1\r\na\r\n$-1\r\n*2\r\n:1\r\n+nested\r\n"
+		}
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	})
+	client := NewClient(address, "secret", 2)
+	client.Timeout = time.Second
+	defer client.Close()
+	tests := []struct {
+		args    []string
+		want    interface{}
+		wantErr error
+	}{
+		{[]string{"GET", "text"}, "hello\r\nworld", nil},
+		{[]string{"GET", "empty"}, "", nil},
+		{[]string{"GET", "missing"}, nil, nil},
+		{[]string{"INCRBY", "counter", "-3"}, int64(-2), nil},
+		{[]string{"LRANGE", "list"}, []interface{}{"a", nil, []interface{}{int64(1), "nested"}}, nil},
+		{[]string{"UNKNOWN"}, nil, Error("ERR unknown command 'UNKNOWN'")},
+	}
+	for _, test := range tests {
+		reply, err := client.Do(test.args...)
+		if !reflect.DeepEqual(reply, test.want) || !errors.Is(err, test.wantErr) {
+			t.Errorf("Do(%q) = %#v, %v, want %#v, %v", test.args, reply, err, test.want, test.wantErr)
+		}
+	}
+	// The connection is still usable after an error answer.
+	if value, err := String(client.Do("GET", "text")); err != nil || value != "hello\r\nworld" {
+		t.Errorf("GET after an error = %q, %v", value, err)
+	}
+	if _, err := Int(client.Do("GET", "missing")); !errors.Is(err, ErrNil) {
+		t.Errorf("Int() of nil = %v, want ErrNil", err)
+	}
+}
+
+func TestDoInvalidReply(t *testing.T) {
+	address := fakeServer(t, func(args []string) string {
+		if args[0] == "TRUNCATED" {
+			// The bulk string is shorter than announced.
+			return "$10\r\nshort\r\n"
+		}
+		return "?invalid\r\n"
+	})
+	client := NewClient(address, "", 0)
+	client.Timeout = 100 * time.Millisecond
+	defer client.Close()
+	if _, err := client.Do("INVALID"); err == nil {
+		t.Error("Do() with an invalid reply succeeded")
+	}
+	if _, err := client.Do("TRUNCATED"); err == nil {
+		t.Error("Do() with a truncated reply succeeded")
+	}
+}
+
+func TestDoAuthenticationFails(t *testing.T) {
+	address := fakeServer(t, func(args []string) string {
+		return "-WRONGPASS invalid password\r\n"
+	})
+	client := NewClient(address, "wrong", 0)
+	client.Timeout = time.Second
+	if _, err := client.Do("GET", "key"); !errors.Is(err, Error("WRONGPASS invalid password")) {
+		t.Errorf("Do() with a wrong password = %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	address := fakeServer(t, func(args []string) string {
+		if len(args) != 6 || args[0] != "SCAN" || args[3] != "prefix:*" {
+			return "-ERR syntax error\r\n"
+		}
+		// Two pages with the cursors 0 and 7.
+		if cursor, _ := strconv.Atoi(args[1]); cursor == 0 {
+			return "*2\r\n$1\r\n7\r\n*2\r\n$8\r\nprefix:a\r\n$8\r\nprefix:b\r\n"
+		}
+		return "*2\r\n$1\r\n0\r\n*1\r\n$8\r\nprefix:c\r\n"
+	})
+	client := NewClient(address, "", 0)
+	client.Timeout = time.Second
+	defer client.Close()
+	keys, err := client.Scan("prefix:*")
+	if err != nil || strings.Join(keys, ",") != "prefix:a,prefix:b,prefix:c" {
+		t.Errorf("Scan() = %q, %v", keys, err)
+	}
+}
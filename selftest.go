@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Entscheider/sshtool/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// selfTestCheck is the result of a single check of the self-test.
+type selfTestCheck struct {
+	// What has been checked: "host_key", "listen", "privileges", "mount" or "command".
+	Check string
+	// The checked thing, e.g. the file of a host key, an address or the user and the name of a directory.
+	Target string
+	// Why the check has failed. Empty if it has passed.
+	Error string `json:",omitempty"`
+}
+
+// selfTestReport is the summary of the self-test, which is written as json if a check has failed.
+type selfTestReport struct {
+	Passed bool
+	Checks []selfTestCheck
+}
+
+// add records the result of a check.
+func (r *selfTestReport) add(check string, target string, err error) {
+	result := selfTestCheck{Check: check, Target: target}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, result)
+}
+
+// finish decides whether the self-test has passed. If not, the failed checks are logged along with the report
+// and the application exits.
+func (r *selfTestReport) finish() {
+	failed := 0
+	for _, check := range r.Checks {
+		if check.Error != "" {
+			log.Printf("Self-test: %s %s failed: %s\n", check.Check, check.Target, check.Error)
+			failed += 1
+		}
+	}
+	r.Passed = failed == 0
+	if r.Passed {
+		log.Printf("Self-test passed (%d checks)\n", len(r.Checks))
+		return
+	}
+	data, _ := json.Marshal(r)
+	ErrPrintf("%s\n", data)
+	fatal(fmt.Errorf("self-test failed with %d problems, set SkipSelfTest to start anyway", failed))
+}
+
+// checkServerKey checks whether the host key can be loaded. A missing key is generated at the start, so only
+// its directory must exist.
+func checkServerKey(filename string) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, err := os.Stat(filepath.Dir(filename))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = ssh.ParsePrivateKey(data)
+	return err
+}
+
+// checkListen checks whether the server can listen on the address.
+func checkListen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// selfTest checks the host keys and the address of the server.
+func (c *Config) selfTest(report *selfTestReport) {
+	if len(c.ServerKeyFilename) == 0 {
+		report.add("host_key", "", fmt.Errorf("at least one host key is required"))
+	}
+	for _, filename := range c.ServerKeyFilename {
+		report.add("host_key", filename, checkServerKey(filename))
+	}
+	address := fmt.Sprintf("%s:%d", c.Host, c.Port)
+	report.add("listen", address, checkListen(address))
+}
+
+// selfTest checks everything the sftp server needs before it starts: the host keys, the addresses of the
+// server, the admin api and the statistics, the RunAs settings and every directory of the users.
+func (c *ContextSftp) selfTest() selfTestReport {
+	config := c.currentConfig()
+	var report selfTestReport
+	config.Config.selfTest(&report)
+	for _, address := range []string{config.AdminAddress, config.MetricsAddress} {
+		if address != "" {
+			report.add("listen", address, checkListen(address))
+		}
+	}
+	report.add("privileges", "RunAs", config.checkPrivilegeSeparation())
+	var usernames []string
+	for username := range config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	var mounts []selfTestCheck
+	var owners, names []string
+	for _, username := range usernames {
+		var userNames []string
+		for name := range config.Users[username].Filesystem {
+			userNames = append(userNames, name)
+		}
+		sort.Strings(userNames)
+		for _, name := range userNames {
+			mounts = append(mounts, selfTestCheck{Check: "mount", Target: username + "/" + name})
+			owners, names = append(owners, username), append(names, name)
+		}
+	}
+	// Unavailable directories take a while to answer, so they are all checked at once.
+	var wg sync.WaitGroup
+	for i := range mounts {
+		username, name := owners[i], names[i]
+		userEntry := config.Users[username]
+		wg.Add(1)
+		go func(result *selfTestCheck) {
+			defer wg.Done()
+			fs, err := config.createMountFS(logger.ConnectionInfo{Username: username}, name, userEntry, userEntry.Filesystem[name], c.shared)
+			if err == nil {
+				err = statRoot(fs)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}(&mounts[i])
+	}
+	wg.Wait()
+	report.Checks = append(report.Checks, mounts...)
+	return report
+}
+
+// selfTest checks everything the cmd server needs before it starts: the host keys, its address and the Command.
+func (c *ContextCmd) selfTest() selfTestReport {
+	config := c.currentConfig()
+	var report selfTestReport
+	config.Config.selfTest(&report)
+	_, err := exec.LookPath(config.Command)
+	report.add("command", config.Command, err)
+	return report
+}
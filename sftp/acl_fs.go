@@ -0,0 +1,280 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ACLRule grants access to a directory or file along with everything below it.
+type ACLRule struct {
+	// The slash separated path the rule applies to, e.g. "/projects/www".
+	Path string
+	// Whether files can be read.
+	Read bool
+	// Whether files and directories can be created, changed and removed.
+	Write bool
+	// Whether directories can be listed.
+	List bool
+}
+
+// ACLWrapperFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and rejects operations according
+// to a list of [sftp.ACLRule]. The rule with the longest path containing a file decides about it, files without
+// any rule cannot be accessed at all. The directories leading to a path some rule grants access to can be listed,
+// but only show the entries leading there.
+type ACLWrapperFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The rules, in any order.
+	Rules []ACLRule
+	// Whether operations violating the rules are only reported to OnDenied instead of being rejected.
+	AuditOnly bool
+	// Is called with the operation (e.g. "Write") and the path of every violation if AuditOnly is set.
+	// May be nil.
+	OnDenied func(operation string, path string)
+}
+
+// Whether a rule for rulePath applies to p, i.e. p is rulePath or below it.
+func covers(rulePath, p string) bool {
+	return rulePath == "/" || p == rulePath || strings.HasPrefix(p, rulePath+"/")
+}
+
+// Whether the rule grants anything.
+func (r ACLRule) grants() bool {
+	return r.Read || r.Write || r.List
+}
+
+// Returns the rule deciding about the path, which grants nothing if there is none.
+func (a ACLWrapperFS) rule(p string) ACLRule {
+	p = path.Clean("/" + p)
+	var found ACLRule
+	for _, r := range a.Rules {
+		if covers(r.Path, p) && (found.Path == "" || len(r.Path) > len(found.Path)) {
+			found = r
+		}
+	}
+	return found
+}
+
+// Whether a rule for a path below p grants anything, so p leads to it.
+func (a ACLWrapperFS) leadsToGranted(p string) bool {
+	p = path.Clean("/" + p)
+	for _, r := range a.Rules {
+		if r.Path != p && covers(p, r.Path) && r.grants() {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any rule applies to a path below p, so the entries of p have to be filtered.
+func (a ACLWrapperFS) hasRulesBelow(p string) bool {
+	p = path.Clean("/" + p)
+	for _, r := range a.Rules {
+		if r.Path != p && covers(p, r.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the path can be seen at all, e.g. by Stat.
+func (a ACLWrapperFS) visible(p string) bool {
+	return a.rule(p).grants() || a.leadsToGranted(p)
+}
+
+func (a ACLWrapperFS) CanRead(p string) bool {
+	return a.rule(p).Read
+}
+
+func (a ACLWrapperFS) CanWrite(p string) bool {
+	return a.rule(p).Write
+}
+
+func (a ACLWrapperFS) CanList(p string) bool {
+	return a.rule(p).List || a.leadsToGranted(p)
+}
+
+// Returns ErrForbidden if the operation is not allowed, unless AuditOnly is set.
+func (a ACLWrapperFS) check(allowed bool, operation string, path string) error {
+	if allowed {
+		return nil
+	}
+	if !a.AuditOnly {
+		return ErrForbidden
+	}
+	if a.OnDenied != nil {
+		a.OnDenied(operation, path)
+	}
+	return nil
+}
+
+func (a ACLWrapperFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	if err := a.check(a.CanList(p), "List", p); err != nil {
+		return nil, err
+	}
+	iter, err := a.Inner.List(p)
+	if err != nil || a.AuditOnly || !a.hasRulesBelow(p) {
+		return iter, err
+	}
+	return filteredLister(iter, func(info os.FileInfo) bool {
+		return a.visible(path.Join(p, info.Name()))
+	}), nil
+}
+
+// filteredLister returns a lister only returning the entries of iter that are kept. Listing the entries in order,
+// as sftp clients do, continues where the previous call has stopped. Any other offset starts from the beginning.
+func filteredLister(iter func([]os.FileInfo, int64) (int, error), keep func(os.FileInfo) bool) func([]os.FileInfo, int64) (int, error) {
+	buffer := make([]os.FileInfo, 128)
+	// The number of kept entries returned so far and the offset of iter after them.
+	next, innerNext := int64(0), int64(0)
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset != next {
+			next, innerNext = 0, 0
+		}
+		n := 0
+		for n < len(ls) {
+			read, err := iter(buffer, innerNext)
+			consumed := 0
+			for _, info := range buffer[:read] {
+				if n == len(ls) {
+					break
+				}
+				consumed++
+				if !keep(info) {
+					continue
+				}
+				if next >= offset {
+					ls[n] = info
+					n++
+				}
+				next++
+			}
+			innerNext += int64(consumed)
+			if consumed < read {
+				// ls is full, the remaining entries are read again by the next call.
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			if read == 0 {
+				return n, io.EOF
+			}
+		}
+		return n, nil
+	}
+}
+
+func (a ACLWrapperFS) Lstat(p string) (os.FileInfo, error) {
+	if err := a.check(a.visible(p), "Lstat", p); err != nil {
+		return nil, err
+	}
+	return a.Inner.Lstat(p)
+}
+
+func (a ACLWrapperFS) Stat(p string) (os.FileInfo, error) {
+	if err := a.check(a.visible(p), "Stat", p); err != nil {
+		return nil, err
+	}
+	return a.Inner.Stat(p)
+}
+
+func (a ACLWrapperFS) ReadLink(p string) (os.FileInfo, error) {
+	if err := a.check(a.visible(p), "ReadLink", p); err != nil {
+		return nil, err
+	}
+	return a.Inner.ReadLink(p)
+}
+
+func (a ACLWrapperFS) Read(p string) (io.ReaderAt, error) {
+	if err := a.check(a.CanRead(p), "Read", p); err != nil {
+		return nil, err
+	}
+	return a.Inner.Read(p)
+}
+
+func (a ACLWrapperFS) Write(p string) (io.WriterAt, error) {
+	if err := a.check(a.CanWrite(p), "Write", p); err != nil {
+		return nil, err
+	}
+	return a.Inner.Write(p)
+}
+
+func (a ACLWrapperFS) SetStat(p string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if err := a.check(a.CanWrite(p), "SetStat", p); err != nil {
+		return err
+	}
+	return a.Inner.SetStat(p, flags, attributes)
+}
+
+func (a ACLWrapperFS) Rename(src, dst string) error {
+	if err := a.check(a.CanWrite(src), "Rename", src); err != nil {
+		return err
+	}
+	if err := a.check(a.CanWrite(dst), "Rename", dst); err != nil {
+		return err
+	}
+	return a.Inner.Rename(src, dst)
+}
+
+// Copy requires the source to be readable and the destination to be writable.
+func (a ACLWrapperFS) Copy(src, dst string) error {
+	if err := a.check(a.CanRead(src), "Copy", src); err != nil {
+		return err
+	}
+	if err := a.check(a.CanWrite(dst), "Copy", dst); err != nil {
+		return err
+	}
+	return CopyFile(a.Inner, src, dst)
+}
+
+func (a ACLWrapperFS) Rmdir(p string) error {
+	if err := a.check(a.CanWrite(p), "Rmdir", p); err != nil {
+		return err
+	}
+	return a.Inner.Rmdir(p)
+}
+
+func (a ACLWrapperFS) Rm(p string) error {
+	if err := a.check(a.CanWrite(p), "Rm", p); err != nil {
+		return err
+	}
+	return a.Inner.Rm(p)
+}
+
+func (a ACLWrapperFS) Mkdir(p string) error {
+	if err := a.check(a.CanWrite(p), "Mkdir", p); err != nil {
+		return err
+	}
+	return a.Inner.Mkdir(p)
+}
+
+func (a ACLWrapperFS) Link(src, dst string) error {
+	if err := a.check(a.CanRead(src), "Link", src); err != nil {
+		return err
+	}
+	if err := a.check(a.CanWrite(dst), "Link", dst); err != nil {
+		return err
+	}
+	return a.Inner.Link(src, dst)
+}
+
+func (a ACLWrapperFS) Symlink(src, dst string) error {
+	if err := a.check(a.CanRead(src), "Symlink", src); err != nil {
+		return err
+	}
+	if err := a.check(a.CanWrite(dst), "Symlink", dst); err != nil {
+		return err
+	}
+	return a.Inner.Symlink(src, dst)
+}
+
+func (a ACLWrapperFS) Space(p string) (Space, error) {
+	if err := a.check(a.visible(p), "Space", p); err != nil {
+		return Space{}, err
+	}
+	return SpaceOf(a.Inner, p)
+}
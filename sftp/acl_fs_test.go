@@ -0,0 +1,92 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLWrapperFS(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"projects/www", "projects/secret", "other"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"projects/www/index.html", "projects/readme", "projects/secret/key", "other/file"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := ACLWrapperFS{Inner: DirFs{Root: root + "/"}, Rules: []ACLRule{
+		{Path: "/projects", Read: true, List: true},
+		{Path: "/projects/www", Read: true, Write: true, List: true},
+		{Path: "/projects/secret"},
+	}}
+	tests := []struct {
+		name      string
+		operation func() error
+		wantErr   error
+	}{
+		{"read granted", func() error { _, err := fs.Read("/projects/readme"); return err }, nil},
+		{"read without rule", func() error { _, err := fs.Read("/other/file"); return err }, ErrForbidden},
+		{"read denied below", func() error { _, err := fs.Read("/projects/secret/key"); return err }, ErrForbidden},
+		{"write granted", func() error { _, err := fs.Write("/projects/www/new"); return err }, nil},
+		{"write not granted", func() error { _, err := fs.Write("/projects/new"); return err }, ErrForbidden},
+		{"rename out of writable", func() error { return fs.Rename("/projects/www/index.html", "/projects/index.html") }, ErrForbidden},
+		{"stat of the root leading to rules", func() error { _, err := fs.Stat("/"); return err }, nil},
+		{"stat without rule", func() error { _, err := fs.Stat("/other"); return err }, ErrForbidden},
+		{"stat of a prefix only", func() error { _, err := fs.Stat("/projectsfoo"); return err }, ErrForbidden},
+		{"list without rule", func() error { _, err := fs.List("/other"); return err }, ErrForbidden},
+		{"list denied below", func() error { _, err := fs.List("/projects/secret"); return err }, ErrForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.operation(); !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+
+	listed := func(p string) []string {
+		lister, err := fs.List(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		ls := make([]os.FileInfo, 1)
+		for offset := int64(0); ; offset++ {
+			n, err := lister(ls, offset)
+			if n == 1 {
+				names = append(names, ls[0].Name())
+			}
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if names := listed("/"); len(names) != 1 || names[0] != "projects" {
+		t.Errorf("List(/) = %v, want only the directory leading to the rules", names)
+	}
+	if names := listed("/projects"); len(names) != 2 {
+		t.Errorf("List(/projects) = %v, want readme and www", names)
+	}
+
+	audited := fs
+	var denied []string
+	audited.AuditOnly = true
+	audited.OnDenied = func(operation string, path string) {
+		denied = append(denied, operation+" "+path)
+	}
+	if _, err := audited.Read("/other/file"); err != nil {
+		t.Errorf("Read() in audit mode = %v", err)
+	}
+	if len(denied) != 1 || denied[0] != "Read /other/file" {
+		t.Errorf("reported %v", denied)
+	}
+}
@@ -0,0 +1,472 @@
+package sftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ArchiveFS is a read-only [sftp.SimplifiedFS] serving the content of a zip or a gzip compressed tar archive, so
+// users can browse and download the files of an archive without extracting it. The archive is indexed when it is
+// used first and again whenever it has changed. Symbolic links and other special files of the archive are left
+// out. It can be used by several sessions at the same time.
+type ArchiveFS struct {
+	// The path of the archive.
+	Path string
+	// Protects index
+	mutex sync.Mutex
+	index *archiveIndex
+}
+
+// NewArchiveFS creates an ArchiveFS for the archive at the given path.
+func NewArchiveFS(path string) *ArchiveFS {
+	return &ArchiveFS{Path: path}
+}
+
+// archiveFile is a file or directory of an archive.
+type archiveFile struct {
+	info deviceFileInfo
+	// The name of the entry within the archive and the number of entries before it.
+	name     string
+	position int
+	// Where the content of an uncompressed entry of a zip archive starts within the archive, -1 for all others.
+	offset int64
+}
+
+// archiveIndex lists the files of an archive.
+type archiveIndex struct {
+	// The modification time and the size of the archive when it was indexed.
+	modTime time.Time
+	size    int64
+	// Whether the archive is a zip archive rather than a tar.gz archive.
+	zip bool
+	// The files and directories by their path like "/dir/file".
+	files map[string]*archiveFile
+	// The content of every directory sorted by name.
+	children map[string][]os.FileInfo
+}
+
+// Adds the directory at the given path and all its parents, unless they have been added before.
+func (i *archiveIndex) addDir(p string, modTime time.Time) {
+	for {
+		if file, ok := i.files[p]; ok && file.info.IsDir() {
+			return
+		}
+		i.files[p] = &archiveFile{info: deviceFileInfo{name: path.Base(p), mode: os.ModeDir | 0o555, modTime: modTime},
+			offset: -1}
+		if p == "/" {
+			return
+		}
+		p = path.Dir(p)
+	}
+}
+
+// Adds the file with the given entry name and the info of its content, along with its parent directories.
+func (i *archiveIndex) addFile(name string, position int, size int64, modTime time.Time, offset int64) {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return
+	}
+	i.addDir(path.Dir(p), i.modTime)
+	i.files[p] = &archiveFile{
+		info:     deviceFileInfo{name: path.Base(p), size: size, mode: 0o444, modTime: modTime},
+		name:     name,
+		position: position,
+		offset:   offset,
+	}
+}
+
+// Fills the children from the files.
+func (i *archiveIndex) listChildren() {
+	for p, file := range i.files {
+		if p != "/" {
+			i.children[path.Dir(p)] = append(i.children[path.Dir(p)], file.info)
+		}
+	}
+	for _, children := range i.children {
+		sort.Slice(children, func(a, b int) bool {
+			return children[a].Name() < children[b].Name()
+		})
+	}
+}
+
+// Indexes the archive at the given path.
+func readArchiveIndex(p string) (*archiveIndex, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index := &archiveIndex{
+		modTime:  stat.ModTime(),
+		size:     stat.Size(),
+		files:    map[string]*archiveFile{},
+		children: map[string][]os.FileInfo{},
+	}
+	index.addDir("/", stat.ModTime())
+	magic := make([]byte, 2)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		return nil, fmt.Errorf("%s is no zip or tar.gz archive", p)
+	}
+	switch {
+	case bytes.Equal(magic, []byte("PK")):
+		index.zip = true
+		archive, err := zip.NewReader(file, stat.Size())
+		if err != nil {
+			return nil, err
+		}
+		for position, entry := range archive.File {
+			mode := entry.Mode()
+			switch {
+			case mode.IsDir():
+				index.addDir(path.Clean("/"+entry.Name), entry.Modified)
+			case mode.IsRegular():
+				offset := int64(-1)
+				if entry.Method == zip.Store {
+					if offset, err = entry.DataOffset(); err != nil {
+						return nil, err
+					}
+				}
+				index.addFile(entry.Name, position, int64(entry.UncompressedSize64), entry.Modified, offset)
+			}
+		}
+	case bytes.Equal(magic, []byte{0x1f, 0x8b}):
+		decompressed, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		archive := tar.NewReader(decompressed)
+		for position := 0; ; position++ {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			mode := header.FileInfo().Mode()
+			switch {
+			case mode.IsDir():
+				index.addDir(path.Clean("/"+header.Name), header.ModTime)
+			case mode.IsRegular():
+				index.addFile(header.Name, position, header.Size, header.ModTime, -1)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s is no zip or tar.gz archive", p)
+	}
+	index.listChildren()
+	return index, nil
+}
+
+// Returns the index of the archive, which is read again if the archive has changed.
+func (a *ArchiveFS) load() (*archiveIndex, error) {
+	stat, err := os.Stat(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.index != nil && a.index.modTime.Equal(stat.ModTime()) && a.index.size == stat.Size() {
+		return a.index, nil
+	}
+	index, err := readArchiveIndex(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	a.index = index
+	return index, nil
+}
+
+// Returns the file or directory at the given path.
+func (a *ArchiveFS) file(p string) (*archiveFile, *archiveIndex, error) {
+	index, err := a.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, ok := index.files[path.Clean("/"+p)]
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+	return file, index, nil
+}
+
+// Opens the content of the file from its start.
+func (a *ArchiveFS) open(file *archiveFile, index *archiveIndex) (io.ReadCloser, error) {
+	archive, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := openArchiveEntry(archive, file, index)
+	if err != nil {
+		_ = archive.Close()
+		return nil, err
+	}
+	return archiveEntryReader{stream, archive}, nil
+}
+
+// Returns the content of the file within the opened archive.
+func openArchiveEntry(opened *os.File, file *archiveFile, index *archiveIndex) (io.Reader, error) {
+	// The archive may have been replaced since it was indexed.
+	changed := fmt.Errorf("the archive has changed while reading %s", file.name)
+	if index.zip {
+		archive, err := zip.NewReader(opened, index.size)
+		if err != nil {
+			return nil, err
+		}
+		if file.position >= len(archive.File) || archive.File[file.position].Name != file.name {
+			return nil, changed
+		}
+		return archive.File[file.position].Open()
+	}
+	decompressed, err := gzip.NewReader(opened)
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(decompressed)
+	for position := 0; position <= file.position; position++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, changed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if position == file.position && header.Name != file.name {
+			return nil, changed
+		}
+	}
+	return archive, nil
+}
+
+// archiveEntryReader reads the content of an entry and closes the archive along with it.
+type archiveEntryReader struct {
+	io.Reader
+	archive *os.File
+}
+
+func (r archiveEntryReader) Close() error {
+	if closer, ok := r.Reader.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	return r.archive.Close()
+}
+
+// storedEntryReader reads an uncompressed entry of a zip archive right from the archive.
+type storedEntryReader struct {
+	*io.SectionReader
+	archive *os.File
+}
+
+func (r storedEntryReader) Close() error {
+	return r.archive.Close()
+}
+
+func (a *ArchiveFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	file, index, err := a.file(p)
+	if err != nil {
+		return nil, err
+	}
+	if !file.info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	fileinfos := index.children[path.Clean("/"+p)]
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (a *ArchiveFS) Lstat(p string) (os.FileInfo, error) {
+	return a.Stat(p)
+}
+
+func (a *ArchiveFS) Stat(p string) (os.FileInfo, error) {
+	file, _, err := a.file(p)
+	if err != nil {
+		return nil, err
+	}
+	return file.info, nil
+}
+
+func (a *ArchiveFS) ReadLink(p string) (os.FileInfo, error) {
+	return a.Stat(p)
+}
+
+func (a *ArchiveFS) Read(p string) (io.ReaderAt, error) {
+	file, index, err := a.file(p)
+	if err != nil {
+		return nil, err
+	}
+	if file.info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	if file.offset >= 0 {
+		// Uncompressed files can be read right from the archive.
+		archive, err := os.Open(a.Path)
+		if err != nil {
+			return nil, err
+		}
+		return storedEntryReader{io.NewSectionReader(archive, file.offset, file.info.size), archive}, nil
+	}
+	return &streamReaderAt{open: func() (io.ReadCloser, error) {
+		return a.open(file, index)
+	}}, nil
+}
+
+func (a *ArchiveFS) Write(_ string) (io.WriterAt, error) {
+	return nil, ErrForbidden
+}
+
+func (a *ArchiveFS) SetStat(_ string, _ gosftp.FileAttrFlags, _ *gosftp.FileStat) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Rename(_, _ string) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Rmdir(_ string) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Rm(_ string) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Mkdir(_ string) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Link(_, _ string) error {
+	return ErrForbidden
+}
+
+func (a *ArchiveFS) Symlink(_, _ string) error {
+	return ErrForbidden
+}
+
+// Space reports the size of the archive and the number of its files, of which nothing is available.
+func (a *ArchiveFS) Space(_ string) (Space, error) {
+	index, err := a.load()
+	if err != nil {
+		return Space{}, err
+	}
+	return Space{Total: uint64(index.size), Files: uint64(len(index.files))}, nil
+}
+
+// The number of bytes streamReaderAt keeps after reading them and the number of bytes it reads at once.
+const (
+	streamWindow = 1 << 20
+	streamChunk  = 32 * 1024
+)
+
+// streamReaderAt reads at any offset of a stream that can only be read from its start, like a compressed file of
+// an archive. Reading before the current position of the stream opens it again, unless the bytes are among the
+// last streamWindow ones read, so the slightly reordered requests of sftp clients downloading a file are cheap.
+type streamReaderAt struct {
+	// Opens the stream from its start.
+	open func() (io.ReadCloser, error)
+	// Protects the fields below
+	mutex  sync.Mutex
+	stream io.ReadCloser
+	// The position of the stream.
+	offset int64
+	// The last bytes read from the stream, which end at offset.
+	window []byte
+	closed bool
+}
+
+// Opens the stream from its start again.
+func (s *streamReaderAt) reopen() error {
+	if s.stream != nil {
+		_ = s.stream.Close()
+		s.stream = nil
+	}
+	s.offset = 0
+	s.window = s.window[:0]
+	stream, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.stream = stream
+	return nil
+}
+
+// Reads the next chunk of the stream into the window, which keeps at most limit bytes.
+func (s *streamReaderAt) fill(limit int) error {
+	chunk := make([]byte, streamChunk)
+	n, err := s.stream.Read(chunk)
+	s.window = append(s.window, chunk[:n]...)
+	if over := len(s.window) - limit; over > 0 {
+		s.window = s.window[over:]
+	}
+	s.offset += int64(n)
+	return err
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	if s.stream == nil || off < s.offset-int64(len(s.window)) {
+		if err := s.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	// The last chunk may end after the requested bytes, which must still be in the window then.
+	limit := int(max(streamWindow, int64(len(p)+streamChunk)))
+	end := off + int64(len(p))
+	var err error
+	for s.offset < end && err == nil {
+		err = s.fill(limit)
+	}
+	if err != nil && err != io.EOF {
+		// The stream is broken, the next read starts again.
+		_ = s.stream.Close()
+		s.stream = nil
+		return 0, err
+	}
+	if off >= s.offset {
+		return 0, io.EOF
+	}
+	start := s.offset - int64(len(s.window))
+	n := copy(p, s.window[off-start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *streamReaderAt) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.stream == nil {
+		return nil
+	}
+	err := s.stream.Close()
+	s.stream = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package sftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a zip archive with the given files, storing the ones in stored without compression.
+func writeTestZip(t *testing.T, p string, files map[string]string, stored map[string]bool) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range files {
+		method := zip.Deflate
+		if stored[name] {
+			method = zip.Store
+		}
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buffer.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Writes a tar.gz archive with the given files.
+func writeTestTarGz(t *testing.T, p string, files map[string]string) {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.WriteHeader(&tar.Header{Name: "link", Linkname: "docs", Typeflag: tar.TypeSymlink}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buffer.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveFS(t *testing.T) {
+	large := string(bytes.Repeat([]byte("0123456789"), 300000))
+	files := map[string]string{
+		"docs/readme.txt":   "hello",
+		"docs/sub/data.bin": large,
+		"top.txt":           "top",
+	}
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		write func(p string)
+	}{
+		{"zip", func(p string) { writeTestZip(t, p, files, map[string]bool{"top.txt": true}) }},
+		{"tar.gz", func(p string) { writeTestTarGz(t, p, files) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := filepath.Join(dir, "archive."+test.name)
+			test.write(p)
+			fs := NewArchiveFS(p)
+			list, err := fs.List("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos := make([]os.FileInfo, 10)
+			n, _ := list(infos, 0)
+			if n != 2 || infos[0].Name() != "docs" || !infos[0].IsDir() || infos[1].Name() != "top.txt" {
+				t.Errorf("listed %d files: %v", n, infos[:n])
+			}
+			if info, err := fs.Stat("/docs/sub/data.bin"); err != nil || info.Size() != int64(len(large)) {
+				t.Errorf("Stat() = %v, %v", info, err)
+			}
+			for name, content := range files {
+				reader, err := fs.Read("/" + name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Read the second half before the first one, as reordered requests do.
+				data := make([]byte, len(content))
+				half := int64(len(content) / 2)
+				if _, err := reader.ReadAt(data[half:], half); err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				if _, err := reader.ReadAt(data[:half], 0); err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("read wrong content of %s", name)
+				}
+				if _, err := reader.ReadAt(data[:1], int64(len(content))); err != io.EOF {
+					t.Errorf("read after the end of %s: %v", name, err)
+				}
+				_ = reader.(io.Closer).Close()
+			}
+			if _, err := fs.Stat("/link"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Stat() of a symbolic link = %v", err)
+			}
+			if err := fs.Rm("/top.txt"); !errors.Is(err, ErrForbidden) {
+				t.Errorf("Rm() = %v, want %v", err, ErrForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package sftp
+
+import (
+	"container/list"
+	"github.com/Entscheider/sshtool/stats"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultCacheBlockSize is the size of the blocks of a BlockCache if none is given.
+const DefaultCacheBlockSize = 256 * 1024
+
+// blockKey identifies a block of a file in a BlockCache. A file gets a new generation whenever its size or its
+// modification time changes, so blocks of older versions are never returned and just drop out of the cache.
+type blockKey struct {
+	file    string
+	modTime int64
+	size    int64
+	index   int64
+}
+
+// cachedBlock is an entry of a BlockCache.
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// blockLoad is a block that is currently read from the filesystem. Other readers of the same block wait for it.
+type blockLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// BlockCache keeps the recently read blocks of files in memory up to a maximal number of bytes, so files read
+// by many sessions at the same time are only read once from the filesystem. It can be shared between several
+// filesystems (and goroutines).
+type BlockCache struct {
+	blockSize int64
+	maxBytes  int64
+	// Protects the fields below
+	mutex sync.Mutex
+	bytes int64
+	// The cached blocks, the most recently used one at the front.
+	lru     *list.List
+	blocks  map[blockKey]*list.Element
+	loading map[blockKey]*blockLoad
+	// Counters for Usage.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewBlockCache creates a BlockCache that keeps up to maxBytes bytes in blocks of blockSize bytes. A blockSize
+// of zero uses DefaultCacheBlockSize.
+func NewBlockCache(maxBytes int64, blockSize int64) *BlockCache {
+	if blockSize <= 0 {
+		blockSize = DefaultCacheBlockSize
+	}
+	return &BlockCache{
+		blockSize: blockSize,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		blocks:    map[blockKey]*list.Element{},
+		loading:   map[blockKey]*blockLoad{},
+	}
+}
+
+// block returns the block with the given key, calling load if it is not cached yet. If several goroutines ask
+// for the same missing block, load is only called once.
+func (b *BlockCache) block(key blockKey, load func() ([]byte, error)) ([]byte, error) {
+	b.mutex.Lock()
+	if element, ok := b.blocks[key]; ok {
+		b.hits++
+		b.lru.MoveToFront(element)
+		b.mutex.Unlock()
+		return element.Value.(*cachedBlock).data, nil
+	}
+	if pending, ok := b.loading[key]; ok {
+		b.mutex.Unlock()
+		<-pending.done
+		return pending.data, pending.err
+	}
+	b.misses++
+	pending := &blockLoad{done: make(chan struct{})}
+	b.loading[key] = pending
+	b.mutex.Unlock()
+
+	pending.data, pending.err = load()
+
+	b.mutex.Lock()
+	delete(b.loading, key)
+	if pending.err == nil {
+		b.add(key, pending.data)
+	}
+	b.mutex.Unlock()
+	close(pending.done)
+	return pending.data, pending.err
+}
+
+// add inserts a block and drops the least recently used ones until the cache fits into maxBytes again.
+// The caller must hold the mutex.
+func (b *BlockCache) add(key blockKey, data []byte) {
+	if int64(len(data)) > b.maxBytes {
+		return
+	}
+	b.blocks[key] = b.lru.PushFront(&cachedBlock{key: key, data: data})
+	b.bytes += int64(len(data))
+	for b.bytes > b.maxBytes {
+		oldest := b.lru.Back()
+		block := b.lru.Remove(oldest).(*cachedBlock)
+		delete(b.blocks, block.key)
+		b.bytes -= int64(len(block.data))
+		b.evictions++
+	}
+}
+
+// Usage returns the memory currently used by the cache along with its hits, misses and evictions so far.
+func (b *BlockCache) Usage() stats.CacheUsage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return stats.CacheUsage{
+		Bytes:     b.bytes,
+		MaxBytes:  b.maxBytes,
+		Blocks:    int64(len(b.blocks)),
+		Hits:      b.hits,
+		Misses:    b.misses,
+		Evictions: b.evictions,
+	}
+}
+
+// CachedFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and reads regular files through a
+// BlockCache. Everything else is passed to the inner filesystem as is.
+type CachedFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The cache, usually shared between several filesystems.
+	Cache *BlockCache
+	// Identifies the files of Inner among all filesystems sharing the cache, e.g. the root directory. Filesystems
+	// serving the same files should use the same key, so they share their blocks.
+	Key string
+}
+
+// cachedReader is an [io.ReaderAt] that reads the blocks of a file through the cache. Reads beyond the size the
+// file had when it was opened are passed to the inner reader.
+type cachedReader struct {
+	io.ReaderAt
+	cache *BlockCache
+	file  string
+	stat  os.FileInfo
+}
+
+func (r cachedReader) ReadAt(p []byte, off int64) (int, error) {
+	size := r.stat.Size()
+	blockSize := r.cache.blockSize
+	n := 0
+	for n < len(p) && off+int64(n) < size {
+		pos := off + int64(n)
+		index := pos / blockSize
+		key := blockKey{file: r.file, modTime: r.stat.ModTime().UnixNano(), size: size, index: index}
+		data, err := r.cache.block(key, func() ([]byte, error) {
+			data := make([]byte, min(blockSize, size-index*blockSize))
+			read, err := r.ReaderAt.ReadAt(data, index*blockSize)
+			if read == len(data) {
+				return data, nil
+			}
+			if err == nil || err == io.EOF {
+				// The file has been truncated in the meantime.
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		})
+		if err != nil {
+			// The file has changed or cannot be read, we leave the rest to the inner reader.
+			read, err := r.ReaderAt.ReadAt(p[n:], pos)
+			return n + read, err
+		}
+		n += copy(p[n:], data[pos-index*blockSize:])
+	}
+	if n < len(p) {
+		read, err := r.ReaderAt.ReadAt(p[n:], off+int64(n))
+		return n + read, err
+	}
+	return n, nil
+}
+
+func (r cachedReader) Close() error {
+	return closeIfCloser(r.ReaderAt)
+}
+
+func (c CachedFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return c.Inner.List(path)
+}
+
+func (c CachedFS) Lstat(path string) (os.FileInfo, error) {
+	return c.Inner.Lstat(path)
+}
+
+func (c CachedFS) Stat(path string) (os.FileInfo, error) {
+	return c.Inner.Stat(path)
+}
+
+func (c CachedFS) ReadLink(path string) (os.FileInfo, error) {
+	return c.Inner.ReadLink(path)
+}
+
+func (c CachedFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := c.Inner.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := c.Inner.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() {
+		return reader, nil
+	}
+	return cachedReader{ReaderAt: reader, cache: c.Cache, file: c.Key + "\x00" + path, stat: stat}, nil
+}
+
+func (c CachedFS) Write(path string) (io.WriterAt, error) {
+	return c.Inner.Write(path)
+}
+
+func (c CachedFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return c.Inner.SetStat(path, flags, attributes)
+}
+
+func (c CachedFS) Rename(src, dst string) error {
+	return c.Inner.Rename(src, dst)
+}
+
+func (c CachedFS) Copy(src, dst string) error {
+	if copier, ok := c.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (c CachedFS) Rmdir(path string) error {
+	return c.Inner.Rmdir(path)
+}
+
+func (c CachedFS) Rm(path string) error {
+	return c.Inner.Rm(path)
+}
+
+func (c CachedFS) Mkdir(path string) error {
+	return c.Inner.Mkdir(path)
+}
+
+func (c CachedFS) Link(src, dst string) error {
+	return c.Inner.Link(src, dst)
+}
+
+func (c CachedFS) Symlink(src, dst string) error {
+	return c.Inner.Symlink(src, dst)
+}
+
+func (c CachedFS) Space(path string) (Space, error) {
+	return SpaceOf(c.Inner, path)
+}
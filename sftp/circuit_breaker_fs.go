@@ -0,0 +1,250 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreakerFS while its backend is considered to be down.
+var ErrCircuitOpen = fmt.Errorf("backend unavailable, try again later")
+
+// CircuitBreaker counts the consecutive failures of a backend. Once there have been too many, it rejects all
+// operations for a cool-down period instead of waiting for the backend again. Afterwards, a single failure
+// opens it again and a single success closes it. It can be shared by several filesystems.
+type CircuitBreaker struct {
+	// The number of consecutive failures that open the circuit.
+	threshold int
+	cooldown  time.Duration
+	// Protects the fields below
+	mutex    sync.Mutex
+	failures int
+	// Operations are rejected until then.
+	openUntil time.Time
+}
+
+// NewCircuitBreaker creates a CircuitBreaker that opens after the given number of consecutive failures for the
+// given duration.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Open returns whether operations are currently rejected.
+func (b *CircuitBreaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+// Returns ErrCircuitOpen if operations are currently rejected.
+func (b *CircuitBreaker) allow() error {
+	if b.Open() {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Whether the error means that the backend has failed, instead of rejecting the operation.
+func isBackendFailure(err error) bool {
+	var status *gosftp.StatusError
+	switch {
+	case err == nil, err == io.EOF, err == ErrForbidden, errors.Is(err, ErrNotSupported),
+		errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrExist), errors.Is(err, os.ErrPermission):
+		return false
+	case errors.As(err, &status):
+		// A remote server has answered.
+		return false
+	}
+	return true
+}
+
+// Counts the result of an operation and returns err.
+func (b *CircuitBreaker) record(err error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !isBackendFailure(err) {
+		b.failures = 0
+		return err
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	return err
+}
+
+// Runs f unless the circuit is open and counts its result.
+func (b *CircuitBreaker) run(f func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	return b.record(f())
+}
+
+// CircuitBreakerFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and fails fast with
+// ErrCircuitOpen while its CircuitBreaker is open.
+type CircuitBreakerFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner   SimplifiedFS
+	Breaker *CircuitBreaker
+}
+
+// circuitReader is an [io.ReaderAt] whose reads are counted by the CircuitBreaker.
+type circuitReader struct {
+	io.ReaderAt
+	breaker *CircuitBreaker
+}
+
+func (r circuitReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	err := r.breaker.run(func() error {
+		var err error
+		n, err = r.ReaderAt.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (r circuitReader) Close() error {
+	return closeIfCloser(r.ReaderAt)
+}
+
+// circuitWriter is an [io.WriterAt] whose writes are counted by the CircuitBreaker.
+type circuitWriter struct {
+	io.WriterAt
+	breaker *CircuitBreaker
+}
+
+func (w circuitWriter) WriteAt(p []byte, off int64) (int, error) {
+	var n int
+	err := w.breaker.run(func() error {
+		var err error
+		n, err = w.WriterAt.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (w circuitWriter) Close() error {
+	// Closing may upload the file (e.g. for an ObjectFS).
+	return w.breaker.record(closeIfCloser(w.WriterAt))
+}
+
+func (c CircuitBreakerFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	var lister func([]os.FileInfo, int64) (int, error)
+	err := c.Breaker.run(func() error {
+		var err error
+		lister, err = c.Inner.List(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		var n int
+		err := c.Breaker.run(func() error {
+			var err error
+			n, err = lister(ls, offset)
+			return err
+		})
+		return n, err
+	}, nil
+}
+
+// Runs a function returning a FileInfo with the CircuitBreaker.
+func (c CircuitBreakerFS) stat(f func() (os.FileInfo, error)) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := c.Breaker.run(func() error {
+		var err error
+		info, err = f()
+		return err
+	})
+	return info, err
+}
+
+func (c CircuitBreakerFS) Lstat(path string) (os.FileInfo, error) {
+	return c.stat(func() (os.FileInfo, error) { return c.Inner.Lstat(path) })
+}
+
+func (c CircuitBreakerFS) Stat(path string) (os.FileInfo, error) {
+	return c.stat(func() (os.FileInfo, error) { return c.Inner.Stat(path) })
+}
+
+func (c CircuitBreakerFS) ReadLink(path string) (os.FileInfo, error) {
+	return c.stat(func() (os.FileInfo, error) { return c.Inner.ReadLink(path) })
+}
+
+func (c CircuitBreakerFS) Read(path string) (io.ReaderAt, error) {
+	var reader io.ReaderAt
+	err := c.Breaker.run(func() error {
+		var err error
+		reader, err = c.Inner.Read(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return circuitReader{ReaderAt: reader, breaker: c.Breaker}, nil
+}
+
+func (c CircuitBreakerFS) Write(path string) (io.WriterAt, error) {
+	var writer io.WriterAt
+	err := c.Breaker.run(func() error {
+		var err error
+		writer, err = c.Inner.Write(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return circuitWriter{WriterAt: writer, breaker: c.Breaker}, nil
+}
+
+func (c CircuitBreakerFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return c.Breaker.run(func() error { return c.Inner.SetStat(path, flags, attributes) })
+}
+
+func (c CircuitBreakerFS) Rename(src, dst string) error {
+	return c.Breaker.run(func() error { return c.Inner.Rename(src, dst) })
+}
+
+func (c CircuitBreakerFS) Copy(src, dst string) error {
+	if copier, ok := c.Inner.(Copier); ok {
+		return c.Breaker.run(func() error { return copier.Copy(src, dst) })
+	}
+	return ErrNotSupported
+}
+
+func (c CircuitBreakerFS) Rmdir(path string) error {
+	return c.Breaker.run(func() error { return c.Inner.Rmdir(path) })
+}
+
+func (c CircuitBreakerFS) Rm(path string) error {
+	return c.Breaker.run(func() error { return c.Inner.Rm(path) })
+}
+
+func (c CircuitBreakerFS) Mkdir(path string) error {
+	return c.Breaker.run(func() error { return c.Inner.Mkdir(path) })
+}
+
+func (c CircuitBreakerFS) Link(src, dst string) error {
+	return c.Breaker.run(func() error { return c.Inner.Link(src, dst) })
+}
+
+func (c CircuitBreakerFS) Symlink(src, dst string) error {
+	return c.Breaker.run(func() error { return c.Inner.Symlink(src, dst) })
+}
+
+func (c CircuitBreakerFS) Space(path string) (Space, error) {
+	var space Space
+	err := c.Breaker.run(func() error {
+		var err error
+		space, err = SpaceOf(c.Inner, path)
+		return err
+	})
+	return space, err
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package sftp
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// cloneFile lets dst share the blocks of src until one of them is changed, which only some filesystems
+// (like btrfs or xfs) support.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sftp
+
+import "os"
+
+// cloneFile is only supported on linux.
+func cloneFile(_, _ *os.File) error {
+	return ErrNotSupported
+}
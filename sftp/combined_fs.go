@@ -16,19 +16,40 @@ import (
 // CombinedFS combines different SimplifiedFS by serving it as a subdirectory to the root of this filesystem.
 // It is not recommended nesting several CombinedFS.
 type CombinedFS struct {
-	Dirs    map[string]SimplifiedFS
-	logging logger.Logger
+	Dirs map[string]SimplifiedFS
+	// If not nil, the filesystems are taken from this table instead of Dirs, so they can be changed at runtime.
+	Mounts *MountTable
+	// Reports whether the filesystem with the given name is currently unavailable. Unavailable filesystems are
+	// left out when listing the root. May be nil.
+	Unavailable func(name string) bool
+	// Whether unavailable filesystems are listed as empty directories instead of being left out.
+	ShowUnavailable bool
+	logging         logger.Logger
+}
+
+// Returns the current sub filesystems by their name.
+func (c CombinedFS) dirs() map[string]SimplifiedFS {
+	if c.Mounts != nil {
+		return c.Mounts.current()
+	}
+	return c.Dirs
 }
 
 // Extract gets the filesystem that handles the given path and returns subpath within this filesystem and the
 // filesystem itself.
 func (c CombinedFS) Extract(path string) (string, SimplifiedFS, error) {
+	_, subpath, sfs, err := c.extractMount(path)
+	return subpath, sfs, err
+}
+
+// extractMount is like Extract, but also returns the name of the filesystem.
+func (c CombinedFS) extractMount(path string) (string, string, SimplifiedFS, error) {
 	// Remove a starting slash.
 	if path[0] == '/' {
 		path = path[1:]
 	}
 	// Iterate through every subdirectory
-	for name, sfs := range c.Dirs {
+	for name, sfs := range c.dirs() {
 		// If the path belongs to this filesystem, we return it
 		if len(path) >= len(name) && path[:len(name)] == name {
 			// path = name + '/....' or path = name ?
@@ -38,11 +59,11 @@ func (c CombinedFS) Extract(path string) (string, SimplifiedFS, error) {
 			}
 			// Only return it if we are actually in this sub filesystem.
 			if subpath[0] == '/' {
-				return subpath, sfs, nil
+				return name, subpath, sfs, nil
 			}
 		}
 	}
-	return "", nil, os.ErrNotExist
+	return "", "", nil, os.ErrNotExist
 }
 
 func min(a, b int64) int64 {
@@ -88,11 +109,18 @@ func (c CombinedFS) List(path string) (func([]os.FileInfo, int64) (int, error),
 	// If we are at root, we list all sub filesystems.
 	if path == "/" {
 		// Get every key (=name) from filesystem map.
-		topDirs := make([]string, len(c.Dirs))
-		i := 0
-		for name := range c.Dirs {
-			topDirs[i] = name
-			i += 1
+		dirs := c.dirs()
+		topDirs := make([]string, 0, len(dirs))
+		// The unavailable filesystems shown as empty directories.
+		placeholders := make(map[string]bool)
+		for name := range dirs {
+			if c.Unavailable != nil && c.Unavailable(name) {
+				if !c.ShowUnavailable {
+					continue
+				}
+				placeholders[name] = true
+			}
+			topDirs = append(topDirs, name)
 		}
 		sort.Strings(topDirs)
 
@@ -102,12 +130,15 @@ func (c CombinedFS) List(path string) (func([]os.FileInfo, int64) (int, error),
 				return 0, io.EOF
 			}
 			// remaining is the number of FileInfo objects we copy into the fs array
-			remaining := min(int64(len(topDirs))-offset, int64(len(fs))-offset)
+			remaining := min(int64(len(topDirs))-offset, int64(len(fs)))
 			for i := 0; i < int(remaining); i++ {
 				// Get the name, create a FileInfo object for it and add into the fs array
 				dirname := topDirs[int(offset)+i]
-				//fs[i] = topDirPath(dirname)
-				stat, err := c.Dirs[dirname].Stat("/")
+				if placeholders[dirname] {
+					fs[i] = topDirPath(dirname)
+					continue
+				}
+				stat, err := dirs[dirname].Stat("/")
 				if err != nil {
 					c.logging.Err("CombineFS List", err.Error())
 					return 0, err
@@ -415,6 +446,25 @@ func (c CombinedFS) Rename(src, dst string) error {
 	}
 }
 
+// Copy copies the file if both paths belong to the same filesystem and it is able to copy it itself.
+func (c CombinedFS) Copy(src, dst string) error {
+	srcName, subSrc, srcSfs, err := c.extractMount(src)
+	if err != nil {
+		return err
+	}
+	dstName, subDst, _, err := c.extractMount(dst)
+	if err != nil {
+		return err
+	}
+	if srcName != dstName {
+		return ErrNotSupported
+	}
+	if copier, ok := srcSfs.(Copier); ok {
+		return copier.Copy(subSrc, subDst)
+	}
+	return ErrNotSupported
+}
+
 func (c CombinedFS) Rmdir(path string) error {
 	if path == "/" {
 		return os.ErrPermission
@@ -538,3 +588,15 @@ func (c CombinedFS) Symlink(src, dst string) error {
 	// otherwise, we cannot link
 	return fmt.Errorf("cannot symlink between different file systems")
 }
+
+// Space returns the space of the filesystem containing the path. The root directory has no storage of its own.
+func (c CombinedFS) Space(path string) (Space, error) {
+	if path == "/" {
+		return Space{}, ErrNotSupported
+	}
+	subpath, sfs, err := c.Extract(path)
+	if err != nil {
+		return Space{}, err
+	}
+	return SpaceOf(sfs, subpath)
+}
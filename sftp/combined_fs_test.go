@@ -0,0 +1,51 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCombinedFSListPaged(t *testing.T) {
+	dirs := map[string]SimplifiedFS{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		dirs[name] = DirFs{Root: t.TempDir() + "/"}
+	}
+	c := CombinedFS{Dirs: dirs, Unavailable: func(name string) bool { return name == "c" }, ShowUnavailable: true}
+	tests := []struct {
+		name      string
+		offset    int64
+		size      int
+		wantNames []string
+		wantEOF   bool
+	}{
+		{"first page", 0, 2, []string{"a", "b"}, false},
+		{"middle page", 2, 2, []string{"c", "d"}, false},
+		{"last page", 4, 2, []string{"e"}, true},
+		{"exact end", 3, 2, []string{"d", "e"}, true},
+		{"large page", 0, 10, []string{"a", "b", "c", "d", "e"}, true},
+		{"at end", 5, 2, nil, true},
+		{"past end", 7, 2, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, err := c.List("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := make([]os.FileInfo, test.size)
+			n, err := list(page, test.offset)
+			if (err == io.EOF) != test.wantEOF || (err != nil && err != io.EOF) {
+				t.Fatalf("error = %v, want EOF %v", err, test.wantEOF)
+			}
+			if n != len(test.wantNames) {
+				t.Fatalf("listed %d entries, want %d", n, len(test.wantNames))
+			}
+			for i, name := range test.wantNames {
+				if page[i].Name() != name || !page[i].IsDir() {
+					t.Errorf("entry %d = %s (dir %v), want directory %s", i, page[i].Name(), page[i].IsDir(), name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+)
+
+// Copier can be implemented by a [sftp.SimplifiedFS] that is able to copy a file itself, e.g. by cloning it on the
+// disk. Copy returns ErrNotSupported if it cannot copy these files, CopyFile then copies the content instead.
+type Copier interface {
+	// Copy copies the file at src to dst, replacing the content of dst if it exists.
+	Copy(src, dst string) error
+}
+
+// CopyFile copies the file at src to dst within the filesystem, replacing the content of dst if it exists.
+// The content is only read and written through the filesystem if it is no Copier or cannot copy the file itself.
+func CopyFile(fs SimplifiedFS, src, dst string) error {
+	if copier, ok := fs.(Copier); ok {
+		if err := copier.Copy(src, dst); !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+	n, err := CopyData(fs, src, 0, 0, dst, 0)
+	if err != nil {
+		return err
+	}
+	// The destination may have been larger than the source.
+	if stat, err := fs.Stat(dst); err != nil || stat.Size() <= n {
+		return err
+	}
+	return fs.SetStat(dst, gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: uint64(n)})
+}
+
+// CopyData copies length bytes (or everything if length is zero) of the file at src starting at srcOffset into
+// the file at dst starting at dstOffset. The content is read and written through the filesystem. Returns the
+// number of copied bytes.
+func CopyData(fs SimplifiedFS, src string, srcOffset, length int64, dst string, dstOffset int64) (int64, error) {
+	reader, err := fs.Read(src)
+	if err != nil {
+		return 0, err
+	}
+	defer closeIfCloser(reader)
+	writer, err := fs.Write(dst)
+	if err != nil {
+		return 0, err
+	}
+	if length == 0 {
+		// Larger than every file, the reader ends with the file anyway.
+		length = 1<<63 - 1 - srcOffset
+	}
+	n, err := io.Copy(io.NewOffsetWriter(writer, dstOffset), io.NewSectionReader(reader, srcOffset, length))
+	// Closing may fail as well, e.g. if a hook rejects the content.
+	if closeErr := closeIfCloser(writer); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Normalizes a path sent by the client, which may be relative to the root.
+func normalizeClientPath(p string) (string, error) {
+	return normalizePath(path.Join("/", p))
+}
+
+// Handles the copy-file request, which copies a file by its path. Returns the paths of the source and the
+// destination.
+func (w *wrapper) copyFile(r *extendedRequest) (string, string, error) {
+	src, err := r.string()
+	if err != nil {
+		return "", "", err
+	}
+	dst, err := r.string()
+	if err != nil {
+		return src, "", err
+	}
+	overwrite, err := r.bool()
+	if err != nil {
+		return src, dst, err
+	}
+	if src, err = normalizeClientPath(src); err != nil {
+		return src, dst, err
+	}
+	if dst, err = normalizeClientPath(dst); err != nil {
+		return src, dst, err
+	}
+	if !overwrite {
+		if _, err := w.fs.Lstat(dst); err == nil {
+			return src, dst, os.ErrExist
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return src, dst, err
+		}
+	}
+	return src, dst, CopyFile(w.fs, src, dst)
+}
+
+// Handles the copy-data request, which copies a range between files opened by the client. Returns the paths of
+// the source and the destination.
+func (w *wrapper) copyData(r *extendedRequest, file func(handle string) (string, bool)) (string, string, error) {
+	srcHandle, err := r.string()
+	if err != nil {
+		return "", "", err
+	}
+	srcOffset, err := r.uint64()
+	if err != nil {
+		return "", "", err
+	}
+	length, err := r.uint64()
+	if err != nil {
+		return "", "", err
+	}
+	dstHandle, err := r.string()
+	if err != nil {
+		return "", "", err
+	}
+	dstOffset, err := r.uint64()
+	if err != nil {
+		return "", "", err
+	}
+	src, ok := file(srcHandle)
+	if !ok {
+		return "", "", fmt.Errorf("invalid handle")
+	}
+	dst, ok := file(dstHandle)
+	if !ok {
+		return src, "", fmt.Errorf("invalid handle")
+	}
+	if src, err = normalizeClientPath(src); err != nil {
+		return src, dst, err
+	}
+	if dst, err = normalizeClientPath(dst); err != nil {
+		return src, dst, err
+	}
+	if srcOffset > 1<<62 || length > 1<<62 || dstOffset > 1<<62 {
+		return src, dst, os.ErrInvalid
+	}
+	if srcOffset == 0 && length == 0 && dstOffset == 0 && src != dst {
+		// Copying the whole file into an empty one (as clients usually do) is the same as copying the file,
+		// which the filesystem may be able to do without passing the content through us.
+		if stat, err := w.fs.Stat(dst); err == nil && stat.Size() == 0 {
+			return src, dst, CopyFile(w.fs, src, dst)
+		}
+	}
+	_, err = CopyData(w.fs, src, int64(srcOffset), int64(length), dst, int64(dstOffset))
+	return src, dst, err
+}
@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+)
+
+// TransferCounter is notified about the data transferred through a [sftp.CountingFS].
+type TransferCounter interface {
+	// AddRead is called after n bytes have been read.
+	AddRead(n int)
+	// AddWritten is called after n bytes have been written.
+	AddWritten(n int)
+	// HandleOpened is called after a file has been opened for reading or writing.
+	HandleOpened()
+	// HandleClosed is called after a file opened before has been closed.
+	HandleClosed()
+}
+
+// CountingFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and reports all
+// transferred bytes and open files to a TransferCounter.
+type CountingFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The object to report to
+	Counter TransferCounter
+}
+
+// countingReader is an [io.ReaderAt] that reports the read bytes.
+type countingReader struct {
+	io.ReaderAt
+	counter TransferCounter
+	once    sync.Once
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.counter.AddRead(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	r.once.Do(r.counter.HandleClosed)
+	return closeIfCloser(r.ReaderAt)
+}
+
+// countingWriter is an [io.WriterAt] that reports the written bytes.
+type countingWriter struct {
+	io.WriterAt
+	counter TransferCounter
+	once    sync.Once
+}
+
+func (w *countingWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.counter.AddWritten(n)
+	return n, err
+}
+
+func (w *countingWriter) Close() error {
+	w.once.Do(w.counter.HandleClosed)
+	return closeIfCloser(w.WriterAt)
+}
+
+func (c CountingFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return c.Inner.List(path)
+}
+
+func (c CountingFS) Lstat(path string) (os.FileInfo, error) {
+	return c.Inner.Lstat(path)
+}
+
+func (c CountingFS) Stat(path string) (os.FileInfo, error) {
+	return c.Inner.Stat(path)
+}
+
+func (c CountingFS) ReadLink(path string) (os.FileInfo, error) {
+	return c.Inner.ReadLink(path)
+}
+
+func (c CountingFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := c.Inner.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	c.Counter.HandleOpened()
+	return &countingReader{ReaderAt: reader, counter: c.Counter}, nil
+}
+
+func (c CountingFS) Write(path string) (io.WriterAt, error) {
+	writer, err := c.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	c.Counter.HandleOpened()
+	return &countingWriter{WriterAt: writer, counter: c.Counter}, nil
+}
+
+func (c CountingFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return c.Inner.SetStat(path, flags, attributes)
+}
+
+func (c CountingFS) Rename(src, dst string) error {
+	return c.Inner.Rename(src, dst)
+}
+
+func (c CountingFS) Copy(src, dst string) error {
+	if copier, ok := c.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (c CountingFS) Rmdir(path string) error {
+	return c.Inner.Rmdir(path)
+}
+
+func (c CountingFS) Rm(path string) error {
+	return c.Inner.Rm(path)
+}
+
+func (c CountingFS) Mkdir(path string) error {
+	return c.Inner.Mkdir(path)
+}
+
+func (c CountingFS) Link(src, dst string) error {
+	return c.Inner.Link(src, dst)
+}
+
+func (c CountingFS) Symlink(src, dst string) error {
+	return c.Inner.Symlink(src, dst)
+}
+
+func (c CountingFS) Space(path string) (Space, error) {
+	return SpaceOf(c.Inner, path)
+}
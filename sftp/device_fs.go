@@ -0,0 +1,167 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// DeviceFS is a read-only [sftp.SimplifiedFS] whose root directory contains a single file with the content of
+// a block device or a disk image, e.g. for pulling an image of a disk for backups. As clients read at any offset,
+// interrupted downloads can be resumed.
+type DeviceFS struct {
+	// The path of the block device (e.g. "/dev/sdb") or the disk image. The file is named like it.
+	Path string
+}
+
+// deviceFileInfo describes the file of a DeviceFS or its root directory.
+type deviceFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (d deviceFileInfo) Name() string {
+	return d.name
+}
+
+func (d deviceFileInfo) Size() int64 {
+	return d.size
+}
+
+func (d deviceFileInfo) Mode() os.FileMode {
+	return d.mode
+}
+
+func (d deviceFileInfo) ModTime() time.Time {
+	return d.modTime
+}
+
+func (d deviceFileInfo) IsDir() bool {
+	return d.mode.IsDir()
+}
+
+func (d deviceFileInfo) Sys() interface{} {
+	return nil
+}
+
+// The name of the file within the root directory.
+func (d DeviceFS) name() string {
+	return filepath.Base(d.Path)
+}
+
+// Returns the info of the file with the size of the device.
+func (d DeviceFS) fileInfo() (os.FileInfo, error) {
+	file, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	// Block devices have no size on their own.
+	if stat.Mode()&os.ModeDevice != 0 {
+		if size, err = blockDeviceSize(file); err != nil {
+			return nil, err
+		}
+	}
+	return deviceFileInfo{name: d.name(), size: size, mode: 0o444, modTime: stat.ModTime()}, nil
+}
+
+// Returns the info of the file or the root directory at path.
+func (d DeviceFS) stat(p string) (os.FileInfo, error) {
+	switch path.Clean("/" + p) {
+	case "/":
+		return deviceFileInfo{name: "/", mode: os.ModeDir | 0o555}, nil
+	case "/" + d.name():
+		return d.fileInfo()
+	}
+	return nil, os.ErrNotExist
+}
+
+func (d DeviceFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	if path.Clean("/"+p) != "/" {
+		if _, err := d.stat(p); err != nil {
+			return nil, err
+		}
+		return nil, os.ErrInvalid
+	}
+	info, err := d.fileInfo()
+	if err != nil {
+		return nil, err
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset > 0 || len(ls) == 0 {
+			return 0, io.EOF
+		}
+		ls[0] = info
+		return 1, io.EOF
+	}, nil
+}
+
+func (d DeviceFS) Lstat(p string) (os.FileInfo, error) {
+	return d.stat(p)
+}
+
+func (d DeviceFS) Stat(p string) (os.FileInfo, error) {
+	return d.stat(p)
+}
+
+func (d DeviceFS) ReadLink(p string) (os.FileInfo, error) {
+	return d.stat(p)
+}
+
+func (d DeviceFS) Read(p string) (io.ReaderAt, error) {
+	if path.Clean("/"+p) != "/"+d.name() {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(d.Path)
+}
+
+func (d DeviceFS) Write(_ string) (io.WriterAt, error) {
+	return nil, ErrForbidden
+}
+
+func (d DeviceFS) SetStat(_ string, _ gosftp.FileAttrFlags, _ *gosftp.FileStat) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Rename(_, _ string) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Rmdir(_ string) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Rm(_ string) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Mkdir(_ string) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Link(_, _ string) error {
+	return ErrForbidden
+}
+
+func (d DeviceFS) Symlink(_, _ string) error {
+	return ErrForbidden
+}
+
+// Space reports the size of the device, of which nothing is available.
+func (d DeviceFS) Space(_ string) (Space, error) {
+	info, err := d.fileInfo()
+	if err != nil {
+		return Space{}, err
+	}
+	return Space{Total: uint64(info.Size()), Files: 1}, nil
+}
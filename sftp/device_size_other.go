@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package sftp
+
+import (
+	"io"
+	"os"
+)
+
+// blockDeviceSize returns the size of the block device opened as file in bytes. Without the ioctl of linux,
+// we rely on the end of the device the operating system reports when seeking.
+func blockDeviceSize(file *os.File) (int64, error) {
+	return file.Seek(0, io.SeekEnd)
+}
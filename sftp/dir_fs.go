@@ -24,6 +24,10 @@ type DirFs struct {
 	Root string
 	// Whether to only support read operations.
 	Readonly bool
+	// The permission of newly created files. If nil, 0644 is used (limited by the umask of the process).
+	FileMode *os.FileMode
+	// The permission of newly created directories. If nil, 0755 is used (limited by the umask of the process).
+	DirMode *os.FileMode
 }
 
 func (d DirFs) statOfRoot() (os.FileInfo, error) {
@@ -154,7 +158,70 @@ func (d DirFs) Write(path string) (io.WriterAt, error) {
 	if !d.CanWrite(abspath) {
 		return nil, ErrForbidden
 	}
-	return os.OpenFile(abspath, os.O_WRONLY|os.O_CREATE, 0o644)
+	if d.FileMode == nil {
+		return os.OpenFile(abspath, os.O_WRONLY|os.O_CREATE, 0o644)
+	}
+	_, statErr := os.Lstat(abspath)
+	file, err := os.OpenFile(abspath, os.O_WRONLY|os.O_CREATE, *d.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	// The umask of the process has been applied during creation, so we have to set the permission explicitly.
+	if os.IsNotExist(statErr) {
+		if err := file.Chmod(*d.FileMode); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// Copy copies the file without reading it into this process. The copy is cloned if the filesystem supports it.
+func (d DirFs) Copy(src, dst string) error {
+	absSrc, err := d.IntoAbsPath(src)
+	if err != nil {
+		return err
+	}
+	absDst, err := d.IntoAbsPath(dst)
+	if err != nil {
+		return err
+	}
+	if !d.CanRead(absSrc) || !d.CanWrite(absDst) {
+		return ErrForbidden
+	}
+	in, err := os.Open(absSrc)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	srcStat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !srcStat.Mode().IsRegular() {
+		return fmt.Errorf("%s is no regular file", src)
+	}
+	// Truncating the destination would destroy the source otherwise.
+	if dstStat, err := os.Stat(absDst); err == nil && os.SameFile(srcStat, dstStat) {
+		return fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+	writer, err := d.Write(dst)
+	if err != nil {
+		return err
+	}
+	out := writer.(*os.File)
+	if err := out.Truncate(0); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if cloneFile(out, in) != nil {
+		// Uses copy_file_range where available, so the content still stays in the kernel.
+		if _, err := io.Copy(out, in); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	return out.Close()
 }
 
 func (d DirFs) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
@@ -255,7 +322,15 @@ func (d DirFs) Mkdir(path string) error {
 	if !d.CanWrite(abspath) {
 		return ErrForbidden
 	}
-	return os.Mkdir(abspath, 0o755)
+	if d.DirMode == nil {
+		return os.Mkdir(abspath, 0o755)
+	}
+	err = os.Mkdir(abspath, *d.DirMode)
+	if err != nil {
+		return err
+	}
+	// The umask of the process has been applied during creation, so we have to set the permission explicitly.
+	return os.Chmod(abspath, *d.DirMode)
 }
 
 func (d DirFs) Link(src, dst string) error {
@@ -287,3 +362,20 @@ func (d DirFs) Symlink(src, dst string) error {
 	}
 	return os.Symlink(absSrc, absDst)
 }
+
+// Space returns the space of the disk containing the path. Nothing is available if the filesystem is read-only.
+func (d DirFs) Space(path string) (Space, error) {
+	abspath, err := d.IntoAbsPath(path)
+	if err != nil {
+		return Space{}, err
+	}
+	if !d.CanRead(abspath) {
+		return Space{}, ErrForbidden
+	}
+	space, err := diskSpace(abspath)
+	if d.Readonly {
+		space.Available = 0
+		space.FreeFiles = 0
+	}
+	return space, err
+}
@@ -0,0 +1,642 @@
+package sftp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// The number of plaintext bytes encrypted together. Every chunk is stored with its own nonce and tag.
+	encryptedChunkSize = 64 * 1024
+	// The size of the random nonce stored in front of every chunk.
+	encryptedNonceSize = 12
+	// The number of bytes a chunk grows by on the disk: its nonce and the tag of AES-GCM.
+	encryptedOverhead = encryptedNonceSize + 16
+	// The size of a full chunk on the disk.
+	encryptedDiskChunkSize = encryptedChunkSize + encryptedOverhead
+	// The first bytes of every encrypted file, followed by the random id of the file. Files of the first version
+	// did not mark their last chunk.
+	encryptedMagic = "SSE2"
+	// The size of the random id of a file, which binds its chunks to it.
+	encryptedFileIDSize = 16
+	// The size of the header in front of the first chunk.
+	encryptedHeaderSize = int64(len(encryptedMagic) + encryptedFileIDSize)
+)
+
+// ErrNotEncrypted is returned for files of an [sftp.EncryptedFS] that have not been written through it.
+var ErrNotEncrypted = errors.New("the file is not encrypted")
+
+// ErrTruncated is returned (wrapped) for files of an [sftp.EncryptedFS] whose last chunks have been cut off.
+var ErrTruncated = errors.New("the encrypted file is truncated")
+
+// EncryptedFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and stores the content of all files
+// encrypted with AES-GCM, so the inner filesystem never sees the plaintext. Every file gets a random id and is
+// encrypted in chunks of 64 KiB, each with a random nonce, so files can be read and written at any offset.
+// The last chunk is marked as such (like the STREAM construction), so files whose end has been cut off on the
+// inner filesystem are detected instead of being read as shorter files. Even empty files have a last chunk.
+// Optionally, the names of files and directories are encrypted as well. Must be created with NewEncryptedFS.
+type EncryptedFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// Whether the names of files and directories are encrypted as well. Names of the inner filesystem that cannot
+	// be decrypted are not listed then.
+	EncryptNames bool
+	aead         cipher.AEAD
+	// The key for deriving the nonces of the names, which have to be the same for the same name.
+	nameKey []byte
+}
+
+// NewEncryptedFS creates an EncryptedFS with the given AES key of 16, 24 or 32 bytes.
+func NewEncryptedFS(inner SimplifiedFS, key []byte, encryptNames bool) (EncryptedFS, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return EncryptedFS{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return EncryptedFS{}, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("sshtool file names"))
+	return EncryptedFS{Inner: inner, EncryptNames: encryptNames, aead: aead, nameKey: mac.Sum(nil)}, nil
+}
+
+// Returns the plaintext size of a file with the given size on the disk.
+func encryptedPlainSize(diskSize int64) int64 {
+	if diskSize <= encryptedHeaderSize {
+		return 0
+	}
+	n := diskSize - encryptedHeaderSize
+	size := n / encryptedDiskChunkSize * encryptedChunkSize
+	if rest := n % encryptedDiskChunkSize; rest > encryptedOverhead {
+		size += rest - encryptedOverhead
+	}
+	return size
+}
+
+// Returns the offset of a chunk on the disk.
+func encryptedChunkOffset(index int64) int64 {
+	return encryptedHeaderSize + index*encryptedDiskChunkSize
+}
+
+// encryptName encrypts a single component of a path. The nonce is derived from the name, so the same name is
+// always encrypted the same way and can be looked up.
+func (e EncryptedFS) encryptName(name string) string {
+	mac := hmac.New(sha256.New, e.nameKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:e.aead.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(e.aead.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// decryptName decrypts a single component of a path encrypted with encryptName.
+func (e EncryptedFS) decryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) < e.aead.NonceSize() {
+		return "", ErrNotEncrypted
+	}
+	plain, err := e.aead.Open(nil, data[:e.aead.NonceSize()], data[e.aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrNotEncrypted
+	}
+	return string(plain), nil
+}
+
+// Returns the path on the inner filesystem.
+func (e EncryptedFS) innerPath(path string) string {
+	if !e.EncryptNames {
+		return path
+	}
+	components := strings.Split(path, "/")
+	for i, component := range components {
+		if component != "" && component != "." && component != ".." {
+			components[i] = e.encryptName(component)
+		}
+	}
+	return strings.Join(components, "/")
+}
+
+// encryptedInfo reports the plaintext size and name of a file.
+type encryptedInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i encryptedInfo) Name() string {
+	return i.name
+}
+
+func (i encryptedInfo) Size() int64 {
+	return i.size
+}
+
+// Returns the info of an inner file as seen through this filesystem. The name is only decrypted if decryptName is
+// true, as the root and the targets of links keep theirs.
+func (e EncryptedFS) info(info os.FileInfo, decryptName bool) (os.FileInfo, error) {
+	name := info.Name()
+	if e.EncryptNames && decryptName {
+		var err error
+		if name, err = e.decryptName(name); err != nil {
+			return nil, err
+		}
+	}
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		size = encryptedPlainSize(size)
+	}
+	return encryptedInfo{FileInfo: info, name: name, size: size}, nil
+}
+
+// Whether the path is the root of the filesystem, whose name is not encrypted.
+func isRoot(path string) bool {
+	return strings.Trim(path, "/.") == ""
+}
+
+func (e EncryptedFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	iter, err := e.Inner.List(e.innerPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if e.EncryptNames {
+		iter = filteredLister(iter, func(info os.FileInfo) bool {
+			_, err := e.decryptName(info.Name())
+			return err == nil
+		})
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		n, err := iter(ls, offset)
+		for i, info := range ls[:n] {
+			// Undecryptable names have been left out above.
+			ls[i], _ = e.info(info, true)
+		}
+		return n, err
+	}, nil
+}
+
+func (e EncryptedFS) Lstat(path string) (os.FileInfo, error) {
+	info, err := e.Inner.Lstat(e.innerPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return e.info(info, !isRoot(path))
+}
+
+func (e EncryptedFS) Stat(path string) (os.FileInfo, error) {
+	info, err := e.Inner.Stat(e.innerPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return e.info(info, !isRoot(path))
+}
+
+func (e EncryptedFS) ReadLink(path string) (os.FileInfo, error) {
+	info, err := e.Inner.ReadLink(e.innerPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return e.info(info, false)
+}
+
+// encryptedFile encrypts and decrypts the chunks of a single file.
+type encryptedFile struct {
+	aead cipher.AEAD
+	// The random id of the file from its header.
+	id []byte
+	// Reads the encrypted content. May be nil if the file cannot be read.
+	reader io.ReaderAt
+}
+
+// Reads the id of the file from its header. Returns nil if the file is empty.
+func readEncryptedHeader(reader io.ReaderAt) ([]byte, error) {
+	header := make([]byte, encryptedHeaderSize)
+	n, err := reader.ReadAt(header, 0)
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if n < len(header) || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrNotEncrypted
+	}
+	return header[len(encryptedMagic):], nil
+}
+
+// The additional data of a chunk, which binds it to its file and its position and tells whether it is the last one.
+func (f *encryptedFile) additionalData(index int64, last bool) []byte {
+	data := binary.BigEndian.AppendUint64(append([]byte{}, f.id...), uint64(index))
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// readChunk returns the plaintext of a chunk and whether it is the last one. The plaintext is nil if there is no
+// chunk at the index.
+func (f *encryptedFile) readChunk(index int64) ([]byte, bool, error) {
+	data := make([]byte, encryptedDiskChunkSize)
+	n, err := f.reader.ReadAt(data, encryptedChunkOffset(index))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+	if n == 0 {
+		return nil, false, nil
+	}
+	if n < encryptedOverhead {
+		return nil, false, fmt.Errorf("chunk %d: %w", index, ErrTruncated)
+	}
+	nonce, sealed := data[:encryptedNonceSize], data[encryptedNonceSize:n]
+	// Not nil even for the empty last chunk of an empty file.
+	plain := make([]byte, 0, n)
+	if plain, err := f.aead.Open(plain, nonce, sealed, f.additionalData(index, false)); err == nil {
+		return plain, false, nil
+	}
+	plain, err = f.aead.Open(plain, nonce, sealed, f.additionalData(index, true))
+	if err != nil {
+		return nil, false, fmt.Errorf("chunk %d cannot be decrypted: %w", index, err)
+	}
+	return plain, true, nil
+}
+
+// sealChunk encrypts the plaintext of a chunk with a new nonce.
+func (f *encryptedFile) sealChunk(index int64, plain []byte, last bool) ([]byte, error) {
+	nonce := make([]byte, encryptedNonceSize, encryptedNonceSize+len(plain)+f.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, plain, f.additionalData(index, last)), nil
+}
+
+// encryptedReader decrypts the chunks of a file while reading it.
+type encryptedReader struct {
+	encryptedFile
+}
+
+func (r *encryptedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	read := 0
+	for read < len(p) {
+		position := off + int64(read)
+		index := position / encryptedChunkSize
+		plain, last, err := r.readChunk(index)
+		if err != nil {
+			return read, err
+		}
+		if plain == nil {
+			return read, r.endOfFile(index)
+		}
+		start := int(position % encryptedChunkSize)
+		if start >= len(plain) {
+			if last {
+				return read, io.EOF
+			}
+			// Only the last chunk may be shorter.
+			return read, fmt.Errorf("chunk %d: %w", index, ErrTruncated)
+		}
+		read += copy(p[read:], plain[start:])
+		if last && read < len(p) {
+			return read, io.EOF
+		}
+	}
+	return read, nil
+}
+
+// endOfFile returns io.EOF if the chunk in front of the missing one at the index is the last one, and an error
+// wrapping ErrTruncated otherwise.
+func (r *encryptedReader) endOfFile(index int64) error {
+	if index > 0 {
+		plain, last, err := r.readChunk(index - 1)
+		if err != nil {
+			return err
+		}
+		if plain != nil && last {
+			return io.EOF
+		}
+	}
+	return fmt.Errorf("chunk %d is missing: %w", index, ErrTruncated)
+}
+
+func (r *encryptedReader) Close() error {
+	return closeIfCloser(r.reader)
+}
+
+func (e EncryptedFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := e.Inner.Read(e.innerPath(path))
+	if err != nil {
+		return nil, err
+	}
+	id, err := readEncryptedHeader(reader)
+	if err != nil {
+		_ = closeIfCloser(reader)
+		return nil, err
+	}
+	return &encryptedReader{encryptedFile{aead: e.aead, id: id, reader: reader}}, nil
+}
+
+// encryptedWriter encrypts the chunks of a file while writing it. The last changed chunk is kept in memory until
+// another one is changed or the writer is closed, so sequential writes encrypt and write every chunk only once.
+type encryptedWriter struct {
+	encryptedFile
+	writer io.WriterAt
+	// Protects the fields below, as the sftp server may write from several goroutines.
+	mutex sync.Mutex
+	// The plaintext size of the file including the chunk kept in memory and of the chunks on the disk.
+	size       int64
+	sizeOnDisk int64
+	// The index and the plaintext of the chunk kept in memory, which may not have been written yet (dirty).
+	index int64
+	chunk []byte
+	dirty bool
+	// The index of the chunk on the disk that is marked as the last one, or -1 if there is none.
+	last int64
+}
+
+// Returns the index of the last chunk of the file, which is the empty chunk 0 for an empty file.
+func (w *encryptedWriter) lastIndex() int64 {
+	if w.size == 0 {
+		return 0
+	}
+	return (w.size - 1) / encryptedChunkSize
+}
+
+// flush writes the chunk kept in memory if it has been changed. If it is the last one now, the chunk that has been
+// the last one before is written again without the mark.
+func (w *encryptedWriter) flush() error {
+	if !w.dirty {
+		return nil
+	}
+	last := w.index == w.lastIndex()
+	sealed, err := w.sealChunk(w.index, w.chunk, last)
+	if err != nil {
+		return err
+	}
+	if _, err := w.writer.WriteAt(sealed, encryptedChunkOffset(w.index)); err != nil {
+		return err
+	}
+	w.dirty = false
+	w.sizeOnDisk = max(w.sizeOnDisk, w.index*encryptedChunkSize+int64(len(w.chunk)))
+	previous := w.last
+	switch {
+	case last:
+		w.last = w.index
+	case w.last == w.index:
+		w.last = -1
+	}
+	if last && previous >= 0 && previous != w.index {
+		return w.unmark(previous)
+	}
+	return nil
+}
+
+// unmark writes the chunk with the given index again without marking it as the last one.
+func (w *encryptedWriter) unmark(index int64) error {
+	if w.reader == nil {
+		return fmt.Errorf("changing written chunks requires reading the file: %w", ErrNotSupported)
+	}
+	plain, _, err := w.readChunk(index)
+	if err != nil {
+		return err
+	}
+	if plain == nil {
+		return fmt.Errorf("chunk %d is missing: %w", index, ErrTruncated)
+	}
+	sealed, err := w.sealChunk(index, plain, false)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.WriteAt(sealed, encryptedChunkOffset(index))
+	return err
+}
+
+// finish marks the last chunk of the file, which may not have been written since its size has changed.
+func (w *encryptedWriter) finish() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.last == w.lastIndex() {
+		return nil
+	}
+	if err := w.load(w.lastIndex()); err != nil {
+		return err
+	}
+	w.dirty = true
+	return w.flush()
+}
+
+// load keeps the chunk with the given index in memory, writing the previous one.
+func (w *encryptedWriter) load(index int64) error {
+	if w.chunk != nil && w.index == index {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.index, w.chunk = index, nil
+	if index*encryptedChunkSize >= w.sizeOnDisk {
+		// The chunk does not exist yet.
+		w.chunk = []byte{}
+		return nil
+	}
+	if w.reader == nil {
+		return fmt.Errorf("changing written chunks requires reading the file: %w", ErrNotSupported)
+	}
+	chunk, _, err := w.readChunk(index)
+	if err != nil {
+		return err
+	}
+	if chunk == nil {
+		return fmt.Errorf("chunk %d is missing: %w", index, ErrTruncated)
+	}
+	w.chunk = chunk
+	return nil
+}
+
+// Writes p at off, which must not be beyond the end of the file.
+func (w *encryptedWriter) write(p []byte, off int64) error {
+	written := 0
+	for written < len(p) {
+		position := off + int64(written)
+		start := int(position % encryptedChunkSize)
+		n := int(min(int64(encryptedChunkSize-start), int64(len(p)-written)))
+		// Grown before loading, so the chunk in memory is not written as the last one if this one follows it.
+		w.size = max(w.size, position+int64(n))
+		if err := w.load(position / encryptedChunkSize); err != nil {
+			return err
+		}
+		if len(w.chunk) < start+n {
+			w.chunk = append(w.chunk, make([]byte, start+n-len(w.chunk))...)
+		}
+		copy(w.chunk[start:], p[written:written+n])
+		w.dirty = true
+		written += n
+	}
+	return nil
+}
+
+func (w *encryptedWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// A gap is filled with zeros, as every chunk in front of the written one has to exist.
+	zeros := make([]byte, encryptedChunkSize)
+	for w.size < off {
+		if err := w.write(zeros[:min(off-w.size, encryptedChunkSize)], w.size); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.write(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *encryptedWriter) Close() error {
+	w.mutex.Lock()
+	err := w.finish()
+	w.mutex.Unlock()
+	if closeErr := closeIfCloser(w.writer); err == nil {
+		err = closeErr
+	}
+	if closeErr := closeIfCloser(w.reader); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Opens the file at the inner path for writing and reads its header, or writes one for a new file. The reader is
+// nil if the file cannot be read, so only new files can be written.
+func (e EncryptedFS) openWriter(path string) (*encryptedWriter, error) {
+	writer, err := e.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &encryptedWriter{encryptedFile: encryptedFile{aead: e.aead}, writer: writer, last: -1}
+	if reader, err := e.Inner.Read(path); err == nil {
+		w.reader = reader
+		if w.id, err = readEncryptedHeader(reader); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		if stat, err := e.Inner.Stat(path); err == nil {
+			w.size = encryptedPlainSize(stat.Size())
+			w.sizeOnDisk = w.size
+			w.last = w.lastIndex()
+		}
+	}
+	if w.id == nil {
+		w.id = make([]byte, encryptedFileIDSize)
+		if _, err := rand.Read(w.id); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		if _, err := writer.WriteAt(append([]byte(encryptedMagic), w.id...), 0); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		w.size, w.sizeOnDisk, w.last = 0, 0, -1
+	}
+	return w, nil
+}
+
+func (e EncryptedFS) Write(path string) (io.WriterAt, error) {
+	return e.openWriter(e.innerPath(path))
+}
+
+// SetStat truncates files to their size on the disk, re-encrypting the new last chunk.
+func (e EncryptedFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	path = e.innerPath(path)
+	if flags.Size {
+		if err := e.truncate(path, int64(attributes.Size)); err != nil {
+			return err
+		}
+		flags.Size = false
+	}
+	return e.Inner.SetStat(path, flags, attributes)
+}
+
+// Changes the plaintext size of the file at the inner path.
+func (e EncryptedFS) truncate(path string, size int64) error {
+	resize := func(diskSize int64) error {
+		return e.Inner.SetStat(path, gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: uint64(diskSize)})
+	}
+	if size == 0 {
+		// Written again with a new id and an empty last chunk.
+		if err := resize(0); err != nil {
+			return err
+		}
+	}
+	w, err := e.openWriter(path)
+	if err != nil {
+		return err
+	}
+	if size >= w.size {
+		// Growing fills the file with zeros.
+		if _, err := w.WriteAt(nil, size); err != nil {
+			_ = w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	index := size / encryptedChunkSize
+	rest := int(size % encryptedChunkSize)
+	if rest > 0 {
+		if err := w.load(index); err != nil {
+			_ = w.Close()
+			return err
+		}
+		w.chunk, w.dirty = w.chunk[:rest], true
+	}
+	if err := resize(encryptedChunkOffset(index)); err != nil {
+		_ = w.Close()
+		return err
+	}
+	// The new last chunk is marked when closing.
+	w.size, w.sizeOnDisk, w.last = size, index*encryptedChunkSize, -1
+	return w.Close()
+}
+
+func (e EncryptedFS) Rename(src, dst string) error {
+	return e.Inner.Rename(e.innerPath(src), e.innerPath(dst))
+}
+
+// Copy copies the encrypted content, which stays valid as the id of the file is copied along.
+func (e EncryptedFS) Copy(src, dst string) error {
+	return CopyFile(e.Inner, e.innerPath(src), e.innerPath(dst))
+}
+
+func (e EncryptedFS) Rmdir(path string) error {
+	return e.Inner.Rmdir(e.innerPath(path))
+}
+
+func (e EncryptedFS) Rm(path string) error {
+	return e.Inner.Rm(e.innerPath(path))
+}
+
+func (e EncryptedFS) Mkdir(path string) error {
+	return e.Inner.Mkdir(e.innerPath(path))
+}
+
+func (e EncryptedFS) Link(src, dst string) error {
+	return e.Inner.Link(e.innerPath(src), e.innerPath(dst))
+}
+
+func (e EncryptedFS) Symlink(src, dst string) error {
+	return e.Inner.Symlink(e.innerPath(src), e.innerPath(dst))
+}
+
+func (e EncryptedFS) Space(path string) (Space, error) {
+	return SpaceOf(e.Inner, e.innerPath(path))
+}
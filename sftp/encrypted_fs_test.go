@@ -0,0 +1,147 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	root := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, encryptNames := range []bool{false, true} {
+		fs, err := NewEncryptedFS(DirFs{Root: root + "/"}, key, encryptNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, 3*encryptedChunkSize+123)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+		writer, err := fs.Write("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Out of order, like parallel writes of a client.
+		half := len(content) / 2
+		if _, err := writer.WriteAt(content[half:], int64(half)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.WriteAt(content[:half], 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := closeIfCloser(writer); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, _ := os.ReadDir(root)
+		if len(entries) != 1 || (entries[0].Name() == "file") == encryptNames {
+			t.Errorf("stored names %v with encryptNames %v", entries, encryptNames)
+		}
+		stored, _ := os.ReadFile(filepath.Join(root, entries[0].Name()))
+		if bytes.Contains(stored, content[:64]) {
+			t.Error("the content is stored as plaintext")
+		}
+
+		read := func() []byte {
+			reader, err := fs.Read("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeIfCloser(reader)
+			stat, err := fs.Stat("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(io.NewSectionReader(reader, 0, stat.Size()+10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+		if got := read(); !bytes.Equal(got, content) {
+			t.Errorf("read %d bytes, want the %d written ones", len(got), len(content))
+		}
+
+		if err := fs.SetStat("/file", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: encryptedChunkSize + 5}); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(); !bytes.Equal(got, content[:encryptedChunkSize+5]) {
+			t.Errorf("read %d bytes after truncating, want %d", len(got), encryptedChunkSize+5)
+		}
+
+		lister, err := fs.List("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls := make([]os.FileInfo, 2)
+		if n, _ := lister(ls, 0); n != 1 || ls[0].Name() != "file" || ls[0].Size() != encryptedChunkSize+5 {
+			t.Errorf("listed %d entries, want file with its plaintext size", n)
+		}
+		if err := fs.Rm("/file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "plain"), []byte("not encrypted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs, _ := NewEncryptedFS(DirFs{Root: root + "/"}, key, false)
+	if _, err := fs.Read("/plain"); err != ErrNotEncrypted {
+		t.Errorf("Read() of a plain file = %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestEncryptedFSTruncated(t *testing.T) {
+	root := t.TempDir()
+	fs, err := NewEncryptedFS(DirFs{Root: root + "/"}, bytes.Repeat([]byte{7}, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(content []byte, off int64) {
+		writer, err := fs.Write("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.WriteAt(content, off); err != nil {
+			t.Fatal(err)
+		}
+		if err := closeIfCloser(writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() ([]byte, error) {
+		reader, err := fs.Read("/file")
+		if err != nil {
+			return nil, err
+		}
+		defer closeIfCloser(reader)
+		return io.ReadAll(io.NewSectionReader(reader, 0, 10*encryptedChunkSize))
+	}
+
+	write(nil, 0)
+	if data, err := read(); err != nil || len(data) != 0 {
+		t.Errorf("reading an empty file = %d bytes, %v", len(data), err)
+	}
+	// Appending behind a full chunk has to remove the mark of the former last chunk.
+	content := bytes.Repeat([]byte{1}, 2*encryptedChunkSize)
+	write(content[:encryptedChunkSize], 0)
+	write(content[encryptedChunkSize:], encryptedChunkSize)
+	if data, err := read(); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("reading the appended file = %d bytes, %v", len(data), err)
+	}
+
+	for _, size := range []int64{encryptedChunkOffset(1), encryptedHeaderSize, 0} {
+		if err := os.Truncate(filepath.Join(root, "file"), size); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := read(); !errors.Is(err, ErrTruncated) {
+			t.Errorf("reading the file cut to %d bytes = %v, want ErrTruncated", size, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+)
+
+// extendedRequest reads the fields of the data of an extended request.
+type extendedRequest []byte
+
+func (r *extendedRequest) uint64() (uint64, error) {
+	if len(*r) < 8 {
+		return 0, fmt.Errorf("malformed request")
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, nil
+}
+
+func (r *extendedRequest) string() (string, error) {
+	if len(*r) < 4 {
+		return "", fmt.Errorf("malformed request")
+	}
+	n := binary.BigEndian.Uint32(*r)
+	if uint32(len(*r)-4) < n {
+		return "", fmt.Errorf("malformed request")
+	}
+	s := string((*r)[4 : 4+n])
+	*r = (*r)[4+n:]
+	return s, nil
+}
+
+func (r *extendedRequest) bool() (bool, error) {
+	if len(*r) < 1 {
+		return false, fmt.Errorf("malformed request")
+	}
+	v := (*r)[0] != 0
+	*r = (*r)[1:]
+	return v, nil
+}
+
+// Extensions returns the extended requests of the sftp protocol that are supported in addition to the
+// ones of [gosftp.RequestServer].
+func (w *wrapper) Extensions() []string {
+	return []string{"copy-file", "copy-data", "tree-size@sshtool", "space-available"}
+}
+
+// Extended handles the extended requests returned by Extensions.
+func (w *wrapper) Extended(request string, data []byte, file func(handle string) (string, bool)) ([]byte, error) {
+	r := extendedRequest(data)
+	var path, kind string
+	var reply []byte
+	var err error
+	switch request {
+	case "copy-file":
+		kind = "Copy"
+		_, path, err = w.copyFile(&r)
+	case "copy-data":
+		kind = "Copy"
+		_, path, err = w.copyData(&r, file)
+	case "tree-size@sshtool":
+		kind = "TreeSize"
+		path, reply, err = w.treeSize(&r)
+	case "space-available":
+		kind = "Space"
+		path, reply, err = w.spaceAvailable(&r)
+	default:
+		return nil, gosftp.ErrSSHFxOpUnsupported
+	}
+	return reply, w.logExtended(request, kind, path, err)
+}
+
+// FileExtensions returns the extended requests that are answered with a handle the client reads from.
+func (w *wrapper) FileExtensions() []string {
+	return []string{"tar@sshtool"}
+}
+
+// ExtendedFile handles the extended requests returned by FileExtensions.
+func (w *wrapper) ExtendedFile(request string, data []byte) (io.ReaderAt, error) {
+	r := extendedRequest(data)
+	switch request {
+	case "tar@sshtool":
+		path, file, err := w.tar(&r)
+		return file, w.logExtended(request, "Tar", path, err)
+	default:
+		return nil, gosftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// Logs the result of an extended request. Returns the error to send to the client.
+func (w *wrapper) logExtended(request string, kind string, path string, err error) error {
+	if errors.Is(err, ErrNotSupported) {
+		err = gosftp.ErrSSHFxOpUnsupported
+	}
+	if errors.Is(err, ErrForbidden) {
+		w.logAccess(path, kind, "forbidden")
+	} else if err != nil {
+		w.logAccess(path, kind, "error")
+		w.logError(fmt.Sprintf("Error during the %s request", request), err)
+	} else {
+		w.logAccess(path, kind, "ok")
+	}
+	return err
+}
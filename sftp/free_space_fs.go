@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoSpace is returned when a write is refused because the backing filesystem has not enough free space left.
+var ErrNoSpace = fmt.Errorf("not enough free space left on the device")
+
+// FreeSpaceFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and refuses all new writes
+// as soon as the free space of the operating system filesystem at Path drops below a threshold.
+type FreeSpaceFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// A path within the operating system filesystem whose free space should be checked.
+	Path string
+	// The minimal number of bytes that must remain free. Zero disables this check.
+	MinFreeBytes uint64
+	// The minimal percentage (0-100) of the total size that must remain free. Zero disables this check.
+	MinFreePercent float64
+}
+
+// HasEnoughSpace checks whether the free space at Path is above the configured thresholds.
+func (f FreeSpaceFS) HasEnoughSpace() error {
+	free, total, err := freeSpace(f.Path)
+	if err != nil {
+		return err
+	}
+	if free < f.MinFreeBytes {
+		return ErrNoSpace
+	}
+	if total > 0 && float64(free)/float64(total)*100 < f.MinFreePercent {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// spaceCheckingWriter is an [io.WriterAt] that periodically checks the free space while writing.
+type spaceCheckingWriter struct {
+	io.WriterAt
+	fs FreeSpaceFS
+	// Protects the fields below
+	mutex     sync.Mutex
+	lastCheck time.Time
+	lastErr   error
+}
+
+// How long the result of a free space check is reused while writing.
+const freeSpaceCheckInterval = time.Second
+
+func (w *spaceCheckingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	if time.Since(w.lastCheck) > freeSpaceCheckInterval {
+		w.lastErr = w.fs.HasEnoughSpace()
+		w.lastCheck = time.Now()
+	}
+	err := w.lastErr
+	w.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return w.WriterAt.WriteAt(p, off)
+}
+
+func (w *spaceCheckingWriter) Close() error {
+	return closeIfCloser(w.WriterAt)
+}
+
+func (f FreeSpaceFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return f.Inner.List(path)
+}
+
+func (f FreeSpaceFS) Lstat(path string) (os.FileInfo, error) {
+	return f.Inner.Lstat(path)
+}
+
+func (f FreeSpaceFS) Stat(path string) (os.FileInfo, error) {
+	return f.Inner.Stat(path)
+}
+
+func (f FreeSpaceFS) ReadLink(path string) (os.FileInfo, error) {
+	return f.Inner.ReadLink(path)
+}
+
+func (f FreeSpaceFS) Read(path string) (io.ReaderAt, error) {
+	return f.Inner.Read(path)
+}
+
+func (f FreeSpaceFS) Write(path string) (io.WriterAt, error) {
+	if err := f.HasEnoughSpace(); err != nil {
+		return nil, err
+	}
+	writer, err := f.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spaceCheckingWriter{WriterAt: writer, fs: f, lastCheck: time.Now()}, nil
+}
+
+func (f FreeSpaceFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if flags.Size {
+		// Truncating may also enlarge a file
+		if err := f.HasEnoughSpace(); err != nil {
+			return err
+		}
+	}
+	return f.Inner.SetStat(path, flags, attributes)
+}
+
+func (f FreeSpaceFS) Rename(src, dst string) error {
+	return f.Inner.Rename(src, dst)
+}
+
+func (f FreeSpaceFS) Rmdir(path string) error {
+	return f.Inner.Rmdir(path)
+}
+
+func (f FreeSpaceFS) Rm(path string) error {
+	return f.Inner.Rm(path)
+}
+
+func (f FreeSpaceFS) Mkdir(path string) error {
+	if err := f.HasEnoughSpace(); err != nil {
+		return err
+	}
+	return f.Inner.Mkdir(path)
+}
+
+func (f FreeSpaceFS) Link(src, dst string) error {
+	return f.Inner.Link(src, dst)
+}
+
+func (f FreeSpaceFS) Symlink(src, dst string) error {
+	return f.Inner.Symlink(src, dst)
+}
+
+// Space returns the space of the inner filesystem without the bytes that must remain free.
+func (f FreeSpaceFS) Space(path string) (Space, error) {
+	space, err := SpaceOf(f.Inner, path)
+	if err != nil {
+		return space, err
+	}
+	reserved := uint64(float64(space.Total) * f.MinFreePercent / 100)
+	if f.MinFreeBytes > reserved {
+		reserved = f.MinFreeBytes
+	}
+	if space.Available > reserved {
+		space.Available -= reserved
+	} else {
+		space.Available = 0
+	}
+	return space, nil
+}
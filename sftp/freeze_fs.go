@@ -0,0 +1,192 @@
+package sftp
+
+import (
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFrozen is returned by a FreezableFS for every change while its directory is frozen.
+var ErrFrozen = fmt.Errorf("the directory is read-only at the moment")
+
+// Freeze decides whether a directory is frozen, i.e. read-only for a while. It is frozen on demand or by a
+// schedule and can be shared by several filesystems.
+type Freeze struct {
+	// Whether the directory has been frozen on demand.
+	manual atomic.Bool
+	// Protects scheduled
+	mutex sync.Mutex
+	// Returns whether the schedule freezes the directory at the given time. May be nil.
+	scheduled func(time.Time) bool
+}
+
+// NewFreeze creates a Freeze for a directory that is frozen whenever scheduled returns true (if not nil).
+func NewFreeze(scheduled func(time.Time) bool) *Freeze {
+	return &Freeze{scheduled: scheduled}
+}
+
+// SetSchedule replaces the schedule, which may be nil.
+func (f *Freeze) SetSchedule(scheduled func(time.Time) bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.scheduled = scheduled
+}
+
+// Set freezes the directory on demand until it is thawed again by Set(false). The schedule still applies.
+func (f *Freeze) Set(frozen bool) {
+	f.manual.Store(frozen)
+}
+
+// Manual returns whether the directory has been frozen on demand.
+func (f *Freeze) Manual() bool {
+	return f.manual.Load()
+}
+
+// Frozen returns whether the directory is currently frozen, on demand or by the schedule.
+func (f *Freeze) Frozen() bool {
+	if f.manual.Load() {
+		return true
+	}
+	f.mutex.Lock()
+	scheduled := f.scheduled
+	f.mutex.Unlock()
+	return scheduled != nil && scheduled(time.Now())
+}
+
+// Returns ErrFrozen if changes are currently rejected.
+func (f *Freeze) allow() error {
+	if f.Frozen() {
+		return ErrFrozen
+	}
+	return nil
+}
+
+// FreezableFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and rejects all changes with
+// ErrFrozen while its Freeze is frozen. Files opened for writing before cannot be written anymore, too.
+type FreezableFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner  SimplifiedFS
+	Freeze *Freeze
+}
+
+// freezableWriter is an [io.WriterAt] that rejects writes while its directory is frozen.
+type freezableWriter struct {
+	io.WriterAt
+	freeze *Freeze
+}
+
+func (w freezableWriter) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.freeze.allow(); err != nil {
+		return 0, err
+	}
+	return w.WriterAt.WriteAt(p, off)
+}
+
+func (w freezableWriter) Close() error {
+	return closeIfCloser(w.WriterAt)
+}
+
+func (f FreezableFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return f.Inner.List(path)
+}
+
+func (f FreezableFS) Lstat(path string) (os.FileInfo, error) {
+	return f.Inner.Lstat(path)
+}
+
+func (f FreezableFS) Stat(path string) (os.FileInfo, error) {
+	return f.Inner.Stat(path)
+}
+
+func (f FreezableFS) ReadLink(path string) (os.FileInfo, error) {
+	return f.Inner.ReadLink(path)
+}
+
+func (f FreezableFS) Read(path string) (io.ReaderAt, error) {
+	return f.Inner.Read(path)
+}
+
+func (f FreezableFS) Write(path string) (io.WriterAt, error) {
+	if err := f.Freeze.allow(); err != nil {
+		return nil, err
+	}
+	writer, err := f.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	return freezableWriter{WriterAt: writer, freeze: f.Freeze}, nil
+}
+
+func (f FreezableFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.SetStat(path, flags, attributes)
+}
+
+func (f FreezableFS) Rename(src, dst string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Rename(src, dst)
+}
+
+func (f FreezableFS) Copy(src, dst string) error {
+	copier, ok := f.Inner.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return copier.Copy(src, dst)
+}
+
+func (f FreezableFS) Rmdir(path string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Rmdir(path)
+}
+
+func (f FreezableFS) Rm(path string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Rm(path)
+}
+
+func (f FreezableFS) Mkdir(path string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Mkdir(path)
+}
+
+func (f FreezableFS) Link(src, dst string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Link(src, dst)
+}
+
+func (f FreezableFS) Symlink(src, dst string) error {
+	if err := f.Freeze.allow(); err != nil {
+		return err
+	}
+	return f.Inner.Symlink(src, dst)
+}
+
+func (f FreezableFS) Space(path string) (Space, error) {
+	space, err := SpaceOf(f.Inner, path)
+	if f.Freeze.Frozen() {
+		// Nothing can be written at the moment.
+		space.Available = 0
+		space.FreeFiles = 0
+	}
+	return space, err
+}
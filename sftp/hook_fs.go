@@ -0,0 +1,133 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+)
+
+// WriteHook is called by a [sftp.HookFS] after a file opened for writing has been closed.
+// The given filesystem is the one wrapped by the HookFS and can be used to read or remove the file.
+type WriteHook func(fs SimplifiedFS, path string)
+
+// CheckHook is called by a [sftp.HookFS] after a file opened for writing has been closed. A returned error
+// is reported to the client as failure of the close.
+type CheckHook func(fs SimplifiedFS, path string) error
+
+// RenameHook is called by a [sftp.HookFS] after a file has been renamed.
+type RenameHook func(fs SimplifiedFS, src, dst string)
+
+// HookFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and calls hooks after
+// certain operations.
+type HookFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// Called in order after a written file has been closed, before the hooks of AfterWrite. The first error stops
+	// calling further hooks (including AfterWrite) and is returned to the client.
+	CheckWrite []CheckHook
+	// Called in order after a written file has been closed. The close of the client finishes after the hooks.
+	AfterWrite []WriteHook
+	// Called in order after a file has been removed.
+	AfterRemove []WriteHook
+	// Called in order after a file has been renamed.
+	AfterRename []RenameHook
+}
+
+// hookWriter is an [io.WriterAt] that calls the hooks once it has been closed.
+type hookWriter struct {
+	io.WriterAt
+	fs   HookFS
+	path string
+	once sync.Once
+}
+
+func (w *hookWriter) Close() error {
+	err := closeIfCloser(w.WriterAt)
+	w.once.Do(func() {
+		for _, check := range w.fs.CheckWrite {
+			if checkErr := check(w.fs.Inner, w.path); checkErr != nil {
+				if err == nil {
+					err = checkErr
+				}
+				return
+			}
+		}
+		for _, hook := range w.fs.AfterWrite {
+			hook(w.fs.Inner, w.path)
+		}
+	})
+	return err
+}
+
+func (h HookFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return h.Inner.List(path)
+}
+
+func (h HookFS) Lstat(path string) (os.FileInfo, error) {
+	return h.Inner.Lstat(path)
+}
+
+func (h HookFS) Stat(path string) (os.FileInfo, error) {
+	return h.Inner.Stat(path)
+}
+
+func (h HookFS) ReadLink(path string) (os.FileInfo, error) {
+	return h.Inner.ReadLink(path)
+}
+
+func (h HookFS) Read(path string) (io.ReaderAt, error) {
+	return h.Inner.Read(path)
+}
+
+func (h HookFS) Write(path string) (io.WriterAt, error) {
+	writer, err := h.Inner.Write(path)
+	if err != nil || len(h.AfterWrite)+len(h.CheckWrite) == 0 {
+		return writer, err
+	}
+	return &hookWriter{WriterAt: writer, fs: h, path: path}, nil
+}
+
+func (h HookFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return h.Inner.SetStat(path, flags, attributes)
+}
+
+func (h HookFS) Rename(src, dst string) error {
+	if err := h.Inner.Rename(src, dst); err != nil {
+		return err
+	}
+	for _, hook := range h.AfterRename {
+		hook(h.Inner, src, dst)
+	}
+	return nil
+}
+
+func (h HookFS) Rmdir(path string) error {
+	return h.Inner.Rmdir(path)
+}
+
+func (h HookFS) Rm(path string) error {
+	if err := h.Inner.Rm(path); err != nil {
+		return err
+	}
+	for _, hook := range h.AfterRemove {
+		hook(h.Inner, path)
+	}
+	return nil
+}
+
+func (h HookFS) Mkdir(path string) error {
+	return h.Inner.Mkdir(path)
+}
+
+func (h HookFS) Link(src, dst string) error {
+	return h.Inner.Link(src, dst)
+}
+
+func (h HookFS) Symlink(src, dst string) error {
+	return h.Inner.Symlink(src, dst)
+}
+
+func (h HookFS) Space(path string) (Space, error) {
+	return SpaceOf(h.Inner, path)
+}
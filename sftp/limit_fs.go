@@ -0,0 +1,218 @@
+package sftp
+
+import (
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrTooManyRequests is returned by a LimitFS if the session has too many operations running.
+var ErrTooManyRequests = fmt.Errorf("too many requests at once, try again later")
+
+// ErrTooManyHandles is returned by a LimitFS if the session has too many open files.
+var ErrTooManyHandles = fmt.Errorf("too many open files, close some and try again")
+
+// SessionLimits counts the running operations and open files of a single session.
+type SessionLimits struct {
+	// The maximal number of operations (including reading or writing a chunk of a file) running at the same time.
+	// Zero means no limit.
+	MaxRequests int64
+	// The maximal number of open files. Zero means no limit.
+	MaxHandles int64
+	// Must be accessed atomically.
+	requests int64
+	handles  int64
+}
+
+// Reserves one of the given counted slots. Returns false if all are in use.
+func acquire(counter *int64, max int64) bool {
+	if max <= 0 {
+		return true
+	}
+	if atomic.AddInt64(counter, 1) > max {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+// Frees a slot reserved with acquire.
+func release(counter *int64, max int64) {
+	if max > 0 {
+		atomic.AddInt64(counter, -1)
+	}
+}
+
+// Runs f as an operation of the session unless too many are running already.
+func (l *SessionLimits) run(f func() error) error {
+	if !acquire(&l.requests, l.MaxRequests) {
+		return ErrTooManyRequests
+	}
+	defer release(&l.requests, l.MaxRequests)
+	return f()
+}
+
+// LimitFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and rejects operations exceeding the
+// SessionLimits, so a single client cannot use up the resources of the server.
+type LimitFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The limits of the session this filesystem is served to.
+	Limits *SessionLimits
+}
+
+// limitedReader is an [io.ReaderAt] whose reads count as operations of the session.
+type limitedReader struct {
+	io.ReaderAt
+	limits *SessionLimits
+	once   sync.Once
+}
+
+func (r *limitedReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	err := r.limits.run(func() error {
+		var err error
+		n, err = r.ReaderAt.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	r.once.Do(func() { release(&r.limits.handles, r.limits.MaxHandles) })
+	return closeIfCloser(r.ReaderAt)
+}
+
+// limitedWriter is an [io.WriterAt] whose writes count as operations of the session.
+type limitedWriter struct {
+	io.WriterAt
+	limits *SessionLimits
+	once   sync.Once
+}
+
+func (w *limitedWriter) WriteAt(p []byte, off int64) (int, error) {
+	var n int
+	err := w.limits.run(func() error {
+		var err error
+		n, err = w.WriterAt.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (w *limitedWriter) Close() error {
+	w.once.Do(func() { release(&w.limits.handles, w.limits.MaxHandles) })
+	return closeIfCloser(w.WriterAt)
+}
+
+func (l LimitFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	var lister func([]os.FileInfo, int64) (int, error)
+	err := l.Limits.run(func() error {
+		var err error
+		lister, err = l.Inner.List(path)
+		return err
+	})
+	return lister, err
+}
+
+// Runs a function returning a FileInfo as operation of the session.
+func (l LimitFS) stat(f func() (os.FileInfo, error)) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := l.Limits.run(func() error {
+		var err error
+		info, err = f()
+		return err
+	})
+	return info, err
+}
+
+func (l LimitFS) Lstat(path string) (os.FileInfo, error) {
+	return l.stat(func() (os.FileInfo, error) { return l.Inner.Lstat(path) })
+}
+
+func (l LimitFS) Stat(path string) (os.FileInfo, error) {
+	return l.stat(func() (os.FileInfo, error) { return l.Inner.Stat(path) })
+}
+
+func (l LimitFS) ReadLink(path string) (os.FileInfo, error) {
+	return l.stat(func() (os.FileInfo, error) { return l.Inner.ReadLink(path) })
+}
+
+func (l LimitFS) Read(path string) (io.ReaderAt, error) {
+	if !acquire(&l.Limits.handles, l.Limits.MaxHandles) {
+		return nil, ErrTooManyHandles
+	}
+	var reader io.ReaderAt
+	err := l.Limits.run(func() error {
+		var err error
+		reader, err = l.Inner.Read(path)
+		return err
+	})
+	if err != nil {
+		release(&l.Limits.handles, l.Limits.MaxHandles)
+		return nil, err
+	}
+	return &limitedReader{ReaderAt: reader, limits: l.Limits}, nil
+}
+
+func (l LimitFS) Write(path string) (io.WriterAt, error) {
+	if !acquire(&l.Limits.handles, l.Limits.MaxHandles) {
+		return nil, ErrTooManyHandles
+	}
+	var writer io.WriterAt
+	err := l.Limits.run(func() error {
+		var err error
+		writer, err = l.Inner.Write(path)
+		return err
+	})
+	if err != nil {
+		release(&l.Limits.handles, l.Limits.MaxHandles)
+		return nil, err
+	}
+	return &limitedWriter{WriterAt: writer, limits: l.Limits}, nil
+}
+
+func (l LimitFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return l.Limits.run(func() error { return l.Inner.SetStat(path, flags, attributes) })
+}
+
+func (l LimitFS) Rename(src, dst string) error {
+	return l.Limits.run(func() error { return l.Inner.Rename(src, dst) })
+}
+
+func (l LimitFS) Copy(src, dst string) error {
+	return l.Limits.run(func() error { return CopyFile(l.Inner, src, dst) })
+}
+
+func (l LimitFS) Rmdir(path string) error {
+	return l.Limits.run(func() error { return l.Inner.Rmdir(path) })
+}
+
+func (l LimitFS) Rm(path string) error {
+	return l.Limits.run(func() error { return l.Inner.Rm(path) })
+}
+
+func (l LimitFS) Mkdir(path string) error {
+	return l.Limits.run(func() error { return l.Inner.Mkdir(path) })
+}
+
+func (l LimitFS) Link(src, dst string) error {
+	return l.Limits.run(func() error { return l.Inner.Link(src, dst) })
+}
+
+func (l LimitFS) Symlink(src, dst string) error {
+	return l.Limits.run(func() error { return l.Inner.Symlink(src, dst) })
+}
+
+func (l LimitFS) Space(path string) (Space, error) {
+	var space Space
+	err := l.Limits.run(func() error {
+		var err error
+		space, err = SpaceOf(l.Inner, path)
+		return err
+	})
+	return space, err
+}
@@ -0,0 +1,161 @@
+package sftp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The name of the manifest files maintained by a ChecksumManifest.
+const ManifestName = "SHA256SUMS"
+
+// Serializes all changes of manifests, as the manifest of a directory may be changed by several connections.
+var manifestMutex sync.Mutex
+
+// ChecksumManifest maintains a manifest file (in the format of sha256sum) in every directory
+// that lists the checksums of all files in this directory. Its methods are meant to be used as hooks of a
+// [sftp.HookFS]. Errors are passed to OnError (if not nil).
+type ChecksumManifest struct {
+	OnError func(path string, err error)
+}
+
+// Calls OnError if there is an error.
+func (m ChecksumManifest) report(path string, err error) {
+	if err != nil && m.OnError != nil {
+		m.OnError(path, err)
+	}
+}
+
+// Checks whether the path is a manifest (or its temporary file) itself.
+func isManifest(p string) bool {
+	base := path.Base(p)
+	return base == ManifestName || base == "."+ManifestName+".tmp"
+}
+
+// Computes the checksum of the file at the given path.
+func checksum(fs SimplifiedFS, p string) (string, error) {
+	stat, err := fs.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	reader, err := fs.Read(p)
+	if err != nil {
+		return "", err
+	}
+	defer closeIfCloser(reader)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(reader, 0, stat.Size())); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Reads the manifest of the directory. A missing manifest is empty.
+func readManifest(fs SimplifiedFS, dir string) (map[string]string, error) {
+	entries := map[string]string{}
+	manifestPath := path.Join(dir, ManifestName)
+	stat, err := fs.Stat(manifestPath)
+	if err != nil {
+		// There is no manifest yet.
+		return entries, nil
+	}
+	reader, err := fs.Read(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeIfCloser(reader)
+	scanner := bufio.NewScanner(io.NewSectionReader(reader, 0, stat.Size()))
+	for scanner.Scan() {
+		// Every line is "<checksum>  <name>". A "*" in front of the name marks binary mode.
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entries[strings.TrimPrefix(strings.TrimPrefix(parts[1], " "), "*")] = parts[0]
+	}
+	return entries, scanner.Err()
+}
+
+// Writes the manifest of the directory. It is written into a temporary file that replaces the manifest
+// afterwards, so readers never see an incomplete manifest.
+func writeManifest(fs SimplifiedFS, dir string, entries map[string]string) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content strings.Builder
+	for _, name := range names {
+		_, _ = fmt.Fprintf(&content, "%s  %s\n", entries[name], name)
+	}
+	tmpPath := path.Join(dir, "."+ManifestName+".tmp")
+	writer, err := fs.Write(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = writer.WriteAt([]byte(content.String()), 0)
+	if closeErr := closeIfCloser(writer); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Rm(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, path.Join(dir, ManifestName))
+}
+
+// Changes the manifest of the directory with the given function.
+func updateManifest(fs SimplifiedFS, dir string, change func(entries map[string]string)) error {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	entries, err := readManifest(fs, dir)
+	if err != nil {
+		return err
+	}
+	change(entries)
+	return writeManifest(fs, dir, entries)
+}
+
+// Written adds the checksum of the written file to the manifest of its directory.
+func (m ChecksumManifest) Written(fs SimplifiedFS, p string) {
+	if isManifest(p) {
+		return
+	}
+	sum, err := checksum(fs, p)
+	if err != nil {
+		m.report(p, err)
+		return
+	}
+	m.report(p, updateManifest(fs, path.Dir(p), func(entries map[string]string) {
+		entries[path.Base(p)] = sum
+	}))
+}
+
+// Removed removes the file from the manifest of its directory.
+func (m ChecksumManifest) Removed(fs SimplifiedFS, p string) {
+	if isManifest(p) {
+		return
+	}
+	m.report(p, updateManifest(fs, path.Dir(p), func(entries map[string]string) {
+		delete(entries, path.Base(p))
+	}))
+}
+
+// Renamed moves the file from the manifest of the source directory to the one of the destination.
+func (m ChecksumManifest) Renamed(fs SimplifiedFS, src, dst string) {
+	if isManifest(src) || isManifest(dst) {
+		return
+	}
+	if stat, err := fs.Lstat(dst); err != nil || !stat.Mode().IsRegular() {
+		// Directories keep their manifests.
+		return
+	}
+	m.Removed(fs, src)
+	m.Written(fs, dst)
+}
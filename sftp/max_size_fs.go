@@ -0,0 +1,111 @@
+package sftp
+
+import (
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+)
+
+// ErrFileTooLarge is returned when a write would make a file larger than a [sftp.MaxSizeFS] allows.
+var ErrFileTooLarge = fmt.Errorf("file too large")
+
+// MaxSizeFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and refuses writes, truncations and
+// copies that would make a file larger than MaxFileSize, so a single upload cannot fill the disk.
+type MaxSizeFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The maximal size of a file in bytes.
+	MaxFileSize int64
+}
+
+// maxSizeWriter is an [io.WriterAt] that refuses writes ending behind the MaxFileSize.
+type maxSizeWriter struct {
+	io.WriterAt
+	maxFileSize int64
+}
+
+func (w maxSizeWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.maxFileSize {
+		return 0, fmt.Errorf("%w: the limit is %d bytes", ErrFileTooLarge, w.maxFileSize)
+	}
+	return w.WriterAt.WriteAt(p, off)
+}
+
+func (w maxSizeWriter) Close() error {
+	return closeIfCloser(w.WriterAt)
+}
+
+func (m MaxSizeFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return m.Inner.List(path)
+}
+
+func (m MaxSizeFS) Lstat(path string) (os.FileInfo, error) {
+	return m.Inner.Lstat(path)
+}
+
+func (m MaxSizeFS) Stat(path string) (os.FileInfo, error) {
+	return m.Inner.Stat(path)
+}
+
+func (m MaxSizeFS) ReadLink(path string) (os.FileInfo, error) {
+	return m.Inner.ReadLink(path)
+}
+
+func (m MaxSizeFS) Read(path string) (io.ReaderAt, error) {
+	return m.Inner.Read(path)
+}
+
+func (m MaxSizeFS) Write(path string) (io.WriterAt, error) {
+	writer, err := m.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	return maxSizeWriter{writer, m.MaxFileSize}, nil
+}
+
+func (m MaxSizeFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if flags.Size && int64(attributes.Size) > m.MaxFileSize {
+		return fmt.Errorf("%w: the limit is %d bytes", ErrFileTooLarge, m.MaxFileSize)
+	}
+	return m.Inner.SetStat(path, flags, attributes)
+}
+
+func (m MaxSizeFS) Rename(src, dst string) error {
+	return m.Inner.Rename(src, dst)
+}
+
+func (m MaxSizeFS) Copy(src, dst string) error {
+	// Only files can be copied, so the size of the source is the size of the copy.
+	if stat, err := m.Inner.Stat(src); err == nil && stat.Size() > m.MaxFileSize {
+		return fmt.Errorf("%w: the limit is %d bytes", ErrFileTooLarge, m.MaxFileSize)
+	}
+	if copier, ok := m.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (m MaxSizeFS) Rmdir(path string) error {
+	return m.Inner.Rmdir(path)
+}
+
+func (m MaxSizeFS) Rm(path string) error {
+	return m.Inner.Rm(path)
+}
+
+func (m MaxSizeFS) Mkdir(path string) error {
+	return m.Inner.Mkdir(path)
+}
+
+func (m MaxSizeFS) Link(src, dst string) error {
+	return m.Inner.Link(src, dst)
+}
+
+func (m MaxSizeFS) Symlink(src, dst string) error {
+	return m.Inner.Symlink(src, dst)
+}
+
+func (m MaxSizeFS) Space(path string) (Space, error) {
+	return SpaceOf(m.Inner, path)
+}
@@ -0,0 +1,34 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+func TestMaxSizeFS(t *testing.T) {
+	fs := MaxSizeFS{Inner: DirFs{Root: t.TempDir() + "/"}, MaxFileSize: 10}
+	writer, err := fs.Write("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("0123456789"), 0); err != nil {
+		t.Errorf("writing up to the limit failed: %v", err)
+	}
+	if n, err := writer.WriteAt([]byte("x"), 10); !errors.Is(err, ErrFileTooLarge) || n != 0 {
+		t.Errorf("WriteAt() behind the limit = %d, %v, want ErrFileTooLarge", n, err)
+	}
+	_ = writer.(io.Closer).Close()
+	if stat, err := fs.Stat("/file"); err != nil || stat.Size() != 10 {
+		t.Errorf("the file has not the size of the accepted writes: %v", err)
+	}
+	err = fs.SetStat("/file", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: 11})
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("enlarging the file behind the limit = %v, want ErrFileTooLarge", err)
+	}
+	if err := fs.SetStat("/file", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: 5}); err != nil {
+		t.Errorf("truncating the file failed: %v", err)
+	}
+}
@@ -0,0 +1,508 @@
+package sftp
+
+import (
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/stats"
+)
+
+// ErrMemoryFull is returned by a MemFS for changes that would make it keep more than its MaxBytes.
+var ErrMemoryFull = fmt.Errorf("not enough memory left for the directory")
+
+// The memory counted for every file, directory and link of a MemFS besides its content, so a client cannot use
+// up the memory with empty files either.
+const memEntrySize = 256
+
+// How many symbolic links are followed at most while resolving a path of a MemFS.
+const maxMemLinks = 40
+
+// MemFS is a [sftp.SimplifiedFS] that keeps its files in memory, e.g. for scratch space that must not be written to
+// a disk. The files are lost once the MemFS is dropped. Changes that would make it keep more than its MaxBytes are
+// rejected with ErrMemoryFull, so clients cannot use up the memory of the server. It is safe for concurrent use.
+type MemFS struct {
+	// Protects all fields below
+	mutex sync.Mutex
+	// The maximal number of bytes to keep and the number of bytes kept right now (see memEntrySize).
+	maxBytes int64
+	bytes    int64
+	// The files, directories and links by their absolute path. Hard links share their node.
+	nodes map[string]*memNode
+	// The number of changes rejected for exceeding maxBytes.
+	rejected uint64
+}
+
+// memNode is a file, directory or symbolic link of a MemFS.
+type memNode struct {
+	mode    os.FileMode
+	modTime time.Time
+	// The content of a file.
+	data []byte
+	// The absolute path a symbolic link points to.
+	target string
+	// The number of paths of the node. Zero once it has been removed.
+	links int
+}
+
+// NewMemFS creates an empty MemFS that keeps at most maxBytes.
+func NewMemFS(maxBytes int64) *MemFS {
+	root := &memNode{mode: os.ModeDir | 0o755, modTime: time.Now(), links: 1}
+	return &MemFS{maxBytes: maxBytes, nodes: map[string]*memNode{"/": root}}
+}
+
+// memFileInfo is the [os.FileInfo] of a node of a MemFS at the time it was requested.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (m memFileInfo) Name() string {
+	return m.name
+}
+
+func (m memFileInfo) Size() int64 {
+	return m.size
+}
+
+func (m memFileInfo) Mode() os.FileMode {
+	return m.mode
+}
+
+func (m memFileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m memFileInfo) IsDir() bool {
+	return m.mode.IsDir()
+}
+
+func (m memFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Returns the info of the node at the given path. m.mutex must be locked.
+func (n *memNode) info(p string) os.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&os.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+	return memFileInfo{name: path.Base(p), size: size, mode: n.mode, modTime: n.modTime}
+}
+
+// Returns the cleaned absolute path.
+func memPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// Returns the node at the given cleaned path, following symbolic links. Returns the resolved path along with it.
+// m.mutex must be locked.
+func (m *MemFS) resolve(p string) (string, *memNode, error) {
+	for i := 0; i < maxMemLinks; i++ {
+		node, ok := m.nodes[p]
+		if !ok {
+			return p, nil, os.ErrNotExist
+		}
+		if node.mode&os.ModeSymlink == 0 {
+			return p, node, nil
+		}
+		p = node.target
+	}
+	return p, nil, fmt.Errorf("too many levels of symbolic links")
+}
+
+// Checks that the parent of the given cleaned path is a directory and the path itself does not exist yet.
+// m.mutex must be locked.
+func (m *MemFS) checkNew(p string) error {
+	if p == "/" {
+		return os.ErrExist
+	}
+	if parent, ok := m.nodes[path.Dir(p)]; !ok {
+		return os.ErrNotExist
+	} else if !parent.mode.IsDir() {
+		return fmt.Errorf("not a directory %s", path.Dir(p))
+	}
+	if _, ok := m.nodes[p]; ok {
+		return os.ErrExist
+	}
+	return nil
+}
+
+// Counts the given number of bytes as kept, unless this exceeds maxBytes. m.mutex must be locked.
+func (m *MemFS) reserve(bytes int64) error {
+	if bytes > 0 && m.bytes+bytes > m.maxBytes {
+		m.rejected++
+		return ErrMemoryFull
+	}
+	m.bytes += bytes
+	return nil
+}
+
+// Removes the given path of its node and frees its memory. m.mutex must be locked.
+func (m *MemFS) unlink(p string) {
+	node := m.nodes[p]
+	delete(m.nodes, p)
+	m.bytes -= memEntrySize
+	node.links--
+	if node.links == 0 {
+		m.bytes -= int64(len(node.data) + len(node.target))
+		node.data = nil
+	}
+}
+
+// Returns the paths of the entries directly within the directory at the given cleaned path in sorted order.
+// m.mutex must be locked.
+func (m *MemFS) children(dir string) []string {
+	var paths []string
+	for p := range m.nodes {
+		if p != "/" && path.Dir(p) == dir {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (m *MemFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dir, node, err := m.resolve(memPath(p))
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, fmt.Errorf("not a directory %s", p)
+	}
+	// The entries are collected right now, like DirFs does.
+	var fileinfos []os.FileInfo
+	for _, child := range m.children(dir) {
+		fileinfos = append(fileinfos, m.nodes[child].info(child))
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (m *MemFS) Lstat(p string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p = memPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return node.info(p), nil
+}
+
+func (m *MemFS) Stat(p string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	resolved, node, err := m.resolve(memPath(p))
+	if err != nil {
+		return nil, err
+	}
+	info := node.info(resolved).(memFileInfo)
+	// Named like the path, not like its target.
+	info.name = path.Base(memPath(p))
+	return info, nil
+}
+
+// ReadLink returns the info of the symbolic link at the given path, which is named like its target.
+func (m *MemFS) ReadLink(p string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, ok := m.nodes[memPath(p)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return nil, fmt.Errorf("not a symbolic link %s", p)
+	}
+	info := node.info(p).(memFileInfo)
+	info.name = node.target
+	return info, nil
+}
+
+func (m *MemFS) Read(p string) (io.ReaderAt, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, node, err := m.resolve(memPath(p))
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, fmt.Errorf("is a directory %s", p)
+	}
+	return memFile{m, node}, nil
+}
+
+// Write opens the file at the given path for writing, creating it if it does not exist.
+func (m *MemFS) Write(p string) (io.WriterAt, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	resolved, node, err := m.resolve(memPath(p))
+	if err == nil {
+		if node.mode.IsDir() {
+			return nil, fmt.Errorf("is a directory %s", p)
+		}
+		return memFile{m, node}, nil
+	}
+	if err != os.ErrNotExist {
+		return nil, err
+	}
+	if err := m.checkNew(resolved); err != nil {
+		return nil, err
+	}
+	if err := m.reserve(memEntrySize); err != nil {
+		return nil, err
+	}
+	node = &memNode{mode: 0o644, modTime: time.Now(), links: 1}
+	m.nodes[resolved] = node
+	return memFile{m, node}, nil
+}
+
+// Changes the size of the content of the node, unless growing it exceeds maxBytes. m.mutex must be locked.
+func (m *MemFS) truncate(node *memNode, size int64) error {
+	if node.links == 0 {
+		// Its memory has been freed already.
+		return os.ErrNotExist
+	}
+	if err := m.reserve(size - int64(len(node.data))); err != nil {
+		return err
+	}
+	if size < int64(len(node.data)) {
+		m.bytes -= int64(len(node.data)) - size
+		// Copied, so the memory of the dropped part is freed.
+		node.data = append([]byte(nil), node.data[:size]...)
+	} else {
+		node.data = append(node.data, make([]byte, size-int64(len(node.data)))...)
+	}
+	node.modTime = time.Now()
+	return nil
+}
+
+// SetStat changes the size, the permissions and the times. Owners are ignored.
+func (m *MemFS) SetStat(p string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, node, err := m.resolve(memPath(p))
+	if err != nil {
+		return err
+	}
+	if flags.Size {
+		if node.mode.IsDir() {
+			return fmt.Errorf("is a directory %s", p)
+		}
+		if err := m.truncate(node, int64(attributes.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		node.mode = node.mode.Type() | attributes.FileMode().Perm()
+	}
+	if flags.Acmodtime {
+		node.modTime = time.Unix(int64(attributes.Mtime), 0)
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(src, dst string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	src, dst = memPath(src), memPath(dst)
+	node, ok := m.nodes[src]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if src == "/" || dst == "/" {
+		return ErrForbidden
+	}
+	if src == dst {
+		return nil
+	}
+	if node.mode.IsDir() && strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("cannot move %s into itself", src)
+	}
+	if err := m.checkNew(dst); err == os.ErrExist {
+		// Replaces a file or an empty directory of the same kind.
+		existing := m.nodes[dst]
+		if existing.mode.IsDir() != node.mode.IsDir() || len(m.children(dst)) > 0 {
+			return os.ErrExist
+		}
+		m.unlink(dst)
+	} else if err != nil {
+		return err
+	}
+	// The directory is moved along with everything within it.
+	moved := map[string]*memNode{}
+	for p, n := range m.nodes {
+		if p == src || strings.HasPrefix(p, src+"/") {
+			moved[dst+strings.TrimPrefix(p, src)] = n
+			delete(m.nodes, p)
+		}
+	}
+	for p, n := range moved {
+		m.nodes[p] = n
+	}
+	return nil
+}
+
+func (m *MemFS) Rmdir(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p = memPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !node.mode.IsDir() {
+		return fmt.Errorf("not a directory %s", p)
+	}
+	if p == "/" {
+		return ErrForbidden
+	}
+	if len(m.children(p)) > 0 {
+		return fmt.Errorf("directory not empty %s", p)
+	}
+	m.unlink(p)
+	return nil
+}
+
+func (m *MemFS) Rm(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p = memPath(p)
+	node, ok := m.nodes[p]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if node.mode.IsDir() {
+		return fmt.Errorf("is a directory %s", p)
+	}
+	m.unlink(p)
+	return nil
+}
+
+func (m *MemFS) Mkdir(p string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p = memPath(p)
+	if err := m.checkNew(p); err != nil {
+		return err
+	}
+	if err := m.reserve(memEntrySize); err != nil {
+		return err
+	}
+	m.nodes[p] = &memNode{mode: os.ModeDir | 0o755, modTime: time.Now(), links: 1}
+	return nil
+}
+
+// Link creates a hard link, which shares the content of the file at src.
+func (m *MemFS) Link(src, dst string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dst = memPath(dst)
+	node, ok := m.nodes[memPath(src)]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if node.mode.IsDir() {
+		return fmt.Errorf("is a directory %s", src)
+	}
+	if err := m.checkNew(dst); err != nil {
+		return err
+	}
+	if err := m.reserve(memEntrySize); err != nil {
+		return err
+	}
+	node.links++
+	m.nodes[dst] = node
+	return nil
+}
+
+// Symlink creates a symbolic link at dst pointing to the absolute path of src.
+func (m *MemFS) Symlink(src, dst string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	src, dst = memPath(src), memPath(dst)
+	if err := m.checkNew(dst); err != nil {
+		return err
+	}
+	if err := m.reserve(memEntrySize + int64(len(src))); err != nil {
+		return err
+	}
+	m.nodes[dst] = &memNode{mode: os.ModeSymlink | 0o777, modTime: time.Now(), target: src, links: 1}
+	return nil
+}
+
+// SetMaxBytes changes the maximal number of bytes to keep. If more are kept already, the files stay, but nothing
+// can be added until enough has been removed.
+func (m *MemFS) SetMaxBytes(maxBytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.maxBytes = maxBytes
+}
+
+// Space reports the MaxBytes as size of the storage and the entries that fit into the memory left as free files.
+func (m *MemFS) Space(_ string) (Space, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	available := uint64(max(m.maxBytes-m.bytes, 0))
+	return Space{Total: uint64(m.maxBytes), Available: available, FreeFiles: available / memEntrySize}, nil
+}
+
+// Usage returns the memory currently used, the number of files, directories and links, and the number of changes
+// rejected so far for exceeding the MaxBytes.
+func (m *MemFS) Usage() stats.MemoryUsage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return stats.MemoryUsage{Bytes: m.bytes, MaxBytes: m.maxBytes, Entries: int64(len(m.nodes)), Rejected: m.rejected}
+}
+
+// memFile reads and writes the content of a node of a MemFS.
+type memFile struct {
+	fs   *MemFS
+	node *memNode
+}
+
+func (f memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes the data into the content, which is grown as needed unless this exceeds the MaxBytes of the MemFS.
+func (f memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		if err := f.fs.truncate(f.node, end); err != nil {
+			return 0, err
+		}
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
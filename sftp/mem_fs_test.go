@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+// Returns the names of the entries of the directory.
+func listNames(t *testing.T, fs SimplifiedFS, path string) []string {
+	list, err := fs.List(path)
+	if err != nil {
+		t.Fatalf("List(%s) = %v", path, err)
+	}
+	infos := make([]os.FileInfo, 10)
+	n, _ := list(infos, 0)
+	var names []string
+	for _, info := range infos[:n] {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestMemFSLimit(t *testing.T) {
+	fs := NewMemFS(2*memEntrySize + 100)
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Errorf("Mkdir() = %v", err)
+	}
+	writer, err := fs.Write("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(make([]byte, 100), 0); err != nil {
+		t.Errorf("writing up to the limit failed: %v", err)
+	}
+	if n, err := writer.WriteAt([]byte("x"), 100); !errors.Is(err, ErrMemoryFull) || n != 0 {
+		t.Errorf("WriteAt() behind the limit = %d, %v, want ErrMemoryFull", n, err)
+	}
+	// Overwriting needs no more memory.
+	if _, err := writer.WriteAt([]byte("hello"), 95); err != nil {
+		t.Errorf("overwriting failed: %v", err)
+	}
+	if err := fs.Symlink("/file", "/link"); !errors.Is(err, ErrMemoryFull) {
+		t.Errorf("Symlink() behind the limit = %v, want ErrMemoryFull", err)
+	}
+	err = fs.SetStat("/file", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: 101})
+	if !errors.Is(err, ErrMemoryFull) {
+		t.Errorf("enlarging the file behind the limit = %v, want ErrMemoryFull", err)
+	}
+	if usage := fs.Usage(); usage.Bytes != 2*memEntrySize+100 || usage.Entries != 3 || usage.Rejected != 3 {
+		t.Errorf("Usage() = %+v", usage)
+	}
+	// Removing the file frees its memory, even while it is still open.
+	if err := fs.Rm("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("x"), 0); err == nil {
+		t.Errorf("writing into a removed file succeeded")
+	}
+	if space, _ := fs.Space("/"); space.Available != memEntrySize+100 {
+		t.Errorf("available after removing = %d, want %d", space.Available, memEntrySize+100)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS(1 << 20)
+	for _, dir := range []string{"/a", "/a/b"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer, err := fs.Write("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.WriteAt([]byte("hello world"), 0)
+	if err := fs.Link("/a/b/file", "/a/hard"); err != nil {
+		t.Errorf("Link() = %v", err)
+	}
+	if err := fs.Symlink("/a/b/file", "/soft"); err != nil {
+		t.Errorf("Symlink() = %v", err)
+	}
+	if _, err := fs.Write("/missing/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Write() in a missing directory = %v", err)
+	}
+	if err := fs.Rename("/a", "/a/b/c"); err == nil {
+		t.Errorf("moving a directory into itself succeeded")
+	}
+	if err := fs.Rename("/a", "/moved"); err != nil {
+		t.Fatalf("Rename() = %v", err)
+	}
+	if names := listNames(t, fs, "/moved"); len(names) != 2 || names[0] != "b" || names[1] != "hard" {
+		t.Errorf("entries of the moved directory = %v", names)
+	}
+	// The hard link shares the content, the symbolic link still points to the old path.
+	reader, err := fs.Read("/moved/hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if n, _ := reader.ReadAt(p, 6); string(p[:n]) != "world" {
+		t.Errorf("ReadAt() = %q", p[:n])
+	}
+	if _, err := fs.Stat("/soft"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat() of the dangling link = %v", err)
+	}
+	if info, err := fs.ReadLink("/soft"); err != nil || info.Name() != "/a/b/file" {
+		t.Errorf("ReadLink() = %v, %v", info, err)
+	}
+	if err := fs.Rmdir("/moved/b"); err == nil {
+		t.Errorf("removing a directory that is not empty succeeded")
+	}
+	for _, file := range []string{"/moved/b/file", "/moved/hard", "/soft"} {
+		if err := fs.Rm(file); err != nil {
+			t.Errorf("Rm(%s) = %v", file, err)
+		}
+	}
+	for _, dir := range []string{"/moved/b", "/moved"} {
+		if err := fs.Rmdir(dir); err != nil {
+			t.Errorf("Rmdir(%s) = %v", dir, err)
+		}
+	}
+	if usage := fs.Usage(); usage.Bytes != 0 || usage.Entries != 1 {
+		t.Errorf("Usage() after removing everything = %+v", usage)
+	}
+}
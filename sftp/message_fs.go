@@ -0,0 +1,154 @@
+package sftp
+
+import (
+	"errors"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+)
+
+// messageError replaces the message of an error sent to the client, while errors.Is still finds the original.
+type messageError struct {
+	message string
+	err     error
+}
+
+func (m messageError) Error() string {
+	return m.message
+}
+
+func (m messageError) Unwrap() error {
+	return m.err
+}
+
+// MessageFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and replaces the messages of the
+// errors the clients see, e.g. to explain a quota in the language of the user. Other errors are kept as they are.
+type MessageFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The messages by the error they replace (like ErrForbidden). Errors wrapping these are replaced as well.
+	Messages map[error]string
+}
+
+// Returns err with the message of the first matching error of Messages, if any.
+func (m MessageFS) replace(err error) error {
+	if err == nil {
+		return nil
+	}
+	for target, message := range m.Messages {
+		if errors.Is(err, target) {
+			return messageError{message, err}
+		}
+	}
+	return err
+}
+
+// messageReader is an [io.ReaderAt] whose errors have the messages of its MessageFS.
+type messageReader struct {
+	io.ReaderAt
+	fs MessageFS
+}
+
+func (r messageReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	if err == io.EOF {
+		// Readers are expected to return io.EOF itself.
+		return n, err
+	}
+	return n, r.fs.replace(err)
+}
+
+func (r messageReader) Close() error {
+	return r.fs.replace(closeIfCloser(r.ReaderAt))
+}
+
+// messageWriter is an [io.WriterAt] whose errors have the messages of its MessageFS.
+type messageWriter struct {
+	io.WriterAt
+	fs MessageFS
+}
+
+func (w messageWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	return n, w.fs.replace(err)
+}
+
+func (w messageWriter) Close() error {
+	return w.fs.replace(closeIfCloser(w.WriterAt))
+}
+
+func (m MessageFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	lister, err := m.Inner.List(path)
+	return lister, m.replace(err)
+}
+
+func (m MessageFS) Lstat(path string) (os.FileInfo, error) {
+	info, err := m.Inner.Lstat(path)
+	return info, m.replace(err)
+}
+
+func (m MessageFS) Stat(path string) (os.FileInfo, error) {
+	info, err := m.Inner.Stat(path)
+	return info, m.replace(err)
+}
+
+func (m MessageFS) ReadLink(path string) (os.FileInfo, error) {
+	info, err := m.Inner.ReadLink(path)
+	return info, m.replace(err)
+}
+
+func (m MessageFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := m.Inner.Read(path)
+	if err != nil {
+		return nil, m.replace(err)
+	}
+	return messageReader{reader, m}, nil
+}
+
+func (m MessageFS) Write(path string) (io.WriterAt, error) {
+	writer, err := m.Inner.Write(path)
+	if err != nil {
+		return nil, m.replace(err)
+	}
+	return messageWriter{writer, m}, nil
+}
+
+func (m MessageFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return m.replace(m.Inner.SetStat(path, flags, attributes))
+}
+
+func (m MessageFS) Rename(src, dst string) error {
+	return m.replace(m.Inner.Rename(src, dst))
+}
+
+func (m MessageFS) Copy(src, dst string) error {
+	if copier, ok := m.Inner.(Copier); ok {
+		return m.replace(copier.Copy(src, dst))
+	}
+	return ErrNotSupported
+}
+
+func (m MessageFS) Rmdir(path string) error {
+	return m.replace(m.Inner.Rmdir(path))
+}
+
+func (m MessageFS) Rm(path string) error {
+	return m.replace(m.Inner.Rm(path))
+}
+
+func (m MessageFS) Mkdir(path string) error {
+	return m.replace(m.Inner.Mkdir(path))
+}
+
+func (m MessageFS) Link(src, dst string) error {
+	return m.replace(m.Inner.Link(src, dst))
+}
+
+func (m MessageFS) Symlink(src, dst string) error {
+	return m.replace(m.Inner.Symlink(src, dst))
+}
+
+func (m MessageFS) Space(path string) (Space, error) {
+	space, err := SpaceOf(m.Inner, path)
+	return space, m.replace(err)
+}
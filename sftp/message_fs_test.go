@@ -0,0 +1,24 @@
+package sftp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMessageFS(t *testing.T) {
+	store, _ := NewFileUsageStore("")
+	fs := MessageFS{
+		Inner:    newTestQuotaFS(t, store, 1, 1),
+		Messages: map[error]string{ErrQuotaExceeded: "Kontingent erschöpft"},
+	}
+	err := fs.Mkdir("/dir")
+	if err == nil || err.Error() != "Kontingent erschöpft" {
+		t.Errorf("Mkdir() = %v, want the replaced message", err)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Error("the replaced error is no ErrQuotaExceeded anymore")
+	}
+	if _, err := fs.Stat("/missing"); err == nil || err.Error() == "Kontingent erschöpft" {
+		t.Errorf("Stat() = %v, want the original error", err)
+	}
+}
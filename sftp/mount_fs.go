@@ -0,0 +1,204 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// MountFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and serves a further one as a directory
+// within its root, e.g. a private scratch directory of a session. Files are moved between both by copying them.
+type MountFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The name of the directory within the root, e.g. "tmp". It hides an entry of Inner with the same name.
+	Name string
+	// The [sftp.SimplifiedFS] served as the directory.
+	Mounted SimplifiedFS
+}
+
+// Returns the filesystem the path belongs to along with the path within it and whether it is the mounted one.
+func (m MountFS) resolve(p string) (SimplifiedFS, string, bool) {
+	p = path.Clean("/" + p)
+	rest, ok := strings.CutPrefix(p[1:], m.Name)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return m.Inner, p, false
+	}
+	if rest == "" {
+		return m.Mounted, "/", true
+	}
+	return m.Mounted, rest, true
+}
+
+// Checks whether the path is the mounted directory itself, which cannot be changed.
+func (m MountFS) isMountPoint(p string) bool {
+	_, sub, mounted := m.resolve(p)
+	return mounted && sub == "/"
+}
+
+// Returns the info of the mounted directory.
+func (m MountFS) statOfMount() (os.FileInfo, error) {
+	info, err := m.Mounted.Stat("/")
+	if err != nil {
+		return nil, err
+	}
+	return renamedFileInfo{info, m.Name}, nil
+}
+
+func (m MountFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	fs, sub, mounted := m.resolve(p)
+	lister, err := fs.List(sub)
+	if err != nil || mounted || sub != "/" {
+		return lister, err
+	}
+	mount, err := m.statOfMount()
+	if err != nil {
+		return nil, err
+	}
+	// The mounted directory is listed first, so the offsets of the inner entries are just shifted by one.
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset > 0 {
+			return lister(ls, offset-1)
+		}
+		if len(ls) == 0 {
+			return 0, nil
+		}
+		ls[0] = mount
+		n, err := lister(ls[1:], 0)
+		return n + 1, err
+	}, nil
+}
+
+func (m MountFS) Lstat(p string) (os.FileInfo, error) {
+	if m.isMountPoint(p) {
+		return m.statOfMount()
+	}
+	fs, sub, _ := m.resolve(p)
+	return fs.Lstat(sub)
+}
+
+func (m MountFS) Stat(p string) (os.FileInfo, error) {
+	if m.isMountPoint(p) {
+		return m.statOfMount()
+	}
+	fs, sub, _ := m.resolve(p)
+	return fs.Stat(sub)
+}
+
+func (m MountFS) ReadLink(p string) (os.FileInfo, error) {
+	if m.isMountPoint(p) {
+		return nil, os.ErrInvalid
+	}
+	fs, sub, _ := m.resolve(p)
+	return fs.ReadLink(sub)
+}
+
+func (m MountFS) Read(p string) (io.ReaderAt, error) {
+	fs, sub, _ := m.resolve(p)
+	return fs.Read(sub)
+}
+
+func (m MountFS) Write(p string) (io.WriterAt, error) {
+	if m.isMountPoint(p) {
+		return nil, ErrForbidden
+	}
+	fs, sub, _ := m.resolve(p)
+	return fs.Write(sub)
+}
+
+func (m MountFS) SetStat(p string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if m.isMountPoint(p) {
+		return ErrForbidden
+	}
+	fs, sub, _ := m.resolve(p)
+	return fs.SetStat(sub, flags, attributes)
+}
+
+// Runs f with the filesystem of both paths if they belong to the same one and neither is the mounted directory.
+func (m MountFS) within(src, dst string, f func(fs SimplifiedFS, src, dst string) error) error {
+	if m.isMountPoint(src) || m.isMountPoint(dst) {
+		return ErrForbidden
+	}
+	srcFs, subSrc, srcMounted := m.resolve(src)
+	_, subDst, dstMounted := m.resolve(dst)
+	if srcMounted != dstMounted {
+		return ErrNotSupported
+	}
+	return f(srcFs, subSrc, subDst)
+}
+
+func (m MountFS) Rename(src, dst string) error {
+	if m.isMountPoint(src) || m.isMountPoint(dst) {
+		return ErrForbidden
+	}
+	srcFs, subSrc, srcMounted := m.resolve(src)
+	dstFs, subDst, dstMounted := m.resolve(dst)
+	if srcMounted == dstMounted {
+		return srcFs.Rename(subSrc, subDst)
+	}
+	// Moved from one filesystem into the other, so it has to be copied.
+	srcStat, err := srcFs.Stat(subSrc)
+	if err != nil {
+		return err
+	}
+	if _, err := dstFs.Stat(subDst); err == nil {
+		return fmt.Errorf("target path exists")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if srcStat.IsDir() {
+		return renameDirectoryFallback(srcFs, dstFs, subSrc, subDst)
+	}
+	return renameFileFallback(srcFs, dstFs, subSrc, subDst)
+}
+
+func (m MountFS) Rmdir(p string) error {
+	return m.within(p, p, func(fs SimplifiedFS, p, _ string) error {
+		return fs.Rmdir(p)
+	})
+}
+
+func (m MountFS) Rm(p string) error {
+	return m.within(p, p, func(fs SimplifiedFS, p, _ string) error {
+		return fs.Rm(p)
+	})
+}
+
+func (m MountFS) Mkdir(p string) error {
+	return m.within(p, p, func(fs SimplifiedFS, p, _ string) error {
+		return fs.Mkdir(p)
+	})
+}
+
+func (m MountFS) Link(src, dst string) error {
+	return m.within(src, dst, func(fs SimplifiedFS, src, dst string) error {
+		return fs.Link(src, dst)
+	})
+}
+
+func (m MountFS) Symlink(src, dst string) error {
+	return m.within(src, dst, func(fs SimplifiedFS, src, dst string) error {
+		return fs.Symlink(src, dst)
+	})
+}
+
+// Copy copies the file if both paths belong to the same filesystem and it is able to copy it itself.
+func (m MountFS) Copy(src, dst string) error {
+	return m.within(src, dst, func(fs SimplifiedFS, src, dst string) error {
+		copier, ok := fs.(Copier)
+		if !ok {
+			return ErrNotSupported
+		}
+		return copier.Copy(src, dst)
+	})
+}
+
+// Space returns the space of the filesystem the path belongs to.
+func (m MountFS) Space(p string) (Space, error) {
+	fs, sub, _ := m.resolve(p)
+	return SpaceOf(fs, sub)
+}
@@ -0,0 +1,54 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMountFS(t *testing.T) {
+	inner := t.TempDir() + "/"
+	mounted := t.TempDir() + "/"
+	if err := os.WriteFile(filepath.Join(inner, "a"), []byte("inner"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := MountFS{Inner: DirFs{Root: inner}, Name: "tmp", Mounted: DirFs{Root: mounted}}
+	writer, err := fs.Write("/tmp/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("staged"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.(io.Closer).Close()
+	if _, err := os.Stat(filepath.Join(mounted, "upload")); err != nil {
+		t.Errorf("the file was not written into the mounted directory: %v", err)
+	}
+	list, err := fs.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]os.FileInfo, 10)
+	n, _ := list(infos, 0)
+	if n != 2 || infos[0].Name() != "tmp" || !infos[0].IsDir() || infos[1].Name() != "a" {
+		t.Errorf("listed %d files: %v", n, infos[:n])
+	}
+	// Moving a file out of the mounted directory copies it.
+	if err := fs.Rename("/tmp/upload", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(inner, "b")); err != nil || string(content) != "staged" {
+		t.Errorf("moved file contains %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(mounted, "upload")); !os.IsNotExist(err) {
+		t.Errorf("the moved file still exists: %v", err)
+	}
+	if err := fs.Rmdir("/tmp"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Rmdir() of the mounted directory = %v, want %v", err, ErrForbidden)
+	}
+	if _, err := fs.Stat("/tmpfile"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a path only starting with the name = %v", err)
+	}
+}
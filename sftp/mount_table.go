@@ -0,0 +1,77 @@
+package sftp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MountTable contains named filesystems for a CombinedFS. Unlike CombinedFS.Dirs, filesystems can be
+// mounted and unmounted while the table is in use.
+type MountTable struct {
+	mutex sync.RWMutex
+	// The map is never modified but replaced on every change, so it can be used without holding the mutex.
+	dirs map[string]SimplifiedFS
+}
+
+// NewMountTable creates a MountTable containing the given filesystems.
+func NewMountTable(dirs map[string]SimplifiedFS) *MountTable {
+	copied := make(map[string]SimplifiedFS, len(dirs))
+	for name, fs := range dirs {
+		copied[name] = fs
+	}
+	return &MountTable{dirs: copied}
+}
+
+// Returns the current filesystems. The returned map must not be modified.
+func (m *MountTable) current() map[string]SimplifiedFS {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.dirs
+}
+
+// Replaces the filesystems with the result of change that modifies a copy of the current ones.
+func (m *MountTable) update(change func(dirs map[string]SimplifiedFS)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dirs := make(map[string]SimplifiedFS, len(m.dirs)+1)
+	for name, fs := range m.dirs {
+		dirs[name] = fs
+	}
+	change(dirs)
+	m.dirs = dirs
+}
+
+// Mount adds the filesystem under the given name or replaces the one with this name.
+func (m *MountTable) Mount(name string, fs SimplifiedFS) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid mount name %q", name)
+	}
+	m.update(func(dirs map[string]SimplifiedFS) {
+		dirs[name] = fs
+	})
+	return nil
+}
+
+// Unmount removes the filesystem with the given name. Files of this filesystem that are already opened
+// stay usable. Returns false if there is no such filesystem.
+func (m *MountTable) Unmount(name string) bool {
+	found := false
+	m.update(func(dirs map[string]SimplifiedFS) {
+		_, found = dirs[name]
+		delete(dirs, name)
+	})
+	return found
+}
+
+// Names returns the names of all mounted filesystems in sorted order.
+func (m *MountTable) Names() []string {
+	dirs := m.current()
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
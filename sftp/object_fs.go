@@ -0,0 +1,400 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectInfo describes an object of an ObjectStore.
+type ObjectInfo struct {
+	// The full key of the object.
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// ObjectStore is a flat storage of objects identified by keys, like a bucket of a cloud storage.
+// Missing objects are reported with an error matching [os.ErrNotExist].
+type ObjectStore interface {
+	// List returns the objects whose key starts with prefix and does not contain another "/" after it, along with
+	// the common prefixes (ending with "/") of the other ones. At most max objects and prefixes are returned
+	// together. If max is zero, all are returned.
+	List(prefix string, max int) ([]ObjectInfo, []string, error)
+	// Stat returns the info of the object with the given key.
+	Stat(key string) (ObjectInfo, error)
+	// ReadAt reads len(p) bytes of the object starting at off.
+	ReadAt(key string, p []byte, off int64) (int, error)
+	// Put creates or replaces the object with the given content of the given size.
+	Put(key string, content io.Reader, size int64) error
+	// Copy copies the object src to dst.
+	Copy(src, dst string) error
+	// Delete removes the object with the given key.
+	Delete(key string) error
+}
+
+// ContextObjectStore is an ObjectStore whose requests can be canceled.
+type ContextObjectStore interface {
+	ObjectStore
+	// WithContext returns a copy of the store whose requests are aborted once ctx is done. Aborted requests fail
+	// with an error wrapping ctx.Err().
+	WithContext(ctx context.Context) ObjectStore
+}
+
+// timeoutStore makes every request of a ContextObjectStore with a timeout.
+type timeoutStore struct {
+	store   ContextObjectStore
+	timeout time.Duration
+}
+
+// Returns the store for a single request, which must be followed by calling the returned function.
+func (t timeoutStore) request() (ObjectStore, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	return t.store.WithContext(ctx), cancel
+}
+
+func (t timeoutStore) List(prefix string, max int) ([]ObjectInfo, []string, error) {
+	store, cancel := t.request()
+	defer cancel()
+	return store.List(prefix, max)
+}
+
+func (t timeoutStore) Stat(key string) (ObjectInfo, error) {
+	store, cancel := t.request()
+	defer cancel()
+	return store.Stat(key)
+}
+
+func (t timeoutStore) ReadAt(key string, p []byte, off int64) (int, error) {
+	store, cancel := t.request()
+	defer cancel()
+	return store.ReadAt(key, p, off)
+}
+
+func (t timeoutStore) Put(key string, content io.Reader, size int64) error {
+	store, cancel := t.request()
+	defer cancel()
+	return store.Put(key, content, size)
+}
+
+func (t timeoutStore) Copy(src, dst string) error {
+	store, cancel := t.request()
+	defer cancel()
+	return store.Copy(src, dst)
+}
+
+func (t timeoutStore) Delete(key string) error {
+	store, cancel := t.request()
+	defer cancel()
+	return store.Delete(key)
+}
+
+// ErrNotSupported is returned for operations an ObjectFS does not support.
+var ErrNotSupported = fmt.Errorf("operation not supported")
+
+// ObjectFS implements [sftp.SimplifiedFS] for an ObjectStore. Directories are the prefixes of the keys separated by
+// "/". Empty directories are kept with an empty object whose key ends with "/". Written files are buffered in a
+// temporary file and uploaded once they are closed, so they always replace the whole object.
+type ObjectFS struct {
+	Store ObjectStore
+	// The prefix of all keys of this filesystem (without a trailing "/"). Empty for the whole store.
+	Root string
+	// Whether to only support read operations.
+	Readonly bool
+}
+
+// WithTimeout returns a copy of o that aborts every request to the store taking longer than timeout (see
+// [sftp.CancelableFS]), if the store is a ContextObjectStore. Operations on directories making several requests
+// may take longer.
+func (o ObjectFS) WithTimeout(timeout time.Duration) (SimplifiedFS, bool) {
+	store, ok := o.Store.(ContextObjectStore)
+	if !ok {
+		return o, false
+	}
+	o.Store = timeoutStore{store: store, timeout: timeout}
+	return o, true
+}
+
+// objectFileInfo implements [os.FileInfo] for objects and directories.
+type objectFileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+func (o objectFileInfo) Name() string {
+	return o.name
+}
+
+func (o objectFileInfo) Size() int64 {
+	return o.size
+}
+
+func (o objectFileInfo) Mode() os.FileMode {
+	if o.dir {
+		return os.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func (o objectFileInfo) ModTime() time.Time {
+	return o.modified
+}
+
+func (o objectFileInfo) IsDir() bool {
+	return o.dir
+}
+
+func (o objectFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Converts the given path into the key of its object.
+func (o ObjectFS) key(p string) string {
+	return strings.TrimPrefix(path.Join(o.Root, path.Join("/", p)), "/")
+}
+
+// Returns the prefix of all objects in the directory with the given key.
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// Checks whether there are objects in the directory with the given key.
+func (o ObjectFS) isDir(key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	objects, prefixes, err := o.Store.List(dirPrefix(key), 1)
+	if err != nil {
+		return false, err
+	}
+	return len(objects)+len(prefixes) > 0, nil
+}
+
+func (o ObjectFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	prefix := dirPrefix(o.key(p))
+	objects, prefixes, err := o.Store.List(prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	fileinfos := make([]os.FileInfo, 0, len(objects)+len(prefixes))
+	for _, dir := range prefixes {
+		fileinfos = append(fileinfos, objectFileInfo{name: strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/"), dir: true})
+	}
+	for _, object := range objects {
+		// The object keeping this directory.
+		if object.Key == prefix {
+			continue
+		}
+		fileinfos = append(fileinfos, objectFileInfo{name: strings.TrimPrefix(object.Key, prefix), size: object.Size, modified: object.Modified})
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (o ObjectFS) Stat(p string) (os.FileInfo, error) {
+	key := o.key(p)
+	if key != "" {
+		object, err := o.Store.Stat(key)
+		if err == nil {
+			return objectFileInfo{name: path.Base(key), size: object.Size, modified: object.Modified}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	dir, err := o.isDir(key)
+	if err != nil {
+		return nil, err
+	}
+	if !dir {
+		return nil, os.ErrNotExist
+	}
+	if p == "/" {
+		return objectFileInfo{name: "/", dir: true}, nil
+	}
+	return objectFileInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (o ObjectFS) Lstat(p string) (os.FileInfo, error) {
+	// There are no links.
+	return o.Stat(p)
+}
+
+func (o ObjectFS) ReadLink(_ string) (os.FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+// objectReader reads an object with ranged requests.
+type objectReader struct {
+	store ObjectStore
+	key   string
+	size  int64
+}
+
+func (r objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	wanted := p
+	if remaining := r.size - off; int64(len(wanted)) > remaining {
+		wanted = wanted[:remaining]
+	}
+	n, err := r.store.ReadAt(r.key, wanted, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o ObjectFS) Read(p string) (io.ReaderAt, error) {
+	object, err := o.Store.Stat(o.key(p))
+	if err != nil {
+		return nil, err
+	}
+	return objectReader{store: o.Store, key: object.Key, size: object.Size}, nil
+}
+
+// objectWriter buffers a written file in a temporary file and uploads it on close.
+type objectWriter struct {
+	*os.File
+	store ObjectStore
+	key   string
+	once  sync.Once
+}
+
+func (w *objectWriter) Close() error {
+	var err error
+	w.once.Do(func() {
+		defer func() {
+			_ = w.File.Close()
+			_ = os.Remove(w.File.Name())
+		}()
+		var stat os.FileInfo
+		if stat, err = w.File.Stat(); err != nil {
+			return
+		}
+		if _, err = w.File.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		err = w.store.Put(w.key, w.File, stat.Size())
+	})
+	return err
+}
+
+func (o ObjectFS) Write(p string) (io.WriterAt, error) {
+	if o.Readonly {
+		return nil, ErrForbidden
+	}
+	key := o.key(p)
+	if key == "" {
+		return nil, fmt.Errorf("is a directory %s", p)
+	}
+	file, err := os.CreateTemp("", "sshtool-upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{File: file, store: o.Store, key: key}, nil
+}
+
+func (o ObjectFS) SetStat(p string, flags gosftp.FileAttrFlags, _ *gosftp.FileStat) error {
+	if o.Readonly {
+		return ErrForbidden
+	}
+	// Objects have no permissions, owners or settable times, so clients setting them after an upload
+	// should not fail.
+	if flags.Size {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+func (o ObjectFS) Rename(src, dst string) error {
+	if o.Readonly {
+		return ErrForbidden
+	}
+	srcKey := o.key(src)
+	if _, err := o.Store.Stat(srcKey); err != nil {
+		// Renaming a directory would need to copy every object in it.
+		return err
+	}
+	if err := o.Store.Copy(srcKey, o.key(dst)); err != nil {
+		return err
+	}
+	return o.Store.Delete(srcKey)
+}
+
+func (o ObjectFS) Rmdir(p string) error {
+	if o.Readonly {
+		return ErrForbidden
+	}
+	key := o.key(p)
+	if key == "" {
+		return ErrForbidden
+	}
+	objects, prefixes, err := o.Store.List(dirPrefix(key), 2)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if object.Key != dirPrefix(key) {
+			return fmt.Errorf("directory not empty %s", p)
+		}
+	}
+	if len(prefixes) > 0 {
+		return fmt.Errorf("directory not empty %s", p)
+	}
+	if len(objects) == 0 {
+		return os.ErrNotExist
+	}
+	return o.Store.Delete(dirPrefix(key))
+}
+
+func (o ObjectFS) Rm(p string) error {
+	if o.Readonly {
+		return ErrForbidden
+	}
+	key := o.key(p)
+	if key == "" {
+		return fmt.Errorf("is a directory %s", p)
+	}
+	return o.Store.Delete(key)
+}
+
+func (o ObjectFS) Mkdir(p string) error {
+	if o.Readonly {
+		return ErrForbidden
+	}
+	key := o.key(p)
+	if key == "" {
+		return os.ErrExist
+	}
+	return o.Store.Put(dirPrefix(key), strings.NewReader(""), 0)
+}
+
+func (o ObjectFS) Link(_, _ string) error {
+	return ErrNotSupported
+}
+
+func (o ObjectFS) Symlink(_, _ string) error {
+	return ErrNotSupported
+}
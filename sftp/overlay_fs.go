@@ -0,0 +1,427 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The prefix of the name of a whiteout, an empty file in the upper layer of an OverlayFS that hides the file with
+// the same name (without the prefix) and everything below it in the lower layer, like aufs does.
+const whiteoutPrefix = ".wh."
+
+// OverlayFS is a [sftp.SimplifiedFS] that merges a read-only lower layer (e.g. a base dataset shared by all users)
+// with a writable upper layer, like overlayfs. Files of the upper layer take precedence, files of the lower layer
+// are copied up before they are changed and removed ones are hidden by whiteouts in the upper layer. Renaming
+// directories with files of the lower layer is not supported.
+type OverlayFS struct {
+	// The writable layer all changes are written to.
+	Upper SimplifiedFS
+	// The read-only layer below it.
+	Lower SimplifiedFS
+}
+
+// Returns the path of the whiteout of p.
+func whiteoutOf(p string) string {
+	dir, name := path.Split(p)
+	return dir + whiteoutPrefix + name
+}
+
+// Returns an error for the operation on a path of a whiteout, which clients can neither see nor create.
+func checkNoWhiteout(op string, p string) error {
+	if strings.HasPrefix(path.Base(p), whiteoutPrefix) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Returns whether p exists in the upper layer.
+func (o OverlayFS) inUpper(p string) bool {
+	_, err := o.Upper.Lstat(p)
+	return err == nil
+}
+
+// lowerVisible returns whether p of the lower layer is visible, i.e. neither it nor one of its parent directories
+// has a whiteout. Whiteouts are kept when a file is created at their path again, so they still hide the content
+// of the lower layer below it.
+func (o OverlayFS) lowerVisible(p string) bool {
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if o.inUpper(path.Join(current, whiteoutPrefix+name)) {
+			return false
+		}
+		current = path.Join(current, name)
+	}
+	return true
+}
+
+// Returns whether p is visible in the lower layer and exists there.
+func (o OverlayFS) inLower(p string) bool {
+	if !o.lowerVisible(p) {
+		return false
+	}
+	_, err := o.Lower.Lstat(p)
+	return err == nil
+}
+
+// Returns whether p only exists in the lower layer, so it has to be copied up before it is changed.
+func (o OverlayFS) onlyLower(p string) bool {
+	if _, err := o.Upper.Lstat(p); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return o.inLower(p)
+}
+
+// ensureParent creates the parent directories of p in the upper layer that only exist in the lower one.
+func (o OverlayFS) ensureParent(p string) error {
+	dir := path.Dir(p)
+	if dir == "/" || o.inUpper(dir) {
+		return nil
+	}
+	if !o.inLower(dir) {
+		return &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return o.copyUp(dir)
+}
+
+// copyUp copies p from the lower layer to the upper one along with its permissions and modification time. The
+// content of directories is not copied.
+func (o OverlayFS) copyUp(p string) error {
+	if err := o.ensureParent(p); err != nil {
+		return err
+	}
+	info, err := o.Lower.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = o.Upper.Mkdir(p)
+	} else {
+		err = o.copyContent(p)
+	}
+	if err != nil {
+		return err
+	}
+	attributes := gosftp.FileStat{
+		Mode:  uint32(info.Mode().Perm()),
+		Atime: uint32(info.ModTime().Unix()),
+		Mtime: uint32(info.ModTime().Unix()),
+	}
+	return o.Upper.SetStat(p, gosftp.FileAttrFlags{Permissions: true, Acmodtime: true}, &attributes)
+}
+
+// Copies the content of the file at p from the lower layer to the upper one.
+func (o OverlayFS) copyContent(p string) error {
+	reader, err := o.Lower.Read(p)
+	if err != nil {
+		return err
+	}
+	defer closeIfCloser(reader)
+	writer, err := o.Upper.Write(p)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(writer, 0), io.NewSectionReader(reader, 0, 1<<63-1))
+	if closeErr := closeIfCloser(writer); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Creates the whiteout hiding p of the lower layer.
+func (o OverlayFS) createWhiteout(p string) error {
+	if err := o.ensureParent(p); err != nil {
+		return err
+	}
+	writer, err := o.Upper.Write(whiteoutOf(p))
+	if err != nil {
+		return err
+	}
+	return closeIfCloser(writer)
+}
+
+// Returns an error if p exists in either layer.
+func (o OverlayFS) checkNotExists(op string, p string) error {
+	if o.inUpper(p) || o.inLower(p) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrExist}
+	}
+	return nil
+}
+
+// Returns the info of p from the upper layer, or from the lower layer if it is not in the upper one.
+func (o OverlayFS) stat(op string, p string, stat func(fs SimplifiedFS, p string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if err := checkNoWhiteout(op, p); err != nil {
+		return nil, err
+	}
+	info, err := stat(o.Upper, p)
+	if !errors.Is(err, os.ErrNotExist) || !o.lowerVisible(p) {
+		return info, err
+	}
+	return stat(o.Lower, p)
+}
+
+// Calls f for every entry of the directory p of fs.
+func listEach(fs SimplifiedFS, p string, f func(info os.FileInfo)) error {
+	iter, err := fs.List(p)
+	if err != nil {
+		return err
+	}
+	buffer := make([]os.FileInfo, 64)
+	offset := int64(0)
+	for {
+		n, err := iter(buffer, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		offset += int64(n)
+		for _, info := range buffer[:n] {
+			f(info)
+		}
+		if n == 0 || errors.Is(err, io.EOF) {
+			return nil
+		}
+	}
+}
+
+func (o OverlayFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	if err := checkNoWhiteout("open", p); err != nil {
+		return nil, err
+	}
+	var fileinfos []os.FileInfo
+	// The names of the upper layer and the ones hidden by whiteouts.
+	seen := map[string]bool{}
+	found := false
+	err := listEach(o.Upper, p, func(info os.FileInfo) {
+		if name, ok := strings.CutPrefix(info.Name(), whiteoutPrefix); ok {
+			seen[name] = true
+			return
+		}
+		seen[info.Name()] = true
+		fileinfos = append(fileinfos, info)
+	})
+	if err == nil {
+		found = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if o.lowerVisible(p) {
+		err = listEach(o.Lower, p, func(info os.FileInfo) {
+			if !seen[info.Name()] {
+				fileinfos = append(fileinfos, info)
+			}
+		})
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	sort.Slice(fileinfos, func(i, j int) bool { return fileinfos[i].Name() < fileinfos[j].Name() })
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (o OverlayFS) Lstat(p string) (os.FileInfo, error) {
+	return o.stat("lstat", p, SimplifiedFS.Lstat)
+}
+
+func (o OverlayFS) Stat(p string) (os.FileInfo, error) {
+	return o.stat("stat", p, SimplifiedFS.Stat)
+}
+
+func (o OverlayFS) ReadLink(p string) (os.FileInfo, error) {
+	return o.stat("readlink", p, SimplifiedFS.ReadLink)
+}
+
+func (o OverlayFS) Read(p string) (io.ReaderAt, error) {
+	if err := checkNoWhiteout("open", p); err != nil {
+		return nil, err
+	}
+	if o.onlyLower(p) {
+		return o.Lower.Read(p)
+	}
+	return o.Upper.Read(p)
+}
+
+func (o OverlayFS) Write(p string) (io.WriterAt, error) {
+	if err := checkNoWhiteout("open", p); err != nil {
+		return nil, err
+	}
+	var err error
+	if o.onlyLower(p) {
+		err = o.copyUp(p)
+	} else {
+		err = o.ensureParent(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o.Upper.Write(p)
+}
+
+func (o OverlayFS) SetStat(p string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if err := checkNoWhiteout("setstat", p); err != nil {
+		return err
+	}
+	if o.onlyLower(p) {
+		if err := o.copyUp(p); err != nil {
+			return err
+		}
+	}
+	return o.Upper.SetStat(p, flags, attributes)
+}
+
+func (o OverlayFS) Rename(src, dst string) error {
+	if err := checkNoWhiteout("rename", src); err != nil {
+		return err
+	}
+	if err := checkNoWhiteout("rename", dst); err != nil {
+		return err
+	}
+	srcInLower := o.inLower(src)
+	if srcInLower {
+		if info, err := o.Lower.Lstat(src); err == nil && info.IsDir() {
+			// Its content would have to be copied up, which overlayfs does not do either.
+			return ErrNotSupported
+		}
+		if o.onlyLower(src) {
+			if err := o.copyUp(src); err != nil {
+				return err
+			}
+		}
+	}
+	if err := o.ensureParent(dst); err != nil {
+		return err
+	}
+	if o.inLower(dst) {
+		if err := o.createWhiteout(dst); err != nil {
+			return err
+		}
+	}
+	if err := o.Upper.Rename(src, dst); err != nil {
+		return err
+	}
+	if srcInLower {
+		return o.createWhiteout(src)
+	}
+	return nil
+}
+
+func (o OverlayFS) Rmdir(p string) error {
+	if err := checkNoWhiteout("rmdir", p); err != nil {
+		return err
+	}
+	lister, err := o.List(p)
+	if err != nil {
+		return err
+	}
+	if n, _ := lister(make([]os.FileInfo, 1), 0); n > 0 {
+		return fmt.Errorf("directory %s is not empty", p)
+	}
+	inLower := o.inLower(p)
+	if o.inUpper(p) {
+		// Whiteouts are the only files left within it.
+		var whiteouts []string
+		_ = listEach(o.Upper, p, func(info os.FileInfo) {
+			whiteouts = append(whiteouts, path.Join(p, info.Name()))
+		})
+		for _, whiteout := range whiteouts {
+			if err := o.Upper.Rm(whiteout); err != nil {
+				return err
+			}
+		}
+		if err := o.Upper.Rmdir(p); err != nil {
+			return err
+		}
+	}
+	if inLower {
+		return o.createWhiteout(p)
+	}
+	return nil
+}
+
+func (o OverlayFS) Rm(p string) error {
+	if err := checkNoWhiteout("remove", p); err != nil {
+		return err
+	}
+	inLower := o.inLower(p)
+	if !inLower || o.inUpper(p) {
+		if err := o.Upper.Rm(p); err != nil {
+			return err
+		}
+	} else if info, err := o.Lower.Lstat(p); err == nil && info.IsDir() {
+		return fmt.Errorf("is a directory %s", p)
+	}
+	if inLower {
+		return o.createWhiteout(p)
+	}
+	return nil
+}
+
+func (o OverlayFS) Mkdir(p string) error {
+	if err := checkNoWhiteout("mkdir", p); err != nil {
+		return err
+	}
+	if err := o.checkNotExists("mkdir", p); err != nil {
+		return err
+	}
+	if err := o.ensureParent(p); err != nil {
+		return err
+	}
+	return o.Upper.Mkdir(p)
+}
+
+func (o OverlayFS) Link(src, dst string) error {
+	if err := checkNoWhiteout("link", dst); err != nil {
+		return err
+	}
+	if err := o.checkNotExists("link", dst); err != nil {
+		return err
+	}
+	if o.onlyLower(src) {
+		if err := o.copyUp(src); err != nil {
+			return err
+		}
+	}
+	if err := o.ensureParent(dst); err != nil {
+		return err
+	}
+	return o.Upper.Link(src, dst)
+}
+
+func (o OverlayFS) Symlink(src, dst string) error {
+	if err := checkNoWhiteout("symlink", dst); err != nil {
+		return err
+	}
+	if err := o.checkNotExists("symlink", dst); err != nil {
+		return err
+	}
+	if err := o.ensureParent(dst); err != nil {
+		return err
+	}
+	return o.Upper.Symlink(src, dst)
+}
+
+// Space returns the space of the upper layer, which all changes are written to.
+func (o OverlayFS) Space(p string) (Space, error) {
+	return SpaceOf(o.Upper, p)
+}
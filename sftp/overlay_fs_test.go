@@ -0,0 +1,95 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlayFS(t *testing.T) {
+	lowerDir, upperDir := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(lowerDir, "data", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"data/base.txt": "base", "data/sub/deep.txt": "deep", "top.txt": "top"} {
+		if err := os.WriteFile(filepath.Join(lowerDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := OverlayFS{Upper: DirFs{Root: upperDir + "/"}, Lower: DirFs{Root: lowerDir + "/", Readonly: true}}
+	names := func(p string) []string {
+		lister, err := fs.List(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos := make([]os.FileInfo, 10)
+		n, _ := lister(infos, 0)
+		var names []string
+		for _, info := range infos[:n] {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	read := func(p string) string {
+		reader, err := fs.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeIfCloser(reader)
+		data, _ := io.ReadAll(io.NewSectionReader(reader, 0, 100))
+		return string(data)
+	}
+
+	// Writing into a directory of the lower layer copies it and the file up.
+	writer, err := fs.Write("/data/base.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("B"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = closeIfCloser(writer)
+	if got := read("/data/base.txt"); got != "Base" {
+		t.Errorf("read %q after changing the copied up file, want %q", got, "Base")
+	}
+	if content, _ := os.ReadFile(filepath.Join(lowerDir, "data", "base.txt")); string(content) != "base" {
+		t.Errorf("the lower layer has been changed to %q", content)
+	}
+
+	if err := fs.Rm("/top.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/top.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a removed lower file = %v, want not exist", err)
+	}
+	if got := names("/"); len(got) != 1 || got[0] != "data" {
+		t.Errorf("listed %v, want only data without the whiteout", got)
+	}
+
+	// A directory created again does not show the removed content of the lower layer.
+	if err := fs.Rm("/data/sub/deep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rmdir("/data/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/data/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/data/sub"); len(got) != 0 {
+		t.Errorf("listed %v in the new directory, want nothing", got)
+	}
+	if err := fs.Rmdir("/data"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+	if err := fs.Rename("/data/base.txt", "/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("/data"); len(got) != 1 || got[0] != "sub" {
+		t.Errorf("listed %v after moving the file, want only sub", got)
+	}
+	if _, err := fs.Write("/.wh.data"); err == nil {
+		t.Error("a whiteout could be written by the client")
+	}
+}
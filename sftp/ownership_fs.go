@@ -0,0 +1,151 @@
+package sftp
+
+import (
+	"io"
+	"os"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+// OwnershipFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and modifies the
+// ownership reported to the client as well as the ownership changes requested by the client.
+type OwnershipFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// Whether to report every file as owned by UID and GID instead of the real owner.
+	Squash bool
+	// The user id reported if Squash is true.
+	UID uint32
+	// The group id reported if Squash is true.
+	GID uint32
+	// Whether to silently ignore chown requests instead of passing them to the inner filesystem.
+	IgnoreChown bool
+}
+
+// squashedFileInfo modifies the owner of a given FileInfo
+type squashedFileInfo struct {
+	os.FileInfo
+	uid uint32
+	gid uint32
+}
+
+func (s squashedFileInfo) Sys() interface{} {
+	return withOwner(s.FileInfo, s.uid, s.gid)
+}
+
+// withOwner returns the Sys() value of the given FileInfo with the owner replaced by uid and gid.
+// If the platform specific value cannot be modified, a [gosftp.FileStat] is returned.
+func withOwner(info os.FileInfo, uid, gid uint32) interface{} {
+	if sys, ok := withOwnerOs(info.Sys(), uid, gid); ok {
+		return sys
+	}
+	mtime := uint32(info.ModTime().Unix())
+	return &gosftp.FileStat{
+		Size:  uint64(info.Size()),
+		Mode:  sftpFileMode(info.Mode()),
+		Mtime: mtime,
+		Atime: mtime,
+		UID:   uid,
+		GID:   gid,
+	}
+}
+
+// sftpFileMode converts a [os.FileMode] into the mode bits used by the sftp protocol.
+func sftpFileMode(mode os.FileMode) uint32 {
+	result := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		result |= 0o040000
+	case mode&os.ModeSymlink != 0:
+		result |= 0o120000
+	default:
+		result |= 0o100000
+	}
+	return result
+}
+
+func (o OwnershipFS) mapInfo(info os.FileInfo) os.FileInfo {
+	if !o.Squash || info == nil {
+		return info
+	}
+	return squashedFileInfo{info, o.UID, o.GID}
+}
+
+func (o OwnershipFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	iter, err := o.Inner.List(path)
+	if err != nil || !o.Squash {
+		return iter, err
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		n, err := iter(ls, offset)
+		for i := 0; i < n; i++ {
+			ls[i] = o.mapInfo(ls[i])
+		}
+		return n, err
+	}, nil
+}
+
+func (o OwnershipFS) Lstat(path string) (os.FileInfo, error) {
+	info, err := o.Inner.Lstat(path)
+	return o.mapInfo(info), err
+}
+
+func (o OwnershipFS) Stat(path string) (os.FileInfo, error) {
+	info, err := o.Inner.Stat(path)
+	return o.mapInfo(info), err
+}
+
+func (o OwnershipFS) ReadLink(path string) (os.FileInfo, error) {
+	info, err := o.Inner.ReadLink(path)
+	return o.mapInfo(info), err
+}
+
+func (o OwnershipFS) Read(path string) (io.ReaderAt, error) {
+	return o.Inner.Read(path)
+}
+
+func (o OwnershipFS) Write(path string) (io.WriterAt, error) {
+	return o.Inner.Write(path)
+}
+
+func (o OwnershipFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if flags.UidGid {
+		// A chown to the virtual owner is a no-op as every file is already reported as owned by it.
+		isVirtualOwner := o.Squash && attributes.UID == o.UID && attributes.GID == o.GID
+		if o.IgnoreChown || isVirtualOwner {
+			flags.UidGid = false
+		}
+	}
+	if !flags.Size && !flags.Permissions && !flags.UidGid && !flags.Acmodtime {
+		return nil
+	}
+	return o.Inner.SetStat(path, flags, attributes)
+}
+
+func (o OwnershipFS) Rename(src, dst string) error {
+	return o.Inner.Rename(src, dst)
+}
+
+func (o OwnershipFS) Rmdir(path string) error {
+	return o.Inner.Rmdir(path)
+}
+
+func (o OwnershipFS) Rm(path string) error {
+	return o.Inner.Rm(path)
+}
+
+func (o OwnershipFS) Mkdir(path string) error {
+	return o.Inner.Mkdir(path)
+}
+
+func (o OwnershipFS) Link(src, dst string) error {
+	return o.Inner.Link(src, dst)
+}
+
+func (o OwnershipFS) Symlink(src, dst string) error {
+	return o.Inner.Symlink(src, dst)
+}
+
+func (o OwnershipFS) Space(path string) (Space, error) {
+	return SpaceOf(o.Inner, path)
+}
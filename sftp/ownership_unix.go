@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package sftp
+
+import "syscall"
+
+// withOwnerOs returns a copy of the platform specific stat value with the owner replaced by uid and gid.
+func withOwnerOs(sys interface{}, uid, gid uint32) (interface{}, bool) {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+	modified := *stat
+	modified.Uid = uid
+	modified.Gid = gid
+	return &modified, true
+}
@@ -0,0 +1,6 @@
+package sftp
+
+// withOwnerOs returns false as windows has no platform specific stat value containing an uid or gid.
+func withOwnerOs(_ interface{}, _, _ uint32) (interface{}, bool) {
+	return nil, false
+}
@@ -0,0 +1,152 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInvalidPath is returned (wrapped) if a path violates a [sftp.PathPolicy].
+var ErrInvalidPath = errors.New("invalid path")
+
+// PathPolicy restricts the paths of the files and directories that can be created.
+type PathPolicy struct {
+	// The maximal length of a whole path in bytes. Zero means no limit.
+	MaxPathLength int
+	// The maximal length of a created name in bytes. Zero means no limit.
+	MaxNameLength int
+	// Whether names with control characters (like newlines or escape sequences) are rejected.
+	RejectControlCharacters bool
+	// Whether names that are not valid UTF-8 are rejected.
+	RequireUTF8 bool
+	// If not nil, every name must match it completely.
+	AllowedNames *regexp.Regexp
+}
+
+// Check returns an error wrapping ErrInvalidPath if the normalized path is too long or its last name (the one
+// that is created) violates the policy. The names of the parent directories have been checked when they were
+// created, if they were created with the policy in place.
+func (p PathPolicy) Check(path string) error {
+	if p.MaxPathLength > 0 && len(path) > p.MaxPathLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidPath, p.MaxPathLength)
+	}
+	name := path[strings.LastIndex(path, "/")+1:]
+	if p.MaxNameLength > 0 && len(name) > p.MaxNameLength {
+		return fmt.Errorf("%w: the name %q is longer than %d bytes", ErrInvalidPath, name, p.MaxNameLength)
+	}
+	if p.RequireUTF8 && !utf8.ValidString(name) {
+		return fmt.Errorf("%w: the name %q is no valid UTF-8", ErrInvalidPath, name)
+	}
+	if p.RejectControlCharacters && strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: the name %q contains control characters", ErrInvalidPath, name)
+	}
+	if p.AllowedNames != nil && !p.AllowedNames.MatchString(name) {
+		return fmt.Errorf("%w: the name %q contains characters that are not allowed", ErrInvalidPath, name)
+	}
+	return nil
+}
+
+// PathPolicyFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and rejects creating files,
+// directories and links whose path violates a PathPolicy. Existing files can still be accessed, changed and removed
+// whatever their names are, so files created before the policy are not stuck.
+type PathPolicyFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The policy for created paths
+	Policy PathPolicy
+}
+
+// Checks the path if it does not exist yet.
+func (p PathPolicyFS) checkNew(path string) error {
+	if _, err := p.Inner.Lstat(path); err == nil {
+		return nil
+	}
+	return p.Policy.Check(path)
+}
+
+func (p PathPolicyFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return p.Inner.List(path)
+}
+
+func (p PathPolicyFS) Lstat(path string) (os.FileInfo, error) {
+	return p.Inner.Lstat(path)
+}
+
+func (p PathPolicyFS) Stat(path string) (os.FileInfo, error) {
+	return p.Inner.Stat(path)
+}
+
+func (p PathPolicyFS) ReadLink(path string) (os.FileInfo, error) {
+	return p.Inner.ReadLink(path)
+}
+
+func (p PathPolicyFS) Read(path string) (io.ReaderAt, error) {
+	return p.Inner.Read(path)
+}
+
+func (p PathPolicyFS) Write(path string) (io.WriterAt, error) {
+	if err := p.checkNew(path); err != nil {
+		return nil, err
+	}
+	return p.Inner.Write(path)
+}
+
+func (p PathPolicyFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return p.Inner.SetStat(path, flags, attributes)
+}
+
+func (p PathPolicyFS) Rename(src, dst string) error {
+	if err := p.Policy.Check(dst); err != nil {
+		return err
+	}
+	return p.Inner.Rename(src, dst)
+}
+
+func (p PathPolicyFS) Copy(src, dst string) error {
+	if err := p.checkNew(dst); err != nil {
+		return err
+	}
+	if copier, ok := p.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (p PathPolicyFS) Rmdir(path string) error {
+	return p.Inner.Rmdir(path)
+}
+
+func (p PathPolicyFS) Rm(path string) error {
+	return p.Inner.Rm(path)
+}
+
+func (p PathPolicyFS) Mkdir(path string) error {
+	if err := p.Policy.Check(path); err != nil {
+		return err
+	}
+	return p.Inner.Mkdir(path)
+}
+
+func (p PathPolicyFS) Link(src, dst string) error {
+	if err := p.Policy.Check(dst); err != nil {
+		return err
+	}
+	return p.Inner.Link(src, dst)
+}
+
+func (p PathPolicyFS) Symlink(src, dst string) error {
+	if err := p.Policy.Check(dst); err != nil {
+		return err
+	}
+	return p.Inner.Symlink(src, dst)
+}
+
+func (p PathPolicyFS) Space(path string) (Space, error) {
+	return SpaceOf(p.Inner, path)
+}
@@ -0,0 +1,51 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestPathPolicyFS(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(root+"/old\x01dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fs := PathPolicyFS{Inner: DirFs{Root: root + "/"}, Policy: PathPolicy{
+		MaxPathLength:           30,
+		MaxNameLength:           10,
+		RejectControlCharacters: true,
+		RequireUTF8:             true,
+		AllowedNames:            regexp.MustCompile(`^[\p{L}0-9._ \x01-]+$`),
+	}}
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/ok.txt", false},
+		{"/Grüße", false},
+		{"/name-too-long.txt", true},
+		{"/a\nb", true},
+		{"/\xff\xfe", true},
+		{"/a*b", true},
+		// Only the created name is checked, not the existing parent.
+		{"/old\x01dir/new", false},
+		{"/old\x01dir/abcdefghi/abcdefghi/abcdefghi", true},
+	}
+	for _, test := range tests {
+		err := fs.Mkdir(test.path)
+		if test.wantErr != errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Mkdir(%q) = %v, want invalid path %v", test.path, err, test.wantErr)
+		}
+	}
+	writer, err := fs.Write("/bad*name")
+	if !errors.Is(err, ErrInvalidPath) {
+		_ = writer.(io.Closer).Close()
+		t.Errorf("Write() of a forbidden name = %v, want ErrInvalidPath", err)
+	}
+	if err := fs.Rename("/old\x01dir", "/renamed"); err != nil {
+		t.Errorf("renaming a file with an old name to a valid one failed: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 // PermWrapperFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and
@@ -20,6 +21,27 @@ type PermWrapperFS struct {
 	CanWriteRegexp []*regexp.Regexp
 	// A list of regular expressions for files/directories that should be hidden.
 	ShouldHideRegexp []*regexp.Regexp
+	// Whether to hide every file or directory whose name starts with a dot.
+	HideDotfiles bool
+	// Whether operations violating the permissions are only reported to OnDenied instead of being rejected.
+	AuditOnly bool
+	// Is called with the operation (e.g. "Write") and the path of every violation if AuditOnly is set.
+	// May be nil.
+	OnDenied func(operation string, path string)
+}
+
+// Returns ErrForbidden if the operation is not allowed, unless AuditOnly is set.
+func (p PermWrapperFS) check(allowed bool, operation string, path string) error {
+	if allowed {
+		return nil
+	}
+	if !p.AuditOnly {
+		return ErrForbidden
+	}
+	if p.OnDenied != nil {
+		p.OnDenied(operation, path)
+	}
+	return nil
 }
 
 func (p PermWrapperFS) CanRead(path string) bool {
@@ -42,6 +64,9 @@ func (p PermWrapperFS) CanWrite(path string) bool {
 
 // ShouldHide is true iff the given path should be hidden according to the user.
 func (p PermWrapperFS) ShouldHide(path string) bool {
+	if p.HideDotfiles && containsDotfile(path) {
+		return true
+	}
 	for _, r := range p.ShouldHideRegexp {
 		if r.MatchString(path) {
 			return true
@@ -50,6 +75,16 @@ func (p PermWrapperFS) ShouldHide(path string) bool {
 	return false
 }
 
+// Whether any component of the given slash separated path starts with a dot.
+func containsDotfile(path string) bool {
+	for _, component := range strings.Split(path, "/") {
+		if len(component) > 0 && component[0] == '.' {
+			return true
+		}
+	}
+	return false
+}
+
 // Whether the given array contains the given element.
 func contains(array []int64, element int64) bool {
 	for _, item := range array {
@@ -69,24 +104,42 @@ func max(a, b int64) int64 {
 }
 
 func (p PermWrapperFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
-	if !p.CanRead(path) || p.ShouldHide(path) {
-		return nil, ErrForbidden
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "List", path); err != nil {
+		return nil, err
 	}
 	iter, err := p.Inner.List(path)
 	if err != nil {
 		return nil, err
 	}
-	if len(p.ShouldHideRegexp) == 0 {
+	if len(p.ShouldHideRegexp) == 0 && !p.HideDotfiles {
 		return iter, nil
 	}
+	if p.AuditOnly {
+		// Nothing is hidden, but the files that would be are reported.
+		return func(ls []os.FileInfo, offset int64) (int, error) {
+			n, err := iter(ls, offset)
+			for _, info := range ls[:n] {
+				child := filepath.Join(path, info.Name())
+				_ = p.check(!p.ShouldHide(child), "Hide", child)
+			}
+			return n, err
+		}, nil
+	}
 	// which index among all ls results we certainly know not to show
 	var idxToHide []int64
 	// which was the highest offset processed yet
 	maxOffsetYet := int64(0)
+	// The buffers for the inner results, reused by the following calls (which usually ask for as many items),
+	// so paging through a large directory does not allocate them again and again.
+	var raw []os.FileInfo
+	tmp := make([]os.FileInfo, 1)
 	return func(ls []os.FileInfo, offset int64) (int, error) {
 		// We require to filter the inner.List calls:
 		// 1. we create a buffer in which we copy the inner result
-		raw := make([]os.FileInfo, len(ls))
+		if cap(raw) < len(ls) {
+			raw = make([]os.FileInfo, len(ls))
+		}
+		raw = raw[:len(ls)]
 		// 2. We compute the offset we pass to the inner.List call by checking how many
 		//    items we skipped if we go to this offset. The idx to skip are idxToHide and
 		//    are supposed to be computed from previous calls
@@ -101,7 +154,6 @@ func (p PermWrapperFS) List(path string) (func([]os.FileInfo, int64) (int, error
 			} else if i >= maxOffsetYet { // we don't know yet if this should be skipped
 				maxOffsetYet += 1 // as we process this now, we increment the maxOffsetYet
 				// we want to list the single next item
-				tmp := make([]os.FileInfo, 1)
 				n, err := iter(tmp, realOffset)
 				if err != nil {
 					return 0, err
@@ -154,85 +206,112 @@ func (p PermWrapperFS) List(path string) (func([]os.FileInfo, int64) (int, error
 }
 
 func (p PermWrapperFS) Lstat(path string) (os.FileInfo, error) {
-	if p.CanRead(path) && !p.ShouldHide(path) {
-		return p.Inner.Lstat(path)
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "Lstat", path); err != nil {
+		return nil, err
 	}
-	return nil, ErrForbidden
+	return p.Inner.Lstat(path)
 }
 
 func (p PermWrapperFS) Stat(path string) (os.FileInfo, error) {
-	if p.CanRead(path) && !p.ShouldHide(path) {
-		return p.Inner.Stat(path)
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "Stat", path); err != nil {
+		return nil, err
 	}
-	return nil, ErrForbidden
+	return p.Inner.Stat(path)
 }
 
 func (p PermWrapperFS) ReadLink(path string) (os.FileInfo, error) {
-	if p.CanRead(path) && !p.ShouldHide(path) {
-		return p.Inner.ReadLink(path)
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "ReadLink", path); err != nil {
+		return nil, err
 	}
-	return nil, ErrForbidden
+	return p.Inner.ReadLink(path)
 }
 
 func (p PermWrapperFS) Read(path string) (io.ReaderAt, error) {
-	if p.CanRead(path) && !p.ShouldHide(path) {
-		return p.Inner.Read(path)
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "Read", path); err != nil {
+		return nil, err
 	}
-	return nil, ErrForbidden
+	return p.Inner.Read(path)
 }
 
 func (p PermWrapperFS) Write(path string) (io.WriterAt, error) {
-	if p.CanWrite(path) && !p.ShouldHide(path) {
-		return p.Inner.Write(path)
+	if err := p.check(p.CanWrite(path) && !p.ShouldHide(path), "Write", path); err != nil {
+		return nil, err
 	}
-	return nil, ErrForbidden
+	return p.Inner.Write(path)
 }
 
 func (p PermWrapperFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
-	if p.CanWrite(path) && !p.ShouldHide(path) {
-		return p.Inner.SetStat(path, flags, attributes)
+	if err := p.check(p.CanWrite(path) && !p.ShouldHide(path), "SetStat", path); err != nil {
+		return err
 	}
-	return ErrForbidden
+	return p.Inner.SetStat(path, flags, attributes)
 }
 
 func (p PermWrapperFS) Rename(src, dst string) error {
-	if p.CanWrite(src) && p.CanWrite(dst) && !p.ShouldHide(src) && !p.ShouldHide(dst) {
-		return p.Inner.Rename(src, dst)
+	if err := p.check(p.CanWrite(src) && !p.ShouldHide(src), "Rename", src); err != nil {
+		return err
+	}
+	if err := p.check(p.CanWrite(dst) && !p.ShouldHide(dst), "Rename", dst); err != nil {
+		return err
 	}
-	return ErrForbidden
+	return p.Inner.Rename(src, dst)
+}
+
+// Copy requires the source to be readable and the destination to be writable.
+func (p PermWrapperFS) Copy(src, dst string) error {
+	if err := p.check(p.CanRead(src) && !p.ShouldHide(src), "Copy", src); err != nil {
+		return err
+	}
+	if err := p.check(p.CanWrite(dst) && !p.ShouldHide(dst), "Copy", dst); err != nil {
+		return err
+	}
+	return CopyFile(p.Inner, src, dst)
 }
 
 func (p PermWrapperFS) Rmdir(path string) error {
-	if p.CanWrite(path) && !p.ShouldHide(path) {
-		return p.Inner.Rmdir(path)
+	if err := p.check(p.CanWrite(path) && !p.ShouldHide(path), "Rmdir", path); err != nil {
+		return err
 	}
-	return ErrForbidden
+	return p.Inner.Rmdir(path)
 }
 
 func (p PermWrapperFS) Rm(path string) error {
-	if p.CanWrite(path) && !p.ShouldHide(path) {
-		return p.Inner.Rm(path)
+	if err := p.check(p.CanWrite(path) && !p.ShouldHide(path), "Rm", path); err != nil {
+		return err
 	}
-	return ErrForbidden
+	return p.Inner.Rm(path)
 }
 
 func (p PermWrapperFS) Mkdir(path string) error {
-	if p.CanWrite(path) && !p.ShouldHide(path) {
-		return p.Inner.Mkdir(path)
+	if err := p.check(p.CanWrite(path) && !p.ShouldHide(path), "Mkdir", path); err != nil {
+		return err
 	}
-	return ErrForbidden
+	return p.Inner.Mkdir(path)
 }
 
 func (p PermWrapperFS) Link(src, dst string) error {
-	if p.CanRead(src) && p.CanWrite(dst) && !p.ShouldHide(src) && !p.ShouldHide(dst) {
-		return p.Inner.Link(src, dst)
+	if err := p.check(p.CanRead(src) && !p.ShouldHide(src), "Link", src); err != nil {
+		return err
 	}
-	return ErrForbidden
+	if err := p.check(p.CanWrite(dst) && !p.ShouldHide(dst), "Link", dst); err != nil {
+		return err
+	}
+	return p.Inner.Link(src, dst)
 }
 
 func (p PermWrapperFS) Symlink(src, dst string) error {
-	if p.CanRead(src) && p.CanWrite(dst) && !p.ShouldHide(src) && !p.ShouldHide(dst) {
-		return p.Inner.Symlink(src, dst)
+	if err := p.check(p.CanRead(src) && !p.ShouldHide(src), "Symlink", src); err != nil {
+		return err
+	}
+	if err := p.check(p.CanWrite(dst) && !p.ShouldHide(dst), "Symlink", dst); err != nil {
+		return err
+	}
+	return p.Inner.Symlink(src, dst)
+}
+
+func (p PermWrapperFS) Space(path string) (Space, error) {
+	if err := p.check(p.CanRead(path) && !p.ShouldHide(path), "Space", path); err != nil {
+		return Space{}, err
 	}
-	return ErrForbidden
+	return SpaceOf(p.Inner, path)
 }
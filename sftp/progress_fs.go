@@ -0,0 +1,209 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress describes how far the transfer of a single file has come.
+type Progress struct {
+	Path string
+	// Whether the file is written (uploaded) instead of read (downloaded).
+	Upload bool
+	// The bytes transferred since the file has been opened.
+	Bytes int64
+	// The bytes transferred since the previous report. Zero means the transfer is stalled.
+	Delta int64
+	// The time since the file has been opened.
+	Elapsed time.Duration
+}
+
+// ProgressFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and periodically reports the progress
+// of every open file.
+type ProgressFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// Called with the progress of a file. It may be called concurrently.
+	Report func(Progress)
+	// Reports whenever this many bytes have been transferred since the last report. Zero disables this.
+	EveryBytes int64
+	// Reports in this interval as long as the file is open, even if nothing has been transferred.
+	// Zero disables this.
+	Interval time.Duration
+}
+
+// progressTracker counts the bytes of a single open file and reports them.
+type progressTracker struct {
+	// Must be accessed atomically.
+	bytes int64
+	fs    ProgressFS
+	path  string
+	// Whether the file is written.
+	upload bool
+	start  time.Time
+	// Protects reported
+	mutex sync.Mutex
+	// The bytes at the last report.
+	reported int64
+	// Closed once the file has been closed.
+	done chan struct{}
+	once sync.Once
+}
+
+// Creates a tracker for the file and starts the periodic reports.
+func (p ProgressFS) track(path string, upload bool) *progressTracker {
+	tracker := &progressTracker{fs: p, path: path, upload: upload, start: time.Now(), done: make(chan struct{})}
+	if p.Interval > 0 {
+		go func() {
+			ticker := time.NewTicker(p.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-tracker.done:
+					return
+				case <-ticker.C:
+					tracker.report(true)
+				}
+			}
+		}()
+	}
+	return tracker
+}
+
+// Reports the current progress. Unless force is true, it is only reported if EveryBytes have been transferred
+// since the last report.
+func (t *progressTracker) report(force bool) {
+	bytes := atomic.LoadInt64(&t.bytes)
+	t.mutex.Lock()
+	delta := bytes - t.reported
+	if !force && delta < t.fs.EveryBytes {
+		t.mutex.Unlock()
+		return
+	}
+	t.reported = bytes
+	t.mutex.Unlock()
+	t.fs.Report(Progress{Path: t.path, Upload: t.upload, Bytes: bytes, Delta: delta, Elapsed: time.Since(t.start)})
+}
+
+// Counts the transferred bytes and reports if enough of them have been transferred.
+func (t *progressTracker) add(n int) {
+	atomic.AddInt64(&t.bytes, int64(n))
+	if t.fs.EveryBytes > 0 {
+		t.report(false)
+	}
+}
+
+// Stops the periodic reports.
+func (t *progressTracker) close() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// progressReader is an [io.ReaderAt] that tracks the read bytes.
+type progressReader struct {
+	io.ReaderAt
+	tracker *progressTracker
+}
+
+func (r *progressReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.tracker.add(n)
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	r.tracker.close()
+	return closeIfCloser(r.ReaderAt)
+}
+
+// progressWriter is an [io.WriterAt] that tracks the written bytes.
+type progressWriter struct {
+	io.WriterAt
+	tracker *progressTracker
+}
+
+func (w *progressWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.tracker.add(n)
+	return n, err
+}
+
+func (w *progressWriter) Close() error {
+	w.tracker.close()
+	return closeIfCloser(w.WriterAt)
+}
+
+func (p ProgressFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return p.Inner.List(path)
+}
+
+func (p ProgressFS) Lstat(path string) (os.FileInfo, error) {
+	return p.Inner.Lstat(path)
+}
+
+func (p ProgressFS) Stat(path string) (os.FileInfo, error) {
+	return p.Inner.Stat(path)
+}
+
+func (p ProgressFS) ReadLink(path string) (os.FileInfo, error) {
+	return p.Inner.ReadLink(path)
+}
+
+func (p ProgressFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := p.Inner.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{ReaderAt: reader, tracker: p.track(path, false)}, nil
+}
+
+func (p ProgressFS) Write(path string) (io.WriterAt, error) {
+	writer, err := p.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	return &progressWriter{WriterAt: writer, tracker: p.track(path, true)}, nil
+}
+
+func (p ProgressFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return p.Inner.SetStat(path, flags, attributes)
+}
+
+func (p ProgressFS) Rename(src, dst string) error {
+	return p.Inner.Rename(src, dst)
+}
+
+// Copy reports no progress if the inner filesystem copies the file itself, as no data is transferred to the client.
+func (p ProgressFS) Copy(src, dst string) error {
+	if copier, ok := p.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (p ProgressFS) Rmdir(path string) error {
+	return p.Inner.Rmdir(path)
+}
+
+func (p ProgressFS) Rm(path string) error {
+	return p.Inner.Rm(path)
+}
+
+func (p ProgressFS) Mkdir(path string) error {
+	return p.Inner.Mkdir(path)
+}
+
+func (p ProgressFS) Link(src, dst string) error {
+	return p.Inner.Link(src, dst)
+}
+
+func (p ProgressFS) Symlink(src, dst string) error {
+	return p.Inner.Symlink(src, dst)
+}
+
+func (p ProgressFS) Space(path string) (Space, error) {
+	return SpaceOf(p.Inner, path)
+}
@@ -0,0 +1,439 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when an operation is refused because it would exceed a configured limit.
+var ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+
+// QuotaFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and limits the number of
+// files and directories that can be created within it as well as their total size. The current usage is tracked in
+// a [sftp.UsageStore], so it is kept across connections and restarts (if the store is persistent).
+type QuotaFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The store that tracks the usage.
+	Store UsageStore
+	// The key of this filesystem within the store.
+	Key string
+	// The maximal number of files and directories. Zero means no limit.
+	MaxFiles int64
+	// The maximal total size of all files in bytes. Zero means no limit.
+	MaxBytes int64
+	// The number of files and directories above which new files can only be created during the GracePeriod.
+	// Zero means no soft limit.
+	SoftMaxFiles int64
+	// How long files can be created above SoftMaxFiles, counted from the first file above it.
+	GracePeriod time.Duration
+	// Called for every file created above SoftMaxFiles with the number of files including it and the end of the
+	// grace period. May be nil.
+	OnSoftLimit func(files int64, graceEnds time.Time)
+}
+
+// GraceKey returns the key of the store that tracks the grace period of the key. Its Files are the unix time the
+// soft limit has been exceeded at, or zero if it is not exceeded.
+func GraceKey(key string) string {
+	return key + "#grace"
+}
+
+// GraceEnds returns the end of the grace period of the key in the store. Returns false if the soft limit of the
+// key is not exceeded.
+func GraceEnds(store UsageStore, key string, gracePeriod time.Duration) (time.Time, bool, error) {
+	exceeded, ok, err := store.Get(GraceKey(key))
+	if err != nil || !ok || exceeded.Files == 0 {
+		return time.Time{}, false, err
+	}
+	return time.Unix(exceeded.Files, 0).Add(gracePeriod), true, nil
+}
+
+// BytesKey returns the key of the store that tracks the total size of the files of the key. Its Files are the
+// number of bytes.
+func BytesKey(key string) string {
+	return key + "#bytes"
+}
+
+// The keys whose usage is currently counted by NewQuotaFS.
+var countingUsage sync.Map
+
+// NewQuotaFS creates a QuotaFS. If the store doesn't know the usage of this filesystem yet, it is computed in the
+// background by visiting every file of the inner filesystem (once, even if several QuotaFS are created meanwhile).
+// Until then, files can be created as if the filesystem was empty. If counting fails, the next QuotaFS for this
+// key tries again. Nothing is counted while the store cannot be read, its operations fail then anyway.
+func NewQuotaFS(inner SimplifiedFS, store UsageStore, key string, maxFiles int64) QuotaFS {
+	q := QuotaFS{Inner: inner, Store: store, Key: key, MaxFiles: maxFiles}
+	_, filesKnown, filesErr := store.Get(key)
+	_, bytesKnown, bytesErr := store.Get(BytesKey(key))
+	if (filesKnown && bytesKnown) || filesErr != nil || bytesErr != nil {
+		return q
+	}
+	if _, counting := countingUsage.LoadOrStore(key, true); counting {
+		return q
+	}
+	go func() {
+		defer countingUsage.Delete(key)
+		usage, err := CountUsage(inner, "/")
+		if err != nil {
+			return
+		}
+		// Files created while counting may have been added already.
+		if current, _, err := store.Get(key); err == nil {
+			_ = store.Set(key, Usage{Files: max(usage.Files, current.Files)})
+		}
+		if current, _, err := store.Get(BytesKey(key)); err == nil {
+			_ = store.Set(BytesKey(key), Usage{Files: max(usage.Bytes, current.Files)})
+		}
+	}()
+	return q
+}
+
+// Returns the limit for a maximum where zero means no limit.
+func limitOf(maximum int64) int64 {
+	if maximum <= 0 {
+		return math.MaxInt64
+	}
+	return maximum
+}
+
+// Reserves a new file or directory at path in the store if it does not exist yet. Returns true if it has been
+// reserved, which must be undone with release if it cannot be created.
+func (q QuotaFS) reserveCreate(path string) (bool, error) {
+	_, err := q.Inner.Lstat(path)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	usage, reserved, err := q.Store.Reserve(q.Key, 1, limitOf(q.MaxFiles))
+	if err != nil {
+		return false, err
+	}
+	if !reserved {
+		return false, ErrQuotaExceeded
+	}
+	if q.SoftMaxFiles > 0 && usage.Files > q.SoftMaxFiles {
+		graceEnds, err := q.startGrace()
+		if err == nil && !time.Now().Before(graceEnds) {
+			err = ErrQuotaExceeded
+		}
+		if err != nil {
+			q.release(true)
+			return false, err
+		}
+		if q.OnSoftLimit != nil {
+			q.OnSoftLimit(usage.Files, graceEnds)
+		}
+	} else if q.SoftMaxFiles > 0 {
+		// The files may have been removed without this QuotaFS, e.g. by the Retention of a directory.
+		if err := q.endGrace(); err != nil {
+			q.release(true)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Gives back the file reserved by reserveCreate if reserved is true. Unlike removing a file, this does not end the
+// grace period, so a refused file cannot reset it.
+func (q QuotaFS) release(reserved bool) {
+	if reserved {
+		_, _ = q.Store.Add(q.Key, -1)
+	}
+}
+
+// Returns the end of the grace period, which starts now if the soft limit has not been exceeded before.
+func (q QuotaFS) startGrace() (time.Time, error) {
+	if graceEnds, ok, err := GraceEnds(q.Store, q.Key, q.GracePeriod); ok || err != nil {
+		return graceEnds, err
+	}
+	now := time.Now()
+	if err := q.Store.Set(GraceKey(q.Key), Usage{Files: now.Unix()}); err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(q.GracePeriod), nil
+}
+
+// Updates the number of files in the store.
+func (q QuotaFS) add(files int64) error {
+	usage, err := q.Store.Add(q.Key, files)
+	if err != nil || files >= 0 || q.SoftMaxFiles <= 0 || usage.Files > q.SoftMaxFiles {
+		return err
+	}
+	// Dropping to the soft limit ends the grace period.
+	return q.endGrace()
+}
+
+// Reserves the given number of bytes in the store, unless the files would exceed MaxBytes.
+func (q QuotaFS) reserveBytes(bytes int64) error {
+	if bytes <= 0 {
+		return q.addBytes(bytes)
+	}
+	_, reserved, err := q.Store.Reserve(BytesKey(q.Key), bytes, limitOf(q.MaxBytes))
+	if err == nil && !reserved {
+		err = ErrQuotaExceeded
+	}
+	return err
+}
+
+// Updates the total size of the files in the store.
+func (q QuotaFS) addBytes(bytes int64) error {
+	if bytes == 0 {
+		return nil
+	}
+	_, err := q.Store.Add(BytesKey(q.Key), bytes)
+	return err
+}
+
+// Returns the size of the file at path, or zero if it does not exist or is no regular file.
+func (q QuotaFS) sizeOf(path string) int64 {
+	info, err := q.Inner.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// The number of bytes a quotaWriter collects before adding them to the store if there is no MaxBytes, so not every
+// write is a change of the store. With a MaxBytes, every write reserves its growth right away.
+const quotaWriterBatch = 4 * 1024 * 1024
+
+// quotaWriter tracks by how many bytes a file grows while it is written.
+type quotaWriter struct {
+	io.WriterAt
+	quota QuotaFS
+	// Protects the fields below, as the sftp server may write from several goroutines.
+	mutex sync.Mutex
+	// The size of the file as far as known, including the writes of this writer.
+	size int64
+	// The growth that has not been added to the store yet. Always zero with a MaxBytes.
+	pending int64
+}
+
+func (w *quotaWriter) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	w.mutex.Lock()
+	previous := w.size
+	growth := max(end-w.size, 0)
+	var err error
+	if w.quota.MaxBytes > 0 {
+		err = w.quota.reserveBytes(growth)
+	} else if w.pending += growth; w.pending >= quotaWriterBatch {
+		err = w.quota.addBytes(w.pending)
+		w.pending = 0
+	}
+	if err == nil {
+		w.size += growth
+	}
+	w.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.WriterAt.WriteAt(p, off)
+	if err != nil && growth > 0 {
+		w.release(previous, off+int64(n), end)
+	}
+	return n, err
+}
+
+// Gives back the growth of a failed write, which has only reached written instead of end. Nothing is given back if
+// another write has grown the file further meanwhile.
+func (w *quotaWriter) release(previous, written, end int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.size != end {
+		return
+	}
+	size := max(previous, written)
+	if w.quota.MaxBytes > 0 {
+		_ = w.quota.addBytes(size - w.size)
+	} else {
+		w.pending -= w.size - size
+	}
+	w.size = size
+}
+
+func (w *quotaWriter) Close() error {
+	w.mutex.Lock()
+	err := w.quota.addBytes(w.pending)
+	w.pending = 0
+	w.mutex.Unlock()
+	if closeErr := closeIfCloser(w.WriterAt); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Ends the grace period, if any. Exceeding the soft limit again starts a new one.
+func (q QuotaFS) endGrace() error {
+	_, ok, err := GraceEnds(q.Store, q.Key, q.GracePeriod)
+	if ok {
+		return q.Store.Set(GraceKey(q.Key), Usage{})
+	}
+	return err
+}
+
+func (q QuotaFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return q.Inner.List(path)
+}
+
+func (q QuotaFS) Lstat(path string) (os.FileInfo, error) {
+	return q.Inner.Lstat(path)
+}
+
+func (q QuotaFS) Stat(path string) (os.FileInfo, error) {
+	return q.Inner.Stat(path)
+}
+
+func (q QuotaFS) ReadLink(path string) (os.FileInfo, error) {
+	return q.Inner.ReadLink(path)
+}
+
+func (q QuotaFS) Read(path string) (io.ReaderAt, error) {
+	return q.Inner.Read(path)
+}
+
+func (q QuotaFS) Write(path string) (io.WriterAt, error) {
+	size := q.sizeOf(path)
+	reserved, err := q.reserveCreate(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := q.Inner.Write(path)
+	if err != nil {
+		q.release(reserved)
+		return nil, err
+	}
+	return &quotaWriter{WriterAt: writer, quota: q, size: size}, nil
+}
+
+func (q QuotaFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if !flags.Size {
+		return q.Inner.SetStat(path, flags, attributes)
+	}
+	growth := int64(attributes.Size) - q.sizeOf(path)
+	if growth < 0 {
+		if err := q.Inner.SetStat(path, flags, attributes); err != nil {
+			return err
+		}
+		return q.addBytes(growth)
+	}
+	if err := q.reserveBytes(growth); err != nil {
+		return err
+	}
+	if err := q.Inner.SetStat(path, flags, attributes); err != nil {
+		_ = q.addBytes(-growth)
+		return err
+	}
+	return nil
+}
+
+func (q QuotaFS) Rename(src, dst string) error {
+	// An existing destination is replaced by the source.
+	_, dstErr := q.Inner.Lstat(dst)
+	dstSize := q.sizeOf(dst)
+	if err := q.Inner.Rename(src, dst); err != nil {
+		return err
+	}
+	if dstErr == nil {
+		if err := q.addBytes(-dstSize); err != nil {
+			return err
+		}
+		return q.add(-1)
+	}
+	return nil
+}
+
+func (q QuotaFS) Rmdir(path string) error {
+	if err := q.Inner.Rmdir(path); err != nil {
+		return err
+	}
+	return q.add(-1)
+}
+
+func (q QuotaFS) Rm(path string) error {
+	size := q.sizeOf(path)
+	if err := q.Inner.Rm(path); err != nil {
+		return err
+	}
+	if err := q.addBytes(-size); err != nil {
+		return err
+	}
+	return q.add(-1)
+}
+
+func (q QuotaFS) Mkdir(path string) error {
+	reserved, err := q.reserveCreate(path)
+	if err != nil {
+		return err
+	}
+	if err := q.Inner.Mkdir(path); err != nil {
+		q.release(reserved)
+		return err
+	}
+	return nil
+}
+
+func (q QuotaFS) Link(src, dst string) error {
+	reserved, err := q.reserveCreate(dst)
+	if err != nil {
+		return err
+	}
+	if err := q.Inner.Link(src, dst); err != nil {
+		q.release(reserved)
+		return err
+	}
+	return nil
+}
+
+func (q QuotaFS) Symlink(src, dst string) error {
+	reserved, err := q.reserveCreate(dst)
+	if err != nil {
+		return err
+	}
+	if err := q.Inner.Symlink(src, dst); err != nil {
+		q.release(reserved)
+		return err
+	}
+	return nil
+}
+
+// Space returns the space of the inner filesystem, with the number of files limited to MaxFiles and its size to
+// MaxBytes. If the inner filesystem has a tighter limit (e.g. a directory with its own MaxFiles), that one is kept.
+func (q QuotaFS) Space(path string) (Space, error) {
+	space, err := SpaceOf(q.Inner, path)
+	if err != nil {
+		return space, err
+	}
+	if q.MaxBytes > 0 {
+		usage, _, err := q.Store.Get(BytesKey(q.Key))
+		if err != nil {
+			return space, err
+		}
+		available := uint64(max(q.MaxBytes-usage.Files, 0))
+		if space.Total == 0 || available < space.Available {
+			space.Total = uint64(q.MaxBytes)
+			space.Available = available
+		}
+	}
+	if q.MaxFiles <= 0 {
+		return space, nil
+	}
+	usage, _, err := q.Store.Get(q.Key)
+	if err != nil {
+		return space, err
+	}
+	freeFiles := uint64(max(q.MaxFiles-usage.Files, 0))
+	if space.Files == 0 || freeFiles < space.FreeFiles {
+		space.Files = uint64(q.MaxFiles)
+		space.FreeFiles = freeFiles
+	}
+	return space, nil
+}
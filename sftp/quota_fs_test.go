@@ -0,0 +1,291 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+// A UsageStore whose changes fail.
+type failingUsageStore struct {
+	*FileUsageStore
+}
+
+func (f failingUsageStore) Add(string, int64) (Usage, error) {
+	return Usage{}, errors.New("store not available")
+}
+
+func (f failingUsageStore) Reserve(string, int64, int64) (Usage, bool, error) {
+	return Usage{}, false, errors.New("store not available")
+}
+
+// Creates a QuotaFS on a new directory whose usage is known to be files.
+func newTestQuotaFS(t *testing.T, store UsageStore, files int64, maxFiles int64) QuotaFS {
+	if err := store.Set("test", Usage{Files: files}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(BytesKey("test"), Usage{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewQuotaFS(DirFs{Root: t.TempDir() + "/"}, store, "test", maxFiles)
+}
+
+func TestQuotaFS(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     int64
+		maxFiles  int64
+		operation func(q QuotaFS) error
+		wantErr   error
+		wantFiles int64
+	}{
+		{"write", 0, 2, func(q QuotaFS) error {
+			writer, err := q.Write("/a")
+			if err == nil {
+				err = writer.(io.Closer).Close()
+			}
+			return err
+		}, nil, 1},
+		{"write exceeds quota", 2, 2, func(q QuotaFS) error {
+			_, err := q.Write("/a")
+			return err
+		}, ErrQuotaExceeded, 2},
+		{"mkdir and rmdir", 0, 2, func(q QuotaFS) error {
+			if err := q.Mkdir("/dir"); err != nil {
+				return err
+			}
+			return q.Rmdir("/dir")
+		}, nil, 0},
+		{"mkdir exceeds quota", 1, 1, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, ErrQuotaExceeded, 1},
+		{"unlimited", 5, 0, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, nil, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := NewFileUsageStore("")
+			q := newTestQuotaFS(t, store, test.files, test.maxFiles)
+			if err := test.operation(q); !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if usage, _, _ := store.Get("test"); usage.Files != test.wantFiles {
+				t.Errorf("files = %d, want %d", usage.Files, test.wantFiles)
+			}
+		})
+	}
+}
+
+func TestQuotaFSSoftLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		// The unix time the soft limit has been exceeded at, zero if it is not exceeded.
+		exceeded   int64
+		files      int64
+		operation  func(q QuotaFS) error
+		wantErr    error
+		wantWarned bool
+		wantGrace  bool
+		wantFiles  int64
+	}{
+		{"below", 0, 1, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, nil, false, false, 2},
+		{"below after grace period", time.Now().Add(-2 * time.Hour).Unix(), 1, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, nil, false, false, 2},
+		{"starts grace period", 0, 2, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, nil, true, true, 3},
+		{"during grace period", time.Now().Add(-time.Minute).Unix(), 3, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, nil, true, true, 4},
+		{"after grace period", time.Now().Add(-2 * time.Hour).Unix(), 3, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, ErrQuotaExceeded, false, true, 3},
+		{"hard limit", time.Now().Unix(), 4, func(q QuotaFS) error {
+			return q.Mkdir("/dir")
+		}, ErrQuotaExceeded, false, true, 4},
+		{"dropping to the soft limit ends grace period", time.Now().Unix(), 2, func(q QuotaFS) error {
+			if err := q.Mkdir("/dir"); err != nil {
+				return err
+			}
+			return q.Rmdir("/dir")
+		}, nil, true, false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := NewFileUsageStore("")
+			if err := store.Set(GraceKey("test"), Usage{Files: test.exceeded}); err != nil {
+				t.Fatal(err)
+			}
+			q := newTestQuotaFS(t, store, test.files, 4)
+			q.SoftMaxFiles = 2
+			q.GracePeriod = time.Hour
+			warned := false
+			q.OnSoftLimit = func(int64, time.Time) { warned = true }
+			if err := test.operation(q); !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if warned != test.wantWarned {
+				t.Errorf("warned = %v, want %v", warned, test.wantWarned)
+			}
+			if _, grace, _ := GraceEnds(store, "test", q.GracePeriod); grace != test.wantGrace {
+				t.Errorf("grace period = %v, want %v", grace, test.wantGrace)
+			}
+			if usage, _, _ := store.Get("test"); usage.Files != test.wantFiles {
+				t.Errorf("files = %d, want %d", usage.Files, test.wantFiles)
+			}
+		})
+	}
+}
+
+func TestQuotaFSWriteLeavesNoUncountedFile(t *testing.T) {
+	memory, _ := NewFileUsageStore("")
+	q := newTestQuotaFS(t, failingUsageStore{memory}, 0, 10)
+	if _, err := q.Write("/a"); err == nil {
+		t.Fatal("Write succeeded although the file could not be counted")
+	}
+	if _, err := q.Lstat("/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the uncounted file still exists: %v", err)
+	}
+}
+
+func TestQuotaFSMaxBytes(t *testing.T) {
+	store, _ := NewFileUsageStore("")
+	q := newTestQuotaFS(t, store, 0, 0)
+	q.MaxBytes = 10
+	bytesUsed := func() int64 {
+		usage, _, _ := store.Get(BytesKey("test"))
+		return usage.Files
+	}
+	writer, err := q.Write("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("12345678"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting does not grow the file.
+	if _, err := writer.WriteAt([]byte("abcd"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("xyz"), 8); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("WriteAt() beyond MaxBytes = %v, want ErrQuotaExceeded", err)
+	}
+	if err := writer.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if used := bytesUsed(); used != 8 {
+		t.Errorf("bytes = %d after writing, want 8", used)
+	}
+	if err := q.SetStat("/a", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: 11}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("SetStat() beyond MaxBytes = %v, want ErrQuotaExceeded", err)
+	}
+	if err := q.SetStat("/a", gosftp.FileAttrFlags{Size: true}, &gosftp.FileStat{Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if used := bytesUsed(); used != 5 {
+		t.Errorf("bytes = %d after truncating, want 5", used)
+	}
+	if err := q.Rm("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if used := bytesUsed(); used != 0 {
+		t.Errorf("bytes = %d after removing, want 0", used)
+	}
+}
+
+// slowFS takes a while to create files, so concurrent creations overlap.
+type slowFS struct {
+	SimplifiedFS
+}
+
+func (s slowFS) Write(path string) (io.WriterAt, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.SimplifiedFS.Write(path)
+}
+
+func TestQuotaFSConcurrentWriters(t *testing.T) {
+	store, _ := NewFileUsageStore("")
+	q := newTestQuotaFS(t, store, 0, 5)
+	q.Inner = slowFS{q.Inner}
+	q.MaxBytes = 100
+	// All files are opened before any is written and written before any is closed.
+	writers := make([]io.WriterAt, 20)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer, err := q.Write(fmt.Sprintf("/file%d", i))
+			if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+				t.Error(err)
+			}
+			writers[i] = writer
+		}()
+	}
+	wg.Wait()
+	var created, written atomic.Int64
+	for _, writer := range writers {
+		if writer == nil {
+			continue
+		}
+		created.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := int64(0); off < 100; off += 10 {
+				if _, err := writer.WriteAt(make([]byte, 10), off); err != nil {
+					return
+				}
+				written.Add(10)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, writer := range writers {
+		if writer != nil {
+			_ = writer.(io.Closer).Close()
+		}
+	}
+	if usage, _, _ := store.Get("test"); created.Load() != 5 || usage.Files != 5 {
+		t.Errorf("created %d files counted as %d, want 5", created.Load(), usage.Files)
+	}
+	if usage, _, _ := store.Get(BytesKey("test")); written.Load() != 100 || usage.Files != 100 {
+		t.Errorf("wrote %d bytes counted as %d, want 100", written.Load(), usage.Files)
+	}
+}
+
+func TestFileUsageStoreSavesOnClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "usage.json")
+	store, err := NewFileUsageStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", Usage{Files: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewFileUsageStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, ok, _ := loaded.Get("a"); !ok || usage.Files != 5 {
+		t.Errorf("loaded usage = %v, %v, want 5 files", usage, ok)
+	}
+}
@@ -0,0 +1,427 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// RemoteDialer opens a new sftp connection to a remote server. Closing the returned client has to close the
+// whole connection. The returned closer closes the underlying network connection right away, which aborts
+// operations on a server that does not answer anymore.
+type RemoteDialer func() (*gosftp.Client, io.Closer, error)
+
+// RemotePoolOptions configures the connections a RemoteFS opens to its server.
+type RemotePoolOptions struct {
+	// The maximal number of connections that are opened at the same time. Further connections are only opened
+	// while all others are in use. Zero or less means a single connection.
+	Size int
+	// How long an unused connection stays open.
+	IdleTimeout time.Duration
+	// Connections that have been unused for longer than this are checked before they are used again, so a
+	// connection the server or a firewall dropped silently is replaced instead of failing the operation. Zero
+	// disables the checks.
+	HealthCheckInterval time.Duration
+}
+
+// remoteConnection is a single sftp connection to a remote server. It is opened on demand and closed once
+// it has not been used for some time.
+type remoteConnection struct {
+	dial    RemoteDialer
+	options RemotePoolOptions
+	mutex   sync.Mutex
+	client  *gosftp.Client
+	// Closes the network connection of client.
+	network io.Closer
+	// The number of running operations and open files.
+	users int
+	idle  *time.Timer
+	// When the connection has been released the last time.
+	lastUsed time.Time
+}
+
+// load returns the number of users of the connection and whether it is open.
+func (r *remoteConnection) load() (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.users, r.client != nil
+}
+
+// acquire returns the client and opens the connection if necessary. Every call must be followed by release.
+func (r *remoteConnection) acquire() (*gosftp.Client, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.idle != nil {
+		r.idle.Stop()
+		r.idle = nil
+	}
+	if r.client != nil && r.users == 0 && r.options.HealthCheckInterval > 0 &&
+		time.Since(r.lastUsed) > r.options.HealthCheckInterval {
+		if _, err := r.client.Getwd(); err != nil {
+			_ = r.client.Close()
+			r.client = nil
+		}
+	}
+	if r.client == nil {
+		client, network, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.client, r.network = client, network
+		go func() {
+			// Forget the connection once it has been closed, so the next operation reconnects.
+			_ = client.Wait()
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.client == client {
+				r.client = nil
+			}
+		}()
+	}
+	r.users += 1
+	return r.client, nil
+}
+
+// release marks the end of using the client returned by acquire.
+func (r *remoteConnection) release() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.users -= 1
+	r.lastUsed = time.Now()
+	if r.users > 0 || r.client == nil {
+		return
+	}
+	client := r.client
+	r.idle = time.AfterFunc(r.options.IdleTimeout, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.users == 0 && r.client == client {
+			r.client = nil
+			_ = client.Close()
+		}
+	})
+}
+
+// abort closes the network connection of client, so all of its operations fail. The next operation reconnects.
+func (r *remoteConnection) abort(client *gosftp.Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.client == client {
+		r.client = nil
+		_ = r.network.Close()
+	}
+}
+
+// Runs f with the client of conn and aborts it by closing the connection if it takes longer than timeout (if
+// positive). This also fails the other operations of the connection, which would hang as well. Returns an error
+// wrapping context.DeadlineExceeded for aborted operations.
+func abortAfter(timeout time.Duration, conn *remoteConnection, client *gosftp.Client, f func() error) error {
+	if timeout <= 0 {
+		return f()
+	}
+	timer := time.AfterFunc(timeout, func() { conn.abort(client) })
+	err := f()
+	if !timer.Stop() && err != nil {
+		return fmt.Errorf("%w: connection closed: %v", context.DeadlineExceeded, err)
+	}
+	return err
+}
+
+// remotePool shares up to RemotePoolOptions.Size connections to a remote server.
+type remotePool struct {
+	conns []*remoteConnection
+}
+
+// newRemotePool creates a pool whose connections are opened on demand.
+func newRemotePool(dial RemoteDialer, options RemotePoolOptions) *remotePool {
+	pool := &remotePool{conns: make([]*remoteConnection, max(int64(options.Size), 1))}
+	for i := range pool.conns {
+		pool.conns[i] = &remoteConnection{dial: dial, options: options}
+	}
+	return pool
+}
+
+// acquire returns the client of the connection with the fewest users, preferring open connections, and the
+// connection it has to be released to. Concurrent calls may choose the same connection, which is then shared.
+func (p *remotePool) acquire() (*gosftp.Client, *remoteConnection, error) {
+	var best *remoteConnection
+	bestUsers, bestOpen := 0, false
+	for _, conn := range p.conns {
+		users, open := conn.load()
+		if best == nil || users < bestUsers || (users == bestUsers && open && !bestOpen) {
+			best, bestUsers, bestOpen = conn, users, open
+		}
+	}
+	client, err := best.acquire()
+	return client, best, err
+}
+
+// remoteFile is a file of the remote server that keeps the connection open until it is closed.
+type remoteFile struct {
+	*gosftp.File
+	conn   *remoteConnection
+	client *gosftp.Client
+	// Aborts reads and writes taking longer (see abortAfter).
+	timeout time.Duration
+	once    sync.Once
+}
+
+func (f *remoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	err = abortAfter(f.timeout, f.conn, f.client, func() error {
+		n, err = f.File.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *remoteFile) WriteAt(p []byte, off int64) (n int, err error) {
+	err = abortAfter(f.timeout, f.conn, f.client, func() error {
+		n, err = f.File.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *remoteFile) Close() error {
+	err := abortAfter(f.timeout, f.conn, f.client, f.File.Close)
+	f.once.Do(f.conn.release)
+	return err
+}
+
+// RemoteFS implements [sftp.SimplifiedFS] for a directory on a remote sftp server. All copies of a RemoteFS share
+// the same connections.
+type RemoteFS struct {
+	// The path of the directory on the remote server which contents become this filesystem.
+	Root string
+	// Whether to only support read operations.
+	Readonly bool
+	pool     *remotePool
+	// Aborts operations taking longer (see WithTimeout). Zero means no limit.
+	timeout time.Duration
+}
+
+// NewRemoteFS creates a RemoteFS for the directory root that connects with the dialer on first use.
+// The connections are pooled according to the options.
+func NewRemoteFS(dial RemoteDialer, root string, readonly bool, options RemotePoolOptions) RemoteFS {
+	return RemoteFS{
+		Root:     root,
+		Readonly: readonly,
+		pool:     newRemotePool(dial, options),
+	}
+}
+
+// WithRoot returns a RemoteFS for another directory of the same server that shares the connections of r.
+func (r RemoteFS) WithRoot(root string, readonly bool) RemoteFS {
+	r.Root, r.Readonly = root, readonly
+	return r
+}
+
+// WithTimeout returns a copy of r that closes the connection of operations taking longer than timeout (see
+// [sftp.CancelableFS]). A request that has already been sent may still be executed by the server, though.
+func (r RemoteFS) WithTimeout(timeout time.Duration) (SimplifiedFS, bool) {
+	r.timeout = timeout
+	return r, true
+}
+
+// Converts the given path into the path on the remote server.
+func (r RemoteFS) remotePath(p string) string {
+	return path.Join(r.Root, path.Join("/", p))
+}
+
+// Calls f with the client of a connection.
+func (r RemoteFS) with(f func(client *gosftp.Client) error) error {
+	client, conn, err := r.pool.acquire()
+	if err != nil {
+		return err
+	}
+	defer conn.release()
+	return abortAfter(r.timeout, conn, client, func() error { return f(client) })
+}
+
+// Calls f with the client of the connection if writing is allowed.
+func (r RemoteFS) withWrite(f func(client *gosftp.Client) error) error {
+	if r.Readonly {
+		return ErrForbidden
+	}
+	return r.with(f)
+}
+
+// Returns the stat of the given path, using "/" as name for the root.
+func (r RemoteFS) stat(p string, stat func(client *gosftp.Client, p string) (os.FileInfo, error)) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := r.with(func(client *gosftp.Client) error {
+		var err error
+		info, err = stat(client, r.remotePath(p))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == "/" {
+		return renamedFileInfo{info, "/"}, nil
+	}
+	return info, nil
+}
+
+func (r RemoteFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	var fileinfos []os.FileInfo
+	err := r.with(func(client *gosftp.Client) error {
+		var err error
+		// We cache all infos before returning the actual function.
+		fileinfos, err = client.ReadDir(r.remotePath(p))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (r RemoteFS) Lstat(p string) (os.FileInfo, error) {
+	return r.stat(p, (*gosftp.Client).Lstat)
+}
+
+func (r RemoteFS) Stat(p string) (os.FileInfo, error) {
+	return r.stat(p, (*gosftp.Client).Stat)
+}
+
+func (r RemoteFS) ReadLink(p string) (os.FileInfo, error) {
+	// Like DirFs, this returns the stat of the link destination.
+	return r.stat(p, (*gosftp.Client).Stat)
+}
+
+// Opens the file at the given path with the given flags.
+func (r RemoteFS) open(p string, flags int) (*remoteFile, error) {
+	client, conn, err := r.pool.acquire()
+	if err != nil {
+		return nil, err
+	}
+	var file *gosftp.File
+	err = abortAfter(r.timeout, conn, client, func() error {
+		file, err = client.OpenFile(r.remotePath(p), flags)
+		return err
+	})
+	if err != nil {
+		conn.release()
+		return nil, err
+	}
+	return &remoteFile{File: file, conn: conn, client: client, timeout: r.timeout}, nil
+}
+
+func (r RemoteFS) Read(p string) (io.ReaderAt, error) {
+	return r.open(p, os.O_RDONLY)
+}
+
+func (r RemoteFS) Write(p string) (io.WriterAt, error) {
+	if r.Readonly {
+		return nil, ErrForbidden
+	}
+	return r.open(p, os.O_WRONLY|os.O_CREATE)
+}
+
+func (r RemoteFS) SetStat(p string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		remotePath := r.remotePath(p)
+		// flags tells us which attributes actual has to be overwritten.
+		if flags.Size {
+			if err := client.Truncate(remotePath, int64(attributes.Size)); err != nil {
+				return err
+			}
+		}
+		if flags.Permissions {
+			if err := client.Chmod(remotePath, attributes.FileMode()); err != nil {
+				return err
+			}
+		}
+		if flags.UidGid {
+			if err := client.Chown(remotePath, int(attributes.UID), int(attributes.GID)); err != nil {
+				return err
+			}
+		}
+		if flags.Acmodtime {
+			atime := time.Unix(int64(attributes.Atime), 0)
+			mtime := time.Unix(int64(attributes.Mtime), 0)
+			if err := client.Chtimes(remotePath, atime, mtime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r RemoteFS) Rename(src, dst string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		return client.Rename(r.remotePath(src), r.remotePath(dst))
+	})
+}
+
+func (r RemoteFS) Rmdir(p string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		return client.RemoveDirectory(r.remotePath(p))
+	})
+}
+
+func (r RemoteFS) Rm(p string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		remotePath := r.remotePath(p)
+		stat, err := client.Stat(remotePath)
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() {
+			return fmt.Errorf("is a directory %s", p)
+		}
+		return client.Remove(remotePath)
+	})
+}
+
+func (r RemoteFS) Mkdir(p string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		return client.Mkdir(r.remotePath(p))
+	})
+}
+
+func (r RemoteFS) Link(src, dst string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		return client.Link(r.remotePath(src), r.remotePath(dst))
+	})
+}
+
+func (r RemoteFS) Symlink(src, dst string) error {
+	return r.withWrite(func(client *gosftp.Client) error {
+		return client.Symlink(r.remotePath(src), r.remotePath(dst))
+	})
+}
+
+// Space returns the space of the remote storage as reported by the remote server, if it supports statvfs.
+func (r RemoteFS) Space(p string) (Space, error) {
+	var stat *gosftp.StatVFS
+	err := r.with(func(client *gosftp.Client) error {
+		var err error
+		stat, err = client.StatVFS(r.remotePath(p))
+		return err
+	})
+	if err != nil {
+		return Space{}, err
+	}
+	space := Space{Total: stat.TotalSpace(), Available: stat.Frsize * stat.Bavail, Files: stat.Files, FreeFiles: stat.Favail}
+	if r.Readonly {
+		space.Available = 0
+		space.FreeFiles = 0
+	}
+	return space, nil
+}
@@ -0,0 +1,175 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+)
+
+// readerKey identifies an open file in OpenReaders. Like the blocks of a BlockCache, a file gets a new generation
+// whenever its size or its modification time changes, so readers of older versions are not shared anymore.
+type readerKey struct {
+	file    string
+	modTime int64
+	size    int64
+}
+
+// openReader is a reader of the inner filesystem shared by all handles of the same file.
+type openReader struct {
+	reader io.ReaderAt
+	// The number of handles that have not been closed yet.
+	handles int
+}
+
+// OpenReaders keeps the files opened for reading by a SharedFS open while they have handles, so further handles of
+// the same file (e.g. the parallel ranges of a download accelerator) reuse them instead of opening the file again.
+// It can be shared between several filesystems (and goroutines).
+type OpenReaders struct {
+	// Protects the fields below
+	mutex   sync.Mutex
+	readers map[readerKey]*openReader
+}
+
+// NewOpenReaders creates an OpenReaders without open files.
+func NewOpenReaders() *OpenReaders {
+	return &OpenReaders{readers: map[readerKey]*openReader{}}
+}
+
+// acquire returns a handle of the file with the given key, calling open if it is not open yet.
+func (o *OpenReaders) acquire(key readerKey, open func() (io.ReaderAt, error)) (io.ReaderAt, error) {
+	o.mutex.Lock()
+	if existing, ok := o.readers[key]; ok {
+		existing.handles++
+		o.mutex.Unlock()
+		return &sharedReader{ReaderAt: existing.reader, readers: o, key: key}, nil
+	}
+	o.mutex.Unlock()
+	reader, err := open()
+	if err != nil {
+		return nil, err
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if existing, ok := o.readers[key]; ok {
+		// Another handle has opened the file in the meantime.
+		_ = closeIfCloser(reader)
+		existing.handles++
+		return &sharedReader{ReaderAt: existing.reader, readers: o, key: key}, nil
+	}
+	o.readers[key] = &openReader{reader: reader, handles: 1}
+	return &sharedReader{ReaderAt: reader, readers: o, key: key}, nil
+}
+
+// release closes a handle of the file with the given key and closes the file with its last handle.
+func (o *OpenReaders) release(key readerKey) error {
+	o.mutex.Lock()
+	existing := o.readers[key]
+	existing.handles--
+	if existing.handles > 0 {
+		o.mutex.Unlock()
+		return nil
+	}
+	delete(o.readers, key)
+	o.mutex.Unlock()
+	return closeIfCloser(existing.reader)
+}
+
+// sharedReader is a handle of a file in OpenReaders.
+type sharedReader struct {
+	io.ReaderAt
+	readers *OpenReaders
+	key     readerKey
+	once    sync.Once
+}
+
+func (r *sharedReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.readers.release(r.key)
+	})
+	return err
+}
+
+// SharedFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and shares the open files of Read
+// through OpenReaders, so concurrent handles of the same regular file only open it once on the inner filesystem.
+// The inner readers must support concurrent calls of ReadAt. Everything else is passed to the inner filesystem as is.
+type SharedFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The open files, usually shared between several filesystems.
+	Readers *OpenReaders
+	// Identifies the files of Inner among all filesystems sharing the readers, e.g. the root directory.
+	// Filesystems serving the same files should use the same key, so they share their open files.
+	Key string
+}
+
+func (s SharedFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return s.Inner.List(path)
+}
+
+func (s SharedFS) Lstat(path string) (os.FileInfo, error) {
+	return s.Inner.Lstat(path)
+}
+
+func (s SharedFS) Stat(path string) (os.FileInfo, error) {
+	return s.Inner.Stat(path)
+}
+
+func (s SharedFS) ReadLink(path string) (os.FileInfo, error) {
+	return s.Inner.ReadLink(path)
+}
+
+func (s SharedFS) Read(path string) (io.ReaderAt, error) {
+	stat, err := s.Inner.Stat(path)
+	if err != nil || !stat.Mode().IsRegular() {
+		return s.Inner.Read(path)
+	}
+	key := readerKey{file: s.Key + "\x00" + path, modTime: stat.ModTime().UnixNano(), size: stat.Size()}
+	return s.Readers.acquire(key, func() (io.ReaderAt, error) {
+		return s.Inner.Read(path)
+	})
+}
+
+func (s SharedFS) Write(path string) (io.WriterAt, error) {
+	return s.Inner.Write(path)
+}
+
+func (s SharedFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return s.Inner.SetStat(path, flags, attributes)
+}
+
+func (s SharedFS) Rename(src, dst string) error {
+	return s.Inner.Rename(src, dst)
+}
+
+func (s SharedFS) Copy(src, dst string) error {
+	if copier, ok := s.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (s SharedFS) Rmdir(path string) error {
+	return s.Inner.Rmdir(path)
+}
+
+func (s SharedFS) Rm(path string) error {
+	return s.Inner.Rm(path)
+}
+
+func (s SharedFS) Mkdir(path string) error {
+	return s.Inner.Mkdir(path)
+}
+
+func (s SharedFS) Link(src, dst string) error {
+	return s.Inner.Link(src, dst)
+}
+
+func (s SharedFS) Symlink(src, dst string) error {
+	return s.Inner.Symlink(src, dst)
+}
+
+func (s SharedFS) Space(path string) (Space, error) {
+	return SpaceOf(s.Inner, path)
+}
@@ -0,0 +1,51 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedFS(t *testing.T) {
+	root := t.TempDir() + "/"
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	readers := NewOpenReaders()
+	fs := SharedFS{Inner: DirFs{Root: root}, Readers: readers, Key: root}
+	first, err := fs.Read("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fs.Read("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.(*sharedReader).ReaderAt != second.(*sharedReader).ReaderAt {
+		t.Errorf("the handles do not share the open file")
+	}
+	// A changed file is opened again.
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("second version"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	third, err := fs.Read("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 14)
+	if n, err := third.ReadAt(data, 0); n != len(data) || string(data) != "second version" {
+		t.Errorf("read %q, %v from the changed file", data[:n], err)
+	}
+	if len(readers.readers) != 2 {
+		t.Errorf("%d files are open, want 2", len(readers.readers))
+	}
+	for _, reader := range []io.ReaderAt{first, second, third, first} {
+		if err := reader.(io.Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(readers.readers) != 0 {
+		t.Errorf("%d files are still open after closing all handles", len(readers.readers))
+	}
+}
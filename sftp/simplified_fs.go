@@ -1,6 +1,7 @@
 package sftp
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Entscheider/sshtool/logger"
 	gosftp "github.com/pkg/sftp"
@@ -48,11 +49,20 @@ type SimplifiedFS interface {
 	Symlink(src, dst string) error
 }
 
+// FSFactory creates the filesystem to serve for a new connection.
+type FSFactory func(info logger.ConnectionInfo) (SimplifiedFS, error)
+
 // CreateSFTPHandler converts a SimplifiedFS into a [sftp.Handlers] object (to serve this filesystem through sftp)
 // while logging relevant access and information using the given logger parameters for the given connection info.
-func CreateSFTPHandler(fs SimplifiedFS, accessLogger logger.AccessLogger, info logger.ConnectionInfo, log logger.Logger) gosftp.Handlers {
+// The size of a directory requested by the client is computed from at most treeSizeLimit entries
+// (DefaultTreeSizeLimit if zero). If logPrevious is true, the attributes a file had before it is changed by
+// Setstat, Rename, Rmdir or Remove are logged along with the access (see logger.LogChange).
+func CreateSFTPHandler(fs SimplifiedFS, accessLogger logger.AccessLogger, info logger.ConnectionInfo, log logger.Logger, treeSizeLimit int64, logPrevious bool) gosftp.Handlers {
+	if treeSizeLimit == 0 {
+		treeSizeLimit = DefaultTreeSizeLimit
+	}
 	w := &wrapper{
-		fs, accessLogger, info, log,
+		fs, accessLogger, info, log, treeSizeLimit, logPrevious,
 	}
 	return gosftp.Handlers{
 		FileCmd:  w,
@@ -68,6 +78,10 @@ type wrapper struct {
 	accessLogger logger.AccessLogger
 	info         logger.ConnectionInfo
 	log          logger.Logger
+	// The maximal number of entries counted for the size of a directory.
+	treeSizeLimit int64
+	// Whether the attributes of files before a change are logged.
+	logPrevious bool
 }
 
 // Logs that access has happened with the given parameter.
@@ -78,6 +92,35 @@ func (w *wrapper) logAccess(path, kind, status string) {
 	w.accessLogger.NewAccess(w.info, path, kind, status)
 }
 
+// Logs that an access has changed the file at the given path, which had the given attributes before. Without
+// them, this is logged like any other access.
+func (w *wrapper) logChange(path, kind, status string, previous os.FileInfo) {
+	if previous == nil || w.accessLogger == nil {
+		w.logAccess(path, kind, status)
+		return
+	}
+	logger.LogChange(w.accessLogger, w.info, path, kind, status, logger.FileAttributes{
+		Size:    previous.Size(),
+		Mode:    previous.Mode(),
+		ModTime: previous.ModTime(),
+	})
+}
+
+// Returns the attributes of the file at the given path before the given method changes it, if they should be
+// logged. Nil otherwise or if the file cannot be found.
+func (w *wrapper) previousAttributes(path string, method string) os.FileInfo {
+	if !w.logPrevious {
+		return nil
+	}
+	switch method {
+	case "Setstat", "Rename", "Rmdir", "Remove":
+		if info, err := w.fs.Lstat(path); err == nil {
+			return info
+		}
+	}
+	return nil
+}
+
 // Logs that an error has happened in the given context with the given error message err.
 func (w *wrapper) logError(context string, err error) {
 	if w.log == nil {
@@ -93,17 +136,18 @@ func (w *wrapper) Filecmd(r *gosftp.Request) error {
 		w.logError("Error during path normalization in Filecmd", err)
 		return err
 	}
+	previous := w.previousAttributes(path, r.Method)
 	err = w.filecmdCall(path, r)
-	if err == ErrForbidden {
-		w.logAccess(path, r.Method, "forbidden")
+	if errors.Is(err, ErrForbidden) {
+		w.logChange(path, r.Method, "forbidden", previous)
 		return err
 	}
 	if err != nil {
-		w.logAccess(path, r.Method, "error")
+		w.logChange(path, r.Method, "error", previous)
 		w.logError("Error during the fileCmd call", err)
 		return err
 	}
-	w.logAccess(path, r.Method, "ok")
+	w.logChange(path, r.Method, "ok", previous)
 	return nil
 }
 
@@ -149,7 +193,7 @@ func (w *wrapper) Fileread(r *gosftp.Request) (io.ReaderAt, error) {
 		return nil, err
 	}
 	reader, err := w.fs.Read(path)
-	if err == ErrForbidden {
+	if errors.Is(err, ErrForbidden) {
 		w.logAccess(path, r.Method, "forbidden")
 	} else if err != nil {
 		w.logAccess(path, r.Method, "error")
@@ -168,7 +212,7 @@ func (w *wrapper) Filewrite(r *gosftp.Request) (io.WriterAt, error) {
 		return nil, err
 	}
 	writer, err := w.fs.Write(path)
-	if err == ErrForbidden {
+	if errors.Is(err, ErrForbidden) {
 		w.logAccess(path, r.Method, "forbidden")
 	} else if err != nil {
 		w.logAccess(path, r.Method, "error")
@@ -187,7 +231,7 @@ func (w *wrapper) Filelist(r *gosftp.Request) (gosftp.ListerAt, error) {
 		return nil, err
 	}
 	res, err := w.fileListCall(path, r)
-	if err == ErrForbidden {
+	if errors.Is(err, ErrForbidden) {
 		w.logAccess(path, r.Method, "forbidden")
 	} else if err != nil {
 		w.logAccess(path, r.Method, "error")
@@ -198,6 +242,15 @@ func (w *wrapper) Filelist(r *gosftp.Request) (gosftp.ListerAt, error) {
 	return res, err
 }
 
+// closeIfCloser closes the given value if it implements [io.Closer]. This is useful for wrappers around the
+// [io.ReaderAt] and [io.WriterAt] objects, which are closed by the sftp server if possible.
+func closeIfCloser(v interface{}) error {
+	if closer, ok := v.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 // Wraps a function into a ListerAt interface that lists using this function.
 type listenerF func([]os.FileInfo, int64) (int, error)
 
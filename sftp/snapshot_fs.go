@@ -0,0 +1,152 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SnapshotFS is a read-only [sftp.SimplifiedFS] whose root directory contains a directory per snapshot of a
+// filesystem, so users can browse old versions of their files and restore them on their own. The snapshots are
+// the directories within Dir, like ".zfs/snapshot" of a ZFS dataset or the directory btrfs snapshots are taken
+// into. Every snapshot is served under its name.
+type SnapshotFS struct {
+	// The directory containing the snapshots.
+	Dir string
+	// The directory within every snapshot that is served, e.g. the home directory of a user relative to the root
+	// of the snapshotted filesystem. Snapshots without it are left out.
+	Path string
+}
+
+// Splits the path into the name of the snapshot and the path within it. The name is empty for the root directory.
+func (s SnapshotFS) split(p string) (string, string) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", "/"
+	}
+	name, rest, _ := strings.Cut(p[1:], "/")
+	return name, "/" + rest
+}
+
+// Returns the filesystem of the snapshot with the given name.
+func (s SnapshotFS) snapshot(name string) DirFs {
+	return DirFs{Root: filepath.ToSlash(filepath.Join(s.Dir, name, s.Path)) + "/", Readonly: true}
+}
+
+// Returns the info of the root directory.
+func (s SnapshotFS) statOfRoot() (os.FileInfo, error) {
+	stat, err := os.Stat(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return deviceFileInfo{name: "/", mode: os.ModeDir | 0o555, modTime: stat.ModTime()}, nil
+}
+
+// Returns the info of the path with the given stat function of DirFs, naming the directory of a snapshot like it.
+func (s SnapshotFS) stat(p string, stat func(fs DirFs, p string) (os.FileInfo, error)) (os.FileInfo, error) {
+	name, rest := s.split(p)
+	if name == "" {
+		return s.statOfRoot()
+	}
+	info, err := stat(s.snapshot(name), rest)
+	if err != nil || rest != "/" {
+		return info, err
+	}
+	return renamedFileInfo{info, name}, nil
+}
+
+func (s SnapshotFS) List(p string) (func([]os.FileInfo, int64) (int, error), error) {
+	name, rest := s.split(p)
+	if name != "" {
+		return s.snapshot(name).List(rest)
+	}
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var fileinfos []os.FileInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := s.snapshot(entry.Name()).Stat("/")
+		if err != nil {
+			continue
+		}
+		fileinfos = append(fileinfos, renamedFileInfo{info, entry.Name()})
+	}
+	sort.Slice(fileinfos, func(i, j int) bool {
+		return fileinfos[i].Name() < fileinfos[j].Name()
+	})
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset >= int64(len(fileinfos)) {
+			return 0, io.EOF
+		}
+		n := copy(ls, fileinfos[offset:])
+		if n < len(ls) {
+			return n, io.EOF
+		}
+		return n, nil
+	}, nil
+}
+
+func (s SnapshotFS) Lstat(p string) (os.FileInfo, error) {
+	return s.stat(p, DirFs.Lstat)
+}
+
+func (s SnapshotFS) Stat(p string) (os.FileInfo, error) {
+	return s.stat(p, DirFs.Stat)
+}
+
+func (s SnapshotFS) ReadLink(p string) (os.FileInfo, error) {
+	return s.stat(p, DirFs.ReadLink)
+}
+
+func (s SnapshotFS) Read(p string) (io.ReaderAt, error) {
+	name, rest := s.split(p)
+	if name == "" {
+		return nil, os.ErrInvalid
+	}
+	return s.snapshot(name).Read(rest)
+}
+
+func (s SnapshotFS) Write(_ string) (io.WriterAt, error) {
+	return nil, ErrForbidden
+}
+
+func (s SnapshotFS) SetStat(_ string, _ gosftp.FileAttrFlags, _ *gosftp.FileStat) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Rename(_, _ string) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Rmdir(_ string) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Rm(_ string) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Mkdir(_ string) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Link(_, _ string) error {
+	return ErrForbidden
+}
+
+func (s SnapshotFS) Symlink(_, _ string) error {
+	return ErrForbidden
+}
+
+// Space reports the space of the disk with the snapshots, of which nothing is available.
+func (s SnapshotFS) Space(_ string) (Space, error) {
+	return DirFs{Root: filepath.ToSlash(filepath.Clean(s.Dir)) + "/", Readonly: true}.Space("/")
+}
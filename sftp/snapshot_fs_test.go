@@ -0,0 +1,58 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotFS(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"daily-2026-10-15/alice/notes.txt": "old",
+		"daily-2026-10-16/alice/notes.txt": "new",
+		"daily-2026-10-14/bob/notes.txt":   "other user",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := SnapshotFS{Dir: dir, Path: "alice"}
+	list, err := fs.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]os.FileInfo, 10)
+	n, _ := list(infos, 0)
+	if n != 2 || infos[0].Name() != "daily-2026-10-15" || infos[1].Name() != "daily-2026-10-16" {
+		t.Errorf("listed %d snapshots: %v", n, infos[:n])
+	}
+	if info, err := fs.Stat("/daily-2026-10-16"); err != nil || info.Name() != "daily-2026-10-16" || !info.IsDir() {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+	reader, err := fs.Read("/daily-2026-10-15/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.(io.Closer).Close()
+	data := make([]byte, 3)
+	if _, err := reader.ReadAt(data, 0); err != nil || string(data) != "old" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	if _, err := fs.Read("/daily-2026-10-14/notes.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("read a file of another user: %v", err)
+	}
+	if _, err := fs.Read("/daily-2026-10-16/../../daily-2026-10-14/bob/notes.txt"); err == nil {
+		t.Errorf("read a file outside of the served directory")
+	}
+	if err := fs.Mkdir("/daily-2026-10-16/new"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Mkdir() = %v, want %v", err, ErrForbidden)
+	}
+}
@@ -0,0 +1,89 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+)
+
+// Space is the size and the free space of the storage of a filesystem.
+type Space struct {
+	// The size of the storage and the number of bytes that can still be written.
+	Total     uint64
+	Available uint64
+	// The maximal number of files and the number of files that can still be created. Zero if unknown.
+	Files     uint64
+	FreeFiles uint64
+}
+
+// SpaceReporter can be implemented by a [sftp.SimplifiedFS] that knows the space of its storage.
+type SpaceReporter interface {
+	// Space returns the Space of the storage containing the given path.
+	Space(path string) (Space, error)
+}
+
+// SpaceOf returns the Space of the storage containing the path, or ErrNotSupported if the filesystem is no
+// SpaceReporter.
+func SpaceOf(fs SimplifiedFS, path string) (Space, error) {
+	if reporter, ok := fs.(SpaceReporter); ok {
+		return reporter.Space(path)
+	}
+	return Space{}, ErrNotSupported
+}
+
+// Handles the space-available request, which returns the size and the free space of the storage containing a path.
+// Returns the path and the reply.
+func (w *wrapper) spaceAvailable(r *extendedRequest) (string, []byte, error) {
+	p, err := r.string()
+	if err != nil {
+		return "", nil, err
+	}
+	if p, err = normalizeClientPath(p); err != nil {
+		return p, nil, err
+	}
+	space, err := SpaceOf(w.fs, p)
+	if err != nil {
+		return p, nil, err
+	}
+	// The user gets the same space as the device. The size of an allocation unit is unknown (zero).
+	reply := binary.BigEndian.AppendUint64(nil, space.Total)
+	reply = binary.BigEndian.AppendUint64(reply, space.Available)
+	reply = binary.BigEndian.AppendUint64(reply, space.Total)
+	reply = binary.BigEndian.AppendUint64(reply, space.Available)
+	return p, binary.BigEndian.AppendUint32(reply, 0), nil
+}
+
+// StatVFS answers the statvfs@openssh.com request, e.g. for the df command of the OpenSSH client.
+func (w *wrapper) StatVFS(r *gosftp.Request) (*gosftp.StatVFS, error) {
+	path, err := normalizePath(r.Filepath)
+	if err == nil {
+		var space Space
+		space, err = SpaceOf(w.fs, path)
+		if err == nil {
+			w.logAccess(path, "Space", "ok")
+			// The blocks are single bytes, so no space is lost to rounding.
+			return &gosftp.StatVFS{
+				Bsize:   1,
+				Frsize:  1,
+				Blocks:  space.Total,
+				Bfree:   space.Available,
+				Bavail:  space.Available,
+				Files:   space.Files,
+				Ffree:   space.FreeFiles,
+				Favail:  space.FreeFiles,
+				Namemax: 255,
+			}, nil
+		}
+	}
+	if errors.Is(err, ErrForbidden) {
+		w.logAccess(path, "Space", "forbidden")
+		return nil, err
+	}
+	w.logAccess(path, "Space", "error")
+	w.logError(fmt.Sprintf("Error during StatVFS of %s", path), err)
+	if errors.Is(err, ErrNotSupported) {
+		return nil, gosftp.ErrSSHFxOpUnsupported
+	}
+	return nil, err
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package sftp
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users and the total size
+// of the operating system filesystem containing the given path.
+func freeSpace(path string) (free uint64, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
+
+// diskSpace returns the Space of the operating system filesystem containing the given path, as far as it is
+// available to unprivileged users.
+func diskSpace(path string) (Space, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return Space{}, err
+	}
+	return Space{
+		Total:     uint64(stat.Blocks) * uint64(stat.Bsize),
+		Available: uint64(stat.Bavail) * uint64(stat.Bsize),
+		Files:     uint64(stat.Files),
+		FreeFiles: uint64(stat.Ffree),
+	}, nil
+}
@@ -0,0 +1,21 @@
+package sftp
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the number of bytes available to the current user and the total size
+// of the disk containing the given path.
+func freeSpace(path string) (free uint64, total uint64, err error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(pathPtr, &free, &total, &totalFree)
+	return free, total, err
+}
+
+// diskSpace returns the Space of the disk containing the given path. Windows does not limit the number of files.
+func diskSpace(path string) (Space, error) {
+	free, total, err := freeSpace(path)
+	return Space{Total: total, Available: free}, err
+}
@@ -0,0 +1,196 @@
+package sftp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WriteTarGz writes everything below the given path of the filesystem as gzip compressed tar archive to w. The
+// entries are named relative to the parent of the path, so the archive unpacks into a directory of the same name.
+// Symbolic links as well as files and directories that cannot be read are left out. Files that shrink while they
+// are archived are padded with zeros, like GNU tar does.
+func WriteTarGz(fs SimplifiedFS, root string, w io.Writer) error {
+	stat, err := fs.Lstat(root)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	// The names of the entries are relative to this directory.
+	parent := path.Dir(root)
+	if root == "/" {
+		parent = "/"
+	}
+	if err := writeTarEntry(fs, tw, root, parent, stat); err != nil {
+		return err
+	}
+	pending := []string{}
+	if stat.IsDir() {
+		pending = append(pending, root)
+	}
+	buffer := make([]os.FileInfo, 128)
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		lister, err := fs.List(dir)
+		if err != nil {
+			continue
+		}
+		offset := int64(0)
+		for {
+			n, err := lister(buffer, offset)
+			for _, info := range buffer[:n] {
+				child := path.Join(dir, info.Name())
+				if err := writeTarEntry(fs, tw, child, parent, info); err != nil {
+					return err
+				}
+				if info.IsDir() {
+					pending = append(pending, child)
+				}
+			}
+			offset += int64(n)
+			if err != nil || n == 0 {
+				break
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Writes the entry of a file or directory at p into the archive. Only errors of writing the archive are returned.
+func writeTarEntry(fs SimplifiedFS, tw *tar.Writer, p string, parent string, info os.FileInfo) error {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(p, parent), "/")
+	if name == "" {
+		// The root of the filesystem itself
+		name = "."
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil
+	}
+	header.Name = name
+	// The owners on the server mean nothing to the client.
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if info.IsDir() {
+		header.Name += "/"
+		return tw.WriteHeader(header)
+	}
+	reader, err := fs.Read(p)
+	if err != nil {
+		return nil
+	}
+	defer closeIfCloser(reader)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// Errors of writing the archive are kept by tw and returned when the rest is padded.
+	n, _ := io.Copy(tw, io.NewSectionReader(reader, 0, info.Size()))
+	if n < info.Size() {
+		// The file has shrunk or cannot be read anymore.
+		_, err = io.CopyN(tw, zeroReader{}, info.Size()-n)
+		return err
+	}
+	return nil
+}
+
+// zeroReader reads endless zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// The number of bytes a TarStream keeps after they have been read, so requests of a client reading several
+// parts at the same time can be answered in any order.
+const tarStreamWindow = 4 << 20
+
+// TarStream is an [io.ReaderAt] with the content of WriteTarGz, which is generated while it is read. It can only be
+// read from the start to the end, apart from the last bytes read before. It must be closed.
+type TarStream struct {
+	reader *io.PipeReader
+	// Protects the fields below
+	mutex sync.Mutex
+	// The bytes starting at offset that can still be read.
+	buffer []byte
+	offset int64
+	// The error of reading further bytes, io.EOF at the end.
+	err error
+}
+
+// NewTarStream starts to generate the archive of the given path of the filesystem.
+func NewTarStream(fs SimplifiedFS, root string) (*TarStream, error) {
+	if _, err := fs.Lstat(root); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(WriteTarGz(fs, root, writer))
+	}()
+	return &TarStream{reader: reader}, nil
+}
+
+func (t *TarStream) ReadAt(p []byte, off int64) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if off < t.offset {
+		return 0, fmt.Errorf("the archive can only be read from the start to the end")
+	}
+	end := off + int64(len(p))
+	// Generate the archive up to the requested end.
+	for t.err == nil && t.offset+int64(len(t.buffer)) < end {
+		chunk := make([]byte, end-t.offset-int64(len(t.buffer)))
+		n, err := io.ReadFull(t.reader, chunk)
+		t.buffer = append(t.buffer, chunk[:n]...)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		t.err = err
+	}
+	// Drop what is not needed anymore.
+	if drop := int64(len(t.buffer)) - tarStreamWindow; drop > 0 && t.offset+drop <= off {
+		t.buffer = t.buffer[drop:]
+		t.offset += drop
+	}
+	if off >= t.offset+int64(len(t.buffer)) {
+		return 0, t.err
+	}
+	n := copy(p, t.buffer[off-t.offset:])
+	if n < len(p) {
+		return n, t.err
+	}
+	return n, nil
+}
+
+func (t *TarStream) Close() error {
+	return t.reader.CloseWithError(os.ErrClosed)
+}
+
+// Handles the tar@sshtool request, which contains the path of the directory (or file) to archive.
+func (w *wrapper) tar(r *extendedRequest) (string, io.ReaderAt, error) {
+	p, err := r.string()
+	if err != nil {
+		return "", nil, err
+	}
+	if p, err = normalizeClientPath(p); err != nil {
+		return p, nil, err
+	}
+	stream, err := NewTarStream(w.fs, p)
+	if err != nil {
+		return p, nil, err
+	}
+	return p, stream, nil
+}
@@ -0,0 +1,204 @@
+package sftp
+
+import (
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the throughput to a number of bytes per second. It can be shared between
+// several readers and writers (also from different goroutines), which then share the throughput.
+type TokenBucket struct {
+	// Protects the fields below
+	mutex sync.Mutex
+	// The number of tokens (=bytes) added per second.
+	rate float64
+	// The maximal number of tokens the bucket can hold.
+	burst float64
+	// The number of currently available tokens. Can be negative if tokens were taken in advance.
+	tokens float64
+	// The time the tokens were updated the last time.
+	last time.Time
+}
+
+// NewTokenBucket creates a TokenBucket that allows bytesPerSecond bytes per second.
+// It allows a burst of one second worth of bytes.
+func NewTokenBucket(bytesPerSecond uint64) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate (and the burst) of the bucket, which affects all its users right away. Zero means no
+// limit.
+func (b *TokenBucket) SetRate(bytesPerSecond uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// The tokens gathered so far are kept.
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	b.rate = float64(bytesPerSecond)
+	b.burst = float64(bytesPerSecond)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Take removes n tokens from the bucket and blocks until these tokens would have been available.
+func (b *TokenBucket) Take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	rate := b.rate
+	if rate == 0 {
+		b.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	// We take the tokens in advance, so other goroutines wait for them, too.
+	b.tokens -= float64(n)
+	missing := -b.tokens
+	b.mutex.Unlock()
+	if missing > 0 {
+		time.Sleep(time.Duration(missing / rate * float64(time.Second)))
+	}
+}
+
+// ThrottledFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and limits the throughput
+// of all reads and writes using the given TokenBucket objects.
+type ThrottledFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// All buckets that must allow a read or write. Usually they are shared between several filesystems
+	// (e.g. one for all users and one for every user).
+	Buckets []*TokenBucket
+	// Further buckets that must only allow reads (e.g. to keep downloads from saturating the uplink).
+	ReadBuckets []*TokenBucket
+	// Further buckets that must only allow writes.
+	WriteBuckets []*TokenBucket
+}
+
+// Takes n tokens from all Buckets and the given further ones.
+func (t ThrottledFS) take(n int, further []*TokenBucket) {
+	for _, bucket := range t.Buckets {
+		bucket.Take(n)
+	}
+	for _, bucket := range further {
+		bucket.Take(n)
+	}
+}
+
+// throttledReader is an [io.ReaderAt] that limits the throughput of the inner one.
+type throttledReader struct {
+	io.ReaderAt
+	fs ThrottledFS
+}
+
+func (r throttledReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.fs.take(n, r.fs.ReadBuckets)
+	return n, err
+}
+
+func (r throttledReader) Close() error {
+	return closeIfCloser(r.ReaderAt)
+}
+
+// throttledWriter is an [io.WriterAt] that limits the throughput of the inner one.
+type throttledWriter struct {
+	io.WriterAt
+	fs ThrottledFS
+}
+
+func (w throttledWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.fs.take(len(p), w.fs.WriteBuckets)
+	return w.WriterAt.WriteAt(p, off)
+}
+
+func (w throttledWriter) Close() error {
+	return closeIfCloser(w.WriterAt)
+}
+
+func (t ThrottledFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	return t.Inner.List(path)
+}
+
+func (t ThrottledFS) Lstat(path string) (os.FileInfo, error) {
+	return t.Inner.Lstat(path)
+}
+
+func (t ThrottledFS) Stat(path string) (os.FileInfo, error) {
+	return t.Inner.Stat(path)
+}
+
+func (t ThrottledFS) ReadLink(path string) (os.FileInfo, error) {
+	return t.Inner.ReadLink(path)
+}
+
+func (t ThrottledFS) Read(path string) (io.ReaderAt, error) {
+	reader, err := t.Inner.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return throttledReader{reader, t}, nil
+}
+
+func (t ThrottledFS) Write(path string) (io.WriterAt, error) {
+	writer, err := t.Inner.Write(path)
+	if err != nil {
+		return nil, err
+	}
+	return throttledWriter{writer, t}, nil
+}
+
+func (t ThrottledFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return t.Inner.SetStat(path, flags, attributes)
+}
+
+func (t ThrottledFS) Rename(src, dst string) error {
+	return t.Inner.Rename(src, dst)
+}
+
+// Copy is not throttled if the inner filesystem copies the file itself, as no data is transferred to the client.
+func (t ThrottledFS) Copy(src, dst string) error {
+	if copier, ok := t.Inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return ErrNotSupported
+}
+
+func (t ThrottledFS) Rmdir(path string) error {
+	return t.Inner.Rmdir(path)
+}
+
+func (t ThrottledFS) Rm(path string) error {
+	return t.Inner.Rm(path)
+}
+
+func (t ThrottledFS) Mkdir(path string) error {
+	return t.Inner.Mkdir(path)
+}
+
+func (t ThrottledFS) Link(src, dst string) error {
+	return t.Inner.Link(src, dst)
+}
+
+func (t ThrottledFS) Symlink(src, dst string) error {
+	return t.Inner.Symlink(src, dst)
+}
+
+func (t ThrottledFS) Space(path string) (Space, error) {
+	return SpaceOf(t.Inner, path)
+}
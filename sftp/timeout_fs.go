@@ -0,0 +1,348 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout is returned (possibly wrapped) by a TimeoutFS for operations that have taken too long.
+var ErrTimeout = fmt.Errorf("operation timed out")
+
+// CancelableFS is implemented by filesystems whose backend can abort operations, like remote servers and cloud
+// storages.
+type CancelableFS interface {
+	SimplifiedFS
+	// WithTimeout returns a copy of the filesystem that aborts every operation on the backend (including the reads
+	// and writes of the files it opens) taking longer than timeout. Aborted operations fail with an error wrapping
+	// context.DeadlineExceeded. Returns false if the backend of this filesystem cannot abort its operations.
+	WithTimeout(timeout time.Duration) (SimplifiedFS, bool)
+}
+
+// HangingOperations limits the operations that have timed out in a TimeoutFS but are still running, as their
+// backend cannot abort them. Must be created with NewHangingOperations.
+type HangingOperations struct {
+	max   int64
+	count atomic.Int64
+}
+
+// NewHangingOperations creates a HangingOperations allowing at most max operations to hang.
+func NewHangingOperations(max int64) *HangingOperations {
+	return &HangingOperations{max: max}
+}
+
+// Count returns the number of operations that have timed out and are still running. Zero for nil.
+func (h *HangingOperations) Count() int64 {
+	if h == nil {
+		return 0
+	}
+	return h.count.Load()
+}
+
+// full tells whether no further operation may hang.
+func (h *HangingOperations) full() bool {
+	return h != nil && h.count.Load() >= h.max
+}
+
+func (h *HangingOperations) add(delta int64) {
+	if h != nil {
+		h.count.Add(delta)
+	}
+}
+
+// TimeoutFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and fails every operation that takes
+// longer than Timeout with ErrTimeout, so a hanging backend does not block the session forever. If Inner is a
+// CancelableFS, the operation is aborted on its backend. Otherwise, it keeps running in the background until the
+// backend returns, and is counted by Hanging meanwhile.
+type TimeoutFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner   SimplifiedFS
+	Timeout time.Duration
+	// Limits the operations that are still running after their timeout, which should be shared by all TimeoutFS
+	// of the same backend. Once there are too many, further operations fail right away. Nil means no limit.
+	Hanging *HangingOperations
+}
+
+// Converts errors of an aborted operation into ErrTimeout.
+func timeoutError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+// Returns the copy of Inner that aborts its operations after the Timeout, if it can.
+func (t TimeoutFS) cancelable() (SimplifiedFS, bool) {
+	if cancelable, ok := t.Inner.(CancelableFS); ok {
+		return cancelable.WithTimeout(t.Timeout)
+	}
+	return nil, false
+}
+
+// Runs f with Inner, which aborts it after the Timeout if possible. Otherwise, waits at most for the Timeout.
+func (t TimeoutFS) run(f func(inner SimplifiedFS) error) error {
+	if inner, ok := t.cancelable(); ok {
+		return timeoutError(f(inner))
+	}
+	return t.wait(func() error { return f(t.Inner) })
+}
+
+// Runs f in the background and waits at most for the Timeout. f is not started if too many operations hang.
+func (t TimeoutFS) wait(f func() error) error {
+	if t.Hanging.full() {
+		return fmt.Errorf("%w: too many operations are still hanging", ErrTimeout)
+	}
+	done := make(chan error, 1)
+	// Set by whoever is first: the operation finishing or the timer.
+	var decided atomic.Bool
+	go func() {
+		err := f()
+		if !decided.CompareAndSwap(false, true) {
+			// Timed out before, so it is not hanging anymore.
+			t.Hanging.add(-1)
+		}
+		done <- err
+	}()
+	timer := time.NewTimer(t.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		if decided.CompareAndSwap(false, true) {
+			t.Hanging.add(1)
+			return ErrTimeout
+		}
+		// Finished at the same time.
+		return <-done
+	}
+}
+
+// timeoutReader is an [io.ReaderAt] that fails reads taking too long.
+type timeoutReader struct {
+	io.ReaderAt
+	fs TimeoutFS
+	// Whether the reader aborts its reads itself.
+	cancelable bool
+}
+
+func (r timeoutReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.cancelable {
+		n, err := r.ReaderAt.ReadAt(p, off)
+		return n, timeoutError(err)
+	}
+	// The read may still write into its buffer after a timeout, so it gets its own one.
+	buffer := make([]byte, len(p))
+	var n int
+	var readErr error
+	err := r.fs.wait(func() error {
+		n, readErr = r.ReaderAt.ReadAt(buffer, off)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	copy(p, buffer[:n])
+	return n, readErr
+}
+
+func (r timeoutReader) Close() error {
+	if r.cancelable {
+		return timeoutError(closeIfCloser(r.ReaderAt))
+	}
+	return r.fs.wait(func() error {
+		return closeIfCloser(r.ReaderAt)
+	})
+}
+
+// timeoutWriter is an [io.WriterAt] that fails writes taking too long.
+type timeoutWriter struct {
+	io.WriterAt
+	fs TimeoutFS
+	// Whether the writer aborts its writes itself.
+	cancelable bool
+}
+
+func (w timeoutWriter) WriteAt(p []byte, off int64) (int, error) {
+	if w.cancelable {
+		n, err := w.WriterAt.WriteAt(p, off)
+		return n, timeoutError(err)
+	}
+	// The caller may reuse p after a timeout while the write is still running.
+	buffer := append([]byte(nil), p...)
+	var n int
+	var writeErr error
+	err := w.fs.wait(func() error {
+		n, writeErr = w.WriterAt.WriteAt(buffer, off)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, writeErr
+}
+
+func (w timeoutWriter) Close() error {
+	if w.cancelable {
+		return timeoutError(closeIfCloser(w.WriterAt))
+	}
+	return w.fs.wait(func() error {
+		return closeIfCloser(w.WriterAt)
+	})
+}
+
+func (t TimeoutFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	if inner, ok := t.cancelable(); ok {
+		lister, err := inner.List(path)
+		if err != nil {
+			return nil, timeoutError(err)
+		}
+		return func(ls []os.FileInfo, offset int64) (int, error) {
+			n, err := lister(ls, offset)
+			return n, timeoutError(err)
+		}, nil
+	}
+	var lister func([]os.FileInfo, int64) (int, error)
+	err := t.wait(func() error {
+		var err error
+		lister, err = t.Inner.List(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		buffer := make([]os.FileInfo, len(ls))
+		var n int
+		var listErr error
+		if err := t.wait(func() error {
+			n, listErr = lister(buffer, offset)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		copy(ls, buffer[:n])
+		return n, listErr
+	}, nil
+}
+
+// Runs a function returning a FileInfo with the Timeout.
+func (t TimeoutFS) stat(f func(inner SimplifiedFS) (os.FileInfo, error)) (os.FileInfo, error) {
+	result := make(chan os.FileInfo, 1)
+	err := t.run(func(inner SimplifiedFS) error {
+		info, err := f(inner)
+		result <- info
+		return err
+	})
+	if err != nil {
+		// After a timeout, the info may still be sent.
+		return nil, err
+	}
+	return <-result, nil
+}
+
+func (t TimeoutFS) Lstat(path string) (os.FileInfo, error) {
+	return t.stat(func(inner SimplifiedFS) (os.FileInfo, error) { return inner.Lstat(path) })
+}
+
+func (t TimeoutFS) Stat(path string) (os.FileInfo, error) {
+	return t.stat(func(inner SimplifiedFS) (os.FileInfo, error) { return inner.Stat(path) })
+}
+
+func (t TimeoutFS) ReadLink(path string) (os.FileInfo, error) {
+	return t.stat(func(inner SimplifiedFS) (os.FileInfo, error) { return inner.ReadLink(path) })
+}
+
+func (t TimeoutFS) Read(path string) (io.ReaderAt, error) {
+	if inner, ok := t.cancelable(); ok {
+		reader, err := inner.Read(path)
+		if err != nil {
+			return nil, timeoutError(err)
+		}
+		return timeoutReader{ReaderAt: reader, fs: t, cancelable: true}, nil
+	}
+	opened := make(chan io.ReaderAt, 1)
+	err := t.wait(func() error {
+		reader, err := t.Inner.Read(path)
+		opened <- reader
+		return err
+	})
+	if errors.Is(err, ErrTimeout) {
+		// Files opened after the timeout are closed again.
+		go func() { _ = closeIfCloser(<-opened) }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return timeoutReader{ReaderAt: <-opened, fs: t}, nil
+}
+
+func (t TimeoutFS) Write(path string) (io.WriterAt, error) {
+	if inner, ok := t.cancelable(); ok {
+		writer, err := inner.Write(path)
+		if err != nil {
+			return nil, timeoutError(err)
+		}
+		return timeoutWriter{WriterAt: writer, fs: t, cancelable: true}, nil
+	}
+	opened := make(chan io.WriterAt, 1)
+	err := t.wait(func() error {
+		writer, err := t.Inner.Write(path)
+		opened <- writer
+		return err
+	})
+	if errors.Is(err, ErrTimeout) {
+		// Files opened after the timeout are closed again.
+		go func() { _ = closeIfCloser(<-opened) }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return timeoutWriter{WriterAt: <-opened, fs: t}, nil
+}
+
+func (t TimeoutFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.SetStat(path, flags, attributes) })
+}
+
+func (t TimeoutFS) Rename(src, dst string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Rename(src, dst) })
+}
+
+func (t TimeoutFS) Rmdir(path string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Rmdir(path) })
+}
+
+func (t TimeoutFS) Rm(path string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Rm(path) })
+}
+
+func (t TimeoutFS) Mkdir(path string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Mkdir(path) })
+}
+
+func (t TimeoutFS) Link(src, dst string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Link(src, dst) })
+}
+
+func (t TimeoutFS) Symlink(src, dst string) error {
+	return t.run(func(inner SimplifiedFS) error { return inner.Symlink(src, dst) })
+}
+
+func (t TimeoutFS) Space(path string) (Space, error) {
+	result := make(chan Space, 1)
+	err := t.run(func(inner SimplifiedFS) error {
+		space, err := SpaceOf(inner, path)
+		result <- space
+		return err
+	})
+	if err != nil {
+		return Space{}, err
+	}
+	return <-result, nil
+}
@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+// blockingStore is a ContextObjectStore whose requests block until they are canceled.
+type blockingStore struct {
+	ObjectStore
+	ctx context.Context
+	// The number of canceled requests.
+	canceled *atomic.Int64
+}
+
+func (b blockingStore) WithContext(ctx context.Context) ObjectStore {
+	b.ctx = ctx
+	return b
+}
+
+func (b blockingStore) Stat(string) (ObjectInfo, error) {
+	<-b.ctx.Done()
+	b.canceled.Add(1)
+	return ObjectInfo{}, b.ctx.Err()
+}
+
+// blockingFS is a filesystem whose Stat blocks until release is closed.
+type blockingFS struct {
+	SimplifiedFS
+	release chan struct{}
+	calls   *atomic.Int64
+}
+
+func (b blockingFS) Stat(string) (os.FileInfo, error) {
+	b.calls.Add(1)
+	<-b.release
+	return nil, os.ErrNotExist
+}
+
+// silentServer answers the initialization of an sftp client but no request afterwards. Ends once the client has
+// closed its side.
+func silentServer(requests io.Reader, responses io.WriteCloser) {
+	defer responses.Close()
+	var length uint32
+	if binary.Read(requests, binary.BigEndian, &length) != nil {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, requests, int64(length)); err != nil {
+		return
+	}
+	// SSH_FXP_VERSION with version 3
+	_, _ = responses.Write([]byte{0, 0, 0, 5, 2, 0, 0, 0, 3})
+	_, _ = io.Copy(io.Discard, requests)
+}
+
+// pipes closes the pipes of an sftp client like its network connection.
+type pipes struct {
+	responses *io.PipeReader
+	requests  *io.PipeWriter
+}
+
+func (p pipes) Close() error {
+	_ = p.requests.Close()
+	return p.responses.Close()
+}
+
+// Waits until the number of goroutines has dropped to the given one.
+func waitForGoroutines(t *testing.T, want int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are left, want %d", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTimeoutFSCancelsObjectStore(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	var canceled atomic.Int64
+	fs := TimeoutFS{Inner: ObjectFS{Store: blockingStore{canceled: &canceled}}, Timeout: 20 * time.Millisecond}
+	if _, err := fs.Stat("/file"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Stat() = %v, want %v", err, ErrTimeout)
+	}
+	if canceled.Load() == 0 {
+		t.Error("the request to the store has not been canceled")
+	}
+	waitForGoroutines(t, goroutines)
+}
+
+func TestTimeoutFSClosesRemoteConnection(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	var dials atomic.Int64
+	dial := func() (*gosftp.Client, io.Closer, error) {
+		dials.Add(1)
+		responses, serverResponses := io.Pipe()
+		serverRequests, requests := io.Pipe()
+		go silentServer(serverRequests, serverResponses)
+		client, err := gosftp.NewClientPipe(responses, requests)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, pipes{responses, requests}, nil
+	}
+	remote := NewRemoteFS(dial, "/", false, RemotePoolOptions{IdleTimeout: time.Millisecond})
+	fs := TimeoutFS{Inner: remote, Timeout: 20 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if _, err := fs.Stat("/file"); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Stat() = %v, want %v", err, ErrTimeout)
+		}
+	}
+	if dials.Load() != 2 {
+		t.Errorf("connected %d times, want a new connection after the timeout", dials.Load())
+	}
+	waitForGoroutines(t, goroutines)
+}
+
+func TestTimeoutFSLimitsHangingOperations(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	var calls atomic.Int64
+	inner := blockingFS{release: make(chan struct{}), calls: &calls}
+	fs := TimeoutFS{Inner: inner, Timeout: 20 * time.Millisecond, Hanging: NewHangingOperations(1)}
+	for i := 0; i < 2; i++ {
+		if _, err := fs.Stat("/file"); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Stat() = %v, want %v", err, ErrTimeout)
+		}
+	}
+	if calls.Load() != 1 || fs.Hanging.Count() != 1 {
+		t.Errorf("started %d operations with %d hanging, want only one", calls.Load(), fs.Hanging.Count())
+	}
+	close(inner.release)
+	waitForGoroutines(t, goroutines)
+	if fs.Hanging.Count() != 0 {
+		t.Errorf("%d operations are hanging after they have finished", fs.Hanging.Count())
+	}
+	if _, err := fs.Stat("/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat() = %v, want %v", err, os.ErrNotExist)
+	}
+}
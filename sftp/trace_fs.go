@@ -0,0 +1,349 @@
+package sftp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceEntry is a single operation recorded by a [sftp.TraceFS]. A trace is a sequence of these entries written
+// as json lines.
+type TraceEntry struct {
+	// The time the operation started.
+	Time time.Time
+	// How long the operation took.
+	Duration time.Duration
+	// The name of the method of the [sftp.SimplifiedFS] (like "Write"), or "ReadAt", "WriteAt" and "Close" for the
+	// operations on the files opened by Read and Write.
+	Op   string
+	Path string `json:",omitempty"`
+	// The second path of Rename, Copy, Link and Symlink.
+	Target string `json:",omitempty"`
+	// The number of the file opened by Read or Write, which ReadAt, WriteAt and Close refer to.
+	Handle uint64 `json:",omitempty"`
+	// The offset and the number of bytes of ReadAt and WriteAt.
+	Offset int64 `json:",omitempty"`
+	Size   int   `json:",omitempty"`
+	// The number of bytes actually read or written.
+	N int `json:",omitempty"`
+	// The flags and attributes of SetStat.
+	Flags      *gosftp.FileAttrFlags `json:",omitempty"`
+	Attributes *gosftp.FileStat      `json:",omitempty"`
+	// The error the operation failed with. Empty if it succeeded.
+	Error string `json:",omitempty"`
+}
+
+// Trace writes the entries of one or more [sftp.TraceFS] to a writer. It can be used from several goroutines.
+type Trace struct {
+	// Protects encoder
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	// The last handle given to an opened file.
+	handles atomic.Uint64
+}
+
+// NewTrace creates a Trace writing to the given writer.
+func NewTrace(writer io.Writer) *Trace {
+	return &Trace{encoder: json.NewEncoder(writer)}
+}
+
+// Writes the entry of an operation started at start that returned err.
+func (t *Trace) record(entry TraceEntry, start time.Time, err error) {
+	entry.Time = start
+	entry.Duration = time.Since(start)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// A trace is only for debugging, so it must not make the operation fail.
+	_ = t.encoder.Encode(entry)
+}
+
+// TraceFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and records every operation along with
+// its sizes, timing and error into a Trace, so the operations of a session can be replayed with ReplayTrace. The
+// content of the files is not recorded.
+type TraceFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The trace to record to
+	Trace *Trace
+}
+
+// Runs f and records it as operation op on the given paths.
+func (t TraceFS) run(op string, path string, target string, f func() error) error {
+	start := time.Now()
+	err := f()
+	t.Trace.record(TraceEntry{Op: op, Path: path, Target: target}, start, err)
+	return err
+}
+
+// Runs a stat like operation and records it.
+func (t TraceFS) stat(op string, path string, f func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := t.run(op, path, "", func() error {
+		var err error
+		info, err = f(path)
+		return err
+	})
+	return info, err
+}
+
+// tracedReader is an [io.ReaderAt] that records its reads.
+type tracedReader struct {
+	io.ReaderAt
+	trace  *Trace
+	handle uint64
+}
+
+func (r tracedReader) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.trace.record(TraceEntry{Op: "ReadAt", Handle: r.handle, Offset: off, Size: len(p), N: n}, start, err)
+	return n, err
+}
+
+func (r tracedReader) Close() error {
+	start := time.Now()
+	err := closeIfCloser(r.ReaderAt)
+	r.trace.record(TraceEntry{Op: "Close", Handle: r.handle}, start, err)
+	return err
+}
+
+// tracedWriter is an [io.WriterAt] that records its writes.
+type tracedWriter struct {
+	io.WriterAt
+	trace  *Trace
+	handle uint64
+}
+
+func (w tracedWriter) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.trace.record(TraceEntry{Op: "WriteAt", Handle: w.handle, Offset: off, Size: len(p), N: n}, start, err)
+	return n, err
+}
+
+func (w tracedWriter) Close() error {
+	start := time.Now()
+	err := closeIfCloser(w.WriterAt)
+	w.trace.record(TraceEntry{Op: "Close", Handle: w.handle}, start, err)
+	return err
+}
+
+func (t TraceFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	var lister func([]os.FileInfo, int64) (int, error)
+	err := t.run("List", path, "", func() error {
+		var err error
+		lister, err = t.Inner.List(path)
+		return err
+	})
+	return lister, err
+}
+
+func (t TraceFS) Lstat(path string) (os.FileInfo, error) {
+	return t.stat("Lstat", path, t.Inner.Lstat)
+}
+
+func (t TraceFS) Stat(path string) (os.FileInfo, error) {
+	return t.stat("Stat", path, t.Inner.Stat)
+}
+
+func (t TraceFS) ReadLink(path string) (os.FileInfo, error) {
+	return t.stat("ReadLink", path, t.Inner.ReadLink)
+}
+
+func (t TraceFS) Read(path string) (io.ReaderAt, error) {
+	start := time.Now()
+	reader, err := t.Inner.Read(path)
+	handle := t.Trace.handles.Add(1)
+	t.Trace.record(TraceEntry{Op: "Read", Path: path, Handle: handle}, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return tracedReader{reader, t.Trace, handle}, nil
+}
+
+func (t TraceFS) Write(path string) (io.WriterAt, error) {
+	start := time.Now()
+	writer, err := t.Inner.Write(path)
+	handle := t.Trace.handles.Add(1)
+	t.Trace.record(TraceEntry{Op: "Write", Path: path, Handle: handle}, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return tracedWriter{writer, t.Trace, handle}, nil
+}
+
+func (t TraceFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	start := time.Now()
+	err := t.Inner.SetStat(path, flags, attributes)
+	t.Trace.record(TraceEntry{Op: "SetStat", Path: path, Flags: &flags, Attributes: attributes}, start, err)
+	return err
+}
+
+func (t TraceFS) Rename(src, dst string) error {
+	return t.run("Rename", src, dst, func() error { return t.Inner.Rename(src, dst) })
+}
+
+func (t TraceFS) Copy(src, dst string) error {
+	return t.run("Copy", src, dst, func() error {
+		if copier, ok := t.Inner.(Copier); ok {
+			return copier.Copy(src, dst)
+		}
+		return ErrNotSupported
+	})
+}
+
+func (t TraceFS) Rmdir(path string) error {
+	return t.run("Rmdir", path, "", func() error { return t.Inner.Rmdir(path) })
+}
+
+func (t TraceFS) Rm(path string) error {
+	return t.run("Rm", path, "", func() error { return t.Inner.Rm(path) })
+}
+
+func (t TraceFS) Mkdir(path string) error {
+	return t.run("Mkdir", path, "", func() error { return t.Inner.Mkdir(path) })
+}
+
+func (t TraceFS) Link(src, dst string) error {
+	return t.run("Link", src, dst, func() error { return t.Inner.Link(src, dst) })
+}
+
+func (t TraceFS) Symlink(src, dst string) error {
+	return t.run("Symlink", src, dst, func() error { return t.Inner.Symlink(src, dst) })
+}
+
+func (t TraceFS) Space(path string) (Space, error) {
+	var space Space
+	err := t.run("Space", path, "", func() error {
+		var err error
+		space, err = SpaceOf(t.Inner, path)
+		return err
+	})
+	return space, err
+}
+
+// ReplayTrace runs the operations of the trace read from reader against fs in their order. For every operation,
+// report is called with the recorded entry and the entry of its replay. As the content of the files is not
+// recorded, zeros are written instead. Only an unreadable trace makes it fail.
+func ReplayTrace(reader io.Reader, fs SimplifiedFS, report func(recorded, replayed TraceEntry)) error {
+	readers := map[uint64]io.ReaderAt{}
+	writers := map[uint64]io.WriterAt{}
+	defer func() {
+		// Files the session has not closed.
+		for _, reader := range readers {
+			_ = closeIfCloser(reader)
+		}
+		for _, writer := range writers {
+			_ = closeIfCloser(writer)
+		}
+	}()
+	errUnknownHandle := errors.New("unknown handle")
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry TraceEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid trace: %v", err)
+		}
+		replayed := TraceEntry{Op: entry.Op, Path: entry.Path, Target: entry.Target, Handle: entry.Handle,
+			Offset: entry.Offset, Size: entry.Size, Flags: entry.Flags, Attributes: entry.Attributes}
+		start := time.Now()
+		var err error
+		switch entry.Op {
+		case "List":
+			var lister func([]os.FileInfo, int64) (int, error)
+			if lister, err = fs.List(entry.Path); err == nil {
+				// Lists all entries like a client would.
+				infos := make([]os.FileInfo, 100)
+				for offset := int64(0); ; {
+					n, listErr := lister(infos, offset)
+					offset += int64(n)
+					if listErr != nil || n == 0 {
+						break
+					}
+				}
+			}
+		case "Lstat":
+			_, err = fs.Lstat(entry.Path)
+		case "Stat":
+			_, err = fs.Stat(entry.Path)
+		case "ReadLink":
+			_, err = fs.ReadLink(entry.Path)
+		case "Read":
+			var file io.ReaderAt
+			if file, err = fs.Read(entry.Path); err == nil {
+				readers[entry.Handle] = file
+			}
+		case "Write":
+			var file io.WriterAt
+			if file, err = fs.Write(entry.Path); err == nil {
+				writers[entry.Handle] = file
+			}
+		case "ReadAt":
+			if file, ok := readers[entry.Handle]; ok {
+				replayed.N, err = file.ReadAt(make([]byte, entry.Size), entry.Offset)
+			} else {
+				err = errUnknownHandle
+			}
+		case "WriteAt":
+			if file, ok := writers[entry.Handle]; ok {
+				replayed.N, err = file.WriteAt(make([]byte, entry.Size), entry.Offset)
+			} else {
+				err = errUnknownHandle
+			}
+		case "Close":
+			if file, ok := readers[entry.Handle]; ok {
+				err = closeIfCloser(file)
+				delete(readers, entry.Handle)
+			} else if file, ok := writers[entry.Handle]; ok {
+				err = closeIfCloser(file)
+				delete(writers, entry.Handle)
+			} else {
+				err = errUnknownHandle
+			}
+		case "SetStat":
+			if entry.Flags == nil || entry.Attributes == nil {
+				return fmt.Errorf("invalid trace: SetStat of %s without attributes", entry.Path)
+			}
+			err = fs.SetStat(entry.Path, *entry.Flags, entry.Attributes)
+		case "Rename":
+			err = fs.Rename(entry.Path, entry.Target)
+		case "Copy":
+			// A copy that is not supported is followed by the recorded reads and writes of the fallback.
+			err = ErrNotSupported
+			if copier, ok := fs.(Copier); ok {
+				err = copier.Copy(entry.Path, entry.Target)
+			}
+		case "Rmdir":
+			err = fs.Rmdir(entry.Path)
+		case "Rm":
+			err = fs.Rm(entry.Path)
+		case "Mkdir":
+			err = fs.Mkdir(entry.Path)
+		case "Link":
+			err = fs.Link(entry.Path, entry.Target)
+		case "Symlink":
+			err = fs.Symlink(entry.Path, entry.Target)
+		case "Space":
+			_, err = SpaceOf(fs, entry.Path)
+		default:
+			return fmt.Errorf("invalid trace: unknown operation %q", entry.Op)
+		}
+		replayed.Time = start
+		replayed.Duration = time.Since(start)
+		if err != nil {
+			replayed.Error = err.Error()
+		}
+		report(entry, replayed)
+	}
+}
@@ -0,0 +1,53 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestTraceFSReplay(t *testing.T) {
+	var trace bytes.Buffer
+	fs := TraceFS{Inner: DirFs{Root: t.TempDir() + "/"}, Trace: NewTrace(&trace)}
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := fs.Write("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = writer.(io.Closer).Close()
+	reader, err := fs.Read("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = reader.ReadAt(make([]byte, 10), 0)
+	_ = reader.(io.Closer).Close()
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() of a missing file = %v", err)
+	}
+
+	replay := DirFs{Root: t.TempDir() + "/"}
+	var ops []string
+	err = ReplayTrace(&trace, replay, func(recorded, replayed TraceEntry) {
+		ops = append(ops, recorded.Op)
+		if (recorded.Error == "") != (replayed.Error == "") || recorded.N != replayed.N {
+			t.Errorf("replayed %s %s with n=%d error=%q, recorded n=%d error=%q", recorded.Op, recorded.Path,
+				replayed.N, replayed.Error, recorded.N, recorded.Error)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Mkdir", "Write", "WriteAt", "Close", "Read", "ReadAt", "Close", "Stat"}
+	if len(ops) != len(want) {
+		t.Fatalf("replayed %v, want %v", ops, want)
+	}
+	if stat, err := replay.Stat("/dir/file"); err != nil || stat.Size() != 5 {
+		t.Errorf("the replayed file has not the written size: %v", err)
+	}
+}
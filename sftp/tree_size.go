@@ -0,0 +1,101 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+// DefaultTreeSizeLimit is the number of entries TreeSize counts at most if no other limit is given.
+const DefaultTreeSizeLimit = 100000
+
+// TreeUsage is the size of a directory tree computed by TreeSize.
+type TreeUsage struct {
+	// The summed up size of all files.
+	Bytes int64
+	// The number of files (including symbolic links) and directories below the path.
+	Files       int64
+	Directories int64
+	// Whether counting has been stopped at the limit. The numbers are too small then.
+	Truncated bool
+}
+
+// TreeSize sums up the sizes of all files below the given path, counting at most limit entries.
+// Symbolic links are not followed. Directories that cannot be listed are skipped.
+func TreeSize(fs SimplifiedFS, root string, limit int64) (TreeUsage, error) {
+	var usage TreeUsage
+	stat, err := fs.Lstat(root)
+	if err != nil {
+		return usage, err
+	}
+	if !stat.IsDir() {
+		usage.Files = 1
+		usage.Bytes = stat.Size()
+		return usage, nil
+	}
+	pending := []string{root}
+	buffer := make([]os.FileInfo, 128)
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		lister, err := fs.List(dir)
+		if err != nil {
+			if dir == root {
+				return usage, err
+			}
+			continue
+		}
+		offset := int64(0)
+		for {
+			n, err := lister(buffer, offset)
+			for _, info := range buffer[:n] {
+				if usage.Files+usage.Directories >= limit {
+					usage.Truncated = true
+					return usage, nil
+				}
+				if info.IsDir() {
+					usage.Directories++
+					pending = append(pending, path.Join(dir, info.Name()))
+				} else {
+					usage.Files++
+					usage.Bytes += info.Size()
+				}
+			}
+			offset += int64(n)
+			if errors.Is(err, io.EOF) || n == 0 {
+				break
+			}
+			if err != nil {
+				if dir == root {
+					return usage, err
+				}
+				break
+			}
+		}
+	}
+	return usage, nil
+}
+
+// Handles the tree-size request, which returns the TreeUsage of a path. Returns the path and the reply.
+func (w *wrapper) treeSize(r *extendedRequest) (string, []byte, error) {
+	p, err := r.string()
+	if err != nil {
+		return "", nil, err
+	}
+	if p, err = normalizeClientPath(p); err != nil {
+		return p, nil, err
+	}
+	usage, err := TreeSize(w.fs, p, w.treeSizeLimit)
+	if err != nil {
+		return p, nil, err
+	}
+	reply := binary.BigEndian.AppendUint64(nil, uint64(usage.Bytes))
+	reply = binary.BigEndian.AppendUint64(reply, uint64(usage.Files))
+	reply = binary.BigEndian.AppendUint64(reply, uint64(usage.Directories))
+	if usage.Truncated {
+		return p, append(reply, 1), nil
+	}
+	return p, append(reply, 0), nil
+}
@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage describes the resources a user or mount occupies.
+type Usage struct {
+	// The number of files and directories.
+	Files int64
+	// The total size of the files in bytes. Only computed by CountUsage, the stores keep it under BytesKey.
+	Bytes int64
+}
+
+// UsageStore keeps track of the Usage of several filesystems identified by a key.
+type UsageStore interface {
+	// Get returns the usage stored for the given key and whether there is an entry for it. An error means that the
+	// store cannot be read, not that the usage is unknown.
+	Get(key string) (Usage, bool, error)
+	// Set overwrites the usage of the given key.
+	Set(key string, usage Usage) error
+	// Add adds the given number of files to the usage of the given key and returns the new usage.
+	Add(key string, files int64) (Usage, error)
+	// Reserve adds the given number of files to the usage of the given key unless the result would exceed limit.
+	// Returns the new usage and whether the files have been added. The check and the addition are atomic, so
+	// concurrent reservations never exceed the limit together.
+	Reserve(key string, files int64, limit int64) (Usage, bool, error)
+}
+
+// How long a FileUsageStore collects changes before it saves them, so creating many files does not rewrite the
+// file for every single one.
+const usageSaveDelay = time.Second
+
+// FileUsageStore is a UsageStore that persists all entries as json in a file. Changes are saved at most once per
+// usageSaveDelay in the background. Close saves the pending ones.
+type FileUsageStore struct {
+	// The file the entries are saved to. If empty, the entries are only kept in memory.
+	filename string
+	// Protects the fields below
+	mutex   sync.Mutex
+	entries map[string]Usage
+	// Whether a save has been scheduled for the changes since the last one.
+	scheduled bool
+	// The error of the last save, returned by the next change.
+	err error
+}
+
+// NewFileUsageStore creates a FileUsageStore that loads and saves its entries from the given file.
+// If filename is empty, the entries are not persisted at all.
+func NewFileUsageStore(filename string) (*FileUsageStore, error) {
+	store := &FileUsageStore{filename: filename, entries: map[string]Usage{}}
+	if filename == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// changed schedules saving the entries after a change and returns the error of the previous save.
+// The mutex must be held by the caller.
+func (f *FileUsageStore) changed() error {
+	if f.filename == "" {
+		return nil
+	}
+	if !f.scheduled {
+		f.scheduled = true
+		time.AfterFunc(usageSaveDelay, func() {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if f.scheduled {
+				f.err = f.save()
+			}
+		})
+	}
+	err := f.err
+	f.err = nil
+	return err
+}
+
+// Close saves the pending changes.
+func (f *FileUsageStore) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.scheduled {
+		return nil
+	}
+	return f.save()
+}
+
+// save writes all entries into the file. The mutex must be held by the caller.
+func (f *FileUsageStore) save() error {
+	f.scheduled = false
+	if f.filename == "" {
+		return nil
+	}
+	data, err := json.Marshal(f.entries)
+	if err != nil {
+		return err
+	}
+	// We write into a temporary file first, so a crash does not leave a broken file behind.
+	tmp := filepath.Join(filepath.Dir(f.filename), "."+filepath.Base(f.filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.filename)
+}
+
+func (f *FileUsageStore) Get(key string) (Usage, bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	usage, ok := f.entries[key]
+	return usage, ok, nil
+}
+
+func (f *FileUsageStore) Set(key string, usage Usage) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.entries[key] = usage
+	return f.changed()
+}
+
+func (f *FileUsageStore) Add(key string, files int64) (Usage, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	usage := f.entries[key]
+	usage.Files += files
+	if usage.Files < 0 {
+		usage.Files = 0
+	}
+	f.entries[key] = usage
+	return usage, f.changed()
+}
+
+func (f *FileUsageStore) Reserve(key string, files int64, limit int64) (Usage, bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	usage := f.entries[key]
+	if usage.Files+files > limit {
+		return usage, false, nil
+	}
+	usage.Files += files
+	f.entries[key] = usage
+	return usage, true, f.changed()
+}
+
+// CountUsage computes the Usage of the given directory within the filesystem by recursively visiting every entry.
+func CountUsage(fs SimplifiedFS, path string) (Usage, error) {
+	var usage Usage
+	iter, err := fs.List(path)
+	if err != nil {
+		return usage, err
+	}
+	buffer := make([]os.FileInfo, 64)
+	offset := int64(0)
+	for {
+		n, err := iter(buffer, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return usage, err
+		}
+		offset += int64(n)
+		for _, info := range buffer[:n] {
+			usage.Files += 1
+			if info.Mode().IsRegular() {
+				usage.Bytes += info.Size()
+			}
+			if info.IsDir() {
+				sub, err := CountUsage(fs, filepath.ToSlash(filepath.Join(path, info.Name())))
+				if err != nil {
+					return usage, err
+				}
+				usage.Files += sub.Files
+				usage.Bytes += sub.Bytes
+			}
+		}
+		if n == 0 || errors.Is(err, io.EOF) {
+			return usage, nil
+		}
+	}
+}
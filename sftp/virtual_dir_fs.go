@@ -0,0 +1,290 @@
+package sftp
+
+import (
+	"bytes"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VirtualDirFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and adds a directory of generated
+// files to its root. The files are read-only unless they are listed in Writable.
+type VirtualDirFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The name of the directory within the root, e.g. ".server". It hides an entry of Inner with the same name.
+	Name string
+	// The files of the directory by their name. Their content is generated whenever they are read or stat'ed.
+	Files map[string]func() ([]byte, error)
+	// The files of Files that can be replaced by a client. Once a written file is closed, its whole content is
+	// passed to the function, whose error is returned to the client. May be nil.
+	Writable map[string]func([]byte) error
+}
+
+// The largest content accepted for a file of Writable.
+const maxVirtualFileSize = 1 << 20
+
+// virtualFileInfo is the [os.FileInfo] of a generated file or directory.
+type virtualFileInfo struct {
+	name     string
+	size     int64
+	dir      bool
+	writable bool
+}
+
+func (v virtualFileInfo) Name() string {
+	return v.name
+}
+
+func (v virtualFileInfo) Size() int64 {
+	return v.size
+}
+
+func (v virtualFileInfo) Mode() fs.FileMode {
+	if v.dir {
+		return os.FileMode(0555) | os.ModeDir
+	}
+	if v.writable {
+		return os.FileMode(0644)
+	}
+	return os.FileMode(0444)
+}
+
+func (v virtualFileInfo) ModTime() time.Time {
+	// The content is generated right now.
+	return time.Now()
+}
+
+func (v virtualFileInfo) IsDir() bool {
+	return v.dir
+}
+
+func (v virtualFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Checks whether the path lies within the virtual directory. Returns the name of the file within it, which is
+// empty for the directory itself.
+func (v VirtualDirFS) virtual(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(path, "/"), v.Name)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	return strings.TrimPrefix(rest, "/"), true
+}
+
+// Generates the file with the given name.
+func (v VirtualDirFS) generate(name string) ([]byte, error) {
+	generate, ok := v.Files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return generate()
+}
+
+func (v VirtualDirFS) stat(name string) (os.FileInfo, error) {
+	if name == "" {
+		return virtualFileInfo{name: v.Name, size: 0, dir: true}, nil
+	}
+	content, err := v.generate(name)
+	if err != nil {
+		return nil, err
+	}
+	_, writable := v.Writable[name]
+	return virtualFileInfo{name: name, size: int64(len(content)), writable: writable}, nil
+}
+
+// virtualWriter collects the content written to a file of Writable and passes it on once it is closed.
+type virtualWriter struct {
+	// Protects content
+	mutex   sync.Mutex
+	content []byte
+	save    func([]byte) error
+}
+
+func (w *virtualWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	end := off + int64(len(p))
+	if off < 0 || end > maxVirtualFileSize {
+		return 0, ErrForbidden
+	}
+	if end > int64(len(w.content)) {
+		w.content = append(w.content, make([]byte, end-int64(len(w.content)))...)
+	}
+	copy(w.content[off:], p)
+	return len(p), nil
+}
+
+func (w *virtualWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.save(w.content)
+}
+
+func (v VirtualDirFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	if name, ok := v.virtual(path); ok {
+		if name != "" {
+			stat, err := v.stat(name)
+			if err != nil {
+				return nil, err
+			}
+			return func(ls []os.FileInfo, offset int64) (int, error) {
+				if offset > 0 || len(ls) == 0 {
+					return 0, io.EOF
+				}
+				ls[0] = stat
+				return 1, io.EOF
+			}, nil
+		}
+		names := make([]string, 0, len(v.Files))
+		for name := range v.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return func(ls []os.FileInfo, offset int64) (int, error) {
+			n := 0
+			for ; n < len(ls) && int(offset)+n < len(names); n++ {
+				stat, err := v.stat(names[int(offset)+n])
+				if err != nil {
+					return n, err
+				}
+				ls[n] = stat
+			}
+			if int(offset)+n >= len(names) {
+				return n, io.EOF
+			}
+			return n, nil
+		}, nil
+	}
+	lister, err := v.Inner.List(path)
+	if err != nil || (path != "/" && path != "") {
+		return lister, err
+	}
+	// The virtual directory is listed first, so the offsets of the inner entries are just shifted by one.
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset > 0 {
+			return lister(ls, offset-1)
+		}
+		if len(ls) == 0 {
+			return 0, nil
+		}
+		ls[0] = virtualFileInfo{name: v.Name, dir: true}
+		n, err := lister(ls[1:], 0)
+		return n + 1, err
+	}, nil
+}
+
+func (v VirtualDirFS) Lstat(path string) (os.FileInfo, error) {
+	if name, ok := v.virtual(path); ok {
+		return v.stat(name)
+	}
+	return v.Inner.Lstat(path)
+}
+
+func (v VirtualDirFS) Stat(path string) (os.FileInfo, error) {
+	if name, ok := v.virtual(path); ok {
+		return v.stat(name)
+	}
+	return v.Inner.Stat(path)
+}
+
+func (v VirtualDirFS) ReadLink(path string) (os.FileInfo, error) {
+	if _, ok := v.virtual(path); ok {
+		return nil, os.ErrInvalid
+	}
+	return v.Inner.ReadLink(path)
+}
+
+func (v VirtualDirFS) Read(path string) (io.ReaderAt, error) {
+	if name, ok := v.virtual(path); ok {
+		content, err := v.generate(name)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(content), nil
+	}
+	return v.Inner.Read(path)
+}
+
+func (v VirtualDirFS) Write(path string) (io.WriterAt, error) {
+	if name, ok := v.virtual(path); ok {
+		if save, ok := v.Writable[name]; ok {
+			return &virtualWriter{save: save}, nil
+		}
+		return nil, ErrForbidden
+	}
+	return v.Inner.Write(path)
+}
+
+func (v VirtualDirFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if name, ok := v.virtual(path); ok {
+		if _, ok := v.Writable[name]; ok {
+			// Clients set the attributes of uploaded files, which have no meaning here.
+			return nil
+		}
+		return ErrForbidden
+	}
+	return v.Inner.SetStat(path, flags, attributes)
+}
+
+// Runs f if neither src nor dst lies within the virtual directory.
+func (v VirtualDirFS) outside(src, dst string, f func() error) error {
+	if _, ok := v.virtual(src); ok {
+		return ErrForbidden
+	}
+	if _, ok := v.virtual(dst); ok {
+		return ErrForbidden
+	}
+	return f()
+}
+
+func (v VirtualDirFS) Rename(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Rename(src, dst) })
+}
+
+func (v VirtualDirFS) Rmdir(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Rmdir(path) })
+}
+
+func (v VirtualDirFS) Rm(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Rm(path) })
+}
+
+func (v VirtualDirFS) Mkdir(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Mkdir(path) })
+}
+
+func (v VirtualDirFS) Link(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Link(src, dst) })
+}
+
+func (v VirtualDirFS) Symlink(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Symlink(src, dst) })
+}
+
+// Copy copies files outside the virtual directory with the inner filesystem. Generated files are copied
+// through this filesystem instead.
+func (v VirtualDirFS) Copy(src, dst string) error {
+	copier, ok := v.Inner.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	if _, ok := v.virtual(src); ok {
+		return ErrNotSupported
+	}
+	return v.outside(src, dst, func() error { return copier.Copy(src, dst) })
+}
+
+// Space returns the space of the inner filesystem. The virtual directory has no storage.
+func (v VirtualDirFS) Space(path string) (Space, error) {
+	if _, ok := v.virtual(path); ok {
+		return Space{}, ErrNotSupported
+	}
+	return SpaceOf(v.Inner, path)
+}
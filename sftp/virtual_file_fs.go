@@ -0,0 +1,164 @@
+package sftp
+
+import (
+	"bytes"
+	gosftp "github.com/pkg/sftp"
+	"io"
+	"os"
+	"strings"
+)
+
+// VirtualFileFS is a [sftp.SimplifiedFS] that wraps another [sftp.SimplifiedFS] and adds a single read-only
+// generated file to its root.
+type VirtualFileFS struct {
+	// The [sftp.SimplifiedFS] to wrap
+	Inner SimplifiedFS
+	// The name of the file within the root, e.g. ".quota". It hides an entry of Inner with the same name.
+	Name string
+	// Generates the content of the file whenever it is read or stat'ed.
+	Generate func() ([]byte, error)
+}
+
+// Checks whether the path is the virtual file.
+func (v VirtualFileFS) virtual(path string) bool {
+	return strings.TrimPrefix(path, "/") == v.Name
+}
+
+func (v VirtualFileFS) stat() (os.FileInfo, error) {
+	content, err := v.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return virtualFileInfo{name: v.Name, size: int64(len(content))}, nil
+}
+
+func (v VirtualFileFS) List(path string) (func([]os.FileInfo, int64) (int, error), error) {
+	if v.virtual(path) {
+		stat, err := v.stat()
+		if err != nil {
+			return nil, err
+		}
+		return func(ls []os.FileInfo, offset int64) (int, error) {
+			if offset > 0 || len(ls) == 0 {
+				return 0, io.EOF
+			}
+			ls[0] = stat
+			return 1, io.EOF
+		}, nil
+	}
+	lister, err := v.Inner.List(path)
+	if err != nil || (path != "/" && path != "") {
+		return lister, err
+	}
+	// The virtual file is listed first, so the offsets of the inner entries are just shifted by one.
+	return func(ls []os.FileInfo, offset int64) (int, error) {
+		if offset > 0 {
+			return lister(ls, offset-1)
+		}
+		if len(ls) == 0 {
+			return 0, nil
+		}
+		stat, err := v.stat()
+		if err != nil {
+			return 0, err
+		}
+		ls[0] = stat
+		n, err := lister(ls[1:], 0)
+		return n + 1, err
+	}, nil
+}
+
+func (v VirtualFileFS) Lstat(path string) (os.FileInfo, error) {
+	if v.virtual(path) {
+		return v.stat()
+	}
+	return v.Inner.Lstat(path)
+}
+
+func (v VirtualFileFS) Stat(path string) (os.FileInfo, error) {
+	if v.virtual(path) {
+		return v.stat()
+	}
+	return v.Inner.Stat(path)
+}
+
+func (v VirtualFileFS) ReadLink(path string) (os.FileInfo, error) {
+	if v.virtual(path) {
+		return nil, os.ErrInvalid
+	}
+	return v.Inner.ReadLink(path)
+}
+
+func (v VirtualFileFS) Read(path string) (io.ReaderAt, error) {
+	if v.virtual(path) {
+		content, err := v.Generate()
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(content), nil
+	}
+	return v.Inner.Read(path)
+}
+
+func (v VirtualFileFS) Write(path string) (io.WriterAt, error) {
+	if v.virtual(path) {
+		return nil, ErrForbidden
+	}
+	return v.Inner.Write(path)
+}
+
+func (v VirtualFileFS) SetStat(path string, flags gosftp.FileAttrFlags, attributes *gosftp.FileStat) error {
+	if v.virtual(path) {
+		return ErrForbidden
+	}
+	return v.Inner.SetStat(path, flags, attributes)
+}
+
+// Runs f if neither src nor dst is the virtual file.
+func (v VirtualFileFS) outside(src, dst string, f func() error) error {
+	if v.virtual(src) || v.virtual(dst) {
+		return ErrForbidden
+	}
+	return f()
+}
+
+func (v VirtualFileFS) Rename(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Rename(src, dst) })
+}
+
+func (v VirtualFileFS) Rmdir(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Rmdir(path) })
+}
+
+func (v VirtualFileFS) Rm(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Rm(path) })
+}
+
+func (v VirtualFileFS) Mkdir(path string) error {
+	return v.outside(path, path, func() error { return v.Inner.Mkdir(path) })
+}
+
+func (v VirtualFileFS) Link(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Link(src, dst) })
+}
+
+func (v VirtualFileFS) Symlink(src, dst string) error {
+	return v.outside(src, dst, func() error { return v.Inner.Symlink(src, dst) })
+}
+
+// Copy copies files other than the virtual file with the inner filesystem.
+func (v VirtualFileFS) Copy(src, dst string) error {
+	copier, ok := v.Inner.(Copier)
+	if !ok || v.virtual(src) {
+		return ErrNotSupported
+	}
+	return v.outside(src, dst, func() error { return copier.Copy(src, dst) })
+}
+
+// Space returns the space of the inner filesystem. The virtual file has no storage.
+func (v VirtualFileFS) Space(path string) (Space, error) {
+	if v.virtual(path) {
+		return Space{}, ErrNotSupported
+	}
+	return SpaceOf(v.Inner, path)
+}
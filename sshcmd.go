@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/Entscheider/sshtool/admin"
 	gssh "github.com/gliderlabs/ssh"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 
 	"sync/atomic"
 )
@@ -25,6 +31,11 @@ type Config struct {
 	ServerKeyFilename []string
 	// MaxNumberOfConnection is the number of connections after which we reject any further one.
 	MaxNumberOfConnections int
+	// Banning addresses for a while after too many failed logins.
+	AutoBan AutoBanConfig
+	// Whether to start without checking the host keys, the addresses and (depending on the server) the directories
+	// or the command first. Otherwise, the server does not start if one of them fails and reports all problems.
+	SkipSelfTest bool
 }
 
 // DefaultConfig creates a Config object with default parameter.
@@ -42,10 +53,25 @@ type ConfigCmd struct {
 	Config
 	// A list of authorized_keys entry (not the file, the actual keys)
 	AuthorizedKeys []string
+	// The public keys of certificate authorities (formatted like authorized_keys entries) whose OpenSSH user
+	// certificates are accepted as well. The name the client logs in with must be listed as principal.
+	TrustedUserCAKeys []string
+	// The base32 secret of an authenticator app (TOTP). If set, clients are asked for the current code of the app
+	// after their key has been accepted.
+	TOTPSecret string
 	// The command to start on an ssh connection
 	Command string
 	// A list of parameter to give the Command on starting
 	CommandArgs []string
+	// Whether clients are refused a pty, so the Command is always started without one
+	DisablePty bool
+	// Whether the input of clients is ignored. The Command reads from an empty input instead (or a pty nobody
+	// writes to), so it can only show its output.
+	DisableStdin bool
+	// Services clients can forward with ssh in addition to running the Command.
+	Services []CmdService
+	// The file this config has been loaded from.
+	filename string
 }
 
 // ContextCmd is a shared state between all ssh connections on server and the server itself
@@ -53,6 +79,15 @@ type ContextCmd struct {
 	config *ConfigCmd
 	// Number of ssh connection that are currently active
 	activeConnections int32
+	// The time the context was created, shown on the status page
+	start time.Time
+	// Checks the codes for the TOTPSecret
+	totp *totpVerifier
+	// The addresses connections are rejected from and the bans after failed logins (nil if disabled).
+	bans    *admin.BanList
+	autoBan *autoBan
+	// Protects config, which is replaced when the config file is reloaded.
+	configMutex sync.RWMutex
 }
 
 // DefaultCmdConfig creates a ConfigCmd instance with default values
@@ -72,51 +107,165 @@ func LoadConfigCmd(filename string) (ConfigCmd, error) {
 	if err != nil {
 		return c, err
 	}
-	err = toml.Unmarshal(data, &c)
-	return c, err
+	if err = toml.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if _, err := parseAuthorizedKeys(c.TrustedUserCAKeys); err != nil {
+		return c, fmt.Errorf("invalid TrustedUserCAKeys: %v", err)
+	}
+	if c.TOTPSecret != "" {
+		if _, err := decodeTOTPSecret(c.TOTPSecret); err != nil {
+			return c, fmt.Errorf("invalid TOTPSecret: %v", err)
+		}
+	}
+	if err := c.AutoBan.validate(); err != nil {
+		return c, err
+	}
+	c.filename = filename
+	return c, c.validateServices()
 }
 
 // MakeContextCmd creates a [ContextCmd] from the [ConfigCmd]
 func (c *ConfigCmd) MakeContextCmd() ContextCmd {
+	bans := admin.NewBanList()
 	return ContextCmd{
 		config:            c,
 		activeConnections: 0,
+		start:             time.Now(),
+		totp:              newTOTPVerifier(),
+		bans:              bans,
+		autoBan:           c.AutoBan.newAutoBan(bans),
+	}
+}
+
+// Checks whether the given public key is known in the authorized_keys entry from the config and may be used from
+// the address. Returns the restrictions of the options of the key.
+func (c *ConfigCmd) checkValidKey(key gssh.PublicKey, addr net.Addr) (keyRestrictions, bool) {
+	keys := parseAuthorizedKeysFile([]byte(strings.Join(c.AuthorizedKeys, "\n")))
+	authorized, ok := findKey(keys, key, addr)
+	return authorized.restrictions, ok
+}
+
+// connMetadata adapts a [gssh.Context] to a [ssh.ConnMetadata].
+type connMetadata struct {
+	gssh.Context
+}
+
+func (c connMetadata) ClientVersion() []byte {
+	return []byte(c.Context.ClientVersion())
+}
+
+func (c connMetadata) ServerVersion() []byte {
+	return []byte(c.Context.ServerVersion())
+}
+
+func (c connMetadata) SessionID() []byte {
+	return []byte(c.Context.SessionID())
+}
+
+// Checks whether the key is a user certificate signed by one of the TrustedUserCAKeys from the config, which is
+// valid for the user of the connection.
+func (c *ConfigCmd) checkValidCertificate(ctx gssh.Context, key gssh.PublicKey) bool {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || len(c.TrustedUserCAKeys) == 0 {
+		return false
+	}
+	if err := checkUserCertificate(c.TrustedUserCAKeys, connMetadata{ctx}, cert); err != nil {
+		log.Printf("Rejecting certificate of %s at %s: %v\n", ctx.User(), ctx.RemoteAddr(), err)
+		return false
 	}
+	return true
 }
 
-// Checks whether the given public key is known in the authorized_keys entry from the config.
-func (c *ConfigCmd) checkValidKey(key gssh.PublicKey) bool {
-	for _, data := range c.AuthorizedKeys {
-		allowedKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(data))
-		if gssh.KeysEqual(key, allowedKey) {
-			return true
+// Creates the [ssh.ServerConfig] of a new connection. Once the key of the client has been verified, its
+// restrictions are kept in the context. With a TOTPSecret, clients are then asked for the code.
+func (c *ContextCmd) serverConfig(ctx gssh.Context) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{}
+	askTOTP := func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		ok, err := c.totp.askTOTP(conn, client, c.currentConfig().TOTPSecret)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("Wrong TOTP code for %s at %s\n", conn.User(), conn.RemoteAddr())
+			c.recordLoginFailure(conn.RemoteAddr())
+			return nil, fmt.Errorf("permission denied")
 		}
+		return ctx.Permissions().Permissions, nil
+	}
+	config.VerifiedPublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey, _ *ssh.Permissions, _ string) (*ssh.Permissions, error) {
+		restrictions, _ := c.currentConfig().checkValidKey(key, conn.RemoteAddr())
+		if cert, ok := key.(*ssh.Certificate); ok {
+			restrictions = certificateRestrictions(cert)
+		}
+		ctx.SetValue(contextKeyRestrictions, restrictions)
+		if c.currentConfig().TOTPSecret == "" {
+			return ctx.Permissions().Permissions, nil
+		}
+		return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{KeyboardInteractiveCallback: askTOTP}}
+	}
+	return config
+}
+
+// currentConfig returns the config, which may be replaced by reload at any time.
+func (c *ContextCmd) currentConfig() *ConfigCmd {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.config
+}
+
+// reload loads the config file again, which applies to new connections. The listeners, the Services and the
+// AutoBan keep their settings until the next start. If the config is invalid, the previous one is kept.
+func (c *ContextCmd) reload() {
+	config, err := LoadConfigCmd(c.currentConfig().filename)
+	if err != nil {
+		log.Printf("Cannot reload the config, keeping the previous one: %v\n", err)
+		return
+	}
+	c.configMutex.Lock()
+	c.config = &config
+	c.configMutex.Unlock()
+	log.Printf("Reloaded the config\n")
+}
+
+// recordLoginFailure counts a failed login from the address for the AutoBan.
+func (c *ContextCmd) recordLoginFailure(addr net.Addr) {
+	if ban, banned := c.autoBan.recordFailure(addr.String()); banned {
+		log.Printf("Banned %s until %s: %s\n", ban.IP, ban.Until.Format(time.RFC3339), ban.Reason)
 	}
-	return false
 }
 
 // Handles a new ssh session by starting the desired application and expose it through this session.
 func (c *ContextCmd) handle(s gssh.Session) {
 	log.Printf("Connect with %s\n", s.RemoteAddr().String())
 	defer log.Printf("Disconnect from %s\n", s.RemoteAddr().String())
+	config := c.currentConfig()
 	// We do support pty
 	ptyReq, winCh, isPty := s.Pty()
 	// Check if we have too many connections
 	conn := int(atomic.AddInt32(&c.activeConnections, 1))
 	defer atomic.AddInt32(&c.activeConnections, -1)
-	if c.config.MaxNumberOfConnections > 0 && conn > c.config.MaxNumberOfConnections {
+	if config.MaxNumberOfConnections > 0 && conn > config.MaxNumberOfConnections {
 		_, _ = s.Write([]byte("Max Number of Connections reached\n"))
 		return
 	}
 	// We start the command
-	cmd := exec.Command(c.config.Command, c.config.CommandArgs...)
+	cmd := exec.Command(config.Command, config.CommandArgs...)
 	if isPty && WITH_PTY {
 		// If we have pty, and we support pty on the platform, we start the pty relevant initialization and the command.
-		err := WrapPTY(s, cmd, ptyReq, winCh)
+		err := WrapPTY(s, cmd, ptyReq, winCh, !config.DisableStdin)
 		if err != nil {
 			log.Println(err)
 			return
 		}
+	} else if config.DisableStdin {
+		// Without stdin the command gets an empty input
+		cmd.Stdout = s
+		cmd.Stderr = s.Stderr()
+		if err := cmd.Run(); err != nil {
+			log.Println(err)
+			return
+		}
 	} else {
 		// Otherwise we can redirect stdout and copy stdin
 		cmd.Stdout = s
@@ -145,23 +294,55 @@ func (c *ContextCmd) handle(s gssh.Session) {
 	}
 }
 
-func (c *ContextCmd) Listen() {
+// Listen starts the ssh server. It runs until the context is canceled.
+func (c *ContextCmd) Listen(ctx context.Context) {
+	if !c.config.SkipSelfTest {
+		report := c.selfTest()
+		report.finish()
+	}
 	publicKeyHandler := func(ctx gssh.Context, key gssh.PublicKey) bool {
 		// log.Printf("Connection from %s\n", string(key.Marshal()))
-		return c.config.checkValidKey(key)
+		config := c.currentConfig()
+		_, ok := config.checkValidKey(key, ctx.RemoteAddr())
+		return ok || config.checkValidCertificate(ctx, key)
 	}
 	s := &gssh.Server{
 		Addr:             fmt.Sprintf("%s:%d", c.config.Host, c.config.Port),
 		Handler:          c.handle,
 		PublicKeyHandler: publicKeyHandler,
+		// The key is checked by the publicKeyHandler, the config only adds the TOTP code.
+		ServerConfigCallback: c.serverConfig,
+		PtyCallback: func(ctx gssh.Context, pty gssh.Pty) bool {
+			return !c.currentConfig().DisablePty && !restrictionsOf(ctx).noPty
+		},
+		ConnCallback: func(ctx gssh.Context, conn net.Conn) net.Conn {
+			if c.bans.IsBanned(conn.RemoteAddr().String()) {
+				log.Printf("Rejecting connection from banned %s\n", conn.RemoteAddr().String())
+				// Returning nil closes the connection.
+				return nil
+			}
+			return conn
+		},
+		ConnectionFailedCallback: func(conn net.Conn, err error) {
+			log.Printf("Connection failed for %s: %v\n", conn.RemoteAddr().String(), err)
+			c.recordLoginFailure(conn.RemoteAddr())
+		},
 	}
+	c.serveServices(s)
 	hostkeys, err := c.config.getOrGenerateServerKey()
 	fatal(err)
 	for _, hostkey := range hostkeys {
 		s.AddHostKey(hostkey)
 	}
 	log.Printf("Listen on %s:%d\n", c.config.Host, c.config.Port)
-	fatal(s.ListenAndServe())
+	reloadOnHangup(ctx, c.reload)
+	go func() {
+		<-ctx.Done()
+		_ = s.Close()
+	}()
+	if err := s.ListenAndServe(); err != gssh.ErrServerClosed {
+		fatal(err)
+	}
 }
 
 // If v is a non-nil error, this function prints it and exits the application.
@@ -177,8 +358,14 @@ func mainCmd(args []string) {
 		ErrPrintf("\n")
 		ErrPrintf("Config file will be created if does not exists\n")
 		ErrPrintf("Needed Serverkey will also be created if not exists\n")
+		ErrPrintf("With %s, the default config is printed to stdout instead\n", printDefaultFlag)
 		os.Exit(-1)
 	}
+	if args[1] == printDefaultFlag {
+		c := DefaultCmdConfig()
+		fatal(toml.NewEncoder(os.Stdout).Encode(&c))
+		return
+	}
 	if _, err := os.Stat(args[1]); os.IsNotExist(err) {
 		c := DefaultCmdConfig()
 		file, err := os.OpenFile(args[1], os.O_CREATE|os.O_WRONLY, os.ModePerm)
@@ -192,5 +379,5 @@ func mainCmd(args []string) {
 	c, err := LoadConfigCmd(args[1])
 	fatal(err)
 	ctx := c.MakeContextCmd()
-	ctx.Listen()
+	ctx.Listen(context.Background())
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	"github.com/Entscheider/sshtool/sshport"
+	"github.com/Entscheider/sshtool/webdav_fs"
+	gssh "github.com/gliderlabs/ssh"
+)
+
+// CmdService is a service clients of the cmd server can forward with ssh (e.g. `ssh -L 8080:localhost:9100`)
+// in addition to running the Command. No port is opened on the host for it.
+type CmdService struct {
+	// The port clients forward
+	Port uint32
+	// The tcp address (e.g. "127.0.0.1:9100" of a metrics exporter) every forwarded connection is relayed to.
+	// If empty, a http status page of the server is served instead.
+	Address string
+	// A directory served read-only with webdav instead, e.g. the output files of the Command.
+	WebDavDir string
+}
+
+// cmdStatus is the content of the status page.
+type cmdStatus struct {
+	Command                string
+	ActiveConnections      int32
+	MaxNumberOfConnections int
+	Started                time.Time
+}
+
+// validateServices checks that every port is only used once.
+func (c *ConfigCmd) validateServices() error {
+	ports := map[uint32]bool{}
+	for _, service := range c.Services {
+		if service.Port == 0 {
+			return fmt.Errorf("a service needs a Port")
+		}
+		if ports[service.Port] {
+			return fmt.Errorf("the port %d is used by several services", service.Port)
+		}
+		if service.Address != "" && service.WebDavDir != "" {
+			return fmt.Errorf("the service at port %d has both an Address and a WebDavDir", service.Port)
+		}
+		ports[service.Port] = true
+	}
+	return nil
+}
+
+// serveServices makes the Services available to all clients of the server.
+func (c *ContextCmd) serveServices(s *gssh.Server) {
+	if len(c.config.Services) == 0 {
+		return
+	}
+	serviceLogger := logger.NewLogger(os.Stdout)
+	tcpipHandler := sshport.NewSSHConnectionHandler(serviceLogger, context.Background())
+	s.LocalPortForwardingCallback = func(ctx gssh.Context, destinationHost string, destinationPort uint32) bool {
+		// The handler only forwards to the ports of the services.
+		return !restrictionsOf(ctx).noPortForwarding
+	}
+	s.ChannelHandlers = map[string]gssh.ChannelHandler{
+		"session":      gssh.DefaultSessionHandler,
+		"direct-tcpip": tcpipHandler.HandleTCPIP,
+	}
+	for _, service := range c.config.Services {
+		listener := tcpipHandler.CreateListener(service.Port, "")
+		switch {
+		case service.WebDavDir != "":
+			handler := webdav_fs.CreateHandlerForFS(sftp2.DirFs{Root: service.WebDavDir, Readonly: true}, serviceLogger)
+			go func() {
+				log.Println(http.Serve(listener, handler))
+			}()
+		case service.Address == "":
+			go func() {
+				log.Println(http.Serve(listener, http.HandlerFunc(c.serveStatus)))
+			}()
+		default:
+			go relayConnections(listener, service.Address)
+		}
+	}
+}
+
+// serveStatus serves the status of the server as json.
+func (c *ContextCmd) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cmdStatus{
+		Command:                c.currentConfig().Command,
+		ActiveConnections:      atomic.LoadInt32(&c.activeConnections),
+		MaxNumberOfConnections: c.currentConfig().MaxNumberOfConnections,
+		Started:                c.start,
+	})
+}
+
+// relayConnections relays every connection accepted by the listener to the given tcp address.
+func relayConnections(listener net.Listener, address string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target, err := net.Dial("tcp", address)
+			if err != nil {
+				log.Printf("Cannot relay to %s: %v\n", address, err)
+				return
+			}
+			defer target.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				_, _ = io.Copy(target, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				_, _ = io.Copy(conn, target)
+				done <- struct{}{}
+			}()
+			// Once one side has finished, we close both.
+			<-done
+		}()
+	}
+}
@@ -25,20 +25,29 @@ func setWinsize(f *os.File, w, h int) {
 const WITH_PTY = true
 
 // WrapPTY start the given command with pty support and copy the in/output through the ssh session.
-// This function also forward windows resizing
-func WrapPTY(s gssh.Session, cmd *exec.Cmd, ptyReq gssh.Pty, winCh <-chan gssh.Window) error {
+// This function also forward windows resizing. If input is false, nothing the client sends is passed to the command.
+func WrapPTY(s gssh.Session, cmd *exec.Cmd, ptyReq gssh.Pty, winCh <-chan gssh.Window, input bool) error {
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 	f, err := pty.Start(cmd)
 	if err != nil {
 		return err
 	}
+	// Closing the pty hangs up the command, which is then reaped so it does not linger as a zombie.
+	defer func() {
+		_ = f.Close()
+		_ = cmd.Wait()
+	}()
 	go func() {
 		for win := range winCh {
 			setWinsize(f, win.Width, win.Height)
 		}
 	}()
 	// We create a copy goroutine for copying the app output to ssh and handle the error by a chan
-	var errChan chan error
+	errChan := make(chan error, 1)
+	if !input {
+		_, err = io.Copy(s, f) // stdout
+		return err
+	}
 	go func() {
 		defer close(errChan)
 		_, err := io.Copy(f, s)
@@ -10,6 +10,6 @@ import (
 // WITH_PTY signals that we don't support pty on windows systems yet
 const WITH_PTY = false
 
-func WrapPTY(s gssh.Session, cmd *exec.Cmd, ptyReq gssh.Pty, winCh <-chan gssh.Window) error {
+func WrapPTY(s gssh.Session, cmd *exec.Cmd, ptyReq gssh.Pty, winCh <-chan gssh.Window, input bool) error {
 	return fmt.Errorf("PTY not yet supported under windows")
 }
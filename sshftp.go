@@ -2,22 +2,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/Entscheider/sshtool/admin"
+	"github.com/Entscheider/sshtool/events"
 	"github.com/Entscheider/sshtool/logger"
 	mware "github.com/Entscheider/sshtool/middleware"
+	"github.com/Entscheider/sshtool/oidc"
 	sftp2 "github.com/Entscheider/sshtool/sftp"
 	"github.com/Entscheider/sshtool/sshport"
+	"github.com/Entscheider/sshtool/stats"
 	"github.com/Entscheider/sshtool/webdav_fs"
 	gosftp "github.com/pkg/sftp"
-	"golang.org/x/crypto/ssh"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // See also https://github.com/pkg/sftp/blob/master/examples/sftp-server/main.go
@@ -29,8 +41,169 @@ type ConfigSftp struct {
 	Config
 	// The users we accept along with further config for this user.
 	Users map[string]UserEntry
+	// Further files with users in the format of the UsersFile, e.g. one file per user. Every entry is either a
+	// glob pattern like "users.d/*.toml" or a directory whose "*.toml" files are read. Relative paths are relative
+	// to the directory of this config file. A user must not be defined twice.
+	Include []string
+	// A directory with a file "<username>.toml" per user that is not listed in Users, which contains the settings
+	// of the user like an entry of Users. The file is read whenever the user logs in, so users can be added without
+	// a restart. A relative path is relative to the directory of this config file.
+	UsersDir string
+	// The settings of every user that is neither listed in Users nor found in the UsersDir, the UserStore or the LDAP
+	// server, e.g. for users with a certificate of the TrustedUserCAKeys. "%u" in the roots of its directories is
+	// replaced by the username as usual. If nil, unknown users cannot log in.
+	DefaultUser *UserEntry
+	// Named lists of usernames the entries of the ACL can grant access to at once.
+	Groups map[string][]string
+	// Grants access to paths for users and groups. For every user named by an entry, directly or by a group, the
+	// entries replace CanRead, CanWrite, ShouldHide and KeyPermissions: the entry with the longest path containing
+	// a file decides about it, and files without any entry cannot be accessed.
+	ACL []ACLEntry
+	// The outbound proxy and further trusted certificate authorities used to connect to the Upstream servers and
+	// cloud storages of served directories and to the webhooks of the AccessLog.
+	Proxy ProxyConfig
 	// The port a webdav server can be forwarded from
 	WebDavPort uint32
+	// Whether every user with WebDav gets a virtual port of its own instead of sharing the WebDavPort. The ports are
+	// picked from WebDavPort upwards, skipping the ones set for single users, and shown in the StatusDirectory.
+	WebDavAutoPort bool
+	// New writes are refused if the free space of a served directory drops below this value.
+	// Either an absolute size like "10GB" or a percentage like "5%". An empty string disables this check.
+	MinFreeSpace string
+	// The json file the number of files per user and mount is saved to (used for MaxFiles).
+	// If empty, the numbers are only kept in memory and are recomputed on every start.
+	UsageFile string
+	// The maximal number of bytes per second (e.g. "10MB") all users can read and write together.
+	// An empty string means no limit.
+	MaxBandwidth string
+	// The maximal number of bytes per second all users can read (download) together. An empty string means no limit.
+	MaxDownloadBandwidth string
+	// The maximal number of bytes per second all users can write (upload) together. An empty string means no limit.
+	MaxUploadBandwidth string
+	// The address (e.g. "localhost:9100") to serve live statistics about all sessions from.
+	// The statistics are served in the prometheus format under /metrics and as json under /sessions.
+	// An empty string disables this endpoint.
+	MetricsAddress string
+	// The OpenID Connect provider users with OIDCLogin can log in with.
+	OIDC OIDCConfig
+	// A directory server the users that are not listed in Users are looked up in.
+	LDAP LDAPConfig
+	// A database the users that are not listed in Users are looked up in before the LDAP server.
+	UserStore UserStoreConfig
+	// The address of the admin api, either a tcp address like "localhost:9200" or a unix socket like
+	// "unix:/run/sshtool/admin.sock". An empty string disables the api.
+	AdminAddress string
+	// The token clients of the admin api have to send as "Authorization: Bearer <token>".
+	AdminToken string
+	// Automatic tls certificates for the MetricsAddress and the AdminAddress.
+	ACME ACMEConfig
+	// A toml file the users changed with the admin api are saved to. Its users are loaded on start and replace
+	// the users with the same name from this config. If empty, changes are only kept in memory.
+	UsersFile string
+	// Whether the users changed with the admin api are also saved back to this config file. Only the tables of
+	// the users are replaced, the rest of the file is kept as it is.
+	SaveUsersToConfig bool
+	// Scanning of uploaded files for viruses.
+	ClamAV ClamAVConfig
+	// Summaries of the files every user has uploaded, sent in an interval.
+	UploadDigest UploadDigestConfig
+	// A program (with arguments) that decides which directories are served for every new connection, instead of
+	// the Filesystem entries of the users. See runFilesystemCommand.
+	FilesystemCommand []string
+	// The maximal number of OnUpload commands that run at the same time. Defaults to 4.
+	MaxUploadCommands int
+	// A redis server several sshtool servers share their bans, file counts (for MaxFiles) and session counts
+	// (for MaxSessions) with.
+	Redis RedisConfig
+	// Open files report their progress in this interval (e.g. "30s"), even if nothing has been transferred,
+	// so stalled transfers become visible. An empty string disables these reports.
+	ProgressInterval string
+	// Open files report their progress whenever this many bytes (e.g. "100MB") have been transferred since the
+	// last report. An empty string disables these reports.
+	ProgressBytes string
+	// The interval (e.g. "30s") in which the root of every served directory is checked. Directories whose check
+	// fails are left out of the listing of the root until they are available again. An empty string disables
+	// these checks.
+	HealthCheckInterval string
+	// Whether unavailable directories are listed as empty directories instead of being left out.
+	ShowUnavailableMounts bool
+	// The maximal number of operations a single session may run at the same time. Further ones are rejected with
+	// an error, so the client can try again. Zero means no limit.
+	MaxRequestsPerSession int64
+	// The maximal number of files a single session may have opened at the same time. Zero means no limit.
+	MaxHandlesPerSession int64
+	// The maximal number of channels (sftp sessions and port forwards) a single ssh connection may have opened
+	// at the same time. Further ones are rejected. Zero means no limit.
+	MaxChannelsPerConnection int
+	// The amount of data (e.g. "1GB") after which the keys of a connection are exchanged again. An empty string
+	// uses the default of the cipher.
+	RekeyThreshold string
+	// Holding up the connections of banned and suspicious addresses instead of closing them.
+	Tarpit TarpitConfig
+	// The public keys and signature algorithms clients can log in with.
+	KeyPolicy KeyPolicyConfig
+	// The public keys of certificate authorities (formatted like "authorized_keys" lines) whose OpenSSH user
+	// certificates are accepted in addition to the AuthorizedKeys of a user. The user must be listed as principal.
+	TrustedUserCAKeys []string
+	// The maximal number of files and directories counted for the size of a directory requested by a client or
+	// through the admin api. Larger directories get a truncated size. Zero uses a limit of 100000.
+	MaxTreeSizeEntries int64
+	// The number of entries sent in one reply when a client lists a directory. Larger batches need fewer round
+	// trips for large directories. Zero uses the default of 100. Changes require a restart.
+	ListBatchSize int64
+	// The json file the latest login of every user is saved to. If empty, the logins are only kept in memory.
+	LastLoginFile string
+	// Whether users are shown their previous login when logging in.
+	ShowLastLogin bool
+	// The destinations the access log is written to. If empty, it is written to stdout as csv.
+	AccessLog []AccessLogConfig
+	// Whether the size, mode and modification time of a file are logged along with an access that changes
+	// (Setstat or Rename) or removes it, so changes can be reconstructed later.
+	LogPreviousAttributes bool
+	// Whether messages of the server log are dropped while stdout cannot keep up instead of delaying the requests
+	// of the clients. The number of dropped messages is reported by the metrics. Changes require a restart.
+	NonBlockingLog bool
+	// Whether the server log is written to the systemd journal instead of stdout, with the tag of every message
+	// in the field TAG. Changes require a restart.
+	LogToJournal bool
+	// Whether the hostnames of the clients are looked up by reverse DNS and added to the access log and the sessions.
+	// The lookup starts once a client connects and never delays its login. Changes require a restart.
+	ResolveHostnames bool
+	// How long (e.g. "500ms") looking up a hostname may take. Defaults to 1s.
+	ResolveTimeout string
+	// Whether to add a read-only directory ".server" to the root of every user, which contains generated files
+	// about the permissions, the quota and the session of the user as well as the version of the server.
+	StatusDirectory bool
+	// Whether to add a read-only file ".quota" to the root of every user, which shows the used and available space
+	// as well as the number of files of every served directory.
+	QuotaFile bool
+	// The directory the private directories of sessions (see SessionTmp) are created in. If empty, the temporary
+	// directory of the system is used. Users with RunAs must be able to write into it.
+	SessionTmpDir string
+	// Restricts the names of the files and directories users can create.
+	PathPolicy PathPolicyConfig
+	// The messages clients see instead of the ones of the errors by the language (an empty string for the default
+	// of all users) and the kind of error (see errorMessageKeys), e.g. {"de": {"quota_exceeded": "Kontingent
+	// erschöpft"}}.
+	ErrorMessages map[string]map[string]string
+	// The directory a trace of the operations of every sftp session is recorded to, which can be replayed with the
+	// replay command to reproduce issues. An empty string disables tracing.
+	TraceDirectory string
+	// The users whose sessions are traced. If empty, the sessions of all users are traced.
+	TraceUsers []string
+	// Whether users can replace their AuthorizedKeys by writing the file ".ssh/authorized_keys" in their root, e.g.
+	// to add a new key and remove the old one. Keys that are kept keep their options, new keys cannot have any.
+	// Like with the admin api, the changes are only kept across restarts with a UsersFile or SaveUsersToConfig.
+	// Sessions of keys with options or of certificates cannot replace the keys.
+	KeySelfService bool
+	// The amount of memory (e.g. "256MB") for caching the files of directories with CacheReads. The cache is
+	// shared by all sessions, so files downloaded by many of them are only read once. Changes require a restart.
+	ReadCacheSize string
+	// The interval (e.g. "1h") in which the keys of the AuthorizedKeysURL and the GithubUser of a user are
+	// fetched again. Defaults to "10m".
+	AuthorizedKeysRefresh string
+	// The file this config has been loaded from.
+	filename string
 }
 
 // UserEntry contains the setting of the sftp connection for a particular user.
@@ -39,9 +212,45 @@ type UserEntry struct {
 	// This list contains the actual public keys (not the filename) formatted
 	// in the same way the "authorized_keys" lines are formatted.
 	AuthorizedKeys []string
+	// Files in the "authorized_keys" format with further keys of this user, e.g. "/home/%u/.ssh/authorized_keys".
+	// "%u" is replaced by the username. The files are read again whenever they have been changed.
+	AuthorizedKeysFile []string
+	// URLs serving further keys of this user in the "authorized_keys" format, e.g. "https://keys.example.com/%u".
+	// "%u" is replaced by the username. The keys are fetched again after AuthorizedKeysRefresh.
+	AuthorizedKeysURL []string
+	// The name of a GitHub account whose public keys (https://github.com/<name>.keys) this user can log in with.
+	GithubUser string
+	// The bcrypt or argon2 hash of the password this user can authenticate with. If empty, password authentication
+	// is not possible for this user.
+	PasswordHash string
+	// A list of authentication methods that are required to log in, similar to the AuthenticationMethods option
+	// of OpenSSH. Every entry is a comma separated list of methods ("publickey", "password" or "keyboard-interactive") which all must succeed
+	// in the given order, e.g. "publickey,password". The user is authenticated if any entry has succeeded.
+	// If empty, every method set up for this user is sufficient on its own.
+	AuthenticationMethods []string
+	// Whether this user is not allowed to log in.
+	Disabled bool
+	// The networks (e.g. "10.0.0.0/8" or a single address like "192.168.1.5") this user can log in from.
+	// If empty, every address is allowed.
+	AllowedCIDRs []string
+	// The networks this user cannot log in from, even if they are part of the AllowedCIDRs.
+	DeniedCIDRs []string
+	// Whether the user can log in with the OIDC provider of the config. The client is shown a url to
+	// complete the login in a browser (using keyboard-interactive authentication).
+	OIDCLogin bool
+	// The base32 secret of an authenticator app (TOTP). If set, the user is asked for the current code of the app
+	// (using keyboard-interactive authentication) after the other methods have succeeded. Every entry of
+	// AuthenticationMethods must then end with "keyboard-interactive" after another method.
+	TOTPSecret string
+	// A command that is run for every file the user has uploaded. Can be overridden for a directory.
+	OnUpload OnUploadConfig
 	// The directories we serve to the user. All are listed under a specific name in a virtual root directory.
 	// If a directory is listed under an empty key "", this directory is served only without a virtual root filesystem.
 	Filesystem map[string]SFTPEntry
+	// Whether every sftp session gets a private, initially empty directory "tmp" in its root, e.g. as scratch space
+	// or to stage uploads before moving them into place. It is removed along with its content once the session ends.
+	// CanRead and CanWrite apply to it like to any other directory. Cannot be used with Chroot.
+	SessionTmp bool
 	// List of strings containing regular expression for files that can be read. E.g. ".*" to allow all files to be read.
 	// This regular expression are matched against the path relative to (virtual) root directory served to the user.
 	CanRead []string
@@ -51,16 +260,157 @@ type UserEntry struct {
 	// List of strings containing regular expression for files should be hidden.
 	// This regular expression are matched against the path relative to (virtual) root directory served to the user.
 	ShouldHide []string
+	// Replace CanRead, CanWrite and ShouldHide for the sessions logged in with an authorized key whose comment
+	// matches. The first matching entry is used.
+	KeyPermissions []KeyPermissions
+	// Whether to hide all files and directories whose name starts with a dot (e.g. ".git" or ".bashrc").
+	HideDotfiles bool
+	// Whether operations that CanRead, CanWrite, ShouldHide or HideDotfiles would deny are allowed and only
+	// reported, so new regular expressions can be tried out with real clients.
+	AuditOnly bool
+	// Makes this user an auditor of the users named here ("*" for everyone): their entries of the csv and json
+	// files of the AccessLog can be read from the read-only "access-logs" directory. Not supported with RunAs.
+	AuditUsers []string
+	// Like AuditUsers, but for the members of these Groups.
+	AuditGroups []string
+	// The umask applied to the permissions of newly created files (0666) and directories (0777).
+	// If not set, new files are created with 0644 and new directories with 0755.
+	Umask *uint32
+	// If not zero, newly created files get exactly this permission regardless of Umask.
+	ForceFileMode uint32
+	// If not zero, newly created directories get exactly this permission regardless of Umask.
+	ForceDirMode uint32
 	// Whether to enable webdav for this user
 	WebDav bool
+	// The virtual port the webdav server of this user can be forwarded from. Zero uses the WebDavPort of the
+	// config, or a port of its own with WebDavAutoPort.
+	WebDavPort uint32
+	// The maximal number of files and directories this user can have in all served directories. Zero means no limit.
+	MaxFiles int64
+	// The number of files and directories in all served directories above which the user is warned and further
+	// files can only be created during the QuotaGracePeriod. Zero means no soft limit.
+	SoftMaxFiles int64
+	// The maximal total size (e.g. "10GB") of the files this user can have in all served directories. An empty
+	// string means no limit.
+	MaxBytes string
+	// The maximal size (e.g. "2GB") of a single file this user can write. An empty string means no limit.
+	MaxFileSize string
+	// The language of the ErrorMessages this user sees. An empty string uses the default messages.
+	Language string
+	// How long (e.g. "72h") files can be created above SoftMaxFiles of the user or its directories. Defaults to
+	// a week.
+	QuotaGracePeriod string
+	// The maximal number of sftp sessions this user can have at the same time. Zero means no limit.
+	MaxSessions int
+	// The maximal number of bytes per second (e.g. "1MB") this user can read and write across all of its
+	// sftp and webdav connections. An empty string means no limit.
+	MaxBandwidth string
+	// The maximal number of bytes per second this user can read (download) across all of its connections. An
+	// empty string means no limit.
+	MaxDownloadBandwidth string
+	// The maximal number of bytes per second this user can write (upload) across all of its connections. An
+	// empty string means no limit.
+	MaxUploadBandwidth string
+	// Further wrappers around the served filesystem in this order (the first is the innermost), each given by its
+	// name and its parameter like "throttle: 5MBps" (see fsWrappers). The permissions are applied last unless
+	// "perm" is listed.
+	Wrappers []string
+	// Whether the user may request ssh agent forwarding.
+	AllowAgentForwarding bool
+	// Whether the user may request X11 forwarding. Note that X11 forwarding is not supported by the server,
+	// so even allowed requests fail.
+	AllowX11Forwarding bool
+	// Whether the user may request a pseudo terminal.
+	AllowPty bool
+	// The name of an OS account. If set, every sftp session of this user is served in its own process running
+	// as this account. This requires the server to run as root and is not supported on windows.
+	RunAs string
+	// Whether the process of a sftp session changes its root directory into the one served directory of this user.
+	// Requires RunAs and exactly one entry in Filesystem.
+	Chroot bool
+	// The AuthorizedKeys parsed when the entry has been stored (see withParsedKeys).
+	parsedKeys *parsedKeys
 }
 
 // SFTPEntry contains information about a served directory
 type SFTPEntry struct {
-	// The root path which contents should be served
+	// The root path which contents should be served. "%u" is replaced by the username.
 	Root string
+	// Whether to create the root directory (including its parents) if it does not exist on login.
+	CreateRootIfMissing bool
+	// The permission of a root directory created due to CreateRootIfMissing. Defaults to 0755.
+	RootMode uint32
+	// The owner of a root directory created due to CreateRootIfMissing, either "user" or "user:group".
+	// "%u" is replaced by the username. If empty, the owner is not changed.
+	RootOwner string
 	// Whether to serve this directory without any writing-permissions. Has some overlaps with CanWrite (see above).
 	ReadOnly bool
+	// A file with a hex encoded AES key of 16, 24 or 32 bytes (e.g. created with "openssl rand -hex 32"). If set,
+	// the content of all files is stored encrypted in this directory, and files stored without encryption cannot
+	// be read.
+	EncryptionKeyFile string
+	// Whether the names of files and directories are encrypted as well. Requires an EncryptionKeyFile.
+	EncryptNames bool
+	// Whether to report every file as owned by VirtualUID and VirtualGID instead of its real owner.
+	SquashOwner bool
+	// The user id every file is reported with if SquashOwner is true.
+	VirtualUID uint32
+	// The group id every file is reported with if SquashOwner is true.
+	VirtualGID uint32
+	// Whether to silently ignore ownership changes (chown) requested by a client instead of failing.
+	IgnoreChown bool
+	// The maximal number of files and directories within this directory. Zero means no limit.
+	MaxFiles int64
+	// The number of files and directories within this directory above which files can only be created during the
+	// QuotaGracePeriod of the user. Zero means no soft limit.
+	SoftMaxFiles int64
+	// Whether to cache the content of files read from this directory (see ReadCacheSize).
+	CacheReads bool
+	// Whether to maintain a SHA256SUMS file in every directory that lists the checksums of its files.
+	// It is updated whenever a file is uploaded, renamed or removed.
+	ChecksumManifest bool
+	// A command that is run for every file uploaded into this directory instead of the OnUpload command of the user.
+	OnUpload OnUploadConfig
+	// A remote sftp server this directory is relayed to. If set, Root is the path on this server.
+	Upstream UpstreamConfig
+	// A container of the Azure Blob Storage this directory is stored in. If set, Root is the prefix of the blobs.
+	Azure AzureConfig
+	// A bucket of the Google Cloud Storage this directory is stored in. If set, Root is the prefix of the objects.
+	GCS GCSConfig
+	// A block device (e.g. "/dev/sdb") or a disk image that is served read-only as the only file of this directory
+	// instead of the files of Root.
+	Device string
+	// The directory with the snapshots of a btrfs or ZFS filesystem (e.g. "/tank/home/.zfs/snapshot"), which are
+	// served read-only as one directory per snapshot instead of the files of Root. Root is the directory within
+	// every snapshot then (e.g. "%u").
+	Snapshots string
+	// A zip or tar.gz archive (e.g. "/srv/releases/sources.zip") whose content is served read-only instead of the
+	// files of Root, without extracting it.
+	Archive string
+	// The maximal size (e.g. "64MB") of a directory that is kept in memory instead of the files of Root, e.g. for
+	// scratch space that must not be written to a disk. Its files are shared by all sessions of the user and lost on
+	// restart.
+	Memory string
+	// A directory on this machine (e.g. a base dataset shared by all users) whose files are served read-only below
+	// the files of Root, like overlayfs. All changes are written to Root, files removed from Lower are hidden by
+	// whiteouts in Root.
+	Lower string
+	// The automatic removal of old files within this directory.
+	Retention RetentionConfig
+	// Whether to publish every change within this directory, including those made outside of sshtool, as an event
+	// (see the /api/events stream of the admin api). Only directories on this machine can be watched.
+	Watch bool
+	// The maximal duration (e.g. "30s") of every operation on this directory, like reading a chunk or listing a
+	// directory. Operations taking longer fail, so a hanging server or storage does not block the session. They
+	// are aborted on upstream servers (by closing the connection) and cloud storages. Other operations keep
+	// running in the background, but once too many do so, further ones fail right away. An empty string means
+	// no limit.
+	OperationTimeout string
+	// Rejects all operations on this directory for a while after its backend has failed repeatedly.
+	CircuitBreaker CircuitBreakerConfig
+	// Recurring periods in which this directory is read-only, e.g. while a release is published. The directory can
+	// also be frozen at runtime with the admin api.
+	FreezeSchedule []FreezeWindow
 }
 
 // DefaultSftpConfig creates a ConfigSftp with some default parameters.
@@ -68,50 +418,23 @@ func DefaultSftpConfig() ConfigSftp {
 	return ConfigSftp{
 		Config:     DefaultConfig(),
 		WebDavPort: 80,
+		UsageFile:  "usage.json",
 		Users: map[string]UserEntry{
 			"user": {
 				AuthorizedKeys: []string{"ssh-key AAANCC someone@somehwere"},
 				Filesystem: map[string]SFTPEntry{
 					"": {Root: "/", ReadOnly: true},
 				},
-				CanRead:    []string{".*"},
-				CanWrite:   []string{".*"},
-				ShouldHide: []string{},
-				WebDav:     false,
+				CanRead:      []string{".*"},
+				CanWrite:     []string{".*"},
+				ShouldHide:   []string{},
+				HideDotfiles: false,
+				WebDav:       false,
 			},
 		},
 	}
 }
 
-// Returns a function that checks if a public key from a user matches one authorized key from the config
-// for this user.
-func (c *ConfigSftp) buildKeyValidationFunc() (func(username string, key gssh.PublicKey) bool, error) {
-	// We build a map in which we enumerate all parsed public keys accepted for a particular user.
-	keysPerUser := make(map[string][]ssh.PublicKey)
-	for username, entry := range c.Users {
-		keys := make([]ssh.PublicKey, len(entry.AuthorizedKeys))
-		for i, keyString := range entry.AuthorizedKeys {
-			allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
-			if err != nil {
-				return nil, err
-			}
-			keys[i] = allowed
-		}
-		keysPerUser[username] = keys
-	}
-	// The validation function than simple checks if the public key from the user matches any of the allowed one.
-	return func(username string, key gssh.PublicKey) bool {
-		if keys, ok := keysPerUser[username]; ok {
-			for _, publicKey := range keys {
-				if gssh.KeysEqual(publicKey, key) {
-					return true
-				}
-			}
-		}
-		return false
-	}, nil
-}
-
 // ContextSftp contains some information for a serving sftp server.
 type ContextSftp struct {
 	// The config this app has.
@@ -125,24 +448,530 @@ type ContextSftp struct {
 	accessLogger logger.AccessLogger
 	// Object to log debug and errors.
 	logger logger.Logger
+	// State shared by all filesystems created for the users.
+	shared fsShared
+	// Live statistics about all active sessions.
+	stats *stats.Registry
+	// Counts the open channels of every connection (for MaxChannelsPerConnection).
+	channels *mware.ChannelCounter
+	// The parsed AuthorizedKeysFile of the users.
+	keyFiles *authorizedKeysFiles
+	// The keys fetched from the AuthorizedKeysURL of the users.
+	keyURLs *authorizedKeysURLCache
+	// The users looked up in the LDAP server.
+	ldapUsers *userCache
+	// The users looked up in the UserStore.
+	storeUsers *userCache
+	// Checks the codes for the TOTPSecret of the users.
+	totp *totpVerifier
+	// The provider for the OIDC login. Nil if not configured.
+	oidc *oidc.Provider
+	// Manages the certificates of the http listeners. Nil if ACME is not configured.
+	acme *autocert.Manager
+	// The addresses connections are rejected from.
+	bans *admin.BanList
+	// Bans addresses after too many failed logins. Nil if disabled.
+	autoBan *autoBan
+	// Holds up the connections of banned and suspicious addresses. Nil if disabled.
+	tarpit *tarpit
+	// The time the context has been created.
+	start time.Time
+	// Keeps the latest entries of the accessLogger for the admin api.
+	recentAccess *logger.RecentAccessLogger
+	// Receives the entries of the logger and the accessLogger to follow them with the admin api.
+	logs *logger.Stream
+	// The latest login of every user.
+	lastLogins lastLoginStore
+	// Whether new connections are rejected (1) or not (0). Must be accessed atomically.
+	maintenance int32
+	// Protects config, which is replaced when the config file is reloaded, and config.Users, which may be changed
+	// at runtime. The map itself is never modified but replaced.
+	usersMutex sync.RWMutex
+	// The state shared with other servers. Nil if not configured.
+	cluster *clusterState
+	// Resolves the hostnames of the clients (for ResolveHostnames). Nil if disabled.
+	hostnames *hostnameCache
+}
+
+// SetFSFactory sets a function that creates the served directories for every new connection instead of the
+// Filesystem entries of the config. The returned filesystem is still wrapped according to the other settings of
+// the user (like CanRead or MaxBandwidth). It must be called before Listen.
+func (c *ContextSftp) SetFSFactory(factory sftp2.FSFactory) {
+	c.shared.factory = factory
+}
+
+// fsShared contains the objects shared between all filesystems created for the users.
+type fsShared struct {
+	// Tracks the number of files per user and mount (for MaxFiles).
+	usage sftp2.UsageStore
+	// The token buckets for limiting the bandwidth (for MaxBandwidth).
+	bandwidth *bandwidthLimits
+	// The mounted directories of every user, which may be changed at runtime. May be nil.
+	mounts *mountTables
+	// Creates the served directories for a connection instead of the config. May be nil.
+	factory sftp2.FSFactory
+	// Receives events like found viruses. May be nil.
+	events *events.Bus
+	// Limits the number of OnUpload commands running at the same time.
+	uploadCommands chan struct{}
+	// The circuit breakers of the directories (for CircuitBreaker). May be nil.
+	breakers *circuitBreakers
+	// The timed out operations still running in the directories (for OperationTimeout). May be nil.
+	hanging *hangingOperations
+	// The freezes of the directories (for FreezeSchedule and the admin api). May be nil.
+	freezes *mountFreezes
+	// The availability of the served directories (for HealthCheckInterval). May be nil.
+	health *mountHealth
+	// The directories kept in memory (for Memory). May be nil.
+	memories *memoryDirs
+	// The cache for the directories with CacheReads. May be nil.
+	readCache *sftp2.BlockCache
+	// The virtual ports of the webdav servers by username (see webDavPorts). May be nil.
+	webDavPorts map[string]uint32
+	// The files currently opened for reading in all served directories. May be nil.
+	readers *sftp2.OpenReaders
+	// The connections to upstream servers and cloud storages. May be nil.
+	backends *backendPools
+	// Collects the uploaded files for the UploadDigest. May be nil.
+	digest *uploadDigest
+}
+
+// mountTables holds a mount table for every user, so directories mounted at runtime are visible to all of
+// its sessions. Sessions whose directories depend on the connection get a table of their own, which is kept
+// here until the session ends, so directories mounted at runtime reach them too.
+type mountTables struct {
+	// Protects perUser and perSession
+	mutex   sync.Mutex
+	perUser map[string]*sftp2.MountTable
+	// The tables of the sessions by username and session id.
+	perSession map[string]map[uint64]sessionMounts
+}
+
+// sessionMounts is the mount table of a single session along with its connection.
+type sessionMounts struct {
+	info  logger.ConnectionInfo
+	table *sftp2.MountTable
+}
+
+// newMountTables creates an empty mountTables.
+func newMountTables() *mountTables {
+	return &mountTables{perUser: map[string]*sftp2.MountTable{}, perSession: map[string]map[uint64]sessionMounts{}}
+}
+
+// tableFor returns the mount table of the user of the connection. If there is none yet, it is created
+// with the filesystems returned by create. If perConnection is set, every session gets a new table, which
+// is kept until release is called for it.
+func (m *mountTables) tableFor(info logger.ConnectionInfo, perConnection bool, create func() (map[string]sftp2.SimplifiedFS, error)) (*sftp2.MountTable, error) {
+	if m == nil {
+		dirs, err := create()
+		if err != nil {
+			return nil, err
+		}
+		return sftp2.NewMountTable(dirs), nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if perConnection {
+		dirs, err := create()
+		if err != nil {
+			return nil, err
+		}
+		table := sftp2.NewMountTable(dirs)
+		if m.perSession[info.Username] == nil {
+			m.perSession[info.Username] = map[uint64]sessionMounts{}
+		}
+		m.perSession[info.Username][info.SessionID] = sessionMounts{info, table}
+		return table, nil
+	}
+	if table, ok := m.perUser[info.Username]; ok {
+		return table, nil
+	}
+	dirs, err := create()
+	if err != nil {
+		return nil, err
+	}
+	table := sftp2.NewMountTable(dirs)
+	m.perUser[info.Username] = table
+	return table, nil
+}
+
+// release removes the table of the session of the connection, if it has one of its own.
+func (m *mountTables) release(info logger.ConnectionInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.perSession[info.Username], info.SessionID)
+	if len(m.perSession[info.Username]) == 0 {
+		delete(m.perSession, info.Username)
+	}
+}
+
+// get returns the mount tables of the given user that have been created already along with the connection
+// their directories are created for.
+func (m *mountTables) get(username string) []sessionMounts {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var tables []sessionMounts
+	if table, ok := m.perUser[username]; ok {
+		tables = append(tables, sessionMounts{logger.ConnectionInfo{Username: username}, table})
+	}
+	for _, session := range m.perSession[username] {
+		tables = append(tables, session)
+	}
+	return tables
+}
+
+// forget removes the shared mount table of the given user, so it is created anew for the next session.
+func (m *mountTables) forget(username string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.perUser, username)
+}
+
+// forgetAll removes the shared mount tables of all users.
+func (m *mountTables) forgetAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.perUser = map[string]*sftp2.MountTable{}
+}
+
+// bandwidthLimits holds the token buckets shared by all connections to enforce the MaxBandwidth,
+// MaxDownloadBandwidth and MaxUploadBandwidth settings. Changed limits also apply to running sessions, while
+// limits that have not been set before only apply to new sessions.
+type bandwidthLimits struct {
+	// Protects the fields below
+	mutex sync.Mutex
+	// The buckets shared by all users for reads and writes, only reads and only writes. Nil if there is no limit.
+	global, globalRead, globalWrite *sftp2.TokenBucket
+	// The buckets shared by all connections of a user by the username and the kind of limit ("", "#read" or
+	// "#write").
+	perUser map[string]*sftp2.TokenBucket
+}
+
+// Creates a bucket for the given rate, or returns nil if the rate is empty.
+func newRateBucket(rate string) (*sftp2.TokenBucket, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	bytesPerSecond, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	return sftp2.NewTokenBucket(bytesPerSecond), nil
+}
+
+// Changes the rate of the bucket or creates one if it is nil. An empty rate removes the limit of the bucket.
+// The rate must have been checked by parseRate.
+func setRate(bucket *sftp2.TokenBucket, rate string) *sftp2.TokenBucket {
+	if rate == "" {
+		if bucket != nil {
+			bucket.SetRate(0)
+		}
+		return bucket
+	}
+	bytesPerSecond, _ := parseRate(rate)
+	if bucket == nil {
+		return sftp2.NewTokenBucket(bytesPerSecond)
+	}
+	bucket.SetRate(bytesPerSecond)
+	return bucket
+}
+
+// newBandwidthLimits creates the bandwidthLimits with the global limits from the config.
+func newBandwidthLimits(c *ConfigSftp) (*bandwidthLimits, error) {
+	limits := &bandwidthLimits{perUser: map[string]*sftp2.TokenBucket{}}
+	var err error
+	if limits.global, err = newRateBucket(c.MaxBandwidth); err != nil {
+		return nil, err
+	}
+	if limits.globalRead, err = newRateBucket(c.MaxDownloadBandwidth); err != nil {
+		return nil, err
+	}
+	if limits.globalWrite, err = newRateBucket(c.MaxUploadBandwidth); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// Returns the limits of the user by the keys of perUser.
+func userRates(username string, userEntry UserEntry) map[string]string {
+	return map[string]string{
+		username:            userEntry.MaxBandwidth,
+		username + "#read":  userEntry.MaxDownloadBandwidth,
+		username + "#write": userEntry.MaxUploadBandwidth,
+	}
+}
+
+// update applies the global limits of the reloaded config and the limits of all users with buckets, whose current
+// entries are returned by userEntry.
+func (b *bandwidthLimits) update(c *ConfigSftp, userEntry func(username string) (UserEntry, bool)) {
+	b.mutex.Lock()
+	b.global = setRate(b.global, c.MaxBandwidth)
+	b.globalRead = setRate(b.globalRead, c.MaxDownloadBandwidth)
+	b.globalWrite = setRate(b.globalWrite, c.MaxUploadBandwidth)
+	usernames := map[string]bool{}
+	for key := range b.perUser {
+		usernames[strings.TrimSuffix(strings.TrimSuffix(key, "#read"), "#write")] = true
+	}
+	b.mutex.Unlock()
+	// Looking up users may take a while, so the buckets are not locked meanwhile.
+	for username := range usernames {
+		// Sessions of removed users keep their limits.
+		if entry, ok := userEntry(username); ok {
+			b.updateUser(username, entry)
+		}
+	}
+}
+
+// updateUser applies the changed limits of the user to the buckets of its running sessions.
+func (b *bandwidthLimits) updateUser(username string, userEntry UserEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, rate := range userRates(username, userEntry) {
+		if bucket, ok := b.perUser[key]; ok {
+			setRate(bucket, rate)
+		}
+	}
+}
+
+// Appends the global bucket (if any) and the bucket of the user for the given kind and rate (if any) to buckets.
+// The rate of an existing bucket of the user is updated. b.mutex must be locked.
+func (b *bandwidthLimits) appendBuckets(buckets []*sftp2.TokenBucket, global *sftp2.TokenBucket, key string, rate string) ([]*sftp2.TokenBucket, error) {
+	if global != nil {
+		buckets = append(buckets, global)
+	}
+	if bucket, ok := b.perUser[key]; ok {
+		// Entries of users that are not in the config may have changed since the last session.
+		setRate(bucket, rate)
+		return append(buckets, bucket), nil
+	}
+	if rate == "" {
+		return buckets, nil
+	}
+	bucket, err := newRateBucket(rate)
+	if err != nil {
+		return nil, err
+	}
+	b.perUser[key] = bucket
+	return append(buckets, bucket), nil
+}
+
+// throttle wraps fs into a ThrottledFS with all token buckets that limit the bandwidth of the given user, if any.
+func (b *bandwidthLimits) throttle(fs sftp2.SimplifiedFS, username string, userEntry UserEntry) (sftp2.SimplifiedFS, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	throttled := sftp2.ThrottledFS{Inner: fs}
+	var err error
+	if throttled.Buckets, err = b.appendBuckets(nil, b.global, username, userEntry.MaxBandwidth); err != nil {
+		return nil, err
+	}
+	if throttled.ReadBuckets, err = b.appendBuckets(nil, b.globalRead, username+"#read", userEntry.MaxDownloadBandwidth); err != nil {
+		return nil, err
+	}
+	if throttled.WriteBuckets, err = b.appendBuckets(nil, b.globalWrite, username+"#write", userEntry.MaxUploadBandwidth); err != nil {
+		return nil, err
+	}
+	if len(throttled.Buckets) == 0 && len(throttled.ReadBuckets) == 0 && len(throttled.WriteBuckets) == 0 {
+		return fs, nil
+	}
+	return throttled, nil
 }
 
 // Creates a (possible virtual) root [sftp2.SimplifiedFS] from a UserEntry, which describes the directories
 // to serve along with access information.
 // The returning fs has no permission check yet. So it usually needs to be wrapped into a [sftp2.PermWrapperFS]
-func (c *ConfigSftp) createFSWithoutPermission(userEntry UserEntry) sftp2.SimplifiedFS {
+func (c *ConfigSftp) createFSWithoutPermission(info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+	username := info.Username
+	var fs sftp2.SimplifiedFS
 	if entry, ok := userEntry.Filesystem[""]; ok {
 		// We serve only one fs at the top
-		return sftp2.DirFs{Root: entry.Root, Readonly: entry.ReadOnly}
+		mountFS, err := c.createMountFS(info, "", userEntry, entry, shared)
+		if err != nil {
+			return nil, err
+		}
+		fs = mountFS
+	} else {
+		// We must create a virtual fs that servers every directory.
+		// All sessions of the user share the mounts, so they can be changed at runtime. Directories depending on the
+		// connection are created for every session instead.
+		perConnection := userEntry.mountsPerConnection() && info.SessionID != 0
+		table, err := shared.mounts.tableFor(info, perConnection, func() (map[string]sftp2.SimplifiedFS, error) {
+			// Shared directories must not depend on the connection.
+			mountInfo := info
+			if shared.mounts != nil && !perConnection {
+				mountInfo = logger.ConnectionInfo{Username: username}
+			}
+			fsMap := make(map[string]sftp2.SimplifiedFS)
+			for path, entry := range userEntry.Filesystem {
+				mountFS, err := c.createMountFS(mountInfo, path, userEntry, entry, shared)
+				if err != nil {
+					return nil, err
+				}
+				fsMap[path] = mountFS
+			}
+			return fsMap, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		fs = sftp2.CombinedFS{
+			Mounts:          table,
+			Unavailable:     shared.health.unavailableFunc(username),
+			ShowUnavailable: c.ShowUnavailableMounts,
+		}
 	}
-	// We must create a virtual fs that servers every directory
-	fsMap := make(map[string]sftp2.SimplifiedFS)
-	for path, entry := range userEntry.Filesystem {
-		fsMap[path] = sftp2.DirFs{
-			Root: entry.Root, Readonly: entry.ReadOnly,
+	if userEntry.MaxFiles > 0 || userEntry.SoftMaxFiles > 0 || userEntry.MaxBytes != "" {
+		quota := userEntry.limitFiles(fs, shared, username, "/", username, userEntry.MaxFiles, userEntry.SoftMaxFiles)
+		quota.MaxBytes = userEntry.maxBytes()
+		return quota, nil
+	}
+	return fs, nil
+}
+
+// mountsPerConnection tells whether the directories of the user depend on the connection, as the OnUpload commands
+// get the address of the client and the session. Such directories cannot be shared by the sessions of the user.
+func (u UserEntry) mountsPerConnection() bool {
+	if len(u.OnUpload.Command) > 0 {
+		return true
+	}
+	for _, entry := range u.Filesystem {
+		if len(entry.OnUpload.Command) > 0 {
+			return true
 		}
 	}
-	return sftp2.CombinedFS{Dirs: fsMap}
+	return false
+}
+
+// Returns the permissions for newly created files and directories according to the Umask, ForceFileMode and
+// ForceDirMode setting. Nil means the default one should be used, as a umask like 0o777 results in the valid
+// permission 0.
+func (u UserEntry) creationModes() (fileMode *os.FileMode, dirMode *os.FileMode) {
+	if u.Umask != nil {
+		file, dir := os.FileMode(0o666&^*u.Umask).Perm(), os.FileMode(0o777&^*u.Umask).Perm()
+		fileMode, dirMode = &file, &dir
+	}
+	if u.ForceFileMode != 0 {
+		file := os.FileMode(u.ForceFileMode).Perm()
+		fileMode = &file
+	}
+	if u.ForceDirMode != 0 {
+		dir := os.FileMode(u.ForceDirMode).Perm()
+		dirMode = &dir
+	}
+	return fileMode, dirMode
+}
+
+// Creates the [sftp2.SimplifiedFS] for a single served directory described by the given SFTPEntry,
+// which is served under the given name to the user of the connection. Directories not created for a single
+// connection only get the Username.
+func (c *ConfigSftp) createMountFS(info logger.ConnectionInfo, name string, userEntry UserEntry, entry SFTPEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+	username := info.Username
+	entry.Root = entry.rootFor(username)
+	store, err := shared.backends.objectStore(entry, c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	// Whether the directory is on this machine.
+	local := entry.Upstream.Address == "" && store == nil && entry.Device == "" && entry.Snapshots == "" &&
+		entry.Archive == "" && entry.Memory == ""
+	var fs sftp2.SimplifiedFS
+	switch {
+	case entry.Device != "":
+		fs = sftp2.DeviceFS{Path: entry.Device}
+	case entry.Snapshots != "":
+		fs = sftp2.SnapshotFS{Dir: entry.Snapshots, Path: entry.Root}
+	case entry.Archive != "":
+		fs = shared.backends.archiveFS(entry.Archive)
+	case entry.Memory != "":
+		// The config has been validated before, so we can ignore the error here.
+		size, _ := parseByteSize(entry.Memory)
+		fs = shared.memories.forMount(username, name, int64(size))
+	case entry.Upstream.Address != "":
+		fs = shared.backends.remoteFS(username, entry, c.Proxy)
+	case store != nil:
+		fs = sftp2.ObjectFS{Store: store, Root: strings.Trim(entry.Root, "/"), Readonly: entry.ReadOnly}
+	default:
+		if entry.CreateRootIfMissing {
+			if err := entry.createRoot(username); err != nil {
+				return nil, fmt.Errorf("cannot create %s: %v", entry.Root, err)
+			}
+		}
+		fileMode, dirMode := userEntry.creationModes()
+		fs = sftp2.DirFs{Root: entry.Root, Readonly: entry.ReadOnly, FileMode: fileMode, DirMode: dirMode}
+		if entry.Lower != "" {
+			lower := sftp2.DirFs{Root: strings.TrimSuffix(filepath.ToSlash(entry.Lower), "/") + "/", Readonly: true}
+			fs = sftp2.OverlayFS{Upper: fs, Lower: lower}
+		}
+	}
+	if entry.OperationTimeout != "" {
+		// Directly wraps the backend, so remote servers and cloud storages can abort the operation.
+		// The config has been validated before, so we can ignore the error here.
+		timeout, _ := time.ParseDuration(entry.OperationTimeout)
+		fs = sftp2.TimeoutFS{Inner: fs, Timeout: timeout, Hanging: shared.hanging.forMount(username, name)}
+	}
+	if shared.readers != nil && entry.Memory == "" {
+		// Parallel downloads of the same file share its open handle on the backend. Files in memory need no handle.
+		fs = sftp2.SharedFS{Inner: fs, Readers: shared.readers, Key: entry.cacheKey(username)}
+	}
+	if fs, err = entry.encryptedFS(fs); err != nil {
+		return nil, err
+	}
+	if entry.CircuitBreaker.Failures > 0 {
+		fs = sftp2.CircuitBreakerFS{Inner: fs, Breaker: shared.breakers.breakerFor(username, name, entry.CircuitBreaker)}
+	}
+	if entry.CacheReads && shared.readCache != nil && entry.Memory == "" {
+		fs = sftp2.CachedFS{Inner: fs, Cache: shared.readCache, Key: entry.cacheKey(username)}
+	}
+	if entry.SquashOwner || entry.IgnoreChown {
+		fs = sftp2.OwnershipFS{
+			Inner:       fs,
+			Squash:      entry.SquashOwner,
+			UID:         entry.VirtualUID,
+			GID:         entry.VirtualGID,
+			IgnoreChown: entry.IgnoreChown,
+		}
+	}
+	if c.MinFreeSpace != "" && !entry.ReadOnly && local {
+		// The config has been validated before, so we can ignore the error here.
+		minBytes, minPercent, _ := parseSizeOrPercent(c.MinFreeSpace)
+		fs = sftp2.FreeSpaceFS{
+			Inner:          fs,
+			Path:           entry.Root,
+			MinFreeBytes:   minBytes,
+			MinFreePercent: minPercent,
+		}
+	}
+	if entry.ChecksumManifest && !entry.ReadOnly {
+		manifest := sftp2.ChecksumManifest{OnError: func(path string, err error) {
+			shared.events.Publish(events.Event{
+				Type:     events.ManifestFailed,
+				Username: username,
+				Path:     path,
+				Message:  err.Error(),
+			})
+		}}
+		fs = sftp2.HookFS{
+			Inner:       fs,
+			AfterWrite:  []sftp2.WriteHook{manifest.Written},
+			AfterRemove: []sftp2.WriteHook{manifest.Removed},
+			AfterRename: []sftp2.RenameHook{manifest.Renamed},
+		}
+	}
+	if entry.MaxFiles > 0 || entry.SoftMaxFiles > 0 {
+		fs = userEntry.limitFiles(fs, shared, username, "/"+name, username+"/"+name, entry.MaxFiles, entry.SoftMaxFiles)
+	}
+	onUpload := userEntry.OnUpload
+	if len(entry.OnUpload.Command) > 0 {
+		onUpload = entry.OnUpload
+	}
+	// The command needs a local path of the file with its plaintext.
+	if len(onUpload.Command) > 0 && !entry.ReadOnly && local && entry.EncryptionKeyFile == "" {
+		fs = sftp2.HookFS{Inner: fs, CheckWrite: []sftp2.CheckHook{onUpload.uploadCheck(info, entry.Root, name, shared)}}
+	}
+	// Outermost, so a frozen directory does not run any hooks.
+	if !entry.ReadOnly {
+		fs = sftp2.FreezableFS{Inner: fs, Freeze: shared.freezes.freezeFor(username, name, entry.FreezeSchedule)}
+	}
+	return fs, nil
 }
 
 // Converts an array of strings into a parsed array of regular expressions.
@@ -160,14 +989,104 @@ func intoRegexp(array []string) ([]*regexp.Regexp, error) {
 
 // CreateFS creates a (possible virtual) root [sftp2.SimplifiedFS] from a UserEntry, which describes the directories
 // to serve along with access information. The returning fs also checks the required access permissions for a file.
-func (c *ConfigSftp) CreateFS(username string) (sftp2.SimplifiedFS, error) {
-	userEntry, ok := c.Users[username]
-	if !ok {
-		return nil, fmt.Errorf("user %s has no config entry", username)
+// The directories are created by the factory of shared or the FilesystemCommand instead, if either is set.
+func (c *ConfigSftp) CreateFS(info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+	var fs sftp2.SimplifiedFS
+	var err error
+	switch {
+	case shared.factory != nil:
+		fs, err = shared.factory(info)
+	case len(c.FilesystemCommand) > 0:
+		userEntry.Filesystem, err = c.runFilesystemCommand(info)
+		if err != nil {
+			return nil, err
+		}
+		// The directories may differ for every connection, so they cannot be shared.
+		shared.mounts = nil
+		fs, err = c.createFSWithoutPermission(info, userEntry, shared)
+	default:
+		fs, err = c.createFSWithoutPermission(info, userEntry, shared)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userEntry.SessionTmp && info.SessionID != 0 {
+		if fs, err = c.sessionTmpFS(fs, info, userEntry); err != nil {
+			return nil, err
+		}
+	}
+	fs, permApplied, err := c.wrapFS(fs, info, userEntry, shared)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClamAV.Address != "" {
+		fs = sftp2.HookFS{Inner: fs, CheckWrite: []sftp2.CheckHook{c.ClamAV.virusScanHook(info, shared.events)}}
+	}
+	if shared.digest != nil {
+		fs = sftp2.HookFS{Inner: fs, AfterWrite: []sftp2.WriteHook{shared.digest.hook(info)}}
+	}
+	if c.ProgressInterval != "" || c.ProgressBytes != "" {
+		fs = c.progressFS(fs, info, shared.events)
+	}
+	fs, err = shared.bandwidth.throttle(fs, info.Username, userEntry)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxRequestsPerSession > 0 || c.MaxHandlesPerSession > 0 {
+		fs = sftp2.LimitFS{Inner: fs, Limits: &sftp2.SessionLimits{MaxRequests: c.MaxRequestsPerSession, MaxHandles: c.MaxHandlesPerSession}}
+	}
+	if userEntry.MaxFileSize != "" {
+		// The config has been validated before, so we can ignore the error here.
+		size, _ := parseByteSize(userEntry.MaxFileSize)
+		fs = sftp2.MaxSizeFS{Inner: fs, MaxFileSize: int64(size)}
+	}
+	fs = c.PathPolicy.pathPolicyFS(fs)
+	if !permApplied {
+		if fs, err = c.permissionFS(fs, info, userEntry, shared); err != nil {
+			return nil, err
+		}
+	}
+	if c.StatusDirectory {
+		// Added last, so neither the permissions nor HideDotfiles hide it.
+		fs = c.statusFS(fs, info, userEntry, shared)
+	}
+	if c.QuotaFile {
+		fs = c.quotaFS(fs, info, userEntry, shared)
+	}
+	if userEntry.isAuditor() {
+		fs = c.auditFS(fs, userEntry)
+	}
+	return c.messageFS(fs, userEntry.Language), nil
+}
+
+// permissionFS wraps fs into a [sftp2.PermWrapperFS] for the CanRead, CanWrite, ShouldHide and HideDotfiles
+// settings of the user, or into a [sftp2.ACLWrapperFS] if the ACL applies to the user. Returns fs itself if they
+// allow everything.
+func (c *ConfigSftp) permissionFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+	if c.hasACL(info.Username) {
+		fs = sftp2.ACLWrapperFS{
+			Inner:     fs,
+			Rules:     c.aclRulesFor(info.Username),
+			AuditOnly: userEntry.AuditOnly,
+			OnDenied:  auditDenied(info, shared.events),
+		}
+		// Only HideDotfiles is left to apply.
+		userEntry.CanRead, userEntry.CanWrite, userEntry.ShouldHide = nil, nil, nil
 	}
-	fs := c.createFSWithoutPermission(userEntry)
 	if len(userEntry.ShouldHide) == 0 && len(userEntry.CanRead) == 0 && len(userEntry.CanWrite) == 0 {
-		return fs, nil
+		if !userEntry.HideDotfiles {
+			return fs, nil
+		}
+		// Without any regular expression everything is allowed, we only have to hide the dotfiles.
+		all := []*regexp.Regexp{regexp.MustCompile(".*")}
+		return sftp2.PermWrapperFS{
+			Inner:          fs,
+			CanReadRegexp:  all,
+			CanWriteRegexp: all,
+			HideDotfiles:   true,
+			AuditOnly:      userEntry.AuditOnly,
+			OnDenied:       auditDenied(info, shared.events),
+		}, nil
 	}
 	canReadRegexp, err := intoRegexp(userEntry.CanRead)
 	if err != nil {
@@ -186,9 +1105,25 @@ func (c *ConfigSftp) CreateFS(username string) (sftp2.SimplifiedFS, error) {
 		CanReadRegexp:    canReadRegexp,
 		CanWriteRegexp:   canWriteRegexp,
 		ShouldHideRegexp: shouldHideRegexp,
+		HideDotfiles:     userEntry.HideDotfiles,
+		AuditOnly:        userEntry.AuditOnly,
+		OnDenied:         auditDenied(info, shared.events),
 	}, nil
 }
 
+// auditDenied returns a function publishing the operations the permissions of a user in AuditOnly mode would deny.
+func auditDenied(info logger.ConnectionInfo, bus *events.Bus) func(operation string, path string) {
+	return func(operation string, path string) {
+		bus.Publish(events.Event{
+			Type:     events.PermissionAudit,
+			Username: info.Username,
+			IP:       info.IP,
+			Path:     path,
+			Message:  operation + " would be denied",
+		})
+	}
+}
+
 // LoadConfigSftp loads and parses a toml file that contains the configuration for creating a sftp server.
 func LoadConfigSftp(filename string) (ConfigSftp, error) {
 	var c ConfigSftp
@@ -198,41 +1133,456 @@ func LoadConfigSftp(filename string) (ConfigSftp, error) {
 	}
 	//err = json.Unmarshal(data, &c)
 	err = toml.Unmarshal(data, &c)
-	return c, err
+	if err != nil {
+		return c, err
+	}
+	c.filename = filename
+	if err := c.loadIncludes(); err != nil {
+		return c, err
+	}
+	if err := c.loadUsersFile(); err != nil {
+		return c, err
+	}
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	c.parseKeys()
+	return c, nil
+}
+
+// validate checks the config for values that cannot be parsed.
+func (c *ConfigSftp) validate() error {
+	if len(c.Include) > 0 && c.SaveUsersToConfig {
+		// The included users would be saved into this file and defined twice on the next start.
+		return fmt.Errorf("SaveUsersToConfig cannot be used with Include, use a UsersFile instead")
+	}
+	if err := c.validateACL(); err != nil {
+		return err
+	}
+	if err := c.validateTrace(); err != nil {
+		return err
+	}
+	if err := c.PathPolicy.validate(); err != nil {
+		return err
+	}
+	if err := c.validateErrorMessages(); err != nil {
+		return err
+	}
+	if c.MinFreeSpace != "" {
+		if _, _, err := parseSizeOrPercent(c.MinFreeSpace); err != nil {
+			return fmt.Errorf("invalid MinFreeSpace: %v", err)
+		}
+	}
+	for name, rate := range map[string]string{"MaxBandwidth": c.MaxBandwidth, "MaxDownloadBandwidth": c.MaxDownloadBandwidth, "MaxUploadBandwidth": c.MaxUploadBandwidth} {
+		if rate == "" {
+			continue
+		}
+		if _, err := parseRate(rate); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if c.ProgressInterval != "" {
+		if _, err := time.ParseDuration(c.ProgressInterval); err != nil {
+			return fmt.Errorf("invalid ProgressInterval: %v", err)
+		}
+	}
+	if c.HealthCheckInterval != "" {
+		if interval, err := time.ParseDuration(c.HealthCheckInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid HealthCheckInterval %q", c.HealthCheckInterval)
+		}
+	}
+	if c.ProgressBytes != "" {
+		if _, err := parseByteSize(c.ProgressBytes); err != nil {
+			return fmt.Errorf("invalid ProgressBytes: %v", err)
+		}
+	}
+	if c.RekeyThreshold != "" {
+		if threshold, err := parseByteSize(c.RekeyThreshold); err != nil || threshold < 256 {
+			return fmt.Errorf("invalid RekeyThreshold %q, it must be at least 256 bytes", c.RekeyThreshold)
+		}
+	}
+	if c.AuthorizedKeysRefresh != "" {
+		if interval, err := time.ParseDuration(c.AuthorizedKeysRefresh); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid AuthorizedKeysRefresh %q", c.AuthorizedKeysRefresh)
+		}
+	}
+	if c.ResolveTimeout != "" {
+		if timeout, err := time.ParseDuration(c.ResolveTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid ResolveTimeout %q", c.ResolveTimeout)
+		}
+	}
+	if c.ReadCacheSize != "" {
+		if _, err := parseByteSize(c.ReadCacheSize); err != nil {
+			return fmt.Errorf("invalid ReadCacheSize: %v", err)
+		}
+	}
+	if c.MaxRequestsPerSession < 0 || c.MaxHandlesPerSession < 0 {
+		return fmt.Errorf("MaxRequestsPerSession and MaxHandlesPerSession must not be negative")
+	}
+	if c.MaxChannelsPerConnection < 0 {
+		return fmt.Errorf("MaxChannelsPerConnection must not be negative")
+	}
+	if c.MaxTreeSizeEntries < 0 {
+		return fmt.Errorf("MaxTreeSizeEntries must not be negative")
+	}
+	// Replies must fit into the 256KB packets the OpenSSH client accepts, even with long names.
+	if c.ListBatchSize < 0 || c.ListBatchSize > maxListBatchSize {
+		return fmt.Errorf("ListBatchSize must be between 0 and %d", maxListBatchSize)
+	}
+	for _, destination := range c.AccessLog {
+		if err := destination.validate(); err != nil {
+			return err
+		}
+	}
+	if c.AdminAddress != "" && c.AdminToken == "" {
+		return fmt.Errorf("AdminAddress needs an AdminToken")
+	}
+	if err := c.ClamAV.validate(); err != nil {
+		return err
+	}
+	if err := c.UploadDigest.validate(); err != nil {
+		return err
+	}
+	if err := c.ACME.validate(); err != nil {
+		return err
+	}
+	if err := c.Tarpit.validate(); err != nil {
+		return err
+	}
+	if err := c.AutoBan.validate(); err != nil {
+		return err
+	}
+	if _, err := parseAuthorizedKeys(c.TrustedUserCAKeys); err != nil {
+		return fmt.Errorf("invalid TrustedUserCAKeys: %v", err)
+	}
+	if err := c.KeyPolicy.validate(); err != nil {
+		return err
+	}
+	if err := c.Proxy.validate(); err != nil {
+		return err
+	}
+	if err := c.validateLDAP(); err != nil {
+		return err
+	}
+	if err := c.validateUserStore(); err != nil {
+		return err
+	}
+	if c.DefaultUser != nil {
+		if err := c.validateUser("DefaultUser", *c.DefaultUser); err != nil {
+			return err
+		}
+	}
+	if c.UsersDir != "" {
+		if info, err := os.Stat(relativeToConfig(c.filename, c.UsersDir)); err != nil || !info.IsDir() {
+			return fmt.Errorf("the UsersDir %s is not a directory", c.UsersDir)
+		}
+	}
+	// All invalid users are reported at once.
+	var usernames []string
+	for username := range c.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	var errs []error
+	for _, username := range usernames {
+		if err := c.validateUser(username, c.Users[username]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateUser checks the entry of the given user for values that cannot be parsed.
+func (c *ConfigSftp) validateUser(username string, entry UserEntry) error {
+	if _, err := parseAuthorizedKeys(entry.AuthorizedKeys); err != nil {
+		return fmt.Errorf("invalid AuthorizedKeys for user %s: %v", username, err)
+	}
+	if err := checkKeyExpiries(entry.AuthorizedKeys); err != nil {
+		return fmt.Errorf("invalid AuthorizedKeys for user %s: %v", username, err)
+	}
+	if err := entry.validateKeySources(); err != nil {
+		return fmt.Errorf("user %s: %v", username, err)
+	}
+	if entry.PasswordHash != "" {
+		if err := validatePasswordHash(entry.PasswordHash); err != nil {
+			return fmt.Errorf("invalid PasswordHash for user %s: %v", username, err)
+		}
+	}
+	if entry.TOTPSecret != "" {
+		if _, err := decodeTOTPSecret(entry.TOTPSecret); err != nil {
+			return fmt.Errorf("invalid TOTPSecret for user %s: %v", username, err)
+		}
+	}
+	chains, err := entry.authenticationChains()
+	if err != nil {
+		return fmt.Errorf("invalid AuthenticationMethods for user %s: %v", username, err)
+	}
+	if err := entry.checkTOTPChains(chains); err != nil {
+		return fmt.Errorf("invalid AuthenticationMethods for user %s with TOTPSecret: %v", username, err)
+	}
+	for _, cidr := range append(append([]string{}, entry.AllowedCIDRs...), entry.DeniedCIDRs...) {
+		if _, err := parseNetwork(cidr); err != nil {
+			return fmt.Errorf("user %s: %v", username, err)
+		}
+	}
+	for _, chain := range chains {
+		for _, method := range chain {
+			if method == authMethodKeyboardInteractive && c.OIDC.Issuer == "" && entry.TOTPSecret == "" {
+				return fmt.Errorf("user %s needs an OIDC Issuer or a TOTPSecret for %s", username, method)
+			}
+		}
+	}
+	if err := validatePrivilegeSeparation(username, entry); err != nil {
+		return err
+	}
+	if err := c.validateAuditor(username, entry); err != nil {
+		return err
+	}
+	if err := c.validateLanguage(username, entry); err != nil {
+		return err
+	}
+	for name, rate := range map[string]string{"MaxBandwidth": entry.MaxBandwidth, "MaxDownloadBandwidth": entry.MaxDownloadBandwidth, "MaxUploadBandwidth": entry.MaxUploadBandwidth} {
+		if rate == "" {
+			continue
+		}
+		if _, err := parseRate(rate); err != nil {
+			return fmt.Errorf("invalid %s for user %s: %v", name, username, err)
+		}
+	}
+	if entry.RunAs != "" && (entry.MaxBandwidth != "" || entry.MaxDownloadBandwidth != "" || entry.MaxUploadBandwidth != "" ||
+		c.MaxBandwidth != "" || c.MaxDownloadBandwidth != "" || c.MaxUploadBandwidth != "") {
+		// The process serving the session would have token buckets of its own.
+		return fmt.Errorf("user %s cannot use RunAs with a MaxBandwidth, MaxDownloadBandwidth or MaxUploadBandwidth", username)
+	}
+	if err := validateSoftMaxFiles(entry.SoftMaxFiles, entry.MaxFiles); err != nil {
+		return fmt.Errorf("user %s: %v", username, err)
+	}
+	if entry.MaxBytes != "" {
+		if size, err := parseByteSize(entry.MaxBytes); err != nil || size == 0 {
+			return fmt.Errorf("invalid MaxBytes %q for user %s", entry.MaxBytes, username)
+		}
+	}
+	if entry.MaxFileSize != "" {
+		if size, err := parseByteSize(entry.MaxFileSize); err != nil || size == 0 {
+			return fmt.Errorf("invalid MaxFileSize %q for user %s", entry.MaxFileSize, username)
+		}
+	}
+	if entry.QuotaGracePeriod != "" {
+		if period, err := time.ParseDuration(entry.QuotaGracePeriod); err != nil || period <= 0 {
+			return fmt.Errorf("invalid QuotaGracePeriod %q for user %s", entry.QuotaGracePeriod, username)
+		}
+	}
+	if err := entry.OnUpload.validate(); err != nil {
+		return fmt.Errorf("user %s: %v", username, err)
+	}
+	for name, mount := range entry.Filesystem {
+		if name != "" && !validMountName(name) {
+			return fmt.Errorf("invalid directory name %q of user %s", name, username)
+		}
+		if err := mount.OnUpload.validate(); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		if err := mount.validateStorage(); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		if err := mount.validateEncryption(); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		if err := validateSoftMaxFiles(mount.SoftMaxFiles, mount.MaxFiles); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		if err := mount.Retention.validate(); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		if mount.OperationTimeout != "" {
+			if timeout, err := time.ParseDuration(mount.OperationTimeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("directory %s of user %s: invalid OperationTimeout %q", name, username, mount.OperationTimeout)
+			}
+		}
+		if err := mount.CircuitBreaker.validate(); err != nil {
+			return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+		}
+		for _, window := range mount.FreezeSchedule {
+			if err := window.validate(); err != nil {
+				return fmt.Errorf("directory %s of user %s: %v", name, username, err)
+			}
+		}
+		if mount.Watch && (mount.Upstream.Address != "" || mount.objectStore(nil) != nil || mount.Device != "" ||
+			mount.Snapshots != "" || mount.Archive != "" || mount.Memory != "") {
+			return fmt.Errorf("directory %s of user %s: only local directories can be watched", name, username)
+		}
+		if mount.Lower != "" && (mount.Upstream.Address != "" || mount.objectStore(nil) != nil || mount.Device != "" ||
+			mount.Snapshots != "" || mount.Archive != "" || mount.Memory != "") {
+			return fmt.Errorf("directory %s of user %s: only local directories can have a Lower directory", name, username)
+		}
+	}
+	if err := validateWrappers(entry.Wrappers); err != nil {
+		return fmt.Errorf("user %s: %v", username, err)
+	}
+	for _, expressions := range [][]string{entry.CanRead, entry.CanWrite, entry.ShouldHide} {
+		if _, err := intoRegexp(expressions); err != nil {
+			return fmt.Errorf("invalid regular expression for user %s: %v", username, err)
+		}
+	}
+	for _, permissions := range entry.KeyPermissions {
+		if err := permissions.validate(); err != nil {
+			return fmt.Errorf("user %s: %v", username, err)
+		}
+	}
+	return nil
+}
+
+// validMountName tells whether the name of a directory is a single entry of the virtual root directory.
+func validMountName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// newEventBus creates the bus for all events of the server, which are logged with the given logger.
+func newEventBus(log logger.Logger) *events.Bus {
+	bus := events.NewBus()
+	bus.Subscribe(func(e events.Event) {
+		if e.Type == events.TransferProgress || e.Type == events.FileChanged || e.Type == events.PermissionAudit ||
+			e.Type == events.KeysChanged {
+			log.Info("Events", fmt.Sprintf("%s of %s at %s for %s: %s", e.Type, e.Username, e.IP, e.Path, e.Message))
+			return
+		}
+		log.Warn("Events", fmt.Sprintf("%s of %s at %s for %s: %s", e.Type, e.Username, e.IP, e.Path, e.Message))
+	})
+	return bus
 }
 
 // MakeContext converts a [ConfigSftp] into [ContextSftp] by adding default values.
 func (c *ConfigSftp) MakeContext() ContextSftp {
-	log := logger.NewLogger(os.Stdout)
+	logs := logger.NewStream()
+	stdout := logger.NewBufferedLogger(os.Stdout, logger.Options{NonBlocking: c.NonBlockingLog})
+	if c.LogToJournal {
+		journal, err := logger.NewJournalLogger(journalIdentifier)
+		fatal(err)
+		stdout = journal
+	}
+	log := logger.NewStreamLogger(stdout, logs)
+	cluster := c.newClusterState()
+	usage, err := c.newUsageStore(cluster)
+	fatal(err)
+	lastLogins, err := c.newLastLoginStore(cluster)
+	fatal(err)
+	bandwidth, err := newBandwidthLimits(c)
+	fatal(err)
+	var readCache *sftp2.BlockCache
+	if c.ReadCacheSize != "" {
+		// The config has been validated before, so we can ignore the error here.
+		size, _ := parseByteSize(c.ReadCacheSize)
+		readCache = sftp2.NewBlockCache(int64(size), 0)
+	}
+	var provider *oidc.Provider
+	if c.OIDC.Issuer != "" {
+		provider = oidc.NewProvider(c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.ClientSecret, c.OIDC.Scopes)
+	}
+	accessLogger, err := c.newAccessLogger(log)
+	fatal(err)
+	digest, err := c.UploadDigest.newUploadDigest(c.Proxy, func(err error) {
+		log.Warn("UploadDigest", fmt.Sprintf("Cannot send upload digest: %v", err))
+	})
+	fatal(err)
+	recentAccess := logger.NewRecentAccessLogger(logger.NewStreamAccessLogger(accessLogger, logs), 100)
+	registry := stats.NewRegistry()
+	registry.WatchLog("server", func() uint64 { return logger.Dropped(stdout) })
+	registry.WatchLog("access", func() uint64 { return logger.Dropped(accessLogger) })
+	if readCache != nil {
+		registry.WatchCache("read", readCache.Usage)
+	}
+	bans := newBanList(cluster, log)
+	channels := mware.NewChannelCounter(func(ctx gssh.Context) int {
+		return c.MaxChannelsPerConnection
+	}, func(ctx gssh.Context, channelType string) {
+		log.Info("ContextSftp", fmt.Sprintf("Rejecting %s channel of %s at %s: too many channels", channelType, ctx.User(), ctx.RemoteAddr()))
+	})
 	return ContextSftp{
 		config:            c,
 		activeConnections: 0,
-		accessLogger:      logger.NewAccessLogger(os.Stdout),
+		accessLogger:      recentAccess,
+		recentAccess:      recentAccess,
+		logs:              logs,
 		logger:            log,
 		tcpipHandler:      sshport.NewSSHConnectionHandler(log, context.Background()),
+		shared:            fsShared{usage: usage, bandwidth: bandwidth, mounts: newMountTables(), events: newEventBus(log), uploadCommands: newUploadCommandSlots(c), breakers: newCircuitBreakers(registry), hanging: newHangingOperations(), freezes: newMountFreezes(), health: newMountHealth(), memories: newMemoryDirs(registry), readCache: readCache, webDavPorts: c.webDavPorts(), readers: sftp2.NewOpenReaders(), backends: newBackendPools(), digest: digest},
+		stats:             registry,
+		channels:          channels,
+		keyFiles:          newAuthorizedKeysFiles(),
+		keyURLs:           newAuthorizedKeysURLCache(),
+		ldapUsers:         newUserCache(),
+		storeUsers:        newUserCache(),
+		totp:              newTOTPVerifier(),
+		oidc:              provider,
+		acme:              c.newACMEManager(),
+		bans:              bans,
+		autoBan:           c.AutoBan.newAutoBan(bans),
+		tarpit:            newTarpit(c.Tarpit),
+		lastLogins:        lastLogins,
+		cluster:           cluster,
+		hostnames:         c.newHostnameCache(),
+		start:             time.Now(),
 	}
 }
 
-// Listen starts the sftp server.
+// The largest ListBatchSize.
+const maxListBatchSize = 400
+
+// applyListBatchSize sets the ListBatchSize for all sftp servers of this process.
+func (c *ConfigSftp) applyListBatchSize() {
+	if c.ListBatchSize > 0 {
+		gosftp.MaxFilelist = c.ListBatchSize
+	}
+}
+
+// createFS creates the filesystem served to the user of the connection.
+func (c *ContextSftp) createFS(ctx context.Context, info logger.ConnectionInfo) (sftp2.SimplifiedFS, error) {
+	entry, ok := c.connectionEntry(ctx)
+	if !ok {
+		return nil, fmt.Errorf("user %s has no config entry", info.Username)
+	}
+	fs, err := c.currentConfig().CreateFS(info, entry, c.shared)
+	if err != nil || !c.currentConfig().KeySelfService || restrictionsOf(ctx).limited {
+		return fs, err
+	}
+	return c.keysFS(fs, info), nil
+}
+
+// Listen starts the sftp server. It runs until the context is canceled.
 func (c *ContextSftp) Listen(ctx context.Context) {
-	// Build a function that validates ssh connection request and rejects them if they are not authorized.
-	validationF, err := c.config.buildKeyValidationFunc()
-	fatal(err)
-	// validationF -> public key validation function expected from the ssh package.
-	publicKeyHandler := func(ctx gssh.Context, key gssh.PublicKey) bool {
-		username := ctx.User()
-		//fmt.Printf(string(gossh.MarshalAuthorizedKey(key)))
-		return validationF(username, key)
+	if !c.config.SkipSelfTest {
+		report := c.selfTest()
+		report.finish()
 	}
+	fatal(c.config.checkPrivilegeSeparation())
+	c.config.applyListBatchSize()
 	// This function creates the [sftp.Handlers] filesystem for the user of the connection.
-	sftpHandler := func(connectionInfo logger.ConnectionInfo) gosftp.Handlers {
-		fs, err := c.config.CreateFS(connectionInfo.Username)
+	sftpHandler := func(connectionInfo logger.ConnectionInfo, s gssh.Session) (gosftp.Handlers, func()) {
+		session := c.stats.StartSession(connectionInfo, "sftp", func() { _ = s.Close() })
+		session.SetChannels(func() int { return c.channels.Count(s.Context()) })
+		if !c.allowSession(connectionInfo.Username, session.ID) {
+			c.logger.Info("ContextSftp", fmt.Sprintf("Rejecting session of %s at %s: too many sessions", connectionInfo.Username, connectionInfo.IP))
+			c.stats.EndSession(session)
+			_ = s.Close()
+			return sftp2.CreateSFTPHandler(sftp2.EmptyFS{}, c.accessLogger, connectionInfo, c.logger, 0, false), nil
+		}
+		connectionInfo.SessionID = session.ID
+		fs, err := c.createFS(s.Context(), connectionInfo)
 		if err != nil {
 			// On error, we serve an empty fs
 			c.logger.Err("ContextSftp", fmt.Sprintf("Error while creating virtual fs for user %s: %s", connectionInfo.Username, err.Error()))
 			fs = sftp2.EmptyFS{}
 		}
-		return sftp2.CreateSFTPHandler(fs, c.accessLogger, connectionInfo, c.logger)
+		config := c.currentConfig()
+		fs, endTrace := config.traceFS(fs, connectionInfo, c.logger)
+		fs = sftp2.CountingFS{Inner: fs, Counter: session}
+		return sftp2.CreateSFTPHandler(fs, c.accessLogger, connectionInfo, c.logger, config.MaxTreeSizeEntries, config.LogPreviousAttributes), func() {
+			endTrace()
+			config.removeSessionTmp(connectionInfo, c.logger)
+			c.shared.mounts.release(connectionInfo)
+			c.stats.EndSession(session)
+			c.endSession(connectionInfo.Username, session.ID)
+		}
 	}
 	s := &gssh.Server{
 		Addr: fmt.Sprintf("%s:%d", c.config.Host, c.config.Port),
@@ -242,23 +1592,48 @@ func (c *ContextSftp) Listen(ctx context.Context) {
 			_, _ = s.Write([]byte("Not allowed"))
 		},
 		SubsystemHandlers: mware.AddSftpSubsystemHandler(sftpHandler, c.accessLogger, gssh.DefaultSubsystemHandlers),
-		PublicKeyHandler:  publicKeyHandler,
+		// The authentication is done within the ssh.ServerConfig to support several methods in sequence.
+		ServerConfigCallback: c.serverConfig(),
+		ConnCallback: func(ctx gssh.Context, conn net.Conn) net.Conn {
+			banned := c.bans.IsBanned(conn.RemoteAddr().String())
+			if c.tarpit != nil && (banned || c.tarpit.suspicious(conn.RemoteAddr().String())) {
+				// Every connection is handled in its own goroutine, so we can block it.
+				start := time.Now()
+				if c.tarpit.hold(conn) {
+					c.logger.Info("ContextSftp", fmt.Sprintf("Released %s from the tarpit after %s", conn.RemoteAddr().String(), time.Since(start).Round(time.Second)))
+					return nil
+				}
+			}
+			if banned {
+				c.logger.Info("ContextSftp", fmt.Sprintf("Rejecting connection from banned %s", conn.RemoteAddr().String()))
+				// Returning nil closes the connection.
+				return nil
+			}
+			if hostname := c.hostnames.start(conn.RemoteAddr().String()); hostname != nil {
+				ctx.SetValue(mware.ContextKeyHostname, hostname)
+			}
+			return conn
+		},
 		ConnectionFailedCallback: func(conn net.Conn, err error) {
 			c.logger.Info("SFTPServer", fmt.Sprintf("Connection failed for %s: %v", conn.RemoteAddr().String(), err))
+			c.tarpit.recordFailure(conn.RemoteAddr().String())
+			c.recordLoginFailure(conn.RemoteAddr())
 		},
 		LocalPortForwardingCallback: func(ctx gssh.Context, destinationHost string, destinationPort uint32) bool {
 			// We allow port forwarding if webdav is enabled
-			userConfig, ok := c.config.Users[ctx.User()]
+			userConfig, ok := c.connectionEntry(ctx)
 			if !ok || !userConfig.WebDav {
 				return false
 			}
 			return true
 		},
 	}
+	// Sessions of users with RunAs are served in their own process.
+	s.SubsystemHandlers["sftp"] = c.privilegeSeparated(s.SubsystemHandlers["sftp"])
 	// Add the tcp/ip forward handler to the connection
 	s.ChannelHandlers = map[string]gssh.ChannelHandler{
-		"session":      gssh.DefaultSessionHandler,
-		"direct-tcpip": c.tcpipHandler.HandleTCPIP,
+		"session":      c.channels.Limit(mware.FilterSessionRequests(gssh.DefaultSessionHandler, c.allowSessionRequest)),
+		"direct-tcpip": c.channels.Limit(c.tcpipHandler.HandleTCPIP),
 	}
 	// We generate private and public keys if they don't exist yet.
 	hostkeys, err := c.config.getOrGenerateServerKey()
@@ -269,19 +1644,175 @@ func (c *ContextSftp) Listen(ctx context.Context) {
 	log.Printf("Listen on %s:%d\n", c.config.Host, c.config.Port)
 	// Start the webdav server on the virtual tcp/ip connections
 	c.startTcpip(ctx)
-	fatal(s.ListenAndServe())
+	c.startACME(ctx)
+	c.startMetrics(ctx)
+	c.startAdmin(ctx)
+	if c.cluster != nil {
+		go c.refreshSessions(ctx)
+	}
+	go c.runJanitor(ctx)
+	if c.shared.digest != nil {
+		go c.shared.digest.run(ctx)
+	}
+	c.startWatchers(ctx)
+	if c.config.HealthCheckInterval != "" {
+		// The config has been validated before, so we can ignore the error here.
+		interval, _ := time.ParseDuration(c.config.HealthCheckInterval)
+		go c.checkHealth(ctx, interval)
+	}
+	reloadOnHangup(ctx, c.reload)
+	// When the context say to cancel, we close the server
+	go func() {
+		<-ctx.Done()
+		_ = s.Close()
+	}()
+	if err := s.ListenAndServe(); err != gssh.ErrServerClosed {
+		fatal(err)
+	}
+	if closer, ok := c.shared.usage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot save the UsageFile: %v", err))
+		}
+	}
+}
+
+// startSettings returns the settings by their names that are only applied on start, as the listeners and the
+// state built from them (like the read cache, the bans or the metrics) are kept by reload.
+func (c *ConfigSftp) startSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"Host":                     c.Host,
+		"Port":                     c.Port,
+		"ServerKeyFilename":        c.ServerKeyFilename,
+		"AutoBan":                  c.AutoBan,
+		"SkipSelfTest":             c.SkipSelfTest,
+		"WebDavPort":               c.WebDavPort,
+		"WebDavAutoPort":           c.WebDavAutoPort,
+		"UsageFile":                c.UsageFile,
+		"MetricsAddress":           c.MetricsAddress,
+		"OIDC":                     c.OIDC,
+		"AdminAddress":             c.AdminAddress,
+		"AdminToken":               c.AdminToken,
+		"ACME":                     c.ACME,
+		"UploadDigest":             c.UploadDigest,
+		"MaxUploadCommands":        c.MaxUploadCommands,
+		"Redis":                    c.Redis,
+		"HealthCheckInterval":      c.HealthCheckInterval,
+		"MaxChannelsPerConnection": c.MaxChannelsPerConnection,
+		"Tarpit":                   c.Tarpit,
+		"ListBatchSize":            c.ListBatchSize,
+		"LastLoginFile":            c.LastLoginFile,
+		"AccessLog":                c.AccessLog,
+		"NonBlockingLog":           c.NonBlockingLog,
+		"LogToJournal":             c.LogToJournal,
+		"ResolveHostnames":         c.ResolveHostnames,
+		"ResolveTimeout":           c.ResolveTimeout,
+		"ReadCacheSize":            c.ReadCacheSize,
+	}
+}
+
+// changedStartSettings returns the names of the settings only applied on start that differ in other.
+func (c *ConfigSftp) changedStartSettings(other *ConfigSftp) []string {
+	var changed []string
+	previous := c.startSettings()
+	for name, value := range other.startSettings() {
+		if !reflect.DeepEqual(value, previous[name]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reload loads the config file again. Its users and all settings that are read for every connection (like the
+// directories, the permissions and the keys) apply to new connections, while established sessions keep theirs.
+// The bandwidth limits also change for running sessions. If the config is invalid or changes a setting that is
+// only applied on start (see startSettings), the previous one is kept.
+func (c *ContextSftp) reload() {
+	config, err := LoadConfigSftp(c.currentConfig().filename)
+	if err != nil {
+		c.logger.Err("ContextSftp", fmt.Sprintf("Cannot reload the config, keeping the previous one: %v", err))
+		return
+	}
+	if changed := c.currentConfig().changedStartSettings(&config); len(changed) > 0 {
+		c.logger.Err("ContextSftp", fmt.Sprintf("Cannot reload the config, keeping the previous one: %s can only be changed by a restart", strings.Join(changed, ", ")))
+		return
+	}
+	c.usersMutex.Lock()
+	c.config = &config
+	c.usersMutex.Unlock()
+	// The next sessions should use the changed directories.
+	c.shared.mounts.forgetAll()
+	c.shared.bandwidth.update(&config, c.userEntry)
+	c.logger.Info("ContextSftp", "Reloaded the config")
+}
+
+// allowSessionRequest decides whether the user of the connection may make the given request within a session.
+// Agent forwarding, X11 forwarding and pseudo terminals must be allowed explicitly, other requests are passed on.
+func (c *ContextSftp) allowSessionRequest(ctx gssh.Context, requestType string) bool {
+	userConfig, _ := c.connectionEntry(ctx)
+	var allowed bool
+	switch requestType {
+	case mware.AgentForwardingRequest:
+		allowed = userConfig.AllowAgentForwarding
+	case mware.X11ForwardingRequest:
+		allowed = userConfig.AllowX11Forwarding
+	case mware.PtyRequest:
+		allowed = userConfig.AllowPty
+	default:
+		return true
+	}
+	if !allowed {
+		c.logger.Info("ContextSftp", fmt.Sprintf("Denying %s request of %s at %s", requestType, ctx.User(), ctx.RemoteAddr()))
+	}
+	return allowed
+}
+
+// webDavPorts returns the virtual ports of the webdav servers of the users with WebDav. Users without a
+// WebDavPort of their own get the WebDavPort of the config or, with WebDavAutoPort, the lowest port from there on
+// that no other user has. As they are picked by the order of the usernames, the ports are the same on every start
+// as long as no user is added.
+func (c *ConfigSftp) webDavPorts() map[string]uint32 {
+	ports := map[string]uint32{}
+	used := map[uint32]bool{}
+	var auto []string
+	for username, entry := range c.Users {
+		switch {
+		case !entry.WebDav:
+		case entry.WebDavPort != 0:
+			ports[username] = entry.WebDavPort
+			used[entry.WebDavPort] = true
+		case c.WebDavAutoPort:
+			auto = append(auto, username)
+		default:
+			ports[username] = c.WebDavPort
+			used[c.WebDavPort] = true
+		}
+	}
+	sort.Strings(auto)
+	port := c.WebDavPort
+	for _, username := range auto {
+		for used[port] {
+			port++
+		}
+		ports[username] = port
+		used[port] = true
+	}
+	return ports
 }
 
 // startTcpip starts for every user a webdav server (if desired) that listens
 // on the tcp/ip forwarded ssh connection.
 func (c *ContextSftp) startTcpip(ctx context.Context) {
-	for username, entry := range c.config.Users {
-		if !entry.WebDav {
+	config := c.currentConfig()
+	for username, entry := range config.Users {
+		port, ok := c.shared.webDavPorts[username]
+		if !entry.WebDav || !ok {
 			continue
 		}
 		// Create a new net.Handler that works over ssh and serve a webdav http server over it.
-		listener := c.tcpipHandler.CreateListener(c.config.WebDavPort, username)
-		fs, err := c.config.CreateFS(username)
+		listener := c.tcpipHandler.CreateListener(port, username)
+		c.logger.Info("startTcpip", fmt.Sprintf("Serving webdav to %s on the virtual port %d", username, port))
+		fs, err := config.CreateFS(logger.ConnectionInfo{Username: username}, entry, c.shared)
 		if err != nil {
 			c.logger.Err("startTcpip", fmt.Sprintf("Cannot create fs for user %s: %v", username, err))
 			continue
@@ -310,6 +1841,39 @@ func (c *ContextSftp) startTcpip(ctx context.Context) {
 
 }
 
+// startMetrics starts the http server for the live statistics if desired.
+func (c *ContextSftp) startMetrics(ctx context.Context) {
+	if c.config.MetricsAddress == "" {
+		return
+	}
+	server := http.Server{
+		Addr:        c.config.MetricsAddress,
+		Handler:     c.stats.Handler(),
+		BaseContext: func(l net.Listener) context.Context { return ctx },
+		TLSConfig:   c.tlsConfig(),
+	}
+	go func() {
+		<-ctx.Done()
+		err := server.Close()
+		if err != nil {
+			c.logger.Err("startMetrics", err.Error())
+		}
+	}()
+	go func() {
+		c.logger.Info("startMetrics", fmt.Sprintf("Serve statistics on %s", server.Addr))
+		var err error
+		if server.TLSConfig != nil {
+			// The certificates are taken from the TLSConfig.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			c.logger.Err("startMetrics", err.Error())
+		}
+	}()
+}
+
 // Starts the sftp server
 func mainSftp(args []string) {
 	if len(args) != 2 {
@@ -317,6 +1881,12 @@ func mainSftp(args []string) {
 		ErrPrintf("\n")
 		ErrPrintf("Config file will be created if does not exists\n")
 		ErrPrintf("Needed Serverkey will also be created if not exists\n")
+		ErrPrintf("With %s, the default config is printed to stdout instead\n", printDefaultFlag)
+		return
+	}
+	if args[1] == printDefaultFlag {
+		c := DefaultSftpConfig()
+		fatal(toml.NewEncoder(os.Stdout).Encode(&c))
 		return
 	}
 	if _, err := os.Stat(args[1]); os.IsNotExist(err) {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+// The SYSLOG_IDENTIFIER of the entries written to the systemd journal.
+const journalIdentifier = "sshtool"
+
+// AccessLogConfig configures a destination the access log is written to.
+type AccessLogConfig struct {
+	// Either "csv" (the format used on stdout by default), "json" (one object per line), "webhook" or "journal"
+	// (the systemd journal with structured fields).
+	Type string
+	// The file the entries are appended to. An empty string writes them to stdout. Not used by webhooks.
+	File string
+	// The url every entry is posted to as json object by a webhook.
+	URL string
+	// Whether entries of a csv access log are dropped while its file cannot keep up instead of delaying the
+	// requests of the clients. Webhooks always drop entries. The number of dropped entries is reported by the metrics.
+	NonBlocking bool
+	// The number of entries of a csv access log waiting to be written. Zero uses a buffer of 1024 entries.
+	BufferSize int
+}
+
+// validate checks the settings for values that are not supported.
+func (a AccessLogConfig) validate() error {
+	switch a.Type {
+	case "csv", "json":
+		if a.URL != "" {
+			return fmt.Errorf("the %s access log has no URL", a.Type)
+		}
+	case "webhook":
+		if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid URL %q of the webhook access log", a.URL)
+		}
+		if a.File != "" {
+			return fmt.Errorf("the webhook access log has no File")
+		}
+	case "journal":
+		if a.File != "" || a.URL != "" {
+			return fmt.Errorf("the journal access log has neither File nor URL")
+		}
+	default:
+		return fmt.Errorf("unknown access log type %q", a.Type)
+	}
+	if a.Type != "csv" && (a.NonBlocking || a.BufferSize != 0) {
+		return fmt.Errorf("the %s access log has no NonBlocking or BufferSize", a.Type)
+	}
+	if a.BufferSize < 0 {
+		return fmt.Errorf("invalid BufferSize %d of the csv access log", a.BufferSize)
+	}
+	return nil
+}
+
+// Opens the file of the access log for appending, or stdout if there is none.
+func (a AccessLogConfig) open() (io.Writer, error) {
+	if a.File == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(a.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// newAccessLogger creates the access logger writing to all destinations of the AccessLog setting. Without any,
+// the entries are written to stdout as csv. Errors of webhooks are logged to log.
+func (c *ConfigSftp) newAccessLogger(log logger.Logger) (logger.AccessLogger, error) {
+	if len(c.AccessLog) == 0 {
+		return logger.NewAccessLogger(os.Stdout), nil
+	}
+	loggers := make([]logger.AccessLogger, 0, len(c.AccessLog))
+	for _, destination := range c.AccessLog {
+		switch destination.Type {
+		case "webhook":
+			client, err := c.Proxy.httpClient(10 * time.Second)
+			if err != nil {
+				return nil, err
+			}
+			loggers = append(loggers, logger.NewWebhookAccessLogger(destination.URL, client, func(err error) {
+				log.Warn("AccessLog", fmt.Sprintf("Cannot post access log entry: %v", err))
+			}))
+		case "journal":
+			journal, err := logger.NewJournalAccessLogger(journalIdentifier)
+			if err != nil {
+				return nil, err
+			}
+			loggers = append(loggers, journal)
+		default:
+			writer, err := destination.open()
+			if err != nil {
+				return nil, err
+			}
+			if destination.Type == "json" {
+				loggers = append(loggers, logger.NewJSONAccessLogger(writer))
+			} else {
+				loggers = append(loggers, logger.NewBufferedAccessLogger(writer, logger.Options{
+					BufferSize: destination.BufferSize, NonBlocking: destination.NonBlocking}))
+			}
+		}
+	}
+	return logger.NewMultiAccessLogger(loggers...), nil
+}
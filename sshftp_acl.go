@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// ACLEntry grants the users and groups it names access to a path and everything below it, as an alternative to
+// the regular expressions of CanRead, CanWrite and ShouldHide.
+type ACLEntry struct {
+	// The path relative to the (virtual) root directory served to the users, e.g. "/projects/www".
+	Path string
+	// The names of the users the entry applies to.
+	Users []string
+	// The names of the Groups whose members the entry applies to.
+	Groups []string
+	// Whether files can be read.
+	Read bool
+	// Whether files and directories can be created, changed and removed.
+	Write bool
+	// Whether directories can be listed.
+	List bool
+}
+
+// appliesTo tells whether the entry names the user, either directly or by one of its groups.
+func (a ACLEntry) appliesTo(username string, groups map[string][]string) bool {
+	for _, name := range a.Users {
+		if name == username {
+			return true
+		}
+	}
+	for _, group := range a.Groups {
+		for _, member := range groups[group] {
+			if member == username {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasACL tells whether any entry of the ACL applies to the user, which then replaces its CanRead, CanWrite and
+// ShouldHide.
+func (c *ConfigSftp) hasACL(username string) bool {
+	for _, entry := range c.ACL {
+		if entry.appliesTo(username, c.Groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclRulesFor compiles the entries of the ACL that apply to the user into rules for a [sftp2.ACLWrapperFS].
+// Entries with the same path are combined, so the user gets everything any of them grants.
+func (c *ConfigSftp) aclRulesFor(username string) []sftp2.ACLRule {
+	var rules []sftp2.ACLRule
+	index := map[string]int{}
+	for _, entry := range c.ACL {
+		if !entry.appliesTo(username, c.Groups) {
+			continue
+		}
+		p := path.Clean("/" + entry.Path)
+		i, ok := index[p]
+		if !ok {
+			i = len(rules)
+			index[p] = i
+			rules = append(rules, sftp2.ACLRule{Path: p})
+		}
+		rules[i].Read = rules[i].Read || entry.Read
+		rules[i].Write = rules[i].Write || entry.Write
+		rules[i].List = rules[i].List || entry.List
+	}
+	return rules
+}
+
+// validateACL checks that the entries of the ACL name a path and existing groups.
+func (c *ConfigSftp) validateACL() error {
+	for i, entry := range c.ACL {
+		if !strings.HasPrefix(entry.Path, "/") {
+			return fmt.Errorf("the Path %q of ACL entry %d must start with /", entry.Path, i+1)
+		}
+		if len(entry.Users) == 0 && len(entry.Groups) == 0 {
+			return fmt.Errorf("ACL entry %d for %s names neither Users nor Groups", i+1, entry.Path)
+		}
+		for _, group := range entry.Groups {
+			if _, ok := c.Groups[group]; !ok {
+				return fmt.Errorf("ACL entry %d for %s names the unknown group %q", i+1, entry.Path, group)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig configures the automatic tls certificates of the http listeners (the MetricsAddress and the
+// AdminAddress), which are then served over https.
+type ACMEConfig struct {
+	// The domains a certificate is requested for. Empty disables ACME, so the listeners serve plain http.
+	Domains []string
+	// The contact address for the certificate authority, e.g. to be warned about expiring certificates. May be empty.
+	Email string
+	// The directory the account key and the certificates are kept in. A relative path is relative to the directory
+	// of this config file. Defaults to "acme".
+	CacheDir string
+	// The directory url of the certificate authority. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// The address (e.g. ":80") answering the HTTP-01 challenges. TLS-ALPN-01 challenges are answered by the listeners
+	// themselves, which requires one of them to be reachable on port 443 if this is empty.
+	HTTPAddress string
+}
+
+// validate checks the settings for values that are not supported.
+func (a ACMEConfig) validate() error {
+	if len(a.Domains) == 0 {
+		if a.HTTPAddress != "" {
+			return fmt.Errorf("the ACME HTTPAddress needs Domains")
+		}
+		return nil
+	}
+	for _, domain := range a.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return fmt.Errorf("invalid ACME domain %q", domain)
+		}
+	}
+	if a.HTTPAddress != "" {
+		if _, _, err := net.SplitHostPort(a.HTTPAddress); err != nil {
+			return fmt.Errorf("invalid ACME HTTPAddress %q", a.HTTPAddress)
+		}
+	}
+	return nil
+}
+
+// newACMEManager creates the manager of the certificates, or returns nil if ACME is disabled. The account key and
+// the certificates are kept in the CacheDir, so they survive restarts.
+func (c *ConfigSftp) newACMEManager() *autocert.Manager {
+	if len(c.ACME.Domains) == 0 {
+		return nil
+	}
+	cacheDir := c.ACME.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme"
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(relativeToConfig(c.filename, cacheDir)),
+		HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+		Client:     &acme.Client{DirectoryURL: c.ACME.DirectoryURL, UserAgent: "sshtool"},
+		Email:      c.ACME.Email,
+	}
+}
+
+// tlsConfig returns the tls config of the http listeners, or nil if they serve plain http.
+func (c *ContextSftp) tlsConfig() *tls.Config {
+	if c.acme == nil {
+		return nil
+	}
+	config := c.acme.TLSConfig()
+	// Clients connecting without a server name (e.g. by ip) get the certificate of the first domain.
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			named := *hello
+			named.ServerName = c.config.ACME.Domains[0]
+			hello = &named
+		}
+		return c.acme.GetCertificate(hello)
+	}
+	return config
+}
+
+// startACME starts the http server answering the HTTP-01 challenges if desired. The certificates themselves are
+// obtained and renewed by the manager when they are needed.
+func (c *ContextSftp) startACME(ctx context.Context) {
+	if c.acme == nil || c.config.ACME.HTTPAddress == "" {
+		return
+	}
+	server := http.Server{
+		Addr:        c.config.ACME.HTTPAddress,
+		Handler:     c.acme.HTTPHandler(nil),
+		BaseContext: func(l net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		err := server.Close()
+		if err != nil {
+			c.logger.Err("startACME", err.Error())
+		}
+	}()
+	go func() {
+		c.logger.Info("startACME", fmt.Sprintf("Answer ACME challenges on %s", server.Addr))
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			c.logger.Err("startACME", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Entscheider/sshtool/admin"
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	"github.com/Entscheider/sshtool/stats"
+)
+
+// adminBackend implements [admin.Backend] for a running sftp server.
+type adminBackend struct {
+	c *ContextSftp
+}
+
+func (b adminBackend) Status() admin.Status {
+	return admin.Status{
+		Start:       b.c.start,
+		Users:       len(b.c.currentConfig().Users),
+		Sessions:    len(b.c.stats.Sessions()),
+		Maintenance: b.c.inMaintenance(),
+	}
+}
+
+func (b adminBackend) Sessions() []stats.SessionSnapshot {
+	return b.c.stats.Sessions()
+}
+
+func (b adminBackend) KillSession(id uint64) bool {
+	return b.c.stats.Kill(id)
+}
+
+func (b adminBackend) UserStats() []admin.UserStats {
+	users := b.c.currentConfig().Users
+	perUser := make(map[string]*admin.UserStats, len(users))
+	for username, entry := range users {
+		userStats := &admin.UserStats{Username: username, Files: -1, MaxFiles: entry.MaxFiles}
+		if usage, ok, _ := b.c.shared.usage.Get(username); ok {
+			userStats.Files = usage.Files
+		}
+		if login, ok := b.c.lastLogins.Get(username); ok {
+			userStats.LastLogin = &login
+		}
+		perUser[username] = userStats
+	}
+	for _, session := range b.c.stats.Sessions() {
+		userStats, ok := perUser[session.Username]
+		if !ok {
+			continue
+		}
+		userStats.Sessions += 1
+		userStats.BytesRead += session.BytesRead
+		userStats.BytesWritten += session.BytesWritten
+	}
+	result := make([]admin.UserStats, 0, len(perUser))
+	for _, userStats := range perUser {
+		result = append(result, *userStats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
+}
+
+func (b adminBackend) BanList() *admin.BanList {
+	return b.c.bans
+}
+
+func (b adminBackend) Events() *events.Bus {
+	return b.c.shared.events
+}
+
+func (b adminBackend) Logs() *logger.Stream {
+	return b.c.logs
+}
+
+func (b adminBackend) RecentAccess() []logger.AccessEntry {
+	return b.c.recentAccess.Entries()
+}
+
+func (b adminBackend) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&b.c.maintenance, value)
+	b.c.logger.Info("ContextSftp", fmt.Sprintf("Maintenance mode: %v", enabled))
+}
+
+func (b adminBackend) User(name string) (interface{}, bool) {
+	entry, ok := b.c.userEntry(name)
+	// The credentials stay on the server. A PATCH keeps them, since it only changes the given fields.
+	entry.PasswordHash = ""
+	entry.TOTPSecret = ""
+	return entry, ok
+}
+
+// Returns the entry of the user from the config. Users of the UsersDir, the UserStore or the LDAP server cannot be
+// changed, since any change would turn them into users of the config.
+func (b adminBackend) configUser(name string) (UserEntry, bool, error) {
+	entry, ok := b.c.currentConfig().Users[name]
+	if ok {
+		return entry, true, nil
+	}
+	if _, ok := b.c.userEntry(name); ok {
+		return UserEntry{}, true, fmt.Errorf("user %s is not part of the config and cannot be changed", name)
+	}
+	return UserEntry{}, false, nil
+}
+
+func (b adminBackend) UpdateUser(name string, config json.RawMessage, replace bool) error {
+	entry, ok, err := b.configUser(name)
+	if err != nil {
+		return err
+	}
+	if replace {
+		entry = UserEntry{}
+	} else if !ok {
+		return admin.ErrNoSuchUser
+	}
+	// Decoding into the existing entry only changes the given fields.
+	if err := json.Unmarshal(config, &entry); err != nil {
+		return err
+	}
+	if err := b.c.setUser(name, &entry); err != nil {
+		return err
+	}
+	// The next session should use the changed directories.
+	b.c.shared.mounts.forget(name)
+	return nil
+}
+
+func (b adminBackend) DeleteUser(name string) (bool, error) {
+	if _, ok, err := b.configUser(name); !ok || err != nil {
+		return ok, err
+	}
+	b.c.shared.mounts.forget(name)
+	return true, b.c.setUser(name, nil)
+}
+
+func (b adminBackend) Mounts(user string) (interface{}, bool) {
+	entry, ok := b.c.userEntry(user)
+	return entry.Filesystem, ok
+}
+
+func (b adminBackend) Mount(user string, name string, config json.RawMessage) error {
+	entry, ok, err := b.configUser(user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return admin.ErrNoSuchUser
+	}
+	if _, ok := entry.Filesystem[""]; ok {
+		return fmt.Errorf("user %s is served a single directory without names", user)
+	}
+	if name == "" || !validMountName(name) {
+		return fmt.Errorf("invalid mount name %q", name)
+	}
+	var mount SFTPEntry
+	if err := json.Unmarshal(config, &mount); err != nil {
+		return err
+	}
+	if mount.Root == "" {
+		return fmt.Errorf("the mount needs a Root")
+	}
+	// Checks the mount before changing the config.
+	current := b.c.currentConfig()
+	mountFS, err := current.createMountFS(logger.ConnectionInfo{Username: user}, name, entry, mount, b.c.shared)
+	if err != nil {
+		return err
+	}
+	filesystem := make(map[string]SFTPEntry, len(entry.Filesystem)+1)
+	for n, e := range entry.Filesystem {
+		filesystem[n] = e
+	}
+	filesystem[name] = mount
+	entry.Filesystem = filesystem
+	if err := b.c.setUser(user, &entry); err != nil {
+		return err
+	}
+	for _, mounts := range b.c.shared.mounts.get(user) {
+		// Sessions with directories of their own get a directory created for their connection.
+		if mounts.info.SessionID != 0 {
+			if mountFS, err = current.createMountFS(mounts.info, name, entry, mount, b.c.shared); err != nil {
+				return err
+			}
+		}
+		if err := mounts.table.Mount(name, mountFS); err != nil {
+			return err
+		}
+	}
+	if entry.mountsPerConnection() {
+		// The next sessions get directories of their own.
+		b.c.shared.mounts.forget(user)
+	}
+	return nil
+}
+
+func (b adminBackend) Unmount(user string, name string) (bool, error) {
+	entry, ok, err := b.configUser(user)
+	if !ok || err != nil {
+		return false, err
+	}
+	if _, ok := entry.Filesystem[name]; !ok || name == "" {
+		return false, nil
+	}
+	filesystem := make(map[string]SFTPEntry, len(entry.Filesystem))
+	for n, e := range entry.Filesystem {
+		if n != name {
+			filesystem[n] = e
+		}
+	}
+	entry.Filesystem = filesystem
+	if err := b.c.setUser(user, &entry); err != nil {
+		return false, err
+	}
+	for _, mounts := range b.c.shared.mounts.get(user) {
+		mounts.table.Unmount(name)
+	}
+	return true, nil
+}
+
+// Returns the freeze of the directory with the given name of the user, if the user has such a directory.
+func (b adminBackend) freezeOf(user string, name string) (*sftp2.Freeze, bool) {
+	entry, ok := b.c.userEntry(user)
+	if !ok {
+		return nil, false
+	}
+	mount, ok := entry.Filesystem[name]
+	if !ok {
+		return nil, false
+	}
+	return b.c.shared.freezes.freezeFor(user, name, mount.FreezeSchedule), true
+}
+
+func (b adminBackend) FreezeMount(user string, name string, frozen bool) bool {
+	freeze, ok := b.freezeOf(user, name)
+	if !ok {
+		return false
+	}
+	freeze.Set(frozen)
+	b.c.logger.Info("ContextSftp", fmt.Sprintf("Directory %q of %s frozen: %v", name, user, frozen))
+	return true
+}
+
+func (b adminBackend) MountFreeze(user string, name string) (admin.FreezeState, bool) {
+	freeze, ok := b.freezeOf(user, name)
+	if !ok {
+		return admin.FreezeState{}, false
+	}
+	return admin.FreezeState{Frozen: freeze.Frozen(), Manual: freeze.Manual()}, true
+}
+
+func (b adminBackend) TreeSize(user string, dir string) (interface{}, error) {
+	entry, ok := b.c.userEntry(user)
+	if !ok {
+		return nil, admin.ErrNoSuchUser
+	}
+	config := b.c.currentConfig()
+	fs, err := config.createFSWithoutPermission(logger.ConnectionInfo{Username: user}, entry, b.c.shared)
+	if err != nil {
+		return nil, err
+	}
+	limit := config.MaxTreeSizeEntries
+	if limit == 0 {
+		limit = sftp2.DefaultTreeSizeLimit
+	}
+	return sftp2.TreeSize(fs, path.Clean("/"+dir), limit)
+}
+
+func (b adminBackend) Archive(user string, dir string) (io.ReadCloser, error) {
+	entry, ok := b.c.userEntry(user)
+	if !ok {
+		return nil, admin.ErrNoSuchUser
+	}
+	fs, err := b.c.currentConfig().createFSWithoutPermission(logger.ConnectionInfo{Username: user}, entry, b.c.shared)
+	if err != nil {
+		return nil, err
+	}
+	dir = path.Clean("/" + dir)
+	if _, err := fs.Lstat(dir); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(sftp2.WriteTarGz(fs, dir, writer))
+	}()
+	return reader, nil
+}
+
+// inMaintenance checks whether new connections are rejected because of the maintenance mode.
+func (c *ContextSftp) inMaintenance() bool {
+	return atomic.LoadInt32(&c.maintenance) == 1
+}
+
+// startAdmin starts the admin api if desired.
+func (c *ContextSftp) startAdmin(ctx context.Context) {
+	address := c.config.AdminAddress
+	if address == "" {
+		return
+	}
+	server := &admin.Server{Backend: adminBackend{c}, Token: c.config.AdminToken, TLSConfig: c.tlsConfig()}
+	go func() {
+		c.logger.Info("startAdmin", fmt.Sprintf("Serve admin api on %s", address))
+		if err := server.ListenAndServe(ctx, address); err != nil {
+			c.logger.Err("startAdmin", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// auditDirectory is the name of the directory added to the root of auditors (see AuditUsers).
+const auditDirectory = "access-logs"
+
+// isAuditor tells whether the user can read the entries of any other user from the access logs.
+func (u UserEntry) isAuditor() bool {
+	return len(u.AuditUsers) > 0 || len(u.AuditGroups) > 0
+}
+
+// validateAuditor checks that the AuditGroups of an auditor exist and that its session can read the access logs.
+func (c *ConfigSftp) validateAuditor(username string, entry UserEntry) error {
+	for _, group := range entry.AuditGroups {
+		if _, ok := c.Groups[group]; !ok {
+			return fmt.Errorf("unknown group %q in AuditGroups of user %s", group, username)
+		}
+	}
+	if entry.isAuditor() && entry.RunAs != "" {
+		// The files of the access log can only be read by the server itself.
+		return fmt.Errorf("user %s cannot use AuditUsers or AuditGroups with RunAs", username)
+	}
+	return nil
+}
+
+// audits tells whether the auditor can read the entries of the given user.
+func (c *ConfigSftp) audits(auditor UserEntry, username string) bool {
+	if slices.Contains(auditor.AuditUsers, "*") || slices.Contains(auditor.AuditUsers, username) {
+		return true
+	}
+	for _, group := range auditor.AuditGroups {
+		if slices.Contains(c.Groups[group], username) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAccessLog returns the lines of a csv or json access log whose username is accepted. Lines that cannot be
+// parsed are left out, so an auditor never sees entries of other users.
+func filterAccessLog(data []byte, logType string, accept func(username string) bool) []byte {
+	var filtered bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var username string
+		if logType == "json" {
+			var entry struct{ Username string }
+			if json.Unmarshal(line, &entry) != nil {
+				continue
+			}
+			username = entry.Username
+		} else {
+			// The columns are the time, the type, the ip and the username, followed by the others.
+			record, err := csv.NewReader(bytes.NewReader(line)).Read()
+			if err != nil || len(record) < 4 {
+				continue
+			}
+			username = record[3]
+		}
+		if accept(username) {
+			filtered.Write(line)
+			filtered.WriteByte('\n')
+		}
+	}
+	return filtered.Bytes()
+}
+
+// auditFS adds the read-only audit directory to fs, which contains every csv and json file of the AccessLog
+// reduced to the entries of the users the auditor can read. The files are filtered whenever they are read.
+func (c *ConfigSftp) auditFS(fs sftp2.SimplifiedFS, userEntry UserEntry) sftp2.SimplifiedFS {
+	files := make(map[string]func() ([]byte, error))
+	for _, destination := range c.AccessLog {
+		if destination.File == "" || destination.Type == "webhook" {
+			continue
+		}
+		name := filepath.Base(destination.File)
+		for i := 2; files[name] != nil; i++ {
+			name = fmt.Sprintf("%s.%d", filepath.Base(destination.File), i)
+		}
+		file, logType := destination.File, destination.Type
+		files[name] = func() ([]byte, error) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			return filterAccessLog(data, logType, func(username string) bool {
+				return c.audits(userEntry, username)
+			}), nil
+		}
+	}
+	return sftp2.VirtualDirFS{Inner: fs, Name: auditDirectory, Files: files}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/admin"
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// Names of the supported authentication methods. They are the same as used by OpenSSH.
+const (
+	authMethodPublicKey = "publickey"
+	authMethodPassword  = "password"
+	// Used for logging in with the OIDC device flow and for asking for TOTP codes.
+	authMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+// OIDCConfig configures an OpenID Connect provider users can log in with using the device flow.
+type OIDCConfig struct {
+	// The issuer url of the provider, e.g. "https://accounts.example.com". An empty string disables the login.
+	Issuer string
+	// The id of the client registered at the provider.
+	ClientID string
+	// The secret of the client. May be empty for public clients.
+	ClientSecret string
+	// Further scopes to request besides "openid".
+	Scopes []string
+	// The claim of the id token that has to match the ssh username. Defaults to "preferred_username".
+	UsernameClaim string
+}
+
+// KeyPolicyConfig restricts the public keys and signature algorithms clients can log in with.
+type KeyPolicyConfig struct {
+	// The minimal size of RSA keys in bits, e.g. 3072. Zero allows every size.
+	MinRSABits int
+	// Whether DSA keys are rejected.
+	RejectDSA bool
+	// Whether signatures using SHA-1 ("ssh-rsa") are rejected. Clients with RSA keys have to use "rsa-sha2-256" or
+	// "rsa-sha2-512" instead.
+	RejectSHA1 bool
+}
+
+// validate checks the settings for values that are not supported.
+func (p KeyPolicyConfig) validate() error {
+	if p.MinRSABits < 0 {
+		return fmt.Errorf("the MinRSABits of the KeyPolicy must not be negative")
+	}
+	return nil
+}
+
+// checkKey returns an error telling why the key is too weak, or nil if it is allowed. For certificates, the
+// certified key is checked.
+func (p KeyPolicyConfig) checkKey(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if p.RejectDSA && key.Type() == ssh.InsecureKeyAlgoDSA {
+		return fmt.Errorf("DSA keys are not allowed")
+	}
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok && p.MinRSABits > 0 {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+			return fmt.Errorf("the RSA key has %d bits, at least %d are required", rsaKey.N.BitLen(), p.MinRSABits)
+		}
+	}
+	return nil
+}
+
+// checkSignature returns an error telling why the signature algorithm is not allowed, or nil if it is.
+func (p KeyPolicyConfig) checkSignature(algorithm string) error {
+	if p.RejectSHA1 && (algorithm == ssh.KeyAlgoRSA || algorithm == ssh.CertAlgoRSAv01) {
+		return fmt.Errorf("signatures with ssh-rsa (SHA-1) are not allowed, use rsa-sha2-256 or rsa-sha2-512")
+	}
+	return nil
+}
+
+// parseAuthenticationMethods parses the AuthenticationMethods setting of a user. Every entry is a comma separated
+// list of methods which all must succeed in the given order.
+func parseAuthenticationMethods(entries []string) ([][]string, error) {
+	result := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		var methods []string
+		for _, method := range strings.Split(entry, ",") {
+			method = strings.TrimSpace(method)
+			switch method {
+			case authMethodPublicKey, authMethodPassword, authMethodKeyboardInteractive:
+				methods = append(methods, method)
+			default:
+				return nil, fmt.Errorf("unknown authentication method %q", method)
+			}
+		}
+		result = append(result, methods)
+	}
+	return result, nil
+}
+
+// authenticationChains returns every list of methods that authenticate the given user if all of them succeed
+// in the given order. If the user has not set AuthenticationMethods, every configured method is sufficient on its own,
+// followed by the TOTP code if the user has a TOTPSecret.
+func (u UserEntry) authenticationChains() ([][]string, error) {
+	if len(u.AuthenticationMethods) > 0 {
+		return parseAuthenticationMethods(u.AuthenticationMethods)
+	}
+	chains := [][]string{{authMethodPublicKey}}
+	if u.PasswordHash != "" {
+		chains = append(chains, []string{authMethodPassword})
+	}
+	if u.OIDCLogin {
+		chains = append(chains, []string{authMethodKeyboardInteractive})
+	}
+	if u.TOTPSecret != "" {
+		for i := range chains {
+			chains[i] = append(chains[i], authMethodKeyboardInteractive)
+		}
+	}
+	return chains, nil
+}
+
+// checkTOTPChains checks that every list of methods of a user with a TOTPSecret asks for the TOTP code last and
+// after another method (a key, a password or the OIDC login), so neither is the code skipped nor sufficient on its
+// own. keyboard-interactive asks for the code unless it is the first method of a user with OIDCLogin.
+func (u UserEntry) checkTOTPChains(chains [][]string) error {
+	if u.TOTPSecret == "" {
+		return nil
+	}
+	for _, chain := range chains {
+		last := len(chain) - 1
+		if last < 0 || chain[last] != authMethodKeyboardInteractive {
+			return fmt.Errorf("%q does not end with %s for the TOTP code", strings.Join(chain, ","), authMethodKeyboardInteractive)
+		}
+		other := u.OIDCLogin && last > 0 && chain[0] == authMethodKeyboardInteractive
+		for _, method := range chain[:last] {
+			other = other || method == authMethodPublicKey || method == authMethodPassword
+		}
+		if !other {
+			return fmt.Errorf("%q needs another method before the TOTP code", strings.Join(chain, ","))
+		}
+	}
+	return nil
+}
+
+// connectionAuthenticator authenticates a single ssh connection. It remembers which methods already succeeded,
+// so a user can be required to authenticate with several methods in sequence.
+type connectionAuthenticator struct {
+	context *ContextSftp
+	ctx     gssh.Context
+	// The user the methods in succeeded belong to.
+	user string
+	// The methods that already succeeded in this order.
+	succeeded []string
+	// Sends messages to the client before the authentication has finished.
+	preAuth ssh.ServerPreAuthConn
+	// Whether the client has been told about the maintenance mode.
+	toldMaintenance bool
+}
+
+// isPrefix checks whether prefix is the beginning of the given methods.
+func isPrefix(prefix, methods []string) bool {
+	if len(prefix) > len(methods) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != methods[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the succeeded methods for the given user. They are reset if the user has changed.
+func (a *connectionAuthenticator) succeededFor(user string) []string {
+	if a.user != user {
+		a.user = user
+		a.succeeded = nil
+	}
+	return a.succeeded
+}
+
+// allows checks whether the given method can be the next one for the user of the connection.
+func (a *connectionAuthenticator) allows(conn ssh.ConnMetadata, method string) bool {
+	user := conn.User()
+	entry, ok := a.context.userEntry(user)
+	if !ok || entry.Disabled {
+		return false
+	}
+	if a.context.inMaintenance() {
+		a.tellMaintenance(conn, entry)
+		return false
+	}
+	if !entry.allowsAddress(conn.RemoteAddr()) {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("Rejecting %s login of %s from %s: address not allowed", method, user, conn.RemoteAddr()))
+		return false
+	}
+	chains, err := entry.authenticationChains()
+	if err != nil {
+		return false
+	}
+	attempt := append(append([]string{}, a.succeededFor(user)...), method)
+	for _, chain := range chains {
+		if isPrefix(attempt, chain) {
+			return true
+		}
+	}
+	return false
+}
+
+// tellMaintenance shows the maintenance message in the language of the user once per connection, as every
+// authentication method is rejected during the maintenance mode.
+func (a *connectionAuthenticator) tellMaintenance(conn ssh.ConnMetadata, entry UserEntry) {
+	if a.toldMaintenance {
+		return
+	}
+	a.toldMaintenance = true
+	a.context.logger.Info("ContextSftp", fmt.Sprintf("Rejecting login of %s from %s due to maintenance", conn.User(), conn.RemoteAddr()))
+	if a.preAuth == nil {
+		return
+	}
+	message := a.context.currentConfig().maintenanceMessage(entry.Language)
+	if err := a.preAuth.SendAuthBanner(message + "\n"); err != nil {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("Cannot show the maintenance message to %s: %v", conn.User(), err))
+	}
+}
+
+// completed is called after the given method has succeeded for the user of the connection. It either finishes the
+// authentication or returns a [ssh.PartialSuccessError] that lists the methods that may follow.
+func (a *connectionAuthenticator) completed(conn ssh.ConnMetadata, method string) (*ssh.Permissions, error) {
+	user := conn.User()
+	a.succeeded = append(a.succeededFor(user), method)
+	entry, _ := a.context.userEntry(user)
+	chains, err := entry.authenticationChains()
+	if err != nil {
+		return nil, err
+	}
+	next := ssh.ServerAuthCallbacks{}
+	for _, chain := range chains {
+		if !isPrefix(a.succeeded, chain) {
+			continue
+		}
+		if len(chain) == len(a.succeeded) {
+			a.loggedIn(conn)
+			return a.ctx.Permissions().Permissions, nil
+		}
+		switch chain[len(a.succeeded)] {
+		case authMethodPublicKey:
+			next.PublicKeyCallback = a.publicKey
+		case authMethodPassword:
+			next.PasswordCallback = a.password
+		case authMethodKeyboardInteractive:
+			next.KeyboardInteractiveCallback = a.keyboardInteractive
+		}
+	}
+	a.context.logger.Info("ContextSftp", fmt.Sprintf("Partial authentication of %s with %s", user, strings.Join(a.succeeded, ",")))
+	return nil, &ssh.PartialSuccessError{Next: next}
+}
+
+// loggedIn records the login of the user after the authentication has finished and shows the previous one to
+// the user if desired.
+func (a *connectionAuthenticator) loggedIn(conn ssh.ConnMetadata) {
+	user := conn.User()
+	login := admin.LastLogin{Time: time.Now(), IP: conn.RemoteAddr().String(), Methods: append([]string{}, a.succeeded...)}
+	if key, ok := a.ctx.Value(gssh.ContextKeyPublicKey).(ssh.PublicKey); ok {
+		login.KeyFingerprint = ssh.FingerprintSHA256(key)
+	}
+	previous, ok := a.context.recordLogin(user, login)
+	if ok && a.preAuth != nil && a.context.currentConfig().ShowLastLogin {
+		// The banner is the only message clients show during the login.
+		if err := a.preAuth.SendAuthBanner(lastLoginBanner(previous)); err != nil {
+			a.context.logger.Info("ContextSftp", fmt.Sprintf("Cannot show the last login to %s: %v", user, err))
+		}
+	}
+}
+
+// publicKey only checks if the key is accepted for the user. Whether the authentication has finished is decided
+// in verifiedPublicKey after the client has proven to own the key.
+func (a *connectionAuthenticator) publicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if !a.allows(conn, authMethodPublicKey) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	if _, ok := a.context.validateKey(conn, key); !ok && !a.context.validateCertificate(conn, key) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	if err := a.context.currentConfig().KeyPolicy.checkKey(key); err != nil {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("Rejecting key of %s at %s: %v", conn.User(), conn.RemoteAddr(), err))
+		return nil, fmt.Errorf("permission denied")
+	}
+	return a.ctx.Permissions().Permissions, nil
+}
+
+func (a *connectionAuthenticator) verifiedPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey, _ *ssh.Permissions, signatureAlgorithm string) (*ssh.Permissions, error) {
+	if err := a.context.currentConfig().KeyPolicy.checkSignature(signatureAlgorithm); err != nil {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("Rejecting key of %s at %s: %v", conn.User(), conn.RemoteAddr(), err))
+		return nil, fmt.Errorf("permission denied")
+	}
+	a.ctx.SetValue(gssh.ContextKeyPublicKey, key)
+	restrictions, _ := a.context.validateKey(conn, key)
+	if cert, ok := key.(*ssh.Certificate); ok {
+		restrictions = certificateRestrictions(cert)
+	}
+	a.ctx.SetValue(contextKeyRestrictions, restrictions)
+	return a.completed(conn, authMethodPublicKey)
+}
+
+func (a *connectionAuthenticator) password(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if !a.allows(conn, authMethodPassword) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	entry, _ := a.context.userEntry(conn.User())
+	if !checkPassword(entry.PasswordHash, password) {
+		a.context.recordLoginFailure(conn.RemoteAddr())
+		return nil, fmt.Errorf("permission denied")
+	}
+	return a.completed(conn, authMethodPassword)
+}
+
+// keyboardInteractive asks for the TOTP code of users with a TOTPSecret once another method has succeeded (or
+// if they cannot log in with OIDC). Otherwise, the user is logged in with the OIDC device flow.
+func (a *connectionAuthenticator) keyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if !a.allows(conn, authMethodKeyboardInteractive) {
+		return nil, fmt.Errorf("permission denied")
+	}
+	entry, _ := a.context.userEntry(conn.User())
+	if entry.TOTPSecret != "" && (len(a.succeededFor(conn.User())) > 0 || !entry.OIDCLogin) {
+		ok, err := a.context.totp.askTOTP(conn, client, entry.TOTPSecret)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			a.context.logger.Info("ContextSftp", fmt.Sprintf("Wrong TOTP code for %s at %s", conn.User(), conn.RemoteAddr()))
+			a.context.recordLoginFailure(conn.RemoteAddr())
+			return nil, fmt.Errorf("permission denied")
+		}
+		return a.completed(conn, authMethodKeyboardInteractive)
+	}
+	return a.oidcLogin(conn, client)
+}
+
+// oidcLogin logs the user in with the OIDC device flow. The user is asked to open the verification url of the
+// provider, and we wait until the login there has been completed.
+func (a *connectionAuthenticator) oidcLogin(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	provider := a.context.oidc
+	if provider == nil {
+		return nil, fmt.Errorf("permission denied")
+	}
+	auth, err := provider.StartDeviceFlow(a.ctx)
+	if err != nil {
+		a.context.logger.Err("ContextSftp", fmt.Sprintf("Cannot start OIDC login for %s: %v", conn.User(), err))
+		return nil, fmt.Errorf("permission denied")
+	}
+	instruction := fmt.Sprintf("Open %s and enter the code %s to log in.", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		instruction = fmt.Sprintf("Open %s to log in (code %s).", auth.VerificationURIComplete, auth.UserCode)
+	}
+	// Without any question the client only shows the instruction.
+	if _, err := client(conn.User(), instruction, nil, nil); err != nil {
+		return nil, err
+	}
+	claims, err := provider.WaitForLogin(a.ctx, auth)
+	if err != nil {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("OIDC login for %s failed: %v", conn.User(), err))
+		return nil, fmt.Errorf("permission denied")
+	}
+	if name, _ := claims.String(a.context.currentConfig().OIDC.usernameClaim()); name != conn.User() {
+		a.context.logger.Info("ContextSftp", fmt.Sprintf("OIDC login for %s belongs to %q", conn.User(), name))
+		return nil, fmt.Errorf("permission denied")
+	}
+	return a.completed(conn, authMethodKeyboardInteractive)
+}
+
+// usernameClaim returns the claim that has to match the ssh username.
+func (o OIDCConfig) usernameClaim() string {
+	if o.UsernameClaim == "" {
+		return "preferred_username"
+	}
+	return o.UsernameClaim
+}
+
+// recordLoginFailure counts a failed login from the address for the AutoBan.
+func (c *ContextSftp) recordLoginFailure(addr net.Addr) {
+	if ban, banned := c.autoBan.recordFailure(addr.String()); banned {
+		c.logger.Info("ContextSftp", fmt.Sprintf("Banned %s until %s: %s", ban.IP, ban.Until.Format(time.RFC3339), ban.Reason))
+	}
+}
+
+// serverConfig creates a [ssh.ServerConfig] that authenticates the connection of the given context.
+// It is supposed to be used as [gssh.Server.ServerConfigCallback]. All handlers for authentication
+// of the [gssh.Server] must be nil, otherwise they overwrite the ones set here.
+func (c *ContextSftp) serverConfig() gssh.ServerConfigCallback {
+	return func(ctx gssh.Context) *ssh.ServerConfig {
+		auth := &connectionAuthenticator{context: c, ctx: ctx}
+		config := &ssh.ServerConfig{
+			PreAuthConnCallback:         func(conn ssh.ServerPreAuthConn) { auth.preAuth = conn },
+			PublicKeyCallback:           auth.publicKey,
+			VerifiedPublicKeyCallback:   auth.verifiedPublicKey,
+			PasswordCallback:            auth.password,
+			KeyboardInteractiveCallback: auth.keyboardInteractive,
+			// Without any authentication handler, the gssh.Server allows clients without authentication.
+			// This callback rejects them.
+			NoClientAuthCallback: func(_ ssh.ConnMetadata) (*ssh.Permissions, error) {
+				return nil, fmt.Errorf("authentication required")
+			},
+		}
+		if threshold := c.currentConfig().RekeyThreshold; threshold != "" {
+			// The config has been validated before, so we can ignore the error here.
+			config.RekeyThreshold, _ = parseByteSize(threshold)
+		}
+		return config
+	}
+}
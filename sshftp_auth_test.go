@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuthenticationChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   UserEntry
+		want    [][]string
+		wantErr bool
+	}{
+		{"key only", UserEntry{}, [][]string{{"publickey"}}, false},
+		{"password", UserEntry{PasswordHash: "hash"}, [][]string{{"publickey"}, {"password"}}, false},
+		{"oidc", UserEntry{OIDCLogin: true}, [][]string{{"publickey"}, {"keyboard-interactive"}}, false},
+		{"totp", UserEntry{PasswordHash: "hash", TOTPSecret: "secret"},
+			[][]string{{"publickey", "keyboard-interactive"}, {"password", "keyboard-interactive"}}, false},
+		{"methods", UserEntry{AuthenticationMethods: []string{"publickey, password", "keyboard-interactive"}},
+			[][]string{{"publickey", "password"}, {"keyboard-interactive"}}, false},
+		{"unknown method", UserEntry{AuthenticationMethods: []string{"publickey,hostbased"}}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.entry.authenticationChains()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("authenticationChains() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("authenticationChains() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckTOTPChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   UserEntry
+		wantErr bool
+	}{
+		{"no totp", UserEntry{AuthenticationMethods: []string{"publickey"}}, false},
+		{"default chains", UserEntry{PasswordHash: "hash", TOTPSecret: "secret"}, false},
+		{"key and totp", UserEntry{TOTPSecret: "secret", AuthenticationMethods: []string{"publickey,keyboard-interactive"}}, false},
+		{"totp skipped", UserEntry{TOTPSecret: "secret", AuthenticationMethods: []string{"publickey"}}, true},
+		{"one chain without totp", UserEntry{TOTPSecret: "secret",
+			AuthenticationMethods: []string{"publickey,keyboard-interactive", "password"}}, true},
+		{"totp only", UserEntry{TOTPSecret: "secret", AuthenticationMethods: []string{"keyboard-interactive"}}, true},
+		{"totp twice", UserEntry{TOTPSecret: "secret", AuthenticationMethods: []string{"keyboard-interactive,keyboard-interactive"}}, true},
+		{"oidc and totp", UserEntry{TOTPSecret: "secret", OIDCLogin: true,
+			AuthenticationMethods: []string{"keyboard-interactive,keyboard-interactive"}}, false},
+		{"totp first", UserEntry{TOTPSecret: "secret", AuthenticationMethods: []string{"keyboard-interactive,publickey"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chains, err := test.entry.authenticationChains()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.entry.checkTOTPChains(chains); (err != nil) != test.wantErr {
+				t.Errorf("checkTOTPChains() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
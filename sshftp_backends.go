@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// backendKey identifies the backend of a served directory whose connections can be shared by all sessions.
+type backendKey struct {
+	// The user the upstream server is logged in as, if Upstream has no User.
+	username string
+	upstream UpstreamConfig
+	azure    AzureConfig
+	gcs      GCSConfig
+	proxy    ProxyConfig
+}
+
+// backendPools shares the connections to upstream servers and the clients of cloud storages between all sessions,
+// so the many sessions download accelerators open for reading a file in parallel do not connect again and again.
+// The same goes for the indexes of archives.
+type backendPools struct {
+	// Protects the fields below
+	mutex     sync.Mutex
+	upstreams map[backendKey]sftp2.RemoteFS
+	stores    map[backendKey]sftp2.ObjectStore
+	// The served archives by their path.
+	archives map[string]*sftp2.ArchiveFS
+}
+
+// newBackendPools creates backendPools without connections.
+func newBackendPools() *backendPools {
+	return &backendPools{
+		upstreams: map[backendKey]sftp2.RemoteFS{},
+		stores:    map[backendKey]sftp2.ObjectStore{},
+		archives:  map[string]*sftp2.ArchiveFS{},
+	}
+}
+
+// remoteFS returns the RemoteFS of the entry (which must already be expanded with rootFor) for the given user,
+// connecting through the proxy. If p is nil, every call returns a RemoteFS with a connection of its own.
+func (p *backendPools) remoteFS(username string, entry SFTPEntry, proxy ProxyConfig) sftp2.RemoteFS {
+	if p == nil {
+		return sftp2.NewRemoteFS(entry.Upstream.dialer(username, proxy), entry.Root, entry.ReadOnly, entry.Upstream.poolOptions())
+	}
+	key := backendKey{upstream: entry.Upstream, proxy: proxy}
+	if entry.Upstream.User == "" {
+		key.username = username
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	remote, ok := p.upstreams[key]
+	if !ok {
+		remote = sftp2.NewRemoteFS(entry.Upstream.dialer(username, proxy), entry.Root, entry.ReadOnly, entry.Upstream.poolOptions())
+		p.upstreams[key] = remote
+	}
+	return remote.WithRoot(entry.Root, entry.ReadOnly)
+}
+
+// objectStore returns the cloud storage of the entry or nil if it is not stored in one. Its requests are made
+// through the proxy. If p is nil, every call returns a new store.
+func (p *backendPools) objectStore(entry SFTPEntry, proxy ProxyConfig) (sftp2.ObjectStore, error) {
+	if entry.Azure.Container == "" && entry.GCS.Bucket == "" {
+		return nil, nil
+	}
+	if p == nil {
+		client, err := proxy.httpClient(0)
+		if err != nil {
+			return nil, err
+		}
+		return entry.objectStore(client), nil
+	}
+	key := backendKey{azure: entry.Azure, gcs: entry.GCS, proxy: proxy}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if store, ok := p.stores[key]; ok {
+		return store, nil
+	}
+	client, err := proxy.httpClient(0)
+	if err != nil {
+		return nil, err
+	}
+	store := entry.objectStore(client)
+	p.stores[key] = store
+	return store, nil
+}
+
+// archiveFS returns the ArchiveFS of the archive at the given path, which is only indexed once for all sessions.
+// If p is nil, every call returns a new ArchiveFS.
+func (p *backendPools) archiveFS(path string) *sftp2.ArchiveFS {
+	if p == nil {
+		return sftp2.NewArchiveFS(path)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	archive, ok := p.archives[path]
+	if !ok {
+		archive = sftp2.NewArchiveFS(path)
+		p.archives[path] = archive
+	}
+	return archive
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	"github.com/Entscheider/sshtool/stats"
+)
+
+// How long a circuit breaker rejects operations if no Cooldown is configured.
+const defaultCircuitCooldown = 30 * time.Second
+
+// CircuitBreakerConfig configures failing fast for a directory whose backend keeps failing.
+type CircuitBreakerConfig struct {
+	// The number of consecutive failed operations after which all operations are rejected immediately for the
+	// Cooldown. Zero disables the circuit breaker.
+	Failures int
+	// How long operations are rejected (e.g. "1m"). Defaults to 30 seconds.
+	Cooldown string
+}
+
+func (c CircuitBreakerConfig) validate() error {
+	if c.Failures < 0 {
+		return fmt.Errorf("the CircuitBreaker Failures must not be negative")
+	}
+	if c.Cooldown != "" {
+		if cooldown, err := time.ParseDuration(c.Cooldown); err != nil || cooldown <= 0 {
+			return fmt.Errorf("invalid CircuitBreaker Cooldown %q", c.Cooldown)
+		}
+	}
+	return nil
+}
+
+// cooldown returns the configured Cooldown. The config must have been checked by validate.
+func (c CircuitBreakerConfig) cooldown() time.Duration {
+	if c.Cooldown == "" {
+		return defaultCircuitCooldown
+	}
+	cooldown, _ := time.ParseDuration(c.Cooldown)
+	return cooldown
+}
+
+// circuitBreakers holds the circuit breaker of every directory, so all sessions share them.
+type circuitBreakers struct {
+	// Reports the state of the breakers.
+	stats *stats.Registry
+	// Protects perMount
+	mutex    sync.Mutex
+	perMount map[string]*sftp2.CircuitBreaker
+}
+
+// newCircuitBreakers creates an empty circuitBreakers whose breakers are reported to the registry.
+func newCircuitBreakers(registry *stats.Registry) *circuitBreakers {
+	return &circuitBreakers{stats: registry, perMount: map[string]*sftp2.CircuitBreaker{}}
+}
+
+// breakerFor returns the circuit breaker of the directory with the given name of the user.
+// If b is nil, every call returns a new breaker.
+func (b *circuitBreakers) breakerFor(username, name string, config CircuitBreakerConfig) *sftp2.CircuitBreaker {
+	if b == nil {
+		return sftp2.NewCircuitBreaker(config.Failures, config.cooldown())
+	}
+	key := username + "/" + name
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if breaker, ok := b.perMount[key]; ok {
+		return breaker
+	}
+	breaker := sftp2.NewCircuitBreaker(config.Failures, config.cooldown())
+	b.perMount[key] = breaker
+	b.stats.WatchBackend(key, breaker.Open)
+	return breaker
+}
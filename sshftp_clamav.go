@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Entscheider/sshtool/clamav"
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// How long scanning a single file may take.
+const virusScanTimeout = 5 * time.Minute
+
+// ClamAVConfig configures the scanning of uploaded files with clamd.
+type ClamAVConfig struct {
+	// The address of clamd, either a unix socket like "unix:/run/clamav/clamd.ctl" or a tcp address like
+	// "localhost:3310". An empty string disables scanning.
+	Address string
+	// What happens to infected files: "delete" (the default) or "quarantine".
+	Action string
+	// The directory infected files are moved to if Action is "quarantine".
+	QuarantineDir string
+	// Whether files that cannot be scanned (e.g. while clamd is not reachable) are handled like infected ones.
+	// Otherwise, they are kept (fail-open).
+	FailClosed bool
+}
+
+// validate checks the settings for values that are not supported.
+func (c ClamAVConfig) validate() error {
+	switch c.Action {
+	case "", "delete":
+	case "quarantine":
+		if c.QuarantineDir == "" {
+			return fmt.Errorf("ClamAV needs a QuarantineDir for quarantining")
+		}
+	default:
+		return fmt.Errorf("unknown ClamAV Action %q", c.Action)
+	}
+	return nil
+}
+
+// Sends the content of the file to clamd.
+func scanFile(client clamav.Client, fs sftp2.SimplifiedFS, path string) (clamav.Result, error) {
+	stat, err := fs.Stat(path)
+	if err != nil {
+		return clamav.Result{}, err
+	}
+	reader, err := fs.Read(path)
+	if err != nil {
+		return clamav.Result{}, err
+	}
+	defer func() {
+		if closer, ok := reader.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}()
+	return client.Scan(io.NewSectionReader(reader, 0, stat.Size()))
+}
+
+// quarantine copies the file into the QuarantineDir before it is removed.
+func (c ClamAVConfig) quarantine(fs sftp2.SimplifiedFS, path string, info logger.ConnectionInfo) error {
+	stat, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	reader, err := fs.Read(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closer, ok := reader.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}()
+	name := fmt.Sprintf("%s-%s-%s", time.Now().Format("20060102-150405"), info.Username, filepath.Base(path))
+	file, err := os.OpenFile(filepath.Join(c.QuarantineDir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, io.NewSectionReader(reader, 0, stat.Size())); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// virusScanHook returns a hook that scans every written file and removes infected ones, as well as the ones that
+// cannot be scanned if FailClosed is set. The close of the client fails if the file has been removed. Files are
+// only removed once they have been quarantined, if Action is "quarantine". The results are published to the bus.
+func (c ClamAVConfig) virusScanHook(info logger.ConnectionInfo, bus *events.Bus) sftp2.CheckHook {
+	client := clamav.Client{Address: c.Address, Timeout: virusScanTimeout}
+	return func(fs sftp2.SimplifiedFS, path string) error {
+		event := events.Event{Username: info.Username, IP: info.IP, Path: path}
+		result, err := scanFile(client, fs, path)
+		switch {
+		case err != nil:
+			event.Type = events.ScanFailed
+			event.Message = err.Error()
+			if !c.FailClosed {
+				bus.Publish(event)
+				return nil
+			}
+		case result.Infected:
+			event.Type = events.VirusFound
+			event.Message = fmt.Sprintf("infected with %s", result.Signature)
+		default:
+			return nil
+		}
+		defer func() { bus.Publish(event) }()
+		if c.Action == "quarantine" {
+			if err := c.quarantine(fs, path, info); err != nil {
+				// Removing the file would lose its only copy.
+				event.Message += fmt.Sprintf(", cannot quarantine: %v, kept", err)
+				return nil
+			}
+			event.Message += ", quarantined"
+		}
+		if err := fs.Rm(path); err != nil {
+			event.Message += fmt.Sprintf(", cannot remove: %v", err)
+			return nil
+		}
+		event.Message += ", removed"
+		if event.Type == events.ScanFailed {
+			return fmt.Errorf("the file could not be scanned for viruses and has been removed")
+		}
+		return fmt.Errorf("the file is infected with %s and has been removed", result.Signature)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// infectedClamd returns the address of a clamd reporting everything as infected.
+func infectedClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			// Reads the command and the chunks up to the terminating chunk of length zero.
+			_, _ = reader.ReadString(0)
+			for zeros := 0; zeros < 4; {
+				b, err := reader.ReadByte()
+				if err != nil {
+					break
+				}
+				if b == 0 {
+					zeros++
+				} else {
+					zeros = 0
+				}
+			}
+			_, _ = conn.Write([]byte("stream: Test-Signature FOUND\x00"))
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// An address nobody listens on.
+func unreachableClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+	return address
+}
+
+func TestVirusScanHook(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name      string
+		config    ClamAVConfig
+		wantKept  bool
+		wantErr   bool
+		wantEvent string
+	}{
+		{"infected", ClamAVConfig{Address: infectedClamd(t)}, false, true, events.VirusFound},
+		{"quarantine fails", ClamAVConfig{Address: infectedClamd(t), Action: "quarantine",
+			QuarantineDir: filepath.Join(root, "missing")}, true, false, events.VirusFound},
+		{"scan fails open", ClamAVConfig{Address: unreachableClamd(t)}, true, false, events.ScanFailed},
+		{"scan fails closed", ClamAVConfig{Address: unreachableClamd(t), FailClosed: true}, false, true, events.ScanFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "upload"), []byte("content"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			bus := events.NewBus()
+			var published []events.Event
+			bus.Subscribe(func(event events.Event) { published = append(published, event) })
+			hook := test.config.virusScanHook(logger.ConnectionInfo{Username: "alice"}, bus)
+			err := hook(sftp2.DirFs{Root: dir + "/"}, "/upload")
+			if (err != nil) != test.wantErr {
+				t.Errorf("hook() = %v, want an error %v", err, test.wantErr)
+			}
+			if _, statErr := os.Stat(filepath.Join(dir, "upload")); (statErr == nil) != test.wantKept {
+				t.Errorf("the file has been kept: %v, want %v", statErr == nil, test.wantKept)
+			}
+			if len(published) != 1 || published[0].Type != test.wantEvent {
+				t.Errorf("published %v, want one %s event", published, test.wantEvent)
+			} else if test.wantKept && test.wantEvent == events.VirusFound && !strings.Contains(published[0].Message, "kept") {
+				t.Errorf("the event does not tell that the file has been kept: %s", published[0].Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Entscheider/sshtool/admin"
+	"github.com/Entscheider/sshtool/logger"
+	"github.com/Entscheider/sshtool/redis"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// How long a session is counted without being refreshed by its server (e.g. if the server has crashed).
+const clusterSessionTTL = 90 * time.Second
+
+// How often the sessions of this server are refreshed.
+const clusterRefreshInterval = 30 * time.Second
+
+// RedisConfig configures the redis server several sshtool servers share their state with.
+type RedisConfig struct {
+	// The address of the server like "localhost:6379". An empty string disables sharing.
+	Address string
+	// The password to authenticate with.
+	Password string
+	// The database to use.
+	DB int
+	// The prefix of all keys. Defaults to "sshtool:".
+	Prefix string
+}
+
+// clusterState is the state shared with other servers in redis.
+type clusterState struct {
+	client *redis.Client
+	prefix string
+	// Identifies this server, so its sessions can be told apart from the ones of other servers.
+	instance string
+}
+
+// newClusterState connects to the redis server of the config. Returns nil if no server is configured.
+func (c *ConfigSftp) newClusterState() *clusterState {
+	if c.Redis.Address == "" {
+		return nil
+	}
+	prefix := c.Redis.Prefix
+	if prefix == "" {
+		prefix = "sshtool:"
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &clusterState{
+		client:   redis.NewClient(c.Redis.Address, c.Redis.Password, c.Redis.DB),
+		prefix:   prefix,
+		instance: hex.EncodeToString(id),
+	}
+}
+
+// newUsageStore creates the store for the number of files per user and mount. If the state is shared, so is the
+// store.
+func (c *ConfigSftp) newUsageStore(cluster *clusterState) (sftp2.UsageStore, error) {
+	if cluster != nil {
+		return redisUsageStore{cluster}, nil
+	}
+	return sftp2.NewFileUsageStore(c.UsageFile)
+}
+
+// redisUsageStore is a [sftp2.UsageStore] in redis.
+type redisUsageStore struct {
+	cluster *clusterState
+}
+
+func (r redisUsageStore) Get(key string) (sftp2.Usage, bool, error) {
+	files, err := redis.Int(r.cluster.client.Do("GET", r.cluster.prefix+"usage:"+key))
+	if errors.Is(err, redis.ErrNil) {
+		// Unknown, so the usage is counted.
+		return sftp2.Usage{}, false, nil
+	}
+	if err != nil {
+		return sftp2.Usage{}, false, err
+	}
+	return sftp2.Usage{Files: files}, true, nil
+}
+
+func (r redisUsageStore) Set(key string, usage sftp2.Usage) error {
+	_, err := r.cluster.client.Do("SET", r.cluster.prefix+"usage:"+key, strconv.FormatInt(usage.Files, 10))
+	return err
+}
+
+func (r redisUsageStore) Add(key string, files int64) (sftp2.Usage, error) {
+	total, err := redis.Int(r.cluster.client.Do("INCRBY", r.cluster.prefix+"usage:"+key, strconv.FormatInt(files, 10)))
+	return sftp2.Usage{Files: total}, err
+}
+
+// reserveScript adds ARGV[1] to the usage in KEYS[1] unless it would exceed ARGV[2]. Returns the new usage and
+// whether it has been added.
+const reserveScript = `local usage = tonumber(redis.call('GET', KEYS[1]) or '0')
+local reserved = usage + tonumber(ARGV[1])
+if reserved > tonumber(ARGV[2]) then
+	return {usage, 0}
+end
+redis.call('SET', KEYS[1], reserved)
+return {reserved, 1}`
+
+func (r redisUsageStore) Reserve(key string, files int64, limit int64) (sftp2.Usage, bool, error) {
+	reply, err := r.cluster.client.Do("EVAL", reserveScript, "1", r.cluster.prefix+"usage:"+key,
+		strconv.FormatInt(files, 10), strconv.FormatInt(limit, 10))
+	if err != nil {
+		return sftp2.Usage{}, false, err
+	}
+	array, ok := reply.([]interface{})
+	if !ok || len(array) != 2 {
+		return sftp2.Usage{}, false, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	usage, err := redis.Int(array[0], nil)
+	if err != nil {
+		return sftp2.Usage{}, false, err
+	}
+	added, err := redis.Int(array[1], nil)
+	return sftp2.Usage{Files: usage}, added == 1, err
+}
+
+// redisBanStore is an [admin.BanStore] in redis. Every ban is saved as json and expires with the ban.
+type redisBanStore struct {
+	cluster *clusterState
+}
+
+func (r redisBanStore) Put(ban admin.Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", r.cluster.prefix + "ban:" + ban.IP, string(data)}
+	if !ban.Until.IsZero() {
+		milliseconds := time.Until(ban.Until).Milliseconds()
+		if milliseconds <= 0 {
+			return nil
+		}
+		args = append(args, "PX", strconv.FormatInt(milliseconds, 10))
+	}
+	_, err = r.cluster.client.Do(args...)
+	return err
+}
+
+func (r redisBanStore) Remove(ip string) (bool, error) {
+	removed, err := redis.Int(r.cluster.client.Do("DEL", r.cluster.prefix+"ban:"+ip))
+	return removed > 0, err
+}
+
+func (r redisBanStore) Get(ip string) (admin.Ban, bool, error) {
+	data, err := redis.String(r.cluster.client.Do("GET", r.cluster.prefix+"ban:"+ip))
+	if err == redis.ErrNil {
+		return admin.Ban{}, false, nil
+	}
+	if err != nil {
+		return admin.Ban{}, false, err
+	}
+	var ban admin.Ban
+	if err := json.Unmarshal([]byte(data), &ban); err != nil {
+		return admin.Ban{}, false, err
+	}
+	return ban, true, nil
+}
+
+func (r redisBanStore) All() ([]admin.Ban, error) {
+	keys, err := r.cluster.client.Scan(r.cluster.prefix + "ban:*")
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]admin.Ban, 0, len(keys))
+	for _, key := range keys {
+		ban, ok, err := r.Get(key[len(r.cluster.prefix+"ban:"):])
+		if err != nil {
+			return nil, err
+		}
+		// The ban may have expired in the meantime.
+		if ok {
+			bans = append(bans, ban)
+		}
+	}
+	return bans, nil
+}
+
+// redisLastLoginStore is a lastLoginStore in redis. Every login is saved as json.
+type redisLastLoginStore struct {
+	cluster *clusterState
+}
+
+func (r redisLastLoginStore) Get(user string) (admin.LastLogin, bool) {
+	data, err := redis.String(r.cluster.client.Do("GET", r.cluster.prefix+"login:"+user))
+	if err != nil {
+		return admin.LastLogin{}, false
+	}
+	var login admin.LastLogin
+	if err := json.Unmarshal([]byte(data), &login); err != nil {
+		return admin.LastLogin{}, false
+	}
+	return login, true
+}
+
+func (r redisLastLoginStore) Set(user string, login admin.LastLogin) error {
+	data, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	_, err = r.cluster.client.Do("SET", r.cluster.prefix+"login:"+user, string(data))
+	return err
+}
+
+// The key of the sorted set containing the sessions of the user, scored by the time they expire.
+func (s *clusterState) sessionsKey(username string) string {
+	return s.prefix + "sessions:" + username
+}
+
+// The member of the sorted set for the session with the given id.
+func (s *clusterState) sessionMember(id uint64) string {
+	return s.instance + ":" + strconv.FormatUint(id, 10)
+}
+
+// Adds the session with the given id to the sessions of the user.
+func (s *clusterState) addSession(username string, id uint64) error {
+	expires := time.Now().Add(clusterSessionTTL).UnixNano() / int64(time.Millisecond)
+	key := s.sessionsKey(username)
+	if _, err := s.client.Do("ZADD", key, strconv.FormatInt(expires, 10), s.sessionMember(id)); err != nil {
+		return err
+	}
+	_, err := s.client.Do("PEXPIRE", key, strconv.FormatInt(clusterSessionTTL.Milliseconds(), 10))
+	return err
+}
+
+// startSession counts the session with the given id for the user. If the user already has max sessions
+// on all servers together, the session is not counted and false is returned. A max of zero means no limit.
+func (s *clusterState) startSession(username string, id uint64, max int) (bool, error) {
+	key := s.sessionsKey(username)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if _, err := s.client.Do("ZREMRANGEBYSCORE", key, "-inf", strconv.FormatInt(now, 10)); err != nil {
+		return false, err
+	}
+	// Adding before counting ensures that two servers cannot both accept the last allowed session.
+	if err := s.addSession(username, id); err != nil {
+		return false, err
+	}
+	if max <= 0 {
+		return true, nil
+	}
+	count, err := redis.Int(s.client.Do("ZCARD", key))
+	if err != nil {
+		return false, err
+	}
+	if count > int64(max) {
+		s.endSession(username, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+// endSession stops counting the session with the given id.
+func (s *clusterState) endSession(username string, id uint64) {
+	_, _ = s.client.Do("ZREM", s.sessionsKey(username), s.sessionMember(id))
+}
+
+// refreshSessions keeps the sessions of this server counted until the context is done.
+func (c *ContextSftp) refreshSessions(ctx context.Context) {
+	ticker := time.NewTicker(clusterRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, session := range c.stats.Sessions() {
+			if session.Protocol != "sftp" {
+				continue
+			}
+			if err := c.cluster.addSession(session.Username, session.ID); err != nil {
+				c.logger.Err("Cluster", fmt.Sprintf("Cannot refresh the sessions in redis: %v", err))
+				break
+			}
+		}
+	}
+}
+
+// allowSession checks whether the user may start another session and counts it if so. The session is
+// identified by the id of the stats registry.
+func (c *ContextSftp) allowSession(username string, id uint64) bool {
+	entry, _ := c.userEntry(username)
+	if c.cluster == nil {
+		if entry.MaxSessions <= 0 {
+			return true
+		}
+		count := 0
+		for _, session := range c.stats.Sessions() {
+			if session.Username == username && session.Protocol == "sftp" {
+				count += 1
+			}
+		}
+		// The count includes the new session.
+		return count <= entry.MaxSessions
+	}
+	allowed, err := c.cluster.startSession(username, id, entry.MaxSessions)
+	if err != nil {
+		// We rather accept a session than locking everybody out if redis is not available.
+		c.logger.Err("Cluster", fmt.Sprintf("Cannot count the sessions of %s in redis: %v", username, err))
+		return true
+	}
+	return allowed
+}
+
+// endSession stops counting the session of the user with the given id.
+func (c *ContextSftp) endSession(username string, id uint64) {
+	if c.cluster != nil {
+		c.cluster.endSession(username, id)
+	}
+}
+
+// newBanList creates the list of banned addresses, which is shared with other servers if configured.
+func newBanList(cluster *clusterState, log logger.Logger) *admin.BanList {
+	if cluster == nil {
+		return admin.NewBanList()
+	}
+	return admin.NewSharedBanList(redisBanStore{cluster}, func(err error) {
+		log.Err("Cluster", fmt.Sprintf("Cannot access the bans in redis: %v", err))
+	})
+}
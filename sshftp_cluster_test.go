@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Entscheider/sshtool/redis"
+)
+
+// fakeRedis answers every command with the reply for its name (like "GET"), ignoring the arguments.
+func fakeRedis(t *testing.T, replies map[string]string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					// The command is an array of bulk strings, the first one is its name.
+					var count int
+					if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+						return
+					}
+					args := make([]string, count)
+					for i := range args {
+						var length int
+						if _, err := fmt.Fscanf(reader, "$%d\r\n", &length); err != nil {
+							return
+						}
+						data := make([]byte, length+2)
+						if _, err := io.ReadFull(reader, data); err != nil {
+							return
+						}
+						args[i] = string(data[:length])
+					}
+					_, _ = conn.Write([]byte(replies[args[0]]))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestUsageStore(address string) redisUsageStore {
+	client := redis.NewClient(address, "", 0)
+	client.Timeout = time.Second
+	return redisUsageStore{&clusterState{client: client, prefix: "test:"}}
+}
+
+func TestRedisUsageStore(t *testing.T) {
+	store := newTestUsageStore(fakeRedis(t, map[string]string{
+		"GET":  "$-1\r\n",
+		"EVAL": "*2\r\n:5\r\n:0\r\n",
+	}))
+	if _, ok, err := store.Get("alice"); ok || err != nil {
+		t.Errorf("Get() of a missing key = %v, %v, want unknown", ok, err)
+	}
+	if usage, reserved, err := store.Reserve("alice", 1, 5); usage.Files != 5 || reserved || err != nil {
+		t.Errorf("Reserve() above the limit = %v, %v, %v, want 5 files without reserving", usage, reserved, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := newTestUsageStore(listener.Addr().String())
+	_ = listener.Close()
+	if _, ok, err := unreachable.Get("alice"); ok || err == nil {
+		t.Errorf("Get() without a server = %v, %v, want an error", ok, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// The number of files listed per user in a digest if MaxFiles is not set.
+const defaultDigestMaxFiles = 100
+
+// UploadDigestConfig configures summaries of the files every user has uploaded, which are sent once per interval
+// instead of one notification per file, so bulk uploads do not flood the receivers.
+type UploadDigestConfig struct {
+	// The interval (e.g. "15m") in which the digests are sent. An empty string disables the digests.
+	Interval string
+	// The url the digest of every user is posted to as json object. An empty string posts nothing.
+	URL string
+	// The SMTP server (e.g. "mail.example.com:587") the digests are mailed through. An empty string mails nothing.
+	SMTPAddress string
+	// The credentials for the SMTP server. If SMTPUsername is empty, no authentication is used.
+	SMTPUsername string
+	SMTPPassword string
+	// The sender and the recipients of the mails.
+	From string
+	To   []string
+	// The number of files listed per user in a digest, further ones are only counted. Zero lists 100 files.
+	MaxFiles int
+}
+
+// validate checks the settings for values that are not supported.
+func (d UploadDigestConfig) validate() error {
+	if d.Interval == "" {
+		return nil
+	}
+	if interval, err := time.ParseDuration(d.Interval); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid UploadDigest Interval %q", d.Interval)
+	}
+	if d.URL == "" && d.SMTPAddress == "" {
+		return fmt.Errorf("the UploadDigest needs a URL or an SMTPAddress")
+	}
+	if d.URL != "" {
+		if u, err := url.Parse(d.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid UploadDigest URL %q", d.URL)
+		}
+	}
+	if d.SMTPAddress != "" {
+		if _, _, err := net.SplitHostPort(d.SMTPAddress); err != nil {
+			return fmt.Errorf("invalid UploadDigest SMTPAddress %q", d.SMTPAddress)
+		}
+		if d.From == "" || len(d.To) == 0 {
+			return fmt.Errorf("mailing the UploadDigest needs From and To")
+		}
+	}
+	if d.MaxFiles < 0 {
+		return fmt.Errorf("invalid UploadDigest MaxFiles %d", d.MaxFiles)
+	}
+	return nil
+}
+
+// uploadDigestEntry is the digest of a single user, posted as json object.
+type uploadDigestEntry struct {
+	Username string
+	// The period the files have been uploaded in.
+	Since time.Time
+	Until time.Time
+	// The number of uploaded files and their total size in bytes.
+	Count int
+	Bytes int64
+	// The paths of the first uploaded files, at most MaxFiles.
+	Files []string
+}
+
+// uploadDigest collects the uploaded files of every user until the next digest is sent.
+type uploadDigest struct {
+	config  UploadDigestConfig
+	client  *http.Client
+	onError func(error)
+	// Protects since and perUser.
+	mutex   sync.Mutex
+	since   time.Time
+	perUser map[string]*uploadDigestEntry
+}
+
+// newUploadDigest creates the digest for the config, or returns nil if the digests are disabled. Failures to send
+// a digest are passed to onError.
+func (d UploadDigestConfig) newUploadDigest(proxy ProxyConfig, onError func(error)) (*uploadDigest, error) {
+	if d.Interval == "" {
+		return nil, nil
+	}
+	client, err := proxy.httpClient(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadDigest{config: d, client: client, onError: onError, since: time.Now(), perUser: map[string]*uploadDigestEntry{}}, nil
+}
+
+// add records a file the user has uploaded.
+func (u *uploadDigest) add(username string, path string, size int64) {
+	maxFiles := u.config.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultDigestMaxFiles
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	entry, ok := u.perUser[username]
+	if !ok {
+		entry = &uploadDigestEntry{Username: username}
+		u.perUser[username] = entry
+	}
+	entry.Count++
+	entry.Bytes += size
+	if len(entry.Files) < maxFiles {
+		entry.Files = append(entry.Files, path)
+	}
+}
+
+// hook returns a hook recording every file written by the user of the connection.
+func (u *uploadDigest) hook(info logger.ConnectionInfo) sftp2.WriteHook {
+	return func(fs sftp2.SimplifiedFS, path string) {
+		size := int64(0)
+		if stat, err := fs.Stat(path); err == nil {
+			size = stat.Size()
+		}
+		u.add(info.Username, path, size)
+	}
+}
+
+// take returns the digests of all users with uploads since the previous call, sorted by username.
+func (u *uploadDigest) take() []uploadDigestEntry {
+	u.mutex.Lock()
+	perUser, since := u.perUser, u.since
+	u.perUser, u.since = map[string]*uploadDigestEntry{}, time.Now()
+	u.mutex.Unlock()
+	entries := make([]uploadDigestEntry, 0, len(perUser))
+	for _, entry := range perUser {
+		entry.Since, entry.Until = since, u.since
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
+	return entries
+}
+
+// send posts and mails the digests of all users with uploads since the previous call.
+func (u *uploadDigest) send() {
+	for _, entry := range u.take() {
+		if u.config.URL != "" {
+			if err := u.post(entry); err != nil {
+				u.onError(err)
+			}
+		}
+		if u.config.SMTPAddress != "" {
+			if err := u.mail(entry); err != nil {
+				u.onError(err)
+			}
+		}
+	}
+}
+
+func (u *uploadDigest) post(entry uploadDigestEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	response, err := u.client.Post(u.config.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("the UploadDigest URL %s answered with %s", u.config.URL, response.Status)
+	}
+	return nil
+}
+
+func (u *uploadDigest) mail(entry uploadDigestEntry) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\n", u.config.From, strings.Join(u.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s uploaded %d files\r\n\r\n", entry.Username, entry.Count)
+	fmt.Fprintf(&body, "%s uploaded %d files (%d bytes) between %s and %s:\r\n\r\n", entry.Username, entry.Count,
+		entry.Bytes, entry.Since.Format(time.RFC3339), entry.Until.Format(time.RFC3339))
+	for _, path := range entry.Files {
+		fmt.Fprintf(&body, "%s\r\n", path)
+	}
+	if more := entry.Count - len(entry.Files); more > 0 {
+		fmt.Fprintf(&body, "and %d further files\r\n", more)
+	}
+	var auth smtp.Auth
+	if u.config.SMTPUsername != "" {
+		// The config has been validated before, so we can ignore the error here.
+		host, _, _ := net.SplitHostPort(u.config.SMTPAddress)
+		auth = smtp.PlainAuth("", u.config.SMTPUsername, u.config.SMTPPassword, host)
+	}
+	return smtp.SendMail(u.config.SMTPAddress, auth, u.config.From, u.config.To, []byte(body.String()))
+}
+
+// run sends the digests every Interval until the context is canceled. The uploads since the last digest are sent
+// before it returns.
+func (u *uploadDigest) run(ctx context.Context) {
+	// The config has been validated before, so we can ignore the error here.
+	interval, _ := time.ParseDuration(u.config.Interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			u.send()
+			return
+		case <-ticker.C:
+			u.send()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestUploadDigestSend(t *testing.T) {
+	var mutex sync.Mutex
+	var received []uploadDigestEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry uploadDigestEntry
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		received = append(received, entry)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	config := UploadDigestConfig{Interval: "1m", URL: server.URL, MaxFiles: 2}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := config.newUploadDigest(ProxyConfig{}, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest.add("bob", "/a", 1)
+	digest.add("alice", "/b", 2)
+	digest.add("bob", "/c", 3)
+	digest.add("bob", "/d", 4)
+	digest.send()
+	if len(received) != 2 {
+		t.Fatalf("received %d digests, want one per user", len(received))
+	}
+	bob := received[1]
+	if bob.Username != "bob" || bob.Count != 3 || bob.Bytes != 8 || len(bob.Files) != 2 {
+		t.Errorf("digest of bob = %+v, want 3 files with 8 bytes and 2 listed", bob)
+	}
+	digest.send()
+	if len(received) != 2 {
+		t.Errorf("received %d digests, want none without further uploads", len(received)-2)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// readEncryptionKey reads the hex encoded AES key of 16, 24 or 32 bytes from the file.
+func readEncryptionKey(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("the EncryptionKeyFile %s is not hex encoded", file)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("the key in the EncryptionKeyFile %s has %d bytes instead of 16, 24 or 32", file, len(key))
+	}
+	return key, nil
+}
+
+// validateEncryption checks the EncryptionKeyFile of the directory.
+func (e SFTPEntry) validateEncryption() error {
+	if e.EncryptionKeyFile == "" {
+		if e.EncryptNames {
+			return fmt.Errorf("EncryptNames needs an EncryptionKeyFile")
+		}
+		return nil
+	}
+	if e.Device != "" || e.Snapshots != "" || e.Archive != "" || e.Memory != "" {
+		return fmt.Errorf("a Device, Snapshots, an Archive or Memory cannot be encrypted")
+	}
+	if e.Watch {
+		return fmt.Errorf("an encrypted directory cannot be watched")
+	}
+	_, err := readEncryptionKey(e.EncryptionKeyFile)
+	return err
+}
+
+// encryptedFS wraps fs into a [sftp2.EncryptedFS] if the directory has an EncryptionKeyFile.
+func (e SFTPEntry) encryptedFS(fs sftp2.SimplifiedFS) (sftp2.SimplifiedFS, error) {
+	if e.EncryptionKeyFile == "" {
+		return fs, nil
+	}
+	key, err := readEncryptionKey(e.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return sftp2.NewEncryptedFS(fs, key, e.EncryptNames)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// The longest FreezeWindow. The schedule is checked for every minute of the window.
+const maxFreezeDuration = 7 * 24 * time.Hour
+
+// FreezeWindow is a recurring period in which a directory is read-only, e.g. while a release is published.
+type FreezeWindow struct {
+	// The start of the period as cron expression with the fields minute, hour, day of month, month and day of
+	// week (0 is Sunday) in local time, e.g. "0 22 * * 5" for every Friday at 22:00. Fields can be "*", lists
+	// ("1,15"), ranges ("1-5") and steps ("*/15").
+	Cron string
+	// How long (e.g. "2h") the directory stays read-only after every start.
+	Duration string
+}
+
+// cronField is the set of allowed values of a field of a cron expression.
+type cronField struct {
+	values []bool
+	// Whether the field is "*", which matters for the days (see matches).
+	any bool
+}
+
+// Parses a field of a cron expression whose values lie between min and max.
+func parseCronField(field string, min, max int) (cronField, error) {
+	result := cronField{values: make([]bool, max+1), any: field == "*"}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return result, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return result, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return result, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				// Like "5/15", which starts at 5.
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return result, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			result.values[v] = true
+		}
+	}
+	return result, nil
+}
+
+// cronSchedule is a parsed cron expression.
+type cronSchedule struct {
+	minute, hour, day, month, weekday cronField
+}
+
+// parseCron parses a cron expression with five fields.
+func parseCron(expression string) (cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("invalid cron expression %q, it needs five fields", expression)
+	}
+	var s cronSchedule
+	targets := []*cronField{&s.minute, &s.hour, &s.day, &s.month, &s.weekday}
+	ranges := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	for i, field := range fields {
+		parsed, err := parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid cron expression %q: %v", expression, err)
+		}
+		*targets[i] = parsed
+	}
+	// Sunday is 0 and 7.
+	s.weekday.values[0] = s.weekday.values[0] || s.weekday.values[7]
+	return s, nil
+}
+
+// matches checks whether the schedule starts at the minute of t. Like in cron, the day matches if either the day
+// of month or the day of week matches, unless one of them is "*".
+func (s cronSchedule) matches(t time.Time) bool {
+	if !s.minute.values[t.Minute()] || !s.hour.values[t.Hour()] || !s.month.values[int(t.Month())] {
+		return false
+	}
+	day, weekday := s.day.values[t.Day()], s.weekday.values[int(t.Weekday())]
+	if s.day.any || s.weekday.any {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// validate checks the window for values that are not supported.
+func (w FreezeWindow) validate() error {
+	if _, err := parseCron(w.Cron); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(w.Duration)
+	if err != nil || duration < time.Minute || duration > maxFreezeDuration {
+		return fmt.Errorf("invalid freeze Duration %q, it must be between 1m and %s", w.Duration, maxFreezeDuration)
+	}
+	return nil
+}
+
+// freezeSchedule decides whether one of the windows is open. The result is kept for the current minute, as
+// checking a window means looking at every minute of it.
+type freezeSchedule struct {
+	schedules []cronSchedule
+	// The duration of each window in minutes.
+	minutes []int
+	// Protects the fields below
+	mutex sync.Mutex
+	// The minute of the last check and its result.
+	checked time.Time
+	frozen  bool
+}
+
+// newFreezeSchedule creates the schedule of the windows. They must have been checked by validate.
+func newFreezeSchedule(windows []FreezeWindow) *freezeSchedule {
+	s := &freezeSchedule{}
+	for _, window := range windows {
+		schedule, _ := parseCron(window.Cron)
+		duration, _ := time.ParseDuration(window.Duration)
+		s.schedules = append(s.schedules, schedule)
+		s.minutes = append(s.minutes, int(duration/time.Minute))
+	}
+	return s
+}
+
+// active returns whether a window has started within its duration before t.
+func (s *freezeSchedule) active(t time.Time) bool {
+	minute := t.Local().Truncate(time.Minute)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if minute.Equal(s.checked) {
+		return s.frozen
+	}
+	s.checked, s.frozen = minute, false
+	for i, schedule := range s.schedules {
+		for m := 0; m < s.minutes[i] && !s.frozen; m++ {
+			s.frozen = schedule.matches(minute.Add(-time.Duration(m) * time.Minute))
+		}
+	}
+	return s.frozen
+}
+
+// Returns the function deciding whether the windows freeze a directory, nil if there are none.
+func scheduleOf(windows []FreezeWindow) func(time.Time) bool {
+	if len(windows) == 0 {
+		return nil
+	}
+	return newFreezeSchedule(windows).active
+}
+
+// mountFreezes holds the freeze of every directory, so a directory frozen on demand is frozen for all sessions.
+type mountFreezes struct {
+	// Protects perMount
+	mutex    sync.Mutex
+	perMount map[string]*mountFreeze
+}
+
+// mountFreeze is the freeze of a directory along with the windows of its schedule.
+type mountFreeze struct {
+	freeze  *sftp2.Freeze
+	windows string
+}
+
+func newMountFreezes() *mountFreezes {
+	return &mountFreezes{perMount: map[string]*mountFreeze{}}
+}
+
+// freezeFor returns the freeze of the directory with the given name of the user. If the windows have changed,
+// its schedule is replaced. If f is nil, every call returns a new freeze.
+func (f *mountFreezes) freezeFor(username, name string, windows []FreezeWindow) *sftp2.Freeze {
+	if f == nil {
+		return sftp2.NewFreeze(scheduleOf(windows))
+	}
+	key := username + "/" + name
+	described := fmt.Sprint(windows)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	existing, ok := f.perMount[key]
+	if !ok {
+		existing = &mountFreeze{freeze: sftp2.NewFreeze(scheduleOf(windows)), windows: described}
+		f.perMount[key] = existing
+	} else if existing.windows != described {
+		existing.freeze.SetSchedule(scheduleOf(windows))
+		existing.windows = described
+	}
+	return existing.freeze
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+// How long the FilesystemCommand may run.
+const filesystemCommandTimeout = 30 * time.Second
+
+// runFilesystemCommand runs the FilesystemCommand for the given connection and returns the directories to serve.
+// The command gets the connection info (Username, IP and KeyFingerprint) as json object on stdin and has to
+// print the directories in the same format as the Filesystem entry of a user as json on stdout, e.g.
+// {"data": {"Root": "/srv/tenant1", "ReadOnly": true}}. A non-zero exit code or an invalid output is returned as
+// error, for which the session is served an empty directory.
+func (c *ConfigSftp) runFilesystemCommand(info logger.ConnectionInfo) (map[string]SFTPEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), filesystemCommandTimeout)
+	defer cancel()
+	input, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, c.FilesystemCommand[0], c.FilesystemCommand[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("filesystem command failed for %s: %v %s", info.Username, err, strings.TrimSpace(stderr.String()))
+	}
+	var filesystem map[string]SFTPEntry
+	if err := json.Unmarshal(output, &filesystem); err != nil {
+		return nil, fmt.Errorf("invalid output of filesystem command for %s: %v", info.Username, err)
+	}
+	return filesystem, nil
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+func TestFilesystemCommand(t *testing.T) {
+	dir := t.TempDir() + "/"
+	info := logger.ConnectionInfo{Username: "alice", IP: "192.0.2.1", KeyFingerprint: "SHA256:abc", SessionID: 1}
+	// Serves the directory only to the connection it gets on stdin.
+	script := `grep -q '"IP":"192.0.2.1"' && echo '{"data": {"Root": "` + dir + `"}}'`
+	config := &ConfigSftp{FilesystemCommand: []string{"sh", "-c", script}}
+	entry := UserEntry{Filesystem: map[string]SFTPEntry{"home": {Root: "/nonexistent/"}}}
+	filesystem, err := config.runFilesystemCommand(info)
+	if err != nil || len(filesystem) != 1 || filesystem["data"].Root != dir {
+		t.Fatalf("runFilesystemCommand() = %v, %v", filesystem, err)
+	}
+	session, err := config.sessionConfig(info, entry)
+	if err != nil || session.Users["alice"].Filesystem["data"].Root != dir {
+		t.Errorf("sessionConfig() = %v, %v", session.Users["alice"].Filesystem, err)
+	}
+
+	for _, command := range [][]string{{"sh", "-c", "echo denied >&2; exit 1"}, {"echo", "no json"}} {
+		config.FilesystemCommand = command
+		if _, err := config.runFilesystemCommand(info); err == nil {
+			t.Errorf("runFilesystemCommand() of %q succeeded", command)
+		}
+		// The sftp handler serves an empty directory on this error.
+		if _, err := config.CreateFS(info, entry, fsShared{}); err == nil {
+			t.Errorf("CreateFS() with %q succeeded", command)
+		}
+		// The process of a RunAs session serves an empty directory instead of the ones of the user.
+		session, err := config.sessionConfig(info, entry)
+		if err == nil || len(session.Users["alice"].Filesystem) != 0 {
+			t.Errorf("sessionConfig() with %q = %v, %v", command, session.Users["alice"].Filesystem, err)
+		}
+		bandwidth, err := newBandwidthLimits(&session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := session.CreateFS(info, session.Users["alice"], fsShared{bandwidth: bandwidth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := fs.List("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make([]os.FileInfo, 1)
+		if n, _ := list(files, 0); n != 0 {
+			t.Errorf("served directory with %q contains %s", command, files[0].Name())
+		}
+	}
+}
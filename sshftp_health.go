@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// How long checking a single directory may take before it is considered unavailable.
+const healthProbeTimeout = 10 * time.Second
+
+// mountProbe is the state of checking a single served directory.
+type mountProbe struct {
+	// The config the fs has been created for. The fs is created again if it changes.
+	entry SFTPEntry
+	// Kept between the checks, so connections to remote servers are reused. Nil if it could not be created.
+	fs sftp2.SimplifiedFS
+	// Whether the last check has failed.
+	unavailable bool
+	// Whether a check is still running.
+	running bool
+}
+
+// mountHealth keeps track of the availability of every served directory.
+type mountHealth struct {
+	// Protects probes
+	mutex  sync.Mutex
+	probes map[string]*mountProbe
+}
+
+// newMountHealth creates a mountHealth considering every directory available.
+func newMountHealth() *mountHealth {
+	return &mountHealth{probes: map[string]*mountProbe{}}
+}
+
+// unavailableFunc returns a function reporting whether a directory of the user is unavailable.
+// If h is nil, all directories are available.
+func (h *mountHealth) unavailableFunc(username string) func(name string) bool {
+	if h == nil {
+		return nil
+	}
+	return func(name string) bool {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		probe, ok := h.probes[username+"/"+name]
+		return ok && probe.unavailable
+	}
+}
+
+// checkHealth checks the directories of all users in the HealthCheckInterval until the context is done.
+func (c *ContextSftp) checkHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.probeMounts()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeMounts starts checking every served directory whose previous check has finished.
+func (c *ContextSftp) probeMounts() {
+	config := c.currentConfig()
+	health := c.shared.health
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	seen := make(map[string]bool)
+	for username, userEntry := range config.Users {
+		// A single directory is served directly, there is nothing to hide it from.
+		if _, ok := userEntry.Filesystem[""]; ok {
+			continue
+		}
+		for name, entry := range userEntry.Filesystem {
+			key := username + "/" + name
+			seen[key] = true
+			probe, ok := health.probes[key]
+			if !ok {
+				probe = &mountProbe{}
+				health.probes[key] = probe
+			}
+			if probe.running {
+				continue
+			}
+			probe.running = true
+			go c.probe(config, username, name, userEntry, entry, probe)
+		}
+	}
+	// Forget the directories that are no longer served.
+	for key := range health.probes {
+		if !seen[key] {
+			delete(health.probes, key)
+		}
+	}
+}
+
+// statRoot checks whether the root of the directory can be read. It gives up after the healthProbeTimeout.
+func statRoot(fs sftp2.SimplifiedFS) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := fs.Stat("/")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthProbeTimeout):
+		return fmt.Errorf("no answer within %s", healthProbeTimeout)
+	}
+}
+
+// probe checks whether the root of the directory can be read and records the result.
+func (c *ContextSftp) probe(config *ConfigSftp, username, name string, userEntry UserEntry, entry SFTPEntry, probe *mountProbe) {
+	// Only this goroutine uses the fs and the entry while the probe is running.
+	var err error
+	if probe.fs == nil || !reflect.DeepEqual(probe.entry, entry) {
+		probe.fs, err = config.createMountFS(logger.ConnectionInfo{Username: username}, name, userEntry, entry, c.shared)
+		probe.entry = entry
+	}
+	if err == nil {
+		err = statRoot(probe.fs)
+	}
+	c.shared.health.mutex.Lock()
+	defer c.shared.health.mutex.Unlock()
+	probe.running = false
+	c.setAvailability(username+"/"+name, probe, err)
+}
+
+// setAvailability records the result of a check and logs changes. The mutex of the mountHealth must be held.
+func (c *ContextSftp) setAvailability(key string, probe *mountProbe, err error) {
+	unavailable := err != nil
+	if unavailable && !probe.unavailable {
+		c.logger.Warn("HealthCheck", fmt.Sprintf("Directory %s is unavailable: %v", key, err))
+	} else if !unavailable && probe.unavailable {
+		c.logger.Info("HealthCheck", fmt.Sprintf("Directory %s is available again", key))
+	}
+	probe.unavailable = unavailable
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default of ResolveTimeout.
+const defaultResolveTimeout = time.Second
+
+// How long a resolved hostname (or the lack of one) is kept.
+const hostnameCacheDuration = time.Hour
+
+// hostnameLookup is the reverse DNS lookup of an address, which may still be running.
+type hostnameLookup struct {
+	// Closed once the lookup has finished.
+	done     chan struct{}
+	hostname string
+	// The time after which the address is looked up again.
+	expires time.Time
+}
+
+// hostnameCache resolves the hostnames of the clients in the background and keeps them for a while, so clients
+// that connect often do not cause a lookup every time.
+type hostnameCache struct {
+	// How long a lookup may take.
+	timeout time.Duration
+	// Protects the fields below
+	mutex   sync.Mutex
+	lookups map[string]*hostnameLookup
+	// The last time expired lookups have been removed from the map.
+	lastCleanup time.Time
+}
+
+// newHostnameCache creates the cache for ResolveHostnames. Returns nil if the hostnames are not resolved.
+func (c *ConfigSftp) newHostnameCache() *hostnameCache {
+	if !c.ResolveHostnames {
+		return nil
+	}
+	// The config has been validated before, so we can ignore the error here.
+	timeout := defaultResolveTimeout
+	if c.ResolveTimeout != "" {
+		timeout, _ = time.ParseDuration(c.ResolveTimeout)
+	}
+	return &hostnameCache{timeout: timeout, lookups: map[string]*hostnameLookup{}}
+}
+
+// start looks up the hostname of the address in the background unless it is known already. Returns a function
+// that waits for the lookup and returns the hostname, or an empty string if there is none. Returns nil if h is nil.
+func (h *hostnameCache) start(addr string) func() string {
+	if h == nil {
+		return nil
+	}
+	ip := hostOf(addr)
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if now.Sub(h.lastCleanup) > time.Minute {
+		for key, lookup := range h.lookups {
+			if now.After(lookup.expires) {
+				delete(h.lookups, key)
+			}
+		}
+		h.lastCleanup = now
+	}
+	lookup, ok := h.lookups[ip]
+	if !ok || now.After(lookup.expires) {
+		lookup = &hostnameLookup{done: make(chan struct{}), expires: now.Add(hostnameCacheDuration)}
+		h.lookups[ip] = lookup
+		go func() {
+			defer close(lookup.done)
+			ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+			defer cancel()
+			if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+				lookup.hostname = strings.TrimSuffix(names[0], ".")
+			}
+		}()
+	}
+	return func() string {
+		<-lookup.done
+		return lookup.hostname
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyRestrictions are the restrictions the options of an authorized key put on the connections logged in with it.
+type keyRestrictions struct {
+	// Whether the served directories can only be read (the "readonly" option, which OpenSSH does not know).
+	readOnly bool
+	// Whether port forwarding (and thus webdav), agent forwarding, pseudo terminals or X11 forwarding are denied.
+	noPortForwarding  bool
+	noAgentForwarding bool
+	noPty             bool
+	noX11Forwarding   bool
+	// Whether the key is limited in any way, by its options (including from and expiry-time) or as certificate.
+	// Sessions of such keys cannot replace the keys of the user (see KeySelfService), as the new keys would not
+	// be limited anymore.
+	limited bool
+	// The comment of the key, which selects the KeyPermissions of the user.
+	comment string
+}
+
+// contextKeyRestrictions is the key of the keyRestrictions of the key the user of a connection has logged in
+// with in its context.
+var contextKeyRestrictions = &struct{ name string }{"key-restrictions"}
+
+// restrictionsOf returns the restrictions of the key the user of the connection has logged in with.
+func restrictionsOf(ctx context.Context) keyRestrictions {
+	restrictions, _ := ctx.Value(contextKeyRestrictions).(keyRestrictions)
+	return restrictions
+}
+
+// apply returns the entry of a user logged in with a key with these restrictions.
+func (r keyRestrictions) apply(entry UserEntry) UserEntry {
+	permissions := entry.keyPermissionsFor(r.comment)
+	if permissions != nil {
+		entry = permissions.apply(entry)
+	}
+	if r.readOnly {
+		// Nothing is writable, whatever the directories are.
+		entry.CanWrite = nil
+		entry.AuditOnly = false
+		filesystem := make(map[string]SFTPEntry, len(entry.Filesystem))
+		for name, mount := range entry.Filesystem {
+			mount.ReadOnly = true
+			filesystem[name] = mount
+		}
+		entry.Filesystem = filesystem
+	}
+	// Webdav is served through port forwarding and does not know about the key of the connection.
+	if r.readOnly || r.noPortForwarding || permissions != nil {
+		entry.WebDav = false
+	}
+	entry.AllowAgentForwarding = entry.AllowAgentForwarding && !r.noAgentForwarding
+	entry.AllowPty = entry.AllowPty && !r.noPty
+	entry.AllowX11Forwarding = entry.AllowX11Forwarding && !r.noX11Forwarding
+	return entry
+}
+
+// certificateRestrictions returns the restrictions of a user certificate. Like in OpenSSH, forwarding,
+// terminals and X11 are only allowed if the certificate has the matching permit-* extension.
+func certificateRestrictions(cert *ssh.Certificate) keyRestrictions {
+	permits := func(extension string) bool {
+		_, ok := cert.Extensions[extension]
+		return ok
+	}
+	return keyRestrictions{
+		noPortForwarding:  !permits("permit-port-forwarding"),
+		noAgentForwarding: !permits("permit-agent-forwarding"),
+		noPty:             !permits("permit-pty"),
+		noX11Forwarding:   !permits("permit-X11-forwarding"),
+		// Certificates expire, so new keys must not replace them.
+		limited: true,
+	}
+}
+
+// authorizedKey is a key of an authorized_keys file.
+type authorizedKey struct {
+	key ssh.PublicKey
+	// The patterns of the from option. If empty, the key can be used from every address.
+	from []string
+	// The time of the expiry-time option after which the key is rejected. Zero if it does not expire.
+	expires time.Time
+	// The restrictions of the other options.
+	restrictions keyRestrictions
+}
+
+// parsedKeys are the AuthorizedKeys of a UserEntry parsed once the entry has been stored.
+type parsedKeys struct {
+	// The AuthorizedKeys that have been parsed, joined by newlines.
+	source string
+	keys   []authorizedKey
+}
+
+// parseExpiryTime parses the value of the expiry-time option. Like in OpenSSH, it is formatted as YYYYMMDD or
+// YYYYMMDDHHMM[SS] in local time or in UTC with a trailing "Z".
+func parseExpiryTime(value string) (time.Time, error) {
+	value = strings.Trim(value, `"`)
+	location := time.Local
+	if utc, ok := strings.CutSuffix(value, "Z"); ok {
+		value, location = utc, time.UTC
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	expires, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	return expires, nil
+}
+
+// checkKeyExpiries checks the expiry-time options of keys formatted like the lines of an "authorized_keys" file.
+func checkKeyExpiries(authorizedKeys []string) error {
+	for _, line := range authorizedKeys {
+		_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return err
+		}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			if strings.EqualFold(name, "expiry-time") {
+				if _, err := parseExpiryTime(value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expired returns whether the key has expired at the given time according to its expiry-time option.
+func (k authorizedKey) expired(now time.Time) bool {
+	return !k.expires.IsZero() && !now.Before(k.expires)
+}
+
+// allows checks whether the key can be used from the given address according to its from option.
+// Like OpenSSH, a pattern is either a wildcard pattern (e.g. "192.168.1.*"), a CIDR (e.g. "10.0.0.0/8") or one of
+// these prefixed with "!" to deny the matching addresses.
+func (k authorizedKey) allows(addr net.Addr) bool {
+	if len(k.from) == 0 {
+		return true
+	}
+	host := hostOf(addr.String())
+	ip := net.ParseIP(host)
+	allowed := false
+	for _, pattern := range k.from {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var matches bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			matches = ip != nil && network.Contains(ip)
+		} else {
+			matches, _ = path.Match(pattern, host)
+		}
+		if matches && negated {
+			return false
+		}
+		allowed = allowed || matches
+	}
+	return allowed
+}
+
+// parseAuthorizedKeysFile parses the content of an authorized_keys file. Comments, empty lines and lines that
+// cannot be parsed are skipped. Of the options of a key, from, expiry-time, restrict, readonly and the ones restrict
+// stands for (like no-pty, which pty allows again after restrict) are supported. Keys with the cert-authority option
+// or an invalid expiry-time are skipped, as they are no (usable) keys of the user.
+func parseAuthorizedKeysFile(data []byte) []authorizedKey {
+	var keys []authorizedKey
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// There is no further valid key.
+			break
+		}
+		data = rest
+		entry := authorizedKey{key: key}
+		skip := false
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			name = strings.ToLower(name)
+			switch name {
+			case "cert-authority":
+				skip = true
+			case "from":
+				entry.from = strings.Split(strings.Trim(value, `"`), ",")
+			case "expiry-time":
+				if entry.expires, err = parseExpiryTime(value); err != nil {
+					skip = true
+				}
+			case "restrict":
+				entry.restrictions = keyRestrictions{readOnly: entry.restrictions.readOnly, noPortForwarding: true,
+					noAgentForwarding: true, noPty: true, noX11Forwarding: true}
+			case "readonly":
+				entry.restrictions.readOnly = true
+			case "no-port-forwarding", "port-forwarding":
+				entry.restrictions.noPortForwarding = strings.HasPrefix(name, "no-")
+			case "no-agent-forwarding", "agent-forwarding":
+				entry.restrictions.noAgentForwarding = strings.HasPrefix(name, "no-")
+			case "no-pty", "pty":
+				entry.restrictions.noPty = strings.HasPrefix(name, "no-")
+			case "no-x11-forwarding", "x11-forwarding":
+				entry.restrictions.noX11Forwarding = strings.HasPrefix(name, "no-")
+			}
+		}
+		entry.restrictions.limited = len(options) > 0
+		entry.restrictions.comment = comment
+		if !skip {
+			keys = append(keys, entry)
+		}
+	}
+	return keys
+}
+
+// authorizedKeysFile is a parsed authorized_keys file along with the state of the file it was parsed from.
+type authorizedKeysFile struct {
+	modTime time.Time
+	size    int64
+	keys    []authorizedKey
+}
+
+// authorizedKeysFiles caches the parsed authorized_keys files of the users and re-reads a file once it has
+// been changed.
+type authorizedKeysFiles struct {
+	// Protects files
+	mutex sync.Mutex
+	files map[string]authorizedKeysFile
+}
+
+func newAuthorizedKeysFiles() *authorizedKeysFiles {
+	return &authorizedKeysFiles{files: map[string]authorizedKeysFile{}}
+}
+
+// keys returns the keys of the authorized_keys file with the given name.
+func (a *authorizedKeysFiles) keys(filename string) ([]authorizedKey, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	cached, ok := a.files[filename]
+	a.mutex.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.keys, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	file := authorizedKeysFile{modTime: stat.ModTime(), size: stat.Size(), keys: parseAuthorizedKeysFile(data)}
+	a.mutex.Lock()
+	a.files[filename] = file
+	a.mutex.Unlock()
+	return file.keys, nil
+}
+
+// findKey looks for the key among the keys that may be used from the address and have not expired.
+func findKey(keys []authorizedKey, key ssh.PublicKey, addr net.Addr) (authorizedKey, bool) {
+	now := time.Now()
+	for _, authorized := range keys {
+		if gssh.KeysEqual(authorized.key, key) && authorized.allows(addr) && !authorized.expired(now) {
+			return authorized, true
+		}
+	}
+	return authorizedKey{}, false
+}
+
+// validateKeyFromFiles checks if the key is listed in one of the AuthorizedKeysFile of the user of the connection
+// and may be used from its address. Returns the restrictions of the key.
+func (c *ContextSftp) validateKeyFromFiles(conn ssh.ConnMetadata, entry UserEntry, key ssh.PublicKey) (keyRestrictions, bool) {
+	for _, filename := range entry.AuthorizedKeysFile {
+		filename = strings.ReplaceAll(filename, "%u", conn.User())
+		keys, err := c.keyFiles.keys(filename)
+		if err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot read the AuthorizedKeysFile %s of %s: %v", filename, conn.User(), err))
+			continue
+		}
+		if authorized, ok := findKey(keys, key, conn.RemoteAddr()); ok {
+			return authorized.restrictions, true
+		}
+	}
+	return keyRestrictions{}, false
+}
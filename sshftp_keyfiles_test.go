@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertificateRestrictions(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		want       keyRestrictions
+	}{
+		{"no extensions", nil, keyRestrictions{noPortForwarding: true, noAgentForwarding: true, noPty: true,
+			noX11Forwarding: true, limited: true}},
+		{"ssh-keygen defaults", map[string]string{"permit-port-forwarding": "", "permit-agent-forwarding": "",
+			"permit-pty": "", "permit-X11-forwarding": "", "permit-user-rc": ""}, keyRestrictions{limited: true}},
+		{"pty only", map[string]string{"permit-pty": ""}, keyRestrictions{noPortForwarding: true,
+			noAgentForwarding: true, noX11Forwarding: true, limited: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert := &ssh.Certificate{Permissions: ssh.Permissions{Extensions: test.extensions}}
+			if got := certificateRestrictions(cert); got != test.want {
+				t.Errorf("certificateRestrictions() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExpiryTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"20261231", time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local), false},
+		{`"20261231"`, time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local), false},
+		{"202612311530", time.Date(2026, 12, 31, 15, 30, 0, 0, time.Local), false},
+		{"20261231153045", time.Date(2026, 12, 31, 15, 30, 45, 0, time.Local), false},
+		{"20261231Z", time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), false},
+		{"202612311530Z", time.Date(2026, 12, 31, 15, 30, 0, 0, time.UTC), false},
+		{"2026123", time.Time{}, true},
+		{"2026123115", time.Time{}, true},
+		{"20261331", time.Time{}, true},
+		{"2026-12-31", time.Time{}, true},
+		{"Z", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseExpiryTime(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseExpiryTime(%q) error = %v, wantErr %v", test.value, err, test.wantErr)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("parseExpiryTime(%q) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeyExpired(t *testing.T) {
+	expires := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		expires time.Time
+		now     time.Time
+		want    bool
+	}{
+		{"no expiry", time.Time{}, expires, false},
+		{"before", expires, expires.Add(-time.Second), false},
+		{"at expiry", expires, expires, true},
+		{"after", expires, expires.Add(time.Hour), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := (authorizedKey{expires: test.expires}).expired(test.now); got != test.want {
+				t.Errorf("expired() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyPermissions(t *testing.T) {
+	entry := UserEntry{
+		CanRead:  []string{".*"},
+		CanWrite: []string{".*"},
+		WebDav:   true,
+		KeyPermissions: []KeyPermissions{
+			{Comment: "^ci$", CanWrite: []string{"^/releases/"}},
+			{Comment: "backup", CanWrite: []string{}},
+		},
+	}
+	tests := []struct {
+		comment  string
+		canWrite []string
+		webDav   bool
+	}{
+		{"", []string{".*"}, true},
+		{"alice@laptop", []string{".*"}, true},
+		{"ci", []string{"^/releases/"}, false},
+		{"nightly backup", []string{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.comment, func(t *testing.T) {
+			got := keyRestrictions{comment: test.comment}.apply(entry)
+			if !reflect.DeepEqual(got.CanWrite, test.canWrite) || got.WebDav != test.webDav {
+				t.Errorf("CanWrite = %q, WebDav = %v, want %q, %v", got.CanWrite, got.WebDav, test.canWrite, test.webDav)
+			}
+			if !reflect.DeepEqual(got.CanRead, entry.CanRead) {
+				t.Errorf("CanRead = %q, want it unchanged", got.CanRead)
+			}
+		})
+	}
+	keys := parseAuthorizedKeysFile([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFkA4/+LP509Q6ScJmZjLDO2F8/Qzw1fS1HOCYEuXkvC ci\n"))
+	if len(keys) != 1 || keys[0].restrictions.comment != "ci" {
+		t.Errorf("parsed %+v, want a key with the comment ci", keys)
+	}
+}
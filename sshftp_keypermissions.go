@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// KeyPermissions replaces the permissions of a user for the sessions logged in with certain authorized keys, e.g.
+// so the key of a build server can only write releases without an account of its own.
+type KeyPermissions struct {
+	// A regular expression matched against the comment of the authorized key the user has logged in with, e.g.
+	// "^ci$" for keys with the comment "ci". Keys without a comment never match.
+	Comment string
+	// Replace the CanRead, CanWrite and ShouldHide of the user if set, even if empty.
+	CanRead    []string
+	CanWrite   []string
+	ShouldHide []string
+}
+
+// validate checks the regular expressions of the permissions.
+func (k KeyPermissions) validate() error {
+	if k.Comment == "" {
+		return fmt.Errorf("KeyPermissions need a Comment")
+	}
+	if _, err := regexp.Compile(k.Comment); err != nil {
+		return fmt.Errorf("invalid Comment of KeyPermissions: %v", err)
+	}
+	for _, expressions := range [][]string{k.CanRead, k.CanWrite, k.ShouldHide} {
+		if _, err := intoRegexp(expressions); err != nil {
+			return fmt.Errorf("invalid regular expression of KeyPermissions %q: %v", k.Comment, err)
+		}
+	}
+	return nil
+}
+
+// apply returns the entry with the permissions that are set replacing the ones of the user.
+func (k KeyPermissions) apply(entry UserEntry) UserEntry {
+	if k.CanRead != nil {
+		entry.CanRead = k.CanRead
+	}
+	if k.CanWrite != nil {
+		entry.CanWrite = k.CanWrite
+	}
+	if k.ShouldHide != nil {
+		entry.ShouldHide = k.ShouldHide
+	}
+	return entry
+}
+
+// keyPermissionsFor returns the first KeyPermissions of the user whose Comment matches the comment of a key, or
+// nil if there is none.
+func (u UserEntry) keyPermissionsFor(comment string) *KeyPermissions {
+	if comment == "" {
+		return nil
+	}
+	for i, permissions := range u.KeyPermissions {
+		// The config has been validated before, so we can ignore the error here.
+		if matches, _ := regexp.MatchString(permissions.Comment, comment); matches {
+			return &u.KeyPermissions[i]
+		}
+	}
+	return nil
+}
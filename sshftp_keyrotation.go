@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// keysDirectory is the name of the directory added to the root for KeySelfService.
+const keysDirectory = ".ssh"
+
+// rotatedKeys parses the authorized_keys file written by a user whose AuthorizedKeys are currently the given
+// ones. Keys that are kept keep their line (and thus their options), new keys must not have options, so users
+// cannot lift the restrictions of their keys. Returns the new AuthorizedKeys.
+func rotatedKeys(current []string, content []byte, policy KeyPolicyConfig) ([]string, error) {
+	existing, err := parseAuthorizedKeys(current)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	var added []ssh.PublicKey
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		duplicate := false
+		for _, other := range added {
+			duplicate = duplicate || gssh.KeysEqual(other, key)
+		}
+		if duplicate {
+			continue
+		}
+		added = append(added, key)
+		kept := false
+		for j, other := range existing {
+			if gssh.KeysEqual(other, key) {
+				result = append(result, current[j])
+				kept = true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+		if len(options) > 0 {
+			return nil, fmt.Errorf("line %d: new keys cannot have options", i+1)
+		}
+		if err := policy.checkKey(key); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		result = append(result, strings.TrimSpace(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))+" "+comment))
+	}
+	if len(result) == 0 {
+		// Nobody could log in with a key anymore.
+		return nil, fmt.Errorf("at least one key is required")
+	}
+	return result, nil
+}
+
+// Returns the fingerprints of the keys of the list that are not part of the other list.
+func missingKeys(keys []string, other []string) []string {
+	var fingerprints []string
+	otherKeys, _ := parseAuthorizedKeys(other)
+	for _, line := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, otherKey := range otherKeys {
+			found = found || gssh.KeysEqual(key, otherKey)
+		}
+		if !found {
+			fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+		}
+	}
+	return fingerprints
+}
+
+// replaceKeys replaces the AuthorizedKeys of the user of the connection with the keys of the written
+// authorized_keys file.
+func (c *ContextSftp) replaceKeys(info logger.ConnectionInfo, content []byte) error {
+	config := c.currentConfig()
+	entry, ok := config.Users[info.Username]
+	if !ok {
+		// E.g. the users of the LDAP server.
+		return fmt.Errorf("the keys of %s cannot be changed", info.Username)
+	}
+	keys, err := rotatedKeys(entry.AuthorizedKeys, content, config.KeyPolicy)
+	if err != nil {
+		c.logger.Info("ContextSftp", fmt.Sprintf("Rejecting the keys of %s at %s: %v", info.Username, info.IP, err))
+		return err
+	}
+	added, removed := missingKeys(keys, entry.AuthorizedKeys), missingKeys(entry.AuthorizedKeys, keys)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	entry.AuthorizedKeys = keys
+	if err := c.setUser(info.Username, &entry); err != nil {
+		return err
+	}
+	c.shared.events.Publish(events.Event{
+		Type:     events.KeysChanged,
+		Time:     time.Now(),
+		Username: info.Username,
+		IP:       info.IP,
+		Path:     "/" + keysDirectory + "/authorized_keys",
+		Message:  fmt.Sprintf("added %v, removed %v", added, removed),
+	})
+	return nil
+}
+
+// keysFS adds the directory for KeySelfService to fs. Its authorized_keys file contains the keys returned by
+// current, and writing it passes the new content to replace.
+func keysFS(fs sftp2.SimplifiedFS, current func() []string, replace func(content []byte) error) sftp2.SimplifiedFS {
+	return sftp2.VirtualDirFS{
+		Inner: fs,
+		Name:  keysDirectory,
+		Files: map[string]func() ([]byte, error){
+			"authorized_keys": func() ([]byte, error) {
+				var content strings.Builder
+				for _, key := range current() {
+					content.WriteString(key + "\n")
+				}
+				return []byte(content.String()), nil
+			},
+		},
+		Writable: map[string]func([]byte) error{
+			"authorized_keys": replace,
+		},
+	}
+}
+
+// keysFS adds the directory for KeySelfService to fs. Its authorized_keys file contains the AuthorizedKeys of
+// the user, which are replaced whenever it is written.
+func (c *ContextSftp) keysFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo) sftp2.SimplifiedFS {
+	return keysFS(fs, func() []string {
+		entry, _ := c.userEntry(info.Username)
+		return entry.AuthorizedKeys
+	}, func(content []byte) error {
+		return c.replaceKeys(info, content)
+	})
+}
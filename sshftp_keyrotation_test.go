@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns a new ed25519 key formatted like an authorized_keys line without options and comment.
+func newAuthorizedKeyLine(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestRotatedKeys(t *testing.T) {
+	oldKey, newKey := newAuthorizedKeyLine(t), newAuthorizedKeyLine(t)
+	current := []string{`from="10.0.0.0/8",readonly ` + oldKey + " old"}
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{"keep", oldKey + "\n", current, false},
+		{"keep without options", oldKey + " changed comment\n", current, false},
+		{"add", oldKey + "\n" + newKey + " new\n", []string{current[0], newKey + " new"}, false},
+		{"replace", "# comment\n\n" + newKey + "\n", []string{newKey}, false},
+		{"duplicate", newKey + "\n" + newKey + " again\n", []string{newKey}, false},
+		{"new key with options", "no-pty " + newKey + "\n", nil, true},
+		{"no key", "# nothing\n", nil, true},
+		{"invalid line", "ssh-ed25519 invalid\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := rotatedKeys(current, []byte(test.content), KeyPolicyConfig{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("rotatedKeys() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("rotatedKeys() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAuthorizedKeysFileLimited(t *testing.T) {
+	key := newAuthorizedKeyLine(t)
+	tests := []struct {
+		line    string
+		limited bool
+	}{
+		{key, false},
+		{"readonly " + key, true},
+		{`from="192.168.1.*" ` + key, true},
+		{"expiry-time=20300101 " + key, true},
+		{"restrict,pty " + key, true},
+	}
+	for _, test := range tests {
+		keys := parseAuthorizedKeysFile([]byte(test.line))
+		if len(keys) != 1 {
+			t.Fatalf("parseAuthorizedKeysFile(%q) returned %d keys", test.line, len(keys))
+		}
+		if keys[0].restrictions.limited != test.limited {
+			t.Errorf("parseAuthorizedKeysFile(%q) limited = %v, want %v", test.line, keys[0].restrictions.limited, test.limited)
+		}
+	}
+}
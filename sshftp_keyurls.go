@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The interval in which the keys of AuthorizedKeysURL and GithubUser are fetched again if
+// AuthorizedKeysRefresh is empty.
+const defaultAuthorizedKeysRefresh = 10 * time.Minute
+
+// Responses with more keys than this are cut off.
+const maxAuthorizedKeysResponse = 1 << 20
+
+// A valid name of a GitHub account.
+var githubUserPattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,38})$`)
+
+// authorizedKeysURLs returns the URLs the keys of the user are fetched from, with "%u" replaced by the username.
+func (u UserEntry) authorizedKeysURLs(username string) []string {
+	urls := make([]string, 0, len(u.AuthorizedKeysURL)+1)
+	for _, keysURL := range u.AuthorizedKeysURL {
+		urls = append(urls, strings.ReplaceAll(keysURL, "%u", url.PathEscape(username)))
+	}
+	if u.GithubUser != "" {
+		urls = append(urls, "https://github.com/"+u.GithubUser+".keys")
+	}
+	return urls
+}
+
+// validateKeySources checks the AuthorizedKeysURL and the GithubUser of a user.
+func (u UserEntry) validateKeySources() error {
+	for _, keysURL := range u.AuthorizedKeysURL {
+		parsed, err := url.Parse(strings.ReplaceAll(keysURL, "%u", "user"))
+		if err != nil {
+			return fmt.Errorf("invalid AuthorizedKeysURL %q: %v", keysURL, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid AuthorizedKeysURL %q, it must be a http or https url", keysURL)
+		}
+	}
+	if u.GithubUser != "" && !githubUserPattern.MatchString(u.GithubUser) {
+		return fmt.Errorf("invalid GithubUser %q", u.GithubUser)
+	}
+	return nil
+}
+
+// fetchedKeys are the keys fetched from a URL along with the time they have been fetched.
+type fetchedKeys struct {
+	fetched time.Time
+	keys    []authorizedKey
+}
+
+// authorizedKeysURLCache caches the keys fetched from the AuthorizedKeysURL of the users. The keys of a URL are
+// fetched again once they are older than the refresh interval. If that fails, the previous keys are kept.
+type authorizedKeysURLCache struct {
+	client *http.Client
+	// Protects fetched
+	mutex   sync.Mutex
+	fetched map[string]fetchedKeys
+}
+
+func newAuthorizedKeysURLCache() *authorizedKeysURLCache {
+	return &authorizedKeysURLCache{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		fetched: map[string]fetchedKeys{},
+	}
+}
+
+// fetch requests the keys of the URL.
+func (a *authorizedKeysURLCache) fetch(keysURL string) ([]authorizedKey, error) {
+	response, err := a.client.Get(keysURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxAuthorizedKeysResponse))
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthorizedKeysFile(data), nil
+}
+
+// keys returns the keys of the URL, fetching them if they are older than refresh.
+func (a *authorizedKeysURLCache) keys(keysURL string, refresh time.Duration) ([]authorizedKey, error) {
+	a.mutex.Lock()
+	cached, ok := a.fetched[keysURL]
+	a.mutex.Unlock()
+	if ok && time.Since(cached.fetched) < refresh {
+		return cached.keys, nil
+	}
+	keys, err := a.fetch(keysURL)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err != nil {
+		if ok {
+			// We try again after the next interval and use the previous keys until then, so logins do not
+			// wait for an unreachable server every time.
+			a.fetched[keysURL] = fetchedKeys{fetched: time.Now(), keys: cached.keys}
+		}
+		return cached.keys, err
+	}
+	a.fetched[keysURL] = fetchedKeys{fetched: time.Now(), keys: keys}
+	return keys, nil
+}
+
+// validateKeyFromURLs checks if the key is served by one of the AuthorizedKeysURL (or by the GithubUser) of the
+// user of the connection and may be used from its address. Returns the restrictions of the key.
+func (c *ContextSftp) validateKeyFromURLs(conn ssh.ConnMetadata, entry UserEntry, key ssh.PublicKey) (keyRestrictions, bool) {
+	refresh := defaultAuthorizedKeysRefresh
+	if interval := c.currentConfig().AuthorizedKeysRefresh; interval != "" {
+		// Validated before
+		refresh, _ = time.ParseDuration(interval)
+	}
+	for _, keysURL := range entry.authorizedKeysURLs(conn.User()) {
+		keys, err := c.keyURLs.keys(keysURL, refresh)
+		if err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot fetch the keys of %s from %s: %v", conn.User(), keysURL, err))
+		}
+		if authorized, ok := findKey(keys, key, conn.RemoteAddr()); ok {
+			return authorized.restrictions, true
+		}
+	}
+	return keyRestrictions{}, false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/admin"
+)
+
+// lastLoginStore keeps the latest successful login of every user.
+type lastLoginStore interface {
+	// Get returns the latest login of the user and whether there is one.
+	Get(user string) (admin.LastLogin, bool)
+	// Set replaces the latest login of the user.
+	Set(user string, login admin.LastLogin) error
+}
+
+// newLastLoginStore creates the store for the latest logins. If the state is shared, so is the store.
+func (c *ConfigSftp) newLastLoginStore(cluster *clusterState) (lastLoginStore, error) {
+	if cluster != nil {
+		return redisLastLoginStore{cluster}, nil
+	}
+	return newFileLastLoginStore(c.LastLoginFile)
+}
+
+// fileLastLoginStore is a lastLoginStore that persists all logins as json in a file.
+type fileLastLoginStore struct {
+	// The file the logins are saved to. If empty, they are only kept in memory.
+	filename string
+	// Protects logins
+	mutex  sync.Mutex
+	logins map[string]admin.LastLogin
+}
+
+// newFileLastLoginStore creates a fileLastLoginStore that loads and saves its logins from the given file.
+func newFileLastLoginStore(filename string) (*fileLastLoginStore, error) {
+	store := &fileLastLoginStore{filename: filename, logins: map[string]admin.LastLogin{}}
+	if filename == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.logins); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (f *fileLastLoginStore) Get(user string) (admin.LastLogin, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	login, ok := f.logins[user]
+	return login, ok
+}
+
+func (f *fileLastLoginStore) Set(user string, login admin.LastLogin) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.logins[user] = login
+	if f.filename == "" {
+		return nil
+	}
+	data, err := json.Marshal(f.logins)
+	if err != nil {
+		return err
+	}
+	// We write into a temporary file first, so a crash does not leave a broken file behind.
+	tmp := filepath.Join(filepath.Dir(f.filename), "."+filepath.Base(f.filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.filename)
+}
+
+// recordLogin saves the login of the user and returns the one before, which is shown to the user if
+// ShowLastLogin is set.
+func (c *ContextSftp) recordLogin(user string, login admin.LastLogin) (admin.LastLogin, bool) {
+	previous, ok := c.lastLogins.Get(user)
+	if err := c.lastLogins.Set(user, login); err != nil {
+		c.logger.Err("ContextSftp", fmt.Sprintf("Cannot save the login of %s: %v", user, err))
+	}
+	return previous, ok
+}
+
+// lastLoginBanner returns the message telling the user about the previous login, like sshd does.
+func lastLoginBanner(login admin.LastLogin) string {
+	return fmt.Sprintf("Last login: %s from %s\n", login.Time.Local().Format(time.ANSIC), hostOf(login.IP))
+}
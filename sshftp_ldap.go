@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Entscheider/sshtool/ldap"
+	"golang.org/x/crypto/ssh"
+)
+
+// The defaults of the LDAPConfig.
+const (
+	defaultLDAPUserFilter     = "(&(objectClass=posixAccount)(uid=%u))"
+	defaultLDAPKeyAttribute   = "sshPublicKey"
+	defaultLDAPGroupAttribute = "memberOf"
+	defaultLDAPCacheTime      = time.Minute
+)
+
+// The timeout for connecting to the directory server and for every request.
+const ldapTimeout = 10 * time.Second
+
+// Once this many users are cached, the outdated ones are removed. Clients can try any username, so the cache
+// would grow without limit otherwise.
+const maxCachedUsers = 1000
+
+// LDAPConfig looks up users that are not listed in Users in a directory server when they log in.
+type LDAPConfig struct {
+	// The address of the server like "ldaps://ldap.example.com" or "ldap://localhost:389". An empty string
+	// disables the lookup.
+	Address string
+	// The distinguished name and the password to bind with for searching. If empty, the server is searched
+	// anonymously.
+	BindDN       string
+	BindPassword string
+	// The distinguished name below which the users are searched, e.g. "ou=people,dc=example,dc=com".
+	BaseDN string
+	// The filter for the entry of a user, "%u" is replaced by the username.
+	// Defaults to "(&(objectClass=posixAccount)(uid=%u))".
+	UserFilter string
+	// The attribute of the entry with the public keys of the user. Defaults to "sshPublicKey".
+	KeyAttribute string
+	// The attribute of the entry listing the distinguished names of the groups of the user. Defaults to "memberOf".
+	GroupAttribute string
+	// The settings for the members of the groups. The first group the user is a member of is used, users of
+	// none of the groups cannot log in.
+	Groups []LDAPGroup
+	// How long (e.g. "5m") a looked up user is used before it is looked up again. Defaults to "1m".
+	CacheTime string
+}
+
+// LDAPGroup are the settings of the members of a group of the directory server.
+type LDAPGroup struct {
+	// The distinguished name of the group (e.g. "cn=sftp,ou=groups,dc=example,dc=com") or only its common name
+	// ("sftp"). An empty string matches every user.
+	Group string
+	// The settings of the members like the directories they are served ("%u" in the Root is replaced by the
+	// username as usual). The keys of the user are added to its AuthorizedKeys.
+	User UserEntry
+}
+
+// validateLDAP checks the LDAP settings for values that are not supported.
+func (c *ConfigSftp) validateLDAP() error {
+	l := c.LDAP
+	if l.Address == "" {
+		return nil
+	}
+	parsed, err := url.Parse(l.Address)
+	if err != nil || (parsed.Scheme != "ldap" && parsed.Scheme != "ldaps") || parsed.Host == "" {
+		return fmt.Errorf("invalid LDAP Address %q, it must be a ldap or ldaps url", l.Address)
+	}
+	if l.BaseDN == "" {
+		return fmt.Errorf("LDAP needs a BaseDN")
+	}
+	if l.UserFilter != "" && !strings.Contains(l.UserFilter, "%u") {
+		return fmt.Errorf("the LDAP UserFilter must contain %%u")
+	}
+	if l.CacheTime != "" {
+		if cacheTime, err := time.ParseDuration(l.CacheTime); err != nil || cacheTime < 0 {
+			return fmt.Errorf("invalid LDAP CacheTime %q", l.CacheTime)
+		}
+	}
+	for _, group := range l.Groups {
+		if err := c.validateUser(fmt.Sprintf("of the LDAP group %q", group.Group), group.User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value or its default if it is empty.
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Checks whether the user is a member of the group, given by the distinguished names of its groups.
+func (g LDAPGroup) matches(groups []string) bool {
+	if g.Group == "" {
+		return true
+	}
+	for _, dn := range groups {
+		if strings.EqualFold(dn, g.Group) {
+			return true
+		}
+		// The common name is the value of the first component, e.g. "sftp" of "cn=sftp,ou=groups,...".
+		first, _, _ := strings.Cut(dn, ",")
+		if name, value, ok := strings.Cut(first, "="); ok && strings.EqualFold(strings.TrimSpace(name), "cn") &&
+			strings.EqualFold(strings.TrimSpace(value), g.Group) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupUser searches the user in the directory server and returns its settings. Returns false if the user
+// does not exist or is in none of the groups.
+func (l LDAPConfig) lookupUser(username string) (UserEntry, bool, error) {
+	conn, err := ldap.Dial(l.Address, ldapTimeout)
+	if err != nil {
+		return UserEntry{}, false, err
+	}
+	defer conn.Close()
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return UserEntry{}, false, err
+		}
+	}
+	keyAttribute := orDefault(l.KeyAttribute, defaultLDAPKeyAttribute)
+	groupAttribute := orDefault(l.GroupAttribute, defaultLDAPGroupAttribute)
+	filter := strings.ReplaceAll(orDefault(l.UserFilter, defaultLDAPUserFilter), "%u", ldap.EscapeFilter(username))
+	entries, err := conn.Search(l.BaseDN, filter, []string{keyAttribute, groupAttribute})
+	if err != nil {
+		return UserEntry{}, false, err
+	}
+	if len(entries) == 0 {
+		return UserEntry{}, false, nil
+	}
+	if len(entries) > 1 {
+		return UserEntry{}, false, fmt.Errorf("the UserFilter matches %d entries for %s", len(entries), username)
+	}
+	groups := entries[0].Values(groupAttribute)
+	for _, group := range l.Groups {
+		if !group.matches(groups) {
+			continue
+		}
+		entry := group.User
+		entry.AuthorizedKeys = append([]string{}, group.User.AuthorizedKeys...)
+		for _, key := range entries[0].Values(keyAttribute) {
+			// Keys that cannot be parsed would make all keys of the user invalid.
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err == nil {
+				entry.AuthorizedKeys = append(entry.AuthorizedKeys, strings.TrimSpace(key))
+			}
+		}
+		return entry, true, nil
+	}
+	return UserEntry{}, false, nil
+}
+
+// cachedUser is a user looked up in the directory server (or the UserStore) along with the time of the lookup.
+type cachedUser struct {
+	looked time.Time
+	entry  UserEntry
+	// Whether the user exists (and is member of one of the groups).
+	exists bool
+}
+
+// userCache caches the users looked up in the directory server (or the UserStore), so the server is only asked
+// once per login. If a lookup fails, the previous result is used until the next lookup.
+type userCache struct {
+	// Protects users
+	mutex sync.Mutex
+	users map[string]cachedUser
+}
+
+func newUserCache() *userCache {
+	return &userCache{users: map[string]cachedUser{}}
+}
+
+// Returns the CacheTime of a config or the fallback if it is empty. The CacheTime must have been validated before.
+func cacheTimeOr(cacheTime string, fallback time.Duration) time.Duration {
+	if cacheTime == "" {
+		return fallback
+	}
+	duration, _ := time.ParseDuration(cacheTime)
+	return duration
+}
+
+// lookup returns the settings of the user, looking it up with lookupUser if its cached settings are older than
+// the cacheTime.
+func (u *userCache) lookup(cacheTime time.Duration, username string, lookupUser func(string) (UserEntry, bool, error)) (UserEntry, bool, error) {
+	u.mutex.Lock()
+	cached, ok := u.users[username]
+	u.mutex.Unlock()
+	if ok && time.Since(cached.looked) < cacheTime {
+		return cached.entry, cached.exists, nil
+	}
+	entry, exists, err := lookupUser(username)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err != nil {
+		if ok {
+			u.users[username] = cachedUser{looked: time.Now(), entry: cached.entry, exists: cached.exists}
+		}
+		return cached.entry, cached.exists, err
+	}
+	if len(u.users) >= maxCachedUsers {
+		for name, user := range u.users {
+			if time.Since(user.looked) >= cacheTime {
+				delete(u.users, name)
+			}
+		}
+	}
+	entry = entry.withParsedKeys()
+	u.users[username] = cachedUser{looked: time.Now(), entry: entry, exists: exists}
+	return entry, exists, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	"github.com/Entscheider/sshtool/stats"
+)
+
+// memoryDirs holds the directories kept in memory (for Memory), so all sessions of a user share their files.
+type memoryDirs struct {
+	// Protects perMount
+	mutex    sync.Mutex
+	perMount map[string]*sftp2.MemFS
+	// Reports the memory usage of the directories.
+	stats *stats.Registry
+}
+
+// newMemoryDirs creates an empty memoryDirs reporting to the registry.
+func newMemoryDirs(registry *stats.Registry) *memoryDirs {
+	return &memoryDirs{perMount: map[string]*sftp2.MemFS{}, stats: registry}
+}
+
+// forMount returns the directory with the given name of the user that is kept in memory. A changed maxBytes applies
+// to the existing directory. If m is nil, every call returns a new directory.
+func (m *memoryDirs) forMount(username, name string, maxBytes int64) *sftp2.MemFS {
+	if m == nil {
+		return sftp2.NewMemFS(maxBytes)
+	}
+	key := username + "/" + name
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	memory, ok := m.perMount[key]
+	if !ok {
+		memory = sftp2.NewMemFS(maxBytes)
+		m.perMount[key] = memory
+		m.stats.WatchMemory(key, memory.Usage)
+	}
+	memory.SetMaxBytes(maxBytes)
+	return memory
+}
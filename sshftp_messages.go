@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// errorMessageKeys are the keys of the ErrorMessages along with the errors whose messages they replace.
+var errorMessageKeys = map[string]error{
+	"forbidden":      sftp2.ErrForbidden,
+	"quota_exceeded": sftp2.ErrQuotaExceeded,
+	"no_space":       sftp2.ErrNoSpace,
+	"file_too_large": sftp2.ErrFileTooLarge,
+	"frozen":         sftp2.ErrFrozen,
+	"timeout":        sftp2.ErrTimeout,
+	"invalid_path":   sftp2.ErrInvalidPath,
+	"not_supported":  sftp2.ErrNotSupported,
+}
+
+// The key of the ErrorMessages with the message shown to users logging in during the maintenance mode, which
+// replaces the default one.
+const (
+	maintenanceMessageKey     = "maintenance"
+	defaultMaintenanceMessage = "The server is under maintenance, please try again later."
+)
+
+// validateErrorMessages checks that the ErrorMessages only use known keys. The Language of the users is checked
+// by validateLanguage.
+func (c *ConfigSftp) validateErrorMessages() error {
+	for language, messages := range c.ErrorMessages {
+		for key := range messages {
+			if _, ok := errorMessageKeys[key]; !ok && key != maintenanceMessageKey {
+				return fmt.Errorf("unknown key %q in the ErrorMessages of language %q", key, language)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLanguage checks that there are ErrorMessages for the Language of the user.
+func (c *ConfigSftp) validateLanguage(username string, entry UserEntry) error {
+	if _, ok := c.ErrorMessages[entry.Language]; entry.Language != "" && !ok {
+		return fmt.Errorf("user %s: there are no ErrorMessages for the Language %q", username, entry.Language)
+	}
+	return nil
+}
+
+// maintenanceMessage returns the message shown to users of the given language logging in during the maintenance
+// mode.
+func (c *ConfigSftp) maintenanceMessage(language string) string {
+	if message, ok := c.ErrorMessages[language][maintenanceMessageKey]; ok {
+		return message
+	}
+	if message, ok := c.ErrorMessages[""][maintenanceMessageKey]; ok {
+		return message
+	}
+	return defaultMaintenanceMessage
+}
+
+// messageFS wraps fs into a [sftp2.MessageFS] with the ErrorMessages of the default language, overridden by the
+// ones of the given language. Returns fs itself if there are none.
+func (c *ConfigSftp) messageFS(fs sftp2.SimplifiedFS, language string) sftp2.SimplifiedFS {
+	messages := map[error]string{}
+	for _, lang := range []string{"", language} {
+		for key, message := range c.ErrorMessages[lang] {
+			if err, ok := errorMessageKeys[key]; ok {
+				messages[err] = message
+			}
+		}
+	}
+	if len(messages) == 0 {
+		return fs
+	}
+	return sftp2.MessageFS{Inner: fs, Messages: messages}
+}
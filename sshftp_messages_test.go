@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestMaintenanceMessage(t *testing.T) {
+	c := ConfigSftp{ErrorMessages: map[string]map[string]string{
+		"":   {"maintenance": "Back soon"},
+		"de": {"maintenance": "Bald wieder da"},
+		"fr": {"forbidden": "Interdit"},
+	}}
+	if err := c.validateErrorMessages(); err != nil {
+		t.Fatal(err)
+	}
+	for language, want := range map[string]string{"": "Back soon", "de": "Bald wieder da", "fr": "Back soon"} {
+		if message := c.maintenanceMessage(language); message != want {
+			t.Errorf("maintenanceMessage(%q) = %q, want %q", language, message, want)
+		}
+	}
+	if message := (&ConfigSftp{}).maintenanceMessage("de"); message != defaultMaintenanceMessage {
+		t.Errorf("maintenanceMessage() without ErrorMessages = %q", message)
+	}
+}
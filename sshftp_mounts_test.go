@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+func TestMountTablesPerConnection(t *testing.T) {
+	dir := t.TempDir() + "/"
+	config := &ConfigSftp{}
+	shared := fsShared{mounts: newMountTables(), uploadCommands: newUploadCommandSlots(config)}
+	plain := UserEntry{Filesystem: map[string]SFTPEntry{"a": {Root: dir}, "b": {Root: dir}}}
+	withUpload := UserEntry{Filesystem: map[string]SFTPEntry{"a": {Root: dir},
+		"b": {Root: dir, OnUpload: OnUploadConfig{Command: []string{"true"}}}}}
+	for session := uint64(1); session <= 2; session++ {
+		for _, user := range []struct {
+			name  string
+			entry UserEntry
+		}{{"bob", plain}, {"alice", withUpload}} {
+			info := logger.ConnectionInfo{Username: user.name, IP: "192.0.2.1", SessionID: session}
+			if _, err := config.createFSWithoutPermission(info, user.entry, shared); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The sessions of bob share the table, which does not know the connection.
+	if tables := shared.mounts.get("bob"); len(tables) != 1 || tables[0].info.IP != "" {
+		t.Errorf("tables of bob = %+v, want a single shared one", tables)
+	}
+	tables := shared.mounts.get("alice")
+	if len(tables) != 2 || tables[0].table == tables[1].table {
+		t.Fatalf("tables of alice = %+v, want one per session", tables)
+	}
+	for _, mounts := range tables {
+		if mounts.info.IP != "192.0.2.1" || len(mounts.table.Names()) != 2 {
+			t.Errorf("table of session %d = %+v with %v", mounts.info.SessionID, mounts.info, mounts.table.Names())
+		}
+	}
+	shared.mounts.release(logger.ConnectionInfo{Username: "alice", SessionID: 1})
+	if tables := shared.mounts.get("alice"); len(tables) != 1 || tables[0].info.SessionID != 2 {
+		t.Errorf("tables of alice after the end of session 1 = %+v", tables)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Entscheider/sshtool/azureblob"
+	"github.com/Entscheider/sshtool/gcs"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// AzureConfig describes a container of the Azure Blob Storage a directory is stored in.
+type AzureConfig struct {
+	// The name of the storage account.
+	Account string
+	// The name of the container. An empty string disables this storage.
+	Container string
+	// The base64 encoded access key of the account.
+	AccountKey string
+	// A shared access signature allowing access to the container, which can be used instead of the AccountKey.
+	SASToken string
+}
+
+// GCSConfig describes a bucket of the Google Cloud Storage a directory is stored in.
+type GCSConfig struct {
+	// The name of the bucket. An empty string disables this storage.
+	Bucket string
+	// The json key file of a service account. If empty, the service account of the vm sshtool runs on is used.
+	CredentialsFile string
+}
+
+// validateStorage checks whether at most one storage besides Root is configured and whether it is complete.
+func (e SFTPEntry) validateStorage() error {
+	count := 0
+	for _, used := range []bool{e.Upstream.Address != "", e.Azure.Container != "", e.GCS.Bucket != "", e.Device != "",
+		e.Snapshots != "", e.Archive != "", e.Memory != ""} {
+		if used {
+			count += 1
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("only one of Upstream, Azure, GCS, Device, Snapshots, Archive and Memory can be used")
+	}
+	if e.Device != "" && (e.Retention.MaxAge != "" || e.CreateRootIfMissing) {
+		return fmt.Errorf("a Device cannot be used with Retention or CreateRootIfMissing")
+	}
+	if e.Snapshots != "" && (e.Retention.MaxAge != "" || e.CreateRootIfMissing) {
+		return fmt.Errorf("Snapshots cannot be used with Retention or CreateRootIfMissing")
+	}
+	if e.Archive != "" && (e.Retention.MaxAge != "" || e.CreateRootIfMissing) {
+		return fmt.Errorf("an Archive cannot be used with Retention or CreateRootIfMissing")
+	}
+	if e.Memory != "" {
+		if e.Retention.MaxAge != "" || e.CreateRootIfMissing {
+			return fmt.Errorf("Memory cannot be used with Retention or CreateRootIfMissing")
+		}
+		if size, err := parseByteSize(e.Memory); err != nil || size == 0 {
+			return fmt.Errorf("invalid Memory %q", e.Memory)
+		}
+	}
+	if e.Upstream.Address != "" {
+		return e.Upstream.validate()
+	}
+	if e.Azure.Container != "" {
+		if e.Azure.Account == "" {
+			return fmt.Errorf("Azure needs an Account")
+		}
+		if e.Azure.AccountKey == "" && e.Azure.SASToken == "" {
+			return fmt.Errorf("Azure needs an AccountKey or a SASToken")
+		}
+	}
+	return nil
+}
+
+// objectStore returns the cloud storage of the directory making its requests with the client (http.DefaultClient
+// if nil) or nil if it is not stored in one.
+func (e SFTPEntry) objectStore(client *http.Client) sftp2.ObjectStore {
+	switch {
+	case e.Azure.Container != "":
+		return &azureblob.Store{
+			Account:    e.Azure.Account,
+			Container:  e.Azure.Container,
+			AccountKey: e.Azure.AccountKey,
+			SASToken:   e.Azure.SASToken,
+			Client:     client,
+		}
+	case e.GCS.Bucket != "":
+		return &gcs.Store{Bucket: e.GCS.Bucket, CredentialsFile: e.GCS.CredentialsFile, Client: client}
+	}
+	return nil
+}
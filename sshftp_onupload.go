@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// The number of OnUpload commands that run at the same time if MaxUploadCommands is not set.
+const defaultMaxUploadCommands = 4
+
+// How long an OnUpload command may run if its Timeout is not set.
+const defaultUploadCommandTimeout = time.Minute
+
+// OnUploadConfig describes a command that is run for every uploaded file.
+type OnUploadConfig struct {
+	// The program (with arguments) to run. The absolute path of the uploaded file and the username are appended
+	// as arguments. The path as seen by the client is passed in the environment variable SSHTOOL_PATH. If the
+	// directory is created for a single connection, its address and session id are passed in SSHTOOL_IP and
+	// SSHTOOL_SESSION. An empty command disables this.
+	Command []string
+	// How long the command may run (e.g. "30s"). Defaults to one minute.
+	Timeout string
+	// Whether the upload is rejected if the command fails. The client is told that the upload failed and
+	// the file is removed. Otherwise, a failure is only logged.
+	RejectOnFailure bool
+}
+
+// validate checks the settings for values that are not supported.
+func (c OnUploadConfig) validate() error {
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return fmt.Errorf("invalid OnUpload Timeout: %v", err)
+		}
+	}
+	return nil
+}
+
+// timeout returns how long the command may run.
+func (c OnUploadConfig) timeout() time.Duration {
+	if c.Timeout == "" {
+		return defaultUploadCommandTimeout
+	}
+	// The config has been validated before, so we can ignore the error here.
+	timeout, _ := time.ParseDuration(c.Timeout)
+	return timeout
+}
+
+// newUploadCommandSlots creates the semaphore limiting the number of OnUpload commands running at the same time.
+func newUploadCommandSlots(c *ConfigSftp) chan struct{} {
+	max := c.MaxUploadCommands
+	if max <= 0 {
+		max = defaultMaxUploadCommands
+	}
+	return make(chan struct{}, max)
+}
+
+// run runs the command for the file at the given path on the disk. It waits for a free slot first.
+func (c OnUploadConfig) run(slots chan struct{}, file string, virtualPath string, info logger.ConnectionInfo) error {
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	args := append(append([]string{}, c.Command[1:]...), file, info.Username)
+	cmd := exec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Env = append(os.Environ(), "SSHTOOL_PATH="+virtualPath, "SSHTOOL_USER="+info.Username)
+	if info.IP != "" {
+		cmd.Env = append(cmd.Env, "SSHTOOL_IP="+info.IP)
+	}
+	if info.SessionID != 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SSHTOOL_SESSION=%d", info.SessionID))
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// uploadCheck returns a hook that runs the command for every file of the user of the connection written into the
+// directory at root. The directory is served under the name mount. Failures are published to the bus of shared.
+func (c OnUploadConfig) uploadCheck(info logger.ConnectionInfo, root string, mount string, shared fsShared) sftp2.CheckHook {
+	return func(fs sftp2.SimplifiedFS, path string) error {
+		file := filepath.Join(root, filepath.FromSlash(path))
+		err := c.run(shared.uploadCommands, file, pathpkg.Join("/", mount, path), info)
+		if err == nil {
+			return nil
+		}
+		event := events.Event{Type: events.UploadCommandFailed, Username: info.Username, IP: info.IP, Path: path, Message: err.Error()}
+		if !c.RejectOnFailure {
+			shared.events.Publish(event)
+			return nil
+		}
+		if rmErr := fs.Rm(path); rmErr != nil {
+			event.Message += fmt.Sprintf(", cannot remove: %v", rmErr)
+		} else {
+			event.Message += ", removed"
+		}
+		shared.events.Publish(event)
+		return fmt.Errorf("upload of %s rejected", path)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Hash is a parsed argon2 hash in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>" with salt and hash base64 encoded without padding.
+type argon2Hash struct {
+	// Either "argon2id" or "argon2i"
+	variant string
+	// The memory in KiB
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2Hash parses an argon2 hash in the PHC string format.
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return h, fmt.Errorf("not an argon2 hash in the PHC string format")
+	}
+	h.variant = parts[1]
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return h, fmt.Errorf("unsupported variant %s", h.variant)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, fmt.Errorf("unsupported version %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("invalid parameters %s", parts[3])
+	}
+	if h.time == 0 || h.threads == 0 {
+		return h, fmt.Errorf("invalid parameters %s", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("invalid salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, fmt.Errorf("invalid hash")
+	}
+	return h, nil
+}
+
+// matches checks whether the password has this hash.
+func (h argon2Hash) matches(password []byte) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// validatePasswordHash checks that the hash is either a bcrypt or an argon2 hash.
+func validatePasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// checkPassword checks whether the password matches the given bcrypt or argon2 hash.
+func checkPassword(hash string, password []byte) bool {
+	if hash == "" {
+		return false
+	}
+	if strings.HasPrefix(hash, "$argon2") {
+		// The config has been validated before, so the hash can be parsed.
+		h, err := parseArgon2Hash(hash)
+		return err == nil && h.matches(password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Creates an argon2id hash of the password with cheap parameters.
+func testArgon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"valid", testArgon2Hash("secret"), false},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA", false},
+		{"argon2d", "$argon2d$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA", true},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA", true},
+		{"missing parameters", "$argon2id$v=19$m=64,t=1$c2FsdHNhbHQ$aGFzaA", true},
+		{"zero time", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaA", true},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$aGFzaA", true},
+		{"invalid salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaA", true},
+		{"empty hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$", true},
+		{"missing hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ", true},
+		{"no leading dollar", "argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA$", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseArgon2Hash(test.hash); (err != nil) != test.wantErr {
+				t.Errorf("parseArgon2Hash(%q) error = %v, wantErr %v", test.hash, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"argon2 match", testArgon2Hash("secret"), "secret", true},
+		{"argon2 mismatch", testArgon2Hash("secret"), "Secret", false},
+		{"bcrypt match", string(bcryptHash), "secret", true},
+		{"bcrypt mismatch", string(bcryptHash), "secret2", false},
+		{"no hash", "", "", false},
+		{"invalid argon2", "$argon2id$broken", "secret", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkPassword(test.hash, []byte(test.password)); got != test.want {
+				t.Errorf("checkPassword() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
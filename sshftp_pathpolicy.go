@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// PathPolicyConfig restricts the names of the files and directories users can create, e.g. for storages or
+// clients of other systems that cannot handle every name.
+type PathPolicyConfig struct {
+	// The maximal length of a path in bytes. Zero means no limit.
+	MaxPathLength int
+	// The maximal length of a single name in bytes. Zero means no limit.
+	MaxNameLength int
+	// Whether names with control characters (like newlines) are rejected.
+	RejectControlCharacters bool
+	// Whether names that are not valid UTF-8 are rejected.
+	RequireUTF8 bool
+	// The characters names may consist of, in the syntax of a character class of a regular expression
+	// (e.g. "a-zA-Z0-9._ -"). An empty string allows all characters.
+	AllowedCharacters string
+}
+
+// enabled returns whether the policy restricts anything.
+func (p PathPolicyConfig) enabled() bool {
+	return p != PathPolicyConfig{}
+}
+
+// validate checks the settings for values that are not supported.
+func (p PathPolicyConfig) validate() error {
+	if p.MaxPathLength < 0 || p.MaxNameLength < 0 {
+		return fmt.Errorf("the lengths of the PathPolicy must not be negative")
+	}
+	if p.AllowedCharacters != "" {
+		if _, err := regexp.Compile(p.allowedNames()); err != nil {
+			return fmt.Errorf("invalid AllowedCharacters of the PathPolicy: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns the regular expression names consisting of the AllowedCharacters match.
+func (p PathPolicyConfig) allowedNames() string {
+	return "^[" + p.AllowedCharacters + "]+$"
+}
+
+// pathPolicyFS wraps fs into a [sftp2.PathPolicyFS] if the policy restricts anything.
+func (p PathPolicyConfig) pathPolicyFS(fs sftp2.SimplifiedFS) sftp2.SimplifiedFS {
+	if !p.enabled() {
+		return fs
+	}
+	policy := sftp2.PathPolicy{
+		MaxPathLength:           p.MaxPathLength,
+		MaxNameLength:           p.MaxNameLength,
+		RejectControlCharacters: p.RejectControlCharacters,
+		RequireUTF8:             p.RequireUTF8,
+	}
+	if p.AllowedCharacters != "" {
+		// The config has been validated before, so the expression compiles.
+		policy.AllowedNames = regexp.MustCompile(p.allowedNames())
+	}
+	return sftp2.PathPolicyFS{Inner: fs, Policy: policy}
+}
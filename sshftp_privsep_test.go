@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+func TestSessionConfigACL(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"pub", "secret"} {
+		if err := os.Mkdir(dir+"/"+name, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dir+"/"+name+"/file", []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := logger.ConnectionInfo{Username: "alice", SessionID: 1}
+	entry := UserEntry{RunAs: "nobody", Filesystem: map[string]SFTPEntry{"data": {Root: dir + "/"}}}
+	config := &ConfigSftp{
+		Groups: map[string][]string{"staff": {"alice", "bob"}},
+		ACL: []ACLEntry{
+			{Path: "/data/pub", Groups: []string{"staff"}, Read: true, List: true},
+			{Path: "/data/secret", Users: []string{"bob"}, Read: true},
+		},
+		Users: map[string]UserEntry{"alice": entry},
+	}
+	session, err := config.sessionConfig(info, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The groups are not passed on, only the entries that apply to the user.
+	if len(session.Groups) != 0 || len(session.ACL) != 1 || !session.hasACL("alice") {
+		t.Fatalf("sessionConfig() = %v, %v", session.Groups, session.ACL)
+	}
+	bandwidth, err := newBandwidthLimits(&session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := session.CreateFS(info, session.Users["alice"], fsShared{bandwidth: bandwidth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Read("/data/pub/file"); err != nil {
+		t.Errorf("Read() of a granted file: %v", err)
+	}
+	if _, err := fs.Read("/data/secret/file"); err == nil {
+		t.Errorf("Read() of a file the ACL does not grant succeeded")
+	}
+	if _, err := fs.Write("/data/pub/new"); err == nil {
+		t.Errorf("Write() below a read-only path succeeded")
+	}
+}
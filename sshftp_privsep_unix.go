@@ -0,0 +1,469 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Entscheider/sshtool/logger"
+	mware "github.com/Entscheider/sshtool/middleware"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	gssh "github.com/gliderlabs/ssh"
+	gosftp "github.com/pkg/sftp"
+)
+
+// The name of the command a sftp session is served with in its own process.
+const sessionProcessCmd = "sftp-session"
+
+func init() {
+	CMDS[sessionProcessCmd] = cmd{mainSftpSession, "Internal command serving a single sftp session with dropped privileges"}
+}
+
+// sessionRequest is passed to the process serving a single sftp session.
+type sessionRequest struct {
+	// The config containing only the user of the session and the settings needed for serving it.
+	Config ConfigSftp
+	// The connection to serve.
+	Info logger.ConnectionInfo
+	// The number of files of the user and its directories (see MaxFiles) by their key in the UsageStore.
+	// Changes are reported back with sessionMessage, as only we keep the store.
+	Usage map[string]sftp2.Usage
+	// Whether KeySelfService applies to this session. Then AuthorizedKeys are the keys of the user, and new keys
+	// are reported back with sessionMessage.
+	KeySelfService bool
+	AuthorizedKeys []string `json:",omitempty"`
+}
+
+// sessionMessage is written as json line to stderr by the process serving a single sftp session, so we apply
+// the changes it cannot apply on its own.
+type sessionMessage struct {
+	// The key in the UsageStore whose number of files has changed by Files, or has been set to Files if SetUsage.
+	UsageKey string `json:",omitempty"`
+	Files    int64  `json:",omitempty"`
+	SetUsage bool   `json:",omitempty"`
+	// The content of the authorized_keys file written for KeySelfService.
+	AuthorizedKeys string `json:",omitempty"`
+}
+
+// validatePrivilegeSeparation checks whether RunAs and Chroot are set up correctly for the given user.
+func validatePrivilegeSeparation(username string, entry UserEntry) error {
+	if entry.Chroot && entry.RunAs == "" {
+		return fmt.Errorf("user %s needs RunAs to use Chroot", username)
+	}
+	if entry.Chroot && len(entry.Filesystem) != 1 {
+		return fmt.Errorf("user %s needs exactly one Filesystem entry to use Chroot", username)
+	}
+	if entry.Chroot && entry.SessionTmp {
+		// The directories of the sessions are outside of the root directory.
+		return fmt.Errorf("user %s cannot use SessionTmp with Chroot", username)
+	}
+	for _, fsEntry := range entry.Filesystem {
+		if entry.Chroot && (fsEntry.Upstream.Address != "" || fsEntry.objectStore(nil) != nil || fsEntry.Device != "" ||
+			fsEntry.Snapshots != "" || fsEntry.Archive != "" || fsEntry.Memory != "") {
+			return fmt.Errorf("user %s cannot use Chroot for a directory that is not on this machine", username)
+		}
+		if entry.RunAs != "" && fsEntry.Memory != "" {
+			// The memory of the process of a session is lost when the session ends.
+			return fmt.Errorf("user %s cannot use RunAs with a directory kept in Memory", username)
+		}
+	}
+	return nil
+}
+
+// checkPrivilegeSeparation checks whether we are allowed to change the user for every session that
+// requires this.
+func (c *ConfigSftp) checkPrivilegeSeparation() error {
+	for username, entry := range c.Users {
+		if entry.RunAs != "" && os.Geteuid() != 0 {
+			return fmt.Errorf("user %s needs RunAs, but the server is not running as root", username)
+		}
+	}
+	return nil
+}
+
+// sessionConfig returns a config that only contains what the process serving the session of the given connection
+// with the entry of its user needs. Everything else (like the credentials of the admin api, of the OIDC provider
+// and of redis) stays with us, as the process runs with the privileges of the user. If the FilesystemCommand fails,
+// its error is returned along with a config that serves an empty directory.
+func (c *ConfigSftp) sessionConfig(info logger.ConnectionInfo, entry UserEntry) (ConfigSftp, error) {
+	config := ConfigSftp{
+		MinFreeSpace:          c.MinFreeSpace,
+		ClamAV:                c.ClamAV,
+		MaxUploadCommands:     c.MaxUploadCommands,
+		ProgressInterval:      c.ProgressInterval,
+		ProgressBytes:         c.ProgressBytes,
+		ShowUnavailableMounts: c.ShowUnavailableMounts,
+		MaxRequestsPerSession: c.MaxRequestsPerSession,
+		MaxHandlesPerSession:  c.MaxHandlesPerSession,
+		KeyPolicy:             c.KeyPolicy,
+		MaxTreeSizeEntries:    c.MaxTreeSizeEntries,
+		PathPolicy:            c.PathPolicy,
+		ErrorMessages:         c.ErrorMessages,
+		ListBatchSize:         c.ListBatchSize,
+		StatusDirectory:       c.StatusDirectory,
+		QuotaFile:             c.QuotaFile,
+		LogPreviousAttributes: c.LogPreviousAttributes,
+		Proxy:                 c.Proxy,
+		SessionTmpDir:         c.SessionTmpDir,
+	}
+	username := info.Username
+	// The groups stay with us, so the entries of the ACL that apply to the user name it directly.
+	for _, rule := range c.aclRulesFor(username) {
+		config.ACL = append(config.ACL, ACLEntry{Path: rule.Path, Users: []string{username},
+			Read: rule.Read, Write: rule.Write, List: rule.List})
+	}
+	if len(c.FilesystemCommand) > 0 {
+		// The command is run with our privileges, the session process only gets its result.
+		filesystem, err := c.runFilesystemCommand(info)
+		if err != nil {
+			entry.Filesystem = map[string]SFTPEntry{}
+			config.Users = map[string]UserEntry{username: entry.withoutCredentials()}
+			return config, err
+		}
+		entry.Filesystem = filesystem
+	}
+	config.Users = map[string]UserEntry{username: entry.withoutCredentials()}
+	return config, nil
+}
+
+// withoutCredentials returns the entry without the keys and secrets the user authenticates with.
+func (u UserEntry) withoutCredentials() UserEntry {
+	u.AuthorizedKeys = nil
+	u.AuthorizedKeysFile = nil
+	u.AuthorizedKeysURL = nil
+	u.GithubUser = ""
+	u.PasswordHash = ""
+	u.TOTPSecret = ""
+	return u
+}
+
+// privilegeSeparated wraps the sftp subsystem handler, so that sessions of users with RunAs are served
+// in a separate process running as this user. All other sessions are passed to next.
+func (c *ContextSftp) privilegeSeparated(next gssh.SubsystemHandler) gssh.SubsystemHandler {
+	return func(s gssh.Session) {
+		entry, ok := c.userEntry(s.User())
+		if !ok || entry.RunAs == "" {
+			next(s)
+			return
+		}
+		info := mware.NewConnectionInfo(s)
+		version, stream := mware.PeekSFTPVersion(s)
+		info.Client += fmt.Sprintf(" sftp=%d", version)
+		c.accessLogger.NewLogin(info, "granted")
+		defer c.accessLogger.Logout(info)
+		session := c.stats.StartSession(info, "sftp", func() { _ = s.Close() })
+		session.SetChannels(func() int { return c.channels.Count(s.Context()) })
+		defer c.stats.EndSession(session)
+		if !c.allowSession(info.Username, session.ID) {
+			c.logger.Info("ContextSftp", fmt.Sprintf("Rejecting session of %s at %s: too many sessions", info.Username, info.IP))
+			return
+		}
+		defer c.endSession(info.Username, session.ID)
+		info.SessionID = session.ID
+		// The directory is created by the process of the session, which may not be able to remove it on exit.
+		defer c.currentConfig().removeSessionTmp(info, c.logger)
+		if err := c.runSessionProcess(s, stream, info); err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Error while serving %s in its own process: %v", info.Username, err))
+		}
+	}
+}
+
+// runSessionProcess starts a new process of this program that serves the sftp session and waits until it ends.
+// The process reads the requests from stream instead of the session. The access log entries of this process are
+// passed to our accessLogger.
+func (c *ContextSftp) runSessionProcess(s gssh.Session, stream io.Reader, info logger.ConnectionInfo) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	entry, _ := c.connectionEntry(s.Context())
+	if port, ok := c.shared.webDavPorts[info.Username]; ok {
+		// Shown in the StatusDirectory.
+		entry.WebDavPort = port
+	}
+	config, err := c.currentConfig().sessionConfig(info, entry)
+	if err != nil {
+		// Like other sessions, the user is served an empty directory then.
+		c.logger.Err("ContextSftp", fmt.Sprintf("Error while creating virtual fs for user %s: %s", info.Username, err.Error()))
+	}
+	usage, err := c.sessionUsage(info.Username, config.Users[info.Username])
+	if err != nil {
+		return err
+	}
+	request := sessionRequest{Config: config, Info: info, Usage: usage}
+	if c.currentConfig().KeySelfService && !restrictionsOf(s.Context()).limited {
+		request.KeySelfService = true
+		request.AuthorizedKeys = entry.AuthorizedKeys
+	}
+	cmd := exec.CommandContext(s.Context(), executable, sessionProcessCmd)
+	cmd.Stdin = stream
+	cmd.Stdout = s
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	// The request is passed with a pipe to keep it out of the environment and the command line.
+	requestReader, requestWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer requestWriter.Close()
+	cmd.ExtraFiles = []*os.File{requestReader}
+	err = cmd.Start()
+	_ = requestReader.Close()
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(requestWriter).Encode(request)
+	_ = requestWriter.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+	}
+	_ = logger.ReplayAccessLog(stderr, c.accessLogger, func(line string) {
+		var message sessionMessage
+		if json.Unmarshal([]byte(line), &message) != nil || (message.UsageKey == "" && message.AuthorizedKeys == "") {
+			c.logger.Info("SessionProcess", line)
+			return
+		}
+		c.applySessionMessage(info, message)
+	})
+	waitErr := cmd.Wait()
+	if err != nil {
+		return err
+	}
+	return waitErr
+}
+
+// sessionUsage returns the entries of the UsageStore the process serving a session of the user may use. Fails if
+// the store cannot be read, as the process would count the usage again otherwise.
+func (c *ContextSftp) sessionUsage(username string, entry UserEntry) (map[string]sftp2.Usage, error) {
+	keys := []string{username, username + "#maxfiles", sftp2.GraceKey(username), sftp2.BytesKey(username)}
+	for name := range entry.Filesystem {
+		key := username + "/" + name
+		keys = append(keys, key, sftp2.GraceKey(key), sftp2.BytesKey(key))
+	}
+	usage := map[string]sftp2.Usage{}
+	for _, key := range keys {
+		files, ok, err := c.shared.usage.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			usage[key] = files
+		}
+	}
+	return usage, nil
+}
+
+// applySessionMessage applies a change reported by the process serving a session of the connection.
+func (c *ContextSftp) applySessionMessage(info logger.ConnectionInfo, message sessionMessage) {
+	var err error
+	switch {
+	case message.AuthorizedKeys != "":
+		// The keys are checked again, the process may not be trusted.
+		err = c.replaceKeys(info, []byte(message.AuthorizedKeys))
+	case !strings.HasPrefix(message.UsageKey, info.Username+"/") && !strings.HasPrefix(message.UsageKey, info.Username+"#") &&
+		message.UsageKey != info.Username:
+		err = fmt.Errorf("the usage %s does not belong to the user", message.UsageKey)
+	case message.SetUsage:
+		err = c.shared.usage.Set(message.UsageKey, sftp2.Usage{Files: message.Files})
+	default:
+		_, err = c.shared.usage.Add(message.UsageKey, message.Files)
+	}
+	if err != nil {
+		c.logger.Err("SessionProcess", fmt.Sprintf("Cannot apply change of the session of %s: %v", info.Username, err))
+	}
+}
+
+// sessionUsageStore is the UsageStore of the process serving a single sftp session. It keeps the usage in memory
+// and reports every change to the server, which keeps the actual store.
+type sessionUsageStore struct {
+	*sftp2.FileUsageStore
+	report func(sessionMessage)
+}
+
+func (s sessionUsageStore) Set(key string, usage sftp2.Usage) error {
+	if err := s.FileUsageStore.Set(key, usage); err != nil {
+		return err
+	}
+	s.report(sessionMessage{UsageKey: key, Files: usage.Files, SetUsage: true})
+	return nil
+}
+
+func (s sessionUsageStore) Add(key string, files int64) (sftp2.Usage, error) {
+	usage, err := s.FileUsageStore.Add(key, files)
+	if err == nil {
+		s.report(sessionMessage{UsageKey: key, Files: files})
+	}
+	return usage, err
+}
+
+// Reserve is only atomic within this session, as the server applies the reported change without checking the
+// limit again.
+func (s sessionUsageStore) Reserve(key string, files int64, limit int64) (sftp2.Usage, bool, error) {
+	usage, added, err := s.FileUsageStore.Reserve(key, files, limit)
+	if err == nil && added {
+		s.report(sessionMessage{UsageKey: key, Files: files})
+	}
+	return usage, added, err
+}
+
+// lockedWriter serializes the writes to a writer shared by several loggers, so their lines do not interleave.
+type lockedWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(p)
+}
+
+// dropPrivileges changes into the root directory of the user (if Chroot is set) and switches to the account
+// RunAs for the rest of the process. The Root of the served directory is adjusted if we have changed into it.
+func dropPrivileges(username string, entry *UserEntry) error {
+	account, err := user.Lookup(entry.RunAs)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return err
+	}
+	groupIds, err := account.GroupIds()
+	if err != nil {
+		return err
+	}
+	groups := make([]int, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		group, err := strconv.Atoi(groupId)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, group)
+	}
+	if entry.Chroot {
+		if len(entry.Filesystem) != 1 {
+			return fmt.Errorf("Chroot needs exactly one served directory")
+		}
+		for name, fsEntry := range entry.Filesystem {
+			fsEntry.Root = fsEntry.rootFor(username)
+			if fsEntry.CreateRootIfMissing {
+				if err := fsEntry.createRoot(username); err != nil {
+					return err
+				}
+			}
+			if err := syscall.Chroot(fsEntry.Root); err != nil {
+				return err
+			}
+			if err := os.Chdir("/"); err != nil {
+				return err
+			}
+			fsEntry.Root = "/"
+			entry.Filesystem[name] = fsEntry
+		}
+	}
+	// The group has to be changed first, as we are not allowed to do it afterwards.
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// stdio combines stdin and stdout of this process.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdio) Close() error {
+	return os.Stdout.Close()
+}
+
+// mainSftpSession serves a single sftp session over stdin and stdout. It is started by runSessionProcess
+// and reads the sessionRequest from file descriptor 3.
+func mainSftpSession(_ []string) {
+	var request sessionRequest
+	requestFile := os.NewFile(3, "request")
+	fatal(json.NewDecoder(requestFile).Decode(&request))
+	_ = requestFile.Close()
+	config := request.Config
+	username := request.Info.Username
+	entry, ok := config.Users[username]
+	if !ok {
+		fatal(fmt.Errorf("user %s has no config entry", username))
+	}
+	fatal(dropPrivileges(username, &entry))
+	config.Users[username] = entry
+
+	// The log, the access log and our messages share stderr.
+	stderr := &lockedWriter{writer: os.Stderr}
+	log := logger.NewLogger(stderr)
+	defer log.Close()
+	report := func(message sessionMessage) {
+		if data, err := json.Marshal(message); err == nil {
+			_, _ = stderr.Write(append(data, '\n'))
+		}
+	}
+	memory, err := sftp2.NewFileUsageStore("")
+	fatal(err)
+	for key, usage := range request.Usage {
+		fatal(memory.Set(key, usage))
+	}
+	usage := sessionUsageStore{FileUsageStore: memory, report: report}
+	bandwidth, err := newBandwidthLimits(&config)
+	fatal(err)
+	fs, err := config.CreateFS(request.Info, entry, fsShared{usage: usage, bandwidth: bandwidth, events: newEventBus(log), uploadCommands: newUploadCommandSlots(&config)})
+	if err != nil {
+		log.Err("SessionProcess", fmt.Sprintf("Error while creating virtual fs for user %s: %s", username, err.Error()))
+		fs = sftp2.EmptyFS{}
+	} else if request.KeySelfService {
+		var keysMutex sync.Mutex
+		keys := request.AuthorizedKeys
+		fs = keysFS(fs, func() []string {
+			keysMutex.Lock()
+			defer keysMutex.Unlock()
+			return keys
+		}, func(content []byte) error {
+			keysMutex.Lock()
+			defer keysMutex.Unlock()
+			// Checked here to answer the client, and again by the server applying them.
+			newKeys, err := rotatedKeys(keys, content, config.KeyPolicy)
+			if err != nil {
+				return err
+			}
+			report(sessionMessage{AuthorizedKeys: string(content)})
+			keys = newKeys
+			return nil
+		})
+	}
+	handlers := sftp2.CreateSFTPHandler(fs, logger.NewJSONAccessLogger(stderr), request.Info, log, config.MaxTreeSizeEntries, config.LogPreviousAttributes)
+	config.applyListBatchSize()
+	server := gosftp.NewRequestServer(mware.WithExtensions(stdio{}, handlers), handlers)
+	if err := server.Serve(); err != nil && err != io.EOF {
+		log.Err("SessionProcess", fmt.Sprintf("Error %v", err))
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	gssh "github.com/gliderlabs/ssh"
+)
+
+// validatePrivilegeSeparation rejects RunAs and Chroot as they are not supported on windows.
+func validatePrivilegeSeparation(username string, entry UserEntry) error {
+	if entry.RunAs != "" || entry.Chroot {
+		return fmt.Errorf("user %s uses RunAs or Chroot, which are not supported on windows", username)
+	}
+	return nil
+}
+
+// checkPrivilegeSeparation does nothing on windows, as validatePrivilegeSeparation already rejects RunAs.
+func (c *ConfigSftp) checkPrivilegeSeparation() error {
+	return nil
+}
+
+// privilegeSeparated returns next, as separate processes per session are not supported on windows.
+func (c *ContextSftp) privilegeSeparated(next gssh.SubsystemHandler) gssh.SubsystemHandler {
+	return next
+}
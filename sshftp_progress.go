@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// progressFS wraps fs so that open files publish their progress as events.TransferProgress.
+// The settings must have been checked by validate.
+func (c *ConfigSftp) progressFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, bus *events.Bus) sftp2.SimplifiedFS {
+	interval, _ := time.ParseDuration(c.ProgressInterval)
+	var everyBytes int64
+	if c.ProgressBytes != "" {
+		size, _ := parseByteSize(c.ProgressBytes)
+		everyBytes = int64(size)
+	}
+	return sftp2.ProgressFS{
+		Inner:      fs,
+		EveryBytes: everyBytes,
+		Interval:   interval,
+		Report: func(p sftp2.Progress) {
+			direction := "download"
+			if p.Upload {
+				direction = "upload"
+			}
+			message := fmt.Sprintf("%s: %d bytes after %s (%d since the last report)", direction, p.Bytes, p.Elapsed.Round(time.Second), p.Delta)
+			if p.Delta == 0 {
+				message += ", stalled"
+			}
+			bus.Publish(events.Event{Type: events.TransferProgress, Username: info.Username, IP: info.IP, Path: p.Path, Message: message})
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// quotaFile is the name of the file added to the root for QuotaFile.
+const quotaFile = ".quota"
+
+// defaultQuotaGracePeriod is the QuotaGracePeriod if none is given.
+const defaultQuotaGracePeriod = 7 * 24 * time.Hour
+
+// validateSoftMaxFiles checks that the soft limit is below the hard limit, if both are given.
+func validateSoftMaxFiles(softMaxFiles int64, maxFiles int64) error {
+	if softMaxFiles < 0 {
+		return fmt.Errorf("SoftMaxFiles must not be negative")
+	}
+	if softMaxFiles > 0 && maxFiles > 0 && softMaxFiles >= maxFiles {
+		return fmt.Errorf("SoftMaxFiles must be less than MaxFiles")
+	}
+	return nil
+}
+
+// gracePeriod returns the QuotaGracePeriod of the user.
+func (u UserEntry) gracePeriod() time.Duration {
+	// The config has been validated before, so we can ignore the error here.
+	if period, err := time.ParseDuration(u.QuotaGracePeriod); err == nil {
+		return period
+	}
+	return defaultQuotaGracePeriod
+}
+
+// maxBytes returns the MaxBytes of the user, or zero if there is no limit.
+func (u UserEntry) maxBytes() int64 {
+	// The config has been validated before, so we can ignore the error here.
+	size, _ := parseByteSize(u.MaxBytes)
+	return int64(size)
+}
+
+// limitFiles limits the number of files of fs, which are counted in the UsageStore with the key. Files created
+// above softMaxFiles are published as event for the path of the user.
+func (u UserEntry) limitFiles(fs sftp2.SimplifiedFS, shared fsShared, username, path, key string, maxFiles, softMaxFiles int64) sftp2.QuotaFS {
+	quota := sftp2.NewQuotaFS(fs, shared.usage, key, maxFiles)
+	quota.SoftMaxFiles = softMaxFiles
+	quota.GracePeriod = u.gracePeriod()
+	quota.OnSoftLimit = func(files int64, graceEnds time.Time) {
+		shared.events.Publish(events.Event{
+			Type:     events.SoftLimitExceeded,
+			Username: username,
+			Path:     path,
+			Message: fmt.Sprintf("%d files exceed the soft limit of %d, no further files can be created after %s",
+				files, softMaxFiles, graceEnds.Format(time.RFC3339)),
+		})
+	}
+	return quota
+}
+
+// softLimitNotice describes the soft limit of the key for the quota file, e.g. ", soft limit of 100 files exceeded
+// until 2026-10-23T10:00:00Z". It is empty if there is no soft limit.
+func softLimitNotice(shared fsShared, key string, softMaxFiles int64, gracePeriod time.Duration) string {
+	if softMaxFiles <= 0 {
+		return ""
+	}
+	graceEnds, exceeded, _ := sftp2.GraceEnds(shared.usage, key, gracePeriod)
+	switch {
+	case !exceeded:
+		return fmt.Sprintf(", soft limit of %d files", softMaxFiles)
+	case time.Now().Before(graceEnds):
+		return fmt.Sprintf(", soft limit of %d files exceeded until %s", softMaxFiles, graceEnds.Format(time.RFC3339))
+	default:
+		return fmt.Sprintf(", soft limit of %d files exceeded, no further files can be created", softMaxFiles)
+	}
+}
+
+// quotaFS adds the quota file to fs, which lists the space and the number of files of every served directory
+// like df, e.g. "/data: 1.2GB used, 18.8GB available of 20.0GB, 120 of 1000 files".
+func (c *ConfigSftp) quotaFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) sftp2.SimplifiedFS {
+	return sftp2.VirtualFileFS{
+		Inner: fs,
+		Name:  quotaFile,
+		Generate: func() ([]byte, error) {
+			var content strings.Builder
+			usage, ok, err := shared.usage.Get(info.Username)
+			if err != nil {
+				return nil, err
+			}
+			if ok && userEntry.MaxFiles > 0 {
+				fmt.Fprintf(&content, "all directories: %d of %d files%s\n", usage.Files, userEntry.MaxFiles,
+					softLimitNotice(shared, info.Username, userEntry.SoftMaxFiles, userEntry.gracePeriod()))
+			} else if ok && userEntry.SoftMaxFiles > 0 {
+				fmt.Fprintf(&content, "all directories: %d files%s\n", usage.Files,
+					softLimitNotice(shared, info.Username, userEntry.SoftMaxFiles, userEntry.gracePeriod()))
+			}
+			if maxBytes := userEntry.maxBytes(); maxBytes > 0 {
+				usage, _, err := shared.usage.Get(sftp2.BytesKey(info.Username))
+				if err != nil {
+					return nil, err
+				}
+				fmt.Fprintf(&content, "all directories: %s used of %s\n", formatByteSize(uint64(max(usage.Files, 0))),
+					formatByteSize(uint64(maxBytes)))
+			}
+			var names []string
+			for name := range userEntry.Filesystem {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				path := "/" + name
+				space, err := sftp2.SpaceOf(fs, path)
+				if err != nil {
+					// E.g. storages that do not report their space.
+					fmt.Fprintf(&content, "%s: unknown\n", path)
+					continue
+				}
+				used := space.Total - min(space.Available, space.Total)
+				fmt.Fprintf(&content, "%s: %s used, %s available of %s", path, formatByteSize(used),
+					formatByteSize(space.Available), formatByteSize(space.Total))
+				if space.Files > 0 {
+					fmt.Fprintf(&content, ", %d of %d files", space.Files-min(space.FreeFiles, space.Files), space.Files)
+				}
+				content.WriteString(softLimitNotice(shared, info.Username+path, userEntry.Filesystem[name].SoftMaxFiles,
+					userEntry.gracePeriod()))
+				content.WriteString("\n")
+			}
+			return []byte(content.String()), nil
+		},
+	}
+}
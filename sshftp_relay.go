@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How long an unused connection to an upstream server stays open if its IdleTimeout is not set.
+const upstreamIdleTimeout = 5 * time.Minute
+
+// How long connecting to an upstream server may take.
+const upstreamDialTimeout = 30 * time.Second
+
+// UpstreamConfig describes a remote sftp server a directory is relayed to.
+type UpstreamConfig struct {
+	// The address of the server like "files.internal:22". An empty string disables relaying.
+	Address string
+	// The username to log in with. Defaults to the name of the user connected to us.
+	User string
+	// The password to log in with.
+	Password string
+	// The path of a private key to log in with.
+	PrivateKeyFile string
+	// Whether to log in with the keys of the ssh agent of this process (found via SSH_AUTH_SOCK).
+	UseAgent bool
+	// The public key of the server formatted like an "authorized_keys" line. Connections to servers with another
+	// key are refused.
+	HostKey string
+	// The maximal number of connections shared by all sessions. Further connections are only opened while all
+	// others are busy. Zero means a single connection.
+	Connections int
+	// How long (e.g. "10m") an unused connection stays open. Defaults to 5 minutes.
+	IdleTimeout string
+	// Connections that have been unused for longer than this (e.g. "1m") are checked before they are used again.
+	// An empty string disables the checks.
+	HealthCheckInterval string
+}
+
+// validate checks the settings for values that are not supported.
+func (u UpstreamConfig) validate() error {
+	if u.HostKey == "" {
+		return fmt.Errorf("the Upstream needs a HostKey")
+	}
+	if _, err := parseAuthorizedKeys([]string{u.HostKey}); err != nil {
+		return fmt.Errorf("invalid Upstream HostKey: %v", err)
+	}
+	if u.Password == "" && u.PrivateKeyFile == "" && !u.UseAgent {
+		return fmt.Errorf("the Upstream needs a Password, a PrivateKeyFile or UseAgent")
+	}
+	if u.Connections < 0 {
+		return fmt.Errorf("invalid Upstream Connections %d", u.Connections)
+	}
+	for name, value := range map[string]string{"IdleTimeout": u.IdleTimeout, "HealthCheckInterval": u.HealthCheckInterval} {
+		if value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid Upstream %s %q", name, value)
+		}
+	}
+	return nil
+}
+
+// poolOptions returns how the connections to the upstream server are pooled.
+func (u UpstreamConfig) poolOptions() sftp2.RemotePoolOptions {
+	options := sftp2.RemotePoolOptions{Size: u.Connections, IdleTimeout: upstreamIdleTimeout}
+	// The config has been validated before, so we can ignore the errors here.
+	if u.IdleTimeout != "" {
+		options.IdleTimeout, _ = time.ParseDuration(u.IdleTimeout)
+	}
+	if u.HealthCheckInterval != "" {
+		options.HealthCheckInterval, _ = time.ParseDuration(u.HealthCheckInterval)
+	}
+	return options
+}
+
+// clientConfig creates the config for logging in as the given user. The returned function has to be called once
+// the login has finished.
+func (u UpstreamConfig) clientConfig(username string) (*ssh.ClientConfig, func(), error) {
+	// The config has been validated before, so we can ignore the error here.
+	hostKeys, _ := parseAuthorizedKeys([]string{u.HostKey})
+	config := &ssh.ClientConfig{
+		User:            u.User,
+		HostKeyCallback: ssh.FixedHostKey(hostKeys[0]),
+		Timeout:         upstreamDialTimeout,
+	}
+	if config.User == "" {
+		config.User = username
+	}
+	done := func() {}
+	if u.PrivateKeyFile != "" {
+		content, err := os.ReadFile(u.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid PrivateKeyFile %s: %v", u.PrivateKeyFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if u.UseAgent {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot connect to the ssh agent: %v", err)
+		}
+		done = func() { _ = conn.Close() }
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if u.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(u.Password))
+	}
+	return config, done, nil
+}
+
+// dial opens the ssh connection to the upstream server through the proxy.
+func (u UpstreamConfig) dial(config *ssh.ClientConfig, proxy ProxyConfig) (*ssh.Client, error) {
+	conn, err := proxy.dial(u.Address, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, u.Address, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+// dialer returns a function that connects to the upstream server for the given user through the proxy.
+func (u UpstreamConfig) dialer(username string, proxy ProxyConfig) sftp2.RemoteDialer {
+	return func() (*gosftp.Client, io.Closer, error) {
+		config, done, err := u.clientConfig(username)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := u.dial(config, proxy)
+		done()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot connect to upstream %s: %v", u.Address, err)
+		}
+		client, err := gosftp.NewClient(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+		go func() {
+			// Closing the sftp client only ends the sftp session.
+			_ = client.Wait()
+			_ = conn.Close()
+		}()
+		return client, conn, nil
+	}
+}
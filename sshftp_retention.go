@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// How often the janitor looks for expired files.
+const janitorInterval = time.Hour
+
+// RetentionConfig configures the automatic removal of old files within a served directory.
+type RetentionConfig struct {
+	// Files that have not been modified for this long (e.g. "720h" for 30 days) are removed.
+	// An empty string disables the removal.
+	MaxAge string
+	// Regular expressions for the paths (relative to the served directory, e.g. "^/keep/") of files that are never
+	// removed.
+	Exclude []string
+	// Whether to only log the files that would be removed.
+	DryRun bool
+}
+
+func (r RetentionConfig) validate() error {
+	if r.MaxAge == "" {
+		return nil
+	}
+	age, err := time.ParseDuration(r.MaxAge)
+	if err != nil {
+		return fmt.Errorf("invalid Retention MaxAge: %v", err)
+	}
+	if age <= 0 {
+		return fmt.Errorf("the Retention MaxAge must be positive")
+	}
+	if _, err := intoRegexp(r.Exclude); err != nil {
+		return fmt.Errorf("invalid Retention Exclude: %v", err)
+	}
+	return nil
+}
+
+// runJanitor removes expired files of all served directories with a Retention until the context is done.
+func (c *ContextSftp) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		c.cleanup()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup removes the expired files of all served directories with a Retention once.
+func (c *ContextSftp) cleanup() {
+	config := c.currentConfig()
+	for username, userEntry := range config.Users {
+		for name, entry := range userEntry.Filesystem {
+			if entry.Retention.MaxAge == "" {
+				continue
+			}
+			removed, err := c.cleanupMount(config, username, name, userEntry, entry)
+			if err != nil {
+				c.logger.Err("Retention", fmt.Sprintf("Cannot clean up directory %q of %s: %v", name, username, err))
+			}
+			// The removed files are counted for the directory by its QuotaFS, but not for the user.
+			if removed > 0 && (userEntry.MaxFiles > 0 || userEntry.SoftMaxFiles > 0) {
+				if _, err := c.shared.usage.Add(username, -removed); err != nil {
+					c.logger.Err("Retention", fmt.Sprintf("Cannot update the number of files of %s: %v", username, err))
+				}
+			}
+		}
+	}
+}
+
+// cleanupMount removes the expired files of a single served directory and returns how many have been removed.
+func (c *ContextSftp) cleanupMount(config *ConfigSftp, username, name string, userEntry UserEntry, entry SFTPEntry) (int64, error) {
+	// The config has been validated before, so we can ignore the errors here.
+	maxAge, _ := time.ParseDuration(entry.Retention.MaxAge)
+	exclude, _ := intoRegexp(entry.Retention.Exclude)
+	// Old files are also removed from directories the user can only read.
+	entry.ReadOnly = false
+	fs, err := config.createMountFS(logger.ConnectionInfo{Username: username}, name, userEntry, entry, c.shared)
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(-maxAge)
+	var removed int64
+	err = walkFS(fs, "/", func(p string, info os.FileInfo) {
+		if info.IsDir() || !info.ModTime().Before(deadline) {
+			return
+		}
+		for _, rexp := range exclude {
+			if rexp.MatchString(p) {
+				return
+			}
+		}
+		if entry.Retention.DryRun {
+			c.logger.Info("Retention", fmt.Sprintf("Would remove %s from directory %q of %s (modified %s)", p, name, username, info.ModTime().Format(time.RFC3339)))
+			return
+		}
+		if err := fs.Rm(p); err != nil {
+			c.logger.Err("Retention", fmt.Sprintf("Cannot remove %s from directory %q of %s: %v", p, name, username, err))
+			return
+		}
+		removed++
+		c.logger.Info("Retention", fmt.Sprintf("Removed %s from directory %q of %s", p, name, username))
+	})
+	return removed, err
+}
+
+// walkFS calls visit for every file and directory below dir. Symbolic links are not followed.
+func walkFS(fs sftp2.SimplifiedFS, dir string, visit func(path string, info os.FileInfo)) error {
+	list, err := fs.List(dir)
+	if err != nil {
+		return err
+	}
+	var infos []os.FileInfo
+	buffer := make([]os.FileInfo, 128)
+	for {
+		n, err := list(buffer, int64(len(infos)))
+		infos = append(infos, buffer[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := walkFS(fs, p, visit); err != nil {
+				return err
+			}
+		}
+		visit(p, info)
+	}
+	return nil
+}
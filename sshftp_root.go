@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// rootFor returns the root directory of the entry for the given user by replacing "%u" with the username.
+func (e SFTPEntry) rootFor(username string) string {
+	return strings.ReplaceAll(e.Root, "%u", username)
+}
+
+// cacheKey identifies the files of the entry (which must already be expanded with rootFor) in the read cache,
+// so directories of different users serving the same files share their cached blocks.
+func (e SFTPEntry) cacheKey(username string) string {
+	switch {
+	case e.Upstream.Address != "":
+		// The upstream server may show different files to different accounts.
+		user := e.Upstream.User
+		if user == "" {
+			user = username
+		}
+		return "sftp://" + user + "@" + e.Upstream.Address + e.Root
+	case e.Azure.Container != "":
+		return "azure://" + e.Azure.Account + "/" + e.Azure.Container + "/" + e.Root
+	case e.GCS.Bucket != "":
+		return "gs://" + e.GCS.Bucket + "/" + e.Root
+	case e.Device != "":
+		return e.Device
+	case e.Snapshots != "":
+		return "snapshots:" + e.Snapshots + ":" + e.Root
+	case e.Archive != "":
+		return "archive:" + e.Archive
+	}
+	return e.Root
+}
+
+// createRoot creates the root directory of the entry (which must already be expanded with rootFor) if it
+// does not exist yet and applies RootMode and RootOwner to it.
+func (e SFTPEntry) createRoot(username string) error {
+	if _, err := os.Stat(e.Root); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	mode := os.FileMode(0o755)
+	if e.RootMode != 0 {
+		mode = os.FileMode(e.RootMode).Perm()
+	}
+	if err := os.MkdirAll(e.Root, mode); err != nil {
+		return err
+	}
+	// Change the mode explicitly, as MkdirAll is affected by the umask of the process.
+	if err := os.Chmod(e.Root, mode); err != nil {
+		return err
+	}
+	if e.RootOwner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(strings.ReplaceAll(e.RootOwner, "%u", username))
+	if err != nil {
+		return err
+	}
+	return os.Chown(e.Root, uid, gid)
+}
+
+// lookupOwner resolves an owner given as "user" or "user:group" into the user and group id.
+// Without a group, the primary group of the user is used.
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	account, err := user.Lookup(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	groupId := account.Gid
+	if len(parts) == 2 {
+		group, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		groupId = group.Gid
+	}
+	if uid, err = strconv.Atoi(account.Uid); err != nil {
+		return 0, 0, fmt.Errorf("unsupported user id %s", account.Uid)
+	}
+	if gid, err = strconv.Atoi(groupId); err != nil {
+		return 0, 0, fmt.Errorf("unsupported group id %s", groupId)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// The name of the private directory of a session (see SessionTmp) within the root of its filesystem.
+const sessionTmpName = "tmp"
+
+// sessionTmpPath returns the directory on this machine that is served as the private directory of the session of
+// the connection.
+func (c *ConfigSftp) sessionTmpPath(info logger.ConnectionInfo) string {
+	dir := c.SessionTmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("sshtool-session-%s-%d", url.PathEscape(info.Username), info.SessionID))
+}
+
+// sessionTmpFS adds the private directory of the session of the connection to the root of fs. The directory is
+// created empty, so whatever a previous session with the same id may have left is removed before.
+func (c *ConfigSftp) sessionTmpFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, userEntry UserEntry) (sftp2.SimplifiedFS, error) {
+	dir := c.sessionTmpPath(info)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create the directory of the session: %v", err)
+	}
+	fileMode, dirMode := userEntry.creationModes()
+	tmp := sftp2.DirFs{Root: filepath.ToSlash(dir) + "/", FileMode: fileMode, DirMode: dirMode}
+	return sftp2.MountFS{Inner: fs, Name: sessionTmpName, Mounted: tmp}, nil
+}
+
+// removeSessionTmp removes the private directory of the session of the connection along with its content, if the
+// session has one.
+func (c *ConfigSftp) removeSessionTmp(info logger.ConnectionInfo, log logger.Logger) {
+	if info.SessionID == 0 {
+		return
+	}
+	if err := os.RemoveAll(c.sessionTmpPath(info)); err != nil {
+		log.Warn("SessionTmp", fmt.Sprintf("Cannot remove the directory of the session of %s: %v", info.Username, err))
+	}
+}
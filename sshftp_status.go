@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// statusDirectory is the name of the directory added to the root for StatusDirectory.
+const statusDirectory = ".server"
+
+// serverVersion returns the version of this binary, including the commit it has been built from if known.
+func serverVersion() string {
+	version := "unknown"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return fmt.Sprintf("sshtool %s (%s)", version, runtime.Version())
+	}
+	version = info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " " + setting.Value
+		}
+	}
+	return fmt.Sprintf("sshtool %s (%s)", version, info.GoVersion)
+}
+
+// statusPermissions is the content of permissions.json in the status directory.
+type statusPermissions struct {
+	CanRead      []string
+	CanWrite     []string
+	ShouldHide   []string
+	HideDotfiles bool
+	AuditOnly    bool
+	Wrappers     []string
+	// Whether the served directories are read-only (or frozen at the moment) by their name.
+	ReadOnly map[string]bool
+}
+
+// statusQuota is the usage of a directory in quota.json in the status directory.
+type statusQuota struct {
+	Files int64
+	// The maximal number of files and directories. Zero means no limit.
+	MaxFiles int64
+	// The number of files and directories above which files can only be created until GraceEnds. Zero means no
+	// soft limit.
+	SoftMaxFiles int64 `json:",omitempty"`
+	// The end of the grace period if the soft limit is exceeded.
+	GraceEnds *time.Time `json:",omitempty"`
+	// The total size of the files in bytes and its limit, if the size is limited.
+	Bytes    int64 `json:",omitempty"`
+	MaxBytes int64 `json:",omitempty"`
+}
+
+// newStatusQuota returns the usage of the key in quota.json.
+func newStatusQuota(shared fsShared, key string, files, maxFiles, softMaxFiles int64, gracePeriod time.Duration) statusQuota {
+	quota := statusQuota{Files: files, MaxFiles: maxFiles, SoftMaxFiles: softMaxFiles}
+	if graceEnds, ok, _ := sftp2.GraceEnds(shared.usage, key, gracePeriod); ok && softMaxFiles > 0 {
+		quota.GraceEnds = &graceEnds
+	}
+	return quota
+}
+
+// statusQuotas is the content of quota.json in the status directory. Only limited or counted directories are
+// included.
+type statusQuotas struct {
+	// The usage of all served directories together.
+	User *statusQuota `json:",omitempty"`
+	// The usage of every single served directory by its name.
+	Directories map[string]statusQuota `json:",omitempty"`
+}
+
+// statusWebDav is the content of webdav.json in the status directory.
+type statusWebDav struct {
+	// The virtual port to forward, e.g. with "ssh -L 8080:localhost:<Port> user@server".
+	Port uint32
+}
+
+// statusSession is the content of session.json in the status directory.
+type statusSession struct {
+	logger.ConnectionInfo
+	Time time.Time
+}
+
+// statusFS adds the status directory to fs, which contains generated files about the permissions, the quota
+// and the session of the user as well as the version of the server.
+func (c *ConfigSftp) statusFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) sftp2.SimplifiedFS {
+	asJSON := func(v func() interface{}) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			data, err := json.MarshalIndent(v(), "", "  ")
+			return append(data, '\n'), err
+		}
+	}
+	status := sftp2.VirtualDirFS{
+		Inner: fs,
+		Name:  statusDirectory,
+		Files: map[string]func() ([]byte, error){
+			"version.txt": func() ([]byte, error) {
+				return []byte(serverVersion() + "\n"), nil
+			},
+			"session.json": asJSON(func() interface{} {
+				return statusSession{ConnectionInfo: info, Time: time.Now()}
+			}),
+			"permissions.json": asJSON(func() interface{} {
+				readOnly := make(map[string]bool, len(userEntry.Filesystem))
+				for name, entry := range userEntry.Filesystem {
+					readOnly[name] = entry.ReadOnly || shared.freezes.freezeFor(info.Username, name, entry.FreezeSchedule).Frozen()
+				}
+				return statusPermissions{
+					CanRead:      userEntry.CanRead,
+					CanWrite:     userEntry.CanWrite,
+					ShouldHide:   userEntry.ShouldHide,
+					HideDotfiles: userEntry.HideDotfiles,
+					AuditOnly:    userEntry.AuditOnly,
+					Wrappers:     userEntry.Wrappers,
+					ReadOnly:     readOnly,
+				}
+			}),
+			"quota.json": asJSON(func() interface{} {
+				quotas := statusQuotas{Directories: map[string]statusQuota{}}
+				if usage, ok, _ := shared.usage.Get(info.Username); ok || userEntry.MaxFiles > 0 || userEntry.SoftMaxFiles > 0 || userEntry.MaxBytes != "" {
+					quota := newStatusQuota(shared, info.Username, usage.Files, userEntry.MaxFiles,
+						userEntry.SoftMaxFiles, userEntry.gracePeriod())
+					if quota.MaxBytes = userEntry.maxBytes(); quota.MaxBytes > 0 {
+						bytes, _, _ := shared.usage.Get(sftp2.BytesKey(info.Username))
+						quota.Bytes = bytes.Files
+					}
+					quotas.User = &quota
+				}
+				for name, entry := range userEntry.Filesystem {
+					key := info.Username + "/" + name
+					if usage, ok, _ := shared.usage.Get(key); ok || entry.MaxFiles > 0 || entry.SoftMaxFiles > 0 {
+						quotas.Directories[name] = newStatusQuota(shared, key, usage.Files, entry.MaxFiles,
+							entry.SoftMaxFiles, userEntry.gracePeriod())
+					}
+				}
+				return quotas
+			}),
+		},
+	}
+	// Separate processes (see RunAs) get the port of the user as WebDavPort of the entry.
+	if port, ok := shared.webDavPorts[info.Username]; ok || (userEntry.WebDav && userEntry.WebDavPort != 0) {
+		if !ok {
+			port = userEntry.WebDavPort
+		}
+		status.Files["webdav.json"] = asJSON(func() interface{} {
+			return statusWebDav{Port: port}
+		})
+	}
+	return status
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// The interval a line is sent to a held up client in if Interval is not set.
+const defaultTarpitInterval = 10 * time.Second
+
+// The number of connections held up at the same time if MaxConnections is not set.
+const defaultTarpitConnections = 64
+
+// Failed handshakes older than this do not count for FailedHandshakes.
+const tarpitFailureWindow = time.Hour
+
+// TarpitConfig configures holding up the connections of banned and suspicious addresses. Instead of closing
+// them, the server sends random lines before its ssh version very slowly, which clients wait for.
+type TarpitConfig struct {
+	// Whether connections of banned addresses are held up instead of being closed.
+	Enabled bool
+	// The interval (e.g. "10s") a line is sent in. Defaults to 10s.
+	Interval string
+	// The maximal number of connections held up at the same time. Further ones are closed. Defaults to 64.
+	MaxConnections int
+	// Addresses whose ssh handshake has failed this many times within an hour are held up as well, like scanners
+	// that only look for the ssh version. Zero only holds up banned addresses.
+	FailedHandshakes int
+}
+
+// validate checks the settings for values that are not supported.
+func (c TarpitConfig) validate() error {
+	if c.Interval != "" {
+		if interval, err := time.ParseDuration(c.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid Tarpit Interval %q", c.Interval)
+		}
+	}
+	if c.MaxConnections < 0 || c.FailedHandshakes < 0 {
+		return fmt.Errorf("the Tarpit MaxConnections and FailedHandshakes must not be negative")
+	}
+	return nil
+}
+
+// tarpit holds up connections and remembers the addresses of failed handshakes.
+type tarpit struct {
+	interval       time.Duration
+	maxConnections int
+	// The failed handshakes of every address. Nil if suspicious addresses are not held up.
+	failures *failureLog
+	// Protects active
+	mutex sync.Mutex
+	// The number of connections currently held up.
+	active int
+}
+
+// newTarpit creates the tarpit for the config. Returns nil if it is disabled.
+func newTarpit(config TarpitConfig) *tarpit {
+	if !config.Enabled {
+		return nil
+	}
+	t := &tarpit{
+		interval:       defaultTarpitInterval,
+		maxConnections: config.MaxConnections,
+	}
+	if config.FailedHandshakes > 0 {
+		t.failures = newFailureLog(tarpitFailureWindow, config.FailedHandshakes)
+	}
+	if config.Interval != "" {
+		// The config has been validated before, so we can ignore the error here.
+		t.interval, _ = time.ParseDuration(config.Interval)
+	}
+	if t.maxConnections == 0 {
+		t.maxConnections = defaultTarpitConnections
+	}
+	return t
+}
+
+// Returns the ip of an address like "1.2.3.4:1234".
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// recordFailure remembers a failed handshake from the address. Does nothing if t is nil.
+func (t *tarpit) recordFailure(addr string) {
+	if t == nil || t.failures == nil {
+		return
+	}
+	t.failures.record(addr)
+}
+
+// suspicious returns whether the address has failed too many handshakes recently. Returns false if t is nil.
+func (t *tarpit) suspicious(addr string) bool {
+	if t == nil || t.failures == nil {
+		return false
+	}
+	return t.failures.exceeded(addr)
+}
+
+// Returns a random line, which is not mistaken for the ssh version.
+func tarpitLine() []byte {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	line := make([]byte, 3+rand.IntN(30), 35)
+	for i := range line {
+		line[i] = chars[rand.IntN(len(chars))]
+	}
+	return append(line, '\r', '\n')
+}
+
+// hold sends a line to the connection in every interval until the client gives up. Returns false without
+// waiting if too many connections are held up already. The caller still has to close the connection.
+func (t *tarpit) hold(conn net.Conn) bool {
+	t.mutex.Lock()
+	if t.active >= t.maxConnections {
+		t.mutex.Unlock()
+		return false
+	}
+	t.active++
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		t.active--
+		t.mutex.Unlock()
+	}()
+	for {
+		time.Sleep(t.interval)
+		// A client that does not read anymore must not block us forever.
+		_ = conn.SetWriteDeadline(time.Now().Add(t.interval))
+		if _, err := conn.Write(tarpitLine()); err != nil {
+			return true
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+func TestWebDavPorts(t *testing.T) {
+	users := map[string]UserEntry{
+		"carol": {WebDav: true},
+		"alice": {WebDav: true},
+		"bob":   {WebDav: true, WebDavPort: 8081},
+		"dave":  {},
+	}
+	tests := []struct {
+		name string
+		auto bool
+		want map[string]uint32
+	}{
+		{"shared", false, map[string]uint32{"alice": 8080, "bob": 8081, "carol": 8080}},
+		{"auto", true, map[string]uint32{"alice": 8080, "bob": 8081, "carol": 8082}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := ConfigSftp{Users: users, WebDavPort: 8080, WebDavAutoPort: test.auto}
+			if got := c.webDavPorts(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("webDavPorts() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterAccessLog(t *testing.T) {
+	accept := func(username string) bool { return username == "alice" }
+	csvLog := "\"2024-01-02\",\"login\",\"10.0.0.1\",\"alice\",\"\",\"\",\"ok\",\"\",\"\",\"\"\n" +
+		"\"2024-01-02\",\"login\",\"10.0.0.2\",\"bob\",\"\",\"\",\"ok\",\"\",\"\",\"\"\n" +
+		"\"2024-01-02\",\"access\",\"10.0.0.1\",\"alice\",\"/a \"\"b\"\"\",\"read\",\"ok\",\"\",\"\",\"\"\n"
+	want := "\"2024-01-02\",\"login\",\"10.0.0.1\",\"alice\",\"\",\"\",\"ok\",\"\",\"\",\"\"\n" +
+		"\"2024-01-02\",\"access\",\"10.0.0.1\",\"alice\",\"/a \"\"b\"\"\",\"read\",\"ok\",\"\",\"\",\"\"\n"
+	if got := string(filterAccessLog([]byte(csvLog), "csv", accept)); got != want {
+		t.Errorf("filterAccessLog(csv) = %q, want %q", got, want)
+	}
+	jsonLog := "{\"Type\":\"login\",\"Username\":\"bob\"}\n{\"Type\":\"login\",\"Username\":\"alice\"}\nbroken\n"
+	if got := string(filterAccessLog([]byte(jsonLog), "json", accept)); got != "{\"Type\":\"login\",\"Username\":\"alice\"}\n" {
+		t.Errorf("filterAccessLog(json) = %q", got)
+	}
+}
+
+func TestCreationModes(t *testing.T) {
+	umask := uint32(0o777)
+	fileMode, dirMode := UserEntry{Umask: &umask}.creationModes()
+	if fileMode == nil || *fileMode != 0 || dirMode == nil || *dirMode != 0 {
+		t.Errorf("creationModes() with Umask 0o777 = %v, %v, want 0", fileMode, dirMode)
+	}
+	fileMode, dirMode = UserEntry{Umask: &umask, ForceFileMode: 0o600}.creationModes()
+	if fileMode == nil || *fileMode != 0o600 || dirMode == nil || *dirMode != 0 {
+		t.Errorf("creationModes() with ForceFileMode = %v, %v", fileMode, dirMode)
+	}
+	if fileMode, dirMode = (UserEntry{}).creationModes(); fileMode != nil || dirMode != nil {
+		t.Errorf("creationModes() without settings = %v, %v, want the defaults", fileMode, dirMode)
+	}
+}
+
+func TestBandwidthLimitsUpdate(t *testing.T) {
+	limits, err := newBandwidthLimits(&ConfigSftp{MaxBandwidth: "1KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := limits.throttle(sftp2.DirFs{}, "alice", UserEntry{MaxDownloadBandwidth: "1KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttled, ok := fs.(sftp2.ThrottledFS)
+	if !ok || len(throttled.Buckets) != 1 || len(throttled.ReadBuckets) != 1 {
+		t.Fatalf("throttle() = %#v, want a global and a read bucket", fs)
+	}
+	// The running session is no longer limited after both limits have been removed.
+	limits.update(&ConfigSftp{}, func(string) (UserEntry, bool) { return UserEntry{}, true })
+	start := time.Now()
+	throttled.Buckets[0].Take(2048)
+	throttled.ReadBuckets[0].Take(2048)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("the removed limits still apply")
+	}
+}
+
+func TestValidateUserRejectsRunAsWithBandwidth(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config ConfigSftp
+		entry  UserEntry
+	}{
+		{"user limit", ConfigSftp{}, UserEntry{RunAs: "nobody", MaxUploadBandwidth: "1MB"}},
+		{"global limit", ConfigSftp{MaxBandwidth: "1MB"}, UserEntry{RunAs: "nobody"}},
+	} {
+		if err := test.config.validateUser("alice", test.entry); err == nil {
+			t.Errorf("validateUser() with RunAs and a %s succeeded", test.name)
+		}
+	}
+	if err := (&ConfigSftp{}).validateUser("alice", UserEntry{RunAs: "nobody"}); err != nil {
+		t.Errorf("validateUser() with RunAs = %v", err)
+	}
+}
+
+func TestChangedStartSettings(t *testing.T) {
+	previous := &ConfigSftp{ReadCacheSize: "64MB", MetricsAddress: "localhost:9100"}
+	reloaded := &ConfigSftp{ReadCacheSize: "128MB", MetricsAddress: "localhost:9100", MaxBandwidth: "1MB",
+		Users: map[string]UserEntry{"alice": {}}}
+	if got := previous.changedStartSettings(reloaded); !reflect.DeepEqual(got, []string{"ReadCacheSize"}) {
+		t.Errorf("changedStartSettings() = %v, want [ReadCacheSize]", got)
+	}
+	if got := previous.changedStartSettings(previous); len(got) != 0 {
+		t.Errorf("changedStartSettings() of the same config = %v", got)
+	}
+}
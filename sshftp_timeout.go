@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// The number of timed out operations per directory that may keep running in the background, because the backend
+// of the directory cannot abort them (for OperationTimeout).
+const maxHangingOperations = 32
+
+// hangingOperations holds the timed out operations of every directory, so all sessions share the limit.
+type hangingOperations struct {
+	// Protects perMount
+	mutex    sync.Mutex
+	perMount map[string]*sftp2.HangingOperations
+}
+
+// newHangingOperations creates an empty hangingOperations.
+func newHangingOperations() *hangingOperations {
+	return &hangingOperations{perMount: map[string]*sftp2.HangingOperations{}}
+}
+
+// forMount returns the hanging operations of the directory with the given name of the user.
+// If h is nil, every call returns a new one.
+func (h *hangingOperations) forMount(username, name string) *sftp2.HangingOperations {
+	if h == nil {
+		return sftp2.NewHangingOperations(maxHangingOperations)
+	}
+	key := username + "/" + name
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hanging, ok := h.perMount[key]
+	if !ok {
+		hanging = sftp2.NewHangingOperations(maxHangingOperations)
+		h.perMount[key] = hanging
+	}
+	return hanging
+}
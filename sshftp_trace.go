@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+const replayHelp = "Replay a trace of an sftp session recorded to the TraceDirectory against a directory"
+
+// validateTrace checks that TraceUsers are only given along with a TraceDirectory.
+func (c *ConfigSftp) validateTrace() error {
+	if len(c.TraceUsers) > 0 && c.TraceDirectory == "" {
+		return fmt.Errorf("TraceUsers needs a TraceDirectory")
+	}
+	return nil
+}
+
+// traceFS wraps fs into a [sftp2.TraceFS] recording to a new file in the TraceDirectory if the sessions of the
+// user of the connection are traced. The returned function closes the trace and has to be called at the end of
+// the session. Tracing is skipped (and logged) if the file cannot be created, so the session is still served.
+func (c *ConfigSftp) traceFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, log logger.Logger) (sftp2.SimplifiedFS, func()) {
+	if c.TraceDirectory == "" || (len(c.TraceUsers) > 0 && !slices.Contains(c.TraceUsers, info.Username)) {
+		return fs, func() {}
+	}
+	name := fmt.Sprintf("%s-%s-%d.trace", url.PathEscape(info.Username), time.Now().Format("20060102-150405"), info.SessionID)
+	if err := os.MkdirAll(c.TraceDirectory, 0o700); err != nil {
+		log.Warn("Trace", fmt.Sprintf("Cannot create the TraceDirectory: %v", err))
+		return fs, func() {}
+	}
+	// Written unbuffered, so the trace is complete even if the server crashes.
+	file, err := os.OpenFile(filepath.Join(c.TraceDirectory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Warn("Trace", fmt.Sprintf("Cannot trace the session of %s: %v", info.Username, err))
+		return fs, func() {}
+	}
+	log.Info("Trace", fmt.Sprintf("Tracing the session of %s to %s", info.Username, file.Name()))
+	return sftp2.TraceFS{Inner: fs, Trace: sftp2.NewTrace(file)}, func() { _ = file.Close() }
+}
+
+// Replays a trace against a directory.
+func mainReplay(args []string) {
+	verbose := len(args) == 4 && args[3] == "-v"
+	if len(args) != 3 && !verbose {
+		ErrPrintf("Wrong arguments: %s tracefile directory [-v]\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Runs the operations of a session recorded to the TraceDirectory against the directory and reports\n")
+		ErrPrintf("those whose outcome differs. With -v, every operation is reported.\n")
+		ErrPrintf("The directory is changed by the operations, so it should be a copy.\n")
+		return
+	}
+	file, err := os.Open(args[1])
+	fatal(err)
+	defer file.Close()
+	root, err := filepath.Abs(args[2])
+	fatal(err)
+	fs := sftp2.DirFs{Root: filepath.ToSlash(root) + "/"}
+	count, differing := 0, 0
+	fatal(sftp2.ReplayTrace(file, fs, func(recorded, replayed sftp2.TraceEntry) {
+		count++
+		differs := (recorded.Error == "") != (replayed.Error == "") || recorded.N != replayed.N
+		if differs {
+			differing++
+		}
+		if !differs && !verbose {
+			return
+		}
+		fmt.Printf("%d %s %s", count, recorded.Op, recorded.Path)
+		if recorded.Target != "" {
+			fmt.Printf(" -> %s", recorded.Target)
+		}
+		if recorded.Handle != 0 {
+			fmt.Printf(" handle=%d", recorded.Handle)
+		}
+		if recorded.Size != 0 {
+			fmt.Printf(" offset=%d size=%d", recorded.Offset, recorded.Size)
+		}
+		fmt.Printf("\n  recorded: n=%d error=%q took %s\n", recorded.N, recorded.Error, recorded.Duration)
+		fmt.Printf("  replayed: n=%d error=%q took %s\n", replayed.N, replayed.Error, replayed.Duration)
+	}))
+	fmt.Printf("%d operations replayed, %d with a different outcome\n", count, differing)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// usersFile is the content of the UsersFile.
+type usersFile struct {
+	Users map[string]UserEntry
+}
+
+// parseAuthorizedKeys parses keys formatted like the lines of an "authorized_keys" file.
+func parseAuthorizedKeys(authorizedKeys []string) ([]ssh.PublicKey, error) {
+	keys := make([]ssh.PublicKey, len(authorizedKeys))
+	for i, keyString := range authorizedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// withParsedKeys returns the entry with its AuthorizedKeys parsed, so they are not parsed again for every login.
+// Entries are stored this way.
+func (u UserEntry) withParsedKeys() UserEntry {
+	source := strings.Join(u.AuthorizedKeys, "\n")
+	u.parsedKeys = &parsedKeys{source: source, keys: parseAuthorizedKeysFile([]byte(source))}
+	return u
+}
+
+// authorizedKeys returns the parsed AuthorizedKeys. They are only parsed here if the entry has not been stored
+// with withParsedKeys or they have been changed since.
+func (u UserEntry) authorizedKeys() []authorizedKey {
+	source := strings.Join(u.AuthorizedKeys, "\n")
+	if u.parsedKeys != nil && u.parsedKeys.source == source {
+		return u.parsedKeys.keys
+	}
+	return parseAuthorizedKeysFile([]byte(source))
+}
+
+// parseKeys parses the AuthorizedKeys of all users of the config once (see withParsedKeys).
+func (c *ConfigSftp) parseKeys() {
+	for username, entry := range c.Users {
+		c.Users[username] = entry.withParsedKeys()
+	}
+	if c.DefaultUser != nil {
+		entry := c.DefaultUser.withParsedKeys()
+		c.DefaultUser = &entry
+	}
+}
+
+// parseNetwork parses a network like "10.0.0.0/8". A single address is a network of its own.
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", cidr)
+	}
+	return network, nil
+}
+
+// Checks whether the address is part of one of the networks. They must have been checked by parseNetwork.
+func inNetworks(ip net.IP, networks []string) bool {
+	for _, cidr := range networks {
+		if network, err := parseNetwork(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddress checks whether the user can log in from the address according to its AllowedCIDRs and DeniedCIDRs.
+func (u UserEntry) allowsAddress(addr net.Addr) bool {
+	if len(u.AllowedCIDRs) == 0 && len(u.DeniedCIDRs) == 0 {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	ip := net.ParseIP(hostOf(addr.String()))
+	if ip == nil {
+		return false
+	}
+	if len(u.AllowedCIDRs) > 0 && !inNetworks(ip, u.AllowedCIDRs) {
+		return false
+	}
+	return !inNetworks(ip, u.DeniedCIDRs)
+}
+
+// Returns the path relative to the directory of the config file, unless it is absolute.
+func relativeToConfig(configFile string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), path)
+}
+
+// Returns the files an entry of Include stands for. A directory stands for its "*.toml" files.
+func includedFiles(configFile string, pattern string) ([]string, error) {
+	pattern = relativeToConfig(configFile, pattern)
+	if !strings.ContainsAny(pattern, "*?[") {
+		info, err := os.Stat(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			pattern = filepath.Join(pattern, "*.toml")
+		}
+	}
+	return filepath.Glob(pattern)
+}
+
+// loadIncludes adds the users from the files of Include to the config.
+func (c *ConfigSftp) loadIncludes() error {
+	for _, pattern := range c.Include {
+		files, err := includedFiles(c.filename, pattern)
+		if err != nil {
+			return fmt.Errorf("invalid Include %q: %v", pattern, err)
+		}
+		for _, file := range files {
+			var users usersFile
+			if _, err := toml.DecodeFile(file, &users); err != nil {
+				return fmt.Errorf("cannot read included file %s: %v", file, err)
+			}
+			if c.Users == nil {
+				c.Users = map[string]UserEntry{}
+			}
+			for username, entry := range users.Users {
+				if _, ok := c.Users[username]; ok {
+					return fmt.Errorf("user %s of the included file %s is defined twice", username, file)
+				}
+				c.Users[username] = entry
+			}
+		}
+	}
+	return nil
+}
+
+// lookupDirUser reads the settings of the user from its file in the UsersDir. Returns false if the user has no
+// file. Settings that are not valid are reported as error.
+func (c *ConfigSftp) lookupDirUser(username string) (UserEntry, bool, error) {
+	// Names like "../x" must not read files outside of the UsersDir.
+	if username == "" || !validMountName(username) {
+		return UserEntry{}, false, nil
+	}
+	var entry UserEntry
+	_, err := toml.DecodeFile(filepath.Join(relativeToConfig(c.filename, c.UsersDir), username+".toml"), &entry)
+	if errors.Is(err, os.ErrNotExist) {
+		return UserEntry{}, false, nil
+	}
+	if err != nil {
+		return UserEntry{}, false, fmt.Errorf("invalid settings of %s: %v", username, err)
+	}
+	if err := c.validateUser(username, entry); err != nil {
+		return UserEntry{}, false, err
+	}
+	return entry.withParsedKeys(), true, nil
+}
+
+// loadUsersFile adds the users from the UsersFile (if it exists) to the config.
+func (c *ConfigSftp) loadUsersFile() error {
+	if c.UsersFile == "" {
+		return nil
+	}
+	var users usersFile
+	_, err := toml.DecodeFile(c.UsersFile, &users)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.Users == nil {
+		c.Users = map[string]UserEntry{}
+	}
+	for username, entry := range users.Users {
+		c.Users[username] = entry
+	}
+	return nil
+}
+
+// Writes the data into the file. A temporary file is written first, so a crash does not leave a broken file behind.
+func writeFileAtomically(filename string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Encodes v as toml into the file.
+func writeTomlFile(filename string, v interface{}) error {
+	var buffer bytes.Buffer
+	if err := toml.NewEncoder(&buffer).Encode(v); err != nil {
+		return err
+	}
+	return writeFileAtomically(filename, buffer.Bytes())
+}
+
+// Matches the header of a table or an array of tables and captures the first part of its key.
+var tomlTableHeader = regexp.MustCompile(`^\s*\[\[?\s*("[^"]*"|'[^']*'|[A-Za-z0-9_-]+)(\s*\.\s*("[^"]*"|'[^']*'|[A-Za-z0-9_-]+))*\s*\]\]?\s*(#.*)?$`)
+
+// Matches users defined directly in the root table, which cannot be replaced.
+var tomlRootUsers = regexp.MustCompile(`^\s*("Users"|'Users'|Users)\s*[.=]`)
+
+// replaceUsersTables replaces all tables of the users in the toml document with the given users. The rest of the
+// document (including its comments) is kept as it is, while the users are appended to its end.
+func replaceUsersTables(data []byte, users map[string]UserEntry) ([]byte, error) {
+	var kept []string
+	inUsers, inRoot := false, true
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if match := tomlTableHeader.FindStringSubmatch(line); match != nil {
+			inUsers, inRoot = strings.Trim(match[1], `"'`) == "Users", false
+		} else if inRoot && tomlRootUsers.MatchString(line) {
+			return nil, fmt.Errorf("cannot replace the users, as they are not defined as tables")
+		}
+		if !inUsers {
+			kept = append(kept, line)
+		}
+	}
+	document := strings.TrimRight(strings.Join(kept, ""), "\n")
+	var buffer bytes.Buffer
+	if len(users) > 0 {
+		if err := toml.NewEncoder(&buffer).Encode(usersFile{Users: users}); err != nil {
+			return nil, err
+		}
+		document += "\n\n" + buffer.String()
+	}
+	return []byte(strings.TrimLeft(document, "\n")), nil
+}
+
+// saveUsers writes the users into the UsersFile and the config file if desired. Only the users are replaced in the
+// config file, so its other settings (like the AdminToken) and comments stay as they are.
+func (c *ConfigSftp) saveUsers() error {
+	if c.UsersFile != "" {
+		if err := writeTomlFile(c.UsersFile, usersFile{Users: c.Users}); err != nil {
+			return err
+		}
+	}
+	if c.SaveUsersToConfig && c.filename != "" {
+		data, err := os.ReadFile(c.filename)
+		if err != nil {
+			return err
+		}
+		if data, err = replaceUsersTables(data, c.Users); err != nil {
+			return err
+		}
+		return writeFileAtomically(c.filename, data)
+	}
+	return nil
+}
+
+// currentConfig returns a copy of the config with the current users. As users may be changed at runtime,
+// the config must not be read directly when users are involved. The returned Users must not be modified.
+func (c *ContextSftp) currentConfig() *ConfigSftp {
+	c.usersMutex.RLock()
+	defer c.usersMutex.RUnlock()
+	config := *c.config
+	return &config
+}
+
+// userEntry returns the current entry of the given user. Users that are not listed in the config are looked up
+// in the UsersDir, the UserStore and then in the LDAP server. Only users none of them knows get the DefaultUser,
+// if any. A failed lookup (that has no cached entry to fall back to) rejects the user, as the DefaultUser could
+// grant more than its own entry.
+func (c *ContextSftp) userEntry(username string) (UserEntry, bool) {
+	config := c.currentConfig()
+	entry, ok := config.Users[username]
+	if ok {
+		return entry, ok
+	}
+	if config.UsersDir != "" {
+		entry, ok, err := config.lookupDirUser(username)
+		if err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot read %s from the UsersDir: %v", username, err))
+		}
+		if ok || err != nil {
+			return entry, ok
+		}
+	}
+	if config.UserStore.URL != "" {
+		entry, ok, err := c.storeUsers.lookup(cacheTimeOr(config.UserStore.CacheTime, defaultUserStoreCacheTime), username, config.lookupStoreUser)
+		if err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot look up %s in the UserStore: %v", username, err))
+		}
+		if ok || err != nil {
+			return entry, ok
+		}
+	}
+	if config.LDAP.Address != "" {
+		entry, ok, err := c.ldapUsers.lookup(cacheTimeOr(config.LDAP.CacheTime, defaultLDAPCacheTime), username, config.LDAP.lookupUser)
+		if err != nil {
+			c.logger.Err("ContextSftp", fmt.Sprintf("Cannot look up %s in the LDAP server: %v", username, err))
+		}
+		if ok || err != nil {
+			return entry, ok
+		}
+	}
+	return config.defaultUser(username)
+}
+
+// defaultUser returns the DefaultUser for a user that is not known otherwise. Returns false if there is no
+// DefaultUser or the username cannot be used as part of a path.
+func (c *ConfigSftp) defaultUser(username string) (UserEntry, bool) {
+	// The username replaces "%u" in the roots of the directories, "../x" must not lead outside of them.
+	if c.DefaultUser == nil || username == "" || !validMountName(username) {
+		return UserEntry{}, false
+	}
+	return *c.DefaultUser, true
+}
+
+// validateKey checks if a public key from the user of the connection matches one authorized key from the config
+// or the AuthorizedKeysFile, the AuthorizedKeysURL or the GithubUser of this user. Returns the restrictions of the
+// options of the matching key.
+func (c *ContextSftp) validateKey(conn ssh.ConnMetadata, key gssh.PublicKey) (keyRestrictions, bool) {
+	entry, ok := c.userEntry(conn.User())
+	if !ok {
+		return keyRestrictions{}, false
+	}
+	restrictions, ok := c.findAuthorizedKey(conn, entry, key)
+	if ok && entry.keyPermissionsFor(restrictions.comment) != nil {
+		// Keys replaced with KeySelfService could have another comment and thus escape the KeyPermissions.
+		restrictions.limited = true
+	}
+	return restrictions, ok
+}
+
+// findAuthorizedKey looks for the key among the authorized keys of the entry and returns the restrictions of the
+// matching one.
+func (c *ContextSftp) findAuthorizedKey(conn ssh.ConnMetadata, entry UserEntry, key gssh.PublicKey) (keyRestrictions, bool) {
+	// The keys have been validated before, so no line is skipped.
+	if authorized, ok := findKey(entry.authorizedKeys(), key, conn.RemoteAddr()); ok {
+		return authorized.restrictions, true
+	}
+	if restrictions, ok := c.validateKeyFromFiles(conn, entry, key); ok {
+		return restrictions, true
+	}
+	return c.validateKeyFromURLs(conn, entry, key)
+}
+
+// connectionEntry returns the entry of the user of the connection with the restrictions of the key the user has
+// logged in with.
+func (c *ContextSftp) connectionEntry(ctx context.Context) (UserEntry, bool) {
+	username, _ := ctx.Value(gssh.ContextKeyUser).(string)
+	entry, ok := c.userEntry(username)
+	return restrictionsOf(ctx).apply(entry), ok
+}
+
+// validateCertificate checks if the key is a user certificate signed by one of the TrustedUserCAKeys, which is
+// valid for the user of the connection.
+func (c *ContextSftp) validateCertificate(conn ssh.ConnMetadata, key ssh.PublicKey) bool {
+	cert, ok := key.(*ssh.Certificate)
+	config := c.currentConfig()
+	if !ok || len(config.TrustedUserCAKeys) == 0 {
+		return false
+	}
+	if _, ok := c.userEntry(conn.User()); !ok {
+		return false
+	}
+	if err := checkUserCertificate(config.TrustedUserCAKeys, conn, cert); err != nil {
+		c.logger.Info("ContextSftp", fmt.Sprintf("Rejecting certificate of %s at %s: %v", conn.User(), conn.RemoteAddr(), err))
+		return false
+	}
+	return true
+}
+
+// setUser adds or replaces the entry of the given user and saves the users. A nil entry removes the user. The users
+// stay as they are if they cannot be saved.
+// Connections of this user that are already established are not affected, except for changed bandwidth limits.
+func (c *ContextSftp) setUser(username string, entry *UserEntry) error {
+	c.usersMutex.Lock()
+	defer c.usersMutex.Unlock()
+	if entry != nil {
+		if err := c.config.validateUser(username, *entry); err != nil {
+			return err
+		}
+	}
+	// The map is replaced, as readers may still use the old one.
+	users := make(map[string]UserEntry, len(c.config.Users)+1)
+	for name, e := range c.config.Users {
+		users[name] = e
+	}
+	if entry != nil {
+		users[username] = entry.withParsedKeys()
+	} else {
+		delete(users, username)
+	}
+	config := *c.config
+	config.Users = users
+	if err := config.saveUsers(); err != nil {
+		return err
+	}
+	c.config.Users = users
+	if entry != nil {
+		c.shared.bandwidth.updateUser(username, *entry)
+	}
+	c.logger.Info("ContextSftp", fmt.Sprintf("Changed the config of user %s", username))
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Entscheider/sshtool/logger"
+)
+
+func TestLoadIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"users.d/alice.toml": "[Users.alice]\nDisabled = true\n",
+		"users.d/bob.toml":   "[Users.bob]\n",
+		"users.d/notes.txt":  "not a config",
+		"other.toml":         "[Users.carol]\n",
+		"twice.toml":         "[Users.alice]\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name      string
+		include   []string
+		wantUsers []string
+		wantErr   bool
+	}{
+		{"directory", []string{"users.d"}, []string{"root", "alice", "bob"}, false},
+		{"glob", []string{"users.d/b*.toml", "other.toml"}, []string{"root", "bob", "carol"}, false},
+		{"absolute", []string{filepath.Join(dir, "other.toml")}, []string{"root", "carol"}, false},
+		{"no match", []string{"missing/*.toml"}, []string{"root"}, false},
+		{"missing directory", []string{"missing"}, nil, true},
+		{"defined twice", []string{"users.d", "twice.toml"}, nil, true},
+		{"defined in the config", []string{"root.toml"}, nil, true},
+	}
+	if err := os.WriteFile(filepath.Join(dir, "root.toml"), []byte("[Users.root]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := ConfigSftp{Users: map[string]UserEntry{"root": {}}, Include: test.include}
+			c.filename = filepath.Join(dir, "sftp.toml")
+			err := c.loadIncludes()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("loadIncludes() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(c.Users) != len(test.wantUsers) {
+				t.Errorf("users = %v, want %v", c.Users, test.wantUsers)
+			}
+			for _, username := range test.wantUsers {
+				if _, ok := c.Users[username]; !ok {
+					t.Errorf("user %s is missing", username)
+				}
+			}
+			if alice, ok := c.Users["alice"]; ok && !alice.Disabled {
+				t.Errorf("the entry of alice has not been read")
+			}
+		})
+	}
+}
+
+func TestLookupDirUser(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"users/alice.toml":   "Disabled = true\n",
+		"users/invalid.toml": "Disabled = \n",
+		"users/bad.toml":     "CanRead = [\"(\"]\n",
+		"users/french.toml":  "Language = \"fr\"\n",
+		"secret.toml":        "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		username string
+		want     bool
+		wantErr  bool
+	}{
+		{"alice", true, false},
+		{"bob", false, false},
+		{"invalid", false, true},
+		{"bad", false, true},
+		{"french", false, true},
+		{"../secret", false, false},
+		{"", false, false},
+	}
+	c := ConfigSftp{UsersDir: "users"}
+	c.filename = filepath.Join(dir, "sftp.toml")
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			entry, ok, err := c.lookupDirUser(test.username)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("lookupDirUser(%q) error = %v, wantErr %v", test.username, err, test.wantErr)
+			}
+			if ok != test.want {
+				t.Errorf("lookupDirUser(%q) = %v, want %v", test.username, ok, test.want)
+			}
+			if ok && !entry.Disabled {
+				t.Errorf("the settings of %s have not been read", test.username)
+			}
+		})
+	}
+}
+
+func TestDefaultUser(t *testing.T) {
+	template := &UserEntry{Filesystem: map[string]SFTPEntry{"": {Root: "/srv/sftp/%u"}}}
+	tests := []struct {
+		name        string
+		defaultUser *UserEntry
+		username    string
+		want        bool
+	}{
+		{"no default", nil, "alice", false},
+		{"default", template, "alice", true},
+		{"parent directory", template, "..", false},
+		{"path", template, "a/b", false},
+		{"empty", template, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := ConfigSftp{DefaultUser: test.defaultUser}
+			entry, ok := c.defaultUser(test.username)
+			if ok != test.want {
+				t.Fatalf("defaultUser(%q) = %v, want %v", test.username, ok, test.want)
+			}
+			if ok && entry.Filesystem[""].rootFor(test.username) != "/srv/sftp/"+test.username {
+				t.Errorf("root = %s", entry.Filesystem[""].rootFor(test.username))
+			}
+		})
+	}
+}
+
+func TestReplaceUsersTables(t *testing.T) {
+	config := `# The admin api
+AdminAddress = "localhost:8443"
+AdminToken = "secret"
+
+[Users.alice]
+PasswordHash = "old"
+
+[[Users.alice.ACL]]
+Path = "/private"
+
+[OIDC]
+# Only for the staff
+Issuer = "https://login.example.com"
+`
+	data, err := replaceUsersTables([]byte(config), map[string]UserEntry{"bob": {Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kept := range []string{"# The admin api", "AdminToken = \"secret\"", "[OIDC]\n# Only for the staff\n"} {
+		if !strings.Contains(string(data), kept) {
+			t.Errorf("%q has not been kept in:\n%s", kept, data)
+		}
+	}
+	var c ConfigSftp
+	if err := toml.Unmarshal(data, &c); err != nil {
+		t.Fatalf("invalid document %v:\n%s", err, data)
+	}
+	if _, ok := c.Users["alice"]; ok || !c.Users["bob"].Disabled || c.OIDC.Issuer != "https://login.example.com" {
+		t.Errorf("users = %v, OIDC = %v, want only bob and the OIDC provider", c.Users, c.OIDC)
+	}
+	if _, err := replaceUsersTables([]byte("Users.alice.Disabled = true\n"), nil); err == nil {
+		t.Error("replaceUsersTables() replaced users of the root table")
+	}
+}
+
+func TestDefaultUserOnFailedLookup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "invalid.toml"), []byte("Disabled = \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &ConfigSftp{UsersDir: dir, DefaultUser: &UserEntry{}}
+	c := &ContextSftp{config: config, logger: logger.NewLogger(io.Discard)}
+	if _, ok := c.userEntry("alice"); !ok {
+		t.Errorf("userEntry() of an unknown user did not return the DefaultUser")
+	}
+	// The user may exist with less permissions than the DefaultUser has.
+	if _, ok := c.userEntry("invalid"); ok {
+		t.Errorf("userEntry() of a user that cannot be read returned the DefaultUser")
+	}
+}
+
+func TestSetUserNotSaved(t *testing.T) {
+	config := &ConfigSftp{SaveUsersToConfig: true, Users: map[string]UserEntry{"alice": {}}}
+	config.filename = filepath.Join(t.TempDir(), "missing.toml")
+	c := &ContextSftp{config: config, logger: logger.NewLogger(io.Discard)}
+	if err := c.setUser("alice", nil); err == nil {
+		t.Fatal("setUser() succeeded without a config file to save the users to")
+	}
+	if _, ok := c.userEntry("alice"); !ok {
+		t.Errorf("the user has been removed although it could not be saved")
+	}
+}
+
+func TestAuthorizedKeysChangedAfterStoring(t *testing.T) {
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl alice"
+	entry := UserEntry{AuthorizedKeys: []string{key}}.withParsedKeys()
+	if len(entry.authorizedKeys()) != 1 {
+		t.Fatalf("authorizedKeys() = %v, want the key", entry.authorizedKeys())
+	}
+	entry.AuthorizedKeys = nil
+	if len(entry.authorizedKeys()) != 0 {
+		t.Errorf("authorizedKeys() = %v, want the removed key to be gone", entry.authorizedKeys())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Entscheider/sshtool/events"
+	"github.com/fsnotify/fsnotify"
+)
+
+// startWatchers publishes the changes within every served directory with Watch as events.FileChanged until the
+// context is done.
+func (c *ContextSftp) startWatchers(ctx context.Context) {
+	for username, userEntry := range c.currentConfig().Users {
+		for name, entry := range userEntry.Filesystem {
+			if !entry.Watch {
+				continue
+			}
+			root := entry.rootFor(username)
+			watcher, err := fsnotify.NewWatcher()
+			if err != nil {
+				c.logger.Err("Watch", fmt.Sprintf("Cannot watch directory %q of %s: %v", name, username, err))
+				continue
+			}
+			if err := addRecursive(watcher, root); err != nil {
+				c.logger.Err("Watch", fmt.Sprintf("Cannot watch directory %q of %s: %v", name, username, err))
+				_ = watcher.Close()
+				continue
+			}
+			go c.watch(ctx, watcher, username, name, root)
+		}
+	}
+}
+
+// addRecursive adds the directory and all directories below it to the watcher, as fsnotify only watches
+// the direct content of a directory.
+func addRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(p)
+		}
+		return nil
+	})
+}
+
+// watch publishes the changes reported by the watcher for the directory root, which is served under the given
+// name to the user.
+func (c *ContextSftp) watch(ctx context.Context, watcher *fsnotify.Watcher, username, name, root string) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			c.logger.Err("Watch", fmt.Sprintf("Watching directory %q of %s: %v", name, username, err))
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				// New directories must be watched as well. Errors are ignored, as the directory may
+				// already be gone again.
+				_ = addRecursive(watcher, event.Name)
+			}
+			rel, err := filepath.Rel(root, event.Name)
+			if err != nil {
+				continue
+			}
+			c.shared.events.Publish(events.Event{
+				Type:     events.FileChanged,
+				Username: username,
+				// The path as seen by the user.
+				Path:    path.Join("/", name, filepath.ToSlash(rel)),
+				Message: strings.ToLower(event.Op.String()),
+			})
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+)
+
+// fsWrapper is a wrapper that can be listed in the Wrappers of a user.
+type fsWrapper struct {
+	// Whether the wrapper is configured with a parameter (e.g. "throttle: 1MB") or used without (e.g. "perm").
+	hasParam bool
+	// Checks the parameter. May be nil if every parameter is accepted.
+	validate func(param string) error
+	// Wraps the filesystem of a session of the user.
+	wrap func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, error)
+}
+
+// Parses a positive number.
+func parsePositive(param string) (int64, error) {
+	n, err := strconv.ParseInt(param, 10, 64)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("%d is not positive", n)
+	}
+	return n, err
+}
+
+// fsWrappers are the wrappers available for the Wrappers of a user by their name.
+var fsWrappers = map[string]fsWrapper{
+	// The permissions of the user (CanRead, CanWrite, ShouldHide and HideDotfiles or the ACL), which are otherwise
+	// applied last.
+	"perm": {
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, _ string, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+			return c.permissionFS(fs, info, userEntry, shared)
+		},
+	},
+	// Rejects all changes.
+	"readonly": {
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, _ string, _ logger.ConnectionInfo, _ UserEntry, _ fsShared) (sftp2.SimplifiedFS, error) {
+			return sftp2.PermWrapperFS{Inner: fs, CanReadRegexp: []*regexp.Regexp{regexp.MustCompile(".*")}}, nil
+		},
+	},
+	// Limits the bytes per second of a single session, e.g. "throttle: 5MBps".
+	"throttle": {
+		hasParam: true,
+		validate: func(param string) error {
+			_, err := parseRate(param)
+			return err
+		},
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, _ logger.ConnectionInfo, _ UserEntry, _ fsShared) (sftp2.SimplifiedFS, error) {
+			rate, _ := parseRate(param)
+			return sftp2.ThrottledFS{Inner: fs, Buckets: []*sftp2.TokenBucket{sftp2.NewTokenBucket(rate)}}, nil
+		},
+	},
+	// Fails operations taking longer than the duration, e.g. "timeout: 30s".
+	"timeout": {
+		hasParam: true,
+		validate: func(param string) error {
+			if timeout, err := time.ParseDuration(param); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid duration %q", param)
+			}
+			return nil
+		},
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, _ logger.ConnectionInfo, _ UserEntry, _ fsShared) (sftp2.SimplifiedFS, error) {
+			timeout, _ := time.ParseDuration(param)
+			return sftp2.TimeoutFS{Inner: fs, Timeout: timeout}, nil
+		},
+	},
+	// Limits the number of files and directories, e.g. "maxfiles: 1000". It is counted separately from MaxFiles.
+	"maxfiles": {
+		hasParam: true,
+		validate: func(param string) error {
+			_, err := parsePositive(param)
+			return err
+		},
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, info logger.ConnectionInfo, _ UserEntry, shared fsShared) (sftp2.SimplifiedFS, error) {
+			maxFiles, _ := parsePositive(param)
+			return sftp2.NewQuotaFS(fs, shared.usage, info.Username+"#maxfiles", maxFiles), nil
+		},
+	},
+	// Limits the number of operations a session runs at the same time, e.g. "requests: 16".
+	"requests": {
+		hasParam: true,
+		validate: func(param string) error {
+			_, err := parsePositive(param)
+			return err
+		},
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, _ logger.ConnectionInfo, _ UserEntry, _ fsShared) (sftp2.SimplifiedFS, error) {
+			n, _ := parsePositive(param)
+			return sftp2.LimitFS{Inner: fs, Limits: &sftp2.SessionLimits{MaxRequests: n}}, nil
+		},
+	},
+	// Limits the number of files a session has opened at the same time, e.g. "handles: 32".
+	"handles": {
+		hasParam: true,
+		validate: func(param string) error {
+			_, err := parsePositive(param)
+			return err
+		},
+		wrap: func(c *ConfigSftp, fs sftp2.SimplifiedFS, param string, _ logger.ConnectionInfo, _ UserEntry, _ fsShared) (sftp2.SimplifiedFS, error) {
+			n, _ := parsePositive(param)
+			return sftp2.LimitFS{Inner: fs, Limits: &sftp2.SessionLimits{MaxHandles: n}}, nil
+		},
+	},
+}
+
+// Splits an entry of Wrappers like "throttle: 5MB" into its name and parameter.
+func splitWrapper(entry string) (string, string) {
+	name, param, _ := strings.Cut(entry, ":")
+	return strings.TrimSpace(name), strings.TrimSpace(param)
+}
+
+// validateWrappers checks that all wrappers exist and have valid parameters.
+func validateWrappers(entries []string) error {
+	perm := false
+	for _, entry := range entries {
+		name, param := splitWrapper(entry)
+		wrapper, ok := fsWrappers[name]
+		if !ok {
+			return fmt.Errorf("unknown wrapper %q", name)
+		}
+		if wrapper.hasParam != (param != "") {
+			if wrapper.hasParam {
+				return fmt.Errorf("the wrapper %s needs a parameter", name)
+			}
+			return fmt.Errorf("the wrapper %s takes no parameter", name)
+		}
+		if wrapper.validate != nil {
+			if err := wrapper.validate(param); err != nil {
+				return fmt.Errorf("wrapper %s: %v", name, err)
+			}
+		}
+		if name == "perm" {
+			if perm {
+				return fmt.Errorf("the wrapper perm can only be used once")
+			}
+			perm = true
+		}
+	}
+	return nil
+}
+
+// wrapFS wraps the filesystem of a session of the user into the Wrappers of the user in their order, so the
+// first one is the innermost. Returns whether the permissions have been applied by one of them.
+func (c *ConfigSftp) wrapFS(fs sftp2.SimplifiedFS, info logger.ConnectionInfo, userEntry UserEntry, shared fsShared) (sftp2.SimplifiedFS, bool, error) {
+	perm := false
+	for _, entry := range userEntry.Wrappers {
+		name, param := splitWrapper(entry)
+		// The config has been validated before, so the wrapper exists.
+		var err error
+		fs, err = fsWrappers[name].wrap(c, fs, param, info, userEntry, shared)
+		if err != nil {
+			return nil, false, fmt.Errorf("wrapper %s: %v", name, err)
+		}
+		perm = perm || name == "perm"
+	}
+	return fs, perm, nil
+}
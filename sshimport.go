@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
+)
+
+const importHelp = "Generate sftp users from OpenSSH authorized_keys files and an sshd_config"
+
+// The options of a key in an authorized_keys file that sshtool applies to keys of the config as well. It does
+// not run a user rc file anyway, so no-user-rc is kept, too.
+var supportedKeyOptions = map[string]bool{
+	"from": true, "expiry-time": true, "restrict": true, "readonly": true, "no-user-rc": true, "user-rc": true,
+	"no-port-forwarding": true, "port-forwarding": true, "no-agent-forwarding": true, "agent-forwarding": true,
+	"no-pty": true, "pty": true, "no-x11-forwarding": true, "x11-forwarding": true,
+}
+
+// sshdBlock is the global section or a Match block of an sshd_config.
+type sshdBlock struct {
+	// The criteria of the Match line as pairs of the criterion and its patterns, empty for the global section.
+	criteria []string
+	// The arguments of the keywords (in lower case). Like sshd, the first value of a keyword is used.
+	options map[string][]string
+}
+
+// parseSshdConfig splits an sshd_config into its global section and its Match blocks.
+func parseSshdConfig(data []byte) ([]sshdBlock, error) {
+	blocks := []sshdBlock{{options: map[string][]string{}}}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The keyword is separated from its arguments by spaces or "=".
+		keyword, rest := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			keyword, rest = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+		args, err := splitSshdArgs(strings.TrimPrefix(rest, "="))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		keyword = strings.ToLower(keyword)
+		if keyword == "match" {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("line %d: Match without criteria", lineNo)
+			}
+			blocks = append(blocks, sshdBlock{criteria: args, options: map[string][]string{}})
+			continue
+		}
+		block := blocks[len(blocks)-1]
+		if _, ok := block.options[keyword]; !ok {
+			block.options[keyword] = args
+		}
+	}
+	return blocks, scanner.Err()
+}
+
+// Splits the arguments of an sshd_config line at spaces, keeping quoted arguments together.
+func splitSshdArgs(s string) ([]string, error) {
+	var args []string
+	for s = strings.TrimLeft(s, " \t"); s != ""; s = strings.TrimLeft(s, " \t") {
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+	return args, nil
+}
+
+// matchPatternList checks the name against a comma separated list of OpenSSH patterns. Patterns prefixed with "!"
+// deny the matching names.
+func matchPatternList(patterns string, name string) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), name); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matches checks whether the Match block applies to the user. The account of the user may be nil if it does not
+// exist on this machine. Returns an error for criteria that cannot be checked without a connection.
+func (b sshdBlock) matches(name string, account *user.User) (bool, error) {
+	for i := 0; i < len(b.criteria); i++ {
+		criterion := strings.ToLower(b.criteria[i])
+		if criterion == "all" {
+			continue
+		}
+		if i+1 >= len(b.criteria) {
+			return false, fmt.Errorf("the criterion %s has no patterns", b.criteria[i])
+		}
+		i++
+		switch criterion {
+		case "user":
+			if !matchPatternList(b.criteria[i], name) {
+				return false, nil
+			}
+		case "group":
+			if account == nil || !inGroups(b.criteria[i], account) {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("the criterion %s is not supported", b.criteria[i-1])
+		}
+	}
+	return true, nil
+}
+
+// Checks whether the account is member of a group matching the patterns.
+func inGroups(patterns string, account *user.User) bool {
+	ids, err := account.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if group, err := user.LookupGroupId(id); err == nil && matchPatternList(patterns, group.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshdOptions returns the options of the sshd_config that apply to the user. The first matching Match block
+// setting a keyword overrides the global section.
+func sshdOptions(blocks []sshdBlock, name string, account *user.User) map[string][]string {
+	options := map[string][]string{}
+	fromMatch := map[string]bool{}
+	for i, block := range blocks {
+		if i > 0 {
+			ok, err := block.matches(name, account)
+			if err != nil {
+				ErrPrintf("Warning: skipping the block \"Match %s\" for %s: %v\n", strings.Join(block.criteria, " "), name, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		for keyword, args := range block.options {
+			if !fromMatch[keyword] {
+				options[keyword] = args
+				fromMatch[keyword] = i > 0
+			}
+		}
+	}
+	return options
+}
+
+// Replaces the tokens of sshd_config paths (%h, %u, %U and %%) for the user. Relative paths are relative to
+// the home directory.
+func expandSshdPath(p string, name string, account *user.User) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' {
+			result.WriteByte(p[i])
+			continue
+		}
+		if i+1 >= len(p) {
+			return "", fmt.Errorf("invalid token at the end of %q", p)
+		}
+		i++
+		switch p[i] {
+		case '%':
+			result.WriteByte('%')
+		case 'u':
+			result.WriteString(name)
+		case 'h', 'U':
+			if account == nil {
+				return "", fmt.Errorf("%q needs the account of %s, which does not exist on this machine", p, name)
+			}
+			if p[i] == 'h' {
+				result.WriteString(account.HomeDir)
+			} else {
+				result.WriteString(account.Uid)
+			}
+		default:
+			return "", fmt.Errorf("unknown token %%%c in %q", p[i], p)
+		}
+	}
+	expanded := result.String()
+	if !filepath.IsAbs(expanded) {
+		if account == nil {
+			return "", fmt.Errorf("the relative path %q needs the home directory of %s, which does not exist on this machine", p, name)
+		}
+		expanded = filepath.Join(account.HomeDir, expanded)
+	}
+	return expanded, nil
+}
+
+// importKeys reads the keys of an authorized_keys file along with their options. Keys with options sshtool cannot
+// apply are left out, so no restriction gets lost.
+func importKeys(filename string, name string) []string {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrPrintf("Warning: cannot read the keys of %s: %v\n", name, err)
+		return nil
+	}
+	keys := []string{}
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// There is no further valid key.
+			break
+		}
+		data = rest
+		var unsupported []string
+		for _, option := range options {
+			keyword, _, _ := strings.Cut(option, "=")
+			if !supportedKeyOptions[strings.ToLower(keyword)] {
+				unsupported = append(unsupported, option)
+			}
+		}
+		if len(unsupported) > 0 {
+			ErrPrintf("Warning: skipping the key %q of %s, its options %s are not supported in AuthorizedKeys\n",
+				comment, name, strings.Join(unsupported, ","))
+			continue
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if len(options) > 0 {
+			line = strings.Join(options, ",") + " " + line
+		}
+		if comment != "" {
+			line += " " + comment
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// Applies the arguments of internal-sftp or sftp-server (e.g. "-R -u 027") to the user entry.
+func applySftpServerArgs(args []string, name string, entry *UserEntry, served *SFTPEntry) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-R":
+			served.ReadOnly = true
+		case "-u":
+			if i+1 >= len(args) {
+				ErrPrintf("Warning: -u without umask for %s\n", name)
+				continue
+			}
+			i++
+			umask, err := strconv.ParseUint(args[i], 8, 32)
+			if err != nil {
+				ErrPrintf("Warning: invalid umask %q for %s\n", args[i], name)
+				continue
+			}
+			value := uint32(umask)
+			entry.Umask = &value
+		case "-d", "-f", "-l", "-P", "-p":
+			// Options with an argument that do not change what the user can do (or are not supported)
+			if args[i] == "-P" || args[i] == "-p" {
+				ErrPrintf("Warning: the sftp option %s of %s is not supported, restrict the user with CanRead and CanWrite\n", args[i], name)
+			}
+			i++
+		}
+	}
+}
+
+// Returns the chains of AuthenticationMethods that sshtool supports. "any" means every method on its own.
+func importAuthenticationMethods(chains []string, name string) []string {
+	var result []string
+	for _, chain := range chains {
+		if chain == "any" {
+			return nil
+		}
+		methods := strings.Split(chain, ",")
+		supported := true
+		for i, method := range methods {
+			// Submethods like "keyboard-interactive:pam" are not supported.
+			method, _, _ = strings.Cut(method, ":")
+			methods[i] = method
+			if method != "publickey" && method != "password" {
+				supported = false
+			}
+		}
+		if !supported {
+			ErrPrintf("Warning: skipping the AuthenticationMethods %q of %s, only publickey and password are imported\n", chain, name)
+			continue
+		}
+		result = append(result, strings.Join(methods, ","))
+	}
+	return result
+}
+
+// importUser generates the entry of a user. If keysFile is empty, the keys are read from the AuthorizedKeysFile
+// of the sshd_config (or its default).
+func importUser(name string, keysFile string, blocks []sshdBlock) UserEntry {
+	// The account is nil if the user does not exist on this machine.
+	account, _ := user.Lookup(name)
+	options := sshdOptions(blocks, name, account)
+	entry := UserEntry{
+		CanRead:    []string{".*"},
+		CanWrite:   []string{".*"},
+		ShouldHide: []string{},
+	}
+	keysFiles := []string{keysFile}
+	if keysFile == "" {
+		keysFiles = options["authorizedkeysfile"]
+		if keysFiles == nil {
+			keysFiles = []string{".ssh/authorized_keys", ".ssh/authorized_keys2"}
+		}
+	}
+	entry.AuthorizedKeys = []string{}
+	for _, filename := range keysFiles {
+		if filename == "none" {
+			continue
+		}
+		if keysFile == "" {
+			expanded, err := expandSshdPath(filename, name, account)
+			if err != nil {
+				ErrPrintf("Warning: cannot read the keys of %s: %v\n", name, err)
+				continue
+			}
+			filename = expanded
+			if _, err := os.Stat(filename); os.IsNotExist(err) {
+				continue
+			}
+		}
+		entry.AuthorizedKeys = append(entry.AuthorizedKeys, importKeys(filename, name)...)
+	}
+	// Like OpenSSH, the user is served the chroot directory or otherwise the home directory.
+	var served SFTPEntry
+	if chroot := options["chrootdirectory"]; len(chroot) > 0 && chroot[0] != "none" {
+		root, err := expandSshdPath(chroot[0], name, account)
+		if err != nil {
+			ErrPrintf("Warning: cannot import the ChrootDirectory of %s: %v\n", name, err)
+		}
+		served.Root = root
+		entry.Chroot = err == nil && account != nil
+	} else if account != nil {
+		served.Root = account.HomeDir
+	} else {
+		ErrPrintf("Warning: %s does not exist on this machine, set the Root of its directory\n", name)
+	}
+	if command := options["forcecommand"]; len(command) > 0 {
+		if command[0] == "internal-sftp" {
+			applySftpServerArgs(command[1:], name, &entry, &served)
+		} else {
+			ErrPrintf("Warning: the ForceCommand %q of %s is not imported\n", strings.Join(command, " "), name)
+		}
+	} else if subsystem := options["subsystem"]; len(subsystem) > 1 && subsystem[0] == "sftp" {
+		applySftpServerArgs(subsystem[2:], name, &entry, &served)
+	}
+	entry.Filesystem = map[string]SFTPEntry{"": served}
+	if account != nil {
+		// Like with OpenSSH, the files are accessed as the user.
+		entry.RunAs = name
+	}
+	if methods := options["authenticationmethods"]; methods != nil {
+		entry.AuthenticationMethods = importAuthenticationMethods(methods, name)
+		for _, chain := range entry.AuthenticationMethods {
+			if strings.Contains(chain, "password") {
+				ErrPrintf("Warning: %s needs a password, set its PasswordHash\n", name)
+				break
+			}
+		}
+	}
+	// Unlike sshd, sshtool allows none of these by default.
+	entry.AllowAgentForwarding = sshdYes(options, "allowagentforwarding")
+	entry.AllowPty = sshdYes(options, "permittty")
+	entry.AllowX11Forwarding = sshdYes(options, "x11forwarding")
+	return entry
+}
+
+// Returns whether the yes/no option is set to yes.
+func sshdYes(options map[string][]string, keyword string) bool {
+	args := options[keyword]
+	return len(args) > 0 && strings.ToLower(args[0]) == "yes"
+}
+
+// Prints the users generated from authorized_keys files and an sshd_config in the format of the UsersFile.
+func mainImport(args []string) {
+	if len(args) < 2 {
+		ErrPrintf("Wrong arguments: %s [sshd_config=/etc/ssh/sshd_config] user[=authorized_keys]...\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Prints sftp users for the given OpenSSH users in the format of the UsersFile.\n")
+		ErrPrintf("Without a file, the keys are read from the AuthorizedKeysFile of the sshd_config.\n")
+		ErrPrintf("The Match blocks of the sshd_config for the users are applied.\n")
+		return
+	}
+	var blocks []sshdBlock
+	users := usersFile{Users: map[string]UserEntry{}}
+	var names, keysFiles []string
+	for _, arg := range args[1:] {
+		if filename, ok := strings.CutPrefix(arg, "sshd_config="); ok {
+			data, err := os.ReadFile(filename)
+			fatal(err)
+			blocks, err = parseSshdConfig(data)
+			if err != nil {
+				fatal(fmt.Errorf("invalid sshd_config %s: %v", filename, err))
+			}
+			continue
+		}
+		name, keysFile, _ := strings.Cut(arg, "=")
+		names = append(names, name)
+		keysFiles = append(keysFiles, keysFile)
+	}
+	for i, name := range names {
+		users.Users[name] = importUser(name, keysFiles[i], blocks)
+	}
+	fatal(toml.NewEncoder(os.Stdout).Encode(&users))
+}
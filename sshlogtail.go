@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+const logtailHelp = "Follow the log of a running sftp server through its admin api"
+
+// Creates a client for the admin api at the given address (see admin.Listen) and returns it along with the url
+// of the api.
+func adminClient(address string) (*http.Client, string) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+		// The host is ignored by the transport.
+		return &http.Client{Transport: transport}, "http://admin/api"
+	}
+	return &http.Client{}, "http://" + address + "/api"
+}
+
+// Prints the entries of the log stream of the response until it ends.
+func printLogStream(response *http.Response) error {
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e logger.StreamEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		if e.Username != "" {
+			fmt.Printf("%s [%s] %s %s - %s\n", e.Time.Local(), e.Level, e.Tag, e.Username, e.Message)
+		} else {
+			fmt.Printf("%s [%s] %s - %s\n", e.Time.Local(), e.Level, e.Tag, e.Message)
+		}
+	}
+	return scanner.Err()
+}
+
+// Follows the log of the sftp server with the given config.
+func mainLogtail(args []string) {
+	if len(args) < 2 {
+		ErrPrintf("Wrong arguments: %s configfile [user=name] [tag=tag] [level=level]...\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Connects to the AdminAddress of the sftp config and prints its log until the server stops.\n")
+		ErrPrintf("Filters of the same kind can be given several times (e.g. level=warn level=error).\n")
+		ErrPrintf("The levels are debug, info, warn, error and access.\n")
+		return
+	}
+	c, err := LoadConfigSftp(args[1])
+	fatal(err)
+	if c.AdminAddress == "" {
+		fatal(fmt.Errorf("the config has no AdminAddress"))
+	}
+	query := url.Values{}
+	for _, filter := range args[2:] {
+		key, value, ok := strings.Cut(filter, "=")
+		if !ok || (key != "user" && key != "tag" && key != "level") {
+			fatal(fmt.Errorf("invalid filter %q", filter))
+		}
+		query.Add(key, value)
+	}
+	client, api := adminClient(c.AdminAddress)
+	request, err := http.NewRequest(http.MethodGet, api+"/logs?"+query.Encode(), nil)
+	fatal(err)
+	request.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	response, err := client.Do(request)
+	fatal(err)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		fatal(fmt.Errorf("the admin api answered with %s", response.Status))
+	}
+	fatal(printLogStream(response))
+}
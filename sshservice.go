@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// The servers that can be run in the background by their command. They serve the given config file until the
+// context is canceled.
+var backgroundServers = map[string]func(ctx context.Context, configFile string) error{
+	"sftp": func(ctx context.Context, configFile string) error {
+		c, err := LoadConfigSftp(configFile)
+		if err != nil {
+			return err
+		}
+		server := c.MakeContext()
+		server.Listen(ctx)
+		return nil
+	},
+	"cmd": func(ctx context.Context, configFile string) error {
+		c, err := LoadConfigCmd(configFile)
+		if err != nil {
+			return err
+		}
+		server := c.MakeContextCmd()
+		server.Listen(ctx)
+		return nil
+	},
+}
+
+// Returns the server of the command or an error if the command cannot be run in the background.
+func backgroundServer(command string) (func(ctx context.Context, configFile string) error, error) {
+	server, ok := backgroundServers[command]
+	if !ok {
+		var commands []string
+		for name := range backgroundServers {
+			commands = append(commands, name)
+		}
+		sort.Strings(commands)
+		return nil, fmt.Errorf("cannot run %q in the background, only %v", command, commands)
+	}
+	return server, nil
+}
+
+// reloadOnHangup calls reload whenever the process receives SIGHUP until the context is canceled. There is no
+// SIGHUP on Windows, so a service has to be restarted there instead.
+func reloadOnHangup(ctx context.Context, reload func()) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangups:
+				reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,180 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const daemonHelp = "Run the sftp or cmd server as a background daemon with a pid file"
+
+// The environment variable telling the started process that it is the daemon.
+const daemonEnv = "SSHTOOL_DAEMON"
+
+// If the daemon exits within this time after its start, it is reported as failed (e.g. due to an invalid config).
+const daemonStartupTime = 2 * time.Second
+
+func init() {
+	CMDS["daemon"] = cmd{mainDaemon, daemonHelp}
+}
+
+// daemonOptions are the arguments of the daemon command.
+type daemonOptions struct {
+	// The file the pid of the daemon is written to. Empty for none.
+	pidFile string
+	// The file the output of the daemon is appended to. Empty for discarding it.
+	logFile string
+	// The server to run and its config.
+	command    string
+	configFile string
+}
+
+// Parses the arguments of the daemon command. Paths are made absolute, the daemon does not depend on them being
+// relative to the working directory.
+func parseDaemonArgs(args []string) (daemonOptions, error) {
+	var options daemonOptions
+	var rest []string
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "pidfile="); ok {
+			options.pidFile = value
+		} else if value, ok := strings.CutPrefix(arg, "log="); ok {
+			options.logFile = value
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) != 2 {
+		return options, fmt.Errorf("expected a command and a config file")
+	}
+	options.command, options.configFile = rest[0], rest[1]
+	for _, path := range []*string{&options.pidFile, &options.logFile, &options.configFile} {
+		if *path == "" {
+			continue
+		}
+		absolute, err := filepath.Abs(*path)
+		if err != nil {
+			return options, err
+		}
+		*path = absolute
+	}
+	return options, nil
+}
+
+// Returns the pid of the running process written to the pid file, or 0 if there is none.
+func runningPid(pidFile string) int {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	// Signal 0 only checks whether the process exists.
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0
+	}
+	return pid
+}
+
+// startDaemon starts this program again as daemon in a new session, detached from the terminal. It waits for a
+// moment, so a daemon failing right at its start is reported.
+func startDaemon(options daemonOptions) error {
+	if options.pidFile != "" {
+		if pid := runningPid(options.pidFile); pid != 0 {
+			return fmt.Errorf("the daemon of %s is already running with pid %d", options.pidFile, pid)
+		}
+	}
+	if _, err := backgroundServer(options.command); err != nil {
+		return err
+	}
+	if _, err := os.Stat(options.configFile); err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	output, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if options.logFile != "" {
+		output, err = os.OpenFile(options.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = output.Close() }()
+	daemon := exec.Command(executable, os.Args[1:]...)
+	daemon.Env = append(os.Environ(), daemonEnv+"=1")
+	daemon.Stdout = output
+	daemon.Stderr = output
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := daemon.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- daemon.Wait() }()
+	select {
+	case err := <-exited:
+		if options.logFile != "" {
+			return fmt.Errorf("the daemon has exited (%v), see %s", err, options.logFile)
+		}
+		return fmt.Errorf("the daemon has exited (%v)", err)
+	case <-time.After(daemonStartupTime):
+	}
+	fmt.Printf("Started the daemon with pid %d\n", daemon.Process.Pid)
+	return nil
+}
+
+// runDaemon serves the server of the daemon until it receives SIGTERM or SIGINT. The pid file exists as long as
+// the daemon runs.
+func runDaemon(options daemonOptions) error {
+	server, err := backgroundServer(options.command)
+	if err != nil {
+		return err
+	}
+	// The daemon has no terminal it could lose. Once the server is listening, SIGHUP reloads its config.
+	signal.Ignore(syscall.SIGHUP)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if options.pidFile != "" {
+		pid := strconv.Itoa(os.Getpid())
+		if err := os.WriteFile(options.pidFile, []byte(pid+"\n"), 0644); err != nil {
+			return err
+		}
+		defer func() {
+			// Another daemon may have taken over the file in the meantime.
+			if data, err := os.ReadFile(options.pidFile); err == nil && strings.TrimSpace(string(data)) == pid {
+				_ = os.Remove(options.pidFile)
+			}
+		}()
+	}
+	return server(ctx, options.configFile)
+}
+
+func mainDaemon(args []string) {
+	options, err := parseDaemonArgs(args[1:])
+	if err != nil {
+		ErrPrintf("%v\n", err)
+		ErrPrintf("Usage: %s [pidfile=path] [log=path] sftp|cmd configfile\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Starts the server in the background. Its output is appended to the log file, and its pid\n")
+		ErrPrintf("is written to the pid file until it is stopped with SIGTERM.\n")
+		os.Exit(-1)
+	}
+	if os.Getenv(daemonEnv) == "" {
+		fatal(startDaemon(options))
+		return
+	}
+	_ = os.Unsetenv(daemonEnv)
+	fatal(runDaemon(options))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceHelp = "Install, start, stop or remove the sftp or cmd server as Windows service"
+
+// How long a stopping service waits for its server.
+const serviceStopTimeout = 10 * time.Second
+
+func init() {
+	CMDS["service"] = cmd{mainService, serviceHelp}
+}
+
+// installService registers a service running the server of the command with the config file. Its output is
+// written to the event log under the name of the service.
+func installService(name string, command string, configFile string) error {
+	if _, err := backgroundServer(command); err != nil {
+		return err
+	}
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = manager.Disconnect() }()
+	config := mgr.Config{DisplayName: "sshtool " + name, Description: fmt.Sprintf("sshtool %s serving %s", command, configFile), StartType: mgr.StartAutomatic}
+	service, err := manager.CreateService(name, executable, config, "service", "run", name, command, configFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = service.Close() }()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = service.Delete()
+		return err
+	}
+	return nil
+}
+
+// removeService stops and removes the service along with its event log source.
+func removeService(name string) error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = manager.Disconnect() }()
+	service, err := manager.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = service.Close() }()
+	// The service may not be running.
+	_, _ = service.Control(svc.Stop)
+	if err := service.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(name)
+}
+
+// controlService starts or stops the service.
+func controlService(name string, start bool) error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = manager.Disconnect() }()
+	service, err := manager.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = service.Close() }()
+	if start {
+		return service.Start()
+	}
+	_, err = service.Control(svc.Stop)
+	return err
+}
+
+// windowsService runs a server as Windows service.
+type windowsService struct {
+	name       string
+	server     func(ctx context.Context, configFile string) error
+	configFile string
+}
+
+// Writes every line of the reader to the event log. Lines of errors (like "[E]" of the logger) are logged as
+// errors.
+func logToEventLog(reader io.Reader, events *eventlog.Log) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, "[E]"):
+			_ = events.Error(1, line)
+		case strings.Contains(line, "[W]"):
+			_ = events.Warning(1, line)
+		default:
+			_ = events.Info(1, line)
+		}
+	}
+}
+
+// Execute serves the server until the service is stopped.
+func (w windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	events, err := eventlog.Open(w.name)
+	if err != nil {
+		return true, 1
+	}
+	defer func() { _ = events.Close() }()
+	// A service has no console, so everything written to stdout and stderr goes to the event log.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		_ = events.Error(1, err.Error())
+		return true, 1
+	}
+	os.Stdout, os.Stderr = writer, writer
+	log.SetOutput(writer)
+	go logToEventLog(reader, events)
+	// Relative paths in the config are relative to the directory of the config.
+	if err := os.Chdir(filepath.Dir(w.configFile)); err != nil {
+		_ = events.Error(1, err.Error())
+		return true, 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- w.server(ctx, w.configFile) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				_ = events.Error(1, err.Error())
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+func mainService(args []string) {
+	usage := func() {
+		ErrPrintf("Usage: %s install name sftp|cmd configfile\n", args[0])
+		ErrPrintf("       %s start|stop|remove name\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Installs the server as Windows service, which is started automatically. Its output is\n")
+		ErrPrintf("written to the event log. Relative paths in the config are relative to its directory.\n")
+		os.Exit(-1)
+	}
+	if len(args) < 3 {
+		usage()
+	}
+	name := args[2]
+	switch {
+	case args[1] == "install" && len(args) == 5:
+		fatal(installService(name, args[3], args[4]))
+		fmt.Printf("Installed the service %s\n", name)
+	case args[1] == "start" && len(args) == 3:
+		fatal(controlService(name, true))
+	case args[1] == "stop" && len(args) == 3:
+		fatal(controlService(name, false))
+	case args[1] == "remove" && len(args) == 3:
+		fatal(removeService(name))
+		fmt.Printf("Removed the service %s\n", name)
+	case args[1] == "run" && len(args) == 5:
+		// Called by the service manager.
+		server, err := backgroundServer(args[3])
+		fatal(err)
+		fatal(svc.Run(name, windowsService{name: name, server: server, configFile: args[4]}))
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+	sftp2 "github.com/Entscheider/sshtool/sftp"
+	gosftp "github.com/pkg/sftp"
+)
+
+const sshsynchelp = "Mirror a local directory to or from a remote sftp server"
+
+// ConfigSync describes a directory that is mirrored between this machine and a remote sftp server.
+type ConfigSync struct {
+	// The remote server. Its User must be set.
+	Remote UpstreamConfig
+	// The outbound proxy the remote server is connected through.
+	Proxy ProxyConfig
+	// The directory on the remote server.
+	RemoteDir string
+	// The directory on this machine.
+	LocalDir string
+	// Either "push" to copy the local directory to the server or "pull" for the other way.
+	Direction string
+	// How to decide whether a file has changed: "size" compares the size and modification time,
+	// "checksum" the sha256 checksum of the content.
+	Compare string
+	// Regular expressions for the paths (relative to the directory, e.g. "\.pdf$") of files to mirror.
+	// If empty, all files are mirrored.
+	Include []string
+	// Regular expressions for the paths of files and directories not to mirror.
+	Exclude []string
+	// Whether to remove files and directories of the destination that do not exist in the source.
+	Delete bool
+	// Whether to only print what would be done.
+	DryRun bool
+}
+
+// DefaultSyncConfig creates a ConfigSync with some default parameters.
+func DefaultSyncConfig() ConfigSync {
+	return ConfigSync{
+		Remote:    UpstreamConfig{Address: "files.example.com:22", User: "user", PrivateKeyFile: "id_ed25519", HostKey: "ssh-ed25519 AAAA..."},
+		RemoteDir: "/backup",
+		LocalDir:  "/srv/data",
+		Direction: "push",
+		Compare:   "size",
+		Include:   []string{},
+		Exclude:   []string{},
+	}
+}
+
+// LoadConfigSync parses the ConfigSync from a toml file with the given filename.
+func LoadConfigSync(filename string) (ConfigSync, error) {
+	var c ConfigSync
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return c, err
+	}
+	if err := toml.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+// validate checks the config for values that are not supported.
+func (c *ConfigSync) validate() error {
+	if err := c.Remote.validate(); err != nil {
+		return err
+	}
+	if c.Remote.User == "" {
+		return fmt.Errorf("the Remote needs a User")
+	}
+	if err := c.Proxy.validate(); err != nil {
+		return err
+	}
+	if c.Direction != "push" && c.Direction != "pull" {
+		return fmt.Errorf("unknown Direction %q", c.Direction)
+	}
+	if c.Compare != "size" && c.Compare != "checksum" {
+		return fmt.Errorf("unknown Compare %q", c.Compare)
+	}
+	if _, err := intoRegexp(c.Include); err != nil {
+		return fmt.Errorf("invalid Include: %v", err)
+	}
+	if _, err := intoRegexp(c.Exclude); err != nil {
+		return fmt.Errorf("invalid Exclude: %v", err)
+	}
+	return nil
+}
+
+// syncer mirrors the content of one [sftp2.SimplifiedFS] to another.
+type syncer struct {
+	config  *ConfigSync
+	src     sftp2.SimplifiedFS
+	dst     sftp2.SimplifiedFS
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	// The number of failed operations.
+	failed int
+}
+
+// Whether the file or directory with the given path is mirrored.
+func (s *syncer) selected(p string, dir bool) bool {
+	for _, rexp := range s.exclude {
+		if rexp.MatchString(p) {
+			return false
+		}
+	}
+	if dir || len(s.include) == 0 {
+		return true
+	}
+	for _, rexp := range s.include {
+		if rexp.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints the failed operation and counts it.
+func (s *syncer) fail(action string, p string, err error) {
+	ErrPrintf("Cannot %s %s: %v\n", action, p, err)
+	s.failed++
+}
+
+// Returns the sha256 checksum of the file.
+func checksum(fs sftp2.SimplifiedFS, p string) ([]byte, error) {
+	reader, err := fs.Read(p)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(reader, 0, 1<<62)); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// Whether the file of the destination differs from the one of the source.
+func (s *syncer) changed(p string, info os.FileInfo) (bool, error) {
+	existing, err := s.dst.Stat(p)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing.IsDir() || existing.Size() != info.Size() {
+		return true, nil
+	}
+	if s.config.Compare == "size" {
+		// Not every server keeps fractions of seconds.
+		return existing.ModTime().Unix() != info.ModTime().Unix(), nil
+	}
+	srcSum, err := checksum(s.src, p)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := checksum(s.dst, p)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(srcSum, dstSum), nil
+}
+
+// Copies the file from the source to the destination and takes over its modification time.
+func (s *syncer) copy(p string, info os.FileInfo) error {
+	reader, err := s.src.Read(p)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	writer, err := s.dst.Write(p)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(writer, 0), io.NewSectionReader(reader, 0, 1<<62))
+	if closer, ok := writer.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// The file is not truncated when it is opened.
+	attributes := &gosftp.FileStat{
+		Size:  uint64(info.Size()),
+		Atime: uint32(info.ModTime().Unix()),
+		Mtime: uint32(info.ModTime().Unix()),
+	}
+	return s.dst.SetStat(p, gosftp.FileAttrFlags{Size: true, Acmodtime: true}, attributes)
+}
+
+// Mirrors the source to the destination.
+func (s *syncer) run() error {
+	wanted := make(map[string]bool)
+	err := walkFS(s.src, "/", func(p string, info os.FileInfo) {
+		if !s.selected(p, info.IsDir()) {
+			return
+		}
+		wanted[p] = true
+		if info.IsDir() {
+			existing, err := s.dst.Stat(p)
+			if err == nil && existing.IsDir() {
+				return
+			}
+			fmt.Printf("mkdir %s\n", p)
+			if !s.config.DryRun {
+				if err := mkdirAll(s.dst, p); err != nil {
+					s.fail("create", p, err)
+				}
+			}
+			return
+		}
+		if !info.Mode().IsRegular() {
+			return
+		}
+		changed, err := s.changed(p, info)
+		if err != nil {
+			s.fail("compare", p, err)
+			return
+		}
+		if !changed {
+			return
+		}
+		fmt.Printf("copy %s\n", p)
+		if s.config.DryRun {
+			return
+		}
+		// The files are visited before their directory.
+		if err := mkdirAll(s.dst, path.Dir(p)); err != nil {
+			s.fail("create", path.Dir(p), err)
+			return
+		}
+		if err := s.copy(p, info); err != nil {
+			s.fail("copy", p, err)
+		}
+	})
+	if err != nil || !s.config.Delete {
+		return err
+	}
+	// The directories that still contain something after deleting.
+	kept := make(map[string]bool)
+	keep := func(p string) {
+		for dir := path.Dir(p); dir != "/" && !kept[dir]; dir = path.Dir(dir) {
+			kept[dir] = true
+		}
+	}
+	return walkFS(s.dst, "/", func(p string, info os.FileInfo) {
+		// Excluded files are kept.
+		if wanted[p] || kept[p] || !s.selected(p, info.IsDir()) {
+			keep(p)
+			return
+		}
+		fmt.Printf("delete %s\n", p)
+		if s.config.DryRun {
+			return
+		}
+		remove := s.dst.Rm
+		if info.IsDir() {
+			remove = s.dst.Rmdir
+		}
+		if err := remove(p); err != nil {
+			s.fail("delete", p, err)
+			keep(p)
+		}
+	})
+}
+
+// Creates the directory along with all missing parents.
+func mkdirAll(fs sftp2.SimplifiedFS, p string) error {
+	if p == "/" {
+		return nil
+	}
+	if info, err := fs.Stat(p); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", p)
+		}
+		return nil
+	}
+	if err := mkdirAll(fs, path.Dir(p)); err != nil {
+		return err
+	}
+	return fs.Mkdir(p)
+}
+
+// Mirrors a directory between this machine and a remote sftp server.
+func mainSync(args []string) {
+	if len(args) != 2 {
+		ErrPrintf("Wrong arguments: %s configfile\n", args[0])
+		ErrPrintf("\n")
+		ErrPrintf("Config file will be created if does not exists\n")
+		return
+	}
+	if _, err := os.Stat(args[1]); os.IsNotExist(err) {
+		c := DefaultSyncConfig()
+		file, err := os.OpenFile(args[1], os.O_CREATE|os.O_WRONLY, 0600)
+		fatal(err)
+		err = toml.NewEncoder(file).Encode(&c)
+		_ = file.Close()
+		fatal(err)
+		fmt.Printf("Created default config to %s\n", args[1])
+		os.Exit(-1)
+	}
+	c, err := LoadConfigSync(args[1])
+	fatal(err)
+	local := sftp2.DirFs{Root: c.LocalDir}
+	remote := sftp2.NewRemoteFS(c.Remote.dialer(c.Remote.User, c.Proxy), c.RemoteDir, false, c.Remote.poolOptions())
+	s := &syncer{config: &c, src: local, dst: remote}
+	if c.Direction == "pull" {
+		s.src, s.dst = remote, local
+	}
+	// The config has been validated before, so we can ignore the errors here.
+	s.include, _ = intoRegexp(c.Include)
+	s.exclude, _ = intoRegexp(c.Exclude)
+	fatal(s.run())
+	if s.failed > 0 {
+		ErrPrintf("%d operations failed\n", s.failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Escapes a label value for the prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// A metric of every session
+type sessionMetric struct {
+	name   string
+	help   string
+	kind   string
+	getter func(s SessionSnapshot) string
+}
+
+// A metric of every cache
+type cacheMetric struct {
+	name   string
+	help   string
+	kind   string
+	getter func(u CacheUsage) string
+}
+
+var cacheMetrics = []cacheMetric{
+	{"sshtool_cache_bytes", "Bytes currently kept by the cache.", "gauge",
+		func(u CacheUsage) string { return strconv.FormatInt(u.Bytes, 10) }},
+	{"sshtool_cache_max_bytes", "Bytes the cache may keep at most.", "gauge",
+		func(u CacheUsage) string { return strconv.FormatInt(u.MaxBytes, 10) }},
+	{"sshtool_cache_blocks", "Blocks currently kept by the cache.", "gauge",
+		func(u CacheUsage) string { return strconv.FormatInt(u.Blocks, 10) }},
+	{"sshtool_cache_hits_total", "Reads answered from the cache.", "counter",
+		func(u CacheUsage) string { return strconv.FormatUint(u.Hits, 10) }},
+	{"sshtool_cache_misses_total", "Reads that were not answered from the cache.", "counter",
+		func(u CacheUsage) string { return strconv.FormatUint(u.Misses, 10) }},
+	{"sshtool_cache_evictions_total", "Blocks dropped for more recently read ones.", "counter",
+		func(u CacheUsage) string { return strconv.FormatUint(u.Evictions, 10) }},
+}
+
+// A metric of every directory kept in memory
+type memoryMetric struct {
+	name   string
+	help   string
+	kind   string
+	getter func(u MemoryUsage) string
+}
+
+var memoryMetrics = []memoryMetric{
+	{"sshtool_memory_fs_bytes", "Bytes currently kept by the directory in memory.", "gauge",
+		func(u MemoryUsage) string { return strconv.FormatInt(u.Bytes, 10) }},
+	{"sshtool_memory_fs_max_bytes", "Bytes the directory in memory may keep at most.", "gauge",
+		func(u MemoryUsage) string { return strconv.FormatInt(u.MaxBytes, 10) }},
+	{"sshtool_memory_fs_entries", "Files, directories and links of the directory in memory.", "gauge",
+		func(u MemoryUsage) string { return strconv.FormatInt(u.Entries, 10) }},
+	{"sshtool_memory_fs_rejected_total", "Changes rejected for exceeding the memory of the directory.", "counter",
+		func(u MemoryUsage) string { return strconv.FormatUint(u.Rejected, 10) }},
+}
+
+var sessionMetrics = []sessionMetric{
+	{"sshtool_session_read_bytes_total", "Bytes read by the session.", "counter",
+		func(s SessionSnapshot) string { return strconv.FormatInt(s.BytesRead, 10) }},
+	{"sshtool_session_written_bytes_total", "Bytes written by the session.", "counter",
+		func(s SessionSnapshot) string { return strconv.FormatInt(s.BytesWritten, 10) }},
+	{"sshtool_session_read_bytes_per_second", "Current read rate of the session.", "gauge",
+		func(s SessionSnapshot) string { return strconv.FormatFloat(s.ReadRate, 'f', 0, 64) }},
+	{"sshtool_session_written_bytes_per_second", "Current write rate of the session.", "gauge",
+		func(s SessionSnapshot) string { return strconv.FormatFloat(s.WriteRate, 'f', 0, 64) }},
+	{"sshtool_session_open_handles", "Currently open files of the session.", "gauge",
+		func(s SessionSnapshot) string { return strconv.FormatInt(s.OpenHandles, 10) }},
+	{"sshtool_session_connection_channels", "Open channels of the ssh connection of the session.", "gauge",
+		func(s SessionSnapshot) string { return strconv.Itoa(s.Channels) }},
+}
+
+// WriteMetrics writes the statistics of all sessions in the prometheus text format to the given writer.
+func (r *Registry) WriteMetrics(writer io.Writer) error {
+	sessions := r.Sessions()
+	if _, err := fmt.Fprintf(writer, "# HELP sshtool_sessions Number of active sessions.\n# TYPE sshtool_sessions gauge\nsshtool_sessions %d\n", len(sessions)); err != nil {
+		return err
+	}
+	for _, metric := range sessionMetrics {
+		if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			_, err := fmt.Fprintf(writer, "%s{session=\"%d\",user=\"%s\",ip=\"%s\",protocol=\"%s\"} %s\n",
+				metric.name, session.ID, escapeLabel(session.Username), escapeLabel(session.IP),
+				escapeLabel(session.Protocol), metric.getter(session))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	backends := r.Backends()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := fmt.Fprintf(writer, "# HELP sshtool_backend_down Whether the backend is unavailable.\n# TYPE sshtool_backend_down gauge\n"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		down := 0
+		if backends[name] {
+			down = 1
+		}
+		if _, err := fmt.Fprintf(writer, "sshtool_backend_down{backend=\"%s\"} %d\n", escapeLabel(name), down); err != nil {
+			return err
+		}
+	}
+	logs := r.DroppedLogEntries()
+	names = names[:0]
+	for name := range logs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := fmt.Fprintf(writer, "# HELP sshtool_log_dropped_entries_total Entries dropped because the log could not keep up.\n# TYPE sshtool_log_dropped_entries_total counter\n"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(writer, "sshtool_log_dropped_entries_total{log=\"%s\"} %d\n", escapeLabel(name), logs[name]); err != nil {
+			return err
+		}
+	}
+	caches := r.Caches()
+	names = names[:0]
+	for name := range caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, metric := range cacheMetrics {
+		if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintf(writer, "%s{cache=\"%s\"} %s\n", metric.name, escapeLabel(name), metric.getter(caches[name])); err != nil {
+				return err
+			}
+		}
+	}
+	memories := r.Memories()
+	names = names[:0]
+	for name := range memories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, metric := range memoryMetrics {
+		if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintf(writer, "%s{directory=\"%s\"} %s\n", metric.name, escapeLabel(name), metric.getter(memories[name])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler creates a [http.Handler] that serves the statistics in the prometheus text format under /metrics
+// and as json under /sessions. The availability of the backends is served as json under /backends.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = r.WriteMetrics(w)
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.Sessions())
+	})
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.Backends())
+	})
+	return mux
+}
@@ -0,0 +1,342 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Entscheider/sshtool/logger"
+)
+
+// How often the transfer rates of all sessions are computed.
+const sampleInterval = time.Second
+
+// Session collects live statistics about a single connection.
+// It implements [sftp.TransferCounter] so it can be used with a [sftp.CountingFS].
+type Session struct {
+	// The following fields must be accessed atomically. They are the first ones to be 64-bit aligned.
+	bytesRead    int64
+	bytesWritten int64
+	openHandles  int64
+
+	// A unique id of this session within its Registry.
+	ID uint64
+	// Information about the connection.
+	Info logger.ConnectionInfo
+	// The protocol of this session (e.g. sftp)
+	Protocol string
+	// The time this session has started.
+	Start time.Time
+
+	// Protects the fields below
+	mutex sync.Mutex
+	// The values of bytesRead and bytesWritten at the last sample.
+	lastRead    int64
+	lastWritten int64
+	// The transfer rates in bytes per second computed at the last sample.
+	readRate  float64
+	writeRate float64
+	// Terminates the session. May be nil.
+	kill func()
+	// Returns the number of open channels of the ssh connection of this session. May be nil.
+	channels func() int
+}
+
+func (s *Session) AddRead(n int) {
+	atomic.AddInt64(&s.bytesRead, int64(n))
+}
+
+func (s *Session) AddWritten(n int) {
+	atomic.AddInt64(&s.bytesWritten, int64(n))
+}
+
+func (s *Session) HandleOpened() {
+	atomic.AddInt64(&s.openHandles, 1)
+}
+
+func (s *Session) HandleClosed() {
+	atomic.AddInt64(&s.openHandles, -1)
+}
+
+// SetChannels sets the function returning the number of open channels of the ssh connection of this session.
+func (s *Session) SetChannels(channels func() int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.channels = channels
+}
+
+// Computes the transfer rates since the last sample that has happened the given duration ago.
+func (s *Session) sample(elapsed time.Duration) {
+	read := atomic.LoadInt64(&s.bytesRead)
+	written := atomic.LoadInt64(&s.bytesWritten)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readRate = float64(read-s.lastRead) / elapsed.Seconds()
+	s.writeRate = float64(written-s.lastWritten) / elapsed.Seconds()
+	s.lastRead = read
+	s.lastWritten = written
+}
+
+// Snapshot returns the current statistics of this session.
+func (s *Session) Snapshot() SessionSnapshot {
+	s.mutex.Lock()
+	readRate, writeRate, channels := s.readRate, s.writeRate, s.channels
+	s.mutex.Unlock()
+	openChannels := 0
+	if channels != nil {
+		openChannels = channels()
+	}
+	return SessionSnapshot{
+		ID:           s.ID,
+		Username:     s.Info.Username,
+		IP:           s.Info.IP,
+		Hostname:     s.Info.Hostname,
+		Protocol:     s.Protocol,
+		Start:        s.Start,
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+		OpenHandles:  atomic.LoadInt64(&s.openHandles),
+		ReadRate:     readRate,
+		WriteRate:    writeRate,
+		Channels:     openChannels,
+	}
+}
+
+// SessionSnapshot contains the statistics of a Session at a specific point in time.
+type SessionSnapshot struct {
+	ID       uint64
+	Username string
+	IP       string
+	// The hostname of the IP if resolved (see logger.ConnectionInfo).
+	Hostname string `json:",omitempty"`
+	Protocol string
+	Start    time.Time
+	// The number of bytes read and written since the session has started.
+	BytesRead    int64
+	BytesWritten int64
+	// The number of currently open files.
+	OpenHandles int64
+	// The current transfer rates in bytes per second.
+	ReadRate  float64
+	WriteRate float64
+	// The number of open channels (sessions and port forwards) of the ssh connection of this session.
+	Channels int
+}
+
+// Registry keeps track of all active sessions and periodically computes their transfer rates.
+type Registry struct {
+	// Protects the fields below
+	mutex    sync.Mutex
+	sessions map[uint64]*Session
+	nextID   uint64
+	// Report for every watched backend whether it is unavailable.
+	backends map[string]func() bool
+	// Report for every watched log the number of entries it has dropped.
+	logs map[string]func() uint64
+	// Report the memory usage of every watched cache.
+	caches map[string]func() CacheUsage
+	// Report the usage of every watched directory kept in memory.
+	memories map[string]func() MemoryUsage
+	// Closing this channel stops the sampling goroutine.
+	done chan struct{}
+}
+
+// NewRegistry creates a new Registry and starts computing the transfer rates of its sessions.
+func NewRegistry() *Registry {
+	r := &Registry{
+		sessions: map[uint64]*Session{},
+		nextID:   1,
+		backends: map[string]func() bool{},
+		logs:     map[string]func() uint64{},
+		caches:   map[string]func() CacheUsage{},
+		memories: map[string]func() MemoryUsage{},
+		done:     make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.mutex.Lock()
+				for _, session := range r.sessions {
+					session.sample(now.Sub(last))
+				}
+				r.mutex.Unlock()
+				last = now
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Close stops the sampling of the transfer rates.
+func (r *Registry) Close() error {
+	close(r.done)
+	return nil
+}
+
+// StartSession registers a new session for the given connection and protocol.
+// The kill function is called to terminate the session by Kill (it may be nil).
+func (r *Registry) StartSession(info logger.ConnectionInfo, protocol string, kill func()) *Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	session := &Session{
+		ID:       r.nextID,
+		Info:     info,
+		Protocol: protocol,
+		Start:    time.Now(),
+		kill:     kill,
+	}
+	r.nextID += 1
+	r.sessions[session.ID] = session
+	return session
+}
+
+// EndSession removes the given session from the registry.
+func (r *Registry) EndSession(session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, session.ID)
+}
+
+// Kill terminates the session with the given id. Returns false if there is no such session
+// or it cannot be terminated.
+func (r *Registry) Kill(id uint64) bool {
+	r.mutex.Lock()
+	session, ok := r.sessions[id]
+	r.mutex.Unlock()
+	if !ok || session.kill == nil {
+		return false
+	}
+	session.kill()
+	return true
+}
+
+// WatchBackend adds a backend (like a served directory) whose availability is reported by down.
+func (r *Registry) WatchBackend(name string, down func() bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.backends[name] = down
+}
+
+// Backends returns for every watched backend whether it is unavailable.
+func (r *Registry) Backends() map[string]bool {
+	r.mutex.Lock()
+	backends := make(map[string]func() bool, len(r.backends))
+	for name, down := range r.backends {
+		backends[name] = down
+	}
+	r.mutex.Unlock()
+	result := make(map[string]bool, len(backends))
+	for name, down := range backends {
+		result[name] = down()
+	}
+	return result
+}
+
+// WatchLog adds a log whose number of dropped entries is reported by dropped.
+func (r *Registry) WatchLog(name string, dropped func() uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.logs[name] = dropped
+}
+
+// DroppedLogEntries returns for every watched log the number of entries it has dropped.
+func (r *Registry) DroppedLogEntries() map[string]uint64 {
+	r.mutex.Lock()
+	logs := make(map[string]func() uint64, len(r.logs))
+	for name, dropped := range r.logs {
+		logs[name] = dropped
+	}
+	r.mutex.Unlock()
+	result := make(map[string]uint64, len(logs))
+	for name, dropped := range logs {
+		result[name] = dropped()
+	}
+	return result
+}
+
+// CacheUsage describes the memory used by a cache and how well it works.
+type CacheUsage struct {
+	// The bytes currently kept and the maximal number of bytes the cache may keep.
+	Bytes    int64
+	MaxBytes int64
+	// The number of entries currently kept.
+	Blocks int64
+	// The number of lookups answered from the cache, the ones that were not and the entries dropped for newer ones.
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// WatchCache adds a cache whose memory usage is reported by usage.
+func (r *Registry) WatchCache(name string, usage func() CacheUsage) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.caches[name] = usage
+}
+
+// Caches returns the memory usage of every watched cache.
+func (r *Registry) Caches() map[string]CacheUsage {
+	r.mutex.Lock()
+	caches := make(map[string]func() CacheUsage, len(r.caches))
+	for name, usage := range r.caches {
+		caches[name] = usage
+	}
+	r.mutex.Unlock()
+	result := make(map[string]CacheUsage, len(caches))
+	for name, usage := range caches {
+		result[name] = usage()
+	}
+	return result
+}
+
+// MemoryUsage describes the memory used by a directory kept in memory.
+type MemoryUsage struct {
+	// The bytes currently kept and the maximal number of bytes the directory may keep.
+	Bytes    int64
+	MaxBytes int64
+	// The number of files, directories and links.
+	Entries int64
+	// The number of changes rejected for exceeding MaxBytes.
+	Rejected uint64
+}
+
+// WatchMemory adds a directory kept in memory whose usage is reported by usage.
+func (r *Registry) WatchMemory(name string, usage func() MemoryUsage) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.memories[name] = usage
+}
+
+// Memories returns the usage of every watched directory kept in memory.
+func (r *Registry) Memories() map[string]MemoryUsage {
+	r.mutex.Lock()
+	memories := make(map[string]func() MemoryUsage, len(r.memories))
+	for name, usage := range r.memories {
+		memories[name] = usage
+	}
+	r.mutex.Unlock()
+	result := make(map[string]MemoryUsage, len(memories))
+	for name, usage := range memories {
+		result[name] = usage()
+	}
+	return result
+}
+
+// Sessions returns the statistics of all active sessions ordered by their id.
+func (r *Registry) Sessions() []SessionSnapshot {
+	r.mutex.Lock()
+	result := make([]SessionSnapshot, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		result = append(result, session.Snapshot())
+	}
+	r.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The codes of authenticator apps (RFC 6238) change every 30 seconds.
+const totpPeriod = 30
+
+// The question the client is asked for the code of its authenticator app.
+const totpPrompt = "Verification code: "
+
+// decodeTOTPSecret decodes a TOTP secret given in base32 like authenticator apps show it. Spaces and the case
+// are ignored.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("the secret must have at least 80 bits")
+	}
+	return key, nil
+}
+
+// totpCode computes the code of the given time step.
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	// The codes have six digits.
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpVerifier checks TOTP codes. Every code is only accepted once, so a code seen by someone else cannot be
+// used again.
+type totpVerifier struct {
+	// Protects lastStep
+	mutex sync.Mutex
+	// The time step of the latest accepted code by the secret.
+	lastStep map[string]int64
+}
+
+func newTOTPVerifier() *totpVerifier {
+	return &totpVerifier{lastStep: map[string]int64{}}
+}
+
+// verify checks the code against the secret. The codes of the previous and the next time step are accepted as
+// well, as clocks are never exact.
+func (v *totpVerifier) verify(secret string, code string) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return false
+	}
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / totpPeriod
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for step := now - 1; step <= now+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			if step <= v.lastStep[secret] {
+				// Already used
+				return false
+			}
+			v.lastStep[secret] = step
+			return true
+		}
+	}
+	return false
+}
+
+// askTOTP asks the client for the code of its authenticator app and checks it.
+func (v *totpVerifier) askTOTP(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, secret string) (bool, error) {
+	answers, err := client(conn.User(), "", []string{totpPrompt}, []bool{false})
+	if err != nil {
+		return false, err
+	}
+	return len(answers) == 1 && v.verify(secret, answers[0]), nil
+}
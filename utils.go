@@ -12,6 +12,8 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"strconv"
+	"strings"
 )
 
 // GenerateServerKey generates an ed25519 certificate and returns the private key as pem and
@@ -104,3 +106,88 @@ func (c *Config) getOrGenerateServerKey() ([]gssh.Signer, error) {
 	}
 	return result, nil
 }
+
+// Multiplier for the supported size suffixes. All of them are based on 1024.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"TB", 1 << 40}, {"T", 1 << 40},
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses a size like "10GB", "512K" or "100" into the number of bytes.
+// The units K(B), M(B), G(B) and T(B) are based on 1024.
+func parseByteSize(size string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := uint64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return uint64(number * float64(multiplier)), nil
+}
+
+// Parses a rate like "5MB", "5MBps" or "5MB/s" in bytes per second.
+func parseRate(param string) (uint64, error) {
+	rate, err := parseByteSize(strings.TrimSuffix(strings.TrimSuffix(param, "ps"), "/s"))
+	if err == nil && rate == 0 {
+		err = fmt.Errorf("the rate must be positive")
+	}
+	return rate, err
+}
+
+// formatByteSize formats a number of bytes like "1.5GB", using the units of parseByteSize.
+func formatByteSize(bytes uint64) string {
+	for _, unit := range sizeUnits {
+		if unit.multiplier > 1 && len(unit.suffix) == 2 && bytes >= unit.multiplier {
+			return fmt.Sprintf("%.1f%s", float64(bytes)/float64(unit.multiplier), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// parseSizeOrPercent parses either an absolute size (see parseByteSize) or a percentage like "5%".
+// Only one of the return values is not zero.
+func parseSizeOrPercent(value string) (bytes uint64, percent float64, err error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid percentage %q", value)
+		}
+		return 0, percent, nil
+	}
+	bytes, err = parseByteSize(value)
+	return bytes, 0, err
+}
+
+// checkUserCertificate checks whether the certificate has been signed by one of the given CA keys (in the
+// authorized_keys format) and is currently valid for the user of the connection, which must be one of its
+// principals. Returns nil if it is.
+func checkUserCertificate(caKeys []string, conn ssh.ConnMetadata, cert *ssh.Certificate) error {
+	// The keys have been validated before, so we can ignore the error here.
+	authorities, _ := parseAuthorizedKeys(caKeys)
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, authority := range authorities {
+				if bytes.Equal(authority.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	_, err := checker.Authenticate(conn, cert)
+	return err
+}
@@ -2,6 +2,7 @@ package webdav_fs
 
 import (
 	"context"
+	"encoding/xml"
 	"github.com/Entscheider/sshtool/logger"
 	"github.com/Entscheider/sshtool/sftp"
 	"golang.org/x/net/webdav"
@@ -9,6 +10,7 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 // CreateHandlerForFS converts a [sftp.SimplifiedFS] into a [webdav.Handler]
@@ -185,6 +187,38 @@ func (w *webdavReadFile) Write(_ []byte) (n int, err error) {
 	return 0, os.ErrPermission
 }
 
+// DeadProps reports the quota-available-bytes and quota-used-bytes properties (RFC 4331) of directories, so clients
+// can show the space left. If the space of the storage is unknown (or cannot be determined right now), the
+// properties are left out instead of failing the whole listing.
+func (w *webdavReadFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	stat, err := w.Stat()
+	if err != nil || !stat.IsDir() {
+		return nil, nil
+	}
+	space, err := sftp.SpaceOf(w.fs, w.filename)
+	if err != nil {
+		return nil, nil
+	}
+	props := make(map[xml.Name]webdav.Property)
+	for name, value := range map[string]uint64{
+		"quota-available-bytes": space.Available,
+		"quota-used-bytes":      space.Total - min(space.Available, space.Total),
+	} {
+		xmlName := xml.Name{Space: "DAV:", Local: name}
+		props[xmlName] = webdav.Property{XMLName: xmlName, InnerXML: []byte(strconv.FormatUint(value, 10))}
+	}
+	return props, nil
+}
+
+// Patch refuses every change, as the properties are computed.
+func (w *webdavReadFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	result := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		result.Props = append(result.Props, patch.Props...)
+	}
+	return []webdav.Propstat{result}, nil
+}
+
 type webdavWriteFile struct {
 	fs       sftp.SimplifiedFS
 	filename string